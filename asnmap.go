@@ -0,0 +1,72 @@
+package inetdata
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers/asnmap"
+	"io"
+)
+
+// ASNMapFormats are the input formats of LoadASNMap
+var ASNMapFormats = []string{"auto", "mrt", "pfx2as"}
+
+// ValidASNMapFormat returns true if the format name is supported
+func ValidASNMapFormat(format string) bool {
+	for i := range ASNMapFormats {
+		if ASNMapFormats[i] == format {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadASNMap builds a prefix to origin ASN table from MRT RIB dumps or
+// prefix2as files, which may be compressed. The auto format tells MRT files
+// from prefix2as files by their first record. Each file is read on its own,
+// so dumps of several collectors can be combined. The optional wrap function
+// is applied to each raw file stream, for example Progress.CountReader.
+func LoadASNMap(paths []string, format string, wrap func(io.Reader) io.Reader) (*asnmap.Table, error) {
+	t := asnmap.New()
+	for _, path := range paths {
+		if e := loadASNMapFile(t, path, format, wrap); e != nil {
+			return nil, fmt.Errorf("%s: %s", path, e)
+		}
+	}
+	return t, nil
+}
+
+func loadASNMapFile(t *asnmap.Table, path string, format string, wrap func(io.Reader) io.Reader) error {
+	fd, e := OpenPath(path)
+	if e != nil {
+		return e
+	}
+	defer fd.Close()
+
+	var raw io.Reader = fd
+	if wrap != nil {
+		raw = wrap(raw)
+	}
+
+	r, e := NewInputReader(raw, "auto")
+	if e != nil {
+		return e
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	br := bufio.NewReaderSize(r, ReaderBuffer)
+	if format == "auto" {
+		head, _ := br.Peek(asnmap.MRT_HEADER_SIZE)
+		format = "pfx2as"
+		if asnmap.IsMRT(head) {
+			format = "mrt"
+		}
+	}
+
+	if format == "mrt" {
+		_, e = asnmap.ReadMRT(br, t)
+		return e
+	}
+	return asnmap.ReadPrefix2AS(br, t)
+}
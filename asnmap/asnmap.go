@@ -0,0 +1,300 @@
+// Package asnmap maps IP addresses to the autonomous systems that originate
+// them, from open routing data instead of a licensed database. A Table is
+// built from the prefixes and origin ASNs of a BGP RIB dump (see ReadMRT) or
+// a CAIDA prefix2as file (see ReadPrefix2AS), and answers longest prefix
+// matches with a binary search over the flattened prefixes.
+package asnmap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Entry is a routed prefix and its origin ASNs, the most commonly announced
+// origin first. Prefixes announced by several origins (MOAS) and prefixes
+// originated by an AS_SET have more than one.
+type Entry struct {
+	Prefix  *net.IPNet
+	Origins []uint32
+}
+
+// OriginString returns the origins joined with underscores, the prefix2as
+// notation of multiple origins
+func (e *Entry) OriginString() string {
+	return formatOrigins(e.Origins)
+}
+
+func formatOrigins(origins []uint32) string {
+	bits := make([]string, len(origins))
+	for i, asn := range origins {
+		bits[i] = strconv.FormatUint(uint64(asn), 10)
+	}
+	return strings.Join(bits, "_")
+}
+
+// A prefix being collected, with the number of announcements of each origin
+type pending struct {
+	prefix *net.IPNet
+	counts map[uint32]int
+	order  []uint32
+}
+
+// A range of addresses whose longest matching prefix is the entry, or the
+// range of the prefix itself while the table is built
+type span struct {
+	start [16]byte
+	end   [16]byte
+	entry *Entry
+}
+
+// Table is a longest prefix match table. Prefixes are added with Add, and the
+// table is built on the first Lookup or Entries call; adding more prefixes
+// after that rebuilds it. A built table is safe for concurrent lookups.
+type Table struct {
+	pending map[string]*pending
+	entries []*Entry
+	spans   []span
+	built   bool
+}
+
+// New returns an empty table
+func New() *Table {
+	return &Table{pending: make(map[string]*pending)}
+}
+
+// Add records an announcement of a prefix by an origin AS. IPv4 prefixes may
+// be given in either form.
+func (t *Table) Add(prefix *net.IPNet, origin uint32) {
+	ones, bits := prefix.Mask.Size()
+	ip := prefix.IP.Mask(prefix.Mask)
+	if ip4 := ip.To4(); ip4 != nil && bits == 32 {
+		ip = ip4
+	}
+	n := &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)}
+
+	key := n.String()
+	p, ok := t.pending[key]
+	if !ok {
+		p = &pending{prefix: n, counts: make(map[uint32]int)}
+		t.pending[key] = p
+	}
+	if _, seen := p.counts[origin]; !seen {
+		p.order = append(p.order, origin)
+	}
+	p.counts[origin]++
+	t.built = false
+}
+
+// Len returns the number of prefixes in the table
+func (t *Table) Len() int {
+	return len(t.pending)
+}
+
+// Entries returns the prefixes of the table in address order, IPv4 first, with
+// less specific prefixes before the prefixes they contain
+func (t *Table) Entries() []*Entry {
+	t.build()
+	return t.entries
+}
+
+// Lookup returns the longest prefix that contains the address, and false if
+// no prefix does
+func (t *Table) Lookup(ip net.IP) (*Entry, bool) {
+	t.build()
+
+	a, ok := key16(ip)
+	if !ok {
+		return nil, false
+	}
+
+	i := sort.Search(len(t.spans), func(i int) bool {
+		return bytes.Compare(t.spans[i].start[:], a[:]) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(a[:], t.spans[i].end[:]) > 0 {
+		return nil, false
+	}
+	return t.spans[i].entry, true
+}
+
+// Return an address as 16 bytes, with IPv4 addresses in IPv4-mapped form
+func key16(ip net.IP) ([16]byte, bool) {
+	var a [16]byte
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return a, false
+	}
+	copy(a[:], ip16)
+	return a, true
+}
+
+// Return the first and last addresses of a prefix as 16 bytes
+func prefixRange(n *net.IPNet) ([16]byte, [16]byte) {
+	start, _ := key16(n.IP)
+	end := start
+
+	ones, bits := n.Mask.Size()
+	host := bits - ones
+	for i := 15; i >= 0 && host > 0; i-- {
+		if host >= 8 {
+			end[i] = 0xff
+			host -= 8
+		} else {
+			end[i] |= byte(1<<uint(host)) - 1
+			host = 0
+		}
+	}
+	return start, end
+}
+
+// Return the address after a, and false if a is the last address
+func next16(a [16]byte) ([16]byte, bool) {
+	for i := 15; i >= 0; i-- {
+		a[i]++
+		if a[i] != 0 {
+			return a, true
+		}
+	}
+	return a, false
+}
+
+// Return the address before a
+func prev16(a [16]byte) [16]byte {
+	for i := 15; i >= 0; i-- {
+		a[i]--
+		if a[i] != 0xff {
+			break
+		}
+	}
+	return a
+}
+
+// Flatten the nested prefixes into disjoint spans of their most specific
+// prefix. Prefixes either nest or do not overlap, so a stack of the prefixes
+// containing the current address is enough.
+func (t *Table) build() {
+	if t.built {
+		return
+	}
+
+	all := make([]span, 0, len(t.pending))
+	for _, p := range t.pending {
+		origins := append([]uint32{}, p.order...)
+		sort.SliceStable(origins, func(i, j int) bool {
+			return p.counts[origins[i]] > p.counts[origins[j]]
+		})
+		start, end := prefixRange(p.prefix)
+		all = append(all, span{start: start, end: end, entry: &Entry{Prefix: p.prefix, Origins: origins}})
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		if c := bytes.Compare(all[i].start[:], all[j].start[:]); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(all[i].end[:], all[j].end[:]) > 0
+	})
+
+	t.entries = make([]*Entry, len(all))
+	t.spans = t.spans[:0]
+
+	var pos [16]byte
+	done := false
+	stack := []span{}
+
+	// Emit the span of the top of the stack up to and including end
+	emit := func(end [16]byte) {
+		if done || bytes.Compare(pos[:], end[:]) > 0 {
+			return
+		}
+		t.spans = append(t.spans, span{start: pos, end: end, entry: stack[len(stack)-1].entry})
+		var ok bool
+		pos, ok = next16(end)
+		done = !ok
+	}
+
+	for i, r := range all {
+		t.entries[i] = r.entry
+
+		for len(stack) > 0 && bytes.Compare(stack[len(stack)-1].end[:], r.start[:]) < 0 {
+			emit(stack[len(stack)-1].end)
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) > 0 && bytes.Compare(pos[:], r.start[:]) < 0 {
+			emit(prev16(r.start))
+		}
+		pos, done = r.start, false
+		stack = append(stack, r)
+	}
+	for len(stack) > 0 {
+		emit(stack[len(stack)-1].end)
+		stack = stack[:len(stack)-1]
+	}
+
+	// IPv4-mapped addresses sort among the IPv6 addresses
+	sort.SliceStable(t.entries, func(i, j int) bool {
+		return t.entries[i].Prefix.IP.To4() != nil && t.entries[j].Prefix.IP.To4() == nil
+	})
+
+	t.built = true
+}
+
+// ReadPrefix2AS adds the prefixes of a CAIDA Routeviews prefix2as file to the
+// table. Each line is an address, a prefix length, and the origins, separated
+// by whitespace, such as "1.0.0.0 24 13335". Multiple origins are separated by
+// underscores, and the members of an AS_SET by commas. Lines with a CIDR
+// prefix followed by the origins ("1.0.0.0/24 13335") are also accepted, and
+// empty lines and # comments are skipped.
+func ReadPrefix2AS(r io.Reader, t *Table) error {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+
+		bits := strings.Fields(text)
+		cidr, origins := "", ""
+		switch {
+		case len(bits) == 2 && strings.Contains(bits[0], "/"):
+			cidr, origins = bits[0], bits[1]
+		case len(bits) == 3:
+			cidr, origins = bits[0]+"/"+bits[1], bits[2]
+		default:
+			return fmt.Errorf("line %d: expected <prefix> <length> <origins>: %q", line, text)
+		}
+
+		_, n, e := net.ParseCIDR(cidr)
+		if e != nil {
+			return fmt.Errorf("line %d: %s", line, e)
+		}
+
+		for _, asn := range strings.FieldsFunc(origins, func(c rune) bool { return c == '_' || c == ',' }) {
+			v, e := strconv.ParseUint(asn, 10, 32)
+			if e != nil {
+				return fmt.Errorf("line %d: invalid origin %q", line, asn)
+			}
+			t.Add(n, uint32(v))
+		}
+	}
+	return scanner.Err()
+}
+
+// WritePrefix2AS writes the table in the prefix2as format of ReadPrefix2AS,
+// with tab-separated fields
+func WritePrefix2AS(w io.Writer, t *Table) error {
+	bw := bufio.NewWriter(w)
+	for _, e := range t.Entries() {
+		ones, _ := e.Prefix.Mask.Size()
+		if _, err := fmt.Fprintf(bw, "%s\t%d\t%s\n", e.Prefix.IP, ones, e.OriginString()); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
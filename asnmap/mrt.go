@@ -0,0 +1,595 @@
+package asnmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// MRT record types and subtypes (RFC 6396, RFC 8050)
+const MRT_TABLE_DUMP = 12
+const MRT_TABLE_DUMP_V2 = 13
+const MRT_BGP4MP = 16
+const MRT_BGP4MP_ET = 17
+
+const TABLE_DUMP_AFI_IPV4 = 1
+const TABLE_DUMP_AFI_IPV6 = 2
+
+const TABLE_DUMP_V2_RIB_IPV4_UNICAST = 2
+const TABLE_DUMP_V2_RIB_IPV6_UNICAST = 4
+const TABLE_DUMP_V2_RIB_IPV4_UNICAST_ADDPATH = 8
+const TABLE_DUMP_V2_RIB_IPV6_UNICAST_ADDPATH = 10
+
+const BGP4MP_MESSAGE = 1
+const BGP4MP_MESSAGE_AS4 = 4
+const BGP4MP_MESSAGE_LOCAL = 6
+const BGP4MP_MESSAGE_AS4_LOCAL = 7
+const BGP4MP_MESSAGE_ADDPATH = 8
+const BGP4MP_MESSAGE_AS4_ADDPATH = 9
+const BGP4MP_MESSAGE_LOCAL_ADDPATH = 10
+const BGP4MP_MESSAGE_AS4_LOCAL_ADDPATH = 11
+
+// BGP messages, path attributes, and AS_PATH segment types
+const BGP_HEADER_SIZE = 19
+const BGP_MSG_UPDATE = 2
+const BGP_ATTR_AS_PATH = 2
+const BGP_ATTR_MP_REACH_NLRI = 14
+const BGP_ATTR_MP_UNREACH_NLRI = 15
+const BGP_ATTR_AS4_PATH = 17
+const BGP_AS_SET = 1
+const BGP_AS_SEQUENCE = 2
+
+const BGP_AFI_IPV4 = 1
+const BGP_AFI_IPV6 = 2
+const BGP_SAFI_UNICAST = 1
+
+// The size of the MRT common header
+const MRT_HEADER_SIZE = 12
+
+// The largest MRT record that is read, larger records are treated as corrupt
+const MRT_MAX_RECORD = 16 * 1024 * 1024
+
+// Record is an MRT record: the common header fields and the message
+type Record struct {
+	Timestamp uint32
+	Type      uint16
+	Subtype   uint16
+	Body      []byte
+}
+
+// Segment is a segment of an AS path, an AS_SEQUENCE or an AS_SET
+type Segment struct {
+	Type uint8
+	ASNs []uint32
+}
+
+// Route is a prefix announced with an AS path, or withdrawn, at a time. The
+// time of a RIB entry is when the route was received, and the time of an
+// update is when it was recorded.
+type Route struct {
+	Prefix    *net.IPNet
+	Path      []Segment
+	Timestamp uint32
+	Withdrawn bool
+}
+
+// Origins returns the origin of the AS path: the last ASN of a final
+// AS_SEQUENCE, or every member of a final AS_SET. Confederation segments are
+// ignored.
+func (r *Route) Origins() []uint32 {
+	var origins []uint32
+	for _, seg := range r.Path {
+		switch {
+		case seg.Type == BGP_AS_SEQUENCE && len(seg.ASNs) > 0:
+			origins = seg.ASNs[len(seg.ASNs)-1:]
+		case seg.Type == BGP_AS_SET && len(seg.ASNs) > 0:
+			origins = seg.ASNs
+		}
+	}
+	return origins
+}
+
+// OriginString returns the origins joined with underscores, like
+// Entry.OriginString
+func (r *Route) OriginString() string {
+	return formatOrigins(r.Origins())
+}
+
+// PathString returns the AS path separated by spaces, with the members of
+// sets in braces, such as "3356 174 {64512 64513}"
+func (r *Route) PathString() string {
+	bits := []string{}
+	for _, seg := range r.Path {
+		asns := make([]string, len(seg.ASNs))
+		for i, asn := range seg.ASNs {
+			asns[i] = strconv.FormatUint(uint64(asn), 10)
+		}
+		if seg.Type == BGP_AS_SEQUENCE {
+			bits = append(bits, asns...)
+		} else if len(asns) > 0 {
+			bits = append(bits, "{"+strings.Join(asns, " ")+"}")
+		}
+	}
+	return strings.Join(bits, " ")
+}
+
+// IsMRT returns true if the data starts with the header of an MRT table dump
+// or BGP4MP record
+func IsMRT(head []byte) bool {
+	if len(head) < MRT_HEADER_SIZE {
+		return false
+	}
+	switch binary.BigEndian.Uint16(head[4:6]) {
+	case MRT_TABLE_DUMP, MRT_TABLE_DUMP_V2, MRT_BGP4MP, MRT_BGP4MP_ET:
+		return true
+	}
+	return false
+}
+
+// MRTReader reads the records of an uncompressed MRT stream
+type MRTReader struct {
+	br  *bufio.Reader
+	hdr []byte
+}
+
+// NewMRTReader returns a reader of the MRT records of a stream
+func NewMRTReader(r io.Reader) *MRTReader {
+	return &MRTReader{br: bufio.NewReaderSize(r, 1024*1024), hdr: make([]byte, MRT_HEADER_SIZE)}
+}
+
+// Next returns the next record, which owns its body, or io.EOF at the end of
+// the stream
+func (m *MRTReader) Next() (*Record, error) {
+	if _, e := io.ReadFull(m.br, m.hdr); e != nil {
+		if e == io.EOF {
+			return nil, e
+		}
+		return nil, fmt.Errorf("mrt header: %s", e)
+	}
+
+	length := binary.BigEndian.Uint32(m.hdr[8:12])
+	if length > MRT_MAX_RECORD {
+		return nil, fmt.Errorf("mrt record of %d bytes is too large", length)
+	}
+
+	rec := &Record{
+		Timestamp: binary.BigEndian.Uint32(m.hdr[0:4]),
+		Type:      binary.BigEndian.Uint16(m.hdr[4:6]),
+		Subtype:   binary.BigEndian.Uint16(m.hdr[6:8]),
+		Body:      make([]byte, length),
+	}
+	if _, e := io.ReadFull(m.br, rec.Body); e != nil {
+		return nil, fmt.Errorf("mrt record: %s", e)
+	}
+	return rec, nil
+}
+
+// ReadMRT adds the unicast routes of an uncompressed MRT RIB dump, such as a
+// RouteViews rib.* or RIPE RIS bview.* file, to the table. Every RIB entry is
+// an announcement of its prefix by the origin of its AS path, so the origin
+// that most peers see comes first. Records of other types, such as the peer
+// index table and BGP4MP updates, are skipped. It returns the number of RIB
+// entries that were read.
+func ReadMRT(r io.Reader, t *Table) (int64, error) {
+	m := NewMRTReader(r)
+	var count int64 = 0
+
+	for {
+		rec, e := m.Next()
+		if e == io.EOF {
+			return count, nil
+		}
+		if e != nil {
+			return count, e
+		}
+		if rec.Type != MRT_TABLE_DUMP && rec.Type != MRT_TABLE_DUMP_V2 {
+			continue
+		}
+
+		routes, e := ParseRecord(rec)
+		if e != nil {
+			return count, e
+		}
+		for i := range routes {
+			for _, asn := range routes[i].Origins() {
+				t.Add(routes[i].Prefix, asn)
+			}
+		}
+		count += int64(len(routes))
+	}
+}
+
+// ParseRecord returns the unicast routes of a TABLE_DUMP or TABLE_DUMP_V2 RIB
+// record, or the announcements and withdrawals of a BGP4MP UPDATE message.
+// Other records have no routes.
+func ParseRecord(rec *Record) ([]Route, error) {
+	switch rec.Type {
+	case MRT_TABLE_DUMP_V2:
+		return readRIB(rec.Body, rec.Subtype)
+	case MRT_TABLE_DUMP:
+		return readTableDump(rec.Body, rec.Subtype)
+	case MRT_BGP4MP:
+		return readBGP4MP(rec.Body, rec.Subtype, rec.Timestamp)
+	case MRT_BGP4MP_ET:
+		// The extended timestamp adds microseconds before the message
+		if len(rec.Body) < 4 {
+			return nil, fmt.Errorf("truncated bgp4mp record")
+		}
+		return readBGP4MP(rec.Body[4:], rec.Subtype, rec.Timestamp)
+	}
+	return nil, nil
+}
+
+// Read a TABLE_DUMP_V2 RIB record, which holds one prefix and the routes of
+// each peer
+func readRIB(b []byte, subtype uint16) ([]Route, error) {
+	bits := 32
+	addpath := false
+	switch subtype {
+	case TABLE_DUMP_V2_RIB_IPV4_UNICAST:
+	case TABLE_DUMP_V2_RIB_IPV4_UNICAST_ADDPATH:
+		addpath = true
+	case TABLE_DUMP_V2_RIB_IPV6_UNICAST:
+		bits = 128
+	case TABLE_DUMP_V2_RIB_IPV6_UNICAST_ADDPATH:
+		bits, addpath = 128, true
+	default:
+		return nil, nil
+	}
+
+	if len(b) < 5 {
+		return nil, fmt.Errorf("truncated rib record")
+	}
+	plen := int(b[4])
+	if plen > bits {
+		return nil, fmt.Errorf("invalid prefix length %d", plen)
+	}
+	pbytes := (plen + 7) / 8
+	b = b[5:]
+	if len(b) < pbytes+2 {
+		return nil, fmt.Errorf("truncated rib record")
+	}
+
+	ip := make(net.IP, bits/8)
+	copy(ip, b[:pbytes])
+	prefix := &net.IPNet{IP: ip, Mask: net.CIDRMask(plen, bits)}
+
+	entries := int(binary.BigEndian.Uint16(b[pbytes:]))
+	b = b[pbytes+2:]
+
+	routes := make([]Route, 0, entries)
+	for i := 0; i < entries; i++ {
+		// Peer index and originated time, then the path identifier with ADD-PATH
+		skip := 6
+		if addpath {
+			skip += 4
+		}
+		if len(b) < skip+2 {
+			return routes, fmt.Errorf("truncated rib entry")
+		}
+		ts := binary.BigEndian.Uint32(b[2:6])
+		alen := int(binary.BigEndian.Uint16(b[skip:]))
+		b = b[skip+2:]
+		if len(b) < alen {
+			return routes, fmt.Errorf("truncated rib entry attributes")
+		}
+
+		// RIB entries always have 4-byte ASNs
+		attrs, e := parseAttributes(b[:alen], 4)
+		if e != nil {
+			return routes, e
+		}
+		routes = append(routes, Route{Prefix: prefix, Path: attrs.path, Timestamp: ts})
+		b = b[alen:]
+	}
+	return routes, nil
+}
+
+// Read a legacy TABLE_DUMP record, which holds one route with 2-byte ASNs
+func readTableDump(b []byte, subtype uint16) ([]Route, error) {
+	size := 4
+	switch subtype {
+	case TABLE_DUMP_AFI_IPV4:
+	case TABLE_DUMP_AFI_IPV6:
+		size = 16
+	default:
+		return nil, nil
+	}
+
+	// View, sequence, prefix, length, status, time, peer address, peer AS
+	fixed := 4 + size + 1 + 1 + 4 + size + 2
+	if len(b) < fixed+2 {
+		return nil, fmt.Errorf("truncated table dump record")
+	}
+
+	plen := int(b[4+size])
+	if plen > size*8 {
+		return nil, fmt.Errorf("invalid prefix length %d", plen)
+	}
+	ip := make(net.IP, size)
+	copy(ip, b[4:4+size])
+	prefix := &net.IPNet{IP: ip, Mask: net.CIDRMask(plen, size*8)}
+	ts := binary.BigEndian.Uint32(b[4+size+2:])
+
+	alen := int(binary.BigEndian.Uint16(b[fixed:]))
+	b = b[fixed+2:]
+	if len(b) < alen {
+		return nil, fmt.Errorf("truncated table dump attributes")
+	}
+
+	attrs, e := parseAttributes(b[:alen], 2)
+	if e != nil {
+		return nil, e
+	}
+	return []Route{{Prefix: prefix, Path: attrs.path, Timestamp: ts}}, nil
+}
+
+// Read a BGP4MP message record. Only UPDATE messages have routes.
+func readBGP4MP(b []byte, subtype uint16, ts uint32) ([]Route, error) {
+	asn_size := 2
+	addpath := false
+	switch subtype {
+	case BGP4MP_MESSAGE, BGP4MP_MESSAGE_LOCAL:
+	case BGP4MP_MESSAGE_AS4, BGP4MP_MESSAGE_AS4_LOCAL:
+		asn_size = 4
+	case BGP4MP_MESSAGE_ADDPATH, BGP4MP_MESSAGE_LOCAL_ADDPATH:
+		addpath = true
+	case BGP4MP_MESSAGE_AS4_ADDPATH, BGP4MP_MESSAGE_AS4_LOCAL_ADDPATH:
+		asn_size, addpath = 4, true
+	default:
+		return nil, nil
+	}
+
+	// Peer AS, local AS, interface index, address family, peer and local address
+	off := asn_size*2 + 2
+	if len(b) < off+2 {
+		return nil, fmt.Errorf("truncated bgp4mp record")
+	}
+	size := 4
+	if binary.BigEndian.Uint16(b[off:]) == BGP_AFI_IPV6 {
+		size = 16
+	}
+	off += 2 + size*2
+	if len(b) < off+BGP_HEADER_SIZE {
+		return nil, fmt.Errorf("truncated bgp4mp record")
+	}
+
+	// Marker, length, and type of the BGP message
+	msg := b[off:]
+	mlen := int(binary.BigEndian.Uint16(msg[16:18]))
+	if mlen < BGP_HEADER_SIZE || mlen > len(msg) {
+		return nil, fmt.Errorf("invalid bgp message length %d", mlen)
+	}
+	if msg[18] != BGP_MSG_UPDATE {
+		return nil, nil
+	}
+	return readUpdate(msg[BGP_HEADER_SIZE:mlen], asn_size, addpath, ts)
+}
+
+// Read the withdrawn routes, the path attributes, and the announced routes of
+// a BGP UPDATE message
+func readUpdate(b []byte, asn_size int, addpath bool, ts uint32) ([]Route, error) {
+	if len(b) < 2 {
+		return nil, fmt.Errorf("truncated bgp update")
+	}
+	wlen := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+wlen+2 {
+		return nil, fmt.Errorf("truncated bgp update")
+	}
+	withdrawn := b[2 : 2+wlen]
+	b = b[2+wlen:]
+
+	alen := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+alen {
+		return nil, fmt.Errorf("truncated bgp update attributes")
+	}
+	attrs, e := parseAttributes(b[2:2+alen], asn_size)
+	if e != nil {
+		return nil, e
+	}
+	announced := b[2+alen:]
+
+	routes := []Route{}
+	add := func(nlri []byte, bits int, withdraw bool) error {
+		prefixes, e := parseNLRI(nlri, bits, addpath)
+		for _, p := range prefixes {
+			r := Route{Prefix: p, Timestamp: ts, Withdrawn: withdraw}
+			if !withdraw {
+				r.Path = attrs.path
+			}
+			routes = append(routes, r)
+		}
+		return e
+	}
+
+	if e := add(withdrawn, 32, true); e != nil {
+		return routes, e
+	}
+	if e := add(announced, 32, false); e != nil {
+		return routes, e
+	}
+
+	// IPv6 and other families are carried in the multiprotocol attributes
+	if len(attrs.unreach) >= 3 && binary.BigEndian.Uint16(attrs.unreach) == BGP_AFI_IPV6 && attrs.unreach[2] == BGP_SAFI_UNICAST {
+		if e := add(attrs.unreach[3:], 128, true); e != nil {
+			return routes, e
+		}
+	}
+	if len(attrs.reach) >= 4 && binary.BigEndian.Uint16(attrs.reach) == BGP_AFI_IPV6 && attrs.reach[2] == BGP_SAFI_UNICAST {
+		// The next hop and a reserved byte precede the prefixes
+		skip := 4 + int(attrs.reach[3]) + 1
+		if len(attrs.reach) < skip {
+			return routes, fmt.Errorf("truncated mp_reach_nlri attribute")
+		}
+		if e := add(attrs.reach[skip:], 128, false); e != nil {
+			return routes, e
+		}
+	}
+	return routes, nil
+}
+
+// Return the prefixes of an NLRI field, each a length in bits and the bytes
+// of the prefix, preceded by a path identifier with ADD-PATH
+func parseNLRI(b []byte, bits int, addpath bool) ([]*net.IPNet, error) {
+	prefixes := []*net.IPNet{}
+	for len(b) > 0 {
+		if addpath {
+			if len(b) < 4 {
+				return prefixes, fmt.Errorf("truncated nlri path identifier")
+			}
+			b = b[4:]
+			if len(b) == 0 {
+				return prefixes, fmt.Errorf("truncated nlri")
+			}
+		}
+
+		plen := int(b[0])
+		if plen > bits {
+			return prefixes, fmt.Errorf("invalid prefix length %d", plen)
+		}
+		pbytes := (plen + 7) / 8
+		if len(b) < 1+pbytes {
+			return prefixes, fmt.Errorf("truncated nlri")
+		}
+
+		ip := make(net.IP, bits/8)
+		copy(ip, b[1:1+pbytes])
+		prefixes = append(prefixes, &net.IPNet{IP: ip.Mask(net.CIDRMask(plen, bits)), Mask: net.CIDRMask(plen, bits)})
+		b = b[1+pbytes:]
+	}
+	return prefixes, nil
+}
+
+// The path attributes of a route that are used
+type attributes struct {
+	path    []Segment
+	reach   []byte
+	unreach []byte
+}
+
+// Parse BGP path attributes with ASNs of the given size. With 2-byte ASNs, an
+// AS4_PATH attribute replaces the end of the AS_PATH (RFC 6793).
+func parseAttributes(b []byte, asn_size int) (attributes, error) {
+	var attrs attributes
+	var path, path4 []byte
+
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return attrs, fmt.Errorf("truncated path attribute")
+		}
+		flags, atype := b[0], b[1]
+		hlen, alen := 3, int(b[2])
+		if flags&0x10 != 0 {
+			if len(b) < 4 {
+				return attrs, fmt.Errorf("truncated path attribute")
+			}
+			hlen, alen = 4, int(binary.BigEndian.Uint16(b[2:4]))
+		}
+		if len(b) < hlen+alen {
+			return attrs, fmt.Errorf("truncated path attribute")
+		}
+
+		value := b[hlen : hlen+alen]
+		switch atype {
+		case BGP_ATTR_AS_PATH:
+			path = value
+		case BGP_ATTR_AS4_PATH:
+			path4 = value
+		case BGP_ATTR_MP_REACH_NLRI:
+			attrs.reach = value
+		case BGP_ATTR_MP_UNREACH_NLRI:
+			attrs.unreach = value
+		}
+		b = b[hlen+alen:]
+	}
+
+	segs, e := parseSegments(path, asn_size)
+	if e != nil {
+		return attrs, e
+	}
+	attrs.path = segs
+
+	if path4 != nil && asn_size == 2 {
+		segs4, e := parseSegments(path4, 4)
+		if e != nil {
+			return attrs, e
+		}
+		attrs.path = mergeAS4Path(segs, segs4)
+	}
+	return attrs, nil
+}
+
+// Parse the segments of an AS_PATH or AS4_PATH attribute
+func parseSegments(b []byte, asn_size int) ([]Segment, error) {
+	segs := []Segment{}
+
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, fmt.Errorf("truncated as path segment")
+		}
+		stype, count := b[0], int(b[1])
+		if len(b) < 2+count*asn_size {
+			return nil, fmt.Errorf("truncated as path segment")
+		}
+
+		asns := make([]uint32, count)
+		for i := range asns {
+			v := b[2+i*asn_size:]
+			if asn_size == 2 {
+				asns[i] = uint32(binary.BigEndian.Uint16(v))
+			} else {
+				asns[i] = binary.BigEndian.Uint32(v)
+			}
+		}
+		segs = append(segs, Segment{Type: stype, ASNs: asns})
+		b = b[2+count*asn_size:]
+	}
+	return segs, nil
+}
+
+// Return the length of an AS path for path selection: each ASN of a sequence
+// counts, and a set counts as one
+func pathLength(segs []Segment) int {
+	n := 0
+	for _, seg := range segs {
+		if seg.Type == BGP_AS_SEQUENCE {
+			n += len(seg.ASNs)
+		} else if seg.Type == BGP_AS_SET {
+			n++
+		}
+	}
+	return n
+}
+
+// Combine a 2-byte AS_PATH with an AS4_PATH: the leading ASNs of the AS_PATH
+// that the AS4_PATH does not cover, followed by the AS4_PATH. An AS4_PATH
+// longer than the AS_PATH is ignored.
+func mergeAS4Path(path []Segment, path4 []Segment) []Segment {
+	keep := pathLength(path) - pathLength(path4)
+	if keep < 0 {
+		return path
+	}
+
+	merged := []Segment{}
+	for _, seg := range path {
+		if keep == 0 {
+			break
+		}
+		if seg.Type == BGP_AS_SEQUENCE {
+			n := len(seg.ASNs)
+			if n > keep {
+				n = keep
+			}
+			merged = append(merged, Segment{Type: seg.Type, ASNs: seg.ASNs[:n]})
+			keep -= n
+		} else if seg.Type == BGP_AS_SET {
+			merged = append(merged, seg)
+			keep--
+		}
+	}
+	return append(merged, path4...)
+}
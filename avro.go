@@ -0,0 +1,350 @@
+package inetdata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/linkedin/goavro/v2"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var AvroCompressionTypes = []string{"null", "deflate", "snappy"}
+
+// Records are appended to container files in blocks of this many records
+const avro_block_size = 1000
+
+var avro_invalid_name = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// ValidAvroCompression returns true if the codec is a supported Avro container compression
+func ValidAvroCompression(codec string) bool {
+	for _, c := range AvroCompressionTypes {
+		if codec == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Convert a column name into a valid Avro name
+func avroName(name string) string {
+	name = avro_invalid_name.ReplaceAllString(name, "_")
+	if len(name) == 0 || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// AvroSchema generates a record schema with a string field for each column.
+// Column names are converted to valid Avro names (ex: a.b -> a_b).
+func AvroSchema(name string, columns []string) string {
+	seen := map[string]bool{}
+	fields := make([]map[string]string, len(columns))
+	for i, col := range columns {
+		n := avroName(col)
+		if seen[n] {
+			n = fmt.Sprintf("%s_%d", n, i)
+		}
+		seen[n] = true
+		fields[i] = map[string]string{"name": n, "type": "string"}
+	}
+
+	b, _ := json.Marshal(map[string]interface{}{
+		"type":   "record",
+		"name":   avroName(name),
+		"fields": fields,
+	})
+	return string(b)
+}
+
+// A field of a record schema, with a primitive type that values are converted to
+type avroField struct {
+	name     string
+	kind     string
+	nullable bool
+}
+
+var avro_primitive_types = map[string]bool{
+	"string": true, "bytes": true, "int": true, "long": true, "float": true, "double": true, "boolean": true,
+}
+
+// Parse the fields of a record schema. Fields must have a primitive type, or
+// a union of null and a primitive type.
+func avroFields(schema string) ([]avroField, error) {
+	var rec struct {
+		Type   string `json:"type"`
+		Fields []struct {
+			Name string      `json:"name"`
+			Type interface{} `json:"type"`
+		} `json:"fields"`
+	}
+	if e := json.Unmarshal([]byte(schema), &rec); e != nil {
+		return nil, fmt.Errorf("invalid avro schema: %s", e)
+	}
+	if rec.Type != "record" {
+		return nil, errors.New("invalid avro schema: expected a record")
+	}
+
+	fields := []avroField{}
+	for _, f := range rec.Fields {
+		field := avroField{name: f.Name}
+
+		t := f.Type
+		if m, ok := t.(map[string]interface{}); ok {
+			t = m["type"]
+		}
+
+		switch v := t.(type) {
+		case string:
+			field.kind = v
+		case []interface{}:
+			for _, u := range v {
+				name, _ := u.(string)
+				if name == "null" {
+					field.nullable = true
+				} else {
+					field.kind = name
+				}
+			}
+			if len(v) != 2 || !field.nullable {
+				field.kind = ""
+			}
+		}
+
+		if !avro_primitive_types[field.kind] {
+			return nil, fmt.Errorf("unsupported avro schema: field %s must have a primitive type or a union of null and a primitive type", f.Name)
+		}
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+// Convert a text value to the native value for a field
+func (f *avroField) native(val string) (interface{}, error) {
+	if f.nullable && len(val) == 0 {
+		return nil, nil
+	}
+
+	var v interface{}
+	var e error
+
+	switch f.kind {
+	case "string":
+		v = val
+	case "bytes":
+		v = []byte(val)
+	case "int":
+		var n int64
+		n, e = strconv.ParseInt(val, 10, 32)
+		v = int32(n)
+	case "long":
+		v, e = strconv.ParseInt(val, 10, 64)
+	case "float":
+		var n float64
+		n, e = strconv.ParseFloat(val, 32)
+		v = float32(n)
+	case "double":
+		v, e = strconv.ParseFloat(val, 64)
+	case "boolean":
+		v, e = strconv.ParseBool(val)
+	}
+
+	if e != nil {
+		return nil, fmt.Errorf("invalid %s value for %s: %q", f.kind, f.name, val)
+	}
+
+	if f.nullable {
+		return goavro.Union(f.kind, v), nil
+	}
+	return v, nil
+}
+
+// RecordWriter is implemented by outputs that carry discrete records rather
+// than lines, such as Kafka topics
+type RecordWriter interface {
+	WriteRecord(b []byte) error
+}
+
+// Hides the file type of an output, which the container writer would
+// otherwise try to read an existing header from
+type avroOutput struct {
+	io.Writer
+}
+
+// AvroWriter writes rows of text fields as Avro records, converting each
+// field to the type of the corresponding schema field
+type AvroWriter struct {
+	codec   *goavro.Codec
+	fields  []avroField
+	ocf     *goavro.OCFWriter
+	block   []interface{}
+	records RecordWriter
+	prefix  []byte
+	skipped int64
+}
+
+func newAvroWriter(schema string) (*AvroWriter, error) {
+	fields, e := avroFields(schema)
+	if e != nil {
+		return nil, e
+	}
+
+	codec, e := goavro.NewCodec(schema)
+	if e != nil {
+		return nil, fmt.Errorf("invalid avro schema: %s", e)
+	}
+
+	return &AvroWriter{codec: codec, fields: fields}, nil
+}
+
+// NewAvroWriter returns a writer that writes an Avro object container file,
+// with the schema embedded in its header, using the compression codec
+func NewAvroWriter(output io.Writer, schema string, compression string) (*AvroWriter, error) {
+	a, e := newAvroWriter(schema)
+	if e != nil {
+		return nil, e
+	}
+
+	a.ocf, e = goavro.NewOCFWriter(goavro.OCFConfig{W: avroOutput{output}, Codec: a.codec, CompressionName: compression})
+	if e != nil {
+		return nil, e
+	}
+	return a, nil
+}
+
+// NewAvroRegistryWriter registers the schema with a Confluent-compatible schema
+// registry under the subject, and returns a writer that sends each row as a
+// separate record in the registry wire format: a zero byte, the 4-byte schema
+// ID, and the binary encoded record.
+func NewAvroRegistryWriter(output RecordWriter, schema string, registry string, subject string) (*AvroWriter, error) {
+	a, e := newAvroWriter(schema)
+	if e != nil {
+		return nil, e
+	}
+
+	id, e := registerAvroSchema(registry, subject, a.codec.Schema())
+	if e != nil {
+		return nil, e
+	}
+
+	a.records = output
+	a.prefix = make([]byte, 5)
+	binary.BigEndian.PutUint32(a.prefix[1:], uint32(id))
+	return a, nil
+}
+
+// Register a schema, returning its ID. Registering an existing schema returns
+// the existing ID.
+func registerAvroSchema(registry string, subject string, schema string) (int, error) {
+	body, _ := json.Marshal(map[string]string{"schema": schema})
+	endpoint := strings.TrimRight(registry, "/") + "/subjects/" + url.PathEscape(subject) + "/versions"
+
+	client := &http.Client{Timeout: time.Minute}
+	resp, e := client.Post(endpoint, "application/vnd.schemaregistry.v1+json", bytes.NewReader(body))
+	if e != nil {
+		return 0, fmt.Errorf("failed to register the avro schema: %s", e)
+	}
+	defer resp.Body.Close()
+
+	res, e := ioutil.ReadAll(resp.Body)
+	if e != nil {
+		return 0, fmt.Errorf("failed to register the avro schema: %s", e)
+	}
+
+	if resp.StatusCode != 200 {
+		return 0, fmt.Errorf("failed to register the avro schema: HTTP %d: %s", resp.StatusCode, res)
+	}
+
+	var reg struct {
+		ID int `json:"id"`
+	}
+	if e := json.Unmarshal(res, &reg); e != nil {
+		return 0, fmt.Errorf("invalid schema registry response: %s", e)
+	}
+	return reg.ID, nil
+}
+
+// WriteStrings writes a row with one text value per schema field. Missing
+// trailing values are treated as empty. Rows that can not be converted to the
+// schema are reported and skipped.
+func (a *AvroWriter) WriteStrings(row []string) error {
+	rec, e := a.record(row)
+	if e != nil {
+		Log.Warnf("Avro: skipping invalid record %q: %s", strings.Join(row, ","), e)
+		atomic.AddInt64(&a.skipped, 1)
+		return nil
+	}
+
+	if a.records != nil {
+		b, e := a.codec.BinaryFromNative(append([]byte{}, a.prefix...), rec)
+		if e != nil {
+			return e
+		}
+		return a.records.WriteRecord(b)
+	}
+
+	a.block = append(a.block, rec)
+	if len(a.block) >= avro_block_size {
+		return a.flush()
+	}
+	return nil
+}
+
+func (a *AvroWriter) record(row []string) (map[string]interface{}, error) {
+	if len(row) > len(a.fields) {
+		return nil, fmt.Errorf("too many fields: %d > %d", len(row), len(a.fields))
+	}
+
+	rec := make(map[string]interface{}, len(a.fields))
+	for i := range a.fields {
+		val := ""
+		if i < len(row) {
+			val = row[i]
+		}
+
+		v, e := a.fields[i].native(val)
+		if e != nil {
+			return nil, e
+		}
+		rec[a.fields[i].name] = v
+	}
+	return rec, nil
+}
+
+// Append the buffered records to the container file as a block
+func (a *AvroWriter) flush() error {
+	if len(a.block) == 0 {
+		return nil
+	}
+	e := a.ocf.Append(a.block)
+	a.block = nil
+	return e
+}
+
+// NumFields returns the number of fields in the schema
+func (a *AvroWriter) NumFields() int {
+	return len(a.fields)
+}
+
+// Skipped returns the number of rows that could not be converted
+func (a *AvroWriter) Skipped() int64 {
+	return atomic.LoadInt64(&a.skipped)
+}
+
+// Close writes any buffered records. The output itself is not closed.
+func (a *AvroWriter) Close() error {
+	if a.ocf != nil {
+		return a.flush()
+	}
+	return nil
+}
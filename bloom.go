@@ -0,0 +1,84 @@
+package inetdata
+
+import (
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers/bloom"
+	"github.com/fathom6/inetdata-parsers/mtblfile"
+	"os"
+)
+
+// BloomFPR is the false positive rate of the Bloom filter sidecars written by
+// WriteMTBLBloom, set with -bloom. Zero disables the sidecars.
+var BloomFPR = 0.0
+
+// AddBloomFlags registers the -bloom flag of the MTBL builders
+func AddBloomFlags() {
+	flag.Float64Var(&BloomFPR, "bloom", BloomFPR, "Write a Bloom filter sidecar (<output>.bloom) of the keys with this false positive rate (ex: 0.01)")
+}
+
+// ValidBloomFPR returns true if the -bloom rate is zero or a probability
+func ValidBloomFPR(fpr float64) bool {
+	return fpr == 0 || (fpr > 0 && fpr < 1)
+}
+
+// WriteMTBLBloom writes the Bloom filter sidecar of a finished MTBL file with
+// the -bloom rate. Without -bloom, the sidecar of a previous build is removed.
+func WriteMTBLBloom(path string) error {
+	sidecar := bloom.SidecarPath(path)
+	if BloomFPR == 0 {
+		if e := os.Remove(sidecar); e != nil && !os.IsNotExist(e) {
+			return e
+		}
+		return nil
+	}
+
+	r, e := mtblfile.Open(path, false)
+	if e != nil {
+		return e
+	}
+	defer r.Close()
+
+	f, e := bloom.New(r.Metadata.CountEntries, BloomFPR)
+	if e != nil {
+		return e
+	}
+	f.TableSize = r.Size()
+	f.TableEntries = r.Metadata.CountEntries
+
+	it := r.Iter(nil)
+	for {
+		key, _, ok := it.Next()
+		if !ok {
+			break
+		}
+		f.Add(key)
+	}
+	if e := it.Err(); e != nil {
+		return e
+	}
+
+	if e := f.Save(sidecar); e != nil {
+		return fmt.Errorf("failed to write the Bloom filter: %s", e)
+	}
+	return nil
+}
+
+// LoadMTBLBloom loads the Bloom filter sidecar of a MTBL file, returning nil
+// if it has none. A sidecar built for a different version of the file would
+// hide keys, so it is ignored with a warning.
+func LoadMTBLBloom(path string, r *mtblfile.Reader) (*bloom.Filter, error) {
+	f, e := bloom.Load(bloom.SidecarPath(path))
+	if e != nil {
+		if os.IsNotExist(e) {
+			return nil, nil
+		}
+		return nil, e
+	}
+
+	if f.TableSize != r.Size() || f.TableEntries != r.Metadata.CountEntries {
+		Log.Warnf("Ignoring the Bloom filter of %s, it was built for a different version of the file", path)
+		return nil, nil
+	}
+	return f, nil
+}
@@ -0,0 +1,224 @@
+// Package bloom implements the Bloom filter sidecars of MTBL files. A sidecar
+// holds the keys of a table, so that lookups of keys that are not in the
+// table can be answered without reading it. The filter records the size and
+// entry count of the table it was built for, to detect stale sidecars.
+package bloom
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+)
+
+// The magic number at the start of a sidecar file
+const MAGIC = "MTBLBLM1"
+
+// The size in bytes of the sidecar header
+const HEADER_SIZE = 40
+
+// The extension of the sidecar of a MTBL file
+const EXTENSION = ".bloom"
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// Filter is a Bloom filter of byte string keys. Lookups are safe for
+// concurrent use, but adding keys is not.
+type Filter struct {
+	// The size and entry count of the table the filter was built for
+	TableSize    uint64
+	TableEntries uint64
+
+	bits []uint64
+	m    uint64
+	k    uint32
+}
+
+// New returns a filter sized for n keys with the false positive rate fpr
+func New(n uint64, fpr float64) (*Filter, error) {
+	if fpr <= 0 || fpr >= 1 {
+		return nil, fmt.Errorf("invalid false positive rate %v, must be between 0 and 1", fpr)
+	}
+	if n == 0 {
+		n = 1
+	}
+
+	m := uint64(math.Ceil(-float64(n) * math.Log(fpr) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) &^ 63
+	k := uint32(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	if k > 32 {
+		k = 32
+	}
+
+	return &Filter{bits: make([]uint64, m/64), m: m, k: k}, nil
+}
+
+// SidecarPath returns the path of the sidecar of a MTBL file
+func SidecarPath(path string) string {
+	return path + EXTENSION
+}
+
+// Bits returns the size of the filter in bits
+func (f *Filter) Bits() uint64 {
+	return f.m
+}
+
+// Hashes returns the number of hash functions of the filter
+func (f *Filter) Hashes() uint32 {
+	return f.k
+}
+
+// The two hashes combined into the k bit positions of a key
+func hashes(key []byte) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write(key)
+	h1 := h.Sum64()
+
+	// A splitmix64 finalizer of the first hash, made odd to cycle all bits
+	h2 := h1 + 0x9e3779b97f4a7c15
+	h2 = (h2 ^ (h2 >> 30)) * 0xbf58476d1ce4e5b9
+	h2 = (h2 ^ (h2 >> 27)) * 0x94d049bb133111eb
+	h2 = h2 ^ (h2 >> 31)
+	return h1, h2 | 1
+}
+
+// Add a key to the filter
+func (f *Filter) Add(key []byte) {
+	h1, h2 := hashes(key)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % f.m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// MayContain returns false if the key was never added to the filter, and true
+// if it probably was
+func (f *Filter) MayContain(key []byte) bool {
+	h1, h2 := hashes(key)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteTo writes the filter: the header, the bits as little-endian words, and
+// a crc32c checksum of the bits
+func (f *Filter) WriteTo(w io.Writer) (int64, error) {
+	hdr := make([]byte, 0, HEADER_SIZE)
+	hdr = append(hdr, MAGIC...)
+	hdr = binary.LittleEndian.AppendUint64(hdr, f.m)
+	hdr = binary.LittleEndian.AppendUint32(hdr, f.k)
+	hdr = binary.LittleEndian.AppendUint32(hdr, 0)
+	hdr = binary.LittleEndian.AppendUint64(hdr, f.TableSize)
+	hdr = binary.LittleEndian.AppendUint64(hdr, f.TableEntries)
+
+	bw := bufio.NewWriter(w)
+	crc := crc32.New(crc32c)
+	out := io.MultiWriter(bw, crc)
+
+	n, e := bw.Write(hdr)
+	if e != nil {
+		return int64(n), e
+	}
+	total := int64(n)
+
+	var word [8]byte
+	for _, v := range f.bits {
+		binary.LittleEndian.PutUint64(word[:], v)
+		if _, e := out.Write(word[:]); e != nil {
+			return total, e
+		}
+		total += 8
+	}
+
+	if _, e := bw.Write(binary.LittleEndian.AppendUint32(nil, crc.Sum32())); e != nil {
+		return total, e
+	}
+	return total + 4, bw.Flush()
+}
+
+// Read reads a filter written by WriteTo
+func Read(r io.Reader) (*Filter, error) {
+	br := bufio.NewReader(r)
+
+	hdr := make([]byte, HEADER_SIZE)
+	if _, e := io.ReadFull(br, hdr); e != nil {
+		return nil, fmt.Errorf("failed to read the header: %s", e)
+	}
+	if string(hdr[:8]) != MAGIC {
+		return nil, fmt.Errorf("not a Bloom filter sidecar")
+	}
+
+	f := &Filter{
+		m:            binary.LittleEndian.Uint64(hdr[8:]),
+		k:            binary.LittleEndian.Uint32(hdr[16:]),
+		TableSize:    binary.LittleEndian.Uint64(hdr[24:]),
+		TableEntries: binary.LittleEndian.Uint64(hdr[32:]),
+	}
+	if f.m == 0 || f.m%64 != 0 || f.k < 1 || f.k > 32 {
+		return nil, fmt.Errorf("invalid filter size %d with %d hashes", f.m, f.k)
+	}
+
+	f.bits = make([]uint64, f.m/64)
+	crc := crc32.New(crc32c)
+	var word [8]byte
+	for i := range f.bits {
+		if _, e := io.ReadFull(br, word[:]); e != nil {
+			return nil, fmt.Errorf("failed to read the filter: %s", e)
+		}
+		crc.Write(word[:])
+		f.bits[i] = binary.LittleEndian.Uint64(word[:])
+	}
+
+	if _, e := io.ReadFull(br, word[:4]); e != nil {
+		return nil, fmt.Errorf("failed to read the checksum: %s", e)
+	}
+	if binary.LittleEndian.Uint32(word[:4]) != crc.Sum32() {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+	return f, nil
+}
+
+// Save writes the filter to a file, replacing it atomically
+func (f *Filter) Save(path string) error {
+	tmp := path + ".tmp"
+	fd, e := os.Create(tmp)
+	if e != nil {
+		return e
+	}
+	if _, e := f.WriteTo(fd); e != nil {
+		fd.Close()
+		os.Remove(tmp)
+		return e
+	}
+	if e := fd.Close(); e != nil {
+		os.Remove(tmp)
+		return e
+	}
+	return os.Rename(tmp, path)
+}
+
+// Load reads a filter from a file
+func Load(path string) (*Filter, error) {
+	fd, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer fd.Close()
+
+	f, e := Read(fd)
+	if e != nil {
+		return nil, fmt.Errorf("%s: %s", path, e)
+	}
+	return f, nil
+}
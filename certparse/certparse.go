@@ -0,0 +1,527 @@
+// Package certparse extracts the names, validity, and keys of X.509
+// certificates that strict parsers reject, such as certificates with
+// non-minimal DER lengths, negative serial numbers, malformed times, or
+// undecodable extensions. It walks the DER structure element by element,
+// skips the parts it cannot decode, and records a problem code for each.
+package certparse
+
+import (
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// The problem codes of the parts of a certificate that could not be decoded
+const (
+	PROBLEM_SERIAL    = "serial"
+	PROBLEM_ISSUER    = "issuer"
+	PROBLEM_VALIDITY  = "validity"
+	PROBLEM_SUBJECT   = "subject"
+	PROBLEM_KEY       = "key"
+	PROBLEM_EXTENSION = "extension"
+	PROBLEM_SAN       = "san"
+)
+
+// The universal tags of the elements that are decoded
+const (
+	TAG_BOOLEAN          = 0x01
+	TAG_INTEGER          = 0x02
+	TAG_OCTET_STRING     = 0x04
+	TAG_OID              = 0x06
+	TAG_UTF8_STRING      = 0x0c
+	TAG_PRINTABLE_STRING = 0x13
+	TAG_T61_STRING       = 0x14
+	TAG_IA5_STRING       = 0x16
+	TAG_UTC_TIME         = 0x17
+	TAG_GENERALIZED_TIME = 0x18
+	TAG_UNIVERSAL_STRING = 0x1c
+	TAG_BMP_STRING       = 0x1e
+	TAG_SEQUENCE         = 0x30
+	TAG_SET              = 0x31
+)
+
+// The OIDs of the attributes and extensions that are decoded
+var (
+	OID_COMMON_NAME  = asn1.ObjectIdentifier{2, 5, 4, 3}
+	OID_ALT_NAME     = asn1.ObjectIdentifier{2, 5, 29, 17}
+	OID_EMAIL        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+	OID_ORGANIZATION = asn1.ObjectIdentifier{2, 5, 4, 10}
+)
+
+// The short names of the attributes in distinguished names
+var attributeNames = map[string]string{
+	"2.5.4.3":  "CN",
+	"2.5.4.5":  "SERIALNUMBER",
+	"2.5.4.6":  "C",
+	"2.5.4.7":  "L",
+	"2.5.4.8":  "ST",
+	"2.5.4.9":  "STREET",
+	"2.5.4.10": "O",
+	"2.5.4.11": "OU",
+	"2.5.4.17": "POSTALCODE",
+}
+
+// Attribute is a type and value of a distinguished name
+type Attribute struct {
+	Type  asn1.ObjectIdentifier
+	Value string
+}
+
+// Name is a distinguished name, as its attributes in order
+type Name []Attribute
+
+// Get returns the first value of an attribute, or an empty string
+func (n Name) Get(oid asn1.ObjectIdentifier) string {
+	for _, a := range n {
+		if a.Type.Equal(oid) {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// Values returns the values of an attribute
+func (n Name) Values(oid asn1.ObjectIdentifier) []string {
+	values := []string{}
+	for _, a := range n {
+		if a.Type.Equal(oid) {
+			values = append(values, a.Value)
+		}
+	}
+	return values
+}
+
+// String returns the name in the RFC 2253 order and format, like the String
+// method of pkix.Name
+func (n Name) String() string {
+	parts := make([]string, 0, len(n))
+	for i := len(n) - 1; i >= 0; i-- {
+		t, ok := attributeNames[n[i].Type.String()]
+		if !ok {
+			t = n[i].Type.String()
+		}
+		v := strings.NewReplacer(",", "\\,", "+", "\\+", "\"", "\\\"", ";", "\\;", "<", "\\<", ">", "\\>").Replace(n[i].Value)
+		parts = append(parts, t+"="+v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// Certificate holds the parts of a certificate that could be decoded
+type Certificate struct {
+	Raw                     []byte
+	RawTBSCertificate       []byte
+	RawSubjectPublicKeyInfo []byte
+
+	SerialNumber *big.Int
+	Issuer       Name
+	Subject      Name
+	NotBefore    time.Time
+	NotAfter     time.Time
+
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []string
+
+	// The problem codes of the parts that could not be decoded
+	Problems []string
+}
+
+// Error is a certificate whose structure could not be decoded at all
+type Error struct {
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return "malformed certificate: " + e.Msg
+}
+
+// A DER element reader that accepts non-minimal lengths
+type reader []byte
+
+// Read the next element, returning its tag, contents, and the whole element
+func (r *reader) next() (int, []byte, []byte, bool) {
+	b := *r
+	if len(b) < 2 {
+		return 0, nil, nil, false
+	}
+
+	tag := int(b[0])
+	// High tag numbers are not used by certificates
+	if tag&0x1f == 0x1f {
+		return 0, nil, nil, false
+	}
+
+	length := int(b[1])
+	hdr := 2
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		// Indefinite lengths are not DER, and 4 bytes cover any certificate
+		if n == 0 || n > 4 || len(b) < 2+n {
+			return 0, nil, nil, false
+		}
+		length = 0
+		for _, c := range b[2 : 2+n] {
+			length = length<<8 | int(c)
+		}
+		hdr += n
+	}
+	if length < 0 || len(b)-hdr < length {
+		return 0, nil, nil, false
+	}
+
+	*r = b[hdr+length:]
+	return tag, b[hdr : hdr+length], b[:hdr+length], true
+}
+
+// Read the next element if it has a tag
+func (r *reader) expect(tag int) ([]byte, []byte, bool) {
+	save := *r
+	t, body, full, ok := r.next()
+	if !ok || t != tag {
+		*r = save
+		return nil, nil, false
+	}
+	return body, full, true
+}
+
+// Return the tag of the next element, or -1 at the end
+func (r *reader) peek() int {
+	if len(*r) == 0 {
+		return -1
+	}
+	return int((*r)[0])
+}
+
+// Parse decodes a DER certificate
+func Parse(der []byte) (*Certificate, error) {
+	r := reader(der)
+	body, _, ok := r.expect(TAG_SEQUENCE)
+	if !ok {
+		return nil, &Error{"not a sequence"}
+	}
+
+	cr := reader(body)
+	tbs, tbs_raw, ok := cr.expect(TAG_SEQUENCE)
+	if !ok {
+		return nil, &Error{"no tbsCertificate"}
+	}
+
+	c, e := parseTBS(tbs)
+	if e != nil {
+		return nil, e
+	}
+	c.Raw = der[:len(der)-len(r)]
+	c.RawTBSCertificate = tbs_raw
+	return c, nil
+}
+
+// ParseTBS decodes the tbsCertificate of a precertificate
+func ParseTBS(der []byte) (*Certificate, error) {
+	r := reader(der)
+	tbs, tbs_raw, ok := r.expect(TAG_SEQUENCE)
+	if !ok {
+		return nil, &Error{"not a sequence"}
+	}
+
+	c, e := parseTBS(tbs)
+	if e != nil {
+		return nil, e
+	}
+	c.Raw = tbs_raw
+	c.RawTBSCertificate = tbs_raw
+	return c, nil
+}
+
+func (c *Certificate) problem(code string) {
+	for _, p := range c.Problems {
+		if p == code {
+			return
+		}
+	}
+	c.Problems = append(c.Problems, code)
+}
+
+func parseTBS(tbs []byte) (*Certificate, error) {
+	c := &Certificate{}
+	r := reader(tbs)
+
+	// The version is optional
+	r.expect(0xa0)
+
+	serial, _, ok := r.expect(TAG_INTEGER)
+	if ok {
+		// Negative and zero padded serials are read as unsigned
+		c.SerialNumber = new(big.Int).SetBytes(serial)
+	} else {
+		c.problem(PROBLEM_SERIAL)
+		if _, _, _, ok := r.next(); !ok {
+			return nil, &Error{"truncated before the serial number"}
+		}
+	}
+
+	// The signature algorithm
+	if _, _, _, ok := r.next(); !ok {
+		return nil, &Error{"truncated before the signature algorithm"}
+	}
+
+	issuer, _, ok := r.expect(TAG_SEQUENCE)
+	if !ok {
+		return nil, &Error{"no issuer"}
+	}
+	c.Issuer = parseName(c, issuer, PROBLEM_ISSUER)
+
+	validity, _, ok := r.expect(TAG_SEQUENCE)
+	if ok {
+		vr := reader(validity)
+		var ok1, ok2 bool
+		c.NotBefore, ok1 = parseTime(&vr)
+		c.NotAfter, ok2 = parseTime(&vr)
+		if !ok1 || !ok2 {
+			c.problem(PROBLEM_VALIDITY)
+		}
+	} else {
+		c.problem(PROBLEM_VALIDITY)
+		if _, _, _, ok := r.next(); !ok {
+			return nil, &Error{"truncated before the validity"}
+		}
+	}
+
+	subject, _, ok := r.expect(TAG_SEQUENCE)
+	if !ok {
+		return nil, &Error{"no subject"}
+	}
+	c.Subject = parseName(c, subject, PROBLEM_SUBJECT)
+
+	// The rest of the certificate is optional for the names
+	if _, spki, ok := r.expect(TAG_SEQUENCE); ok {
+		c.RawSubjectPublicKeyInfo = spki
+	} else {
+		c.problem(PROBLEM_KEY)
+		return c, nil
+	}
+
+	// The unique identifiers
+	r.expect(0x81)
+	r.expect(0xa1)
+	r.expect(0x82)
+	r.expect(0xa2)
+
+	if r.peek() == 0xa3 {
+		ext, _, _ := r.expect(0xa3)
+		er := reader(ext)
+		exts, _, ok := er.expect(TAG_SEQUENCE)
+		if !ok {
+			c.problem(PROBLEM_EXTENSION)
+			return c, nil
+		}
+		parseExtensions(c, exts)
+	}
+	return c, nil
+}
+
+func parseExtensions(c *Certificate, exts []byte) {
+	r := reader(exts)
+	for len(r) > 0 {
+		ext, _, ok := r.expect(TAG_SEQUENCE)
+		if !ok {
+			c.problem(PROBLEM_EXTENSION)
+			return
+		}
+
+		er := reader(ext)
+		oid_raw, _, ok := er.expect(TAG_OID)
+		if !ok {
+			c.problem(PROBLEM_EXTENSION)
+			continue
+		}
+		er.expect(TAG_BOOLEAN)
+		value, _, ok := er.expect(TAG_OCTET_STRING)
+		if !ok {
+			c.problem(PROBLEM_EXTENSION)
+			continue
+		}
+
+		oid, ok := parseOID(oid_raw)
+		if ok && oid.Equal(OID_ALT_NAME) {
+			parseAltNames(c, value)
+		}
+	}
+}
+
+func parseAltNames(c *Certificate, value []byte) {
+	r := reader(value)
+	names, _, ok := r.expect(TAG_SEQUENCE)
+	if !ok {
+		c.problem(PROBLEM_SAN)
+		return
+	}
+
+	nr := reader(names)
+	for len(nr) > 0 {
+		tag, body, _, ok := nr.next()
+		if !ok {
+			c.problem(PROBLEM_SAN)
+			return
+		}
+		switch tag {
+		case 0x81:
+			c.EmailAddresses = append(c.EmailAddresses, string(body))
+		case 0x82:
+			c.DNSNames = append(c.DNSNames, string(body))
+		case 0x86:
+			c.URIs = append(c.URIs, string(body))
+		case 0x87:
+			if len(body) == net.IPv4len || len(body) == net.IPv6len {
+				c.IPAddresses = append(c.IPAddresses, net.IP(append([]byte{}, body...)))
+			} else {
+				c.problem(PROBLEM_SAN)
+			}
+		}
+	}
+}
+
+// Parse a distinguished name, keeping the attributes that can be decoded
+func parseName(c *Certificate, body []byte, code string) Name {
+	name := Name{}
+	r := reader(body)
+	for len(r) > 0 {
+		rdn, _, ok := r.expect(TAG_SET)
+		if !ok {
+			c.problem(code)
+			return name
+		}
+
+		rr := reader(rdn)
+		for len(rr) > 0 {
+			atv, _, ok := rr.expect(TAG_SEQUENCE)
+			if !ok {
+				c.problem(code)
+				break
+			}
+
+			ar := reader(atv)
+			oid_raw, _, ok := ar.expect(TAG_OID)
+			oid, oid_ok := parseOID(oid_raw)
+			tag, value, _, value_ok := ar.next()
+			if !ok || !oid_ok || !value_ok {
+				c.problem(code)
+				continue
+			}
+			name = append(name, Attribute{Type: oid, Value: decodeString(tag, value)})
+		}
+	}
+	return name
+}
+
+// Decode a directory string. T61 strings are read as Latin-1, and strings of
+// unknown types as their bytes.
+func decodeString(tag int, b []byte) string {
+	switch tag {
+	case TAG_BMP_STRING:
+		if len(b)%2 != 0 {
+			break
+		}
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+		}
+		return string(utf16.Decode(u))
+
+	case TAG_UNIVERSAL_STRING:
+		if len(b)%4 != 0 {
+			break
+		}
+		rs := make([]rune, len(b)/4)
+		for i := range rs {
+			rs[i] = rune(b[4*i])<<24 | rune(b[4*i+1])<<16 | rune(b[4*i+2])<<8 | rune(b[4*i+3])
+		}
+		return string(rs)
+
+	case TAG_T61_STRING:
+		rs := make([]rune, len(b))
+		for i, c := range b {
+			rs[i] = rune(c)
+		}
+		return string(rs)
+	}
+	return string(b)
+}
+
+// Parse an OID from its contents
+func parseOID(b []byte) (asn1.ObjectIdentifier, bool) {
+	if len(b) == 0 {
+		return nil, false
+	}
+
+	oid := asn1.ObjectIdentifier{}
+	v := 0
+	for i, c := range b {
+		if v > 1<<24 {
+			return nil, false
+		}
+		v = v<<7 | int(c&0x7f)
+		if c&0x80 != 0 {
+			if i == len(b)-1 {
+				return nil, false
+			}
+			continue
+		}
+		if len(oid) == 0 {
+			if v < 80 {
+				oid = append(oid, v/40, v%40)
+			} else {
+				oid = append(oid, 2, v-80)
+			}
+		} else {
+			oid = append(oid, v)
+		}
+		v = 0
+	}
+	return oid, true
+}
+
+// The layouts of UTCTime and GeneralizedTime values, including the forms
+// without seconds or with offsets that DER does not allow
+var utcLayouts = []string{"060102150405Z0700", "0601021504Z0700", "060102150405", "0601021504"}
+var generalizedLayouts = []string{"20060102150405Z0700", "20060102150405.999999999Z0700", "200601021504Z0700", "20060102150405"}
+
+// Read a time, returning false if it could not be parsed
+func parseTime(r *reader) (time.Time, bool) {
+	tag, body, _, ok := r.next()
+	if !ok {
+		return time.Time{}, false
+	}
+
+	s := strings.TrimSpace(string(body))
+	layouts := generalizedLayouts
+	switch tag {
+	case TAG_UTC_TIME:
+		layouts = utcLayouts
+	case TAG_GENERALIZED_TIME:
+	default:
+		return time.Time{}, false
+	}
+
+	for _, layout := range layouts {
+		t, e := time.Parse(layout, s)
+		if e != nil {
+			continue
+		}
+		// UTCTime years from 50 are in the 1900s
+		if tag == TAG_UTC_TIME && t.Year() >= 2050 {
+			t = t.AddDate(-100, 0, 0)
+		}
+		return t.UTC(), true
+	}
+	return time.Time{}, false
+}
+
+// String returns a summary of the problems of a certificate
+func (c *Certificate) String() string {
+	return fmt.Sprintf("certificate %s with problems %s", c.Subject, strings.Join(c.Problems, ","))
+}
@@ -0,0 +1,182 @@
+package inetdata
+
+import (
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers/certparse"
+	"github.com/google/certificate-transparency-go/asn1"
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/google/certificate-transparency-go/x509/pkix"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// CertParseModes are the values of -cert-parse: strict drops certificates
+// that the x509 parser rejects, and lenient extracts their names and validity
+// with the certparse package instead
+var CertParseModes = []string{"strict", "lenient"}
+
+// CertParseMode is the mode set with -cert-parse, see AddCertParseFlags
+var CertParseMode = "strict"
+
+// The number of certificates read by the lenient parser, and the number with
+// each problem code
+var lenient_count int64 = 0
+var lenient_problems = map[string]int64{}
+var lenient_lock sync.Mutex
+
+// AddCertParseFlags registers the -cert-parse flag of the tools that parse
+// certificates with ParseCertificate
+func AddCertParseFlags() {
+	flag.StringVar(&CertParseMode, "cert-parse", CertParseMode, "How to handle certificates the x509 parser rejects: strict (drop them) or lenient (extract their names and validity)")
+}
+
+// ApplyCertParse validates the -cert-parse flag after it is parsed
+func ApplyCertParse() error {
+	for _, m := range CertParseModes {
+		if CertParseMode == m {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid -cert-parse %q, expected %s", CertParseMode, strings.Join(CertParseModes, " or "))
+}
+
+// Return true if the x509 parser returned a certificate with only non-fatal
+// errors, such as an unknown critical extension
+func isNonFatal(cert *x509.Certificate, e error) bool {
+	return cert != nil && strings.Contains(e.Error(), "NonFatalErrors:")
+}
+
+// ParseCertificate parses a DER certificate. Certificates with non-fatal
+// errors are returned without an error. With -cert-parse lenient, a
+// certificate the x509 parser rejects is read by certparse.Parse, and the
+// parts it could decode are returned.
+func ParseCertificate(der []byte) (*x509.Certificate, error) {
+	cert, e := x509.ParseCertificate(der)
+	if e == nil || isNonFatal(cert, e) {
+		return cert, nil
+	}
+	if CertParseMode != "lenient" {
+		return nil, e
+	}
+
+	c, le := certparse.Parse(der)
+	if le != nil {
+		return nil, fmt.Errorf("%s (%s)", e, le)
+	}
+	return lenientCertificate(c), nil
+}
+
+// ParseTBSCertificate parses the DER tbsCertificate of a precertificate, see
+// ParseCertificate
+func ParseTBSCertificate(der []byte) (*x509.Certificate, error) {
+	cert, e := x509.ParseTBSCertificate(der)
+	if e == nil || isNonFatal(cert, e) {
+		return cert, nil
+	}
+	if CertParseMode != "lenient" {
+		return nil, e
+	}
+
+	c, le := certparse.ParseTBS(der)
+	if le != nil {
+		return nil, fmt.Errorf("%s (%s)", e, le)
+	}
+	return lenientCertificate(c), nil
+}
+
+// Convert a certificate read by the lenient parser, counting its problems
+func lenientCertificate(c *certparse.Certificate) *x509.Certificate {
+	atomic.AddInt64(&lenient_count, 1)
+
+	cert := &x509.Certificate{
+		Raw:                     c.Raw,
+		RawTBSCertificate:       c.RawTBSCertificate,
+		RawSubjectPublicKeyInfo: c.RawSubjectPublicKeyInfo,
+		SerialNumber:            c.SerialNumber,
+		Issuer:                  pkixName(c.Issuer),
+		Subject:                 pkixName(c.Subject),
+		NotBefore:               c.NotBefore,
+		NotAfter:                c.NotAfter,
+		DNSNames:                c.DNSNames,
+		EmailAddresses:          c.EmailAddresses,
+		IPAddresses:             c.IPAddresses,
+	}
+
+	problems := c.Problems
+	for _, s := range c.URIs {
+		u, e := url.Parse(s)
+		if e != nil {
+			problems = append(problems, certparse.PROBLEM_SAN)
+			continue
+		}
+		cert.URIs = append(cert.URIs, u)
+	}
+
+	lenient_lock.Lock()
+	seen := map[string]bool{}
+	for _, p := range problems {
+		if !seen[p] {
+			seen[p] = true
+			lenient_problems[p]++
+		}
+	}
+	lenient_lock.Unlock()
+
+	return cert
+}
+
+// Convert a name read by the lenient parser
+func pkixName(name certparse.Name) pkix.Name {
+	rdns := pkix.RDNSequence{}
+	for _, a := range name {
+		rdns = append(rdns, pkix.RelativeDistinguishedNameSET{
+			pkix.AttributeTypeAndValue{Type: asn1.ObjectIdentifier(a.Type), Value: a.Value},
+		})
+	}
+	var n pkix.Name
+	n.FillFromRDNSequence(&rdns)
+	return n
+}
+
+// LenientCount returns a pointer to the number of certificates read by the
+// lenient parser, for Progress.AddCounter
+func LenientCount() *int64 {
+	return &lenient_count
+}
+
+// ReportLenientCerts logs the number of certificates read by the lenient
+// parser, with the number that had each problem
+func ReportLenientCerts() {
+	n := atomic.LoadInt64(&lenient_count)
+	if n == 0 {
+		return
+	}
+
+	lenient_lock.Lock()
+	defer lenient_lock.Unlock()
+
+	Log.Infof("Read %d malformed certificates with the lenient parser%s", n, formatCounts(lenient_problems))
+}
+
+// Format counts by reason as " (a=1, b=2)" in the order of the reasons, or
+// an empty string without counts
+func formatCounts(counts map[string]int64) string {
+	if len(counts) == 0 {
+		return ""
+	}
+	reasons := make([]string, 0, len(counts))
+	for r := range counts {
+		reasons = append(reasons, r)
+	}
+	sort.Strings(reasons)
+
+	parts := make([]string, len(reasons))
+	for i, r := range reasons {
+		parts[i] = fmt.Sprintf("%s=%d", r, counts[r])
+	}
+	return " (" + strings.Join(parts, ", ") + ")"
+}
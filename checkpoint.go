@@ -0,0 +1,193 @@
+package inetdata
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Checkpoint records the progress of a long-running job in a JSON file, so
+// that a job restarted with the same arguments resumes from the last commit
+// instead of from the beginning. Positions are named, such as the number of
+// input lines read or the next index of each CT log.
+type Checkpoint struct {
+	Inputs  []string          `json:"inputs,omitempty"`
+	Offsets map[string]int64  `json:"offsets"`
+	Values  map[string]string `json:"values,omitempty"`
+	Parts   []string          `json:"parts,omitempty"`
+	Updated string            `json:"updated"`
+
+	path string
+	lock sync.Mutex
+}
+
+// LoadCheckpoint reads a checkpoint file. A missing file returns an empty
+// checkpoint, which is written to the path on the first commit.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	c := &Checkpoint{path: path, Offsets: map[string]int64{}}
+
+	b, e := ioutil.ReadFile(path)
+	if os.IsNotExist(e) {
+		return c, nil
+	}
+	if e != nil {
+		return nil, e
+	}
+
+	if e := json.Unmarshal(b, c); e != nil {
+		return nil, fmt.Errorf("invalid checkpoint file %s: %s", path, e)
+	}
+	if c.Offsets == nil {
+		c.Offsets = map[string]int64{}
+	}
+	return c, nil
+}
+
+// OpenCheckpoint loads a checkpoint file for a job reading the inputs, see
+// CheckInputs
+func OpenCheckpoint(path string, inputs []string) (*Checkpoint, error) {
+	c, e := LoadCheckpoint(path)
+	if e != nil {
+		return nil, e
+	}
+	if e := c.CheckInputs(inputs); e != nil {
+		return nil, e
+	}
+	return c, nil
+}
+
+// Resumed returns true if the checkpoint was loaded from an existing file
+func (c *Checkpoint) Resumed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.Updated) > 0
+}
+
+// CheckInputs records the input paths of a new checkpoint, or returns an
+// error if a resumed checkpoint was made with different inputs, since its
+// offsets would not apply
+func (c *Checkpoint) CheckInputs(inputs []string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.Updated) == 0 {
+		c.Inputs = append([]string{}, inputs...)
+		return nil
+	}
+
+	if len(c.Inputs) != len(inputs) {
+		return fmt.Errorf("the checkpoint %s was made with different inputs", c.path)
+	}
+	for i := range inputs {
+		if c.Inputs[i] != inputs[i] {
+			return fmt.Errorf("the checkpoint %s was made with different inputs: %s", c.path, c.Inputs[i])
+		}
+	}
+	return nil
+}
+
+// Offset returns a named position and whether it has been committed
+func (c *Checkpoint) Offset(name string) (int64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	v, ok := c.Offsets[name]
+	return v, ok
+}
+
+// SetOffset updates a named position, which is saved by the next Commit
+func (c *Checkpoint) SetOffset(name string, v int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Offsets[name] = v
+}
+
+// Value returns a named value, such as the last tree head of a log, and
+// whether it has been committed
+func (c *Checkpoint) Value(name string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	v, ok := c.Values[name]
+	return v, ok
+}
+
+// SetValue updates a named value, which is saved by the next Commit
+func (c *Checkpoint) SetValue(name string, v string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.Values == nil {
+		c.Values = map[string]string{}
+	}
+	c.Values[name] = v
+}
+
+// ClearOffsets forgets the named positions with a prefix, so that the work
+// they stand for is done again
+func (c *Checkpoint) ClearOffsets(prefix string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for name := range c.Offsets {
+		if strings.HasPrefix(name, prefix) {
+			delete(c.Offsets, name)
+		}
+	}
+}
+
+// AddPart records a file holding the output of committed input
+func (c *Checkpoint) AddPart(path string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Parts = append(c.Parts, path)
+}
+
+// PartNames returns the recorded part files
+func (c *Checkpoint) PartNames() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string{}, c.Parts...)
+}
+
+// Commit writes the checkpoint file. The file is replaced atomically, so a
+// crash leaves either the previous or the new checkpoint.
+func (c *Checkpoint) Commit() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.Updated = time.Now().UTC().Format(time.RFC3339)
+	b, e := json.MarshalIndent(c, "", "  ")
+	if e != nil {
+		return e
+	}
+
+	tmp, e := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if e != nil {
+		return e
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, e := tmp.Write(append(b, '\n')); e != nil {
+		tmp.Close()
+		return e
+	}
+	if e := tmp.Sync(); e != nil {
+		tmp.Close()
+		return e
+	}
+	if e := tmp.Close(); e != nil {
+		return e
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
+
+// Remove deletes the checkpoint file once a job has completed
+func (c *Checkpoint) Remove() error {
+	e := os.Remove(c.path)
+	if os.IsNotExist(e) {
+		return nil
+	}
+	return e
+}
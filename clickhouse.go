@@ -0,0 +1,314 @@
+package inetdata
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClickHouseURL describes a table as clickhouse://[user:pass@]host:port/database?table=NAME&options
+//
+//	table     : the table to insert into (required)
+//	columns   : comma-separated column names for the fields of each line, the
+//	            last column holds the remainder of the line (default key,value)
+//	delimiter : the field delimiter (default ,)
+//	create    : create the table if it does not exist, with String columns
+//	            ordered by the first column (default 0)
+//	batch     : the maximum number of rows per block (default 100000)
+//	linger    : the maximum time to wait for a block to fill (default 5s)
+//	async     : use asynchronous inserts on the server (default 0)
+//	tls       : connect with TLS (default 0)
+type ClickHouseURL struct {
+	Addr      string
+	Database  string
+	User      string
+	Password  string
+	Table     string
+	Columns   []string
+	Delimiter string
+	Create    bool
+	BatchSize int
+	Linger    time.Duration
+	Async     bool
+	TLS       bool
+}
+
+// ParseClickHouseURL parses a clickhouse:// URL
+func ParseClickHouseURL(s string) (*ClickHouseURL, error) {
+	p, e := url.Parse(s)
+	if e != nil || p.Scheme != "clickhouse" {
+		return nil, fmt.Errorf("not a clickhouse URL: %s", s)
+	}
+
+	u := &ClickHouseURL{
+		Addr:      p.Host,
+		Database:  strings.Trim(p.Path, "/"),
+		Columns:   []string{"key", "value"},
+		Delimiter: ",",
+		BatchSize: 100000,
+		Linger:    5 * time.Second,
+	}
+
+	if len(u.Database) == 0 {
+		u.Database = "default"
+	}
+
+	if p.User != nil {
+		u.User = p.User.Username()
+		u.Password, _ = p.User.Password()
+	}
+
+	flag := func(v string) bool {
+		return v == "1" || v == "true"
+	}
+
+	for k := range p.Query() {
+		v := p.Query().Get(k)
+		switch k {
+		case "table":
+			u.Table = v
+		case "columns":
+			u.Columns = strings.Split(v, ",")
+			for i := range u.Columns {
+				if len(u.Columns[i]) == 0 {
+					e = errors.New("empty column name")
+				}
+			}
+		case "delimiter":
+			u.Delimiter = UnescapeDelimiter(v)
+		case "create":
+			u.Create = flag(v)
+		case "batch":
+			u.BatchSize, e = strconv.Atoi(v)
+			if e == nil && u.BatchSize < 1 {
+				e = errors.New("must be positive")
+			}
+		case "linger":
+			u.Linger, e = time.ParseDuration(v)
+		case "async":
+			u.Async = flag(v)
+		case "tls":
+			u.TLS = flag(v)
+		default:
+			e = errors.New("unknown option")
+		}
+
+		if e != nil {
+			return nil, fmt.Errorf("invalid clickhouse URL option %s=%q: %s", k, v, e)
+		}
+	}
+
+	if len(u.Addr) == 0 || len(u.Table) == 0 {
+		return nil, fmt.Errorf("invalid clickhouse URL, expected clickhouse://host:port/database?table=NAME: %s", s)
+	}
+
+	return u, nil
+}
+
+// ClickHouseTableURL returns the URL with a suffix appended to the table name,
+// for tools that write several outputs from one base name
+func ClickHouseTableURL(s string, suffix string) (string, error) {
+	p, e := url.Parse(s)
+	if e != nil {
+		return "", e
+	}
+	q := p.Query()
+	if len(q.Get("table")) == 0 {
+		return "", fmt.Errorf("invalid clickhouse URL, missing the table option: %s", s)
+	}
+	q.Set("table", q.Get("table")+suffix)
+	p.RawQuery = q.Encode()
+	return p.String(), nil
+}
+
+// Quote a ClickHouse identifier
+func clickHouseIdent(name string) string {
+	return "`" + strings.Replace(strings.Replace(name, "\\", "\\\\", -1), "`", "\\`", -1) + "`"
+}
+
+// ClickHouseTableDDL returns the statement that creates the table for the URL
+func ClickHouseTableDDL(u *ClickHouseURL) string {
+	cols := make([]string, len(u.Columns))
+	for i := range u.Columns {
+		cols[i] = clickHouseIdent(u.Columns[i]) + " String"
+	}
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.%s (%s) ENGINE = MergeTree ORDER BY %s",
+		clickHouseIdent(u.Database), clickHouseIdent(u.Table), strings.Join(cols, ", "), clickHouseIdent(u.Columns[0]))
+}
+
+type clickHouseWriter struct {
+	sync.Mutex
+	u       *ClickHouseURL
+	conn    driver.Conn
+	insert  string
+	pending []byte
+	rows    [][]string
+	quit    chan bool
+	err     error
+}
+
+// NewClickHouseWriter connects to ClickHouse and returns a writer that
+// inserts each line written to it as a row. Rows are sent in blocks of up to
+// BatchSize rows using the native protocol; writes block while a block is sent.
+func NewClickHouseWriter(u *ClickHouseURL) (io.WriteCloser, error) {
+	opts := &clickhouse.Options{
+		Addr: []string{u.Addr},
+		Auth: clickhouse.Auth{Database: u.Database, Username: u.User, Password: u.Password},
+	}
+	if u.TLS {
+		opts.TLS = &tls.Config{}
+	}
+	if u.Async {
+		opts.Settings = clickhouse.Settings{"async_insert": 1, "wait_for_async_insert": 1}
+	}
+
+	conn, e := clickhouse.Open(opts)
+	if e != nil {
+		return nil, e
+	}
+
+	if e := conn.Ping(context.Background()); e != nil {
+		conn.Close()
+		return nil, e
+	}
+
+	if u.Create {
+		if e := conn.Exec(context.Background(), ClickHouseTableDDL(u)); e != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to create table %s: %s", u.Table, e)
+		}
+	}
+
+	cols := make([]string, len(u.Columns))
+	for i := range u.Columns {
+		cols[i] = clickHouseIdent(u.Columns[i])
+	}
+
+	w := &clickHouseWriter{
+		u:      u,
+		conn:   conn,
+		insert: fmt.Sprintf("INSERT INTO %s.%s (%s)", clickHouseIdent(u.Database), clickHouseIdent(u.Table), strings.Join(cols, ", ")),
+		quit:   make(chan bool),
+	}
+
+	// Send partial blocks after the linger time
+	go func() {
+		t := time.NewTicker(u.Linger)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				w.Lock()
+				w.flush()
+				w.Unlock()
+			case <-w.quit:
+				return
+			}
+		}
+	}()
+
+	return w, nil
+}
+
+func (w *clickHouseWriter) Write(b []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	w.pending = append(w.pending, b...)
+
+	for {
+		idx := bytes.IndexByte(w.pending, '\n')
+		if idx < 0 {
+			break
+		}
+
+		line := strings.TrimRight(string(w.pending[:idx]), "\r")
+		w.pending = w.pending[idx+1:]
+		if len(line) == 0 {
+			continue
+		}
+
+		row := strings.SplitN(line, w.u.Delimiter, len(w.u.Columns))
+		for len(row) < len(w.u.Columns) {
+			row = append(row, "")
+		}
+		w.rows = append(w.rows, row)
+
+		if len(w.rows) >= w.u.BatchSize {
+			if e := w.flush(); e != nil {
+				return 0, e
+			}
+		}
+	}
+
+	return len(b), nil
+}
+
+// Send the buffered rows as a block, the lock must be held
+func (w *clickHouseWriter) flush() error {
+	if len(w.rows) == 0 || w.err != nil {
+		return w.err
+	}
+
+	rows := w.rows
+	w.rows = nil
+
+	batch, e := w.conn.PrepareBatch(context.Background(), w.insert)
+	if e == nil {
+		for _, row := range rows {
+			args := make([]interface{}, len(row))
+			for i := range row {
+				args[i] = row[i]
+			}
+			if e = batch.Append(args...); e != nil {
+				break
+			}
+		}
+	}
+	if e == nil {
+		e = batch.Send()
+	} else if batch != nil {
+		batch.Abort()
+	}
+
+	if e != nil {
+		w.err = fmt.Errorf("clickhouse insert into %s failed: %s", w.u.Table, e)
+	}
+	return w.err
+}
+
+// Close sends the remaining rows and closes the connection
+func (w *clickHouseWriter) Close() error {
+	close(w.quit)
+
+	w.Lock()
+	if len(w.pending) > 0 {
+		w.pending = append(w.pending, '\n')
+	}
+	w.Unlock()
+
+	w.Write(nil)
+
+	w.Lock()
+	defer w.Unlock()
+
+	e := w.flush()
+	if ce := w.conn.Close(); e == nil {
+		e = ce
+	}
+	return e
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/fathom6/inetdata-parsers"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -298,14 +299,14 @@ func main() {
 
 	handles, e := LookupOrgNets(org)
 	if e != nil {
-		fmt.Fprintf(os.Stderr, "Could not list network handles: %s", e.Error())
+		inetdata.Log.Errorf("Could not list network handles: %s", e.Error())
 		os.Exit(1)
 	}
 
 	for i := range handles {
 		cidrs, e := LookupNetCidrs(handles[i])
 		if e != nil {
-			fmt.Fprintf(os.Stderr, "Could not list CIDRs for %s: %s", handles[i], e.Error())
+			inetdata.Log.Warnf("Could not list CIDRs for %s: %s", handles[i], e.Error())
 			continue
 		}
 		fmt.Println(strings.Join(cidrs, "\n"))
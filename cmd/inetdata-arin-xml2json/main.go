@@ -3,28 +3,39 @@ package main
 // Convert ARIN Bulk XML into JSONL output
 
 import (
+	"bufio"
+	"encoding/csv"
 	"encoding/json"
 	"encoding/xml"
 	"flag"
 	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"io"
 	"os"
+	"strconv"
+	"sync/atomic"
 )
 
+var input_count int64 = 0
+
+// The JSONL output, when -csv is not used
+var json_output io.Writer = os.Stdout
+
 // ARIN POC Record
 
 type ARIN_POC_emails struct {
-	Email string `xml:" email,omitempty" json:"email,omitempty"`
+	Email string `xml:"email,omitempty" json:"email,omitempty"`
 }
 
 type ARIN_POC_iso3166_1 struct {
-	Code2 string `xml:" code2,omitempty" json:"code2,omitempty"`
-	Code3 string `xml:" code3,omitempty" json:"code3,omitempty"`
-	E164  string `xml:" e164,omitempty" json:"e164,omitempty"`
-	Name  string `xml:" name,omitempty" json:"name,omitempty"`
+	Code2 string `xml:"code2,omitempty" json:"code2,omitempty"`
+	Code3 string `xml:"code3,omitempty" json:"code3,omitempty"`
+	E164  string `xml:"e164,omitempty" json:"e164,omitempty"`
+	Name  string `xml:"name,omitempty" json:"name,omitempty"`
 }
 
 type ARIN_POC_line struct {
-	Number string `xml:" number,attr"  json:",omitempty"`
+	Number string `xml:"number,attr" json:",omitempty"`
 	Text   string `xml:",chardata" json:",omitempty"`
 }
 
@@ -33,184 +44,307 @@ type ARIN_POC_name struct {
 }
 
 type ARIN_POC_number struct {
-	PhoneNumber string `xml:" phoneNumber,omitempty" json:"phoneNumber,omitempty"`
-	PhoneType   string `xml:" phoneType,omitempty" json:"phoneType,omitempty"`
-	PocHandle   string `xml:" pocHandle,omitempty" json:"pocHandle,omitempty"`
+	PhoneNumber string `xml:"phoneNumber,omitempty" json:"phoneNumber,omitempty"`
+	PhoneType   string `xml:"phoneType,omitempty" json:"phoneType,omitempty"`
+	PocHandle   string `xml:"pocHandle,omitempty" json:"pocHandle,omitempty"`
 }
 
 type ARIN_POC_phone struct {
-	Number *ARIN_POC_number `xml:" number,omitempty" json:"number,omitempty"`
-	Type   *ARIN_POC_type   `xml:" type,omitempty" json:"type,omitempty"`
+	Number *ARIN_POC_number `xml:"number,omitempty" json:"number,omitempty"`
+	Type   *ARIN_POC_type   `xml:"type,omitempty" json:"type,omitempty"`
 }
 
 type ARIN_POC_phones struct {
-	Phone *ARIN_POC_phone `xml:" phone,omitempty" json:"phone,omitempty"`
+	Phone *ARIN_POC_phone `xml:"phone,omitempty" json:"phone,omitempty"`
 }
 
 type ARIN_POC_poc struct {
-	ARIN_Type        string                  `xml:" arin,omitempty" json:"arin,omitempty"`
-	City             string                  `xml:" city,omitempty" json:"city,omitempty"`
-	Emails           *ARIN_POC_emails        `xml:" emails,omitempty" json:"emails,omitempty"`
-	FirstName        string                  `xml:" firstName,omitempty" json:"firstName,omitempty"`
-	Handle           string                  `xml:" handle,omitempty" json:"handle,omitempty"`
-	IsRoleAccount    string                  `xml:" isRoleAccount,omitempty" json:"isRoleAccount,omitempty"`
-	Iso3166_1        *ARIN_POC_iso3166_1     `xml:" iso3166-1,omitempty" json:"iso3166-1,omitempty"`
-	Iso3166_2        string                  `xml:" iso3166-2,omitempty" json:"iso3166-2,omitempty"`
-	LastName         string                  `xml:" lastName,omitempty" json:"lastName,omitempty"`
-	Phones           *ARIN_POC_phones        `xml:" phones,omitempty" json:"phones,omitempty"`
-	PostalCode       string                  `xml:" postalCode,omitempty" json:"postalCode,omitempty"`
-	Ref              string                  `xml:" ref,omitempty" json:"ref,omitempty"`
-	RegistrationDate string                  `xml:" registrationDate,omitempty" json:"registrationDate,omitempty"`
-	StreetAddress    *ARIN_POC_streetAddress `xml:" streetAddress,omitempty" json:"streetAddress,omitempty"`
-	UpdateDate       *string                 `xml:" updateDate,omitempty" json:"updateDate,omitempty"`
+	ARIN_Type        string                  `xml:"arin,omitempty" json:"arin,omitempty"`
+	City             string                  `xml:"city,omitempty" json:"city,omitempty"`
+	Emails           *ARIN_POC_emails        `xml:"emails,omitempty" json:"emails,omitempty"`
+	FirstName        string                  `xml:"firstName,omitempty" json:"firstName,omitempty"`
+	Handle           string                  `xml:"handle,omitempty" json:"handle,omitempty"`
+	IsRoleAccount    string                  `xml:"isRoleAccount,omitempty" json:"isRoleAccount,omitempty"`
+	Iso3166_1        *ARIN_POC_iso3166_1     `xml:"iso3166-1,omitempty" json:"iso3166-1,omitempty"`
+	Iso3166_2        string                  `xml:"iso3166-2,omitempty" json:"iso3166-2,omitempty"`
+	LastName         string                  `xml:"lastName,omitempty" json:"lastName,omitempty"`
+	Phones           *ARIN_POC_phones        `xml:"phones,omitempty" json:"phones,omitempty"`
+	PostalCode       string                  `xml:"postalCode,omitempty" json:"postalCode,omitempty"`
+	Ref              string                  `xml:"ref,omitempty" json:"ref,omitempty"`
+	RegistrationDate string                  `xml:"registrationDate,omitempty" json:"registrationDate,omitempty"`
+	StreetAddress    *ARIN_POC_streetAddress `xml:"streetAddress,omitempty" json:"streetAddress,omitempty"`
+	UpdateDate       *string                 `xml:"updateDate,omitempty" json:"updateDate,omitempty"`
 }
 
 type ARIN_POC_streetAddress struct {
-	Line []*ARIN_POC_line `xml:" line,omitempty" json:"line,omitempty"`
+	Line []*ARIN_POC_line `xml:"line,omitempty" json:"line,omitempty"`
 }
 
 type ARIN_POC_type struct {
-	Code        string `xml:" code,omitempty" json:"code,omitempty"`
-	Description string `xml:" description,omitempty" json:"description,omitempty"`
+	Code        string `xml:"code,omitempty" json:"code,omitempty"`
+	Description string `xml:"description,omitempty" json:"description,omitempty"`
 }
 
 // ARIN Organization Record
 
 type ARIN_ORG_iso3166_1 struct {
-	Code2 string `xml:" code2,omitempty" json:"code2,omitempty"`
-	Code3 string `xml:" code3,omitempty" json:"code3,omitempty"`
-	E164  string `xml:" e164,omitempty" json:"e164,omitempty"`
-	Name  string `xml:" name,omitempty" json:"name,omitempty"`
+	Code2 string `xml:"code2,omitempty" json:"code2,omitempty"`
+	Code3 string `xml:"code3,omitempty" json:"code3,omitempty"`
+	E164  string `xml:"e164,omitempty" json:"e164,omitempty"`
+	Name  string `xml:"name,omitempty" json:"name,omitempty"`
 }
 
 type ARIN_ORG_line struct {
-	Number string `xml:" number,attr"  json:",omitempty"`
+	Number string `xml:"number,attr" json:",omitempty"`
 	Text   string `xml:",chardata" json:",omitempty"`
 }
 
 type ARIN_ORG_org struct {
-	ARIN_Type        string                  `xml:" arin,omitempty" json:"arin,omitempty"`
-	City             string                  `xml:" city,omitempty" json:"city,omitempty"`
-	Customer         string                  `xml:" customer,omitempty" json:"customer,omitempty"`
-	Handle           string                  `xml:" handle,omitempty" json:"handle,omitempty"`
-	Iso3166_1        *ARIN_ORG_iso3166_1     `xml:" iso3166-1,omitempty" json:"iso3166-1,omitempty"`
-	Iso3166_2        string                  `xml:" iso3166-2,omitempty" json:"iso3166-2,omitempty"`
-	Name             string                  `xml:" name,omitempty" json:"name,omitempty"`
-	PocLinks         *ARIN_ORG_pocLinks      `xml:" pocLinks,omitempty" json:"pocLinks,omitempty"`
-	PostalCode       string                  `xml:" postalCode,omitempty" json:"postalCode,omitempty"`
-	Ref              string                  `xml:" ref,omitempty" json:"ref,omitempty"`
-	RegistrationDate string                  `xml:" registrationDate,omitempty" json:"registrationDate,omitempty"`
-	StreetAddress    *ARIN_ORG_streetAddress `xml:" streetAddress,omitempty" json:"streetAddress,omitempty"`
-	UpdateDate       string                  `xml:" updateDate,omitempty" json:"updateDate,omitempty"`
+	ARIN_Type        string                  `xml:"arin,omitempty" json:"arin,omitempty"`
+	City             string                  `xml:"city,omitempty" json:"city,omitempty"`
+	Customer         string                  `xml:"customer,omitempty" json:"customer,omitempty"`
+	Handle           string                  `xml:"handle,omitempty" json:"handle,omitempty"`
+	Iso3166_1        *ARIN_ORG_iso3166_1     `xml:"iso3166-1,omitempty" json:"iso3166-1,omitempty"`
+	Iso3166_2        string                  `xml:"iso3166-2,omitempty" json:"iso3166-2,omitempty"`
+	Name             string                  `xml:"name,omitempty" json:"name,omitempty"`
+	PocLinks         *ARIN_ORG_pocLinks      `xml:"pocLinks,omitempty" json:"pocLinks,omitempty"`
+	PostalCode       string                  `xml:"postalCode,omitempty" json:"postalCode,omitempty"`
+	Ref              string                  `xml:"ref,omitempty" json:"ref,omitempty"`
+	RegistrationDate string                  `xml:"registrationDate,omitempty" json:"registrationDate,omitempty"`
+	StreetAddress    *ARIN_ORG_streetAddress `xml:"streetAddress,omitempty" json:"streetAddress,omitempty"`
+	UpdateDate       string                  `xml:"updateDate,omitempty" json:"updateDate,omitempty"`
 }
 
 type ARIN_ORG_pocLink struct {
-	Description string `xml:" description,attr"  json:",omitempty"`
-	Function    string `xml:" function,attr"  json:",omitempty"`
-	Handle      string `xml:" handle,attr"  json:",omitempty"`
+	Description string `xml:"description,attr" json:",omitempty"`
+	Function    string `xml:"function,attr" json:",omitempty"`
+	Handle      string `xml:"handle,attr" json:",omitempty"`
 }
 
 type ARIN_ORG_pocLinks struct {
-	PocLink []*ARIN_ORG_pocLink `xml:" pocLink,omitempty" json:"pocLink,omitempty"`
+	PocLink []*ARIN_ORG_pocLink `xml:"pocLink,omitempty" json:"pocLink,omitempty"`
 }
 
 type ARIN_ORG_streetAddress struct {
-	Line []*ARIN_ORG_line `xml:" line,omitempty" json:"line,omitempty"`
+	Line []*ARIN_ORG_line `xml:"line,omitempty" json:"line,omitempty"`
 }
 
 // ARIN Network Record
 
 type ARIN_NET_net struct {
-	ARIN_Type        string              `xml:" arin,omitempty" json:"arin,omitempty"`
-	EndAddress       string              `xml:" endAddress,omitempty" json:"endAddress,omitempty"`
-	Handle           string              `xml:" handle,omitempty" json:"handle,omitempty"`
-	Name             string              `xml:" name,omitempty" json:"name,omitempty"`
-	NetBlocks        *ARIN_NET_netBlocks `xml:" netBlocks,omitempty" json:"netBlocks,omitempty"`
-	OrgHandle        string              `xml:" orgHandle,omitempty" json:"orgHandle,omitempty"`
-	ParentNetHandle  string              `xml:" parentNetHandle,omitempty" json:"parentNetHandle,omitempty"`
-	PocLinks         *ARIN_NET_pocLinks  `xml:" pocLinks,omitempty" json:"pocLinks,omitempty"`
-	Ref              string              `xml:" ref,omitempty" json:"ref,omitempty"`
-	RegistrationDate string              `xml:" registrationDate,omitempty" json:"registrationDate,omitempty"`
-	StartAddress     string              `xml:" startAddress,omitempty" json:"startAddress,omitempty"`
-	UpdateDate       string              `xml:" updateDate,omitempty" json:"updateDate,omitempty"`
-	Version          string              `xml:" version,omitempty" json:"version,omitempty"`
+	ARIN_Type        string              `xml:"arin,omitempty" json:"arin,omitempty"`
+	EndAddress       string              `xml:"endAddress,omitempty" json:"endAddress,omitempty"`
+	Handle           string              `xml:"handle,omitempty" json:"handle,omitempty"`
+	Name             string              `xml:"name,omitempty" json:"name,omitempty"`
+	NetBlocks        *ARIN_NET_netBlocks `xml:"netBlocks,omitempty" json:"netBlocks,omitempty"`
+	OrgHandle        string              `xml:"orgHandle,omitempty" json:"orgHandle,omitempty"`
+	ParentNetHandle  string              `xml:"parentNetHandle,omitempty" json:"parentNetHandle,omitempty"`
+	PocLinks         *ARIN_NET_pocLinks  `xml:"pocLinks,omitempty" json:"pocLinks,omitempty"`
+	Ref              string              `xml:"ref,omitempty" json:"ref,omitempty"`
+	RegistrationDate string              `xml:"registrationDate,omitempty" json:"registrationDate,omitempty"`
+	StartAddress     string              `xml:"startAddress,omitempty" json:"startAddress,omitempty"`
+	UpdateDate       string              `xml:"updateDate,omitempty" json:"updateDate,omitempty"`
+	Version          string              `xml:"version,omitempty" json:"version,omitempty"`
 }
 
 type ARIN_NET_netBlock struct {
-	CidrLenth    string `xml:" cidrLenth,omitempty" json:"cidrLenth,omitempty"`
-	EndAddress   string `xml:" endAddress,omitempty" json:"endAddress,omitempty"`
-	StartAddress string `xml:" startAddress,omitempty" json:"startAddress,omitempty"`
-	Type         string `xml:" type,omitempty" json:"type,omitempty"`
+	CidrLenth    string `xml:"cidrLenth,omitempty" json:"cidrLenth,omitempty"`
+	EndAddress   string `xml:"endAddress,omitempty" json:"endAddress,omitempty"`
+	StartAddress string `xml:"startAddress,omitempty" json:"startAddress,omitempty"`
+	Type         string `xml:"type,omitempty" json:"type,omitempty"`
 }
 
 type ARIN_NET_netBlocks struct {
-	NetBlock *ARIN_NET_netBlock `xml:" netBlock,omitempty" json:"netBlock,omitempty"`
+	NetBlock []*ARIN_NET_netBlock `xml:"netBlock,omitempty" json:"netBlock,omitempty"`
+}
+
+type ARIN_NET_pocLink struct {
+	Description string `xml:"description,attr" json:",omitempty"`
+	Function    string `xml:"function,attr" json:",omitempty"`
+	Handle      string `xml:"handle,attr" json:",omitempty"`
 }
 
 type ARIN_NET_pocLinks struct {
+	PocLink []*ARIN_NET_pocLink `xml:"pocLink,omitempty" json:"pocLink,omitempty"`
 }
 
 // ARIN ASN Record
 
 type ARIN_ASN_asn struct {
-	ARIN_Type        string             `xml:" arin,omitempty" json:"arin,omitempty"`
-	ARIN_ASN_comment *ARIN_ASN_comment  `xml:" comment,omitempty" json:"comment,omitempty"`
-	EndAsNumber      string             `xml:" endAsNumber,omitempty" json:"endAsNumber,omitempty"`
-	Handle           string             `xml:" handle,omitempty" json:"handle,omitempty"`
-	Name             string             `xml:" name,omitempty" json:"name,omitempty"`
-	OrgHandle        string             `xml:" orgHandle,omitempty" json:"orgHandle,omitempty"`
-	PocLinks         *ARIN_ASN_pocLinks `xml:" pocLinks,omitempty" json:"pocLinks,omitempty"`
-	Ref              string             `xml:" ref,omitempty" json:"ref,omitempty"`
-	RegistrationDate string             `xml:" registrationDate,omitempty" json:"registrationDate,omitempty"`
-	StartAsNumber    string             `xml:" startAsNumber,omitempty" json:"startAsNumber,omitempty"`
-	UpdateDate       string             `xml:" updateDate,omitempty" json:"updateDate,omitempty"`
+	ARIN_Type        string             `xml:"arin,omitempty" json:"arin,omitempty"`
+	ARIN_ASN_comment *ARIN_ASN_comment  `xml:"comment,omitempty" json:"comment,omitempty"`
+	EndAsNumber      string             `xml:"endAsNumber,omitempty" json:"endAsNumber,omitempty"`
+	Handle           string             `xml:"handle,omitempty" json:"handle,omitempty"`
+	Name             string             `xml:"name,omitempty" json:"name,omitempty"`
+	OrgHandle        string             `xml:"orgHandle,omitempty" json:"orgHandle,omitempty"`
+	PocLinks         *ARIN_ASN_pocLinks `xml:"pocLinks,omitempty" json:"pocLinks,omitempty"`
+	Ref              string             `xml:"ref,omitempty" json:"ref,omitempty"`
+	RegistrationDate string             `xml:"registrationDate,omitempty" json:"registrationDate,omitempty"`
+	StartAsNumber    string             `xml:"startAsNumber,omitempty" json:"startAsNumber,omitempty"`
+	UpdateDate       string             `xml:"updateDate,omitempty" json:"updateDate,omitempty"`
 }
 
 type ARIN_ASN_comment struct {
-	Line []*ARIN_ASN_line `xml:" line,omitempty" json:"line,omitempty"`
+	Line []*ARIN_ASN_line `xml:"line,omitempty" json:"line,omitempty"`
 }
 
 type ARIN_ASN_line struct {
-	Number string `xml:" number,attr"  json:",omitempty"`
+	Number string `xml:"number,attr" json:",omitempty"`
 	Text   string `xml:",chardata" json:",omitempty"`
 }
 
 type ARIN_ASN_pocLink struct {
-	Description string `xml:" description,attr"  json:",omitempty"`
-	Function    string `xml:" function,attr"  json:",omitempty"`
-	Handle      string `xml:" handle,attr"  json:",omitempty"`
+	Description string `xml:"description,attr" json:",omitempty"`
+	Function    string `xml:"function,attr" json:",omitempty"`
+	Handle      string `xml:"handle,attr" json:",omitempty"`
 }
 
 type ARIN_ASN_pocLinks struct {
-	PocLink []*ARIN_ASN_pocLink `xml:" pocLink,omitempty" json:"pocLink,omitempty"`
+	PocLink []*ARIN_ASN_pocLink `xml:"pocLink,omitempty" json:"pocLink,omitempty"`
+}
+
+// Linked CSV outputs, created when -csv is specified
+var csv_outputs map[string]*csv.Writer
+
+var csv_headers = map[string][]string{
+	"nets":     {"cidr", "net_handle", "org_handle", "net_name", "net_type", "parent_net_handle"},
+	"orgs":     {"org_handle", "org_name", "city", "country", "registration_date", "update_date"},
+	"org-pocs": {"org_handle", "poc_handle", "function", "description"},
+	"asns":     {"asn", "asn_handle", "org_handle", "asn_name"},
+	"asn-pocs": {"asn_handle", "poc_handle", "function", "description"},
+	"net-pocs": {"net_handle", "poc_handle", "function", "description"},
+	"pocs":     {"poc_handle", "first_name", "last_name", "email", "city", "country", "is_role_account"},
+}
+
+// Maximum number of AS numbers to expand from a single ASN range
+const maxASNRange = 1 << 20
+
+func createCSVOutputs(base string) ([]io.WriteCloser, error) {
+	fds := []io.WriteCloser{}
+	csv_outputs = make(map[string]*csv.Writer)
+
+	for name, header := range csv_headers {
+		fd, e := inetdata.CreateOutput(base + "-" + name + ".csv")
+		if e != nil {
+			return fds, e
+		}
+		fds = append(fds, fd)
+
+		w := csv.NewWriter(bufio.NewWriterSize(fd, 1024*1024))
+		w.Write(header)
+		csv_outputs[name] = w
+	}
+	return fds, nil
+}
+
+func writeCSV(name string, row ...string) {
+	csv_outputs[name].Write(row)
+}
+
+func recordToCSV(value interface{}) {
+	switch r := value.(type) {
+	case *ARIN_NET_net:
+		if r.NetBlocks != nil {
+			for _, nb := range r.NetBlocks.NetBlock {
+				if nb == nil || len(nb.StartAddress) == 0 {
+					continue
+				}
+				writeCSV("nets", nb.StartAddress+"/"+nb.CidrLenth, r.Handle, r.OrgHandle, r.Name, nb.Type, r.ParentNetHandle)
+			}
+		}
+		if r.PocLinks != nil {
+			for _, pl := range r.PocLinks.PocLink {
+				writeCSV("net-pocs", r.Handle, pl.Handle, pl.Function, pl.Description)
+			}
+		}
+
+	case *ARIN_ORG_org:
+		country := ""
+		if r.Iso3166_1 != nil {
+			country = r.Iso3166_1.Code2
+		}
+		writeCSV("orgs", r.Handle, r.Name, r.City, country, r.RegistrationDate, r.UpdateDate)
+		if r.PocLinks != nil {
+			for _, pl := range r.PocLinks.PocLink {
+				writeCSV("org-pocs", r.Handle, pl.Handle, pl.Function, pl.Description)
+			}
+		}
+
+	case *ARIN_ASN_asn:
+		start, se := strconv.ParseUint(r.StartAsNumber, 10, 32)
+		end, ee := strconv.ParseUint(r.EndAsNumber, 10, 32)
+		if se != nil {
+			inetdata.Log.Warnf("Invalid ASN range for %s: %s-%s", r.Handle, r.StartAsNumber, r.EndAsNumber)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_NETWORK, r.Handle+","+r.StartAsNumber+"-"+r.EndAsNumber)
+		} else {
+			if ee != nil || end < start {
+				end = start
+			}
+			if end-start > maxASNRange {
+				inetdata.Log.Warnf("ASN range too large for %s: %d-%d", r.Handle, start, end)
+				end = start + maxASNRange
+			}
+			for asn := start; asn <= end; asn++ {
+				writeCSV("asns", strconv.FormatUint(asn, 10), r.Handle, r.OrgHandle, r.Name)
+			}
+		}
+		if r.PocLinks != nil {
+			for _, pl := range r.PocLinks.PocLink {
+				writeCSV("asn-pocs", r.Handle, pl.Handle, pl.Function, pl.Description)
+			}
+		}
+
+	case *ARIN_POC_poc:
+		email, country := "", ""
+		if r.Emails != nil {
+			email = r.Emails.Email
+		}
+		if r.Iso3166_1 != nil {
+			country = r.Iso3166_1.Code2
+		}
+		writeCSV("pocs", r.Handle, r.FirstName, r.LastName, email, r.City, country, r.IsRoleAccount)
+	}
 }
 
 func processRecord(decoder *xml.Decoder, el *xml.StartElement, rtype string, value interface{}) {
-	decoder.DecodeElement(&value, el)
-	if value == nil {
-		fmt.Fprintf(os.Stderr, "Could not decode record type %s\n", rtype)
+	if e := decoder.DecodeElement(value, el); e != nil {
+		inetdata.Log.Warnf("Could not decode record type %s: %s", rtype, e)
+		return
+	}
+
+	atomic.AddInt64(&input_count, 1)
+
+	if csv_outputs != nil {
+		recordToCSV(value)
 		return
 	}
 
 	b, e := json.Marshal(value)
 	if e != nil {
-		fmt.Fprintf(os.Stderr, "Could not marshal type: %s\n", e.Error())
+		inetdata.Log.Warnf("Could not marshal type: %s", e.Error())
 		return
 	}
-	fmt.Println(string(b))
+	json_output.Write(append(b, '\n'))
 }
 
-func processFile(name string) {
-	xmlFile, err := os.Open(name)
+func processFile(name string, progress *inetdata.Progress) {
+	xmlFile, err := inetdata.OpenPath(name)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not open file: %s\n", err.Error())
+		inetdata.Log.Warnf("Could not open file: %s", err.Error())
 		return
 	}
 	defer xmlFile.Close()
 
-	decoder := xml.NewDecoder(xmlFile)
+	input, err := inetdata.NewInputReader(progress.CountReader(xmlFile), "auto")
+	if err != nil {
+		inetdata.Log.Warnf("Could not read file: %s", err.Error())
+		return
+	}
+
+	// Records are decoded one at a time, so memory use does not depend on the file size
+	decoder := xml.NewDecoder(input)
 	var inElement string
-	for {
+	for !inetdata.Interrupted() {
 		t, _ := decoder.Token()
 		if t == nil {
 			break
@@ -233,9 +367,134 @@ func processFile(name string) {
 	}
 }
 
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <arin-bulk.xml> ... <arin-bulk.xml>")
+	fmt.Println("")
+	fmt.Println("Converts ARIN bulk XML (nets, orgs, asns, pocs) to JSONL. With -csv <base>, linked CSV")
+	fmt.Println("files are written instead:")
+	fmt.Println("")
+	fmt.Println("  <base>-nets.csv     : netblock CIDR -> net and org handles")
+	fmt.Println("  <base>-orgs.csv     : org handle -> name and location")
+	fmt.Println("  <base>-org-pocs.csv : org handle -> POC handle")
+	fmt.Println("  <base>-net-pocs.csv : net handle -> POC handle")
+	fmt.Println("  <base>-asns.csv     : AS number -> ASN and org handles")
+	fmt.Println("  <base>-asn-pocs.csv : ASN handle -> POC handle")
+	fmt.Println("  <base>-pocs.csv     : POC handle -> name and contact details")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
 func main() {
-	flag.Parse()
-	for i := range flag.Args() {
-		processFile(flag.Args()[i])
+
+	flag.Usage = func() { usage() }
+	csv_base := flag.String("csv", "", "Write linked CSV files with this path prefix instead of JSONL to stdout")
+	input_glob := flag.String("input-glob", "", "Also read the bulk XML files matching this glob pattern (ex: 'arin_db/*.xml.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-arin-xml2json")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-arin-xml2json")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-arin-xml2json")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
 	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args(), *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	if len(inputs) == 0 {
+		usage()
+		os.Exit(1)
+	}
+
+	fds := []io.WriteCloser{}
+	if len(*csv_base) > 0 {
+		var e error
+		fds, e = createCSVOutputs(*csv_base)
+		if e != nil {
+			inetdata.Log.Errorf("%s", e)
+			os.Exit(1)
+		}
+	} else {
+		dest, e := inetdata.CreateOutput("")
+		if e != nil {
+			inetdata.Log.Errorf("%s", e)
+			os.Exit(1)
+		}
+		fds = append(fds, dest)
+		json_output = dest
+	}
+
+	progress := inetdata.NewProgress("inetdata-arin-xml2json", &input_count, nil)
+	progress.Format = *progress_format
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	for i := range inputs {
+		processFile(inputs[i], progress)
+	}
+
+	quit <- 0
+
+	exit_code := 0
+	for name, w := range csv_outputs {
+		w.Flush()
+		if e := w.Error(); e != nil {
+			inetdata.Log.Warnf("Failed to write %s output: %s", name, e)
+			exit_code = 1
+		}
+	}
+
+	// Uploads to object storage complete on close
+	for i := range fds {
+		if e := fds[i].Close(); e != nil {
+			inetdata.Log.Warnf("Failed to write output: %s", e)
+			exit_code = 1
+		}
+	}
+
+	if exit_code != 0 {
+		os.Exit(exit_code)
+	}
+
+	inetdata.CloseRejects()
+
+	inetdata.ExitIfInterrupted(*csv_base)
+	inetdata.CheckErrorBudget(input_count)
 }
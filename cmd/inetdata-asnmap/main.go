@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/asnmap"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+)
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <rib> ... <rib>")
+	fmt.Println("")
+	fmt.Println("Builds a prefix to origin ASN map from BGP RIB dumps in MRT format (RouteViews rib.*,")
+	fmt.Println("RIPE RIS bview.*) or CAIDA prefix2as files, and writes it in the prefix2as format:")
+	fmt.Println("the prefix address, length, and origins, separated by tabs. The origin of a route is the")
+	fmt.Println("last AS of its path; prefixes seen with several origins list them with underscores,")
+	fmt.Println("the origin seen by the most peers first. Inputs may be compressed.")
+	fmt.Println("")
+	fmt.Println("The output can be loaded much faster than a RIB dump by inetdata-enrich -asnmap, which")
+	fmt.Println("appends the origin and the longest matching prefix of an address to each line. With")
+	fmt.Println("-lookup, the addresses are looked up instead, and written as ip,origins,prefix.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	format := flag.String("format", "auto", "The input format: auto, mrt, or pfx2as")
+	lookup := flag.String("lookup", "", "Look up these comma-separated addresses instead of writing the map")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddOutputFlags()
+
+	inetdata.ParseFlags("inetdata-asnmap")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-asnmap")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-asnmap")
+
+	if !inetdata.ValidASNMapFormat(*format) {
+		inetdata.Log.Errorf("Invalid input format specified: %s", *format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if len(flag.Args()) == 0 {
+		usage()
+		os.Exit(1)
+	}
+
+	// The progress counts the bytes of the dumps while they load
+	progress := inetdata.NewProgress("inetdata-asnmap", nil, nil)
+	progress.Input = &progress.Bytes
+	progress.Format = *progress_format
+	progress.Unit = "bytes"
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	t, e := inetdata.LoadASNMap(flag.Args(), *format, progress.CountReader)
+	quit <- 0
+	if e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+	inetdata.Log.Infof("Loaded %d prefixes", t.Len())
+
+	inetdata.ExitIfInterrupted()
+
+	w, e := inetdata.CreateOutput("")
+	if e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if len(*lookup) > 0 {
+		for _, addr := range strings.Split(*lookup, ",") {
+			addr = strings.TrimSpace(addr)
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				inetdata.Log.Errorf("Invalid address: %s", addr)
+				os.Exit(1)
+			}
+			origins, prefix := "", ""
+			if ent, ok := t.Lookup(ip); ok {
+				origins, prefix = ent.OriginString(), ent.Prefix.String()
+			}
+			io.WriteString(w, addr+","+origins+","+prefix+"\n")
+		}
+	} else if e := asnmap.WritePrefix2AS(w, t); e != nil {
+		inetdata.Log.Errorf("Failed to write output: %s", e)
+		os.Exit(1)
+	}
+
+	if e := w.Close(); e != nil {
+		inetdata.Log.Errorf("Failed to write output: %s", e)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/hll"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var output_count int64 = 0
+var input_count int64 = 0
+var invalid_count int64 = 0
+var wg sync.WaitGroup
+
+var key_field = 1
+var value_fields []int
+var splitter *inetdata.FieldSplitter
+var selector *inetdata.FieldSelector
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] [<input> ... <input>]")
+	fmt.Println("       " + os.Args[0] + " [options] -merge <sketch> ... <sketch>")
+	fmt.Println("")
+	fmt.Println("Estimates the number of unique keys of the input, and with -c, the number of unique")
+	fmt.Println("values of each selected field, using HyperLogLog sketches. The key is field -k split on")
+	fmt.Println("the delimiter -d, or the whole line with -k 0. Each estimate is written as name,estimate,")
+	fmt.Println("where the name is key and field<N> for the fields of -c. The standard error is about")
+	fmt.Println("1.04/sqrt(2^precision), 0.8% with the default -precision of 14.")
+	fmt.Println("")
+	fmt.Println("With -save, the sketches are also written to a file. Sketches are mergeable: with -merge,")
+	fmt.Println("the arguments are sketch files instead of inputs, the sketches with the same name are")
+	fmt.Println("combined, and the estimates are those of the union of the inputs, so that per-shard or")
+	fmt.Println("per-day runs can be combined without reading the data again.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+// Return the names of the sketches, the key first
+func sketchNames() []string {
+	names := []string{"key"}
+	for _, f := range value_fields {
+		names = append(names, "field"+strconv.Itoa(f))
+	}
+	return names
+}
+
+func newSketches(precision int) ([]*hll.Sketch, error) {
+	sketches := []*hll.Sketch{}
+	for _, name := range sketchNames() {
+		s, e := hll.New(name, precision)
+		if e != nil {
+			return nil, e
+		}
+		sketches = append(sketches, s)
+	}
+	return sketches, nil
+}
+
+func inputParser(c <-chan string, sketches []*hll.Sketch) {
+
+	fields := key_field
+	for _, f := range value_fields {
+		if f > fields {
+			fields = f
+		}
+	}
+
+	for r := range c {
+
+		raw := strings.TrimRight(r, "\r")
+		if len(raw) == 0 {
+			continue
+		}
+
+		atomic.AddInt64(&input_count, 1)
+
+		if selector != nil {
+			sel, e := selector.Apply(raw)
+			if e != nil {
+				atomic.AddInt64(&invalid_count, 1)
+				inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, raw)
+				continue
+			}
+			raw = sel
+		}
+
+		if fields == 0 {
+			sketches[0].AddString(raw)
+			continue
+		}
+
+		bits, e := splitter.Split(raw, fields+1)
+		if e != nil || len(bits) < fields {
+			atomic.AddInt64(&invalid_count, 1)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, raw)
+			continue
+		}
+
+		if key_field > 0 {
+			sketches[0].AddString(bits[key_field-1])
+		} else {
+			sketches[0].AddString(raw)
+		}
+
+		for i, f := range value_fields {
+			sketches[i+1].AddString(bits[f-1])
+		}
+	}
+	wg.Done()
+}
+
+// Merge the sketches with the same name, in the order the names are first seen
+func mergeSketches(all []*hll.Sketch) ([]*hll.Sketch, error) {
+	merged := []*hll.Sketch{}
+	by_name := make(map[string]*hll.Sketch)
+
+	for _, s := range all {
+		m, ok := by_name[s.Name]
+		if !ok {
+			m, _ = hll.New(s.Name, s.Precision())
+			by_name[s.Name] = m
+			merged = append(merged, m)
+		}
+		if e := m.Merge(s); e != nil {
+			return nil, fmt.Errorf("sketch %s: %s", s.Name, e)
+		}
+	}
+	return merged, nil
+}
+
+func writeEstimates(sketches []*hll.Sketch) error {
+	w, e := inetdata.CreateOutput("")
+	if e != nil {
+		return e
+	}
+	for _, s := range sketches {
+		io.WriteString(w, splitter.Join(s.Name, strconv.FormatUint(s.Estimate(), 10))+"\n")
+		output_count++
+	}
+	return w.Close()
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	index_key := flag.Int("k", 1, "The field index of the key, 0 uses the whole line")
+	index_vals := flag.String("c", "", "A comma-separated list of field indexes to also estimate the unique values of (ex: 2,3)")
+	delimiter := flag.String("d", ",", "The delimiter to use as a field separator")
+	csv_strict := flag.Bool("csv-strict", false, "Parse the input as RFC 4180 CSV, allowing quoted fields that contain the delimiter")
+	csv_quote := flag.String("csv-quote", "\"", "The quote character for -csv-strict")
+	csv_escape := flag.String("csv-escape", "", "The escape character for quotes in -csv-strict fields (defaults to doubling the quote)")
+	precision := flag.Int("precision", hll.DEFAULT_PRECISION, fmt.Sprintf("The sketch precision, from %d to %d, using 2^precision bytes per sketch", hll.MIN_PRECISION, hll.MAX_PRECISION))
+	save_path := flag.String("save", "", "Write the sketches to this file (ex: fdns-2025-10-01"+hll.EXTENSION+")")
+	merge_mode := flag.Bool("merge", false, "Merge the sketch files given as arguments instead of reading input")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddSampleFlags()
+	inetdata.AddSelectFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-cardinality")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-cardinality")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-cardinality")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if *index_key < 0 {
+		inetdata.Log.Errorf("-k must not be negative")
+		usage()
+		os.Exit(1)
+	}
+
+	if len(*index_vals) > 0 {
+		fields, fe := inetdata.ParseFieldList(*index_vals)
+		if fe != nil {
+			inetdata.Log.Errorf("%s", fe)
+			usage()
+			os.Exit(1)
+		}
+		value_fields = fields
+	}
+
+	fs, fe := inetdata.NewFieldSplitter(inetdata.UnescapeDelimiter(*delimiter), *csv_strict, *csv_quote, *csv_escape)
+	if fe != nil {
+		inetdata.Log.Errorf("%s", fe)
+		usage()
+		os.Exit(1)
+	}
+
+	splitter = fs
+
+	sel, se := inetdata.NewFieldSelector(fs)
+	if se != nil {
+		inetdata.Log.Errorf("%s", se)
+		usage()
+		os.Exit(1)
+	}
+	selector = sel
+	key_field = *index_key
+
+	if *merge_mode {
+		if len(flag.Args()) == 0 {
+			inetdata.Log.Errorf("-merge requires at least one sketch file")
+			usage()
+			os.Exit(1)
+		}
+
+		all := []*hll.Sketch{}
+		for _, path := range flag.Args() {
+			sketches, e := hll.Load(path)
+			if e != nil {
+				inetdata.Log.Errorf("%s", e)
+				os.Exit(1)
+			}
+			all = append(all, sketches...)
+		}
+
+		merged, e := mergeSketches(all)
+		if e != nil {
+			inetdata.Log.Errorf("%s", e)
+			os.Exit(1)
+		}
+
+		if len(*save_path) > 0 {
+			if e := hll.Save(*save_path, merged); e != nil {
+				inetdata.Log.Errorf("%s", e)
+				os.Exit(1)
+			}
+		}
+
+		if e := writeEstimates(merged); e != nil {
+			inetdata.Log.Errorf("Failed to write output: %s", e)
+			os.Exit(1)
+		}
+		return
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args(), *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	// Each parser fills its own sketches, which are merged at the end
+	parser_sketches := [][]*hll.Sketch{}
+	for i := 0; i < inetdata.Workers; i++ {
+		sketches, e := newSketches(*precision)
+		if e != nil {
+			inetdata.Log.Errorf("%s", e)
+			usage()
+			os.Exit(1)
+		}
+		parser_sketches = append(parser_sketches, sketches)
+	}
+
+	progress := inetdata.NewProgress("inetdata-cardinality", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.Errors = &invalid_count
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	// Parse stdin
+	c_inp := make(chan string, inetdata.QueueDepth)
+	progress.AddStage("input", func() int { return len(c_inp) })
+
+	for i := 0; i < inetdata.Workers; i++ {
+		go inputParser(c_inp, parser_sketches[i])
+		wg.Add(1)
+	}
+
+	// Reader closes c_inp on completion
+	e := inetdata.ReadLinesFromInputs(inputs, *input_compression, progress.CountReader, c_inp)
+	if e != nil {
+		inetdata.Log.Warnf("Failed to read input: %s", e)
+	}
+
+	wg.Wait()
+
+	all := []*hll.Sketch{}
+	for _, sketches := range parser_sketches {
+		all = append(all, sketches...)
+	}
+	merged, _ := mergeSketches(all)
+
+	quit <- 0
+
+	inetdata.CloseRejects()
+
+	// Estimates of a partial input would be misleading
+	inetdata.ExitIfInterrupted()
+	inetdata.CheckErrorBudget(input_count)
+
+	if len(*save_path) > 0 {
+		if e := hll.Save(*save_path, merged); e != nil {
+			inetdata.Log.Errorf("%s", e)
+			os.Exit(1)
+		}
+	}
+
+	if e := writeEstimates(merged); e != nil {
+		inetdata.Log.Errorf("Failed to write output: %s", e)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/dnsname"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var output_count int64 = 0
+var input_count int64 = 0
+var invalid_count int64 = 0
+var wg sync.WaitGroup
+
+var normalize bool
+
+// The kinds of inputs
+var input_kinds = []string{"certs", "ja3", "jarm"}
+
+// The hex lengths of the fingerprints of each kind
+var fingerprint_lengths = map[string]int{"ja3": 32, "jarm": 62}
+
+// Quotes the issuer in the keys of the serial-hosts output
+var key_splitter *inetdata.FieldSplitter
+
+// The outputs of each kind of input
+var output_keys = map[string][]string{
+	"certs": {"spki-hosts", "serial-hosts"},
+	"ja3":   {"ja3-hosts"},
+	"jarm":  {"jarm-hosts"},
+}
+
+var outputs = map[string]*inetdata.SortedOutput{}
+
+// A certificate of a line of inetdata-ct2csv
+type ctCert struct {
+	SPKISHA256 string `json:"spki_sha256"`
+	Issuer     string `json:"issuer"`
+	Serial     string `json:"serial"`
+}
+
+type ctCerts struct {
+	Certs []ctCert `json:"certs"`
+}
+
+// A line of an input of a kind
+type pivotLine struct {
+	kind string
+	line string
+}
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <base> [<input> ... <input>]")
+	fmt.Println("")
+	fmt.Println("Reads certificate and TLS fingerprint records and writes pivot tables, sorted and")
+	fmt.Println("deduplicated CSVs that key the hosts by the infrastructure they share:")
+	fmt.Println("")
+	fmt.Println("  <base>-spki-hosts.csv.gz   : spki_sha256,host for the hosts of each public key")
+	fmt.Println("  <base>-serial-hosts.csv.gz : \"serial/issuer\",host for the hosts of each certificate")
+	fmt.Println("                               serial number, with the issuer distinguished name quoted")
+	fmt.Println("  <base>-ja3-hosts.csv.gz    : ja3,host for the JA3 fingerprints of the ja3 inputs")
+	fmt.Println("  <base>-jarm-hosts.csv.gz   : jarm,host for the JARM fingerprints of the jarm inputs")
+	fmt.Println("")
+	fmt.Println("Certs inputs are the output of inetdata-ct2csv with -fields spki_sha256,issuer,serial,")
+	fmt.Println("and ja3 and jarm inputs have host,fingerprint lines. The kind of each input is taken")
+	fmt.Println("from its file name (scan_certs.gz, _ja3, _jarm), or set for all inputs with -type.")
+	fmt.Println("Only the outputs of the kinds that are read are written. The outputs can be loaded")
+	fmt.Println("with inetdata-csv2mtbl to look up the hosts of a key, certificate, or server.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+// Return the kind of an input from its name, or an empty string. The
+// longest kind is tried first, since _ja3 does not match _jarm.
+func inputKind(path string) string {
+	name := strings.ToLower(filepath.Base(path))
+	for _, kind := range []string{"certs", "jarm", "ja3"} {
+		if strings.Contains(name, "_"+kind) {
+			return kind
+		}
+	}
+	return ""
+}
+
+// Return a host in canonical form, or false if it is not a name or address
+func hostName(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+	if ip := net.ParseIP(name); ip != nil {
+		return ip.String(), true
+	}
+	if !dnsname.ValidHostname(strings.TrimPrefix(name, "*.")) {
+		return "", false
+	}
+	if !normalize {
+		return name, true
+	}
+	n, e := dnsname.Normalize(name)
+	return n, e == nil
+}
+
+// Return a lowercase hex value of a length, or false
+func hexValue(s string, length int) (string, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if len(s) != length {
+		return "", false
+	}
+	if _, e := hex.DecodeString(s); e != nil {
+		return "", false
+	}
+	return s, true
+}
+
+func reject(reason string, line string) {
+	atomic.AddInt64(&invalid_count, 1)
+	inetdata.Rejects.Reject(reason, line)
+}
+
+func parseCerts(raw string) {
+	bits := strings.SplitN(raw, "\t", 2)
+	if len(bits) != 2 {
+		reject(inetdata.REJECT_INVALID_LINE, raw)
+		return
+	}
+
+	// The lines keyed by certificate hash repeat the certificates of the
+	// names they are keyed by
+	if inetdata.Match_SHA1.MatchString(bits[0]) {
+		return
+	}
+
+	host, ok := hostName(bits[0])
+	if !ok {
+		reject(inetdata.REJECT_INVALID_NAME, raw)
+		return
+	}
+
+	var certs ctCerts
+	if e := json.Unmarshal([]byte(bits[1]), &certs); e != nil {
+		reject(inetdata.REJECT_INVALID_JSON, raw)
+		return
+	}
+
+	found := false
+	for _, c := range certs.Certs {
+		if spki, ok := hexValue(c.SPKISHA256, 64); ok {
+			outputs["spki-hosts"].Add(spki + "," + host)
+			found = true
+		}
+		if len(c.Serial) > 0 && len(c.Issuer) > 0 {
+			key := strings.ToLower(c.Serial) + "/" + c.Issuer
+			outputs["serial-hosts"].Add(key_splitter.Join(key, host))
+			found = true
+		}
+	}
+
+	if !found {
+		reject(inetdata.REJECT_MISSING_FIELD, raw)
+		return
+	}
+	atomic.AddInt64(&input_count, 1)
+}
+
+func parseFingerprint(kind string, raw string) {
+	bits := strings.Split(raw, ",")
+	if len(bits) < 2 {
+		reject(inetdata.REJECT_INVALID_LINE, raw)
+		return
+	}
+
+	host, ok := hostName(bits[0])
+	if !ok {
+		reject(inetdata.REJECT_INVALID_NAME, raw)
+		return
+	}
+
+	fp, ok := hexValue(bits[1], fingerprint_lengths[kind])
+	if !ok {
+		reject(inetdata.REJECT_INVALID_LINE, raw)
+		return
+	}
+
+	// A server that did not complete any handshake has an all zero JARM
+	if strings.Trim(fp, "0") == "" {
+		return
+	}
+
+	atomic.AddInt64(&input_count, 1)
+	outputs[kind+"-hosts"].Add(fp + "," + host)
+}
+
+func inputParser(c <-chan pivotLine) {
+	defer wg.Done()
+
+	for r := range c {
+		raw := strings.TrimRight(r.line, "\r")
+		if len(raw) == 0 {
+			continue
+		}
+
+		switch r.kind {
+		case "certs":
+			parseCerts(raw)
+		case "ja3", "jarm":
+			parseFingerprint(r.kind, raw)
+		}
+	}
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	input_type := flag.String("type", "", "The kind of every input: certs, ja3, or jarm (default from the file names)")
+	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
+	sort_mem := flag.Uint64("sort-mem", 1, "The maximum amount of memory to use, in gigabytes, for the sorting phase of each output")
+	normalized := flag.Bool("normalize", false, "Encode internationalized names as punycode and skip invalid names")
+	output_compression := flag.String("output-compression", "gzip", "The output compression: none, gzip, zstd, or lz4")
+	compression_level := flag.Int("compression-level", -1, "The output compression level, -1 uses the default for the codec")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddSampleFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-cert2pivots")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-cert2pivots")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-cert2pivots")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidOutputCompression(*output_compression) {
+		inetdata.Log.Errorf("Invalid output compression specified: %s", *output_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if len(*input_type) > 0 && inputKind("_"+*input_type) != *input_type {
+		inetdata.Log.Errorf("Invalid input type specified: %s", *input_type)
+		usage()
+		os.Exit(1)
+	}
+
+	normalize = *normalized
+	key_splitter, _ = inetdata.NewFieldSplitter(",", true, "\"", "")
+
+	if len(flag.Args()) < 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args()[1:], *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	// Group the inputs by kind, in the order they are given
+	kinds := []string{}
+	by_kind := map[string][]string{}
+	for _, path := range inputs {
+		kind := *input_type
+		if len(kind) == 0 {
+			kind = inputKind(path)
+		}
+		if len(kind) == 0 {
+			inetdata.Log.Errorf("Can not tell the kind of %s, use -type", path)
+			os.Exit(1)
+		}
+		if _, ok := by_kind[kind]; !ok {
+			kinds = append(kinds, kind)
+		}
+		by_kind[kind] = append(by_kind[kind], path)
+	}
+
+	// Standard input is read as the kind set with -type
+	if len(inputs) == 0 {
+		if len(*input_type) == 0 {
+			inetdata.Log.Errorf("The kind of the standard input must be set with -type")
+			os.Exit(1)
+		}
+		kinds = []string{*input_type}
+	}
+
+	if len(*sort_tmp) == 0 {
+		*sort_tmp = os.Getenv("HOME")
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	base := flag.Args()[0]
+	ext := ".csv" + inetdata.OutputCompressionExtension(*output_compression)
+	out_names := []string{}
+
+	sorted := []*inetdata.SortedOutput{}
+	for _, kind := range kinds {
+		for _, key := range output_keys[kind] {
+			name := base + "-" + key + ext
+			o, e := inetdata.NewSortedOutput(name, *output_compression, *compression_level, *sort_tmp, *sort_mem*1024*1024*1024, &output_count)
+			if e != nil {
+				inetdata.Log.Errorf("failed to create %s: %s", name, e)
+				os.Exit(1)
+			}
+			outputs[key] = o
+			sorted = append(sorted, o)
+			out_names = append(out_names, name)
+		}
+	}
+
+	progress := inetdata.NewProgress("inetdata-cert2pivots", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.Errors = &invalid_count
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	// Parse the inputs
+	c_inp := make(chan pivotLine, inetdata.QueueDepth)
+	progress.AddStage("input", func() int { return len(c_inp) })
+
+	for i := 0; i < inetdata.Workers; i++ {
+		go inputParser(c_inp)
+		wg.Add(1)
+	}
+
+	// Read each kind of input in turn, tagging its lines with the kind
+	for _, kind := range kinds {
+		c_raw := make(chan string, inetdata.QueueDepth)
+		done := make(chan bool)
+		go func(kind string) {
+			for line := range c_raw {
+				c_inp <- pivotLine{kind: kind, line: line}
+			}
+			done <- true
+		}(kind)
+
+		e := inetdata.ReadLinesFromInputs(by_kind[kind], *input_compression, progress.CountReader, c_raw)
+		<-done
+		if e != nil {
+			inetdata.Log.Warnf("Failed to read input: %s", e)
+		}
+	}
+	close(c_inp)
+
+	wg.Wait()
+
+	// The sorters write their output once their input is closed
+	failed := false
+	for _, o := range sorted {
+		if e := o.Close(); e != nil {
+			inetdata.Log.Warnf("Failed to write %s: %s", o.Path, e)
+			failed = true
+		}
+	}
+
+	quit <- 0
+
+	inetdata.CloseRejects()
+
+	if failed {
+		os.Exit(1)
+	}
+
+	inetdata.ExitIfInterrupted(out_names...)
+	inetdata.CheckErrorBudget(input_count)
+}
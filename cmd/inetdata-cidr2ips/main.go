@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var output_count int64 = 0
+var input_count int64 = 0
+var invalid_count int64 = 0
+var skipped_count int64 = 0
+var wg sync.WaitGroup
+
+var key_field = 1
+var delimiter = ","
+var keep_line = false
+var max_ips *big.Int
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] [<input> ... <input>]")
+	fmt.Println("")
+	fmt.Println("Expands the CIDRs in field -k of each input line into one line per IP address. The field")
+	fmt.Println("may also hold a bare IP address or an inclusive range (ex: 192.0.2.0-192.0.2.9). With")
+	fmt.Println("-keep, the original line is appended to each address, which is useful for joining")
+	fmt.Println("allocations (ex: rir2csv output) against per-IP datasets.")
+	fmt.Println("")
+	fmt.Println("Networks with more than -max-ips addresses are skipped with a warning, so that a stray")
+	fmt.Println("IPv6 prefix or /0 does not produce an endless stream of output.")
+	fmt.Println("")
+	fmt.Println("With -aggregate, the input is instead a list of addresses, CIDRs, or ranges, which are")
+	fmt.Println("collapsed into the minimal set of CIDRs covering them. Overlapping and adjacent entries")
+	fmt.Println("are merged as they are read, so the input must be sorted numerically, unless -sort is")
+	fmt.Println("specified, which performs an external merge sort using temporary files in -t.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+// Parse a CIDR, bare IP address, or inclusive range into its first and last address
+func parseRange(s string) (net.IP, net.IP, error) {
+	if idx := strings.Index(s, "-"); idx >= 0 {
+		s_ip := net.ParseIP(strings.TrimSpace(s[:idx]))
+		e_ip := net.ParseIP(strings.TrimSpace(s[idx+1:]))
+		if s_ip == nil || e_ip == nil {
+			return nil, nil, errors.New("invalid IP range")
+		}
+
+		// Ranges may not span address families
+		if s4, e4 := s_ip.To4(), e_ip.To4(); s4 != nil && e4 != nil {
+			s_ip, e_ip = s4, e4
+		} else if (s4 == nil) != (e4 == nil) {
+			return nil, nil, errors.New("invalid IP range")
+		}
+
+		if bytes.Compare(s_ip, e_ip) > 0 {
+			return nil, nil, errors.New("start address is bigger than end address")
+		}
+		return s_ip, e_ip, nil
+	}
+
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, nil, errors.New("invalid IP address")
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return ip, ip, nil
+	}
+
+	_, n, e := net.ParseCIDR(s)
+	if e != nil {
+		return nil, nil, e
+	}
+
+	s_ip, e_ip := inetdata.CIDRRange(n)
+	return s_ip, e_ip, nil
+}
+
+func expandParser(c <-chan string, o io.Writer) {
+
+	for r := range c {
+
+		raw := strings.TrimSpace(r)
+		if len(raw) == 0 {
+			continue
+		}
+
+		atomic.AddInt64(&input_count, 1)
+
+		bits := strings.SplitN(raw, delimiter, key_field+1)
+		if len(bits) < key_field {
+			inetdata.Log.Warnf("Invalid line: %q", raw)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, raw)
+			atomic.AddInt64(&invalid_count, 1)
+			continue
+		}
+
+		s_ip, e_ip, e := parseRange(strings.TrimSpace(bits[key_field-1]))
+		if e != nil {
+			inetdata.Log.Warnf("Invalid network %q: %s", bits[key_field-1], e)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_NETWORK, raw)
+			atomic.AddInt64(&invalid_count, 1)
+			continue
+		}
+
+		size := new(big.Int).Sub(new(big.Int).SetBytes(e_ip), new(big.Int).SetBytes(s_ip))
+		size.Add(size, big.NewInt(1))
+		if size.Cmp(max_ips) > 0 {
+			inetdata.Log.Warnf("Skipping %s with %s addresses (-max-ips is %s)", bits[key_field-1], size, max_ips)
+			inetdata.Rejects.Reject(inetdata.REJECT_TOO_LARGE, raw)
+			atomic.AddInt64(&skipped_count, 1)
+			continue
+		}
+
+		suffix := "\n"
+		if keep_line {
+			suffix = delimiter + raw + "\n"
+		}
+
+		for ip := s_ip; ; ip = inetdata.NextIP(ip) {
+			io.WriteString(o, ip.String()+suffix)
+			atomic.AddInt64(&output_count, 1)
+			if ip.Equal(e_ip) {
+				break
+			}
+		}
+	}
+	wg.Done()
+}
+
+// Encode a range as a line that sorts numerically by start address
+func encodeRange(s_ip net.IP, e_ip net.IP) string {
+	return string(inetdata.EncodeIPKey(s_ip, "hex")) + "," + string(inetdata.EncodeIPKey(e_ip, "hex"))
+}
+
+func decodeRange(line string) (net.IP, net.IP, error) {
+	bits := strings.SplitN(line, ",", 2)
+	if len(bits) != 2 {
+		return nil, nil, errors.New("invalid encoded range")
+	}
+
+	s_ip, s_ok := inetdata.DecodeIPKey([]byte(bits[0]), "hex")
+	e_ip, e_ok := inetdata.DecodeIPKey([]byte(bits[1]), "hex")
+	if !s_ok || !e_ok {
+		return nil, nil, errors.New("invalid encoded range")
+	}
+	return s_ip, e_ip, nil
+}
+
+// Parse each input line into an encoded range for the sorter or the aggregator
+func rangeParser(c <-chan string, o chan<- string) {
+
+	for r := range c {
+
+		raw := strings.TrimSpace(r)
+		if len(raw) == 0 {
+			continue
+		}
+
+		atomic.AddInt64(&input_count, 1)
+
+		bits := strings.SplitN(raw, delimiter, key_field+1)
+		if len(bits) < key_field {
+			inetdata.Log.Warnf("Invalid line: %q", raw)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, raw)
+			atomic.AddInt64(&invalid_count, 1)
+			continue
+		}
+
+		s_ip, e_ip, e := parseRange(strings.TrimSpace(bits[key_field-1]))
+		if e != nil {
+			inetdata.Log.Warnf("Invalid network %q: %s", bits[key_field-1], e)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_NETWORK, raw)
+			atomic.AddInt64(&invalid_count, 1)
+			continue
+		}
+
+		o <- encodeRange(s_ip, e_ip)
+	}
+	close(o)
+	wg.Done()
+}
+
+// Collapse sorted ranges into CIDRs, merging entries that overlap or are adjacent
+func aggregator(c <-chan string, o io.Writer) {
+
+	var c_start, c_end net.IP
+	unsorted := false
+
+	flush := func() {
+		if c_start == nil {
+			return
+		}
+		cidrs, e := inetdata.IPRange2CIDRs(c_start, c_end)
+		if e != nil {
+			inetdata.Log.Warnf("Invalid range %s-%s: %s", c_start, c_end, e)
+			return
+		}
+		for _, cidr := range cidrs {
+			io.WriteString(o, cidr.String()+"\n")
+			atomic.AddInt64(&output_count, 1)
+		}
+	}
+
+	for line := range c {
+		s_ip, e_ip, e := decodeRange(line)
+		if e != nil {
+			atomic.AddInt64(&invalid_count, 1)
+			continue
+		}
+
+		if c_start != nil && len(s_ip) == len(c_start) {
+			if bytes.Compare(s_ip, c_start) < 0 {
+				unsorted = true
+			} else if bytes.Compare(s_ip, c_end) <= 0 || s_ip.Equal(inetdata.NextIP(c_end)) {
+				// Overlaps or is adjacent to the current range
+				if bytes.Compare(e_ip, c_end) > 0 {
+					c_end = e_ip
+				}
+				continue
+			}
+		}
+
+		flush()
+		c_start, c_end = s_ip, e_ip
+	}
+	flush()
+
+	if unsorted {
+		inetdata.Log.Warnf("The input was not sorted numerically, the output may not be minimal (see -sort)")
+	}
+	wg.Done()
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	aggregate := flag.Bool("aggregate", false, "Collapse the input addresses, CIDRs, and ranges into a minimal list of CIDRs")
+	index_key := flag.Int("k", 1, "The field index of the CIDR, address, or range")
+	field_delimiter := flag.String("d", ",", "The delimiter to use as a field separator")
+	keep := flag.Bool("keep", false, "Append the original line to each expanded address")
+	cap_ips := flag.String("max-ips", "16777216", "Skip networks with more than this many addresses")
+	sort_input := flag.Bool("sort", false, "Sort the input internally for -aggregate instead of requiring numerically sorted input")
+	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
+	sort_mem := flag.Uint64("sort-mem", 1, "The maximum amount of memory to use, in gigabytes, for the sorting phase")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddSampleFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-cidr2ips")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-cidr2ips")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-cidr2ips")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if *index_key < 1 {
+		inetdata.Log.Errorf("-k must be positive")
+		usage()
+		os.Exit(1)
+	}
+
+	limit, ok := new(big.Int).SetString(*cap_ips, 10)
+	if !ok || limit.Sign() < 1 {
+		inetdata.Log.Errorf("Invalid -max-ips specified: %s", *cap_ips)
+		usage()
+		os.Exit(1)
+	}
+
+	if *sort_input && !*aggregate {
+		inetdata.Log.Errorf("-sort requires -aggregate")
+		usage()
+		os.Exit(1)
+	}
+
+	if *keep && *aggregate {
+		inetdata.Log.Errorf("-keep cannot be combined with -aggregate")
+		usage()
+		os.Exit(1)
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args(), *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	key_field = *index_key
+	delimiter = inetdata.UnescapeDelimiter(*field_delimiter)
+	keep_line = *keep
+	max_ips = limit
+
+	if len(delimiter) == 0 {
+		inetdata.Log.Errorf("the delimiter (-d) must not be empty")
+		usage()
+		os.Exit(1)
+	}
+
+	if len(*sort_tmp) == 0 {
+		*sort_tmp = os.Getenv("HOME")
+	}
+
+	progress := inetdata.NewProgress("inetdata-cidr2ips", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.Errors = &invalid_count
+	progress.AddCounter("skipped", &skipped_count)
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	output, oe := inetdata.CreateOutput("")
+	if oe != nil {
+		inetdata.Log.Errorf("%s", oe)
+		os.Exit(1)
+	}
+
+	// Parse stdin
+	c_inp := make(chan string, inetdata.QueueDepth)
+	progress.AddStage("input", func() int { return len(c_inp) })
+
+	if *aggregate {
+		c_rng := make(chan string, inetdata.QueueDepth)
+		c_agg := c_rng
+
+		go rangeParser(c_inp, c_rng)
+		wg.Add(1)
+
+		// The sorter sits between the parser and the aggregator
+		if *sort_input {
+			c_agg = make(chan string, inetdata.QueueDepth)
+			go func() {
+				if e := inetdata.ExternalSort(c_rng, c_agg, *sort_tmp, *sort_mem*1024*1024*1024); e != nil {
+					inetdata.Log.Warnf("Failed to sort input: %s", e)
+				}
+			}()
+		}
+
+		go aggregator(c_agg, output)
+		wg.Add(1)
+	} else {
+		// A single parser keeps the output in input order
+		go expandParser(c_inp, output)
+		wg.Add(1)
+	}
+
+	// Reader closes c_inp on completion
+	e := inetdata.ReadLinesFromInputs(inputs, *input_compression, progress.CountReader, c_inp)
+	if e != nil {
+		inetdata.Log.Warnf("Failed to read input: %s", e)
+	}
+
+	wg.Wait()
+
+	if e := output.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+	}
+
+	quit <- 0
+
+	inetdata.CloseRejects()
+
+	inetdata.ExitIfInterrupted()
+	inetdata.CheckErrorBudget(input_count)
+}
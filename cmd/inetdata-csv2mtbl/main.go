@@ -4,26 +4,41 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
-	"github.com/fathom6/golang-mtbl"
 	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/mtbl"
+	"github.com/fathom6/inetdata-parsers/mtblutil"
 	"os"
 	"runtime"
 	"strings"
+	"sync/atomic"
 )
 
+var output_count int64 = 0
+var input_count int64 = 0
+var invalid_count int64 = 0
+
 func usage() {
-	fmt.Println("Usage: " + os.Args[0] + " [options]")
+	fmt.Println("Usage: " + os.Args[0] + " [options] <output.mtbl> [<input> ... <input>]")
+	fmt.Println("")
+	fmt.Println("Creates a MTBL database from a CSV input. The value can be built from multiple")
+	fmt.Println("fields by passing a list of indexes to -v (ex: -v 2,4), which are joined with the delimiter.")
+	fmt.Println("")
+	fmt.Println("Lines are split naively on the delimiter. With -csv-strict, lines are parsed as RFC 4180")
+	fmt.Println("CSV and quoted fields are stored unquoted. Joined values are quoted where necessary.")
+	fmt.Println("")
+	fmt.Println("With -ip-key binary or hex, keys must be IPv4 or IPv6 addresses and are stored as a")
+	fmt.Println("family byte followed by the address in network byte order (or the same bytes in hex),")
+	fmt.Println("so that keys sort numerically and IPv4 sorts before IPv6. Lines with other keys are")
+	fmt.Println("skipped. Use mq -ip-key with the same format to query and decode the database.")
 	fmt.Println("")
-	fmt.Println("Creates a MTBL database from a CSV input.")
+	fmt.Println("With -checkpoint-file, the sorted records are committed to part files next to the output")
+	fmt.Println("every -checkpoint-interval input lines. A run restarted with the same arguments skips the")
+	fmt.Println("committed lines and merges the parts into the output when it completes.")
 	fmt.Println("")
 	fmt.Println("Options:")
 	flag.PrintDefaults()
 }
 
-func mergeFunc(key []byte, val0 []byte, val1 []byte) (mergedVal []byte) {
-	return []byte(string(val0) + " " + string(val1))
-}
-
 func main() {
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
@@ -32,31 +47,162 @@ func main() {
 	flag.Usage = func() { usage() }
 
 	index_key := flag.Int("k", 1, "The field index to use as the key")
-	index_val := flag.Int("v", 2, "The field index to use as the value")
+	index_vals := flag.String("v", "2", "The field index, or comma-separated list of indexes, to use as the value")
 	reverse_key := flag.Bool("r", false, "Store the key in reverse order")
+	reverse_labels := flag.Bool("L", false, "Store the key with domain labels in reverse order (www.example.com -> com.example.www)")
+	ip_key := flag.String("ip-key", "none", "Encode IP address keys for numeric ordering: none, binary, or hex")
 	max_fields := flag.Int("M", -1, "The maximum number of fields to parse with the delimiter")
-	compression := flag.String("c", "snappy", "The compression type to use (none, snappy, zlib, lz4, lz4hc)")
+	compression := flag.String("c", "snappy", "The compression type to use (none, snappy, zlib, lz4, lz4hc, zstd)")
 	delimiter := flag.String("d", ",", "The delimiter to use as a field separator")
+	csv_strict := flag.Bool("csv-strict", false, "Parse the input as RFC 4180 CSV, allowing quoted fields that contain the delimiter")
+	csv_quote := flag.String("csv-quote", "\"", "The quote character for -csv-strict")
+	csv_escape := flag.String("csv-escape", "", "The escape character for quotes in -csv-strict fields (defaults to doubling the quote)")
+	block_size := flag.Uint64("b", 0, "The MTBL block size in bytes, 0 uses the library default")
 	sort_skip := flag.Bool("S", false, "Skip the sorting phase and assume keys are in pre-sorted order")
 	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
 	sort_mem := flag.Uint64("m", 1, "The maximum amount of memory to use, in gigabytes, for the sorting phase")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	checkpoint_file := flag.String("checkpoint-file", "", "Commit progress to this file and resume from it when restarted")
+	checkpoint_interval := flag.Int64("checkpoint-interval", 10000000, "The number of input lines between checkpoints")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
 	version := flag.Bool("version", false, "Show the version and build timestamp")
 
-	flag.Parse()
+	inetdata.AddTuningFlags()
+	inetdata.AddSampleFlags()
+	inetdata.AddSelectFlags()
+	inetdata.AddRejectFlags()
+	inetdata.AddBloomFlags()
+	inetdata.AddMetaFlags()
+
+	inetdata.ParseFlags("inetdata-csv2mtbl")
 
 	if *version {
 		inetdata.PrintVersion("inetdata-csv2mtbl")
 		os.Exit(0)
 	}
 
-	if len(flag.Args()) != 1 {
+	inetdata.HandleSignals("inetdata-csv2mtbl")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidBloomFPR(inetdata.BloomFPR) {
+		inetdata.Log.Errorf("Invalid Bloom filter false positive rate specified: %v", inetdata.BloomFPR)
 		usage()
 		os.Exit(1)
 	}
 
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if *reverse_key && *reverse_labels {
+		inetdata.Log.Errorf("Only one of -r and -L can be specified")
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidIPKeyFormat(*ip_key) {
+		inetdata.Log.Errorf("Invalid IP key format specified: %s", *ip_key)
+		usage()
+		os.Exit(1)
+	}
+
+	if *ip_key != "none" && (*reverse_key || *reverse_labels) {
+		inetdata.Log.Errorf("-ip-key cannot be combined with -r or -L")
+		os.Exit(1)
+	}
+
+	if len(flag.Args()) < 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args()[1:], *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
 	fname := flag.Args()[0]
 
-	sort_opt := mtbl.SorterOptions{Merge: mergeFunc, MaxMemory: 1000000000}
+	var cp *inetdata.Checkpoint
+	var skip_lines int64 = 0
+
+	if len(*checkpoint_file) > 0 {
+		if *sort_skip {
+			inetdata.Log.Errorf("-checkpoint-file cannot be combined with -S")
+			os.Exit(1)
+		}
+		if *checkpoint_interval < 1 {
+			inetdata.Log.Errorf("-checkpoint-interval must be at least 1")
+			os.Exit(1)
+		}
+
+		var ce error
+		cp, ce = inetdata.OpenCheckpoint(*checkpoint_file, inputs)
+		if ce != nil {
+			inetdata.Log.Errorf("%s", ce)
+			os.Exit(1)
+		}
+
+		skip_lines, _ = cp.Offset("lines")
+		if cp.Resumed() {
+			inetdata.Log.Infof("Resuming from line %d with %d committed parts", skip_lines, len(cp.PartNames()))
+		}
+	}
+
+	*delimiter = inetdata.UnescapeDelimiter(*delimiter)
+
+	splitter, se := inetdata.NewFieldSplitter(*delimiter, *csv_strict, *csv_quote, *csv_escape)
+	if se != nil {
+		inetdata.Log.Errorf("%s", se)
+		os.Exit(1)
+	}
+
+	selector, le := inetdata.NewFieldSelector(splitter)
+	if le != nil {
+		inetdata.Log.Errorf("%s", le)
+		os.Exit(1)
+	}
+
+	val_fields, fe := inetdata.ParseFieldList(*index_vals)
+	if fe != nil {
+		inetdata.Log.Errorf("%s", fe)
+		os.Exit(1)
+	}
+
+	max_val_field := 0
+	for _, i := range val_fields {
+		if i > max_val_field {
+			max_val_field = i
+		}
+	}
+
+	sort_opt := mtbl.SorterOptions{Merge: mtblutil.MergeSpace, MaxMemory: 1000000000}
 	sort_opt.MaxMemory *= *sort_mem
 	if len(*sort_tmp) > 0 {
 		sort_opt.TempDir = *sort_tmp
@@ -64,37 +210,106 @@ func main() {
 
 	compression_alg, ok := inetdata.MTBLCompressionTypes[*compression]
 	if !ok {
-		fmt.Fprintf(os.Stderr, "Invalid compression algorithm: %s\n", *compression)
+		inetdata.Log.Errorf("Invalid compression algorithm: %s", *compression)
 		os.Exit(1)
 	}
 
-	s := mtbl.SorterInit(&sort_opt)
-	defer s.Destroy()
+	w_opt := mtbl.WriterOptions{Compression: compression_alg}
+	if *block_size > 0 {
+		w_opt.BlockSize = *block_size
+	}
+
+	s := inetdata.NewMTBLPartSorter(fname, cp, sort_opt, w_opt)
+
+	// Pre-sorted input is written directly
+	var w *mtbl.Writer
+	if *sort_skip {
+		var we error
+		w, we = mtbl.WriterInit(fname, &w_opt)
+		if we != nil {
+			inetdata.Log.Errorf("%s", we)
+			os.Exit(1)
+		}
+	}
 
-	w, we := mtbl.WriterInit(fname, &mtbl.WriterOptions{Compression: compression_alg})
-	defer w.Destroy()
+	progress := inetdata.NewProgress("inetdata-csv2mtbl", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.Errors = &invalid_count
 
-	if we != nil {
-		fmt.Fprintf(os.Stderr, "Error: %s\n", we)
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	input, ie := inetdata.OpenInputs(inputs, *input_compression, progress.CountReader)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
 		os.Exit(1)
 	}
 
-	scanner := bufio.NewScanner(os.Stdin)
+	var lines int64 = 0
+
+	scanner := bufio.NewScanner(input)
 	for scanner.Scan() {
+		if inetdata.Interrupted() {
+			break
+		}
+
+		lines++
+		if lines <= skip_lines {
+			continue
+		}
+
+		if cp != nil && lines%*checkpoint_interval == 0 {
+			if e := s.Commit("lines", lines-1); e != nil {
+				inetdata.Log.Errorf("Failed to commit the checkpoint: %s", e)
+				os.Exit(1)
+			}
+		}
+
 		raw := strings.TrimSpace(scanner.Text())
 		if len(raw) == 0 {
 			continue
 		}
 
-		bits := strings.SplitN(raw, *delimiter, *max_fields)
+		atomic.AddInt64(&input_count, 1)
+
+		if selector != nil {
+			sel, le := selector.Apply(raw)
+			if le != nil {
+				inetdata.Log.Warnf("Invalid line: %s: %s", le, raw)
+				atomic.AddInt64(&invalid_count, 1)
+				inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, raw)
+				continue
+			}
+			raw = sel
+		}
+
+		bits, se := splitter.Split(raw, *max_fields)
+		if se != nil {
+			inetdata.Log.Warnf("Invalid line: %s: %s", se, raw)
+			atomic.AddInt64(&invalid_count, 1)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, raw)
+			continue
+		}
 
 		if len(bits) < *index_key {
-			fmt.Fprintf(os.Stderr, "No key: %s\n", raw)
+			inetdata.Log.Warnf("No key: %s", raw)
+			atomic.AddInt64(&invalid_count, 1)
+			inetdata.Rejects.Reject(inetdata.REJECT_MISSING_FIELD, raw)
 			continue
 		}
 
-		if len(bits) < *index_val {
-			fmt.Fprintf(os.Stderr, "No value: %s\n", raw)
+		if len(bits) < max_val_field {
+			inetdata.Log.Warnf("No value: %s", raw)
+			atomic.AddInt64(&invalid_count, 1)
+			inetdata.Rejects.Reject(inetdata.REJECT_MISSING_FIELD, raw)
 			continue
 		}
 
@@ -103,30 +318,97 @@ func main() {
 			continue
 		}
 
-		vstr := bits[*index_val-1]
+		vstr := bits[val_fields[0]-1]
+		if len(val_fields) > 1 {
+			vbits := make([]string, len(val_fields))
+			for i, idx := range val_fields {
+				vbits[i] = bits[idx-1]
+			}
+			vstr = splitter.Join(vbits...)
+		}
+
 		if len(vstr) == 0 {
 			continue
 		}
 
+		if *reverse_labels {
+			kstr = inetdata.ReverseLabels(kstr)
+		}
+
 		if *reverse_key {
 			kstr = inetdata.ReverseKey(kstr)
 		}
 
+		kbytes := []byte(kstr)
+		if *ip_key != "none" {
+			enc, ke := inetdata.EncodeIPKeyString(kstr, *ip_key)
+			if ke != nil {
+				inetdata.Log.Warnf("Invalid IP key: %s", raw)
+				atomic.AddInt64(&invalid_count, 1)
+				inetdata.Rejects.Reject(inetdata.REJECT_INVALID_KEY, raw)
+				continue
+			}
+			kbytes = enc
+		}
+
 		if *sort_skip {
-			if e := w.Add([]byte(kstr), []byte(vstr)); e != nil {
+			if e := w.Add(kbytes, []byte(vstr)); e != nil {
 				fmt.Printf("Failed to add %v -> %v: %v\n", kstr, vstr, e)
+				continue
 			}
 		} else {
-			if e := s.Add([]byte(kstr), []byte(vstr)); e != nil {
+			if e := s.Add(kbytes, []byte(vstr)); e != nil {
 				fmt.Printf("Failed to add %v -> %v: %v\n", kstr, vstr, e)
+				continue
 			}
 		}
+		atomic.AddInt64(&output_count, 1)
+	}
+
+	if e := scanner.Err(); e != nil {
+		inetdata.Log.Errorf("Failed to read input: %s", e)
+		os.Exit(1)
+	}
+
+	// An interrupted run commits its progress for the next run to resume
+	if cp != nil && inetdata.Interrupted() {
+		if e := s.Commit("lines", lines); e != nil {
+			inetdata.Log.Errorf("Failed to commit the checkpoint: %s", e)
+			os.Exit(1)
+		}
+		inetdata.Log.Infof("Committed %d lines to %s", lines, *checkpoint_file)
+		quit <- 0
+		inetdata.CloseRejects()
+		os.Exit(inetdata.EXIT_INTERRUPTED)
 	}
 
-	if !*sort_skip {
-		if e := s.Write(w); e != nil {
-			fmt.Fprintf(os.Stderr, "Error: %s\n", e)
+	if *sort_skip {
+		w.Destroy()
+	} else {
+		if e := s.Finish(); e != nil {
+			inetdata.Log.Errorf("%s", e)
 			os.Exit(1)
 		}
 	}
+
+	if cp != nil {
+		cp.Remove()
+	}
+
+	quit <- 0
+
+	inetdata.CloseRejects()
+
+	inetdata.ExitIfInterrupted(fname)
+	inetdata.CheckErrorBudget(lines)
+
+	if e := inetdata.WriteMTBLBloom(fname); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if e := inetdata.WriteMTBLMeta("inetdata-csv2mtbl", fname); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
 }
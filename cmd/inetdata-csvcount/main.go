@@ -0,0 +1,364 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"hash/fnv"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var output_count int64 = 0
+var input_count int64 = 0
+var invalid_count int64 = 0
+var spill_count int64 = 0
+var wg sync.WaitGroup
+var pwg sync.WaitGroup
+
+var key_field = 0
+var count_field = 0
+var min_count int64 = 1
+var splitter *inetdata.FieldSplitter
+var selector *inetdata.FieldSelector
+
+// With -topk, the heavy hitters of each partition
+var top_n = 0
+var top_items []inetdata.TopKItem
+var top_lock sync.Mutex
+
+// An item and the amount to add to its count
+type countItem struct {
+	item string
+	n    int64
+}
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] [<input> ... <input>]")
+	fmt.Println("")
+	fmt.Println("Counts the distinct items of the input and writes item,count lines, like")
+	fmt.Println("`sort | uniq -c` without sorting the input. The item is the whole line, or field -k")
+	fmt.Println("split on the delimiter -d. With -v, field -v holds a count to add instead of 1, so that")
+	fmt.Println("the output of earlier runs can be combined.")
+	fmt.Println("")
+	fmt.Println("Items are hashed into -workers partitions, each counted in memory by its own worker.")
+	fmt.Println("Once the partitions hold -sort-mem gigabytes, their counts are spilled to sorted runs in")
+	fmt.Println("-t and merged at the end. Output lines are written in no particular order, except that")
+	fmt.Println("the items of a partition that spilled are written in byte order.")
+	fmt.Println("")
+	fmt.Println("With -topk N, only the N most frequent items are written, highest count first. They are")
+	fmt.Println("found in one pass with a fixed number of counters per partition (Space-Saving), without")
+	fmt.Println("spilling, so the counts are approximate: an item may be counted too high, never too low.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+func writeOutput(o chan string, q chan bool) {
+	w, e := inetdata.CreateOutput("")
+	if e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+	for r := range o {
+		io.WriteString(w, r)
+	}
+	if e := w.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+	}
+	q <- true
+}
+
+func inputParser(c <-chan string, parts []chan countItem) {
+
+	for r := range c {
+
+		raw := strings.TrimRight(r, "\r")
+		if len(raw) == 0 {
+			continue
+		}
+
+		atomic.AddInt64(&input_count, 1)
+
+		if selector != nil {
+			sel, e := selector.Apply(raw)
+			if e != nil {
+				atomic.AddInt64(&invalid_count, 1)
+				inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, raw)
+				continue
+			}
+			raw = sel
+		}
+
+		item := countItem{item: raw, n: 1}
+
+		if key_field > 0 || count_field > 0 {
+			fields := key_field
+			if count_field > fields {
+				fields = count_field
+			}
+
+			bits, e := splitter.Split(raw, fields+1)
+			if e != nil || len(bits) < fields {
+				atomic.AddInt64(&invalid_count, 1)
+				inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, raw)
+				continue
+			}
+
+			if key_field > 0 {
+				item.item = bits[key_field-1]
+			}
+
+			if count_field > 0 {
+				n, e := strconv.ParseInt(strings.TrimSpace(bits[count_field-1]), 10, 64)
+				if e != nil {
+					atomic.AddInt64(&invalid_count, 1)
+					inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, raw)
+					continue
+				}
+				item.n = n
+			}
+		}
+
+		h := fnv.New32a()
+		io.WriteString(h, item.item)
+		parts[h.Sum32()%uint32(len(parts))] <- item
+	}
+	wg.Done()
+}
+
+// Count the items of a partition and write them once the input is done
+func partitionCounter(c <-chan countItem, o chan<- string, tmpdir string, max_mem uint64) {
+	defer pwg.Done()
+
+	if top_n > 0 {
+		top := inetdata.NewTopK(top_n)
+		for item := range c {
+			top.Add(item.item, item.n)
+		}
+		top_lock.Lock()
+		top_items = append(top_items, top.Top()...)
+		top_lock.Unlock()
+		return
+	}
+
+	counter := inetdata.NewCounter(tmpdir, max_mem)
+	defer counter.Close()
+
+	failed := false
+	for item := range c {
+		if failed {
+			continue
+		}
+
+		spills := counter.Spills()
+		if e := counter.Add(item.item, item.n); e != nil {
+			inetdata.Log.Warnf("Failed to spill counts: %s", e)
+			atomic.AddInt64(&invalid_count, 1)
+			failed = true
+			continue
+		}
+		if counter.Spills() > spills {
+			atomic.AddInt64(&spill_count, 1)
+		}
+	}
+
+	if failed {
+		return
+	}
+
+	e := counter.Emit(func(item string, count int64) error {
+		if count < min_count {
+			return nil
+		}
+		o <- splitter.Join(item, strconv.FormatInt(count, 10)) + "\n"
+		atomic.AddInt64(&output_count, 1)
+		return nil
+	})
+	if e != nil {
+		inetdata.Log.Warnf("Failed to merge spilled counts: %s", e)
+		atomic.AddInt64(&invalid_count, 1)
+	}
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	index_key := flag.Int("k", 0, "The field index of the item, 0 counts whole lines")
+	index_count := flag.Int("v", 0, "The field index of a count to add for each line, 0 adds 1")
+	delimiter := flag.String("d", ",", "The delimiter to use as a field separator")
+	csv_strict := flag.Bool("csv-strict", false, "Parse the input as RFC 4180 CSV, quoting output items where necessary")
+	csv_quote := flag.String("csv-quote", "\"", "The quote character for -csv-strict")
+	csv_escape := flag.String("csv-escape", "", "The escape character for quotes in -csv-strict fields (defaults to doubling the quote)")
+	topk := flag.Int("topk", 0, "Only write the N most frequent items, with approximate counts, highest first (0 writes all items)")
+	minimum := flag.Int64("min-count", 1, "Only write the items counted at least this many times")
+	sort_tmp := flag.String("t", "", "The temporary directory to use for spilled counts")
+	sort_mem := flag.Uint64("sort-mem", 1, "The maximum amount of memory to use, in gigabytes, before counts are spilled")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddSampleFlags()
+	inetdata.AddSelectFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-csvcount")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-csvcount")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-csvcount")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if *index_key < 0 || *index_count < 0 || *topk < 0 || *sort_mem < 1 {
+		inetdata.Log.Errorf("-k, -v, and -topk must not be negative and -sort-mem must be positive")
+		usage()
+		os.Exit(1)
+	}
+
+	if *index_count > 0 && *index_count == *index_key {
+		inetdata.Log.Errorf("-k and -v must be different fields")
+		usage()
+		os.Exit(1)
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args(), *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	fs, fe := inetdata.NewFieldSplitter(inetdata.UnescapeDelimiter(*delimiter), *csv_strict, *csv_quote, *csv_escape)
+	if fe != nil {
+		inetdata.Log.Errorf("%s", fe)
+		usage()
+		os.Exit(1)
+	}
+
+	splitter = fs
+
+	sel, se := inetdata.NewFieldSelector(fs)
+	if se != nil {
+		inetdata.Log.Errorf("%s", se)
+		usage()
+		os.Exit(1)
+	}
+	selector = sel
+	key_field = *index_key
+	count_field = *index_count
+	min_count = *minimum
+	top_n = *topk
+
+	progress := inetdata.NewProgress("inetdata-csvcount", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.Errors = &invalid_count
+	progress.AddCounter("spills", &spill_count)
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	// Output writer
+	outl := make(chan string, inetdata.QueueDepth)
+	outq := make(chan bool, 1)
+	go writeOutput(outl, outq)
+
+	// Partition counters, which share the memory limit
+	part_mem := *sort_mem * 1024 * 1024 * 1024 / uint64(inetdata.Workers)
+	parts := make([]chan countItem, inetdata.Workers)
+	for i := range parts {
+		parts[i] = make(chan countItem, inetdata.QueueDepth)
+		go partitionCounter(parts[i], outl, *sort_tmp, part_mem)
+		pwg.Add(1)
+	}
+
+	// Parse stdin
+	c_inp := make(chan string, inetdata.QueueDepth)
+	progress.AddStage("input", func() int { return len(c_inp) })
+
+	for i := 0; i < inetdata.Workers; i++ {
+		go inputParser(c_inp, parts)
+		wg.Add(1)
+	}
+
+	// Reader closes c_inp on completion
+	e := inetdata.ReadLinesFromInputs(inputs, *input_compression, progress.CountReader, c_inp)
+	if e != nil {
+		inetdata.Log.Warnf("Failed to read input: %s", e)
+	}
+
+	wg.Wait()
+
+	for i := range parts {
+		close(parts[i])
+	}
+	pwg.Wait()
+
+	// The partitions counted disjoint items, so their heavy hitters are combined
+	for _, t := range inetdata.TopKItems(top_items, top_n) {
+		if t.Count < min_count {
+			continue
+		}
+		outl <- splitter.Join(t.Item, strconv.FormatInt(t.Count, 10)) + "\n"
+		atomic.AddInt64(&output_count, 1)
+	}
+
+	close(outl)
+	<-outq
+
+	quit <- 0
+
+	inetdata.CloseRejects()
+
+	inetdata.ExitIfInterrupted()
+	inetdata.CheckErrorBudget(input_count)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+var output_count int64 = 0
+var input_count int64 = 0
+var invalid_count int64 = 0
+
+// The number of keys that were added, removed, or changed
+var added_count int64 = 0
+var removed_count int64 = 0
+var changed_count int64 = 0
+
+var splitter *inetdata.FieldSplitter
+
+// The changes that are written, see -only
+var changes = map[string]bool{"added": true, "removed": true, "changed": true}
+
+var keys_only bool
+var ignore_order bool
+var merge_delimiter = "\x00"
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <old> <new>")
+	fmt.Println("")
+	fmt.Println("Compares two CSV inputs of key,value rows, such as the rollups of two FDNS drops, and")
+	fmt.Println("writes the keys that differ as key,change,old value,new value, where change is one of:")
+	fmt.Println("")
+	fmt.Println("  added   : the key is only in the new input, and the old value is empty")
+	fmt.Println("  removed : the key is only in the old input, and the new value is empty")
+	fmt.Println("  changed : the key is in both inputs with different values")
+	fmt.Println("")
+	fmt.Println("Both inputs must be sorted by the first field in byte order (LC_ALL=C sort -t , -k 1,1),")
+	fmt.Println("which is checked as they are read, and are compared in a single streaming pass. The rows")
+	fmt.Println("of a key that appears more than once are merged with the -m separator. Either input may")
+	fmt.Println("be - to read from stdin.")
+	fmt.Println("")
+	fmt.Println("With -ignore-order, values are split on the -m separator of the merged values of")
+	fmt.Println("inetdata-csvrollup and compared as sets, so that a key whose values were merged in a")
+	fmt.Println("different order is not changed. With -only, only some of the changes are written, and")
+	fmt.Println("with -keys-only, only the key and change (ex: -only added -keys-only for new names).")
+	fmt.Println("")
+	fmt.Println("Lines are split naively on the delimiter. With -csv-strict, the key is parsed as a CSV")
+	fmt.Println("field, so quoted keys may contain the delimiter, and the values are quoted as needed.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+// Read the value of the current key of an input, merging its rows, and leave
+// the input at the next key
+func group(r *inetdata.SortedKeyReader) (string, string, error) {
+	key, rows, e := r.Group()
+	return key, strings.Join(rows, merge_delimiter), e
+}
+
+// Return the form of a value that is compared, with its merged values
+// sorted and deduplicated for -ignore-order
+func compareValue(value string) string {
+	if !ignore_order {
+		return value
+	}
+
+	values := strings.Split(value, merge_delimiter)
+	sort.Strings(values)
+
+	unique := values[:0]
+	for i, v := range values {
+		if i == 0 || v != values[i-1] {
+			unique = append(unique, v)
+		}
+	}
+	return strings.Join(unique, merge_delimiter)
+}
+
+func writeChange(w io.Writer, key string, change string, old string, cur string, count *int64) {
+	atomic.AddInt64(count, 1)
+	if !changes[change] {
+		return
+	}
+
+	line := splitter.Join(key, change)
+	if !keys_only {
+		line = splitter.Join(key, change, old, cur)
+	}
+	io.WriteString(w, line+"\n")
+	atomic.AddInt64(&output_count, 1)
+}
+
+func diff(old *inetdata.SortedKeyReader, cur *inetdata.SortedKeyReader, w io.Writer) error {
+	if e := old.Next(); e != nil {
+		return e
+	}
+	if e := cur.Next(); e != nil {
+		return e
+	}
+
+	for old.Ok() || cur.Ok() {
+		switch {
+		case old.Ok() && cur.Ok() && old.Key() == cur.Key():
+			key, old_value, e := group(old)
+			if e != nil {
+				return e
+			}
+			_, cur_value, e := group(cur)
+			if e != nil {
+				return e
+			}
+			if compareValue(old_value) != compareValue(cur_value) {
+				writeChange(w, key, "changed", old_value, cur_value, &changed_count)
+			}
+
+		case !cur.Ok() || (old.Ok() && old.Less(cur)):
+			key, old_value, e := group(old)
+			if e != nil {
+				return e
+			}
+			writeChange(w, key, "removed", old_value, "", &removed_count)
+
+		default:
+			key, cur_value, e := group(cur)
+			if e != nil {
+				return e
+			}
+			writeChange(w, key, "added", "", cur_value, &added_count)
+		}
+	}
+
+	return nil
+}
+
+func openSide(path string, codec string, wrap func(io.Reader) io.Reader) (io.Reader, error) {
+	if path == "-" {
+		return inetdata.OpenInputs(nil, codec, wrap)
+	}
+	return inetdata.OpenInputs([]string{path}, codec, wrap)
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	only := flag.String("only", "added,removed,changed", "Only write these comma-separated changes: added, removed, or changed")
+	keys := flag.Bool("keys-only", false, "Write only the key and change of each difference, without the values")
+	ignore := flag.Bool("ignore-order", false, "Compare the merged values of a key as sets, ignoring their order and duplicates")
+	merge_sep := flag.String("m", "\\x00", "The separator of merged values, for -ignore-order and keys with several rows")
+	delimiter := flag.String("d", ",", "The delimiter to use as a field separator")
+	csv_strict := flag.Bool("csv-strict", false, "Parse the key as an RFC 4180 CSV field, allowing quoted keys that contain the delimiter")
+	csv_quote := flag.String("csv-quote", "\"", "The quote character for -csv-strict")
+	csv_escape := flag.String("csv-escape", "", "The escape character for quotes in -csv-strict fields (defaults to doubling the quote)")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-csvdiff")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-csvdiff")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-csvdiff")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	selected := map[string]bool{}
+	for _, change := range strings.Split(*only, ",") {
+		change = strings.TrimSpace(change)
+		if !changes[change] {
+			inetdata.Log.Errorf("Invalid change specified: %s", change)
+			usage()
+			os.Exit(1)
+		}
+		selected[change] = true
+	}
+	changes = selected
+
+	if len(flag.Args()) != 2 {
+		usage()
+		os.Exit(1)
+	}
+
+	if flag.Args()[0] == "-" && flag.Args()[1] == "-" {
+		inetdata.Log.Errorf("Only one input can be read from stdin")
+		os.Exit(1)
+	}
+
+	fs, fe := inetdata.NewFieldSplitter(inetdata.UnescapeDelimiter(*delimiter), *csv_strict, *csv_quote, *csv_escape)
+	if fe != nil {
+		inetdata.Log.Errorf("%s", fe)
+		usage()
+		os.Exit(1)
+	}
+	splitter = fs
+
+	keys_only = *keys
+	ignore_order = *ignore
+	merge_delimiter = inetdata.UnescapeDelimiter(*merge_sep)
+
+	progress := inetdata.NewProgress("inetdata-csvdiff", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.Errors = &invalid_count
+	progress.AddCounter("added", &added_count)
+	progress.AddCounter("removed", &removed_count)
+	progress.AddCounter("changed", &changed_count)
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	sides := make([]*inetdata.SortedKeyReader, 2)
+	for i, path := range flag.Args() {
+		r, e := openSide(path, *input_compression, progress.CountReader)
+		if e != nil {
+			inetdata.Log.Errorf("%s", e)
+			os.Exit(1)
+		}
+		if c, ok := r.(io.Closer); ok {
+			defer c.Close()
+		}
+		name := path
+		if path == "-" {
+			name = "stdin"
+		}
+		sides[i] = inetdata.NewSortedKeyReader(name, r, splitter, &input_count, &invalid_count)
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	w, we := inetdata.CreateOutput("")
+	if we != nil {
+		inetdata.Log.Errorf("%s", we)
+		os.Exit(1)
+	}
+
+	exit_code := 0
+	if e := diff(sides[0], sides[1], w); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		exit_code = 1
+	}
+
+	if e := w.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+		exit_code = 1
+	}
+
+	quit <- 0
+
+	if exit_code == 0 {
+		inetdata.Log.Infof("Found %d added, %d removed, and %d changed keys", added_count, removed_count, changed_count)
+
+		inetdata.CloseRejects()
+
+		inetdata.ExitIfInterrupted()
+		inetdata.CheckErrorBudget(input_count)
+	}
+
+	os.Exit(exit_code)
+}
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/rollup"
+	"io"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
-	"time"
 )
 
 var output_count int64 = 0
@@ -17,89 +21,378 @@ var input_count int64 = 0
 var stdout_lock sync.Mutex
 var wg sync.WaitGroup
 
+var key_delimiter = ","
+var key_splitter *inetdata.FieldSplitter
+var selector *inetdata.FieldSelector
+var merge_delimiter = "\x00"
+
+var roller *rollup.Rollup
+
+var output_jsonl = false
+
+// Read key,timestamp,value records and track when each value was seen
+var timestamps = false
+
+// Encode IP address keys as hex so that the output sorts numerically
+var ip_key_hex = false
+
+// Keys with more values than this are spilled, 0 disables spilling
+var max_values_per_key = 0
+var spill_dir = ""
+var spill_mem uint64 = 0
+var spill_count int64 = 0
+
+// Set with -topk to count the records of each key and keep the most frequent
+var top *inetdata.TopK
+
 type OutputKey struct {
 	Key  string
 	Vals []string
+
+	// Set for keys whose values were spilled
+	Spill *spilledKey
+
+	// Set instead of Vals with -timestamps
+	History *rollup.History
+}
+
+type OutputJSON struct {
+	Key    string   `json:"key"`
+	Values []string `json:"values"`
 }
 
 func usage() {
-	fmt.Println("Usage: " + os.Args[0] + " [options]")
+	fmt.Println("Usage: " + os.Args[0] + " [options] [<input> ... <input>]")
 	fmt.Println("")
-	fmt.Println("Reads a pre-sorted (-u -t , -k 1) CSV from stdin, treats all bytes after the first comma")
+	fmt.Println("Reads a pre-sorted (-u -t , -k 1) CSV from stdin, treats all bytes after the first delimiter")
 	fmt.Println("as the value, merges values with the same key using a null byte, outputs an unsorted")
-	fmt.Println("merged CSV as output.")
+	fmt.Println("merged CSV as output. The delimiter and merge separator can be changed with -d and -m,")
+	fmt.Println("both accept escape sequences such as \\t and \\x00.")
+	fmt.Println("")
+	fmt.Println("The key is split off at the first delimiter. With -csv-strict, the key is parsed as a")
+	fmt.Println("CSV field instead, so quoted keys may contain the delimiter; such keys are quoted again")
+	fmt.Println("in the output. The value is always kept as-is.")
+	fmt.Println("")
+	fmt.Println("Input files may be given as arguments or with -input-glob instead of stdin. Files are")
+	fmt.Println("decompressed individually and read in order, arguments first and then glob matches in")
+	fmt.Println("lexical order, so range-partitioned sorted parts (ex: part-00000.gz) remain sorted. The")
+	fmt.Println("files must be sorted as a whole: the rollup fails if a file starts with a key that sorts")
+	fmt.Println("before the last key of the previous file.")
+	fmt.Println("")
+	fmt.Println("Shards that are each sorted, but overlap in key range, can be rolled up with -sharded,")
+	fmt.Println("which merges the input files like sort -m before the rollup.")
+	fmt.Println("")
+	fmt.Println("Unsorted input can be processed with -sort, which performs an external merge sort")
+	fmt.Println("using temporary files in the -t directory.")
+	fmt.Println("")
+	fmt.Println("With -timestamps, the input is key,timestamp,value and each merged value is written as")
+	fmt.Println("first-seen,last-seen,value, building a passive DNS style history of each key. Timestamps")
+	fmt.Println("are compared as integers (ex: Unix times) or, otherwise, lexically (ex: RFC 3339). Values")
+	fmt.Println("are written in the order they were first seen unless -sort-values is set.")
+	fmt.Println("")
+	fmt.Println("Instead of merging, values can be aggregated per key with -agg: count, first, last,")
+	fmt.Println("min, max (numbers by value before other values in byte order), or sum (numeric).")
+	fmt.Println("")
+	fmt.Println("With -topk N, the records of each key are counted instead, and only the N keys with the")
+	fmt.Println("most records are written as key,count, highest count first. The input does not need to")
+	fmt.Println("be sorted, and the keys are found in one pass with a fixed number of counters")
+	fmt.Println("(Space-Saving), so the counts are approximate: a key may be counted too high, never too")
+	fmt.Println("low.")
+	fmt.Println("")
+	fmt.Println("Keys with more than -max-values-per-key values are spilled: merged values are sorted")
+	fmt.Println("and deduplicated through temporary files in -spill-dir, using up to -sort-mem of memory,")
+	fmt.Println("and streamed to the output in sorted order. Other -agg modes aggregate spilled values as")
+	fmt.Println("they arrive.")
+	fmt.Println("")
+	fmt.Println("Merged values are written in no particular order unless -sort-values (byte order) or")
+	fmt.Println("-sort-values-numeric is set, which makes the output identical across runs. The latter")
+	fmt.Println("compares values field by field: IP addresses by value, then numbers by value, then other")
+	fmt.Println("fields in byte order. Keys are then written in input order by a single merger. Spilled")
+	fmt.Println("keys are always written in byte order.")
+	fmt.Println("")
+	fmt.Println("With -format jsonl each key is written as {\"key\": \"...\", \"values\": [...]} instead.")
+	fmt.Println("With -format parquet the keys are written as a Parquet file with a key column and a")
+	fmt.Println("values list column, compressed with -parquet-compression instead of -output-compression.")
+	fmt.Println("With -format pb the keys are written as length-delimited protobuf records with the key as")
+	fmt.Println("the only field and the merged values as values, see proto/record.proto.")
+	fmt.Println("")
+	fmt.Println("With -ip-key hex, IP address keys are written as a hex family byte and address, so that")
+	fmt.Println("sorting the output with LC_ALL=C sort orders addresses numerically. Other keys are kept")
+	fmt.Println("as-is. The binary format is not supported, since it would corrupt the text output.")
+	fmt.Println("")
+	fmt.Println("With -input, records are consumed from a stream instead of stdin and input files, and with")
+	fmt.Println("-output, the output is written to a file or stream instead of stdout. Streams are Kafka")
+	fmt.Println("topics (ex: kafka://broker:9092/topic?group=NAME), see the README for the URL options.")
 	fmt.Println("")
 	fmt.Println("Options:")
 	flag.PrintDefaults()
 }
 
-func showProgress(quit chan int) {
-	start := time.Now()
+// Converts JSONL output records into Parquet rows or protobuf records
+type recordOutput struct {
+	write   func(key string, vals []string) error
+	close   func() error
+	pending []byte
+}
+
+func (w *recordOutput) Write(b []byte) (int, error) {
+	w.pending = append(w.pending, b...)
+
 	for {
-		select {
-		case <-quit:
-			return
-		case <-time.After(time.Second * 1):
-			icount := atomic.LoadInt64(&input_count)
-			ocount := atomic.LoadInt64(&output_count)
-
-			if icount == 0 && ocount == 0 {
-				// Reset start, so that we show stats only from our first input
-				start = time.Now()
-				continue
-			}
-			elapsed := time.Since(start)
-			if elapsed.Seconds() > 1.0 {
-				fmt.Fprintf(os.Stderr, "[*] [inetdata-csvrollup] Read %d and wrote %d records in %d seconds (%d/s in, %d/s out)\n",
-					icount,
-					ocount,
-					int(elapsed.Seconds()),
-					int(float64(icount)/elapsed.Seconds()),
-					int(float64(ocount)/elapsed.Seconds()))
-			}
+		idx := bytes.IndexByte(w.pending, '\n')
+		if idx < 0 {
+			break
+		}
+
+		var o OutputJSON
+		e := json.Unmarshal(w.pending[:idx], &o)
+		w.pending = w.pending[idx+1:]
+		if e != nil {
+			return 0, e
+		}
+
+		if e := w.write(o.Key, o.Values); e != nil {
+			return 0, e
 		}
 	}
+
+	return len(b), nil
+}
+
+func (w *recordOutput) Close() error {
+	return w.close()
 }
 
-func writeOutput(o chan string, q chan bool) {
+func writeOutput(w io.Writer, o chan string, q chan bool) {
 	for r := range o {
-		os.Stdout.Write([]byte(r))
+		w.Write([]byte(r))
 	}
 	q <- true
 }
 
+// Encode the key for output
+func outputKey(key string) string {
+	if ip_key_hex {
+		if enc, e := inetdata.EncodeIPKeyString(key, "hex"); e == nil {
+			return string(enc)
+		}
+	}
+	return key
+}
+
+func formatOutput(key string, vals []string) (string, error) {
+	key = outputKey(key)
+	if !output_jsonl {
+		return key_splitter.QuoteField(key) + key_delimiter + strings.Join(vals, merge_delimiter) + "\n", nil
+	}
+
+	b, e := json.Marshal(OutputJSON{Key: key, Values: vals})
+	if e != nil {
+		return "", e
+	}
+	return string(b) + "\n", nil
+}
+
+func emitOutput(o chan string, key string, vals []string) {
+	line, e := formatOutput(key, vals)
+	if e != nil {
+		inetdata.Log.Warnf("Could not marshal %s: %s", key, e)
+		return
+	}
+	atomic.AddInt64(&output_count, 1)
+
+	// Spilled keys are sent in several parts, see emitStream
+	stdout_lock.Lock()
+	o <- line
+	stdout_lock.Unlock()
+}
+
+// A key with more than max_values_per_key values. In merge mode the values are
+// sorted and deduplicated through temporary files in spill_dir and streamed to
+// the output; other modes aggregate the values as they arrive.
+type spilledKey struct {
+	key    string
+	agg    *rollup.Aggregator
+	vals   chan string
+	sorted chan string
+	done   chan bool
+}
+
+func newSpilledKey(key string) *spilledKey {
+	atomic.AddInt64(&spill_count, 1)
+
+	s := &spilledKey{key: key, done: make(chan bool, 1)}
+	if roller.Mode != rollup.AGG_MODE_MERGE {
+		s.agg = rollup.NewAggregator(key, roller.Mode)
+		return s
+	}
+
+	s.vals = make(chan string, inetdata.QueueDepth)
+	s.sorted = make(chan string, inetdata.QueueDepth)
+
+	go func() {
+		if e := inetdata.ExternalSort(s.vals, s.sorted, spill_dir, spill_mem); e != nil {
+			inetdata.Log.Warnf("Failed to spill values for key %q: %s", key, e)
+		}
+	}()
+
+	return s
+}
+
+func (s *spilledKey) add(val string) {
+	for _, v := range strings.Split(val, merge_delimiter) {
+		if s.agg != nil {
+			s.agg.Add(v)
+		} else {
+			s.vals <- v
+		}
+	}
+}
+
+// Hand the key to the mergers and wait until it has been written, so that
+// only one spilled key is in flight at a time
+func (s *spilledKey) finish(outc chan<- OutputKey) {
+	if s.vals != nil {
+		close(s.vals)
+	}
+	outc <- OutputKey{Key: s.key, Spill: s}
+	<-s.done
+}
+
+func (s *spilledKey) emit(o chan string) {
+	if s.agg != nil {
+		emitOutput(o, s.key, []string{s.agg.Result()})
+	} else {
+		emitStream(o, s.key, s.sorted)
+	}
+	s.done <- true
+}
+
+// Write a single output record whose values arrive on a channel. The record is
+// sent to the writer in parts while holding the output lock, which keeps other
+// records from being interleaved.
+func emitStream(o chan string, key string, vals chan string) {
+	first, ok := <-vals
+	if !ok {
+		return
+	}
+
+	stdout_lock.Lock()
+	defer stdout_lock.Unlock()
+
+	key = outputKey(key)
+
+	var b strings.Builder
+
+	flush := func(force bool) {
+		if force || b.Len() >= 1024*1024 {
+			o <- b.String()
+			b.Reset()
+		}
+	}
+
+	if output_jsonl {
+		kb, _ := json.Marshal(key)
+		vb, _ := json.Marshal(first)
+		b.WriteString(`{"key":` + string(kb) + `,"values":[` + string(vb))
+		for v := range vals {
+			vb, _ = json.Marshal(v)
+			b.WriteString("," + string(vb))
+			flush(false)
+		}
+		b.WriteString("]}\n")
+	} else {
+		b.WriteString(key_splitter.QuoteField(key) + key_delimiter + first)
+		for v := range vals {
+			b.WriteString(merge_delimiter + v)
+			flush(false)
+		}
+		b.WriteString("\n")
+	}
+
+	flush(true)
+	atomic.AddInt64(&output_count, 1)
+}
+
 func mergeAndEmit(c chan OutputKey, o chan string) {
 
 	for r := range c {
 
-		unique := map[string]bool{}
+		if r.Spill != nil {
+			r.Spill.emit(o)
+			continue
+		}
 
-		for i := range r.Vals {
-			vals := strings.SplitN(r.Vals[i], "\x00", -1)
-			for v := range vals {
-				unique[vals[v]] = true
-			}
+		if r.History != nil {
+			emitOutput(o, r.Key, r.History.Values(roller.Sort, key_delimiter))
+			continue
 		}
 
-		out := make([]string, len(unique))
-		i := 0
-		for v := range unique {
-			out[i] = v
-			i++
+		vals := roller.Values(r.Key, r.Vals)
+		if vals == nil {
+			continue
 		}
-		atomic.AddInt64(&output_count, 1)
-		o <- fmt.Sprintf("%s,%s\n", r.Key, strings.Join(out, "\x00"))
+		emitOutput(o, r.Key, vals)
 	}
 
 	wg.Done()
 }
 
+// Select the fields of lines before they are sorted, so that the selected key
+// is the one sorted on
+func selectLines(sel *inetdata.FieldSelector, c <-chan string, out chan<- string) {
+	for r := range c {
+		raw := strings.TrimSpace(r)
+		if len(raw) == 0 {
+			continue
+		}
+
+		line, e := sel.Apply(raw)
+		if e != nil {
+			inetdata.Log.Warnf("Invalid line: %q", raw)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, raw)
+			continue
+		}
+		out <- line
+	}
+	close(out)
+}
+
+// The key of an input line as the parser sees it, or nil for an invalid line
+func inputKey(line []byte) []byte {
+	raw := strings.TrimSpace(string(line))
+	if selector != nil {
+		sel, e := selector.Apply(raw)
+		if e != nil {
+			return nil
+		}
+		raw = sel
+	}
+	bits, e := key_splitter.Split(raw, 2)
+	if e != nil || len(bits) < 2 || len(bits[0]) == 0 {
+		return nil
+	}
+	return []byte(bits[0])
+}
+
 func inputParser(c <-chan string, outc chan<- OutputKey) {
 
 	// Track current key and value array
 	ckey := ""
 	cval := []string{}
 
+	// Set once the current key has too many values to keep in memory
+	var spill *spilledKey
+
+	// The history of the current key with -timestamps
+	var hist *rollup.History
+
+	// The value is the last field, after the timestamp with -timestamps
+	fields := 2
+	if timestamps {
+		fields = 3
+	}
+
 	for r := range c {
 
 		raw := strings.TrimSpace(r)
@@ -107,22 +400,38 @@ func inputParser(c <-chan string, outc chan<- OutputKey) {
 			continue
 		}
 
-		bits := strings.SplitN(raw, ",", 2)
+		if selector != nil {
+			sel, e := selector.Apply(raw)
+			if e != nil {
+				inetdata.Log.Warnf("Invalid line: %q", raw)
+				inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, raw)
+				continue
+			}
+			raw = sel
+		}
+
+		bits, e := key_splitter.Split(raw, fields)
 
-		if len(bits) < 2 || len(bits[0]) == 0 {
-			fmt.Fprintf(os.Stderr, "[-] Invalid line: %q\n", raw)
+		if e != nil || len(bits) < fields || len(bits[0]) == 0 || len(bits[fields-2]) == 0 {
+			inetdata.Log.Warnf("Invalid line: %q", raw)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, raw)
 			continue
 		}
 
 		// Tons of records with a blank (".") DNS response, just ignore
-		if len(bits[1]) == 0 {
+		if len(bits[fields-1]) == 0 {
 			continue
 		}
 
 		atomic.AddInt64(&input_count, 1)
 
 		key := bits[0]
-		val := bits[1]
+		val := bits[fields-1]
+
+		if top != nil {
+			top.Add(key, 1)
+			continue
+		}
 
 		// First key hit
 		if ckey == "" {
@@ -131,43 +440,59 @@ func inputParser(c <-chan string, outc chan<- OutputKey) {
 
 		// Next key hit
 		if ckey != key {
-			outc <- OutputKey{Key: ckey, Vals: cval}
+			if hist != nil {
+				outc <- OutputKey{Key: ckey, History: hist}
+				hist = nil
+			} else if spill != nil {
+				spill.finish(outc)
+				spill = nil
+			} else {
+				outc <- OutputKey{Key: ckey, Vals: cval}
+			}
 			ckey = key
 			cval = []string{}
 		}
 
 		// Cleanup common scan artifacts, not comprehensive
-
-		// Ignore any records where key is empty or identical to the value (except NS)
-		if len(val) >= len(key) {
-			parts := strings.SplitN(val, ",", 2)
-			if len(parts) == 2 && parts[0] != "ns" {
-				if len(parts[1]) == 0 || key == parts[1] {
-					continue
-				}
-			}
-		}
-
-		// TXT records start with an erroneous pipe character
-		if len(val) > 5 && val[0:5] == "txt,|" {
-			val = "txt," + val[5:]
+		val, ok := rollup.CleanDNSValue(key, val)
+		if !ok {
+			continue
 		}
 
-		// DNSSEC-related TXT records often have trailing bytes
-		if len(val) >= 38 && (val[0:6] == "txt,31" || val[0:6] == "txt,00" || val[0:6] == "txt,aa") {
-			val = val[0:38]
+		if timestamps {
+			if hist == nil {
+				hist = rollup.NewHistory(key)
+			}
+			hist.Add(bits[1], val)
+			continue
 		}
 
-		// Mangled TXT value, ignore
-		if len(val) >= 5 && len(val) <= 10 && val[0:5] == "txt,~" {
+		if spill != nil {
+			spill.add(val)
 			continue
 		}
 
 		// New data value
 		cval = append(cval, val)
+
+		if max_values_per_key > 0 && len(cval) > max_values_per_key {
+			spill = newSpilledKey(ckey)
+			for i := range cval {
+				spill.add(cval[i])
+			}
+			cval = []string{}
+		}
 	}
 
-	if len(ckey) > 0 && len(cval) > 0 {
+	if top != nil {
+		for _, t := range top.Top() {
+			outc <- OutputKey{Key: t.Item, Vals: []string{strconv.FormatInt(t.Count, 10)}}
+		}
+	} else if hist != nil {
+		outc <- OutputKey{Key: ckey, History: hist}
+	} else if spill != nil {
+		spill.finish(outc)
+	} else if len(ckey) > 0 && len(cval) > 0 {
 		outc <- OutputKey{Key: ckey, Vals: cval}
 	}
 
@@ -181,43 +506,380 @@ func main() {
 	os.Setenv("LC_ALL", "C")
 
 	flag.Usage = func() { usage() }
+	delimiter := flag.String("d", ",", "The delimiter between the key and the value")
+	merge_sep := flag.String("m", "\\x00", "The separator to use when merging values")
+	csv_strict := flag.Bool("csv-strict", false, "Parse the key as an RFC 4180 CSV field, allowing quoted keys that contain the delimiter")
+	csv_quote := flag.String("csv-quote", "\"", "The quote character for -csv-strict")
+	csv_escape := flag.String("csv-escape", "", "The escape character for quotes in -csv-strict fields (defaults to doubling the quote)")
+	sort_input := flag.Bool("sort", false, "Sort the input internally instead of requiring pre-sorted input")
+	sharded := flag.Bool("sharded", false, "Merge the pre-sorted input files with a streaming k-way merge instead of concatenating them")
+	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
+	sort_mem := flag.Uint64("sort-mem", 1, "The maximum amount of memory to use, in gigabytes, for the sorting phase")
+	sort_lexical := flag.Bool("sort-values", false, "Write merged values in lexical order so that output is deterministic")
+	sort_numeric := flag.Bool("sort-values-numeric", false, "Write merged values in order, comparing IP addresses and numbers by value")
+	max_values := flag.Int("max-values-per-key", 0, "Spill the values of keys with more than this many values instead of holding them in memory (0 disables)")
+	spill_tmp := flag.String("spill-dir", "", "The temporary directory to use for spilled values (defaults to the -t directory)")
+	timestamps_mode := flag.Bool("timestamps", false, "Read key,timestamp,value records and write the first-seen and last-seen timestamps of each value")
+	topk := flag.Int("topk", 0, "Only write the N keys with the most records, with approximate counts, highest first (0 disables)")
+	selected_agg_mode := flag.String("agg", "merge", "The aggregation mode: merge, count, first, last, min, max, or sum")
+	ip_key := flag.String("ip-key", "none", "Encode IP address keys for numeric ordering: none or hex")
+	format := flag.String("format", "csv", "The output format: csv, jsonl, parquet, or pb")
+	parquet_compression := flag.String("parquet-compression", "zstd", "The parquet compression: none, snappy, gzip, or zstd")
+	parquet_row_group := flag.Int("parquet-row-group", 100000, "The maximum number of rows per parquet row group")
+	output_compression := flag.String("output-compression", "none", "The output compression: none, gzip, zstd, or lz4")
+	compression_level := flag.Int("compression-level", -1, "The output compression level, -1 uses the default for the codec")
+	input_stream := flag.String("input", "", "Read from this stream URL instead of stdin (ex: kafka://broker:9092/topic?group=NAME)")
+	output_path := flag.String("output", "", "Write to this file or stream URL instead of stdout (ex: kafka://broker:9092/topic)")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
 	version := flag.Bool("version", false, "Show the version and build timestamp")
 
-	flag.Parse()
+	inetdata.AddTuningFlags()
+	inetdata.AddSampleFlags()
+	inetdata.AddSelectFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddMetaFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-csvrollup")
 
 	if *version {
 		inetdata.PrintVersion("inetdata-csvrollup")
 		os.Exit(0)
 	}
 
+	inetdata.HandleSignals("inetdata-csvrollup")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args(), *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	if len(*input_stream) > 0 {
+		if !inetdata.IsStreamURL(*input_stream) || len(inputs) > 0 {
+			inetdata.Log.Errorf("-input must be a stream URL and cannot be combined with input files")
+			usage()
+			os.Exit(1)
+		}
+		inputs = []string{*input_stream}
+	}
+
+	if *sharded {
+		if *sort_input {
+			inetdata.Log.Errorf("-sharded and -sort are mutually exclusive")
+			usage()
+			os.Exit(1)
+		}
+		if len(inputs) == 0 {
+			inetdata.Log.Errorf("-sharded requires input files")
+			usage()
+			os.Exit(1)
+		}
+	}
+
+	if !inetdata.ValidOutputCompression(*output_compression) {
+		inetdata.Log.Errorf("Invalid output compression specified: %s", *output_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	switch *format {
+	case "csv":
+		output_jsonl = false
+	case "jsonl":
+		output_jsonl = true
+	case "parquet":
+		// Records are written as JSONL and converted to parquet rows
+		output_jsonl = true
+		if *output_compression != "none" {
+			inetdata.Log.Errorf("parquet output is compressed with -parquet-compression, not -output-compression")
+			usage()
+			os.Exit(1)
+		}
+		if !inetdata.ValidParquetCompression(*parquet_compression) {
+			inetdata.Log.Errorf("Invalid parquet compression specified: %s", *parquet_compression)
+			usage()
+			os.Exit(1)
+		}
+	case "pb":
+		output_jsonl = true
+	default:
+		inetdata.Log.Errorf("Invalid output format specified: %s", *format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidMetaOutput(*output_path) {
+		inetdata.Log.Errorf("-meta requires -output with a local file")
+		usage()
+		os.Exit(1)
+	}
+
+	dest, de := inetdata.CreateOutput(*output_path)
+	if de != nil {
+		inetdata.Log.Errorf("%s", de)
+		os.Exit(1)
+	}
+
+	var output io.WriteCloser
+	var oe error
+
+	switch *format {
+	case "parquet":
+		columns := []inetdata.ParquetColumn{{Name: "key"}, {Name: "values", ListSeparator: merge_delimiter}}
+		pw, pe := inetdata.NewParquetWriter(dest, columns, *parquet_compression, *parquet_row_group)
+		output, oe = &recordOutput{
+			write: func(key string, vals []string) error { return pw.Write(key, vals) },
+			close: func() error { return pw.Close() },
+		}, pe
+
+	case "pb":
+		// Protobuf records are compressed with -output-compression
+		compressed, ce := inetdata.NewOutputWriter(dest, *output_compression, *compression_level)
+		if ce != nil {
+			oe = ce
+			break
+		}
+		pw := inetdata.NewProtoWriter(compressed)
+		output = &recordOutput{
+			write: func(key string, vals []string) error {
+				return pw.Write(&inetdata.Record{Fields: []string{key}, Values: vals})
+			},
+			close: func() error {
+				if e := pw.Close(); e != nil {
+					return e
+				}
+				return compressed.Close()
+			},
+		}
+
+	default:
+		output, oe = inetdata.NewOutputWriter(dest, *output_compression, *compression_level)
+	}
+	if oe != nil {
+		inetdata.Log.Errorf("%s", oe)
+		os.Exit(1)
+	}
+
+	key_delimiter = inetdata.UnescapeDelimiter(*delimiter)
+	merge_delimiter = inetdata.UnescapeDelimiter(*merge_sep)
+
+	if len(key_delimiter) == 0 || len(merge_delimiter) == 0 {
+		inetdata.Log.Errorf("the delimiter (-d) and merge separator (-m) must not be empty")
+		usage()
+		os.Exit(1)
+	}
+
+	ks, e := inetdata.NewFieldSplitter(key_delimiter, *csv_strict, *csv_quote, *csv_escape)
+	if e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+	key_splitter = ks
+
+	sel, se := inetdata.NewFieldSelector(ks)
+	if se != nil {
+		inetdata.Log.Errorf("%s", se)
+		usage()
+		os.Exit(1)
+	}
+	selector = sel
+
+	// With -sort, fields are selected before the sorter instead of by the parser
+	var sort_selector *inetdata.FieldSelector
+	if *sort_input {
+		sort_selector, selector = selector, nil
+	}
+
+	if len(*sort_tmp) == 0 {
+		*sort_tmp = os.Getenv("HOME")
+	}
+
+	sort_values := rollup.SORT_VALUES_NONE
+	switch {
+	case *sort_lexical && *sort_numeric:
+		inetdata.Log.Errorf("-sort-values and -sort-values-numeric are mutually exclusive")
+		usage()
+		os.Exit(1)
+	case *sort_lexical:
+		sort_values = rollup.SORT_VALUES_LEXICAL
+	case *sort_numeric:
+		sort_values = rollup.SORT_VALUES_NUMERIC
+	}
+
+	if *max_values < 0 {
+		inetdata.Log.Errorf("-max-values-per-key must not be negative")
+		usage()
+		os.Exit(1)
+	}
+
+	max_values_per_key = *max_values
+	spill_dir = *spill_tmp
+	if len(spill_dir) == 0 {
+		spill_dir = *sort_tmp
+	}
+	spill_mem = *sort_mem * 1024 * 1024 * 1024
+
+	mode, ok := rollup.AggModes[*selected_agg_mode]
+	if !ok {
+		inetdata.Log.Errorf("Invalid aggregation mode specified: %s", *selected_agg_mode)
+		usage()
+		os.Exit(1)
+	}
+	roller = rollup.New(mode, sort_values, merge_delimiter)
+
+	if *timestamps_mode && (mode != rollup.AGG_MODE_MERGE || max_values_per_key > 0) {
+		inetdata.Log.Errorf("-timestamps cannot be combined with -agg or -max-values-per-key")
+		usage()
+		os.Exit(1)
+	}
+	timestamps = *timestamps_mode
+
+	if *topk < 0 {
+		inetdata.Log.Errorf("-topk must not be negative")
+		usage()
+		os.Exit(1)
+	}
+
+	if *topk > 0 {
+		if timestamps || mode != rollup.AGG_MODE_MERGE || max_values_per_key > 0 || *sort_input {
+			inetdata.Log.Errorf("-topk cannot be combined with -timestamps, -agg, -max-values-per-key, or -sort")
+			usage()
+			os.Exit(1)
+		}
+		top = inetdata.NewTopK(*topk)
+	}
+
+	switch *ip_key {
+	case "none":
+	case "hex":
+		ip_key_hex = true
+	default:
+		inetdata.Log.Errorf("Invalid IP key format specified: %s", *ip_key)
+		usage()
+		os.Exit(1)
+	}
+
+	progress := inetdata.NewProgress("inetdata-csvrollup", &input_count, &output_count)
+	progress.Format = *progress_format
+	if max_values_per_key > 0 {
+		progress.AddCounter("spilled", &spill_count)
+	}
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
 	// Progress tracker
 	quit := make(chan int)
-	go showProgress(quit)
+	go progress.Run(quit)
 
 	// Output merger and writer
-	outc := make(chan OutputKey, 1000)
-	outl := make(chan string, 1000)
+	outc := make(chan OutputKey, inetdata.QueueDepth)
+	outl := make(chan string, inetdata.QueueDepth)
 	outq := make(chan bool, 1)
 
-	for i := 0; i < runtime.NumCPU(); i++ {
+	// Keys are written in input order when the values are sorted, and in count
+	// order with -topk
+	mergers := inetdata.Workers
+	if roller.Sort != rollup.SORT_VALUES_NONE || top != nil {
+		mergers = 1
+	}
+
+	for i := 0; i < mergers; i++ {
 		go mergeAndEmit(outc, outl)
 		wg.Add(1)
 	}
 
 	// Not covered by the waitgroup
-	go writeOutput(outl, outq)
+	go writeOutput(output, outl, outq)
 
 	// Parse stdin
-	c_inp := make(chan string, 1000)
+	c_inp := make(chan string, inetdata.QueueDepth)
+	progress.AddStage("input", func() int { return len(c_inp) })
 
 	// Only one parser allowed given the rollup use case
 	go inputParser(c_inp, outc)
 	wg.Add(1)
 
-	// Reader closers c_inp on completion
-	e := inetdata.ReadLines(os.Stdin, c_inp)
-	if e != nil {
-		fmt.Fprintf(os.Stderr, "Error reading input: %s\n", e)
+	switch {
+	case *sharded:
+		// Merger closes c_inp on completion
+		e := inetdata.MergeSortedInputs(inputs, *input_compression, progress.CountReader, c_inp)
+		if e != nil {
+			inetdata.Log.Warnf("Failed to merge input: %s", e)
+		}
+
+	case *sort_input:
+		// The sorter sits between the reader and the parser and closes c_inp on completion
+		c_raw := make(chan string, inetdata.QueueDepth)
+		sort_done := make(chan bool, 1)
+
+		go func() {
+			if e := inetdata.ExternalSort(c_raw, c_inp, *sort_tmp, *sort_mem*1024*1024*1024); e != nil {
+				inetdata.Log.Warnf("Failed to sort input: %s", e)
+			}
+			sort_done <- true
+		}()
+
+		c_read := c_raw
+		if sort_selector != nil {
+			c_read = make(chan string, inetdata.QueueDepth)
+			go selectLines(sort_selector, c_read, c_raw)
+		}
+
+		// Reader closes c_read on completion
+		e := inetdata.ReadLinesFromInputs(inputs, *input_compression, progress.CountReader, c_read)
+		if e != nil {
+			inetdata.Log.Warnf("Failed to read input: %s", e)
+		}
+
+		<-sort_done
+
+	default:
+		// Reader closers c_inp on completion, and fails if the files are not
+		// in key order as a whole
+		e := inetdata.ReadSortedLinesFromInputs(inputs, *input_compression, progress.CountReader, inputKey, c_inp)
+		if e != nil {
+			inetdata.Log.Errorf("Failed to read input: %s", e)
+			os.Exit(1)
+		}
 	}
 
 	wg.Wait()
@@ -227,6 +889,23 @@ func main() {
 	<-outq
 	close(outq)
 
+	if e := output.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+	}
+
+	if e := dest.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+	}
+
 	quit <- 0
 
+	inetdata.CloseRejects()
+
+	inetdata.ExitIfInterrupted(*output_path)
+	inetdata.CheckErrorBudget(input_count)
+
+	if e := inetdata.WriteDatasetMeta("inetdata-csvrollup", *output_path, output_count); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
 }
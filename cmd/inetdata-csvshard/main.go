@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"hash/fnv"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const SHARD_MODE_HASH = 0
+const SHARD_MODE_BYTE = 1
+const SHARD_MODE_LABEL = 2
+
+var shard_modes = map[string]int{
+	"hash":  SHARD_MODE_HASH,
+	"byte":  SHARD_MODE_BYTE,
+	"label": SHARD_MODE_LABEL,
+}
+
+var output_count int64 = 0
+var input_count int64 = 0
+var invalid_count int64 = 0
+var wg sync.WaitGroup
+
+// The number of shards that failed to write, and the lines they dropped
+var shard_errors int64 = 0
+var dropped_count int64 = 0
+
+var shard_mode = SHARD_MODE_HASH
+var shard_count = 16
+var key_field = 1
+var splitter *inetdata.FieldSplitter
+var selector *inetdata.FieldSelector
+
+var output_base string
+var output_compression string
+var compression_level = -1
+var max_lines int64 = 0
+var max_bytes int64 = 0
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <base> [<input> ... <input>]")
+	fmt.Println("")
+	fmt.Println("Splits a CSV stream from stdin into shards by key, so that each shard can be sorted")
+	fmt.Println("and processed in parallel. The key is field -k, split on the delimiter -d. Lines are")
+	fmt.Println("assigned to a shard according to -by:")
+	fmt.Println("")
+	fmt.Println("  hash  : the FNV-1a hash of the key modulo -n, written to <base>-NNN.gz")
+	fmt.Println("  byte  : the first byte of the key, written to <base>-<hex byte>.gz")
+	fmt.Println("  label : the first dot-separated label of the key, written to <base>-<label>.gz")
+	fmt.Println("")
+	fmt.Println("The byte and label modes open one output file per distinct prefix, so they are best")
+	fmt.Println("suited to keys with few prefixes, such as reversed hostnames (-L output of other tools).")
+	fmt.Println("")
+	fmt.Println("With -max-lines or -max-bytes (uncompressed), each shard is rotated into numbered")
+	fmt.Println("files instead (ex: <base>-007-0000.gz, <base>-007-0001.gz).")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+// A single shard and its current output file
+type shardWriter struct {
+	name  string
+	c     chan string
+	fd    io.WriteCloser
+	out   io.WriteCloser
+	buf   *bufio.Writer
+	seq   int
+	lines int64
+	bytes int64
+}
+
+func (s *shardWriter) path() string {
+	name := output_base + "-" + s.name
+	if max_lines > 0 || max_bytes > 0 {
+		name += fmt.Sprintf("-%04d", s.seq)
+	}
+	return name + inetdata.OutputCompressionExtension(output_compression)
+}
+
+func (s *shardWriter) open() error {
+	fd, e := inetdata.CreateOutput(s.path())
+	if e != nil {
+		return e
+	}
+
+	out, e := inetdata.NewOutputWriter(fd, output_compression, compression_level)
+	if e != nil {
+		fd.Close()
+		return e
+	}
+
+	s.fd = fd
+	s.out = out
+	s.buf = bufio.NewWriterSize(out, 256*1024)
+	s.lines = 0
+	s.bytes = 0
+	return nil
+}
+
+func (s *shardWriter) close() error {
+	if s.fd == nil {
+		return nil
+	}
+
+	e := s.buf.Flush()
+	if ce := s.out.Close(); e == nil {
+		e = ce
+	}
+	if ce := s.fd.Close(); e == nil {
+		e = ce
+	}
+	s.fd = nil
+	return e
+}
+
+// Write the lines of the shard. After a write error, the remaining lines of
+// the shard are dropped and counted, and the run fails once it completes.
+func (s *shardWriter) run() {
+	defer wg.Done()
+
+	failed := false
+	fail := func(format string, args ...interface{}) {
+		inetdata.Log.Errorf(format, args...)
+		atomic.AddInt64(&shard_errors, 1)
+		failed = true
+	}
+
+	for line := range s.c {
+		if failed {
+			atomic.AddInt64(&dropped_count, 1)
+			continue
+		}
+
+		rotate := (max_lines > 0 && s.lines >= max_lines) || (max_bytes > 0 && s.bytes > 0 && s.bytes+int64(len(line)) > max_bytes)
+		if s.fd != nil && rotate {
+			if e := s.close(); e != nil {
+				fail("Failed to write %s: %s", s.path(), e)
+				atomic.AddInt64(&dropped_count, 1)
+				continue
+			}
+			s.seq++
+		}
+
+		if s.fd == nil {
+			if e := s.open(); e != nil {
+				fail("Failed to create %s: %s", s.path(), e)
+				atomic.AddInt64(&dropped_count, 1)
+				continue
+			}
+		}
+
+		s.buf.WriteString(line)
+		s.lines++
+		s.bytes += int64(len(line))
+		atomic.AddInt64(&output_count, 1)
+	}
+
+	if e := s.close(); e != nil && !failed {
+		fail("Failed to write %s: %s", s.path(), e)
+	}
+}
+
+// Make a key prefix safe for use in a file name
+func sanitizeName(s string) string {
+	if len(s) == 0 {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(s))
+}
+
+// Determine the shard name for a key
+func shardName(key string) string {
+	switch shard_mode {
+	case SHARD_MODE_BYTE:
+		if len(key) == 0 {
+			return "_"
+		}
+		return fmt.Sprintf("%02x", key[0])
+
+	case SHARD_MODE_LABEL:
+		return sanitizeName(strings.SplitN(key, ".", 2)[0])
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return fmt.Sprintf("%03d", h.Sum32()%uint32(shard_count))
+}
+
+func inputParser(c <-chan string) {
+	defer wg.Done()
+
+	shards := make(map[string]*shardWriter)
+
+	for r := range c {
+		raw := strings.TrimRight(r, "\r")
+		if len(raw) == 0 {
+			continue
+		}
+
+		atomic.AddInt64(&input_count, 1)
+
+		if selector != nil {
+			sel, e := selector.Apply(raw)
+			if e != nil {
+				inetdata.Log.Warnf("Invalid line: %q", raw)
+				inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, raw)
+				atomic.AddInt64(&invalid_count, 1)
+				continue
+			}
+			raw = sel
+		}
+
+		bits, e := splitter.Split(raw, key_field+1)
+		if e != nil || len(bits) < key_field {
+			inetdata.Log.Warnf("Invalid line: %q", raw)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, raw)
+			atomic.AddInt64(&invalid_count, 1)
+			continue
+		}
+
+		name := shardName(bits[key_field-1])
+
+		shard, ok := shards[name]
+		if !ok {
+			shard = &shardWriter{name: name, c: make(chan string, inetdata.QueueDepth)}
+			shards[name] = shard
+			wg.Add(1)
+			go shard.run()
+		}
+
+		shard.c <- raw + "\n"
+	}
+
+	for _, shard := range shards {
+		close(shard.c)
+	}
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	selected_shard_mode := flag.String("by", "hash", "The sharding mode: hash, byte, or label")
+	shards := flag.Int("n", 16, "The number of shards for the hash mode")
+	index_key := flag.Int("k", 1, "The field index to use as the key")
+	delimiter := flag.String("d", ",", "The delimiter to use as a field separator")
+	csv_strict := flag.Bool("csv-strict", false, "Parse the input as RFC 4180 CSV, allowing quoted keys that contain the delimiter")
+	csv_quote := flag.String("csv-quote", "\"", "The quote character for -csv-strict")
+	csv_escape := flag.String("csv-escape", "", "The escape character for quotes in -csv-strict fields (defaults to doubling the quote)")
+	rotate_lines := flag.Int64("max-lines", 0, "Rotate shard files after this many lines (0 disables)")
+	rotate_bytes := flag.Int64("max-bytes", 0, "Rotate shard files after this many uncompressed bytes (0 disables)")
+	selected_output_compression := flag.String("output-compression", "gzip", "The output compression: none, gzip, zstd, or lz4")
+	selected_compression_level := flag.Int("compression-level", -1, "The output compression level, -1 uses the default for the codec")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddSampleFlags()
+	inetdata.AddSelectFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-csvshard")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-csvshard")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-csvshard")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidOutputCompression(*selected_output_compression) {
+		inetdata.Log.Errorf("Invalid output compression specified: %s", *selected_output_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	mode, ok := shard_modes[*selected_shard_mode]
+	if !ok {
+		inetdata.Log.Errorf("Invalid sharding mode specified: %s", *selected_shard_mode)
+		usage()
+		os.Exit(1)
+	}
+	shard_mode = mode
+
+	if *shards < 1 || *index_key < 1 || *rotate_lines < 0 || *rotate_bytes < 0 {
+		inetdata.Log.Errorf("-n and -k must be positive and the rotation limits must not be negative")
+		usage()
+		os.Exit(1)
+	}
+
+	if len(flag.Args()) < 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args()[1:], *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	fs, fe := inetdata.NewFieldSplitter(inetdata.UnescapeDelimiter(*delimiter), *csv_strict, *csv_quote, *csv_escape)
+	if fe != nil {
+		inetdata.Log.Errorf("%s", fe)
+		usage()
+		os.Exit(1)
+	}
+
+	splitter = fs
+
+	sel, se := inetdata.NewFieldSelector(fs)
+	if se != nil {
+		inetdata.Log.Errorf("%s", se)
+		usage()
+		os.Exit(1)
+	}
+	selector = sel
+	shard_count = *shards
+	key_field = *index_key
+	max_lines = *rotate_lines
+	max_bytes = *rotate_bytes
+	output_base = flag.Args()[0]
+	output_compression = *selected_output_compression
+	compression_level = *selected_compression_level
+
+	progress := inetdata.NewProgress("inetdata-csvshard", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.Errors = &invalid_count
+	progress.AddCounter("shard_errors", &shard_errors)
+	progress.AddCounter("dropped", &dropped_count)
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	// Parse stdin
+	c_inp := make(chan string, inetdata.QueueDepth)
+	progress.AddStage("input", func() int { return len(c_inp) })
+
+	// A single parser owns the shard table
+	go inputParser(c_inp)
+	wg.Add(1)
+
+	// Reader closes c_inp on completion
+	read_err := inetdata.ReadLinesFromInputs(inputs, *input_compression, progress.CountReader, c_inp)
+	if read_err != nil {
+		inetdata.Log.Errorf("Failed to read input: %s", read_err)
+	}
+
+	// Wait for the parser and shard writers to finish
+	wg.Wait()
+
+	quit <- 0
+
+	inetdata.CloseRejects()
+
+	inetdata.ExitIfInterrupted(output_base)
+
+	// A truncated set of shards must not look like a successful run
+	if shard_errors > 0 {
+		inetdata.Log.Errorf("The shards are incomplete: %d shards failed to write and dropped %d lines", shard_errors, dropped_count)
+	}
+	if read_err != nil || shard_errors > 0 {
+		os.Exit(1)
+	}
+
+	inetdata.CheckErrorBudget(input_count)
+}
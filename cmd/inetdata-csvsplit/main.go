@@ -11,7 +11,6 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
-	"time"
 )
 
 var output_count int64 = 0
@@ -20,48 +19,29 @@ var stdout_lock sync.Mutex
 var wg1 sync.WaitGroup
 var wg2 sync.WaitGroup
 
+var splitter *inetdata.FieldSplitter
+var selector *inetdata.FieldSelector
+
 type OutputKey struct {
 	Key  string
 	Vals []string
 }
 
 func usage() {
-	fmt.Println("Usage: " + os.Args[0] + " [options]")
+	fmt.Println("Usage: " + os.Args[0] + " [options] <base> [<input> ... <input>]")
 	fmt.Println("")
 	fmt.Println("Reads an unsorted DNS CSV from stdin, writes out sorted and merged normal and inverse CSVs.")
 	fmt.Println("")
+	fmt.Println("Lines are split naively on commas. With -csv-strict, lines are parsed as RFC 4180 CSV so")
+	fmt.Println("that quoted values may contain commas, and such values are quoted again in the output.")
+	fmt.Println("")
+	fmt.Println("When <base> is a clickhouse:// URL, the outputs are inserted into the tables named by the")
+	fmt.Println("table option with _names and _names_inverse appended.")
+	fmt.Println("")
 	fmt.Println("Options:")
 	flag.PrintDefaults()
 }
 
-func showProgress(quit chan int) {
-	start := time.Now()
-	for {
-		select {
-		case <-quit:
-			return
-		case <-time.After(time.Second * 1):
-			icount := atomic.LoadInt64(&input_count)
-			ocount := atomic.LoadInt64(&output_count)
-
-			if icount == 0 && ocount == 0 {
-				// Reset start, so that we show stats only from our first input
-				start = time.Now()
-				continue
-			}
-			elapsed := time.Since(start)
-			if elapsed.Seconds() > 1.0 {
-				fmt.Fprintf(os.Stderr, "[*] [inetdata-csvsplit] Read %d and wrote %d records in %d seconds (%d/s in, %d/s out)\n",
-					icount,
-					ocount,
-					int(elapsed.Seconds()),
-					int(float64(icount)/elapsed.Seconds()),
-					int(float64(ocount)/elapsed.Seconds()))
-			}
-		}
-	}
-}
-
 func outputWriter(fd io.WriteCloser, c chan string) {
 	for r := range c {
 		fd.Write([]byte(r))
@@ -80,12 +60,31 @@ func inputParser(c chan string, c_names chan string, c_inverse chan string) {
 			continue
 		}
 
+		if selector != nil {
+			sel, e := selector.Apply(raw)
+			if e != nil {
+				inetdata.Log.Warnf("Invalid line: %q", raw)
+				inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, raw)
+				continue
+			}
+			raw = sel
+		}
+
 		var name, rtype, value string
 
-		bits := strings.SplitN(raw, ",", 3)
+		var bits []string
+		var e error
+
+		// Strict mode decodes every field, so a quoted value may contain commas
+		if splitter.Strict {
+			bits, e = splitter.Split(raw, -1)
+		} else {
+			bits = strings.SplitN(raw, ",", 3)
+		}
 
-		if len(bits) < 2 || len(bits[0]) == 0 {
-			fmt.Fprintf(os.Stderr, "[-] Invalid line: %q\n", raw)
+		if e != nil || len(bits) < 2 || len(bits) > 3 || len(bits[0]) == 0 {
+			inetdata.Log.Warnf("Invalid line: %q", raw)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, raw)
 			continue
 		}
 
@@ -112,7 +111,8 @@ func inputParser(c chan string, c_names chan string, c_inverse chan string) {
 			} else if inetdata.Match_IPv6.Match([]byte(name)) {
 				rtype = "aaaa"
 			} else {
-				fmt.Fprintf(os.Stderr, "[-] Unknown two-field format: %s\n", raw)
+				inetdata.Log.Warnf("Unknown two-field format: %s", raw)
+				inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, raw)
 				continue
 			}
 		}
@@ -135,32 +135,32 @@ func inputParser(c chan string, c_names chan string, c_inverse chan string) {
 			if !(inetdata.Match_IPv4.Match([]byte(value)) || inetdata.Match_IPv4.Match([]byte(name))) {
 				continue
 			}
-			c_names <- fmt.Sprintf("%s,%s,%s\n", name, rtype, value)
-			c_inverse <- fmt.Sprintf("%s,r-%s,%s\n", value, rtype, name)
+			c_names <- splitter.Join(name, rtype, value) + "\n"
+			c_inverse <- splitter.Join(value, "r-"+rtype, name) + "\n"
 
 		case "aaaa":
 			// Skip invalid IPv6 records (TODO: verify logic)
 			if !(inetdata.Match_IPv6.Match([]byte(value)) || inetdata.Match_IPv6.Match([]byte(name))) {
 				continue
 			}
-			c_names <- fmt.Sprintf("%s,%s,%s\n", name, rtype, value)
-			c_inverse <- fmt.Sprintf("%s,r-%s,%s\n", value, rtype, name)
+			c_names <- splitter.Join(name, rtype, value) + "\n"
+			c_inverse <- splitter.Join(value, "r-"+rtype, name) + "\n"
 
 		case "cname", "ns", "ptr":
-			c_names <- fmt.Sprintf("%s,%s,%s\n", name, rtype, value)
-			c_inverse <- fmt.Sprintf("%s,r-%s,%s\n", value, rtype, name)
+			c_names <- splitter.Join(name, rtype, value) + "\n"
+			c_inverse <- splitter.Join(value, "r-"+rtype, name) + "\n"
 
 		case "mx":
 			parts := strings.SplitN(value, " ", 2)
 			if len(parts) != 2 || len(parts[1]) == 0 {
 				continue
 			}
-			c_names <- fmt.Sprintf("%s,%s,%s\n", name, rtype, parts[1])
-			c_inverse <- fmt.Sprintf("%s,r-%s,%s\n", parts[1], rtype, name)
+			c_names <- splitter.Join(name, rtype, parts[1]) + "\n"
+			c_inverse <- splitter.Join(parts[1], "r-"+rtype, name) + "\n"
 
 		default:
 			// No inverse output for other record types (TXT, DNSSEC, etc)
-			c_names <- fmt.Sprintf("%s,%s,%s\n", name, rtype, value)
+			c_names <- splitter.Join(name, rtype, value) + "\n"
 		}
 	}
 	wg2.Done()
@@ -174,20 +174,86 @@ func main() {
 	flag.Usage = func() { usage() }
 	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
 	sort_mem := flag.Uint64("m", 1, "The maximum amount of memory to use, in gigabytes, for each of the six sort processes")
+	csv_strict := flag.Bool("csv-strict", false, "Parse the input as RFC 4180 CSV, allowing quoted fields that contain commas")
+	csv_quote := flag.String("csv-quote", "\"", "The quote character for -csv-strict")
+	csv_escape := flag.String("csv-escape", "", "The escape character for quotes in -csv-strict fields (defaults to doubling the quote)")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
 	version := flag.Bool("version", false, "Show the version and build timestamp")
 
-	flag.Parse()
+	inetdata.AddTuningFlags()
+	inetdata.AddSampleFlags()
+	inetdata.AddSelectFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-csvsplit")
 
 	if *version {
 		inetdata.PrintVersion("inetdata-csvsplit")
 		os.Exit(0)
 	}
 
-	if len(flag.Args()) != 1 {
+	inetdata.HandleSignals("inetdata-csvsplit")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if len(flag.Args()) < 1 {
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	fs, fe := inetdata.NewFieldSplitter(",", *csv_strict, *csv_quote, *csv_escape)
+	if fe != nil {
+		inetdata.Log.Errorf("%s", fe)
+		usage()
+		os.Exit(1)
+	}
+	splitter = fs
+
+	sel, se := inetdata.NewFieldSelector(fs)
+	if se != nil {
+		inetdata.Log.Errorf("%s", se)
+		usage()
+		os.Exit(1)
+	}
+	selector = sel
+
+	inputs, ie := inetdata.InputPaths(flag.Args()[1:], *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
 	if len(*sort_tmp) == 0 {
 		*sort_tmp = os.Getenv("HOME")
 	}
@@ -197,19 +263,35 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Output files
+	// Output files, or uncompressed ClickHouse tables
 	base := flag.Args()[0]
-	out_fds := []*os.File{}
+	out_fds := []io.WriteCloser{}
+	out_names := []string{}
+	to_clickhouse := strings.HasPrefix(base, "clickhouse://")
 
 	suffix := []string{"-names.gz", "-names-inverse.gz"}
+	if to_clickhouse {
+		suffix = []string{"_names", "_names_inverse"}
+	}
+
 	for i := range suffix {
-		fd, e := os.Create(base + suffix[i])
+		name := base + suffix[i]
+		if to_clickhouse {
+			u, ue := inetdata.ClickHouseTableURL(base, suffix[i])
+			if ue != nil {
+				inetdata.Log.Errorf("%s", ue)
+				os.Exit(1)
+			}
+			name = u
+		}
+
+		fd, e := inetdata.CreateOutput(name)
 		if e != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to create %s: %s\n", base+suffix[i], e)
+			inetdata.Log.Errorf("failed to create %s: %s", name, e)
 			os.Exit(1)
 		}
 		out_fds = append(out_fds, fd)
-		defer fd.Close()
+		out_names = append(out_names, name)
 	}
 
 	// Sort and compression pipes
@@ -225,20 +307,20 @@ func main() {
 			"--key=1",
 			"--field-separator=,",
 			"--compress-program=pigz",
-			fmt.Sprintf("--parallel=%d", runtime.NumCPU()),
+			fmt.Sprintf("--parallel=%d", inetdata.Workers),
 			fmt.Sprintf("--temporary-directory=%s", *sort_tmp),
 			fmt.Sprintf("--buffer-size=%dG", *sort_mem))
 
 		// Configure stdio
 		sort_stdin, sie := sort_proc.StdinPipe()
 		if sie != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to create sort stdin pipe: %s\n", sie)
+			inetdata.Log.Errorf("failed to create sort stdin pipe: %s", sie)
 			os.Exit(1)
 		}
 
 		sort_stdout, soe := sort_proc.StdoutPipe()
 		if soe != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to create sort stdout pipe: %s\n", soe)
+			inetdata.Log.Errorf("failed to create sort stdout pipe: %s", soe)
 			os.Exit(1)
 		}
 
@@ -247,8 +329,9 @@ func main() {
 		subprocs = append(subprocs, sort_proc)
 
 		// Start the sort process
+		inetdata.DetachSignals(sort_proc)
 		if e := sort_proc.Start(); e != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to execute the sort command: %s\n", e)
+			inetdata.Log.Errorf("failed to execute the sort command: %s", e)
 			os.Exit(1)
 		}
 
@@ -258,7 +341,7 @@ func main() {
 		// Configure stdio
 		roll_stdout, roe := roll_proc.StdoutPipe()
 		if roe != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to create sort stdout pipe: %s\n", roe)
+			inetdata.Log.Errorf("failed to create sort stdout pipe: %s", roe)
 			os.Exit(1)
 		}
 
@@ -267,8 +350,9 @@ func main() {
 		subprocs = append(subprocs, roll_proc)
 
 		// Start the rollup process
+		inetdata.DetachSignals(roll_proc)
 		if e := roll_proc.Start(); e != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to execute the inetdata-csvrollup command: %s\n", e)
+			inetdata.Log.Errorf("failed to execute the inetdata-csvrollup command: %s", e)
 			os.Exit(1)
 		}
 
@@ -279,23 +363,37 @@ func main() {
 			"--key=1",
 			"--field-separator=,",
 			"--compress-program=pigz",
-			fmt.Sprintf("--parallel=%d", runtime.NumCPU()),
+			fmt.Sprintf("--parallel=%d", inetdata.Workers),
 			fmt.Sprintf("--temporary-directory=%s", *sort_tmp),
 			fmt.Sprintf("--buffer-size=%dG", *sort_mem))
 
+		sort2_proc.Stdin = roll_stdout
+		sort2_proc.Stderr = os.Stderr
+
+		// ClickHouse tables are fed directly from the sort output
+		if to_clickhouse {
+			sort2_proc.Stdout = out_fds[i]
+			inetdata.DetachSignals(sort2_proc)
+			if e := sort2_proc.Start(); e != nil {
+				inetdata.Log.Errorf("failed to execute the second sort command: %s", e)
+				os.Exit(1)
+			}
+			subprocs = append(subprocs, sort2_proc)
+			continue
+		}
+
 		sort2_stdout, ssoe := sort2_proc.StdoutPipe()
 		if ssoe != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to create sort stdout pipe: %s\n", ssoe)
+			inetdata.Log.Errorf("failed to create sort stdout pipe: %s", ssoe)
 			os.Exit(1)
 		}
-		sort2_proc.Stdin = roll_stdout
-		sort2_proc.Stderr = os.Stderr
 
 		subprocs = append(subprocs, sort2_proc)
 
 		// Start the sort process
+		inetdata.DetachSignals(sort2_proc)
 		if e := sort2_proc.Start(); e != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to execute the second sort command: %s\n", e)
+			inetdata.Log.Errorf("failed to execute the second sort command: %s", e)
 			os.Exit(1)
 		}
 
@@ -312,36 +410,48 @@ func main() {
 		pigz_proc.Stdin = sort2_stdout
 
 		// Start the pigz process
+		inetdata.DetachSignals(pigz_proc)
 		e := pigz_proc.Start()
 		if e != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to execute the pigz command: %s\n", e)
+			inetdata.Log.Errorf("failed to execute the pigz command: %s", e)
 			os.Exit(1)
 		}
 
 		subprocs = append(subprocs, pigz_proc)
 	}
 
-	c_names := make(chan string, 1000)
-	c_inverse := make(chan string, 1000)
+	c_names := make(chan string, inetdata.QueueDepth)
+	c_inverse := make(chan string, inetdata.QueueDepth)
 
 	go outputWriter(sort_input[0], c_names)
 	go outputWriter(sort_input[1], c_inverse)
 	wg1.Add(2)
 
+	progress := inetdata.NewProgress("inetdata-csvsplit", &input_count, &output_count)
+	progress.Format = *progress_format
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
 	// Progress tracker
 	quit := make(chan int)
-	go showProgress(quit)
+	go progress.Run(quit)
 
 	// Parse stdin
-	c_inp := make(chan string, 1000)
+	c_inp := make(chan string, inetdata.QueueDepth)
+	progress.AddStage("input", func() int { return len(c_inp) })
 	go inputParser(c_inp, c_names, c_inverse)
 	go inputParser(c_inp, c_names, c_inverse)
 	wg2.Add(2)
 
 	// Reader closes c_inp on completion
-	e := inetdata.ReadLines(os.Stdin, c_inp)
+	e := inetdata.ReadLinesFromInputs(inputs, *input_compression, progress.CountReader, c_inp)
 	if e != nil {
-		fmt.Fprintf(os.Stderr, "Error reading input: %s\n", e)
+		inetdata.Log.Warnf("Failed to read input: %s", e)
 	}
 
 	// Wait for the input parsers to finish
@@ -366,6 +476,13 @@ func main() {
 	}
 
 	for i := range out_fds {
-		out_fds[i].Close()
+		if e := out_fds[i].Close(); e != nil {
+			inetdata.Log.Warnf("Failed to write output: %s", e)
+		}
 	}
+
+	inetdata.CloseRejects()
+
+	inetdata.ExitIfInterrupted(out_names...)
+	inetdata.CheckErrorBudget(input_count)
 }
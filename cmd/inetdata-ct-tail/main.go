@@ -1,64 +1,115 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/dnsname"
 	ct "github.com/google/certificate-transparency-go"
 	ct_tls "github.com/google/certificate-transparency-go/tls"
 	"github.com/google/certificate-transparency-go/x509"
 	"golang.org/x/net/publicsuffix"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-var CTLogs = []string{
-	"https://ct.googleapis.com/pilot",
-	"https://ct.googleapis.com/aviator",
-	"https://ct.googleapis.com/rocketeer",
-	"https://ct.googleapis.com/submariner",
-	"https://ct.googleapis.com/skydiver",
-	"https://ct.googleapis.com/icarus",
-	"https://ct.googleapis.com/daedalus",
-	"https://ct1.digicert-ct.com/log",
-	"https://ct2.digicert-ct.com/log",
-	"https://ct.izenpe.eus",
-	"https://ct.ws.symantec.com",
-	"https://vega.ws.symantec.com",
-	"https://sirius.ws.symantec.com",
-	"https://ctlog.api.venafi.com",
-	"https://ctlog-gen2.api.venafi.com",
-	"https://ctlog.wosign.com",
-	"https://ctserver.cnnic.cn",
-	"https://ct.startssl.com",
-	"https://www.certificatetransparency.cn/ct",
-	"https://ct.gdca.com.cn",
-	"https://ctlog.gdca.com.cn",
-}
-
 var output_count int64 = 0
 var input_count int64 = 0
+
+// The number of entries downloaded, and of the download, verification, and
+// parse errors of all logs
+var fetched_count int64 = 0
+var error_count int64 = 0
+
+// The errors of each log, exported by the progress tracker
+var log_errors = map[string]*int64{}
+var log_errors_lock sync.Mutex
+
+var progress *inetdata.Progress
 var number *int
 var follow *bool
+var normalize *bool
+var wildcard_mode string
+var start *int64
+var batch_size *int64
+var fetchers *int
+var output_format string
+var output io.Writer = os.Stdout
+var checkpoint *inetdata.Checkpoint
+var checkpoint_interval *int64
+var poll_interval *time.Duration
+
+// The set of the entries that were written with -dedup
+var dedup *inetdata.DedupSet
+var dedup_mode string
+var dedup_count int64 = 0
+
+// The dedup set is saved at most this often, and at exit
+const DEDUP_SAVE_INTERVAL = time.Minute
+
+// The followed logs and their states, and the states and filters of the logs
+// that are followed
+var followed = map[string]string{}
+var followed_lock sync.Mutex
+var log_states = map[string]bool{}
+var include_logs []string
+var exclude_logs []string
 
 var wd sync.WaitGroup
 var wi sync.WaitGroup
 var wo sync.WaitGroup
 
 type CTEntry struct {
-	LeafInput []byte `json:"leaf_input"`
-	ExtraData []byte `json:"extra_data"`
+	LeafInput []byte          `json:"leaf_input"`
+	ExtraData []byte          `json:"extra_data"`
+	Log       string          `json:"-"`
+	Index     int64           `json:"-"`
+	Pending   *sync.WaitGroup `json:"-"`
+}
+
+type CTCertRecord struct {
+	Log       string   `json:"log"`
+	Index     int64    `json:"index"`
+	Timestamp uint64   `json:"timestamp"`
+	Type      string   `json:"type"`
+	SHA1      string   `json:"sha1"`
+	SHA256    string   `json:"sha256"`
+	CN        string   `json:"cn"`
+	Names     []string `json:"names"`
+	IPs       []string `json:"ips,omitempty"`
+	Emails    []string `json:"emails,omitempty"`
+	Issuer    string   `json:"issuer"`
+	NotBefore string   `json:"not_before"`
+	NotAfter  string   `json:"not_after"`
+}
+
+// The records of an entry, with the key of the entry for -dedup. An output
+// without lines tells the writer to commit the checkpoint, with the next
+// index of the log, if set, once the records before it have been written.
+type CTOutput struct {
+	Key    []byte
+	Lines  []string
+	Log    string
+	Offset int64
 }
 
 type CTEntries struct {
@@ -82,10 +133,70 @@ func usage() {
 	fmt.Println("")
 	fmt.Println("Synchronizes data from one or more CT logs and extract hostnames")
 	fmt.Println("")
+	fmt.Println("The output format is one of:")
+	fmt.Println("")
+	fmt.Println("  names : name,type,value records for each hostname in the certificate")
+	fmt.Println("  csv   : log,index,timestamp,type,sha1,sha256,cn,names,issuer,not_before,not_after")
+	fmt.Println("  jsonl : one JSON object per certificate with the same fields as csv")
+	fmt.Println("")
+	fmt.Println("Without -logurl or -logs, the logs are discovered from the -log-list log lists of the CT")
+	fmt.Println("programs, which are cached in -log-list-cache for when they cannot be downloaded. The logs")
+	fmt.Println("in one of the -log-states are followed, and with -f the lists are reloaded every")
+	fmt.Println("-log-list-refresh: new logs are followed from their current tree size, and logs that leave")
+	fmt.Println("the -log-states are stopped. Readonly logs are followed up to their final tree size.")
+	fmt.Println("-include-logs and -exclude-logs select logs by a part of their url, description, or operator.")
+	fmt.Println("")
+	fmt.Println("With -output, records are written to a file or stream instead of stdout. Streams are")
+	fmt.Println("Kafka topics (ex: kafka://broker:9092/topic?key=1), Elasticsearch indexes")
+	fmt.Println("(ex: es://host:9200/index?id=key), or ClickHouse tables (ex: clickhouse://host:9000/db?table=ct),")
+	fmt.Println("see the README for the URL options.")
+	fmt.Println("")
+	fmt.Println("With -checkpoint-file, the next index of each log is committed every -checkpoint-interval")
+	fmt.Println("entries, once the records of those entries have been written. A restarted run continues")
+	fmt.Println("each log from its committed index instead of -start or -n, and appends to an -output file.")
+	fmt.Println("Entries that fail to download are never committed past, and are retried at the next poll.")
+	fmt.Println("The tree size of each log is committed as well, so a restarted run reports how far behind")
+	fmt.Println("each log it is.")
+	fmt.Println("")
+	fmt.Println("With -dedup, the entries seen before are dropped: leaf drops the same entry of a log, such")
+	fmt.Println("as one read twice after a restart, and cert drops a certificate or precertificate that")
+	fmt.Println("was already read from another log. The set of seen entries is kept in -dedup-state,")
+	fmt.Println("either exactly or as a Bloom filter with -dedup-filter bloom.")
+	fmt.Println("")
+	fmt.Println("With -verify, the signature of each tree head is checked with the key of the log from the")
+	fmt.Println("log list, -logs, or -log-key, and each tree head is proven consistent with the last one,")
+	fmt.Println("including the one in the -checkpoint-file of an earlier run. With -verify-inclusion N, every")
+	fmt.Println("Nth entry is proven to be included in the tree head. Misbehavior is logged as an error and")
+	fmt.Println("the run exits with status 4.")
+	fmt.Println("")
+	fmt.Println("With -rotate, the -output file is replaced by a series of files compressed with")
+	fmt.Println("-rotate-compression, one per period such as 1h. Each is written with a .part suffix that is")
+	fmt.Println("removed at the end of its period. The start of the period replaces {time} in the -output")
+	fmt.Println("path, or is added before its extension (ex: -output ct.jsonl -rotate 1h writes")
+	fmt.Println("ct-20060102T150000Z.jsonl.gz).")
+	fmt.Println("")
+	fmt.Println("Wildcard names (*.example.com) are kept, stripped to their parent name, dropped, or")
+	fmt.Println("written as both the wildcard and the parent name, according to -wildcards.")
+	fmt.Println("")
 	fmt.Println("Options:")
 	flag.PrintDefaults()
 }
 
+// Add a certificate name to the set, in canonical form with -normalize and
+// with the -wildcards policy applied
+func addName(names map[string]struct{}, name string) {
+	if !*normalize {
+		name = strings.ToLower(name)
+	} else if cname, err := dnsname.Normalize(name); err == nil {
+		name = cname
+	} else {
+		return
+	}
+	for _, n := range dnsname.Wildcards(name, wildcard_mode) {
+		names[n] = struct{}{}
+	}
+}
+
 func scrubX509Value(bit string) string {
 	bit = strings.Replace(bit, "\x00", "[0x00]", -1)
 	bit = strings.Replace(bit, " ", "_", -1)
@@ -105,7 +216,7 @@ func downloadJSON(url string) ([]byte, error) {
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}
 
-	client := &http.Client{Transport: tr}
+	client := &http.Client{Transport: inetdata.LimitTransport(tr)}
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -161,28 +272,297 @@ func logNameToPath(name string) string {
 	return strings.Replace(bits[1], "/", "_", -1)
 }
 
-func downloadLog(log string, c_inp chan<- CTEntry) {
+// Count an error of a log, registering its counter on first use
+func countLogError(log string) {
+	atomic.AddInt64(&error_count, 1)
+
+	log_errors_lock.Lock()
+	count, ok := log_errors[log]
+	if !ok {
+		count = new(int64)
+		log_errors[log] = count
+		progress.AddLabeledCounter("log_errors", "log", log, count)
+	}
+	log_errors_lock.Unlock()
+
+	atomic.AddInt64(count, 1)
+}
+
+// Download a batch of entries, following up on short reads since logs may
+// cap the number of entries returned by a single get-entries request. On
+// failure, the index of the first entry that was not read is returned.
+func downloadBatch(log string, start_index int64, stop_index int64, c_inp chan<- CTEntry, pending *sync.WaitGroup) (int64, error) {
+	index := start_index
+	retries := 0
+
+	for index <= stop_index {
+		entries, err := downloadEntries(log, index, stop_index)
+		if err == nil && len(entries.Entries) == 0 {
+			err = errors.New("empty response")
+		}
+
+		if err != nil {
+			retries++
+			if retries > 3 {
+				return index, err
+			}
+			time.Sleep(time.Duration(retries) * time.Second)
+			continue
+		}
+		retries = 0
+		atomic.AddInt64(&fetched_count, int64(len(entries.Entries)))
+
+		for entry_index := range entries.Entries {
+			entry := entries.Entries[entry_index]
+			entry.Log = log
+			entry.Index = index
+			if pending != nil {
+				entry.Pending = pending
+				pending.Add(1)
+			}
+			c_inp <- entry
+			index++
+		}
+	}
+	return index, nil
+}
+
+// Download the range [start_index, stop_index) using parallel fetchers. Each
+// entry is added to pending, if set, until it has been parsed. The lowest
+// index that was not read, after a failure or a signal, is returned, or
+// stop_index when the whole range was read. Entries after that index may
+// have been read, and are read again when the range is retried.
+func downloadRange(log string, start_index int64, stop_index int64, c_inp chan<- CTEntry, pending *sync.WaitGroup) int64 {
+	var wf sync.WaitGroup
+	var failed_lock sync.Mutex
+	failed := stop_index
+
+	batches := make(chan int64)
+
+	for i := 0; i < *fetchers; i++ {
+		wf.Add(1)
+		go func() {
+			defer wf.Done()
+			for index := range batches {
+				batch_stop := index + *batch_size - 1
+				if batch_stop >= stop_index {
+					batch_stop = stop_index - 1
+				}
+				if next, err := downloadBatch(log, index, batch_stop, c_inp, pending); err != nil {
+					countLogError(log)
+					inetdata.Log.Warnf("Failed to download entries for %s: index %d -> %s", log, next, err)
+					failed_lock.Lock()
+					if next < failed {
+						failed = next
+					}
+					failed_lock.Unlock()
+				}
+			}
+		}()
+	}
+
+	// Stop handing out batches after a signal, the batches in flight finish
+	index := start_index
+	for ; index < stop_index && !inetdata.Interrupted(); index += *batch_size {
+		batches <- index
+	}
+	close(batches)
+
+	wf.Wait()
+
+	if index < failed {
+		failed = index
+	}
+	return failed
+}
+
+// Download the range [start_index, stop_index) in chunks of -checkpoint-interval
+// entries, committing the next index once the records of a chunk are written.
+// The index to continue from is returned: stop_index, or the first entry that
+// could not be read, which is never committed past and is retried next.
+func downloadCommitted(log string, start_index int64, stop_index int64, c_inp chan<- CTEntry, c_out chan<- CTOutput) int64 {
+	if checkpoint == nil {
+		return downloadRange(log, start_index, stop_index, c_inp, nil)
+	}
+
+	for start_index < stop_index {
+		chunk_stop := start_index + *checkpoint_interval
+		if chunk_stop > stop_index {
+			chunk_stop = stop_index
+		}
+
+		var pending sync.WaitGroup
+		next := downloadRange(log, start_index, chunk_stop, c_inp, &pending)
+		pending.Wait()
+
+		// A chunk cut short by a signal is not committed
+		if inetdata.Interrupted() {
+			return start_index
+		}
+
+		// The empty output tells the writer to commit the next index once
+		// the records before it have been written
+		if next > start_index {
+			c_out <- CTOutput{Log: log, Offset: next}
+		}
+		if next < chunk_stop {
+			return next
+		}
+
+		start_index = chunk_stop
+	}
+	return start_index
+}
+
+// The checkpoint offset of the last tree size seen in a log
+func treeSizeKey(log string) string {
+	return "tree_size:" + log
+}
+
+// Return the state of a followed log in the last log list
+func followedState(log string) string {
+	followed_lock.Lock()
+	defer followed_lock.Unlock()
+	return followed[log]
+}
+
+// Return the urls of the followed logs
+func followedLogs() []string {
+	followed_lock.Lock()
+	defer followed_lock.Unlock()
+
+	urls := []string{}
+	for url := range followed {
+		urls = append(urls, url)
+	}
+	return urls
+}
+
+// Start following a log unless it is already followed, or update its state
+// in the last log list. Logs that are new to a resumed checkpoint, or that
+// are added to the list while following, start at their current tree size.
+func followLog(log inetdata.CTLog, added bool, c_inp chan<- CTEntry, c_out chan<- CTOutput) {
+	followed_lock.Lock()
+	defer followed_lock.Unlock()
+
+	if _, ok := followed[log.URL]; ok {
+		if followed[log.URL] != log.State {
+			inetdata.Log.Infof("The state of %s changed from %s to %s", log.URL, followed[log.URL], log.State)
+		}
+		followed[log.URL] = log.State
+		return
+	}
+	followed[log.URL] = log.State
+
+	if checkpoint != nil && checkpoint.Resumed() {
+		_, committed := checkpoint.Offset(log.URL)
+		_, started := checkpoint.Offset(treeSizeKey(log.URL))
+		if !committed && !started {
+			added = true
+		}
+	}
+
+	if added {
+		inetdata.Log.Infof("Following the new %s log %s (%s)", log.State, log.URL, log.Description)
+	}
+
+	wd.Add(1)
+	go downloadLog(log, added, c_inp, c_out)
+}
+
+func downloadLog(log inetdata.CTLog, at_head bool, c_inp chan<- CTEntry, c_out chan<- CTOutput) {
 	var iteration int64 = 0
 	var current_index int64 = 0
+	failures := uint(0)
+	url := log.URL
 
 	defer wd.Done()
 
+	var verifier *ct.SignatureVerifier
+	if *verify {
+		v, e := headVerifier(log)
+		if e != nil {
+			inetdata.Log.Warnf("%s", e)
+		}
+		if v == nil {
+			inetdata.Log.Warnf("The key of %s is not known, the signatures of its tree heads are not verified", url)
+		}
+		verifier = v
+	}
+
 	for {
 
-		if iteration > 0 {
-			fmt.Fprintf(os.Stderr, "[*] Sleeping for 10 seconds (%s) at index %d\n", log, current_index)
-			time.Sleep(time.Duration(10) * time.Second)
+		if iteration > 0 || failures > 0 {
+			// Back off from a log that keeps failing, up to 64 poll intervals
+			wait := *poll_interval
+			if failures > 0 {
+				if failures > 6 {
+					wait <<= 6
+				} else {
+					wait <<= failures
+				}
+			}
+			inetdata.Log.Infof("Sleeping for %s (%s) at index %d", wait, url, current_index)
+			for wake := time.Now().Add(wait); time.Now().Before(wake) && !inetdata.Interrupted(); {
+				time.Sleep(time.Second)
+			}
+		}
+
+		if inetdata.Interrupted() {
+			break
+		}
+
+		if state := followedState(url); !log_states[state] {
+			inetdata.Log.Infof("Stopping %s at index %d, its state is %s", url, current_index, state)
+			break
 		}
 
-		sth, sth_err := downloadSTH(log)
+		// Without a tree size, the first iteration would start from index 0
+		sth, sth_err := downloadSTH(url)
 		if sth_err != nil {
-			fmt.Fprintf(os.Stderr, "[-] Failed to download STH for %s: %s\n", log, sth_err)
+			failures++
+			countLogError(url)
+			inetdata.Log.Warnf("Failed to download STH for %s (%d failures): %s", url, failures, sth_err)
+			if !*follow {
+				break
+			}
+			continue
+		}
+		failures = 0
+
+		// A tree head that fails verification is not read, and the log is
+		// polled less often until it publishes one that does not
+		if *verify && !verifyHead(url, verifier, sth) {
+			failures++
+			countLogError(url)
+			if !*follow {
+				break
+			}
+			continue
 		}
 
 		var start_index int64 = 0
 
 		if iteration == 0 {
-			start_index = sth.TreeSize - int64(*number)
+			committed := int64(-1)
+			if checkpoint != nil {
+				if v, ok := checkpoint.Offset(url); ok {
+					committed = v
+				}
+			}
+
+			if committed >= 0 {
+				start_index = committed
+				if size, ok := checkpoint.Offset(treeSizeKey(url)); ok && size > committed {
+					inetdata.Log.Infof("Resuming %s at index %d, %d entries behind the last tree size of %d", url, committed, size-committed, size)
+				}
+			} else if at_head {
+				start_index = sth.TreeSize
+			} else if *start >= 0 {
+				start_index = *start
+			} else {
+				start_index = sth.TreeSize - int64(*number)
+			}
 			if start_index < 0 {
 				start_index = 0
 			}
@@ -191,26 +571,19 @@ func downloadLog(log string, c_inp chan<- CTEntry) {
 			start_index = current_index
 		}
 
-		var entry_count int64 = 1000
-
-		for index := start_index; index < sth.TreeSize; index += entry_count {
-			stop_index := index + entry_count - 1
-			if stop_index >= sth.TreeSize {
-				stop_index = sth.TreeSize - 1
-			}
-
-			entries, err := downloadEntries(log, index, stop_index)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "[-] Failed to download entries for %s: index %d -> %s\n", log, index, err)
-				return
-			}
-			for entry_index := range entries.Entries {
-				c_inp <- entries.Entries[entry_index]
-			}
+		if checkpoint != nil {
+			checkpoint.SetOffset(treeSizeKey(url), sth.TreeSize)
 		}
 
-		// Move our index to the end of the last tree
-		current_index = sth.TreeSize
+		// Move our index to the end of the last tree, or to the first entry
+		// that could not be read, which the next iteration starts from
+		next := downloadCommitted(url, start_index, sth.TreeSize, c_inp, c_out)
+		if next > current_index {
+			current_index = next
+		}
+		if next < sth.TreeSize && !inetdata.Interrupted() {
+			failures++
+		}
 		iteration++
 
 		// Break after one loop unless we are in follow mode
@@ -218,116 +591,392 @@ func downloadLog(log string, c_inp chan<- CTEntry) {
 			break
 		}
 
+		// A frozen log does not grow past its final tree head
+		if followedState(url) == "readonly" && log.FinalTreeSize > 0 && current_index >= log.FinalTreeSize {
+			inetdata.Log.Infof("Stopping %s at its final tree size of %d", url, log.FinalTreeSize)
+			break
+		}
 	}
 }
 
-func outputWriter(o <-chan string) {
-	for name := range o {
-		fmt.Print(name)
-		atomic.AddInt64(&output_count, 1)
+// Return the logs of a log list with the -log-states and that match the
+// -include-logs and -exclude-logs filters
+func selectLogs(list []inetdata.CTLog) []inetdata.CTLog {
+	logs := []inetdata.CTLog{}
+	for _, l := range list {
+		if !log_states[l.State] {
+			continue
+		}
+		if len(include_logs) > 0 && !l.Matches(include_logs) {
+			continue
+		}
+		if len(exclude_logs) > 0 && l.Matches(exclude_logs) {
+			continue
+		}
+		logs = append(logs, l)
 	}
-	wo.Done()
+	return logs
 }
 
-func inputParser(c <-chan CTEntry, o chan<- string) {
-
-	for entry := range c {
+// Reload the log lists every interval while following, updating the states
+// of the followed logs and following the logs that were added
+func refreshLogs(sources []string, cache string, interval time.Duration, c_inp chan<- CTEntry, c_out chan<- CTOutput) {
+	defer wd.Done()
 
-		var leaf ct.MerkleTreeLeaf
+	for {
+		for wake := time.Now().Add(interval); time.Now().Before(wake) && !inetdata.Interrupted(); {
+			time.Sleep(time.Second)
+		}
+		if inetdata.Interrupted() {
+			return
+		}
 
-		if rest, err := ct_tls.Unmarshal(entry.LeafInput, &leaf); err != nil {
-			fmt.Fprintf(os.Stderr, "[-] Failed to unmarshal MerkleTreeLeaf: %v (%v)", err, entry)
+		list, e := inetdata.LoadCTLogList(sources, cache)
+		if e != nil {
+			inetdata.Log.Warnf("Failed to refresh the log list: %s", e)
 			continue
-		} else if len(rest) > 0 {
-			fmt.Fprintf(os.Stderr, "[-] Trailing data (%d bytes) after MerkleTreeLeaf: %q", len(rest), rest)
+		}
+
+		// The followed logs that changed state or left the list are stopped
+		listed := map[string]bool{}
+		for _, l := range list {
+			listed[l.URL] = true
+			if len(followedState(l.URL)) > 0 {
+				followLog(l, true, c_inp, c_out)
+			}
+		}
+		for _, url := range followedLogs() {
+			if !listed[url] {
+				followLog(inetdata.CTLog{URL: url, State: "unlisted"}, true, c_inp, c_out)
+			}
+		}
+
+		for _, l := range selectLogs(list) {
+			followLog(l, true, c_inp, c_out)
+		}
+	}
+}
+
+// Split a comma-separated flag value, ignoring empty values
+func splitList(value string) []string {
+	values := []string{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// Read a list of log urls from a file, one per line and optionally followed
+// by the base64 public key of the log, ignoring comments
+func readLogList(path string) ([]inetdata.CTLog, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	logs := []inetdata.CTLog{}
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		bits := strings.Fields(scanner.Text())
+		if len(bits) == 0 || strings.HasPrefix(bits[0], "#") {
 			continue
 		}
+		log := inetdata.CTLog{URL: strings.TrimRight(bits[0], "/"), State: "usable"}
+		if len(bits) > 1 {
+			key, err := base64.StdEncoding.DecodeString(bits[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid key for %s: %s", log.URL, err)
+			}
+			log.Key = key
+		}
+		logs = append(logs, log)
+	}
+	return logs, scanner.Err()
+}
 
-		var cert *x509.Certificate
-		var err error
+// Flush the buffered records to the output, so that they can be committed
+func flushOutput() error {
+	if f, ok := output.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Save the dedup set once the records of its keys have been written
+func saveDedup() {
+	if e := flushOutput(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+		return
+	}
+	if e := dedup.Save(); e != nil {
+		inetdata.Log.Warnf("Failed to save the dedup state: %s", e)
+	}
+}
 
-		switch leaf.TimestampedEntry.EntryType {
-		case ct.X509LogEntryType:
+func outputWriter(o <-chan CTOutput) {
+	saved := time.Now()
 
-			cert, err = x509.ParseCertificate(leaf.TimestampedEntry.X509Entry.Data)
-			if err != nil && !strings.Contains(err.Error(), "NonFatalErrors:") {
-				fmt.Fprintf(os.Stderr, "[-] Failed to parse cert: %s\n", err.Error())
+	for rec := range o {
+		if rec.Lines == nil {
+			// Buffered records must reach the output before they are committed
+			if e := flushOutput(); e != nil {
+				inetdata.Log.Warnf("Failed to write output: %s", e)
 				continue
 			}
+			if len(rec.Log) > 0 {
+				checkpoint.SetOffset(rec.Log, rec.Offset)
+			}
+			if e := checkpoint.Commit(); e != nil {
+				inetdata.Log.Warnf("Failed to commit the checkpoint: %s", e)
+			}
+			continue
+		}
 
-		case ct.PrecertLogEntryType:
-
-			cert, err = x509.ParseTBSCertificate(leaf.TimestampedEntry.PrecertEntry.TBSCertificate)
-			if err != nil && !strings.Contains(err.Error(), "NonFatalErrors:") {
-				fmt.Fprintf(os.Stderr, "[-] Failed to parse precert: %s\n", err.Error())
+		// Keys are added as their records are written, so a saved set never
+		// holds the key of a record that was not
+		if dedup != nil {
+			if !dedup.Add(rec.Key) {
+				atomic.AddInt64(&dedup_count, 1)
 				continue
 			}
+			if time.Since(saved) > DEDUP_SAVE_INTERVAL {
+				saveDedup()
+				saved = time.Now()
+			}
+		}
 
-		default:
-			fmt.Fprintf(os.Stderr, "[-] Unknown entry type: %v (%v)", leaf.TimestampedEntry.EntryType, entry)
-			continue
+		for _, line := range rec.Lines {
+			if _, e := io.WriteString(output, line); e != nil {
+				inetdata.Log.Warnf("Failed to write output: %s", e)
+			}
+			atomic.AddInt64(&output_count, 1)
+		}
+	}
+	wo.Done()
+}
+
+// Return the key of an entry for -dedup: the leaf hash of RFC 6962, which
+// differs between logs, or the SHA256 of the certificate or precertificate,
+// which does not
+func dedupKey(entry CTEntry, leaf *ct.MerkleTreeLeaf, cert *x509.Certificate) []byte {
+	var sum [sha256.Size]byte
+	switch dedup_mode {
+	case "leaf":
+		sum = sha256.Sum256(append([]byte{ct.TreeLeafPrefix}, entry.LeafInput...))
+	case "cert":
+		sum = sha256.Sum256(cert.Raw)
+	default:
+		return nil
+	}
+	return sum[:]
+}
+
+// Render a certificate entry as a single CSV or JSONL line
+func formatRecord(entry CTEntry, leaf *ct.MerkleTreeLeaf, cert *x509.Certificate, names map[string]struct{}) (string, error) {
+	sha1sum := sha1.Sum(cert.Raw)
+	sha256sum := sha256.Sum256(cert.Raw)
+
+	rec := CTCertRecord{
+		Log:       entry.Log,
+		Index:     entry.Index,
+		Timestamp: leaf.TimestampedEntry.Timestamp,
+		Type:      "x509",
+		SHA1:      hex.EncodeToString(sha1sum[:]),
+		SHA256:    hex.EncodeToString(sha256sum[:]),
+		CN:        strings.ToLower(scrubX509Value(cert.Subject.CommonName)),
+		Names:     make([]string, 0, len(names)),
+		Issuer:    cert.Issuer.String(),
+		NotBefore: cert.NotBefore.UTC().Format(time.RFC3339),
+		NotAfter:  cert.NotAfter.UTC().Format(time.RFC3339),
+	}
+
+	if leaf.TimestampedEntry.EntryType == ct.PrecertLogEntryType {
+		rec.Type = "precert"
+	}
+
+	for n := range names {
+		rec.Names = append(rec.Names, n)
+	}
+	sort.Strings(rec.Names)
+
+	for _, ip := range cert.IPAddresses {
+		rec.IPs = append(rec.IPs, ip.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		rec.Emails = append(rec.Emails, strings.ToLower(scrubX509Value(email)))
+	}
+
+	if output_format == "jsonl" {
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return "", err
+		}
+		return string(b) + "\n", nil
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{
+		rec.Log,
+		strconv.FormatInt(rec.Index, 10),
+		strconv.FormatUint(rec.Timestamp, 10),
+		rec.Type,
+		rec.SHA1,
+		rec.SHA256,
+		rec.CN,
+		strings.Join(rec.Names, " "),
+		rec.Issuer,
+		rec.NotBefore,
+		rec.NotAfter,
+	})
+	w.Flush()
+	return buf.String(), w.Error()
+}
+
+func inputParser(c <-chan CTEntry, o chan<- CTOutput) {
+	for entry := range c {
+		parseEntry(entry, o)
+		if entry.Pending != nil {
+			entry.Pending.Done()
+		}
+	}
+
+	wi.Done()
+}
+
+// Write a log entry that could not be parsed to the reject file in the
+// get-entries JSON format
+func rejectEntry(reason string, entry CTEntry) {
+	countLogError(entry.Log)
+	if inetdata.Rejects == nil {
+		return
+	}
+	raw, _ := json.Marshal(entry)
+	inetdata.Rejects.Reject(reason, string(raw))
+}
+
+// Parse a log entry and write its records to the output channel
+func parseEntry(entry CTEntry, o chan<- CTOutput) {
+
+	var leaf ct.MerkleTreeLeaf
+
+	if rest, err := ct_tls.Unmarshal(entry.LeafInput, &leaf); err != nil {
+		inetdata.Log.Warnf("Failed to unmarshal MerkleTreeLeaf: %v (%v)", err, entry)
+		rejectEntry(inetdata.REJECT_INVALID_ENTRY, entry)
+		return
+	} else if len(rest) > 0 {
+		inetdata.Log.Warnf("Trailing data (%d bytes) after MerkleTreeLeaf: %q", len(rest), rest)
+		rejectEntry(inetdata.REJECT_INVALID_ENTRY, entry)
+		return
+	}
+
+	var cert *x509.Certificate
+	var err error
+
+	switch leaf.TimestampedEntry.EntryType {
+	case ct.X509LogEntryType:
+
+		cert, err = inetdata.ParseCertificate(leaf.TimestampedEntry.X509Entry.Data)
+		if err != nil {
+			inetdata.Log.Warnf("Failed to parse cert: %s", err.Error())
+			rejectEntry(inetdata.REJECT_INVALID_CERT, entry)
+			return
+		}
+
+	case ct.PrecertLogEntryType:
+
+		cert, err = inetdata.ParseTBSCertificate(leaf.TimestampedEntry.PrecertEntry.TBSCertificate)
+		if err != nil {
+			inetdata.Log.Warnf("Failed to parse precert: %s", err.Error())
+			rejectEntry(inetdata.REJECT_INVALID_CERT, entry)
+			return
 		}
 
-		// Valid input
-		atomic.AddInt64(&input_count, 1)
+	default:
+		inetdata.Log.Warnf("Unknown entry type: %v (%v)", leaf.TimestampedEntry.EntryType, entry)
+		rejectEntry(inetdata.REJECT_INVALID_ENTRY, entry)
+		return
+	}
+
+	// Valid input
+	atomic.AddInt64(&input_count, 1)
+
+	if *verify_inclusion > 0 && entry.Index%*verify_inclusion == 0 {
+		verifyInclusion(entry)
+	}
 
-		var names = make(map[string]struct{})
+	var names = make(map[string]struct{})
 
-		if _, err := publicsuffix.EffectiveTLDPlusOne(cert.Subject.CommonName); err == nil {
+	if _, err := publicsuffix.EffectiveTLDPlusOne(cert.Subject.CommonName); err == nil {
+		// Make sure this looks like an actual hostname or IP address
+		if !(inetdata.Match_IPv4.Match([]byte(cert.Subject.CommonName)) ||
+			inetdata.Match_IPv6.Match([]byte(cert.Subject.CommonName))) &&
+			(strings.Contains(cert.Subject.CommonName, " ") ||
+				strings.Contains(cert.Subject.CommonName, ":")) {
+			return
+		}
+		addName(names, cert.Subject.CommonName)
+	}
+
+	for _, alt := range cert.DNSNames {
+		if _, err := publicsuffix.EffectiveTLDPlusOne(alt); err == nil {
 			// Make sure this looks like an actual hostname or IP address
 			if !(inetdata.Match_IPv4.Match([]byte(cert.Subject.CommonName)) ||
 				inetdata.Match_IPv6.Match([]byte(cert.Subject.CommonName))) &&
-				(strings.Contains(cert.Subject.CommonName, " ") ||
-					strings.Contains(cert.Subject.CommonName, ":")) {
+				(strings.Contains(alt, " ") ||
+					strings.Contains(alt, ":")) {
 				continue
 			}
-			names[strings.ToLower(cert.Subject.CommonName)] = struct{}{}
+			addName(names, alt)
 		}
+	}
 
-		for _, alt := range cert.DNSNames {
-			if _, err := publicsuffix.EffectiveTLDPlusOne(alt); err == nil {
-				// Make sure this looks like an actual hostname or IP address
-				if !(inetdata.Match_IPv4.Match([]byte(cert.Subject.CommonName)) ||
-					inetdata.Match_IPv6.Match([]byte(cert.Subject.CommonName))) &&
-					(strings.Contains(alt, " ") ||
-						strings.Contains(alt, ":")) {
-					continue
-				}
-				names[strings.ToLower(alt)] = struct{}{}
-			}
+	if output_format != "names" {
+		line, err := formatRecord(entry, &leaf, cert, names)
+		if err != nil {
+			inetdata.Log.Warnf("Failed to format record for %s index %d: %s", entry.Log, entry.Index, err)
+			return
 		}
+		o <- CTOutput{Key: dedupKey(entry, &leaf, cert), Lines: []string{line}}
+		return
+	}
 
-		sha1hash := ""
+	sha1hash := ""
+	lines := []string{}
 
-		// Write the names to the output channel
-		for n := range names {
-			if len(sha1hash) == 0 {
-				sha1 := sha1.Sum(cert.Raw)
-				sha1hash = hex.EncodeToString(sha1[:])
-			}
+	// Write the names to the output channel
+	for n := range names {
+		if len(sha1hash) == 0 {
+			sha1 := sha1.Sum(cert.Raw)
+			sha1hash = hex.EncodeToString(sha1[:])
+		}
 
-			// Dump associated email addresses if available
-			for _, extra := range cert.EmailAddresses {
-				o <- fmt.Sprintf("%s,email,%s\n", n, strings.ToLower(scrubX509Value(extra)))
-			}
+		// Dump associated email addresses if available
+		for _, extra := range cert.EmailAddresses {
+			lines = append(lines, fmt.Sprintf("%s,email,%s\n", n, strings.ToLower(scrubX509Value(extra))))
+		}
 
-			// Dump associated IP addresses if we have at least one name
-			for _, extra := range cert.IPAddresses {
-				o <- fmt.Sprintf("%s,ip,%s\n", n, extra)
-			}
+		// Dump associated IP addresses if we have at least one name
+		for _, extra := range cert.IPAddresses {
+			lines = append(lines, fmt.Sprintf("%s,ip,%s\n", n, extra))
+		}
 
-			o <- fmt.Sprintf("%s,ts,%d\n", n, leaf.TimestampedEntry.Timestamp)
-			o <- fmt.Sprintf("%s,cn,%s\n", n, strings.ToLower(scrubX509Value(cert.Subject.CommonName)))
-			o <- fmt.Sprintf("%s,sha1,%s\n", n, sha1hash)
+		lines = append(lines, fmt.Sprintf("%s,ts,%d\n", n, leaf.TimestampedEntry.Timestamp))
+		lines = append(lines, fmt.Sprintf("%s,cn,%s\n", n, strings.ToLower(scrubX509Value(cert.Subject.CommonName))))
+		lines = append(lines, fmt.Sprintf("%s,sha1,%s\n", n, sha1hash))
 
-			// Dump associated SANs
-			for _, extra := range cert.DNSNames {
-				o <- fmt.Sprintf("%s,dns,%s\n", strings.ToLower(extra), n)
-			}
+		// Dump associated SANs
+		for _, extra := range cert.DNSNames {
+			lines = append(lines, fmt.Sprintf("%s,dns,%s\n", strings.ToLower(extra), n))
 		}
 	}
 
-	wi.Done()
+	if len(lines) > 0 {
+		o <- CTOutput{Key: dedupKey(entry, &leaf, cert), Lines: lines}
+	}
 }
 
 func main() {
@@ -336,46 +985,280 @@ func main() {
 	os.Setenv("LC_ALL", "C")
 
 	flag.Usage = func() { usage() }
+	normalize = flag.Bool("normalize", false, "Encode internationalized names as punycode and skip names with invalid labels")
+	wildcards := flag.String("wildcards", "keep", "The wildcard handling mode: keep, strip, drop, or expand-base")
 	version := flag.Bool("version", false, "Show the version and build timestamp")
 	logurl := flag.String("logurl", "", "Only read from the specified CT log url")
 	number = flag.Int("n", 100, "The number of entries from the end to start from")
 	follow = flag.Bool("f", false, "Follow the tail of the CT log")
-
-	flag.Parse()
+	log_list := flag.String("logs", "", "Read the CT log urls from the specified file, one per line with an optional base64 key")
+	start = flag.Int64("start", -1, "The index to start from in each log, overrides -n when set")
+	batch_size = flag.Int64("batch", 1000, "The number of entries to request per get-entries call")
+	fetchers = flag.Int("fetchers", 1, "The number of parallel fetchers per log")
+	format := flag.String("format", "names", "The output format: names, csv, or jsonl")
+	output_path := flag.String("output", "", "Write to this file or stream URL instead of stdout (ex: kafka://broker:9092/topic)")
+	checkpoint_file := flag.String("checkpoint-file", "", "Commit the next index of each log to this file and resume from it when restarted")
+	checkpoint_interval = flag.Int64("checkpoint-interval", 100000, "The number of entries of a log between checkpoints")
+	log_list_sources := flag.String("log-list", inetdata.CT_LOG_LIST_GOOGLE+","+inetdata.CT_LOG_LIST_APPLE, "Discover the logs from these comma-separated log list files or urls")
+	log_list_cache := flag.String("log-list-cache", inetdata.DefaultCTLogListCache(), "Cache the log lists in this directory (empty to disable)")
+	log_list_refresh := flag.Duration("log-list-refresh", time.Hour, "Reload the log lists at this interval with -f (0 to disable)")
+	states := flag.String("log-states", "usable,qualified,readonly", "Follow the discovered logs in these comma-separated states: "+strings.Join(inetdata.CTLogStates, ", "))
+	include := flag.String("include-logs", "", "Only follow the logs whose url, description, or operator contains one of these comma-separated strings")
+	exclude := flag.String("exclude-logs", "", "Skip the logs whose url, description, or operator contains one of these comma-separated strings")
+	dedup_flag := flag.String("dedup", "none", "Drop the entries seen before: none, leaf for the same log entry, or cert for the same certificate in any log")
+	dedup_state := flag.String("dedup-state", "", "Keep the -dedup set in this directory, so that restarted runs drop the entries seen before")
+	dedup_filter := flag.String("dedup-filter", "exact", "The -dedup set: exact, or bloom to use less memory and drop a fraction of new entries")
+	dedup_capacity := flag.Uint64("dedup-capacity", 100000000, "The number of entries a new bloom -dedup set is sized for")
+	dedup_fpr := flag.Float64("dedup-fpr", 0.001, "The false positive rate of a new bloom -dedup set")
+	verify = flag.Bool("verify", false, "Verify the signatures and consistency of the tree heads of each log")
+	verify_inclusion = flag.Int64("verify-inclusion", 0, "With -verify, also verify that every Nth entry is included in the tree head (0 to disable)")
+	log_key := flag.String("log-key", "", "The base64 public key of the -logurl log, to verify its tree head signatures")
+	poll_interval = flag.Duration("poll-interval", 10*time.Second, "The time to wait between polls of each log with -f")
+	rotate := flag.Duration("rotate", 0, "Write the -output file as a series of files, one per period such as 1h")
+	rotate_compression := flag.String("rotate-compression", "gzip", "The compression of rotated files: none, gzip, zstd, or lz4")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+	inetdata.AddCertParseFlags()
+	inetdata.AddRateLimitFlags()
+
+	inetdata.ParseFlags("inetdata-ct-tail")
 
 	if *version {
 		inetdata.PrintVersion("inetdata-ct-tail")
 		os.Exit(0)
 	}
 
-	logs := []string{}
+	inetdata.HandleSignals("inetdata-ct-tail")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ApplyRateLimits(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if e := inetdata.ApplyCertParse(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	switch *format {
+	case "names", "csv", "jsonl":
+		output_format = *format
+	default:
+		inetdata.Log.Errorf("Invalid output format specified: %s", *format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !dnsname.ValidWildcardPolicy(*wildcards) {
+		inetdata.Log.Errorf("Invalid wildcard mode specified: %s", *wildcards)
+		usage()
+		os.Exit(1)
+	}
+	wildcard_mode = *wildcards
+
+	for _, state := range splitList(*states) {
+		valid := false
+		for _, v := range inetdata.CTLogStates {
+			valid = valid || v == state
+		}
+		if !valid {
+			inetdata.Log.Errorf("Invalid log state specified: %s", state)
+			usage()
+			os.Exit(1)
+		}
+		log_states[state] = true
+	}
+	include_logs = splitList(*include)
+	exclude_logs = splitList(*exclude)
+	log_sources := splitList(*log_list_sources)
+
+	switch *dedup_flag {
+	case "none":
+	case "leaf", "cert":
+		dedup_mode = *dedup_flag
+		d, e := inetdata.OpenDedupSet(*dedup_state, *dedup_filter, *dedup_capacity, *dedup_fpr)
+		if e != nil {
+			inetdata.Log.Errorf("%s", e)
+			os.Exit(1)
+		}
+		if n := d.Len(); n > 0 {
+			inetdata.Log.Infof("Loaded %d dedup keys from %s", n, *dedup_state)
+		}
+		dedup = d
+	default:
+		inetdata.Log.Errorf("Invalid dedup mode specified: %s", *dedup_flag)
+		usage()
+		os.Exit(1)
+	}
+
+	if *verify_inclusion < 0 || (*verify_inclusion > 0 && !*verify) {
+		inetdata.Log.Errorf("-verify-inclusion must not be negative and requires -verify")
+		os.Exit(1)
+	}
+
+	if *poll_interval < time.Second {
+		inetdata.Log.Errorf("-poll-interval must be at least 1s")
+		os.Exit(1)
+	}
+
+	if *batch_size < 1 || *fetchers < 1 {
+		inetdata.Log.Errorf("The batch size and number of fetchers must be at least 1")
+		os.Exit(1)
+	}
+
+	if len(*checkpoint_file) > 0 {
+		if *checkpoint_interval < 1 {
+			inetdata.Log.Errorf("-checkpoint-interval must be at least 1")
+			os.Exit(1)
+		}
+
+		cp, ce := inetdata.LoadCheckpoint(*checkpoint_file)
+		if ce != nil {
+			inetdata.Log.Errorf("%s", ce)
+			os.Exit(1)
+		}
+		if cp.Resumed() {
+			resumed := 0
+			for name := range cp.Offsets {
+				if !strings.HasPrefix(name, "tree_size:") {
+					resumed++
+				}
+			}
+			inetdata.Log.Infof("Resuming %d logs from %s", resumed, *checkpoint_file)
+		}
+		checkpoint = cp
+	}
+
+	// Records trickle in when following, so they are not held in the buffer.
+	// Rotated files are not read until they are complete.
+	if *follow && *rotate == 0 && inetdata.FlushInterval == 0 {
+		inetdata.FlushInterval = time.Second
+	}
+
+	var dest io.WriteCloser
+	var de error
+
+	// Rotated files start a new file when resuming, a local output file is
+	// appended to
+	if *rotate > 0 {
+		dest, de = inetdata.NewRotatingOutput(*output_path, *rotate, *rotate_compression, -1)
+	} else if checkpoint != nil && checkpoint.Resumed() && len(*output_path) > 0 && *output_path != "-" && !inetdata.IsRemotePath(*output_path) {
+		fd, fe := os.OpenFile(*output_path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if fe == nil {
+			dest = inetdata.NewBufferedOutput(fd, inetdata.OutputBuffer, inetdata.FlushInterval, inetdata.FsyncOnClose)
+		}
+		de = fe
+	} else {
+		dest, de = inetdata.CreateOutput(*output_path)
+	}
+	if de != nil {
+		inetdata.Log.Errorf("%s", de)
+		os.Exit(1)
+	}
+	output = dest
+
+	// Logs that are named on the command line are assumed to be usable
+	list := []inetdata.CTLog{}
+	discovered := false
 	if len(*logurl) > 0 {
-		logs = append(logs, *logurl)
+		key, err := base64.StdEncoding.DecodeString(*log_key)
+		if err != nil {
+			inetdata.Log.Errorf("Invalid -log-key: %s", err)
+			os.Exit(1)
+		}
+		list = append(list, inetdata.CTLog{URL: strings.TrimRight(*logurl, "/"), State: "usable", Key: key})
+	} else if len(*log_list) > 0 {
+		logs, err := readLogList(*log_list)
+		if err != nil {
+			inetdata.Log.Errorf("Failed to read log list %s: %s", *log_list, err)
+			os.Exit(1)
+		}
+		list = append(list, logs...)
 	} else {
-		for idx := range CTLogs {
-			logs = append(logs, CTLogs[idx])
+		loaded, err := inetdata.LoadCTLogList(log_sources, *log_list_cache)
+		if err != nil {
+			inetdata.Log.Errorf("Failed to read the log lists: %s", err)
+			os.Exit(1)
 		}
+		list = loaded
+		discovered = true
 	}
 
+	logs := selectLogs(list)
+	if len(logs) == 0 {
+		inetdata.Log.Errorf("No logs match the -log-states, -include-logs, and -exclude-logs filters")
+		os.Exit(1)
+	}
+	if discovered {
+		inetdata.Log.Infof("Following %d of the %d logs in the log lists", len(logs), len(list))
+	}
+
+	progress = inetdata.NewProgress("inetdata-ct-tail", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.Errors = &error_count
+	progress.AddCounter("fetched", &fetched_count)
+	progress.AddCounter("duplicates", &dedup_count)
+	progress.AddCounter("lenient", inetdata.LenientCount())
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
 	// Input
-	c_inp := make(chan CTEntry)
+	c_inp := make(chan CTEntry, inetdata.QueueDepth)
+	progress.AddStage("entries", func() int { return len(c_inp) })
 
 	// Output
-	c_out := make(chan string)
+	c_out := make(chan CTOutput, inetdata.QueueDepth)
+	progress.AddStage("records", func() int { return len(c_out) })
 
 	// Launch one input parser per core
-	for i := 0; i < runtime.NumCPU(); i++ {
+	for i := 0; i < inetdata.Workers; i++ {
 		go inputParser(c_inp, c_out)
 	}
-	wi.Add(runtime.NumCPU())
+	wi.Add(inetdata.Workers)
 
 	// Launch a single output writer
 	go outputWriter(c_out)
 	wo.Add(1)
 
 	for idx := range logs {
-		go downloadLog(logs[idx], c_inp)
+		followLog(logs[idx], false, c_inp, c_out)
+	}
+
+	if discovered && *follow && *log_list_refresh > 0 {
 		wd.Add(1)
+		go refreshLogs(log_sources, *log_list_cache, *log_list_refresh, c_inp, c_out)
 	}
 	// Wait for downloaders
 	wd.Wait()
@@ -391,4 +1274,35 @@ func main() {
 
 	// Wait for the output goroutine
 	wo.Wait()
+
+	if dedup != nil {
+		saveDedup()
+		if dedup_count > 0 {
+			inetdata.Log.Infof("Dropped %d duplicate entries", dedup_count)
+		}
+	}
+
+	if e := dest.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+	}
+
+	quit <- 0
+
+	inetdata.ReportLenientCerts()
+	inetdata.CloseRejects()
+
+	// Rotated files hold whole records when closed, so they are not marked
+	// as partial
+	if *rotate > 0 {
+		inetdata.ExitIfInterrupted()
+	} else {
+		inetdata.ExitIfInterrupted(*output_path)
+	}
+
+	if verify_failures > 0 {
+		inetdata.Log.Errorf("The logs failed %d verifications", verify_failures)
+		os.Exit(EXIT_VERIFY_FAILED)
+	}
+
+	inetdata.CheckErrorBudget(input_count)
 }
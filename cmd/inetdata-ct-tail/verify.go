@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/merkle"
+	ct "github.com/google/certificate-transparency-go"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The exit status after a log failed verification
+const EXIT_VERIFY_FAILED = 4
+
+var verify *bool
+var verify_inclusion *int64
+var verify_failures int64 = 0
+
+// The last verified tree head of each log, which the entries that are read
+// are proven to be included in
+var heads = map[string]CTHead{}
+var heads_lock sync.Mutex
+
+type CTConsistency struct {
+	Consistency [][]byte `json:"consistency"`
+}
+
+type CTAuditProof struct {
+	LeafIndex int64    `json:"leaf_index"`
+	AuditPath [][]byte `json:"audit_path"`
+}
+
+// Report a log that published a tree head or proof that does not verify
+func reportMisbehavior(log string, format string, args ...interface{}) {
+	atomic.AddInt64(&verify_failures, 1)
+	inetdata.Log.With("log", log).Errorf("Log misbehavior: "+format, args...)
+}
+
+// The checkpoint value of the last verified tree head of a log
+func headKey(log string) string {
+	return "sth:" + log
+}
+
+// Return the last verified tree head of a log, from this run or from the
+// checkpoint of an earlier one
+func verifiedHead(log string) (CTHead, bool) {
+	heads_lock.Lock()
+	defer heads_lock.Unlock()
+
+	if h, ok := heads[log]; ok {
+		return h, true
+	}
+	if checkpoint == nil {
+		return CTHead{}, false
+	}
+
+	v, ok := checkpoint.Value(headKey(log))
+	if !ok {
+		return CTHead{}, false
+	}
+	bits := strings.SplitN(v, " ", 2)
+	if len(bits) != 2 {
+		return CTHead{}, false
+	}
+	size, e := strconv.ParseInt(bits[0], 10, 64)
+	if e != nil {
+		return CTHead{}, false
+	}
+	return CTHead{TreeSize: size, SHA256RootHash: bits[1]}, true
+}
+
+// Record the verified tree head of a log, which is committed with the next
+// checkpoint
+func setVerifiedHead(log string, sth CTHead) {
+	heads_lock.Lock()
+	defer heads_lock.Unlock()
+
+	heads[log] = sth
+	if checkpoint != nil {
+		checkpoint.SetValue(headKey(log), fmt.Sprintf("%d %s", sth.TreeSize, sth.SHA256RootHash))
+	}
+}
+
+// Return the verifier of the tree head signatures of a log, or nil if its
+// key is not known
+func headVerifier(log inetdata.CTLog) (*ct.SignatureVerifier, error) {
+	if len(log.Key) == 0 {
+		return nil, nil
+	}
+	key, e := ct.PublicKeyFromB64(base64.StdEncoding.EncodeToString(log.Key))
+	if e != nil {
+		return nil, fmt.Errorf("invalid key for %s: %s", log.URL, e)
+	}
+	return ct.NewSignatureVerifier(key)
+}
+
+// Check the signature of a tree head
+func verifySignature(verifier *ct.SignatureVerifier, sth CTHead) error {
+	head := ct.SignedTreeHead{Version: ct.V1, TreeSize: uint64(sth.TreeSize), Timestamp: uint64(sth.Timestamp)}
+	if e := head.SHA256RootHash.FromBase64String(sth.SHA256RootHash); e != nil {
+		return e
+	}
+	if e := head.TreeHeadSignature.FromBase64String(sth.TreeHeadSignature); e != nil {
+		return e
+	}
+	return verifier.VerifySTHSignature(head)
+}
+
+func downloadConsistency(log string, first int64, second int64) ([][]byte, error) {
+	var proof CTConsistency
+	data, err := downloadJSON(fmt.Sprintf("%s/ct/v1/get-sth-consistency?first=%d&second=%d", log, first, second))
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &proof)
+	return proof.Consistency, err
+}
+
+func downloadAuditProof(log string, leaf_hash []byte, tree_size int64) (CTAuditProof, error) {
+	var proof CTAuditProof
+	hash := url.QueryEscape(base64.StdEncoding.EncodeToString(leaf_hash))
+	data, err := downloadJSON(fmt.Sprintf("%s/ct/v1/get-proof-by-hash?hash=%s&tree_size=%d", log, hash, tree_size))
+	if err != nil {
+		return proof, err
+	}
+	err = json.Unmarshal(data, &proof)
+	return proof, err
+}
+
+// Verify a new tree head of a log: its signature when the key of the log is
+// known, and that it is consistent with the last verified tree head. Returns
+// false if the entries of the head should not be read. Misbehavior is
+// reported, and a consistent head replaces the last verified one.
+func verifyHead(log string, verifier *ct.SignatureVerifier, sth CTHead) bool {
+	if verifier != nil {
+		if e := verifySignature(verifier, sth); e != nil {
+			reportMisbehavior(log, "the signature of the tree head of size %d is invalid: %s", sth.TreeSize, e)
+			return false
+		}
+	}
+
+	root, e := base64.StdEncoding.DecodeString(sth.SHA256RootHash)
+	if e != nil || len(root) != 32 {
+		reportMisbehavior(log, "the root hash of the tree head of size %d is invalid", sth.TreeSize)
+		return false
+	}
+
+	last, ok := verifiedHead(log)
+	if !ok {
+		setVerifiedHead(log, sth)
+		return true
+	}
+
+	// A log may serve an older tree head from another frontend
+	if sth.TreeSize < last.TreeSize {
+		inetdata.Log.Debugf("Ignoring the tree head of size %d of %s, older than %d", sth.TreeSize, log, last.TreeSize)
+		return false
+	}
+
+	last_root, _ := base64.StdEncoding.DecodeString(last.SHA256RootHash)
+
+	var proof [][]byte
+	if sth.TreeSize > last.TreeSize && last.TreeSize > 0 {
+		proof, e = downloadConsistency(log, last.TreeSize, sth.TreeSize)
+		if e != nil {
+			inetdata.Log.Warnf("Failed to download the consistency proof of %s from %d to %d: %s", log, last.TreeSize, sth.TreeSize, e)
+			return false
+		}
+	}
+
+	if e := merkle.VerifyConsistency(uint64(last.TreeSize), uint64(sth.TreeSize), last_root, root, proof); e != nil {
+		reportMisbehavior(log, "the tree head of size %d is not consistent with the tree head of size %d: %s", sth.TreeSize, last.TreeSize, e)
+		return false
+	}
+	setVerifiedHead(log, sth)
+	return true
+}
+
+// Verify that an entry is included in the last verified tree head of its log
+func verifyInclusion(entry CTEntry) {
+	head, ok := verifiedHead(entry.Log)
+	if !ok || entry.Index >= head.TreeSize {
+		return
+	}
+	root, _ := base64.StdEncoding.DecodeString(head.SHA256RootHash)
+
+	leaf_hash := merkle.LeafHash(entry.LeafInput)
+	proof, e := downloadAuditProof(entry.Log, leaf_hash, head.TreeSize)
+	if e != nil {
+		inetdata.Log.Warnf("Failed to download the inclusion proof of %s index %d: %s", entry.Log, entry.Index, e)
+		return
+	}
+
+	if proof.LeafIndex != entry.Index {
+		reportMisbehavior(entry.Log, "the entry at index %d has the inclusion proof of index %d", entry.Index, proof.LeafIndex)
+		return
+	}
+	if e := merkle.VerifyInclusion(uint64(entry.Index), uint64(head.TreeSize), leaf_hash, proof.AuditPath, root); e != nil {
+		reportMisbehavior(entry.Log, "the entry at index %d is not included in the tree head of size %d: %s", entry.Index, head.TreeSize, e)
+	}
+}
@@ -1,17 +1,23 @@
 package main
 
 import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/dnsname"
 	ct "github.com/google/certificate-transparency-go"
 	"github.com/google/certificate-transparency-go/tls"
 	"github.com/google/certificate-transparency-go/x509"
 	"golang.org/x/net/publicsuffix"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
@@ -19,7 +25,6 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
-	"time"
 )
 
 var merge_count int64 = 0
@@ -27,6 +32,7 @@ var output_count int64 = 0
 var input_count int64 = 0
 var invalid_count int64 = 0
 var timestamps *bool
+var normalize *bool
 
 var wg_raw_ct_input sync.WaitGroup
 var wg_parsed_ct_writer sync.WaitGroup
@@ -45,8 +51,20 @@ type ParsedCTEntry struct {
 	DNS        []string `json:"dns,omitempty"`
 	IP         []net.IP `json:"ip,omitempty"`
 	Email      []string `json:"email,omitempty"`
+	URI        []string `json:"uri,omitempty"`
+	SPKISHA256 string   `json:"spki_sha256,omitempty"`
+	KeyType    string   `json:"key_type,omitempty"`
+	KeySize    int      `json:"key_size,omitempty"`
+	Issuer     string   `json:"issuer,omitempty"`
+	Serial     string   `json:"serial,omitempty"`
+	Precert    *bool    `json:"precert,omitempty"`
 }
 
+// The certificate details that can be selected with -fields
+var CTFields = []string{"dns", "ip", "email", "uri", "spki_sha256", "key_type", "key_size", "issuer", "serial", "precert"}
+
+var fields = map[string]bool{}
+
 type ParsedCTEntryOutput struct {
 	Certs []ParsedCTEntry `json:"certs"`
 }
@@ -57,42 +75,43 @@ type NewRecord struct {
 }
 
 func usage() {
-	fmt.Println("Usage: " + os.Args[0] + " [options]")
+	fmt.Println("Usage: " + os.Args[0] + " [options] [<input> ... <input>]")
 	fmt.Println("")
 	fmt.Println("Reads a CT log in JSONL format (one line per record) and emits a CSV")
 	fmt.Println("")
+	fmt.Println("Each name, IP address, and certificate SHA1 is a key whose value lists the certificates")
+	fmt.Println("it appears in, as JSON objects with the SHA1 (h), timestamp (t), common name (cn), and")
+	fmt.Println("the certificate details in -fields:")
+	fmt.Println("")
+	fmt.Println("  dns         : the DNS names of the subject alternative names")
+	fmt.Println("  ip          : the IP addresses of the subject alternative names")
+	fmt.Println("  email       : the email addresses of the subject alternative names")
+	fmt.Println("  uri         : the URIs of the subject alternative names")
+	fmt.Println("  spki_sha256 : the SHA256 of the subject public key info, in hex")
+	fmt.Println("  key_type    : the public key algorithm: RSA, ECDSA, Ed25519, or DSA")
+	fmt.Println("  key_size    : the size of the public key in bits")
+	fmt.Println("  issuer      : the distinguished name of the issuer")
+	fmt.Println("  serial      : the serial number, in hex")
+	fmt.Println("  precert     : true for precertificates and false for certificates")
+	fmt.Println("")
+	fmt.Println("With -format parquet, the records are written as a Parquet file with key and value")
+	fmt.Println("columns, compressed with -parquet-compression instead of -output-compression.")
+	fmt.Println("With -format avro, they are written as an Avro container file with the schema embedded,")
+	fmt.Println("using string fields or the types of the fields in -avro-schema. With -format pb, they are")
+	fmt.Println("written as length-delimited protobuf records (proto/record.proto) with the columns as fields.")
+	fmt.Println("")
 	fmt.Println("Options:")
 	flag.PrintDefaults()
 }
 
-func showProgress(quit chan int) {
-	start := time.Now()
-	for {
-		select {
-		case <-quit:
-			return
-		case <-time.After(time.Second * 1):
-			icount := atomic.LoadInt64(&input_count)
-			ocount := atomic.LoadInt64(&output_count)
-			mcount := atomic.LoadInt64(&merge_count)
-			ecount := atomic.LoadInt64(&invalid_count)
-
-			if icount == 0 && ocount == 0 {
-				// Reset start, so that we show stats only from our first input
-				start = time.Now()
-				continue
-			}
-			elapsed := time.Since(start)
-			if elapsed.Seconds() > 1.0 {
-				fmt.Fprintf(os.Stderr, "[*] [inetdata-ct2csv] Read %d and wrote %d records in %d seconds (%d/s in, %d/s out) (merged: %d, invalid: %d)\n",
-					icount,
-					ocount,
-					int(elapsed.Seconds()),
-					int(float64(icount)/elapsed.Seconds()),
-					int(float64(ocount)/elapsed.Seconds()),
-					mcount, ecount)
-			}
-		}
+// Add a certificate name to the set, in canonical form with -normalize
+func addName(names map[string]struct{}, name string) {
+	if !*normalize {
+		names[strings.ToLower(name)] = struct{}{}
+		return
+	}
+	if cname, err := dnsname.Normalize(name); err == nil {
+		names[cname] = struct{}{}
 	}
 }
 
@@ -102,10 +121,10 @@ func scrubX509Value(bit string) string {
 	return bit
 }
 
-func writeToOutput(c chan NewRecord, d chan bool) {
+func writeToOutput(w io.Writer, c chan NewRecord, d chan bool) {
 
 	for r := range c {
-		fmt.Fprintf(os.Stdout, "%s\t%s\n", r.Key, r.Val)
+		fmt.Fprintf(w, "%s\t%s\n", r.Key, r.Val)
 	}
 
 	// Signal that we are done
@@ -137,7 +156,7 @@ func sortedCTParser(d chan string, c chan NewRecord) {
 			info := ParsedCTEntry{}
 
 			if err := json.Unmarshal([]byte(vals[i]), &info); err != nil {
-				fmt.Fprintf(os.Stderr, "[-] Could not unmarshal %s: %s\n", vals[i], err)
+				inetdata.Log.Warnf("Could not unmarshal %s: %s", vals[i], err)
 				continue
 			}
 			outm.Certs = append(outm.Certs, info)
@@ -145,7 +164,7 @@ func sortedCTParser(d chan string, c chan NewRecord) {
 
 		json, e := json.Marshal(outm)
 		if e != nil {
-			fmt.Fprintf(os.Stderr, "[-] Could not marshal %v: %s\n", outm, e)
+			inetdata.Log.Warnf("Could not marshal %v: %s", outm, e)
 			continue
 		}
 
@@ -171,23 +190,85 @@ func parsedCTWriter(o <-chan string, fd io.WriteCloser) {
 	wg_parsed_ct_writer.Done()
 }
 
+// Return the details of a certificate that are selected with -fields
+func certInfo(cert *x509.Certificate, precert bool) ParsedCTEntry {
+	info := ParsedCTEntry{CommonName: scrubX509Value(cert.Subject.CommonName)}
+
+	if fields["dns"] {
+		info.DNS = append(info.DNS, cert.DNSNames...)
+	}
+	if fields["ip"] {
+		info.IP = append(info.IP, cert.IPAddresses...)
+	}
+	if fields["email"] {
+		for _, extra := range cert.EmailAddresses {
+			info.Email = append(info.Email, scrubX509Value(extra))
+		}
+	}
+	if fields["uri"] {
+		for _, extra := range cert.URIs {
+			info.URI = append(info.URI, extra.String())
+		}
+	}
+	if fields["spki_sha256"] {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		info.SPKISHA256 = hex.EncodeToString(sum[:])
+	}
+	if fields["key_type"] && cert.PublicKeyAlgorithm != x509.UnknownPublicKeyAlgorithm {
+		info.KeyType = cert.PublicKeyAlgorithm.String()
+	}
+	if fields["key_size"] {
+		info.KeySize = publicKeySize(cert)
+	}
+	if fields["issuer"] {
+		info.Issuer = cert.Issuer.String()
+	}
+	if fields["serial"] && cert.SerialNumber != nil {
+		info.Serial = cert.SerialNumber.Text(16)
+	}
+	if fields["precert"] {
+		info.Precert = &precert
+	}
+	return info
+}
+
+// Return the size in bits of the public key of a certificate, or 0 if the
+// key could not be parsed
+func publicKeySize(cert *x509.Certificate) int {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return key.N.BitLen()
+	case *ecdsa.PublicKey:
+		return key.Curve.Params().BitSize
+	case *dsa.PublicKey:
+		return key.P.BitLen()
+	}
+	if cert.PublicKeyAlgorithm == x509.Ed25519 && cert.PublicKey != nil {
+		return 256
+	}
+	return 0
+}
+
 func rawCTReader(c <-chan string, o chan<- string) {
 
 	for r := range c {
 		var entry CTEntry
 
 		if err := json.Unmarshal([]byte(r), &entry); err != nil {
-			fmt.Fprintf(os.Stderr, "Error parsing input: %s\n", r)
+			inetdata.Log.Warnf("Failed to parse input: %s", r)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_JSON, r)
 			continue
 		}
 
 		var leaf ct.MerkleTreeLeaf
 
 		if rest, err := tls.Unmarshal(entry.LeafInput, &leaf); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to unmarshal MerkleTreeLeaf: %v (%s)", err, r)
+			inetdata.Log.Warnf("Failed to unmarshal MerkleTreeLeaf: %v (%s)", err, r)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_ENTRY, r)
 			continue
 		} else if len(rest) > 0 {
-			fmt.Fprintf(os.Stderr, "Trailing data (%d bytes) after MerkleTreeLeaf: %q", len(rest), rest)
+			inetdata.Log.Warnf("Trailing data (%d bytes) after MerkleTreeLeaf: %q", len(rest), rest)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_ENTRY, r)
 			continue
 		}
 
@@ -197,22 +278,25 @@ func rawCTReader(c <-chan string, o chan<- string) {
 		switch leaf.TimestampedEntry.EntryType {
 		case ct.X509LogEntryType:
 
-			cert, err = x509.ParseCertificate(leaf.TimestampedEntry.X509Entry.Data)
-			if err != nil && !strings.Contains(err.Error(), "NonFatalErrors:") {
-				fmt.Fprintf(os.Stderr, "Failed to parse cert: %s\n", err.Error())
+			cert, err = inetdata.ParseCertificate(leaf.TimestampedEntry.X509Entry.Data)
+			if err != nil {
+				inetdata.Log.Warnf("Failed to parse cert: %s", err.Error())
+				inetdata.Rejects.Reject(inetdata.REJECT_INVALID_CERT, r)
 				continue
 			}
 
 		case ct.PrecertLogEntryType:
 
-			cert, err = x509.ParseTBSCertificate(leaf.TimestampedEntry.PrecertEntry.TBSCertificate)
-			if err != nil && !strings.Contains(err.Error(), "NonFatalErrors:") {
-				fmt.Fprintf(os.Stderr, "Failed to parse precert: %s\n", err.Error())
+			cert, err = inetdata.ParseTBSCertificate(leaf.TimestampedEntry.PrecertEntry.TBSCertificate)
+			if err != nil {
+				inetdata.Log.Warnf("Failed to parse precert: %s", err.Error())
+				inetdata.Rejects.Reject(inetdata.REJECT_INVALID_CERT, r)
 				continue
 			}
 
 		default:
-			fmt.Fprintf(os.Stderr, "Unknown entry type: %v (%s)", leaf.TimestampedEntry.EntryType, r)
+			inetdata.Log.Warnf("Unknown entry type: %v (%s)", leaf.TimestampedEntry.EntryType, r)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_ENTRY, r)
 			continue
 		}
 
@@ -229,7 +313,7 @@ func rawCTReader(c <-chan string, o chan<- string) {
 					strings.Contains(cert.Subject.CommonName, ":")) {
 				continue
 			}
-			names[strings.ToLower(cert.Subject.CommonName)] = struct{}{}
+			addName(names, cert.Subject.CommonName)
 		}
 
 		for _, alt := range cert.DNSNames {
@@ -241,7 +325,7 @@ func rawCTReader(c <-chan string, o chan<- string) {
 						strings.Contains(alt, ":")) {
 					continue
 				}
-				names[strings.ToLower(alt)] = struct{}{}
+				addName(names, alt)
 			}
 		}
 
@@ -253,33 +337,18 @@ func rawCTReader(c <-chan string, o chan<- string) {
 		sha1hash := hex.EncodeToString(sha1[:])
 		wrote_hash := false
 
-		// Write the names to the output channel
-		for n := range names {
-
-			info := ParsedCTEntry{Sha1Hash: sha1hash, Timestamp: leaf.TimestampedEntry.Timestamp}
-			info.CommonName = scrubX509Value(cert.Subject.CommonName)
-
-			// Dump associated email addresses if available
-			for _, extra := range cert.EmailAddresses {
-				info.Email = append(info.Email, scrubX509Value(extra))
-			}
-
-			// Dump associated IP addresses if we have at least one name
-			for _, extra := range cert.IPAddresses {
-				info.IP = append(info.IP, extra)
-			}
+		info := certInfo(cert, leaf.TimestampedEntry.EntryType == ct.PrecertLogEntryType)
+		info.Sha1Hash = sha1hash
+		info.Timestamp = leaf.TimestampedEntry.Timestamp
 
-			// Dump associated SANs (overkill, but saves a second lookup)
-			for _, extra := range cert.DNSNames {
-				info.DNS = append(info.DNS, extra)
-			}
-
-			info_bytes, err := json.Marshal(info)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to marshal: %s %+v", n, info)
-				continue
-			}
+		info_bytes, err := json.Marshal(info)
+		if err != nil {
+			inetdata.Log.Warnf("Failed to marshal: %s %+v", sha1hash, info)
+			continue
+		}
 
+		// Write the names to the output channel
+		for n := range names {
 			if wrote_hash == false {
 				o <- fmt.Sprintf("%s,%s\n", sha1hash, info_bytes)
 				wrote_hash = true
@@ -300,15 +369,184 @@ func main() {
 	flag.Usage = func() { usage() }
 	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
 	sort_mem := flag.Uint64("m", 1, "The maximum amount of memory to use, in gigabytes, for the sorting phases")
+	format := flag.String("format", "csv", "The output format: csv, parquet, avro, or pb")
+	avro_schema := flag.String("avro-schema", "", "An Avro schema file (.avsc) with a field per column, instead of string fields")
+	avro_compression := flag.String("avro-compression", "deflate", "The avro container compression: null, deflate, or snappy")
+	parquet_compression := flag.String("parquet-compression", "zstd", "The parquet compression: none, snappy, gzip, or zstd")
+	parquet_row_group := flag.Int("parquet-row-group", 100000, "The maximum number of rows per parquet row group")
+	output_compression := flag.String("output-compression", "none", "The output compression: none, gzip, zstd, or lz4")
+	compression_level := flag.Int("compression-level", -1, "The output compression level, -1 uses the default for the codec")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	normalize = flag.Bool("normalize", false, "Encode internationalized names as punycode and skip names with invalid labels")
 	version := flag.Bool("version", false, "Show the version and build timestamp")
+	selected_fields := flag.String("fields", "dns,ip,email", "The certificate details to include: "+strings.Join(CTFields, ", "))
+
+	inetdata.AddTuningFlags()
+	inetdata.AddJSONSampleFlags("leaf_input")
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+	inetdata.AddCertParseFlags()
 
-	flag.Parse()
+	inetdata.ParseFlags("inetdata-ct2csv")
 
 	if *version {
 		inetdata.PrintVersion("inetdata-ct2csv")
 		os.Exit(0)
 	}
 
+	inetdata.HandleSignals("inetdata-ct2csv")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if e := inetdata.ApplyCertParse(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	for _, field := range strings.Split(*selected_fields, ",") {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+		valid := false
+		for _, f := range CTFields {
+			valid = valid || f == field
+		}
+		if !valid {
+			inetdata.Log.Errorf("Invalid field specified: %s", field)
+			usage()
+			os.Exit(1)
+		}
+		fields[field] = true
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args(), *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidOutputCompression(*output_compression) {
+		inetdata.Log.Errorf("Invalid output compression specified: %s", *output_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	switch *format {
+	case "csv":
+	case "parquet":
+		if *output_compression != "none" {
+			inetdata.Log.Errorf("parquet output is compressed with -parquet-compression, not -output-compression")
+			usage()
+			os.Exit(1)
+		}
+		if !inetdata.ValidParquetCompression(*parquet_compression) {
+			inetdata.Log.Errorf("Invalid parquet compression specified: %s", *parquet_compression)
+			usage()
+			os.Exit(1)
+		}
+	case "avro":
+		if *output_compression != "none" {
+			inetdata.Log.Errorf("avro output is compressed with -avro-compression, not -output-compression")
+			usage()
+			os.Exit(1)
+		}
+		if !inetdata.ValidAvroCompression(*avro_compression) {
+			inetdata.Log.Errorf("Invalid avro compression specified: %s", *avro_compression)
+			usage()
+			os.Exit(1)
+		}
+	case "pb":
+	default:
+		inetdata.Log.Errorf("Invalid output format specified: %s", *format)
+		usage()
+		os.Exit(1)
+	}
+
+	dest, de := inetdata.CreateOutput("")
+	if de != nil {
+		inetdata.Log.Errorf("%s", de)
+		os.Exit(1)
+	}
+
+	var output io.WriteCloser
+	var oe error
+
+	// Protobuf records are compressed with -output-compression
+	var compressed io.WriteCloser
+
+	switch *format {
+	case "parquet":
+		columns := []inetdata.ParquetColumn{{Name: "key"}, {Name: "value"}}
+		pw, pe := inetdata.NewParquetWriter(dest, columns, *parquet_compression, *parquet_row_group)
+		if pe == nil {
+			output = inetdata.NewLineRowWriter(pw, len(columns), "\t")
+		}
+		oe = pe
+	case "avro":
+		columns := []string{"key", "value"}
+		schema := inetdata.AvroSchema("ct", columns)
+		if len(*avro_schema) > 0 {
+			b, e := ioutil.ReadFile(*avro_schema)
+			if e != nil {
+				inetdata.Log.Errorf("%s", e)
+				os.Exit(1)
+			}
+			schema = string(b)
+		}
+
+		aw, ae := inetdata.NewAvroWriter(dest, schema, *avro_compression)
+		if ae == nil && aw.NumFields() != len(columns) {
+			ae = fmt.Errorf("the avro schema must have %d fields: %s", len(columns), strings.Join(columns, ","))
+		}
+		if ae == nil {
+			output = inetdata.NewLineRowWriter(aw, len(columns), "\t")
+		}
+		oe = ae
+	case "pb":
+		compressed, oe = inetdata.NewOutputWriter(dest, *output_compression, *compression_level)
+		if oe == nil {
+			output = inetdata.NewLineRowWriter(inetdata.NewProtoWriter(compressed), 2, "\t")
+		}
+	default:
+		output, oe = inetdata.NewOutputWriter(dest, *output_compression, *compression_level)
+	}
+	if oe != nil {
+		inetdata.Log.Errorf("%s", oe)
+		os.Exit(1)
+	}
+
 	if len(*sort_tmp) == 0 {
 		*sort_tmp = os.Getenv("HOME")
 	}
@@ -322,7 +560,7 @@ func main() {
 	jsonl_writer_done := make(chan bool, 1)
 
 	// Read from the jsonl_writer_ch for NewRecords and write to the CSV writer
-	go writeToOutput(jsonl_writer_ch, jsonl_writer_done)
+	go writeToOutput(output, jsonl_writer_ch, jsonl_writer_done)
 
 	// Create the sort and rollup pipeline
 	subprocs := []*exec.Cmd{}
@@ -334,20 +572,20 @@ func main() {
 		"--key=1",
 		"--field-separator=,",
 		"--compress-program=pigz",
-		fmt.Sprintf("--parallel=%d", runtime.NumCPU()),
+		fmt.Sprintf("--parallel=%d", inetdata.Workers),
 		fmt.Sprintf("--temporary-directory=%s", *sort_tmp),
 		fmt.Sprintf("--buffer-size=%dG", *sort_mem))
 
 	// Configure stdio
 	sort_stdin, sie := sort_proc.StdinPipe()
 	if sie != nil {
-		fmt.Fprintf(os.Stderr, "Error: failed to create sort stdin pipe: %s\n", sie)
+		inetdata.Log.Errorf("failed to create sort stdin pipe: %s", sie)
 		os.Exit(1)
 	}
 
 	sort_stdout, soe := sort_proc.StdoutPipe()
 	if soe != nil {
-		fmt.Fprintf(os.Stderr, "Error: failed to create sort stdout pipe: %s\n", soe)
+		inetdata.Log.Errorf("failed to create sort stdout pipe: %s", soe)
 		os.Exit(1)
 	}
 
@@ -355,8 +593,9 @@ func main() {
 	subprocs = append(subprocs, sort_proc)
 
 	// Start the sort process
+	inetdata.DetachSignals(sort_proc)
 	if e := sort_proc.Start(); e != nil {
-		fmt.Fprintf(os.Stderr, "Error: failed to execute the sort command: %s\n", e)
+		inetdata.Log.Errorf("failed to execute the sort command: %s", e)
 		os.Exit(1)
 	}
 
@@ -366,7 +605,7 @@ func main() {
 	// Configure stdio
 	roll_stdout, roe := roll_proc.StdoutPipe()
 	if roe != nil {
-		fmt.Fprintf(os.Stderr, "Error: failed to create sort stdout pipe: %s\n", roe)
+		inetdata.Log.Errorf("failed to create sort stdout pipe: %s", roe)
 		os.Exit(1)
 	}
 
@@ -375,8 +614,9 @@ func main() {
 	subprocs = append(subprocs, roll_proc)
 
 	// Start the rollup process
+	inetdata.DetachSignals(roll_proc)
 	if e := roll_proc.Start(); e != nil {
-		fmt.Fprintf(os.Stderr, "Error: failed to execute the inetdata-csvrollup command: %s\n", e)
+		inetdata.Log.Errorf("failed to execute the inetdata-csvrollup command: %s", e)
 		os.Exit(1)
 	}
 
@@ -387,13 +627,13 @@ func main() {
 		"--key=1",
 		"--field-separator=,",
 		"--compress-program=pigz",
-		fmt.Sprintf("--parallel=%d", runtime.NumCPU()),
+		fmt.Sprintf("--parallel=%d", inetdata.Workers),
 		fmt.Sprintf("--temporary-directory=%s", *sort_tmp),
 		fmt.Sprintf("--buffer-size=%dG", *sort_mem))
 
 	sort2_stdout, ssoe := sort2_proc.StdoutPipe()
 	if ssoe != nil {
-		fmt.Fprintf(os.Stderr, "Error: failed to create sort stdout pipe: %s\n", ssoe)
+		inetdata.Log.Errorf("failed to create sort stdout pipe: %s", ssoe)
 		os.Exit(1)
 	}
 	sort2_proc.Stdin = roll_stdout
@@ -402,8 +642,9 @@ func main() {
 	subprocs = append(subprocs, sort2_proc)
 
 	// Start the sort process
+	inetdata.DetachSignals(sort2_proc)
 	if e := sort2_proc.Start(); e != nil {
-		fmt.Fprintf(os.Stderr, "Error: failed to execute the second sort command: %s\n", e)
+		inetdata.Log.Errorf("failed to execute the second sort command: %s", e)
 		os.Exit(1)
 	}
 
@@ -417,25 +658,39 @@ func main() {
 		// Read rollup entries from the sort pipe and send to the parser
 		e := inetdata.ReadLinesFromReader(sort2_stdout, c_ct_sorted_output)
 		if e != nil {
-			fmt.Fprintf(os.Stderr, "Error reading sort 2 input: %s\n", e)
+			inetdata.Log.Errorf("Failed to read sort 2 input: %s", e)
 			os.Exit(1)
 		}
 		wg_sort_reader.Done()
 	}()
 
+	progress := inetdata.NewProgress("inetdata-ct2csv", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.AddCounter("merged", &merge_count)
+	progress.Errors = &invalid_count
+	progress.AddCounter("lenient", inetdata.LenientCount())
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
 	// Start the progress tracker
 	quit := make(chan int)
-	go showProgress(quit)
+	go progress.Run(quit)
 
 	// Large channel buffer evens out spikey per-record processing time
 	c_ct_raw_input := make(chan string, 4096)
+	progress.AddStage("input", func() int { return len(c_ct_raw_input) })
 
 	// Output
 	c_ct_parsed_output := make(chan string)
 
 	// Launch one input parser per core
-	wg_raw_ct_input.Add(runtime.NumCPU())
-	for i := 0; i < runtime.NumCPU(); i++ {
+	wg_raw_ct_input.Add(inetdata.Workers)
+	for i := 0; i < inetdata.Workers; i++ {
 		go rawCTReader(c_ct_raw_input, c_ct_parsed_output)
 	}
 
@@ -444,9 +699,9 @@ func main() {
 	go parsedCTWriter(c_ct_parsed_output, sort_stdin)
 
 	// Read CT JSON from stdin, parse, and send to sort
-	e := inetdata.ReadLines(os.Stdin, c_ct_raw_input)
+	e := inetdata.ReadLinesFromInputs(inputs, *input_compression, progress.CountReader, c_ct_raw_input)
 	if e != nil {
-		fmt.Fprintf(os.Stderr, "Error reading input: %s\n", e)
+		inetdata.Log.Warnf("Failed to read input: %s", e)
 	}
 
 	// Wait for the input parsers
@@ -475,6 +730,26 @@ func main() {
 	// Wait for the json writer to finish
 	<-jsonl_writer_done
 
+	if e := output.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+	}
+
+	if compressed != nil {
+		if e := compressed.Close(); e != nil {
+			inetdata.Log.Warnf("Failed to write output: %s", e)
+		}
+	}
+
+	if e := dest.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+	}
+
 	// Stop the progress monitor
 	quit <- 0
+
+	inetdata.ReportLenientCerts()
+	inetdata.CloseRejects()
+
+	inetdata.ExitIfInterrupted()
+	inetdata.CheckErrorBudget(input_count)
 }
@@ -1,121 +1,315 @@
 package main
 
 import (
+	"encoding/csv"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/dnsname"
 	ct "github.com/google/certificate-transparency-go"
 	"github.com/google/certificate-transparency-go/tls"
 	"github.com/google/certificate-transparency-go/x509"
 	"golang.org/x/net/publicsuffix"
+	"io"
+	"net"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
-	"time"
 )
 
 var output_count int64 = 0
 var input_count int64 = 0
 var timestamps *bool
+var csv_output *bool
+var unicode_names *bool
+var normalize *bool
+var unique *bool
+var wildcard_mode string
+var input_format string
 
 var wi sync.WaitGroup
 var wo sync.WaitGroup
 
+var output io.Writer = os.Stdout
+
+// The outputs of -ip-out and -email-out, or nil without them
+var ip_output, email_output io.WriteCloser
+
 type CTEntry struct {
 	LeafInput []byte `json:"leaf_input"`
 	ExtraData []byte `json:"extra_data"`
 }
 
+type CTTailRecord struct {
+	Timestamp uint64   `json:"timestamp"`
+	CN        string   `json:"cn"`
+	Names     []string `json:"names"`
+	IPs       []string `json:"ips"`
+	Emails    []string `json:"emails"`
+}
+
+// The raw names, IP addresses, and email addresses of a certificate
+type certNames struct {
+	ts     uint64
+	names  []string
+	ips    []string
+	emails []string
+}
+
 func usage() {
-	fmt.Println("Usage: " + os.Args[0] + " [options]")
+	fmt.Println("Usage: " + os.Args[0] + " [options] [<input> ... <input>]")
 	fmt.Println("")
 	fmt.Println("Reads a CT log in JSONL format (one line per record) and emits hostnames")
 	fmt.Println("")
+	fmt.Println("The input format is one of:")
+	fmt.Println("")
+	fmt.Println("  json       : raw get-entries records with leaf_input and extra_data")
+	fmt.Println("  tail-csv   : the csv output of inetdata-ct-tail")
+	fmt.Println("  tail-jsonl : the jsonl output of inetdata-ct-tail")
+	fmt.Println("")
+	fmt.Println("Wildcard names (*.example.com) are handled according to -wildcards:")
+	fmt.Println("")
+	fmt.Println("  keep        : emit the name as-is")
+	fmt.Println("  strip       : remove the leading wildcard label and emit the parent name")
+	fmt.Println("  drop        : skip wildcard names entirely")
+	fmt.Println("  expand-base : emit both the wildcard name and the parent name")
+	fmt.Println("")
+	fmt.Println("Use -csv to emit name,timestamp records suitable for inetdata-csvrollup")
+	fmt.Println("")
+	fmt.Println("The IP address and email address SANs are skipped, unless -ip-out or -email-out")
+	fmt.Println("name a file to write them to, in the same format as the names. IP addresses are")
+	fmt.Println("written in canonical form, and the domains of email addresses in lowercase.")
+	fmt.Println("")
 	fmt.Println("Options:")
 	flag.PrintDefaults()
 }
 
-func showProgress(quit chan int) {
-	start := time.Now()
-	for {
-		select {
-		case <-quit:
-			return
-		case <-time.After(time.Second * 1):
-			icount := atomic.LoadInt64(&input_count)
-			ocount := atomic.LoadInt64(&output_count)
-
-			if icount == 0 && ocount == 0 {
-				// Reset start, so that we show stats only from our first input
-				start = time.Now()
+func outputWriter(o <-chan string, w io.Writer) {
+	seen := make(map[string]struct{})
+	for name := range o {
+		if *unique {
+			if _, ok := seen[name]; ok {
 				continue
 			}
-			elapsed := time.Since(start)
-			if elapsed.Seconds() > 1.0 {
-				fmt.Fprintf(os.Stderr, "[*] [inetdata-ct2hostnames] Read %d and wrote %d records in %d seconds (%d/s in, %d/s out)\n",
-					icount,
-					ocount,
-					int(elapsed.Seconds()),
-					int(float64(icount)/elapsed.Seconds()),
-					int(float64(ocount)/elapsed.Seconds()))
-			}
+			seen[name] = struct{}{}
 		}
+		io.WriteString(w, name+"\n")
+		atomic.AddInt64(&output_count, 1)
 	}
+	wo.Done()
 }
 
-func outputWriter(o <-chan string) {
-	for name := range o {
-		fmt.Println(name)
-		atomic.AddInt64(&output_count, 1)
+// Returns true if the name is a syntactically valid hostname, allowing a
+// single leading wildcard label and underscores in labels, that is not an
+// IPv4 address and has a known public suffix
+func validHostname(name string) bool {
+	if !dnsname.ValidHostname(name) {
+		return false
 	}
-	wo.Done()
+
+	// Skip IPv4 addresses that were placed into name fields
+	if inetdata.Match_IPv4.Match([]byte(name)) {
+		return false
+	}
+
+	// Require a known public suffix
+	if _, err := publicsuffix.EffectiveTLDPlusOne(strings.TrimPrefix(name, "*.")); err != nil {
+		return false
+	}
+
+	return true
 }
 
-func inputParser(c <-chan string, o chan<- string) {
+// Normalize a raw certificate name, returning the names to emit
+func normalizeName(raw string) []string {
+	name := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(raw)), ".")
 
-	for r := range c {
-		var entry CTEntry
+	if *normalize {
+		var err error
+		if name, err = dnsname.Normalize(raw); err != nil {
+			return nil
+		}
+	}
 
-		if err := json.Unmarshal([]byte(r), &entry); err != nil {
-			fmt.Fprintf(os.Stderr, "Error parsing input: %s\n", r)
+	out := []string{}
+	for _, n := range dnsname.Wildcards(name, wildcard_mode) {
+		if !validHostname(n) {
 			continue
 		}
+		out = append(out, n)
 
-		var leaf ct.MerkleTreeLeaf
-
-		if rest, err := tls.Unmarshal(entry.LeafInput, &leaf); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to unmarshal MerkleTreeLeaf: %v (%s)", err, r)
-			continue
-		} else if len(rest) > 0 {
-			fmt.Fprintf(os.Stderr, "Trailing data (%d bytes) after MerkleTreeLeaf: %q", len(rest), rest)
-			continue
+		if *unicode_names && strings.Contains(n, "xn--") {
+			if uname, err := dnsname.ToUnicode(n); err == nil && uname != n {
+				out = append(out, uname)
+			}
 		}
+	}
+
+	return out
+}
 
-		var cert *x509.Certificate
+// Return an IP address in canonical form, or false if it is not one
+func normalizeIP(raw string) (string, bool) {
+	ip := net.ParseIP(strings.TrimSpace(raw))
+	if ip == nil {
+		return "", false
+	}
+	return ip.String(), true
+}
+
+// Return an email address with its domain in lowercase, and encoded as
+// punycode with -normalize, or false if it is not an address at a valid
+// hostname
+func normalizeEmail(raw string) (string, bool) {
+	raw = strings.TrimSpace(raw)
+	at := strings.LastIndex(raw, "@")
+	if at < 1 {
+		return "", false
+	}
+
+	local := raw[:at]
+	if strings.ContainsAny(local, " ,\t\r\n") {
+		return "", false
+	}
+
+	domain := strings.TrimSuffix(strings.ToLower(raw[at+1:]), ".")
+	if *normalize {
 		var err error
+		if domain, err = dnsname.Normalize(domain); err != nil {
+			return "", false
+		}
+	}
+	if strings.HasPrefix(domain, "*.") || !validHostname(domain) {
+		return "", false
+	}
+	return local + "@" + domain, true
+}
 
-		switch leaf.TimestampedEntry.EntryType {
-		case ct.X509LogEntryType:
+// Format an output line for a name, address, or email address
+func formatLine(n string, ts uint64) string {
+	switch {
+	case *csv_output:
+		return fmt.Sprintf("%s,%d", n, ts)
+	case *timestamps:
+		return fmt.Sprintf("%d\t%s", ts, n)
+	}
+	return n
+}
 
-			cert, err = x509.ParseCertificate(leaf.TimestampedEntry.X509Entry.Data)
-			if err != nil && !strings.Contains(err.Error(), "NonFatalErrors:") {
-				fmt.Fprintf(os.Stderr, "Failed to parse cert: %s\n", err.Error())
-				continue
-			}
+// Extract the timestamp and raw names from a CT get-entries record
+func parseEntry(r string) (certNames, bool) {
+	var entry CTEntry
 
-		case ct.PrecertLogEntryType:
+	if err := json.Unmarshal([]byte(r), &entry); err != nil {
+		inetdata.Log.Warnf("Failed to parse input: %s", r)
+		inetdata.Rejects.Reject(inetdata.REJECT_INVALID_JSON, r)
+		return certNames{}, false
+	}
 
-			cert, err = x509.ParseTBSCertificate(leaf.TimestampedEntry.PrecertEntry.TBSCertificate)
-			if err != nil && !strings.Contains(err.Error(), "NonFatalErrors:") {
-				fmt.Fprintf(os.Stderr, "Failed to parse precert: %s\n", err.Error())
-				continue
-			}
+	var leaf ct.MerkleTreeLeaf
 
+	if rest, err := tls.Unmarshal(entry.LeafInput, &leaf); err != nil {
+		inetdata.Log.Warnf("Failed to unmarshal MerkleTreeLeaf: %v (%s)", err, r)
+		inetdata.Rejects.Reject(inetdata.REJECT_INVALID_ENTRY, r)
+		return certNames{}, false
+	} else if len(rest) > 0 {
+		inetdata.Log.Warnf("Trailing data (%d bytes) after MerkleTreeLeaf: %q", len(rest), rest)
+		inetdata.Rejects.Reject(inetdata.REJECT_INVALID_ENTRY, r)
+		return certNames{}, false
+	}
+
+	var cert *x509.Certificate
+	var err error
+
+	switch leaf.TimestampedEntry.EntryType {
+	case ct.X509LogEntryType:
+
+		cert, err = inetdata.ParseCertificate(leaf.TimestampedEntry.X509Entry.Data)
+		if err != nil {
+			inetdata.Log.Warnf("Failed to parse cert: %s", err.Error())
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_CERT, r)
+			return certNames{}, false
+		}
+
+	case ct.PrecertLogEntryType:
+
+		cert, err = inetdata.ParseTBSCertificate(leaf.TimestampedEntry.PrecertEntry.TBSCertificate)
+		if err != nil {
+			inetdata.Log.Warnf("Failed to parse precert: %s", err.Error())
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_CERT, r)
+			return certNames{}, false
+		}
+
+	default:
+		inetdata.Log.Warnf("Unknown entry type: %v (%s)", leaf.TimestampedEntry.EntryType, r)
+		inetdata.Rejects.Reject(inetdata.REJECT_INVALID_ENTRY, r)
+		return certNames{}, false
+	}
+
+	c := certNames{
+		ts:     leaf.TimestampedEntry.Timestamp,
+		names:  append([]string{cert.Subject.CommonName}, cert.DNSNames...),
+		emails: cert.EmailAddresses,
+	}
+	for _, ip := range cert.IPAddresses {
+		c.ips = append(c.ips, ip.String())
+	}
+	return c, true
+}
+
+// Extract the timestamp and raw names from an inetdata-ct-tail jsonl record
+func parseTailJSON(r string) (certNames, bool) {
+	var rec CTTailRecord
+
+	if err := json.Unmarshal([]byte(r), &rec); err != nil {
+		inetdata.Log.Warnf("Failed to parse input: %s", r)
+		inetdata.Rejects.Reject(inetdata.REJECT_INVALID_JSON, r)
+		return certNames{}, false
+	}
+
+	return certNames{ts: rec.Timestamp, names: append([]string{rec.CN}, rec.Names...), ips: rec.IPs, emails: rec.Emails}, true
+}
+
+// Extract the timestamp and raw names from an inetdata-ct-tail csv record
+func parseTailCSV(r string) (certNames, bool) {
+	bits, err := csv.NewReader(strings.NewReader(r)).Read()
+	if err != nil || len(bits) < 8 {
+		inetdata.Log.Warnf("Failed to parse input: %s", r)
+		inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, r)
+		return certNames{}, false
+	}
+
+	ts, err := strconv.ParseUint(bits[2], 10, 64)
+	if err != nil {
+		inetdata.Log.Warnf("Failed to parse timestamp: %s", r)
+		inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, r)
+		return certNames{}, false
+	}
+
+	return certNames{ts: ts, names: append([]string{bits[6]}, strings.Fields(bits[7])...)}, true
+}
+
+func inputParser(c <-chan string, o chan<- string, o_ip chan<- string, o_email chan<- string) {
+
+	for r := range c {
+
+		var raw certNames
+		var ok bool
+
+		switch input_format {
+		case "tail-csv":
+			raw, ok = parseTailCSV(r)
+		case "tail-jsonl":
+			raw, ok = parseTailJSON(r)
 		default:
-			fmt.Fprintf(os.Stderr, "Unknown entry type: %v (%s)", leaf.TimestampedEntry.EntryType, r)
+			raw, ok = parseEntry(r)
+		}
+
+		if !ok {
 			continue
 		}
 
@@ -123,37 +317,48 @@ func inputParser(c <-chan string, o chan<- string) {
 		atomic.AddInt64(&input_count, 1)
 
 		var names = make(map[string]struct{})
+		var ips = make(map[string]struct{})
+		var emails = make(map[string]struct{})
 
-		if _, err := publicsuffix.EffectiveTLDPlusOne(cert.Subject.CommonName); err == nil {
-			// Make sure the CN looks like an actual hostname
-			if strings.Contains(cert.Subject.CommonName, " ") ||
-				strings.Contains(cert.Subject.CommonName, ":") ||
-				inetdata.Match_IPv4.Match([]byte(cert.Subject.CommonName)) {
+		for _, n := range raw.names {
+			// Addresses placed into name fields count as IP SANs
+			if ip, ok := normalizeIP(n); ok {
+				ips[ip] = struct{}{}
 				continue
 			}
-			names[strings.ToLower(cert.Subject.CommonName)] = struct{}{}
+			for _, name := range normalizeName(n) {
+				names[name] = struct{}{}
+			}
 		}
 
-		for _, alt := range cert.DNSNames {
-			if _, err := publicsuffix.EffectiveTLDPlusOne(alt); err == nil {
-				// Make sure the CN looks like an actual hostname
-				if strings.Contains(alt, " ") ||
-					strings.Contains(alt, ":") ||
-					inetdata.Match_IPv4.Match([]byte(alt)) {
-					continue
+		if o_ip != nil {
+			for _, n := range raw.ips {
+				if ip, ok := normalizeIP(n); ok {
+					ips[ip] = struct{}{}
 				}
-				names[strings.ToLower(alt)] = struct{}{}
 			}
 		}
 
-		// Write the names to the output channel
-		if *timestamps {
-			for n := range names {
-				o <- fmt.Sprintf("%d\t%s", leaf.TimestampedEntry.Timestamp, n)
+		if o_email != nil {
+			for _, n := range raw.emails {
+				if email, ok := normalizeEmail(n); ok {
+					emails[email] = struct{}{}
+				}
 			}
-		} else {
-			for n := range names {
-				o <- n
+		}
+
+		// Write the names to the output channels
+		for n := range names {
+			o <- formatLine(n, raw.ts)
+		}
+		if o_ip != nil {
+			for n := range ips {
+				o_ip <- formatLine(n, raw.ts)
+			}
+		}
+		if o_email != nil {
+			for n := range emails {
+				o_email <- formatLine(n, raw.ts)
 			}
 		}
 	}
@@ -167,19 +372,128 @@ func main() {
 	os.Setenv("LC_ALL", "C")
 
 	flag.Usage = func() { usage() }
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
 	version := flag.Bool("version", false, "Show the version and build timestamp")
 	timestamps = flag.Bool("timestamps", false, "Prefix all extracted names with the CT entry timestamp")
-
-	flag.Parse()
+	csv_output = flag.Bool("csv", false, "Emit name,timestamp records suitable for inetdata-csvrollup")
+	unicode_names = flag.Bool("unicode", false, "Also emit the decoded Unicode form of punycode (xn--) names")
+	normalize = flag.Bool("normalize", false, "Encode internationalized names as punycode and skip names with invalid labels")
+	unique = flag.Bool("unique", false, "Only emit each distinct output line once (uses memory proportional to the output)")
+	wildcards := flag.String("wildcards", "keep", "The wildcard handling mode: keep, strip, drop, or expand-base")
+	format := flag.String("input-format", "json", "The input format: json, tail-csv, or tail-jsonl")
+	ip_out := flag.String("ip-out", "", "Write the IP address SANs to this file, instead of skipping them")
+	email_out := flag.String("email-out", "", "Write the email address SANs to this file, instead of skipping them")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddJSONSampleFlags("leaf_input,names")
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+	inetdata.AddCertParseFlags()
+
+	inetdata.ParseFlags("inetdata-ct2hostnames")
 
 	if *version {
 		inetdata.PrintVersion("inetdata-ct2hostnames")
 		os.Exit(0)
 	}
 
+	inetdata.HandleSignals("inetdata-ct2hostnames")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if e := inetdata.ApplyCertParse(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	dest, de := inetdata.CreateOutput("")
+	if de != nil {
+		inetdata.Log.Errorf("%s", de)
+		os.Exit(1)
+	}
+	output = dest
+
+	if len(*ip_out) > 0 {
+		if ip_output, de = inetdata.CreateOutput(*ip_out); de != nil {
+			inetdata.Log.Errorf("%s", de)
+			os.Exit(1)
+		}
+	}
+
+	if len(*email_out) > 0 {
+		if email_output, de = inetdata.CreateOutput(*email_out); de != nil {
+			inetdata.Log.Errorf("%s", de)
+			os.Exit(1)
+		}
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !dnsname.ValidWildcardPolicy(*wildcards) {
+		inetdata.Log.Errorf("Invalid wildcard mode specified: %s", *wildcards)
+		usage()
+		os.Exit(1)
+	}
+	wildcard_mode = *wildcards
+
+	switch *format {
+	case "json", "tail-csv", "tail-jsonl":
+		input_format = *format
+	default:
+		inetdata.Log.Errorf("Invalid input format specified: %s", *format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args(), *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	progress := inetdata.NewProgress("inetdata-ct2hostnames", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.AddCounter("lenient", inetdata.LenientCount())
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
 	// Start the progress tracker
 	quit := make(chan int)
-	go showProgress(quit)
+	go progress.Run(quit)
 
 	// Input
 	c_inp := make(chan string)
@@ -187,31 +501,71 @@ func main() {
 	// Output
 	c_out := make(chan string)
 
+	// The outputs of the IP and email addresses, nil without them
+	var c_ip, c_email chan string
+
+	if ip_output != nil {
+		c_ip = make(chan string)
+		go outputWriter(c_ip, ip_output)
+		wo.Add(1)
+	}
+
+	if email_output != nil {
+		c_email = make(chan string)
+		go outputWriter(c_email, email_output)
+		wo.Add(1)
+	}
+
 	// Launch one input parser per core
-	for i := 0; i < runtime.NumCPU(); i++ {
-		go inputParser(c_inp, c_out)
+	for i := 0; i < inetdata.Workers; i++ {
+		go inputParser(c_inp, c_out, c_ip, c_email)
 	}
-	wi.Add(runtime.NumCPU())
+	wi.Add(inetdata.Workers)
 
 	// Launch a single output writer
-	go outputWriter(c_out)
+	go outputWriter(c_out, output)
 	wo.Add(1)
 
 	// Reader closers c_inp on completion
-	e := inetdata.ReadLines(os.Stdin, c_inp)
+	e := inetdata.ReadLinesFromInputs(inputs, *input_compression, progress.CountReader, c_inp)
 	if e != nil {
-		fmt.Fprintf(os.Stderr, "Error reading input: %s\n", e)
+		inetdata.Log.Warnf("Failed to read input: %s", e)
 	}
 
 	// Wait for the input parsers
 	wi.Wait()
 
-	// Close the output handle
+	// Close the output handles
 	close(c_out)
+	if c_ip != nil {
+		close(c_ip)
+	}
+	if c_email != nil {
+		close(c_email)
+	}
 
-	// Wait for the output goroutine
+	// Wait for the output goroutines
 	wo.Wait()
 
+	if e := dest.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+	}
+
+	for _, w := range []io.WriteCloser{ip_output, email_output} {
+		if w == nil {
+			continue
+		}
+		if e := w.Close(); e != nil {
+			inetdata.Log.Warnf("Failed to write output: %s", e)
+		}
+	}
+
 	// Stop the progress monitor
 	quit <- 0
+
+	inetdata.ReportLenientCerts()
+	inetdata.CloseRejects()
+
+	inetdata.ExitIfInterrupted(*ip_out, *email_out)
+	inetdata.CheckErrorBudget(input_count)
 }
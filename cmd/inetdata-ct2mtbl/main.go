@@ -6,8 +6,11 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"github.com/fathom6/golang-mtbl"
 	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/dnsname"
+	"github.com/fathom6/inetdata-parsers/linereader"
+	"github.com/fathom6/inetdata-parsers/mtbl"
+	"github.com/fathom6/inetdata-parsers/mtblutil"
 	ct "github.com/google/certificate-transparency-go"
 	"github.com/google/certificate-transparency-go/tls"
 	"github.com/google/certificate-transparency-go/x509"
@@ -20,14 +23,9 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
-	"time"
 )
 
-const MERGE_MODE_COMBINE = 0
-const MERGE_MODE_FIRST = 1
-const MERGE_MODE_LAST = 2
-
-var merge_mode = MERGE_MODE_COMBINE
+var merge_func mtblutil.MergeFunc
 
 var compression_types = map[string]int{
 	"none":   mtbl.COMPRESSION_NONE,
@@ -42,6 +40,7 @@ var output_count int64 = 0
 var input_count int64 = 0
 var invalid_count int64 = 0
 var timestamps *bool
+var normalize *bool
 
 var wg_raw_ct_input sync.WaitGroup
 var wg_parsed_ct_writer sync.WaitGroup
@@ -59,7 +58,7 @@ type NewRecord struct {
 }
 
 func usage() {
-	fmt.Println("Usage: " + os.Args[0] + " [options] <output.mtbl>")
+	fmt.Println("Usage: " + os.Args[0] + " [options] <output.mtbl> [<input> ... <input>]")
 	fmt.Println("")
 	fmt.Println("Reads a CT log in JSONL format (one line per record) and emits a MTBL")
 	fmt.Println("")
@@ -67,34 +66,14 @@ func usage() {
 	flag.PrintDefaults()
 }
 
-func showProgress(quit chan int) {
-	start := time.Now()
-	for {
-		select {
-		case <-quit:
-			return
-		case <-time.After(time.Second * 1):
-			icount := atomic.LoadInt64(&input_count)
-			ocount := atomic.LoadInt64(&output_count)
-			mcount := atomic.LoadInt64(&merge_count)
-			ecount := atomic.LoadInt64(&invalid_count)
-
-			if icount == 0 && ocount == 0 {
-				// Reset start, so that we show stats only from our first input
-				start = time.Now()
-				continue
-			}
-			elapsed := time.Since(start)
-			if elapsed.Seconds() > 1.0 {
-				fmt.Fprintf(os.Stderr, "[*] [inetdata-ct2mtbl] Read %d and wrote %d records in %d seconds (%d/s in, %d/s out) (merged: %d, invalid: %d)\n",
-					icount,
-					ocount,
-					int(elapsed.Seconds()),
-					int(float64(icount)/elapsed.Seconds()),
-					int(float64(ocount)/elapsed.Seconds()),
-					mcount, ecount)
-			}
-		}
+// Add a certificate name to the set, in canonical form with -normalize
+func addName(names map[string]struct{}, name string) {
+	if !*normalize {
+		names[strings.ToLower(name)] = struct{}{}
+		return
+	}
+	if cname, err := dnsname.Normalize(name); err == nil {
+		names[cname] = struct{}{}
 	}
 }
 
@@ -105,62 +84,14 @@ func scrubX509Value(bit string) string {
 }
 
 func mergeFunc(key []byte, val0 []byte, val1 []byte) (mergedVal []byte) {
-
 	atomic.AddInt64(&merge_count, 1)
-
-	if merge_mode == MERGE_MODE_FIRST {
-		return val0
-	}
-
-	if merge_mode == MERGE_MODE_LAST {
-		return val1
-	}
-
-	// MERGE_MODE_COMBINE
-	var unique = make(map[string]bool)
-	var v0, v1, m [][]string
-
-	// fmt.Fprintf(os.Stderr, "MERGE[%v]     %v    ->    %v\n", string(key), string(val0), string(val1))
-
-	if e := json.Unmarshal(val0, &v0); e != nil {
-		return val1
-	}
-
-	if e := json.Unmarshal(val1, &v1); e != nil {
-		return val0
-	}
-
-	for i := range v0 {
-		if len(v0[i]) == 0 {
-			continue
-		}
-		unique[strings.Join(v0[i], "\x00")] = true
-	}
-
-	for i := range v1 {
-		if len(v1[i]) == 0 {
-			continue
-		}
-		unique[strings.Join(v1[i], "\x00")] = true
-	}
-
-	for i := range unique {
-		m = append(m, strings.SplitN(i, "\x00", 2))
-	}
-
-	d, e := json.Marshal(m)
-	if e != nil {
-		fmt.Fprintf(os.Stderr, "JSON merge error: %v -> %v + %v\n", e, val0, val1)
-		return val0
-	}
-
-	return d
+	return merge_func(key, val0, val1)
 }
 
 func writeToMtbl(s *mtbl.Sorter, c chan NewRecord, d chan bool) {
 	for r := range c {
 		if e := s.Add(r.Key, r.Val); e != nil {
-			fmt.Fprintf(os.Stderr, "[-] Failed to add key=%v (%v): %v\n", r.Key, r.Val, e)
+			inetdata.Log.Warnf("Failed to add key=%v (%v): %v", r.Key, r.Val, e)
 		}
 		atomic.AddInt64(&output_count, 1)
 	}
@@ -217,7 +148,7 @@ func sortedCTParser(d chan string, c chan NewRecord) {
 
 		json, e := json.Marshal(outp)
 		if e != nil {
-			fmt.Fprintf(os.Stderr, "[-] Could not marshal %v: %s\n", outm, e)
+			inetdata.Log.Warnf("Could not marshal %v: %s", outm, e)
 			continue
 		}
 
@@ -241,111 +172,121 @@ func parsedCTWriter(o <-chan string, fd io.WriteCloser) {
 	wg_parsed_ct_writer.Done()
 }
 
-func rawCTReader(c <-chan string, o chan<- string) {
+func rawCTReader(c <-chan *linereader.Line, o chan<- string) {
+	for l := range c {
+		parseRawEntry(l.Bytes, o)
+		l.Recycle()
+	}
+	wg_raw_ct_input.Done()
+}
 
-	for r := range c {
-		var entry CTEntry
+// Parse a JSON CT entry and emit the name,type,value lines of its certificate
+func parseRawEntry(r []byte, o chan<- string) {
+	var entry CTEntry
 
-		if err := json.Unmarshal([]byte(r), &entry); err != nil {
-			fmt.Fprintf(os.Stderr, "Error parsing input: %s\n", r)
-			continue
-		}
+	if err := json.Unmarshal(r, &entry); err != nil {
+		inetdata.Log.Warnf("Failed to parse input: %s", r)
+		inetdata.Rejects.Reject(inetdata.REJECT_INVALID_JSON, string(r))
+		return
+	}
 
-		var leaf ct.MerkleTreeLeaf
+	var leaf ct.MerkleTreeLeaf
 
-		if rest, err := tls.Unmarshal(entry.LeafInput, &leaf); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to unmarshal MerkleTreeLeaf: %v (%s)", err, r)
-			continue
-		} else if len(rest) > 0 {
-			fmt.Fprintf(os.Stderr, "Trailing data (%d bytes) after MerkleTreeLeaf: %q", len(rest), rest)
-			continue
-		}
-
-		var cert *x509.Certificate
-		var err error
+	if rest, err := tls.Unmarshal(entry.LeafInput, &leaf); err != nil {
+		inetdata.Log.Warnf("Failed to unmarshal MerkleTreeLeaf: %v (%s)", err, r)
+		inetdata.Rejects.Reject(inetdata.REJECT_INVALID_ENTRY, string(r))
+		return
+	} else if len(rest) > 0 {
+		inetdata.Log.Warnf("Trailing data (%d bytes) after MerkleTreeLeaf: %q", len(rest), rest)
+		inetdata.Rejects.Reject(inetdata.REJECT_INVALID_ENTRY, string(r))
+		return
+	}
 
-		switch leaf.TimestampedEntry.EntryType {
-		case ct.X509LogEntryType:
+	var cert *x509.Certificate
+	var err error
 
-			cert, err = x509.ParseCertificate(leaf.TimestampedEntry.X509Entry.Data)
-			if err != nil && !strings.Contains(err.Error(), "NonFatalErrors:") {
-				fmt.Fprintf(os.Stderr, "Failed to parse cert: %s\n", err.Error())
-				continue
-			}
+	switch leaf.TimestampedEntry.EntryType {
+	case ct.X509LogEntryType:
 
-		case ct.PrecertLogEntryType:
+		cert, err = inetdata.ParseCertificate(leaf.TimestampedEntry.X509Entry.Data)
+		if err != nil {
+			inetdata.Log.Warnf("Failed to parse cert: %s", err.Error())
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_CERT, string(r))
+			return
+		}
 
-			cert, err = x509.ParseTBSCertificate(leaf.TimestampedEntry.PrecertEntry.TBSCertificate)
-			if err != nil && !strings.Contains(err.Error(), "NonFatalErrors:") {
-				fmt.Fprintf(os.Stderr, "Failed to parse precert: %s\n", err.Error())
-				continue
-			}
+	case ct.PrecertLogEntryType:
 
-		default:
-			fmt.Fprintf(os.Stderr, "Unknown entry type: %v (%s)", leaf.TimestampedEntry.EntryType, r)
-			continue
+		cert, err = inetdata.ParseTBSCertificate(leaf.TimestampedEntry.PrecertEntry.TBSCertificate)
+		if err != nil {
+			inetdata.Log.Warnf("Failed to parse precert: %s", err.Error())
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_CERT, string(r))
+			return
 		}
 
-		// Valid input
-		atomic.AddInt64(&input_count, 1)
+	default:
+		inetdata.Log.Warnf("Unknown entry type: %v (%s)", leaf.TimestampedEntry.EntryType, r)
+		inetdata.Rejects.Reject(inetdata.REJECT_INVALID_ENTRY, string(r))
+		return
+	}
+
+	// Valid input
+	atomic.AddInt64(&input_count, 1)
 
-		var names = make(map[string]struct{})
+	var names = make(map[string]struct{})
 
-		if _, err := publicsuffix.EffectiveTLDPlusOne(cert.Subject.CommonName); err == nil {
+	if _, err := publicsuffix.EffectiveTLDPlusOne(cert.Subject.CommonName); err == nil {
+		// Make sure this looks like an actual hostname or IP address
+		if !(inetdata.Match_IPv4.Match([]byte(cert.Subject.CommonName)) ||
+			inetdata.Match_IPv6.Match([]byte(cert.Subject.CommonName))) &&
+			(strings.Contains(cert.Subject.CommonName, " ") ||
+				strings.Contains(cert.Subject.CommonName, ":")) {
+			return
+		}
+		addName(names, cert.Subject.CommonName)
+	}
+
+	for _, alt := range cert.DNSNames {
+		if _, err := publicsuffix.EffectiveTLDPlusOne(alt); err == nil {
 			// Make sure this looks like an actual hostname or IP address
 			if !(inetdata.Match_IPv4.Match([]byte(cert.Subject.CommonName)) ||
 				inetdata.Match_IPv6.Match([]byte(cert.Subject.CommonName))) &&
-				(strings.Contains(cert.Subject.CommonName, " ") ||
-					strings.Contains(cert.Subject.CommonName, ":")) {
+				(strings.Contains(alt, " ") ||
+					strings.Contains(alt, ":")) {
 				continue
 			}
-			names[strings.ToLower(cert.Subject.CommonName)] = struct{}{}
-		}
-
-		for _, alt := range cert.DNSNames {
-			if _, err := publicsuffix.EffectiveTLDPlusOne(alt); err == nil {
-				// Make sure this looks like an actual hostname or IP address
-				if !(inetdata.Match_IPv4.Match([]byte(cert.Subject.CommonName)) ||
-					inetdata.Match_IPv6.Match([]byte(cert.Subject.CommonName))) &&
-					(strings.Contains(alt, " ") ||
-						strings.Contains(alt, ":")) {
-					continue
-				}
-				names[strings.ToLower(alt)] = struct{}{}
-			}
+			addName(names, alt)
 		}
+	}
 
-		sha1hash := ""
+	sha1hash := ""
 
-		// Write the names to the output channel
-		for n := range names {
-			if len(sha1hash) == 0 {
-				sha1 := sha1.Sum(cert.Raw)
-				sha1hash = hex.EncodeToString(sha1[:])
-			}
+	// Write the names to the output channel
+	for n := range names {
+		if len(sha1hash) == 0 {
+			sha1 := sha1.Sum(cert.Raw)
+			sha1hash = hex.EncodeToString(sha1[:])
+		}
 
-			// Dump associated email addresses if available
-			for _, extra := range cert.EmailAddresses {
-				o <- fmt.Sprintf("%s,email,%s\n", n, strings.ToLower(scrubX509Value(extra)))
-			}
+		// Dump associated email addresses if available
+		for _, extra := range cert.EmailAddresses {
+			o <- fmt.Sprintf("%s,email,%s\n", n, strings.ToLower(scrubX509Value(extra)))
+		}
 
-			// Dump associated IP addresses if we have at least one name
-			for _, extra := range cert.IPAddresses {
-				o <- fmt.Sprintf("%s,ip,%s\n", n, extra)
-			}
+		// Dump associated IP addresses if we have at least one name
+		for _, extra := range cert.IPAddresses {
+			o <- fmt.Sprintf("%s,ip,%s\n", n, extra)
+		}
 
-			o <- fmt.Sprintf("%s,ts,%d\n", n, leaf.TimestampedEntry.Timestamp)
-			o <- fmt.Sprintf("%s,cn,%s\n", n, strings.ToLower(scrubX509Value(cert.Subject.CommonName)))
-			o <- fmt.Sprintf("%s,sha1,%s\n", n, sha1hash)
+		o <- fmt.Sprintf("%s,ts,%d\n", n, leaf.TimestampedEntry.Timestamp)
+		o <- fmt.Sprintf("%s,cn,%s\n", n, strings.ToLower(scrubX509Value(cert.Subject.CommonName)))
+		o <- fmt.Sprintf("%s,sha1,%s\n", n, sha1hash)
 
-			// Dump associated SANs (overkill, but saves a second lookup)
-			for _, extra := range cert.DNSNames {
-				o <- fmt.Sprintf("%s,dns,%s\n", n, strings.ToLower(extra))
-			}
+		// Dump associated SANs (overkill, but saves a second lookup)
+		for _, extra := range cert.DNSNames {
+			o <- fmt.Sprintf("%s,dns,%s\n", n, strings.ToLower(extra))
 		}
 	}
-
-	wg_raw_ct_input.Done()
 }
 
 func main() {
@@ -354,19 +295,74 @@ func main() {
 	os.Setenv("LC_ALL", "C")
 
 	flag.Usage = func() { usage() }
-	compression := flag.String("c", "snappy", "The compression type to use (none, snappy, zlib, lz4, lz4hc)")
+	compression := flag.String("c", "snappy", "The compression type to use (none, snappy, zlib, lz4, lz4hc, zstd)")
 	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
 	sort_mem := flag.Uint64("m", 1, "The maximum amount of memory to use, in gigabytes, for the sorting phases")
 	selected_merge_mode := flag.String("M", "combine", "The merge mode: combine, first, or last")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	normalize = flag.Bool("normalize", false, "Encode internationalized names as punycode and skip names with invalid labels")
 	version := flag.Bool("version", false, "Show the version and build timestamp")
 
-	flag.Parse()
+	inetdata.AddTuningFlags()
+	inetdata.AddJSONSampleFlags("leaf_input")
+	inetdata.AddRejectFlags()
+	inetdata.AddCertParseFlags()
+	inetdata.AddBloomFlags()
+	inetdata.AddMetaFlags()
+
+	inetdata.ParseFlags("inetdata-ct2mtbl")
 
 	if *version {
 		inetdata.PrintVersion("inetdata-ct2mtbl")
 		os.Exit(0)
 	}
 
+	inetdata.HandleSignals("inetdata-ct2mtbl")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidBloomFPR(inetdata.BloomFPR) {
+		inetdata.Log.Errorf("Invalid Bloom filter false positive rate specified: %v", inetdata.BloomFPR)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if e := inetdata.ApplyCertParse(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
 	if len(*sort_tmp) == 0 {
 		*sort_tmp = os.Getenv("HOME")
 	}
@@ -378,20 +374,26 @@ func main() {
 
 	// Configure the MTBL output
 
-	if len(flag.Args()) != 1 {
+	if len(flag.Args()) < 1 {
 		usage()
 		os.Exit(1)
 	}
 
+	inputs, ie := inetdata.InputPaths(flag.Args()[1:], *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
 	switch *selected_merge_mode {
 	case "combine":
-		merge_mode = MERGE_MODE_COMBINE
+		merge_func = mtblutil.MergeJSONArrays
 	case "first":
-		merge_mode = MERGE_MODE_FIRST
+		merge_func = mtblutil.MergeFirst
 	case "last":
-		merge_mode = MERGE_MODE_LAST
+		merge_func = mtblutil.MergeLast
 	default:
-		fmt.Fprintf(os.Stderr, "Error: Invalid merge mode specified: %s\n", *selected_merge_mode)
+		inetdata.Log.Errorf("Invalid merge mode specified: %s", *selected_merge_mode)
 		usage()
 		os.Exit(1)
 	}
@@ -408,20 +410,17 @@ func main() {
 
 	compression_alg, ok := inetdata.MTBLCompressionTypes[*compression]
 	if !ok {
-		fmt.Fprintf(os.Stderr, "[-] Invalid compression algorithm: %s\n", *compression)
+		inetdata.Log.Errorf("Invalid compression algorithm: %s", *compression)
 		os.Exit(1)
 	}
 
 	mtbl_sorter := mtbl.SorterInit(&sort_opt)
 	mtbl_writer, w_e := mtbl.WriterInit(fname, &mtbl.WriterOptions{Compression: compression_alg})
 	if w_e != nil {
-		fmt.Fprintf(os.Stderr, "[-] Error: %s\n", w_e)
+		inetdata.Log.Errorf("%s", w_e)
 		os.Exit(1)
 	}
 
-	defer mtbl_sorter.Destroy()
-	defer mtbl_writer.Destroy()
-
 	mtbl_sorter_ch := make(chan NewRecord, 1)
 	mtbl_sorter_done := make(chan bool, 1)
 
@@ -438,20 +437,20 @@ func main() {
 		"--key=1",
 		"--field-separator=,",
 		"--compress-program=pigz",
-		fmt.Sprintf("--parallel=%d", runtime.NumCPU()),
+		fmt.Sprintf("--parallel=%d", inetdata.Workers),
 		fmt.Sprintf("--temporary-directory=%s", *sort_tmp),
 		fmt.Sprintf("--buffer-size=%dG", *sort_mem))
 
 	// Configure stdio
 	sort_stdin, sie := sort_proc.StdinPipe()
 	if sie != nil {
-		fmt.Fprintf(os.Stderr, "Error: failed to create sort stdin pipe: %s\n", sie)
+		inetdata.Log.Errorf("failed to create sort stdin pipe: %s", sie)
 		os.Exit(1)
 	}
 
 	sort_stdout, soe := sort_proc.StdoutPipe()
 	if soe != nil {
-		fmt.Fprintf(os.Stderr, "Error: failed to create sort stdout pipe: %s\n", soe)
+		inetdata.Log.Errorf("failed to create sort stdout pipe: %s", soe)
 		os.Exit(1)
 	}
 
@@ -459,8 +458,9 @@ func main() {
 	subprocs = append(subprocs, sort_proc)
 
 	// Start the sort process
+	inetdata.DetachSignals(sort_proc)
 	if e := sort_proc.Start(); e != nil {
-		fmt.Fprintf(os.Stderr, "Error: failed to execute the sort command: %s\n", e)
+		inetdata.Log.Errorf("failed to execute the sort command: %s", e)
 		os.Exit(1)
 	}
 
@@ -470,7 +470,7 @@ func main() {
 	// Configure stdio
 	roll_stdout, roe := roll_proc.StdoutPipe()
 	if roe != nil {
-		fmt.Fprintf(os.Stderr, "Error: failed to create sort stdout pipe: %s\n", roe)
+		inetdata.Log.Errorf("failed to create sort stdout pipe: %s", roe)
 		os.Exit(1)
 	}
 
@@ -479,8 +479,9 @@ func main() {
 	subprocs = append(subprocs, roll_proc)
 
 	// Start the rollup process
+	inetdata.DetachSignals(roll_proc)
 	if e := roll_proc.Start(); e != nil {
-		fmt.Fprintf(os.Stderr, "Error: failed to execute the inetdata-csvrollup command: %s\n", e)
+		inetdata.Log.Errorf("failed to execute the inetdata-csvrollup command: %s", e)
 		os.Exit(1)
 	}
 
@@ -491,13 +492,13 @@ func main() {
 		"--key=1",
 		"--field-separator=,",
 		"--compress-program=pigz",
-		fmt.Sprintf("--parallel=%d", runtime.NumCPU()),
+		fmt.Sprintf("--parallel=%d", inetdata.Workers),
 		fmt.Sprintf("--temporary-directory=%s", *sort_tmp),
 		fmt.Sprintf("--buffer-size=%dG", *sort_mem))
 
 	sort2_stdout, ssoe := sort2_proc.StdoutPipe()
 	if ssoe != nil {
-		fmt.Fprintf(os.Stderr, "Error: failed to create sort stdout pipe: %s\n", ssoe)
+		inetdata.Log.Errorf("failed to create sort stdout pipe: %s", ssoe)
 		os.Exit(1)
 	}
 	sort2_proc.Stdin = roll_stdout
@@ -506,8 +507,9 @@ func main() {
 	subprocs = append(subprocs, sort2_proc)
 
 	// Start the sort process
+	inetdata.DetachSignals(sort2_proc)
 	if e := sort2_proc.Start(); e != nil {
-		fmt.Fprintf(os.Stderr, "Error: failed to execute the second sort command: %s\n", e)
+		inetdata.Log.Errorf("failed to execute the second sort command: %s", e)
 		os.Exit(1)
 	}
 
@@ -521,25 +523,39 @@ func main() {
 		// Read rollup entries from the sort pipe and send to the parser
 		e := inetdata.ReadLinesFromReader(sort2_stdout, c_ct_sorted_output)
 		if e != nil {
-			fmt.Fprintf(os.Stderr, "Error reading sort 2 input: %s\n", e)
+			inetdata.Log.Errorf("Failed to read sort 2 input: %s", e)
 			os.Exit(1)
 		}
 		wg_sort_reader.Done()
 	}()
 
+	progress := inetdata.NewProgress("inetdata-ct2mtbl", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.AddCounter("merged", &merge_count)
+	progress.Errors = &invalid_count
+	progress.AddCounter("lenient", inetdata.LenientCount())
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
 	// Start the progress tracker
 	quit := make(chan int)
-	go showProgress(quit)
+	go progress.Run(quit)
 
 	// Large channel buffer evens out spikey per-record processing time
-	c_ct_raw_input := make(chan string, 4096)
+	c_ct_raw_input := make(chan *linereader.Line, 4096)
+	progress.AddStage("input", func() int { return len(c_ct_raw_input) })
 
 	// Output
 	c_ct_parsed_output := make(chan string)
 
 	// Launch one input parser per core
-	wg_raw_ct_input.Add(runtime.NumCPU())
-	for i := 0; i < runtime.NumCPU(); i++ {
+	wg_raw_ct_input.Add(inetdata.Workers)
+	for i := 0; i < inetdata.Workers; i++ {
 		go rawCTReader(c_ct_raw_input, c_ct_parsed_output)
 	}
 
@@ -548,9 +564,9 @@ func main() {
 	go parsedCTWriter(c_ct_parsed_output, sort_stdin)
 
 	// Read CT JSON from stdin, parse, and send to sort
-	e := inetdata.ReadLines(os.Stdin, c_ct_raw_input)
+	e := inetdata.ReadLineBytesFromInputs(inputs, *input_compression, progress.CountReader, c_ct_raw_input)
 	if e != nil {
-		fmt.Fprintf(os.Stderr, "Error reading input: %s\n", e)
+		inetdata.Log.Warnf("Failed to read input: %s", e)
 	}
 
 	// Wait for the input parsers
@@ -581,10 +597,29 @@ func main() {
 
 	// Finalize the MTBL sorter with a write
 	if e = mtbl_sorter.Write(mtbl_writer); e != nil {
-		fmt.Fprintf(os.Stderr, "[-] Error writing MTBL: %s\n", e)
+		inetdata.Log.Errorf("Failed to write MTBL: %s", e)
 		os.Exit(1)
 	}
 
+	mtbl_sorter.Destroy()
+	mtbl_writer.Destroy()
+
 	// Stop the progress monitor
 	quit <- 0
+
+	inetdata.ReportLenientCerts()
+	inetdata.CloseRejects()
+
+	inetdata.ExitIfInterrupted(fname)
+	inetdata.CheckErrorBudget(input_count)
+
+	if e := inetdata.WriteMTBLBloom(fname); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if e := inetdata.WriteMTBLMeta("inetdata-ct2mtbl", fname); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
 }
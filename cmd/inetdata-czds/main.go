@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var output_count int64 = 0
+var input_count int64 = 0
+var invalid_count int64 = 0
+var wg sync.WaitGroup
+
+var progress *inetdata.Progress
+
+var client = &http.Client{}
+
+// The bearer token of the CZDS API
+var access_token string
+
+// Options of the downloads
+var force bool
+var parse bool
+var parse_args []string
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <output-dir>")
+	fmt.Println("")
+	fmt.Println("Authenticates to the ICANN Centralized Zone Data Service (CZDS) API, lists the zones")
+	fmt.Println("that the account is approved for, and downloads them to <output-dir>/<zone>.zone.gz,")
+	fmt.Println("-j at a time. The credentials are read from -username and -password-file, or from the")
+	fmt.Println("CZDS_USERNAME and CZDS_PASSWORD environment variables.")
+	fmt.Println("")
+	fmt.Println("A zone is only downloaded when the server has a newer file than the one on disk, or with")
+	fmt.Println("-force. Downloads are written to a .part file first; an interrupted download is resumed")
+	fmt.Println("from where it stopped by the next run. With -zones, only those zones are downloaded, and")
+	fmt.Println("with -list, the approved zones are listed instead.")
+	fmt.Println("")
+	fmt.Println("With -parse, each zone is piped straight into inetdata-zone2csv -master, with the zone as")
+	fmt.Println("the origin and the -parse-args options, and its output is written to")
+	fmt.Println("<output-dir>/<zone>.csv.gz instead of keeping the zone file. Parsed downloads can not be")
+	fmt.Println("resumed.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+// Authenticate and return the access token
+func authenticate(auth_url string, username string, password string) (string, error) {
+	body, _ := json.Marshal(map[string]string{"username": username, "password": password})
+
+	req, err := http.NewRequest("POST", auth_url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("authentication failed: %s", resp.Status)
+	}
+
+	var auth struct {
+		AccessToken string `json:"accessToken"`
+	}
+	if err := json.Unmarshal(content, &auth); err != nil {
+		return "", err
+	}
+	if len(auth.AccessToken) == 0 {
+		return "", fmt.Errorf("authentication failed: no access token")
+	}
+	return auth.AccessToken, nil
+}
+
+// Return a request of the API with the access token
+func newRequest(method string, u string) (*http.Request, error) {
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+access_token)
+	return req, nil
+}
+
+// Return the download links of the approved zones
+func listZones(api_url string) ([]string, error) {
+	req, err := newRequest("GET", strings.TrimSuffix(api_url, "/")+"/czds/downloads/links")
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing the zones failed: %s", resp.Status)
+	}
+
+	links := []string{}
+	if err := json.Unmarshal(content, &links); err != nil {
+		return nil, err
+	}
+	sort.Strings(links)
+	return links, nil
+}
+
+// Return the zone of a download link (ex: .../czds/downloads/com.zone -> com)
+func linkZone(link string) string {
+	return strings.ToLower(strings.TrimSuffix(path.Base(link), ".zone"))
+}
+
+// Return the modification time of the zone on the server, or a zero time
+func remoteModified(link string) time.Time {
+	req, err := newRequest("HEAD", link)
+	if err != nil {
+		return time.Time{}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return time.Time{}
+	}
+	resp.Body.Close()
+
+	t, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if resp.StatusCode != http.StatusOK || err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// Return true if the local file is at least as new as the server's
+func upToDate(dst string, modified time.Time) bool {
+	st, err := os.Stat(dst)
+	if err != nil || modified.IsZero() {
+		return false
+	}
+	return !st.ModTime().Before(modified)
+}
+
+// Download a zone to dst, resuming a previous partial download
+func downloadZone(link string, dst string) (int64, error) {
+	part := dst + ".part"
+
+	var offset int64 = 0
+	if st, err := os.Stat(part); err == nil {
+		offset = st.Size()
+	}
+
+	req, err := newRequest("GET", link)
+	if err != nil {
+		return 0, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		// The server ignored the range, start over
+		flags |= os.O_TRUNC
+		offset = 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file is already complete
+		return offset, os.Rename(part, dst)
+	default:
+		return 0, fmt.Errorf("download failed: %s", resp.Status)
+	}
+
+	fd, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(fd, progress.CountReader(resp.Body))
+	if ce := fd.Close(); err == nil {
+		err = ce
+	}
+	if err != nil {
+		return offset + n, err
+	}
+	return offset + n, os.Rename(part, dst)
+}
+
+// Download a zone into inetdata-zone2csv, writing its output to dst
+func parseZone(link string, zone string, dst string) (int64, error) {
+	req, err := newRequest("GET", link)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("download failed: %s", resp.Status)
+	}
+
+	part := dst + ".part"
+	fd, err := os.Create(part)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+
+	args := append([]string{"-master", "-origin", zone, "-output-compression", "gzip"}, parse_args...)
+	proc := exec.Command("inetdata-zone2csv", args...)
+	proc.Stdout = fd
+	proc.Stderr = os.Stderr
+
+	stdin, err := proc.StdinPipe()
+	if err != nil {
+		return 0, err
+	}
+
+	inetdata.DetachSignals(proc)
+	if err := proc.Start(); err != nil {
+		return 0, fmt.Errorf("failed to execute the inetdata-zone2csv command: %s", err)
+	}
+
+	n, err := io.Copy(stdin, progress.CountReader(resp.Body))
+	stdin.Close()
+	if we := proc.Wait(); err == nil && we != nil {
+		err = fmt.Errorf("inetdata-zone2csv failed: %s", we)
+	}
+	if err != nil {
+		os.Remove(part)
+		return n, err
+	}
+	return n, os.Rename(part, dst)
+}
+
+// Download the zones of the link channel until it is closed
+func zoneDownloader(c_links chan string, dir string) {
+	defer wg.Done()
+
+	for link := range c_links {
+		if inetdata.Interrupted() {
+			continue
+		}
+
+		zone := linkZone(link)
+		dst := filepath.Join(dir, zone+".zone.gz")
+		if parse {
+			dst = filepath.Join(dir, zone+".csv.gz")
+		}
+
+		modified := remoteModified(link)
+		if !force && upToDate(dst, modified) {
+			inetdata.Log.Infof("Skipping %s, %s is up to date", zone, dst)
+			continue
+		}
+
+		atomic.AddInt64(&input_count, 1)
+
+		var n int64
+		var err error
+		if parse {
+			n, err = parseZone(link, zone, dst)
+		} else {
+			n, err = downloadZone(link, dst)
+		}
+		if err != nil {
+			atomic.AddInt64(&invalid_count, 1)
+			inetdata.Log.Warnf("Failed to download %s: %s", zone, err)
+			continue
+		}
+
+		// Keep the server's time so the next run can tell if the zone changed
+		if !modified.IsZero() {
+			os.Chtimes(dst, modified, modified)
+		}
+
+		atomic.AddInt64(&output_count, 1)
+		inetdata.Log.Infof("Downloaded %s to %s (%d bytes)", zone, dst, n)
+	}
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	username := flag.String("username", os.Getenv("CZDS_USERNAME"), "The CZDS account username (env: CZDS_USERNAME)")
+	password_file := flag.String("password-file", "", "Read the CZDS account password from this file instead of CZDS_PASSWORD")
+	auth_url := flag.String("auth-url", "https://account-api.icann.org/api/authenticate", "The ICANN account authentication endpoint")
+	api_url := flag.String("api-url", "https://czds-api.icann.org", "The CZDS API base URL")
+	zones := flag.String("zones", "", "Only download these comma-separated zones (ex: com,net,org)")
+	list := flag.Bool("list", false, "List the approved zones instead of downloading them")
+	parallel := flag.Int("j", 4, "The number of zones to download in parallel")
+	forced := flag.Bool("force", false, "Download the zones even if the files on disk are up to date")
+	parsed := flag.Bool("parse", false, "Pipe each zone into inetdata-zone2csv -master and keep its output instead of the zone")
+	selected_parse_args := flag.String("parse-args", "", "Extra space-separated options of inetdata-zone2csv with -parse (ex: '-normalize -drop-invalid')")
+	timeout := flag.Duration("timeout", 0, "The maximum time of each request, including the download (0 for no limit)")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+	inetdata.AddRateLimitFlags()
+
+	inetdata.ParseFlags("inetdata-czds")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-czds")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-czds")
+
+	if *parallel < 1 {
+		inetdata.Log.Errorf("-j must be at least 1")
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ApplyRateLimits(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	force = *forced
+	parse = *parsed
+	parse_args = strings.Fields(*selected_parse_args)
+	client.Timeout = *timeout
+	client.Transport = inetdata.LimitTransport(nil)
+
+	password := os.Getenv("CZDS_PASSWORD")
+	if len(*password_file) > 0 {
+		b, e := ioutil.ReadFile(*password_file)
+		if e != nil {
+			inetdata.Log.Errorf("%s", e)
+			os.Exit(1)
+		}
+		password = strings.TrimRight(string(b), "\r\n")
+	}
+
+	if len(*username) == 0 || len(password) == 0 {
+		inetdata.Log.Errorf("The CZDS username and password are required")
+		usage()
+		os.Exit(1)
+	}
+
+	if !*list && len(flag.Args()) != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	token, e := authenticate(*auth_url, *username, password)
+	if e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+	access_token = token
+
+	links, e := listZones(*api_url)
+	if e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if len(*zones) > 0 {
+		wanted := map[string]bool{}
+		for _, z := range strings.Split(strings.ToLower(*zones), ",") {
+			wanted[strings.Trim(strings.TrimSpace(z), ".")] = true
+		}
+		selected := []string{}
+		for _, link := range links {
+			if wanted[linkZone(link)] {
+				selected = append(selected, link)
+				delete(wanted, linkZone(link))
+			}
+		}
+		for z := range wanted {
+			inetdata.Log.Warnf("Zone %s is not approved for this account", z)
+		}
+		links = selected
+	}
+
+	if *list {
+		for _, link := range links {
+			fmt.Println(linkZone(link))
+		}
+		os.Exit(0)
+	}
+
+	dir := flag.Args()[0]
+	if e := os.MkdirAll(dir, 0755); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	inetdata.Log.Infof("Downloading %d zones to %s", len(links), dir)
+
+	progress = inetdata.NewProgress("inetdata-czds", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.Errors = &invalid_count
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	c_links := make(chan string)
+	for i := 0; i < *parallel; i++ {
+		go zoneDownloader(c_links, dir)
+		wg.Add(1)
+	}
+
+	for _, link := range links {
+		if inetdata.Interrupted() {
+			break
+		}
+		c_links <- link
+	}
+	close(c_links)
+
+	wg.Wait()
+
+	quit <- 0
+
+	inetdata.Log.Infof("Downloaded %d of %d zones", output_count, input_count)
+
+	inetdata.ExitIfInterrupted()
+
+	if invalid_count > 0 {
+		os.Exit(1)
+	}
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"github.com/fathom6/golang-mtbl"
 	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/linereader"
+	"github.com/fathom6/inetdata-parsers/mtbl"
+	"github.com/fathom6/inetdata-parsers/mtblutil"
 	"os"
 	"runtime"
 	"strings"
@@ -14,11 +17,17 @@ import (
 	"time"
 )
 
-const MERGE_MODE_COMBINE = 0
-const MERGE_MODE_FIRST = 1
-const MERGE_MODE_LAST = 2
+var merge_func mtblutil.MergeFunc
 
-var merge_mode = MERGE_MODE_COMBINE
+// Encode the record type of untyped address values and add a timestamp to each value
+var typed_values = false
+var value_timestamp = ""
+
+// Read the first-seen,last-seen,value values of csvrollup -timestamps
+var seen_values = false
+
+// The encoding of IP address keys
+var ip_key = "none"
 
 var compression_types = map[string]int{
 	"none":   mtbl.COMPRESSION_NONE,
@@ -40,160 +49,147 @@ type NewRecord struct {
 
 var wg sync.WaitGroup
 
+// Counts the input lines that have not been dropped or added to the sorter
+var inflight sync.WaitGroup
+
 func usage() {
-	fmt.Println("Usage: " + os.Args[0] + " [options] <output.mtbl>")
+	fmt.Println("Usage: " + os.Args[0] + " [options] <output.mtbl> [<input> ... <input>]")
 	fmt.Println("")
 	fmt.Println("Creates a MTBL database from a Sonar FDNS pre-sorted and pre-merged CSV input")
 	fmt.Println("")
+	fmt.Println("The input is the name,values output of inetdata-csvrollup, with values separated by null")
+	fmt.Println("bytes. Each key is stored with a JSON array of values, where each value is an array of")
+	fmt.Println("[type, value] or, for untyped addresses, [value]. With -typed, untyped IPv4 and IPv6")
+	fmt.Println("values are stored as [a, value] and [aaaa, value]. With -timestamp, the timestamp is")
+	fmt.Println("added as the last element of every value; when values are combined, the most recent")
+	fmt.Println("timestamp is kept. With -timestamps, the input is the output of csvrollup -timestamps,")
+	fmt.Println("where each value is first-seen,last-seen,value, and both timestamps are added as the last")
+	fmt.Println("two elements of every value; when values are combined, the earliest first-seen and the")
+	fmt.Println("latest last-seen timestamps are kept. Hostname keys are stored reversed, IP address keys as-is, or with")
+	fmt.Println("-ip-key binary or hex, encoded so that they sort numerically (see mq -ip-key).")
+	fmt.Println("")
+	fmt.Println("With -checkpoint-file, the sorted records are committed to part files next to the output")
+	fmt.Println("every -checkpoint-interval input lines. A run restarted with the same arguments skips the")
+	fmt.Println("committed lines and merges the parts into the output when it completes.")
+	fmt.Println("")
 	fmt.Println("Options:")
 	flag.PrintDefaults()
 }
 
-func showProgress(quit chan int) {
-	start := time.Now()
-	for {
-		select {
-		case <-quit:
-			return
-		case <-time.After(time.Second * 1):
-			icount := atomic.LoadInt64(&input_count)
-			ocount := atomic.LoadInt64(&output_count)
-			mcount := atomic.LoadInt64(&merge_count)
-			ecount := atomic.LoadInt64(&invalid_count)
-
-			if icount == 0 && ocount == 0 {
-				// Reset start, so that we show stats only from our first input
-				start = time.Now()
-				continue
-			}
-			elapsed := time.Since(start)
-			if elapsed.Seconds() > 1.0 {
-				fmt.Fprintf(os.Stderr, "[*] [inetdata-dns2mtbl] Read %d and wrote %d records in %d seconds (%d/s in, %d/s out) (merged: %d, invalid: %d)\n",
-					icount,
-					ocount,
-					int(elapsed.Seconds()),
-					int(float64(icount)/elapsed.Seconds()),
-					int(float64(ocount)/elapsed.Seconds()),
-					mcount, ecount)
-			}
-		}
-	}
-}
-
 func mergeFunc(key []byte, val0 []byte, val1 []byte) (mergedVal []byte) {
-
 	atomic.AddInt64(&merge_count, 1)
-
-	if merge_mode == MERGE_MODE_FIRST {
-		return val0
-	}
-
-	if merge_mode == MERGE_MODE_LAST {
-		return val1
-	}
-
-	// MERGE_MODE_COMBINE
-	var unique = make(map[string]bool)
-	var v0, v1, m [][]string
-
-	// fmt.Fprintf(os.Stderr, "MERGE[%v]     %v    ->    %v\n", string(key), string(val0), string(val1))
-
-	if e := json.Unmarshal(val0, &v0); e != nil {
-		return val1
-	}
-
-	if e := json.Unmarshal(val1, &v1); e != nil {
-		return val0
-	}
-
-	for i := range v0 {
-		if len(v0[i]) == 0 {
-			continue
-		}
-		unique[strings.Join(v0[i], "\x00")] = true
-	}
-
-	for i := range v1 {
-		if len(v1[i]) == 0 {
-			continue
-		}
-		unique[strings.Join(v1[i], "\x00")] = true
-	}
-
-	for i := range unique {
-		m = append(m, strings.SplitN(i, "\x00", 2))
-	}
-
-	d, e := json.Marshal(m)
-	if e != nil {
-		fmt.Fprintf(os.Stderr, "JSON merge error: %v -> %v + %v\n", e, val0, val1)
-		return val0
-	}
-
-	return d
+	return merge_func(key, val0, val1)
 }
 
-func writeToMtbl(s *mtbl.Sorter, c chan NewRecord, d chan bool) {
+func writeToMtbl(s *inetdata.MTBLPartSorter, c chan NewRecord, d chan bool) {
 	for r := range c {
 		if e := s.Add(r.Key, r.Val); e != nil {
-			fmt.Fprintf(os.Stderr, "[-] Failed to add key=%v (%v): %v\n", r.Key, r.Val, e)
+			inetdata.Log.Warnf("Failed to add key=%v (%v): %v", r.Key, r.Val, e)
 		}
 		atomic.AddInt64(&output_count, 1)
+		inflight.Done()
 	}
 	d <- true
 }
 
-func inputParser(d chan string, c chan NewRecord) {
+func inputParser(d chan *linereader.Line, c chan NewRecord) {
+	for l := range d {
+		rec, ok := parseLine(l.Bytes)
+		l.Recycle()
 
-	for raw := range d {
+		if ok {
+			c <- rec
+		} else {
+			inflight.Done()
+		}
+	}
+	wg.Done()
+}
 
-		bits := strings.SplitN(raw, ",", 2)
+// Convert a name,values line into a record
+func parseLine(raw []byte) (NewRecord, bool) {
 
-		if len(bits) != 2 {
-			atomic.AddInt64(&invalid_count, 1)
-			continue
-		}
+	bits := bytes.SplitN(raw, []byte(","), 2)
 
-		atomic.AddInt64(&input_count, 1)
+	if len(bits) != 2 {
+		atomic.AddInt64(&invalid_count, 1)
+		inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, string(raw))
+		return NewRecord{}, false
+	}
 
-		name := bits[0]
-		data := bits[1]
+	atomic.AddInt64(&input_count, 1)
 
-		if len(name) == 0 || len(data) == 0 {
-			atomic.AddInt64(&invalid_count, 1)
-			continue
-		}
-		vals := strings.SplitN(data, "\x00", -1)
-
-		var outp [][]string
-		for i := range vals {
-			info := strings.SplitN(vals[i], ",", 2)
-
-			if len(info) == 1 {
-				// This is a single-mapped value without a type prefix
-				// Types: a, aaaa
-				outp = append(outp, []string{vals[i]})
-			} else {
-				// This is a pair-mapped value with a dns record type
-				// Types: fdns, cname, ns, mx, ptr
-				outp = append(outp, info)
+	name := string(bits[0])
+	data := bits[1]
+
+	if len(name) == 0 || len(data) == 0 {
+		atomic.AddInt64(&invalid_count, 1)
+		inetdata.Rejects.Reject(inetdata.REJECT_MISSING_FIELD, string(raw))
+		return NewRecord{}, false
+	}
+	vals := bytes.Split(data, []byte("\x00"))
+
+	var outp [][]string
+	for i := range vals {
+		val := string(vals[i])
+
+		var seen []string
+		if seen_values {
+			bits := strings.SplitN(val, ",", 3)
+			if len(bits) != 3 || len(bits[0]) == 0 || len(bits[1]) == 0 {
+				atomic.AddInt64(&invalid_count, 1)
+				inetdata.Rejects.Reject(inetdata.REJECT_MISSING_FIELD, string(raw))
+				return NewRecord{}, false
 			}
+			seen, val = bits[:2], bits[2]
 		}
 
-		json, e := json.Marshal(outp)
-		if e != nil {
-			fmt.Fprintf(os.Stderr, "[-] Could not marshal %v: %s\n", outp, e)
-			continue
+		info := strings.SplitN(val, ",", 2)
+
+		if len(info) == 1 {
+			// This is a single-mapped value without a type prefix
+			// Types: a, aaaa
+			if typed_values {
+				if inetdata.Match_IPv4.MatchString(val) {
+					info = []string{"a", val}
+				} else if inetdata.Match_IPv6.MatchString(val) {
+					info = []string{"aaaa", val}
+				}
+			}
 		}
+		// Otherwise this is a pair-mapped value with a dns record type
+		// Types: fdns, cname, ns, mx, ptr
 
-		// Reverse the key unless its an IP address
-		if !(inetdata.Match_IPv4.Match([]byte(name)) || inetdata.Match_IPv6.Match([]byte(name))) {
-			name = inetdata.ReverseKey(name)
+		if len(value_timestamp) > 0 {
+			info = append(info, value_timestamp)
 		}
 
-		c <- NewRecord{Key: []byte(name), Val: json}
+		info = append(info, seen...)
+
+		outp = append(outp, info)
 	}
-	wg.Done()
+
+	json, e := json.Marshal(outp)
+	if e != nil {
+		inetdata.Log.Warnf("Could not marshal %v: %s", outp, e)
+		return NewRecord{}, false
+	}
+
+	// Reverse the key unless its an IP address
+	key := []byte(name)
+	if !(inetdata.Match_IPv4.Match(key) || inetdata.Match_IPv6.Match(key)) {
+		key = []byte(inetdata.ReverseKey(name))
+	} else if ip_key != "none" {
+		enc, ke := inetdata.EncodeIPKeyString(name, ip_key)
+		if ke != nil {
+			atomic.AddInt64(&invalid_count, 1)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_KEY, string(raw))
+			return NewRecord{}, false
+		}
+		key = enc
+	}
+
+	return NewRecord{Key: key, Val: json}, true
 }
 
 func main() {
@@ -203,39 +199,142 @@ func main() {
 
 	flag.Usage = func() { usage() }
 
-	compression := flag.String("c", "snappy", "The compression type to use (none, snappy, zlib, lz4, lz4hc)")
+	compression := flag.String("c", "snappy", "The compression type to use (none, snappy, zlib, lz4, lz4hc, zstd)")
 	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
 	sort_mem := flag.Uint64("m", 1024, "The maximum amount of memory to use, in megabytes, for the sorting phase, per output file")
 	selected_merge_mode := flag.String("M", "combine", "The merge mode: combine, first, or last")
+	typed := flag.Bool("typed", false, "Add the record type (a or aaaa) to address values that have no type prefix")
+	timestamps := flag.Bool("timestamps", false, "Read the first-seen,last-seen,value values of csvrollup -timestamps and keep both timestamps")
+	timestamp := flag.String("timestamp", "", "Add this timestamp to each value, \"now\" uses the current time (ex: 2026-10-01)")
+	selected_ip_key := flag.String("ip-key", "none", "Encode IP address keys for numeric ordering: none, binary, or hex")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	checkpoint_file := flag.String("checkpoint-file", "", "Commit progress to this file and resume from it when restarted")
+	checkpoint_interval := flag.Int64("checkpoint-interval", 10000000, "The number of input lines between checkpoints")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
 	version := flag.Bool("version", false, "Show the version and build timestamp")
 
-	flag.Parse()
+	inetdata.AddTuningFlags()
+	inetdata.AddSampleFlags()
+	inetdata.AddRejectFlags()
+	inetdata.AddBloomFlags()
+	inetdata.AddMetaFlags()
+
+	inetdata.ParseFlags("inetdata-dns2mtbl")
 
 	if *version {
 		inetdata.PrintVersion("inetdata-dns2mtbl")
 		os.Exit(0)
 	}
 
-	if len(flag.Args()) != 1 {
+	inetdata.HandleSignals("inetdata-dns2mtbl")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidBloomFPR(inetdata.BloomFPR) {
+		inetdata.Log.Errorf("Invalid Bloom filter false positive rate specified: %v", inetdata.BloomFPR)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if len(flag.Args()) < 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args()[1:], *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	if *timestamps && len(*timestamp) > 0 {
+		inetdata.Log.Errorf("-timestamp and -timestamps are mutually exclusive")
 		usage()
 		os.Exit(1)
 	}
 
 	switch *selected_merge_mode {
 	case "combine":
-		merge_mode = MERGE_MODE_COMBINE
+		merge_func = mtblutil.MergeTimestampedArrays(len(*timestamp) > 0)
+		if *timestamps {
+			merge_func = mtblutil.MergeSeenArrays
+		}
 	case "first":
-		merge_mode = MERGE_MODE_FIRST
+		merge_func = mtblutil.MergeFirst
 	case "last":
-		merge_mode = MERGE_MODE_LAST
+		merge_func = mtblutil.MergeLast
 	default:
-		fmt.Fprintf(os.Stderr, "Error: Invalid merge mode specified: %s\n", *selected_merge_mode)
+		inetdata.Log.Errorf("Invalid merge mode specified: %s", *selected_merge_mode)
 		usage()
 		os.Exit(1)
 	}
 
+	if !inetdata.ValidIPKeyFormat(*selected_ip_key) {
+		inetdata.Log.Errorf("Invalid IP key format specified: %s", *selected_ip_key)
+		usage()
+		os.Exit(1)
+	}
+
+	ip_key = *selected_ip_key
+	typed_values = *typed
+	value_timestamp = *timestamp
+	seen_values = *timestamps
+	if value_timestamp == "now" {
+		value_timestamp = time.Now().UTC().Format(time.RFC3339)
+	}
+
 	fname := flag.Args()[0]
-	_ = os.Remove(fname)
+
+	var cp *inetdata.Checkpoint
+	var skip_lines int64 = 0
+
+	if len(*checkpoint_file) > 0 {
+		if *checkpoint_interval < 1 {
+			inetdata.Log.Errorf("-checkpoint-interval must be at least 1")
+			os.Exit(1)
+		}
+
+		var ce error
+		cp, ce = inetdata.OpenCheckpoint(*checkpoint_file, inputs)
+		if ce != nil {
+			inetdata.Log.Errorf("%s", ce)
+			os.Exit(1)
+		}
+
+		skip_lines, _ = cp.Offset("lines")
+		if cp.Resumed() {
+			inetdata.Log.Infof("Resuming from line %d with %d committed parts", skip_lines, len(cp.PartNames()))
+		}
+	}
 
 	sort_opt := mtbl.SorterOptions{Merge: mergeFunc, MaxMemory: 1024 * 1024}
 	sort_opt.MaxMemory *= *sort_mem
@@ -246,36 +345,75 @@ func main() {
 
 	compression_alg, ok := inetdata.MTBLCompressionTypes[*compression]
 	if !ok {
-		fmt.Fprintf(os.Stderr, "[-] Invalid compression algorithm: %s\n", *compression)
+		inetdata.Log.Errorf("Invalid compression algorithm: %s", *compression)
 		os.Exit(1)
 	}
 
-	s := mtbl.SorterInit(&sort_opt)
-	w, w_e := mtbl.WriterInit(fname, &mtbl.WriterOptions{Compression: compression_alg})
+	s := inetdata.NewMTBLPartSorter(fname, cp, sort_opt, mtbl.WriterOptions{Compression: compression_alg})
 
-	if w_e != nil {
-		fmt.Fprintf(os.Stderr, "[-] Error: %s\n", w_e)
-		os.Exit(1)
-	}
-
-	s_ch := make(chan NewRecord, 1000)
+	s_ch := make(chan NewRecord, inetdata.QueueDepth)
 	s_done := make(chan bool, 1)
 
 	go writeToMtbl(s, s_ch, s_done)
 
-	p_ch := make(chan string, 1000)
-	for i := 0; i < runtime.NumCPU(); i++ {
+	p_ch := make(chan *linereader.Line, inetdata.QueueDepth)
+	for i := 0; i < inetdata.Workers; i++ {
 		go inputParser(p_ch, s_ch)
 		wg.Add(1)
 	}
 
+	progress := inetdata.NewProgress("inetdata-dns2mtbl", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.AddCounter("merged", &merge_count)
+	progress.Errors = &invalid_count
+	progress.AddStage("input", func() int { return len(p_ch) })
+	progress.AddStage("sort", func() int { return len(s_ch) })
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
 	quit := make(chan int)
-	go showProgress(quit)
+	go progress.Run(quit)
 
-	// Reader closes input on completion
-	e := inetdata.ReadLines(os.Stdin, p_ch)
-	if e != nil {
-		fmt.Fprintf(os.Stderr, "Error reading input: %s\n", e)
+	// Reader closes l_ch on completion
+	l_ch := make(chan *linereader.Line, inetdata.QueueDepth)
+	r_err := make(chan error, 1)
+	go func() {
+		r_err <- inetdata.ReadLineBytesFromInputs(inputs, *input_compression, progress.CountReader, l_ch)
+	}()
+
+	var lines int64 = 0
+
+	for l := range l_ch {
+		lines++
+		if lines <= skip_lines {
+			l.Recycle()
+			continue
+		}
+
+		// Wait for the parsed lines to reach the sorter before committing
+		if cp != nil && lines%*checkpoint_interval == 0 {
+			inflight.Wait()
+			if e := s.Commit("lines", lines-1); e != nil {
+				inetdata.Log.Errorf("Failed to commit the checkpoint: %s", e)
+				os.Exit(1)
+			}
+		}
+
+		inflight.Add(1)
+		p_ch <- l
+	}
+	close(p_ch)
+
+	if e := <-r_err; e != nil {
+		inetdata.Log.Errorf("Failed to read input: %s", e)
+		if cp != nil {
+			os.Exit(1)
+		}
 	}
 
 	wg.Wait()
@@ -283,13 +421,41 @@ func main() {
 	close(s_ch)
 	<-s_done
 
-	if e := s.Write(w); e != nil {
-		fmt.Fprintf(os.Stderr, "[-] Error writing MTBL: %s\n", e)
+	// An interrupted run commits its progress for the next run to resume
+	if cp != nil && inetdata.Interrupted() {
+		if e := s.Commit("lines", lines); e != nil {
+			inetdata.Log.Errorf("Failed to commit the checkpoint: %s", e)
+			os.Exit(1)
+		}
+		quit <- 0
+		inetdata.Log.Infof("Committed %d lines to %s", lines, *checkpoint_file)
+		inetdata.CloseRejects()
+		os.Exit(inetdata.EXIT_INTERRUPTED)
+	}
+
+	if e := s.Finish(); e != nil {
+		inetdata.Log.Errorf("Failed to write MTBL: %s", e)
 		os.Exit(1)
 	}
 
+	if cp != nil {
+		cp.Remove()
+	}
+
 	quit <- 0
 
-	s.Destroy()
-	w.Destroy()
+	inetdata.CloseRejects()
+
+	inetdata.ExitIfInterrupted(fname)
+	inetdata.CheckErrorBudget(input_count)
+
+	if e := inetdata.WriteMTBLBloom(fname); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if e := inetdata.WriteMTBLMeta("inetdata-dns2mtbl", fname); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
 }
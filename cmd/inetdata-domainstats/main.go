@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/dnsname"
+	"golang.org/x/net/publicsuffix"
+	"hash/fnv"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const LEVEL_TLD = "tld"
+const LEVEL_SUFFIX = "suffix"
+const LEVEL_DOMAIN = "domain"
+
+var all_levels = []string{LEVEL_TLD, LEVEL_SUFFIX, LEVEL_DOMAIN}
+
+var output_count int64 = 0
+var input_count int64 = 0
+var invalid_count int64 = 0
+
+var wp sync.WaitGroup
+var wc sync.WaitGroup
+
+var normalize *bool
+var assume_unique *bool
+var suffix_list *inetdata.PublicSuffixList
+
+// Stat counts the hostnames below a TLD, public suffix, or registered domain
+type Stat struct {
+	Level     string `json:"level"`
+	Name      string `json:"name"`
+	Hostnames int64  `json:"hostnames"`
+	Unique    int64  `json:"unique"`
+	Domains   int64  `json:"domains,omitempty"`
+}
+
+// A hostname with its TLD, public suffix, and registered domain
+type Hostname struct {
+	Name   string
+	TLD    string
+	Suffix string
+	Domain string
+}
+
+// The counts of the hostnames sent to one counter. Hostnames are partitioned
+// by hash, so each distinct hostname is only seen by one counter and the
+// unique counts of the partitions can be added together.
+type Partition struct {
+	seen  map[string]struct{}
+	stats map[string]map[string]*Stat
+}
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] [<input> ... <input>]")
+	fmt.Println("")
+	fmt.Println("Reads a list of hostnames and reports the number of hostnames below each top-level")
+	fmt.Println("domain (tld), public suffix (suffix), and registered domain (domain, eTLD+1). Each row")
+	fmt.Println("has the level, the name, the number of hostnames, the number of unique hostnames (the")
+	fmt.Println("unique subdomains of a registered domain), and for tld and suffix rows, the number of")
+	fmt.Println("registered domains. Rows are sorted by unique hostnames, and -top limits each level to")
+	fmt.Println("the largest rows.")
+	fmt.Println("")
+	fmt.Println("Unique hostnames are tracked in memory, which grows with the number of distinct")
+	fmt.Println("hostnames. When the input is already unique (ex: the output of sort -u), -assume-unique")
+	fmt.Println("skips the tracking. Leading wildcard labels (*.) are removed, and IP addresses and names")
+	fmt.Println("without a registered domain are skipped.")
+	fmt.Println("")
+	fmt.Println("The embedded Public Suffix List is used unless -psl is specified, which can be")
+	fmt.Println("either a local file or an http(s) URL (ex: https://publicsuffix.org/list/public_suffix_list.dat)")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+func publicSuffix(name string) string {
+	if suffix_list != nil {
+		return suffix_list.PublicSuffix(name)
+	}
+	domain, _ := publicsuffix.PublicSuffix(name)
+	return domain
+}
+
+// Clean up a hostname and find its TLD, public suffix, and registered domain
+func parseHostname(raw string) (Hostname, bool) {
+	name := strings.ToLower(dnsname.TrimDots(strings.TrimSpace(raw)))
+
+	if *normalize {
+		var err error
+		if name, err = dnsname.Normalize(name); err != nil {
+			return Hostname{}, false
+		}
+	}
+
+	name = strings.TrimPrefix(name, "*.")
+	if len(name) == 0 || dnsname.IsIP(name) {
+		return Hostname{}, false
+	}
+
+	labels := strings.Split(name, ".")
+	suffix := publicSuffix(name)
+
+	// The registered domain is one label longer than the public suffix
+	suffix_labels := strings.Count(suffix, ".") + 1
+	if len(labels) <= suffix_labels {
+		return Hostname{}, false
+	}
+
+	return Hostname{
+		Name:   name,
+		TLD:    labels[len(labels)-1],
+		Suffix: suffix,
+		Domain: strings.Join(labels[len(labels)-suffix_labels-1:], "."),
+	}, true
+}
+
+// Parse hostnames and send each one to the counter of its partition
+func inputParser(c <-chan string, counters []chan Hostname) {
+	for raw := range c {
+		h, ok := parseHostname(raw)
+		if !ok {
+			atomic.AddInt64(&invalid_count, 1)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_NAME, raw)
+			continue
+		}
+		atomic.AddInt64(&input_count, 1)
+
+		f := fnv.New32a()
+		f.Write([]byte(h.Name))
+		counters[f.Sum32()%uint32(len(counters))] <- h
+	}
+	wp.Done()
+}
+
+func (p *Partition) add(level string, name string, unique bool) {
+	s, ok := p.stats[level][name]
+	if !ok {
+		s = &Stat{Level: level, Name: name}
+		p.stats[level][name] = s
+	}
+	s.Hostnames++
+	if unique {
+		s.Unique++
+	}
+}
+
+func hostnameCounter(c <-chan Hostname, p *Partition) {
+	for h := range c {
+		unique := true
+		if !*assume_unique {
+			if _, ok := p.seen[h.Name]; ok {
+				unique = false
+			} else {
+				p.seen[h.Name] = struct{}{}
+			}
+		}
+
+		p.add(LEVEL_TLD, h.TLD, unique)
+		p.add(LEVEL_SUFFIX, h.Suffix, unique)
+		p.add(LEVEL_DOMAIN, h.Domain, unique)
+	}
+	wc.Done()
+}
+
+func newPartition() *Partition {
+	p := &Partition{seen: make(map[string]struct{}), stats: make(map[string]map[string]*Stat)}
+	for _, level := range all_levels {
+		p.stats[level] = make(map[string]*Stat)
+	}
+	return p
+}
+
+// Add up the partitions and count the registered domains of each TLD and
+// public suffix
+func mergePartitions(parts []*Partition) map[string]map[string]*Stat {
+	res := newPartition().stats
+
+	for _, p := range parts {
+		for level, stats := range p.stats {
+			for name, s := range stats {
+				if t, ok := res[level][name]; ok {
+					t.Hostnames += s.Hostnames
+					t.Unique += s.Unique
+				} else {
+					res[level][name] = s
+				}
+			}
+		}
+	}
+
+	for name := range res[LEVEL_DOMAIN] {
+		suffix := publicSuffix(name)
+		if s, ok := res[LEVEL_SUFFIX][suffix]; ok {
+			s.Domains++
+		}
+		if s, ok := res[LEVEL_TLD][name[strings.LastIndex(name, ".")+1:]]; ok {
+			s.Domains++
+		}
+	}
+
+	return res
+}
+
+// Sort the rows of a level by unique hostnames and keep the top rows
+func topStats(stats map[string]*Stat, top int) []*Stat {
+	rows := make([]*Stat, 0, len(stats))
+	for _, s := range stats {
+		rows = append(rows, s)
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Unique != rows[j].Unique {
+			return rows[i].Unique > rows[j].Unique
+		}
+		if rows[i].Hostnames != rows[j].Hostnames {
+			return rows[i].Hostnames > rows[j].Hostnames
+		}
+		return rows[i].Name < rows[j].Name
+	})
+
+	if top > 0 && len(rows) > top {
+		rows = rows[:top]
+	}
+	return rows
+}
+
+func writeStats(w io.Writer, format string, header bool, rows []*Stat) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		for _, s := range rows {
+			if e := enc.Encode(s); e != nil {
+				return e
+			}
+			atomic.AddInt64(&output_count, 1)
+		}
+		return nil
+	}
+
+	cw := csv.NewWriter(w)
+	if header {
+		cw.Write([]string{"level", "name", "hostnames", "unique", "domains"})
+	}
+
+	for _, s := range rows {
+		domains := ""
+		if s.Level != LEVEL_DOMAIN {
+			domains = strconv.FormatInt(s.Domains, 10)
+		}
+		cw.Write([]string{s.Level, s.Name, strconv.FormatInt(s.Hostnames, 10), strconv.FormatInt(s.Unique, 10), domains})
+		atomic.AddInt64(&output_count, 1)
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	format := flag.String("format", "csv", "The output format: csv or json (one object per line)")
+	header := flag.Bool("header", false, "Write a header row with the column names in csv output")
+	selected_levels := flag.String("levels", "tld,suffix,domain", "The comma-separated levels to report: tld, suffix, and domain")
+	top := flag.Int("top", 0, "Only report the top N rows of each level by unique hostnames (0 reports all rows)")
+	assume_unique = flag.Bool("assume-unique", false, "The input has no duplicate hostnames, so skip tracking unique hostnames in memory")
+	normalize = flag.Bool("normalize", false, "Encode internationalized names as punycode and skip names with invalid labels")
+	psl_path := flag.String("psl", "", "Load the Public Suffix List from this file or URL instead of the embedded copy")
+	output_path := flag.String("output", "", "Write to this file or stream URL instead of stdout (ex: kafka://broker:9092/topic)")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.txt.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddSampleFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddMetaFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-domainstats")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-domainstats")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-domainstats")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if *format != "csv" && *format != "json" {
+		inetdata.Log.Errorf("Invalid output format specified: %s", *format)
+		usage()
+		os.Exit(1)
+	}
+
+	if *top < 0 {
+		inetdata.Log.Errorf("-top must not be negative")
+		usage()
+		os.Exit(1)
+	}
+
+	levels := []string{}
+	for _, level := range strings.Split(*selected_levels, ",") {
+		level = strings.TrimSpace(level)
+		switch level {
+		case LEVEL_TLD, LEVEL_SUFFIX, LEVEL_DOMAIN:
+			levels = append(levels, level)
+		default:
+			inetdata.Log.Errorf("Invalid level specified: %s", level)
+			usage()
+			os.Exit(1)
+		}
+	}
+
+	if len(*psl_path) > 0 {
+		psl, e := inetdata.OpenPublicSuffixList(*psl_path)
+		if e != nil {
+			inetdata.Log.Errorf("Failed to load the public suffix list from %s: %s", *psl_path, e)
+			os.Exit(1)
+		}
+		suffix_list = psl
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args(), *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidMetaOutput(*output_path) {
+		inetdata.Log.Errorf("-meta requires -output with a local file")
+		usage()
+		os.Exit(1)
+	}
+
+	dest, de := inetdata.CreateOutput(*output_path)
+	if de != nil {
+		inetdata.Log.Errorf("%s", de)
+		os.Exit(1)
+	}
+
+	progress := inetdata.NewProgress("inetdata-domainstats", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.Errors = &invalid_count
+
+	// Start one counter per worker, each with its own partition of hostnames
+	parts := make([]*Partition, inetdata.Workers)
+	counters := make([]chan Hostname, inetdata.Workers)
+	for i := range counters {
+		parts[i] = newPartition()
+		counters[i] = make(chan Hostname, inetdata.QueueDepth)
+		wc.Add(1)
+		go hostnameCounter(counters[i], parts[i])
+	}
+
+	c_inp := make(chan string, inetdata.QueueDepth)
+	progress.AddStage("input", func() int { return len(c_inp) })
+
+	for i := 0; i < inetdata.Workers; i++ {
+		wp.Add(1)
+		go inputParser(c_inp, counters)
+	}
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	// Reader closes c_inp on completion
+	e := inetdata.ReadLinesFromInputs(inputs, *input_compression, progress.CountReader, c_inp)
+	if e != nil {
+		inetdata.Log.Warnf("Failed to read input: %s", e)
+	}
+
+	wp.Wait()
+	for _, c := range counters {
+		close(c)
+	}
+	wc.Wait()
+
+	stats := mergePartitions(parts)
+
+	for i, level := range levels {
+		if e := writeStats(dest, *format, *header && i == 0, topStats(stats[level], *top)); e != nil {
+			inetdata.Log.Errorf("Failed to write output: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	if e := dest.Close(); e != nil {
+		inetdata.Log.Errorf("Failed to write output: %s", e)
+		os.Exit(1)
+	}
+
+	quit <- 0
+
+	inetdata.CloseRejects()
+
+	inetdata.ExitIfInterrupted(*output_path)
+	inetdata.CheckErrorBudget(input_count)
+
+	if e := inetdata.WriteDatasetMeta("inetdata-domainstats", *output_path, output_count); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/dnsname"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var output_count int64 = 0
+var input_count int64 = 0
+var invalid_count int64 = 0
+
+// The number of SPF and DMARC records decoded
+var spf_count int64 = 0
+var dmarc_count int64 = 0
+
+var wg sync.WaitGroup
+
+// The record kinds that are written, see -only
+var kinds = map[string]bool{"spf": true, "dmarc": true}
+
+var normalize bool
+
+// The owner name prefix of DMARC records
+const DMARC_PREFIX = "_dmarc."
+
+// The DMARC tags that are written, other tags are skipped
+var dmarc_tags = map[string]bool{
+	"p":     true,
+	"sp":    true,
+	"pct":   true,
+	"adkim": true,
+	"aspf":  true,
+	"fo":    true,
+	"ri":    true,
+	"rua":   true,
+	"ruf":   true,
+}
+
+type TXTRecord struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] [<input> ... <input>]")
+	fmt.Println("")
+	fmt.Println("Reads TXT records and decodes SPF and DMARC policies into name,kind,value edges for")
+	fmt.Println("email infrastructure graphs. The input is the name,type,value CSV of inetdata-zone2csv")
+	fmt.Println("or inetdata-sonardnsv2-split, or Sonar FDNS JSONL, and records of other types are skipped.")
+	fmt.Println("Quoted TXT values are unquoted and their strings joined.")
+	fmt.Println("")
+	fmt.Println("SPF records (v=spf1) are written as:")
+	fmt.Println("")
+	fmt.Println("  spf-include  : a domain whose SPF policy is included")
+	fmt.Println("  spf-redirect : the domain whose SPF policy replaces this one")
+	fmt.Println("  spf-ip4      : an authorized IPv4 address or network")
+	fmt.Println("  spf-ip6      : an authorized IPv6 address or network")
+	fmt.Println("  spf-a        : a host whose addresses are authorized")
+	fmt.Println("  spf-mx       : a domain whose mail exchangers are authorized")
+	fmt.Println("  spf-ptr      : a domain whose reverse names are authorized")
+	fmt.Println("  spf-exists   : a domain that authorizes senders when it resolves")
+	fmt.Println("  spf-all      : the result of the all mechanism (ex: -all, ~all)")
+	fmt.Println("")
+	fmt.Println("Only mechanisms with a pass qualifier are written, other than all. Networks are written")
+	fmt.Println("in their canonical form, and a or mx mechanisms without a domain use the record's name.")
+	fmt.Println("")
+	fmt.Println("DMARC records (v=DMARC1 at _dmarc.<domain>) are written for the domain as dmarc-<tag>")
+	fmt.Println("for the p, sp, pct, adkim, aspf, fo, ri, rua, and ruf tags, with one dmarc-rua or")
+	fmt.Println("dmarc-ruf line for each report address.")
+	fmt.Println("")
+	fmt.Println("Records with malformed mechanisms or tags are rejected as a whole.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+// Return a TXT value with its quoted strings unquoted and joined, or the
+// value as it is when it is not quoted
+func unquoteTXT(value string) string {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "\"") {
+		return value
+	}
+
+	var b strings.Builder
+	quoted := false
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && i+3 < len(value) && isDigits(value[i+1:i+4]):
+			n, _ := strconv.Atoi(value[i+1 : i+4])
+			b.WriteByte(byte(n))
+			i += 3
+		case c == '\\' && i+1 < len(value):
+			b.WriteByte(value[i+1])
+			i++
+		case quoted:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the canonical form of an SPF network, an address or an address
+// with a prefix length, or an empty string if it is invalid
+func normalizeNetwork(value string, v6 bool) string {
+	if strings.Contains(value, "/") {
+		ip, n, e := net.ParseCIDR(value)
+		if e != nil || (ip.To4() == nil) != v6 {
+			return ""
+		}
+		return n.String()
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil || (ip.To4() == nil) != v6 {
+		return ""
+	}
+	return ip.String()
+}
+
+// Return the domain of a domain-spec, or an empty string if it is invalid.
+// Domains with macros (ex: %{i}._spf.example.com) are kept as they are.
+func normalizeDomain(domain string) string {
+	domain = dnsname.TrimDots(strings.ToLower(domain))
+	if len(domain) == 0 || domain == "." {
+		return ""
+	}
+	if normalize && !strings.Contains(domain, "%") {
+		n, e := dnsname.Normalize(domain)
+		if e != nil {
+			return ""
+		}
+		return n
+	}
+	return domain
+}
+
+// Decode an SPF record into name,kind,value lines, or return false if it is
+// malformed
+func decodeSPF(name string, value string) ([]string, bool) {
+	lines := []string{}
+
+	for _, term := range strings.Fields(value)[1:] {
+		term = strings.ToLower(term)
+
+		// Modifiers
+		if i := strings.Index(term, "="); i > 0 && !strings.ContainsAny(term[:i], ":/") {
+			switch term[:i] {
+			case "redirect":
+				domain := normalizeDomain(term[i+1:])
+				if len(domain) == 0 {
+					return nil, false
+				}
+				lines = append(lines, name+",spf-redirect,"+domain)
+			}
+			continue
+		}
+
+		qualifier := "+"
+		if strings.ContainsAny(term[:1], "+-~?") {
+			qualifier, term = term[:1], term[1:]
+		}
+
+		mechanism, arg := term, ""
+		if i := strings.IndexAny(term, ":/"); i >= 0 {
+			mechanism, arg = term[:i], strings.TrimPrefix(term[i:], ":")
+		}
+
+		if mechanism == "all" {
+			if len(arg) > 0 {
+				return nil, false
+			}
+			lines = append(lines, name+",spf-all,"+qualifier+"all")
+			continue
+		}
+
+		switch mechanism {
+		case "ip4", "ip6":
+			network := normalizeNetwork(arg, mechanism == "ip6")
+			if len(network) == 0 {
+				return nil, false
+			}
+			if qualifier == "+" {
+				lines = append(lines, name+",spf-"+mechanism+","+network)
+			}
+
+		case "a", "mx", "ptr":
+			// The domain is optional and a and mx may have prefix lengths
+			domain := name
+			if i := strings.Index(arg, "/"); i >= 0 {
+				arg = arg[:i]
+			}
+			if len(arg) > 0 {
+				domain = normalizeDomain(arg)
+			}
+			if len(domain) == 0 {
+				return nil, false
+			}
+			if qualifier == "+" {
+				lines = append(lines, name+",spf-"+mechanism+","+domain)
+			}
+
+		case "include", "exists":
+			domain := normalizeDomain(arg)
+			if len(domain) == 0 {
+				return nil, false
+			}
+			if qualifier == "+" {
+				lines = append(lines, name+",spf-"+mechanism+","+domain)
+			}
+
+		default:
+			return nil, false
+		}
+	}
+
+	return lines, true
+}
+
+// Decode a DMARC record into name,kind,value lines, or return false if it is
+// malformed
+func decodeDMARC(name string, value string) ([]string, bool) {
+	lines := []string{}
+
+	for _, tag := range strings.Split(value, ";")[1:] {
+		tag = strings.TrimSpace(tag)
+		if len(tag) == 0 {
+			continue
+		}
+
+		bits := strings.SplitN(tag, "=", 2)
+		if len(bits) != 2 {
+			return nil, false
+		}
+
+		key := strings.ToLower(strings.TrimSpace(bits[0]))
+		val := strings.TrimSpace(bits[1])
+		if !dmarc_tags[key] {
+			continue
+		}
+
+		switch key {
+		case "rua", "ruf":
+			for _, uri := range strings.Split(val, ",") {
+				uri = strings.ToLower(strings.TrimSpace(uri))
+				if len(uri) == 0 {
+					continue
+				}
+				lines = append(lines, name+",dmarc-"+key+","+uri)
+			}
+
+		case "pct", "ri":
+			if _, e := strconv.ParseUint(val, 10, 32); e != nil {
+				return nil, false
+			}
+			lines = append(lines, name+",dmarc-"+key+","+val)
+
+		default:
+			if len(val) == 0 {
+				return nil, false
+			}
+			lines = append(lines, name+",dmarc-"+key+","+strings.ToLower(val))
+		}
+	}
+
+	return lines, true
+}
+
+// Return the owner name and value of a TXT record in a CSV or JSON line, or
+// false if the line is not a TXT record
+func parseLine(raw string) (string, string, bool) {
+	if strings.HasPrefix(raw, "{") {
+		rec := TXTRecord{}
+		if e := json.Unmarshal([]byte(raw), &rec); e != nil {
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_JSON, raw)
+			atomic.AddInt64(&invalid_count, 1)
+			return "", "", false
+		}
+		return rec.Name, rec.Value, strings.ToLower(rec.Type) == "txt"
+	}
+
+	bits := strings.SplitN(raw, ",", 3)
+	if len(bits) != 3 {
+		inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, raw)
+		atomic.AddInt64(&invalid_count, 1)
+		return "", "", false
+	}
+	return bits[0], bits[2], strings.ToLower(bits[1]) == "txt"
+}
+
+// Return true if a TXT value starts with a version tag, case-insensitively
+func hasVersion(value string, version string) bool {
+	if len(value) < len(version) || !strings.EqualFold(value[:len(version)], version) {
+		return false
+	}
+	return len(value) == len(version) || value[len(version)] == ' ' || value[len(version)] == ';'
+}
+
+func inputParser(c chan string, o chan string) {
+	for r := range c {
+		raw := strings.TrimSpace(r)
+		if len(raw) == 0 {
+			continue
+		}
+
+		atomic.AddInt64(&input_count, 1)
+
+		name, value, ok := parseLine(raw)
+		if !ok {
+			continue
+		}
+
+		name = dnsname.TrimDots(strings.ToLower(name))
+		value = unquoteTXT(value)
+
+		var lines []string
+		switch {
+		case kinds["spf"] && hasVersion(value, "v=spf1"):
+			atomic.AddInt64(&spf_count, 1)
+			name = normalizeDomain(name)
+			if len(name) == 0 {
+				inetdata.Rejects.Reject(inetdata.REJECT_INVALID_NAME, raw)
+				atomic.AddInt64(&invalid_count, 1)
+				continue
+			}
+			lines, ok = decodeSPF(name, value)
+
+		case kinds["dmarc"] && hasVersion(value, "v=DMARC1") && strings.HasPrefix(name, DMARC_PREFIX):
+			atomic.AddInt64(&dmarc_count, 1)
+			name = normalizeDomain(strings.TrimPrefix(name, DMARC_PREFIX))
+			if len(name) == 0 {
+				inetdata.Rejects.Reject(inetdata.REJECT_INVALID_NAME, raw)
+				atomic.AddInt64(&invalid_count, 1)
+				continue
+			}
+			lines, ok = decodeDMARC(name, value)
+
+		default:
+			continue
+		}
+
+		if !ok {
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_ENTRY, raw)
+			atomic.AddInt64(&invalid_count, 1)
+			continue
+		}
+
+		for _, line := range lines {
+			o <- line + "\n"
+		}
+	}
+	wg.Done()
+}
+
+func outputWriter(w io.Writer, o chan string, done chan bool) {
+	for r := range o {
+		io.WriteString(w, r)
+		atomic.AddInt64(&output_count, 1)
+	}
+	done <- true
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	only := flag.String("only", "spf,dmarc", "Only decode these comma-separated record kinds: spf or dmarc")
+	normalized := flag.Bool("normalize", false, "Encode internationalized names as punycode and reject records with invalid names")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-emailauth2csv")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-emailauth2csv")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-emailauth2csv")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	selected := map[string]bool{}
+	for _, kind := range strings.Split(*only, ",") {
+		kind = strings.TrimSpace(kind)
+		if !kinds[kind] {
+			inetdata.Log.Errorf("Invalid record kind specified: %s", kind)
+			usage()
+			os.Exit(1)
+		}
+		selected[kind] = true
+	}
+	kinds = selected
+
+	normalize = *normalized
+
+	inputs, ie := inetdata.InputPaths(flag.Args(), *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	progress := inetdata.NewProgress("inetdata-emailauth2csv", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.Errors = &invalid_count
+	progress.AddCounter("spf", &spf_count)
+	progress.AddCounter("dmarc", &dmarc_count)
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	w, we := inetdata.CreateOutput("")
+	if we != nil {
+		inetdata.Log.Errorf("%s", we)
+		os.Exit(1)
+	}
+
+	// Write output
+	c_out := make(chan string, inetdata.QueueDepth)
+	done := make(chan bool)
+	go outputWriter(w, c_out, done)
+
+	// Parse input
+	c_inp := make(chan string, inetdata.QueueDepth)
+	progress.AddStage("input", func() int { return len(c_inp) })
+
+	for i := 0; i < inetdata.Workers; i++ {
+		go inputParser(c_inp, c_out)
+		wg.Add(1)
+	}
+
+	// Reader closes c_inp on completion
+	e := inetdata.ReadLinesFromInputs(inputs, *input_compression, progress.CountReader, c_inp)
+	if e != nil {
+		inetdata.Log.Warnf("Failed to read input: %s", e)
+	}
+
+	wg.Wait()
+	close(c_out)
+	<-done
+
+	if e := w.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+	}
+
+	quit <- 0
+
+	inetdata.Log.Infof("Decoded %d SPF and %d DMARC records", spf_count, dmarc_count)
+
+	inetdata.CloseRejects()
+
+	inetdata.ExitIfInterrupted()
+	inetdata.CheckErrorBudget(input_count)
+}
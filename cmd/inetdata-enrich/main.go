@@ -0,0 +1,416 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/asnmap"
+	"github.com/oschwald/maxminddb-golang"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var output_count int64 = 0
+var input_count int64 = 0
+var invalid_count int64 = 0
+var cached_count int64 = 0
+var wg sync.WaitGroup
+
+var key_field = 1
+var splitter *inetdata.FieldSplitter
+var selector *inetdata.FieldSelector
+
+var country_db *maxminddb.Reader
+var asn_db *maxminddb.Reader
+var asn_map *asnmap.Table
+var cache *lookupCache
+
+type countryRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] [<input> ... <input>]")
+	fmt.Println("")
+	fmt.Println("Reads CSV with an IP address in field -k and appends columns from MaxMind MMDB databases and BGP routing data:")
+	fmt.Println("")
+	fmt.Println("  -country : the ISO country code (GeoLite2-Country, GeoLite2-City, or compatible)")
+	fmt.Println("  -asn     : the AS number and AS name (GeoLite2-ASN or compatible)")
+	fmt.Println("  -asnmap  : the origin AS numbers and the longest matching prefix, from BGP RIB dumps")
+	fmt.Println("             (MRT) or prefix2as files, see inetdata-asnmap")
+	fmt.Println("")
+	fmt.Println("Columns are appended in that order for each database specified. Lines with an invalid")
+	fmt.Println("address, or addresses not found in a database, get empty columns. Lookups are cached")
+	fmt.Println("in an LRU cache of -cache addresses, shared by the -workers lookup workers. Output lines")
+	fmt.Println("are written in no particular order when more than one worker is used.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+// A fixed-size LRU cache of lookup results, keyed by the address
+type lookupCache struct {
+	sync.Mutex
+	size  int
+	items map[string]*list.Element
+	order *list.List
+}
+
+type cacheEntry struct {
+	key  string
+	cols []string
+}
+
+func newLookupCache(size int) *lookupCache {
+	return &lookupCache{size: size, items: make(map[string]*list.Element), order: list.New()}
+}
+
+func (c *lookupCache) get(key string) ([]string, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheEntry).cols, true
+}
+
+func (c *lookupCache) add(key string, cols []string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.order.MoveToFront(el)
+		el.Value.(*cacheEntry).cols = cols
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&cacheEntry{key: key, cols: cols})
+
+	if c.order.Len() > c.size {
+		el := c.order.Back()
+		c.order.Remove(el)
+		delete(c.items, el.Value.(*cacheEntry).key)
+	}
+}
+
+// Look up the enrichment columns for an address
+func lookup(ip net.IP) []string {
+	cols := []string{}
+
+	if country_db != nil {
+		var rec countryRecord
+		if e := country_db.Lookup(ip, &rec); e != nil {
+			inetdata.Log.Warnf("Country lookup failed for %s: %s", ip, e)
+		}
+		code := rec.Country.IsoCode
+		if len(code) == 0 {
+			code = rec.RegisteredCountry.IsoCode
+		}
+		cols = append(cols, code)
+	}
+
+	if asn_db != nil {
+		var rec asnRecord
+		if e := asn_db.Lookup(ip, &rec); e != nil {
+			inetdata.Log.Warnf("ASN lookup failed for %s: %s", ip, e)
+		}
+		asn := ""
+		if rec.Number > 0 {
+			asn = strconv.FormatUint(uint64(rec.Number), 10)
+		}
+		cols = append(cols, asn, rec.Organization)
+	}
+
+	if asn_map != nil {
+		origins, prefix := "", ""
+		if ent, ok := asn_map.Lookup(ip); ok {
+			origins, prefix = ent.OriginString(), ent.Prefix.String()
+		}
+		cols = append(cols, origins, prefix)
+	}
+
+	return cols
+}
+
+func emptyColumns() []string {
+	n := 0
+	if country_db != nil {
+		n++
+	}
+	if asn_db != nil {
+		n += 2
+	}
+	if asn_map != nil {
+		n += 2
+	}
+	return make([]string, n)
+}
+
+func writeOutput(o chan string, q chan bool) {
+	w, e := inetdata.CreateOutput("")
+	if e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+	for r := range o {
+		io.WriteString(w, r)
+	}
+	if e := w.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+	}
+	q <- true
+}
+
+func inputParser(c <-chan string, o chan<- string) {
+
+	empty := emptyColumns()
+
+	for r := range c {
+
+		raw := strings.TrimRight(r, "\r")
+		if len(raw) == 0 {
+			continue
+		}
+
+		atomic.AddInt64(&input_count, 1)
+
+		if selector != nil {
+			sel, e := selector.Apply(raw)
+			if e != nil {
+				atomic.AddInt64(&invalid_count, 1)
+				inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, raw)
+				continue
+			}
+			raw = sel
+		}
+
+		cols := empty
+
+		bits, e := splitter.Split(raw, key_field+1)
+		if e != nil || len(bits) < key_field {
+			atomic.AddInt64(&invalid_count, 1)
+		} else if ip := net.ParseIP(strings.TrimSpace(bits[key_field-1])); ip == nil {
+			atomic.AddInt64(&invalid_count, 1)
+		} else {
+			key := ip.String()
+			if res, ok := cache.get(key); ok {
+				atomic.AddInt64(&cached_count, 1)
+				cols = res
+			} else {
+				cols = lookup(ip)
+				cache.add(key, cols)
+			}
+		}
+
+		o <- raw + splitter.Delimiter + splitter.Join(cols...) + "\n"
+		atomic.AddInt64(&output_count, 1)
+	}
+	wg.Done()
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	country_path := flag.String("country", "", "The MMDB database to read country codes from (ex: GeoLite2-Country.mmdb)")
+	asn_path := flag.String("asn", "", "The MMDB database to read AS numbers and names from (ex: GeoLite2-ASN.mmdb)")
+	asnmap_paths := flag.String("asnmap", "", "Comma-separated BGP RIB dumps or prefix2as files to read origin AS numbers from (ex: pfx2as.txt.gz)")
+	asnmap_format := flag.String("asnmap-format", "auto", "The format of the -asnmap files: auto, mrt, or pfx2as")
+	index_key := flag.Int("k", 1, "The field index of the IP address")
+	delimiter := flag.String("d", ",", "The delimiter to use as a field separator")
+	csv_strict := flag.Bool("csv-strict", false, "Parse the input as RFC 4180 CSV, quoting appended fields where necessary")
+	csv_quote := flag.String("csv-quote", "\"", "The quote character for -csv-strict")
+	csv_escape := flag.String("csv-escape", "", "The escape character for quotes in -csv-strict fields (defaults to doubling the quote)")
+	cache_size := flag.Int("cache", 100000, "The number of addresses to keep in the lookup cache")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddSampleFlags()
+	inetdata.AddSelectFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-enrich")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-enrich")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-enrich")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidASNMapFormat(*asnmap_format) {
+		inetdata.Log.Errorf("Invalid asnmap format specified: %s", *asnmap_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if len(*country_path) == 0 && len(*asn_path) == 0 && len(*asnmap_paths) == 0 {
+		inetdata.Log.Errorf("At least one of -country, -asn, or -asnmap must be specified")
+		usage()
+		os.Exit(1)
+	}
+
+	if *index_key < 1 || *cache_size < 1 {
+		inetdata.Log.Errorf("-k and -cache must be positive")
+		usage()
+		os.Exit(1)
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args(), *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	fs, fe := inetdata.NewFieldSplitter(inetdata.UnescapeDelimiter(*delimiter), *csv_strict, *csv_quote, *csv_escape)
+	if fe != nil {
+		inetdata.Log.Errorf("%s", fe)
+		usage()
+		os.Exit(1)
+	}
+
+	if len(*country_path) > 0 {
+		db, e := maxminddb.Open(*country_path)
+		if e != nil {
+			inetdata.Log.Errorf("Failed to open %s: %s", *country_path, e)
+			os.Exit(1)
+		}
+		defer db.Close()
+		country_db = db
+	}
+
+	if len(*asn_path) > 0 {
+		db, e := maxminddb.Open(*asn_path)
+		if e != nil {
+			inetdata.Log.Errorf("Failed to open %s: %s", *asn_path, e)
+			os.Exit(1)
+		}
+		defer db.Close()
+		asn_db = db
+	}
+
+	if len(*asnmap_paths) > 0 {
+		t, e := inetdata.LoadASNMap(strings.Split(*asnmap_paths, ","), *asnmap_format, nil)
+		if e != nil {
+			inetdata.Log.Errorf("Failed to load -asnmap: %s", e)
+			os.Exit(1)
+		}
+		asn_map = t
+	}
+
+	splitter = fs
+
+	sel, se := inetdata.NewFieldSelector(fs)
+	if se != nil {
+		inetdata.Log.Errorf("%s", se)
+		usage()
+		os.Exit(1)
+	}
+	selector = sel
+	key_field = *index_key
+	cache = newLookupCache(*cache_size)
+
+	progress := inetdata.NewProgress("inetdata-enrich", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.Errors = &invalid_count
+	progress.AddCounter("cached", &cached_count)
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	// Output writer
+	outl := make(chan string, inetdata.QueueDepth)
+	outq := make(chan bool, 1)
+	go writeOutput(outl, outq)
+
+	// Parse stdin
+	c_inp := make(chan string, inetdata.QueueDepth)
+	progress.AddStage("input", func() int { return len(c_inp) })
+
+	for i := 0; i < inetdata.Workers; i++ {
+		go inputParser(c_inp, outl)
+		wg.Add(1)
+	}
+
+	// Reader closes c_inp on completion
+	e := inetdata.ReadLinesFromInputs(inputs, *input_compression, progress.CountReader, c_inp)
+	if e != nil {
+		inetdata.Log.Warnf("Failed to read input: %s", e)
+	}
+
+	wg.Wait()
+
+	close(outl)
+	<-outq
+
+	quit <- 0
+
+	inetdata.CloseRejects()
+
+	inetdata.ExitIfInterrupted()
+	inetdata.CheckErrorBudget(input_count)
+}
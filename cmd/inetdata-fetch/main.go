@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// The Rapid7 Open Data API, which returns a signed URL for each study file
+const RAPID7_API = "https://us.api.insight.rapid7.com/opendata/studies/"
+const RAPID7_PREFIX = "rapid7:"
+
+type headerList []string
+
+func (h *headerList) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerList) Get() interface{} {
+	return []string(*h)
+}
+
+func (h *headerList) Set(v string) error {
+	if !strings.Contains(v, ":") {
+		return fmt.Errorf("expected Name: value")
+	}
+	*h = append(*h, v)
+	return nil
+}
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <url>")
+	fmt.Println("")
+	fmt.Println("Downloads a dataset file over HTTP or HTTPS. When the server supports range requests,")
+	fmt.Println("the file is fetched in -chunk-size chunks, -j at a time, and each chunk is retried up to")
+	fmt.Println("-retries times, waiting -backoff before the second attempt and twice as long before")
+	fmt.Println("each next one. The chunks are written in order, so only -j chunks are held in memory.")
+	fmt.Println("")
+	fmt.Println("The file is written to -o, by default the last element of the URL path in the current")
+	fmt.Println("directory, through a .part file that is renamed once the download is complete and")
+	fmt.Println("verified. With -digest, the contents are checked against a checksum such as")
+	fmt.Println("sha256:<hex>, and a file that does not match is removed.")
+	fmt.Println("")
+	fmt.Println("With -exec, the contents are piped into a shell command instead of a file, such as")
+	fmt.Println("\"inetdata-rdns2csv rdns\", so that a dataset can be parsed while it downloads. A digest")
+	fmt.Println("mismatch is then reported after the command has finished.")
+	fmt.Println("")
+	fmt.Println("Rapid7 Open Data files are given as rapid7:<study>/<file> (ex: rapid7:sonar.rdns_v2/")
+	fmt.Println("2025-10-01-1759276800-rdns.json.gz) and resolved with the API key of -rapid7-key.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+// Resolve a Rapid7 Open Data file to its signed download URL
+func rapid7URL(file string, key string, timeout time.Duration) (string, error) {
+	if len(key) == 0 {
+		return "", fmt.Errorf("a Rapid7 API key is required for %s", file)
+	}
+
+	req, err := http.NewRequest("GET", RAPID7_API+strings.Trim(file, "/")+"/download/", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Api-Key", key)
+	req.Header.Set("Accept", "application/json")
+
+	client := &http.Client{Timeout: timeout, Transport: inetdata.LimitTransport(nil)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("resolving %s failed: %s", file, resp.Status)
+	}
+
+	var res struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(content, &res); err != nil {
+		return "", err
+	}
+	if len(res.URL) == 0 {
+		return "", fmt.Errorf("resolving %s failed: no url", file)
+	}
+	return res.URL, nil
+}
+
+// Pipe the contents into a shell command
+func runCommand(command string, input io.Reader) (int64, error) {
+	proc := exec.Command("sh", "-c", command)
+	proc.Stdout = os.Stdout
+	proc.Stderr = os.Stderr
+
+	stdin, err := proc.StdinPipe()
+	if err != nil {
+		return 0, err
+	}
+
+	inetdata.DetachSignals(proc)
+	if err := proc.Start(); err != nil {
+		return 0, fmt.Errorf("failed to execute the command: %s", err)
+	}
+
+	// A command that exits early breaks the pipe, so its own error comes first
+	n, err := io.Copy(stdin, input)
+	stdin.Close()
+	if we := proc.Wait(); we != nil {
+		err = fmt.Errorf("the command failed: %s", we)
+	}
+	return n, err
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	var headers headerList
+
+	flag.Usage = func() { usage() }
+	output_path := flag.String("o", "", "Write the file to this path, or - for stdout (defaults to the name in the URL)")
+	command := flag.String("exec", "", "Pipe the contents into this shell command instead of writing a file")
+	digest := flag.String("digest", "", "Verify the contents against this checksum: md5, sha1, sha256, or sha512, a colon, and the hex sum")
+	parallel := flag.Int("j", 8, "The number of chunks to download in parallel")
+	chunk_size := flag.Int64("chunk-size", 16, "The size of each chunk, in megabytes")
+	retries := flag.Int("retries", 5, "The number of attempts of each chunk")
+	backoff := flag.Duration("backoff", time.Second, "The delay before retrying a chunk, doubled for each further attempt")
+	timeout := flag.Duration("timeout", 0, "The maximum time of each request (0 for no limit)")
+	rapid7_key := flag.String("rapid7-key", os.Getenv("RAPID7_API_KEY"), "The Rapid7 Open Data API key for rapid7: files (env: RAPID7_API_KEY)")
+	flag.Var(&headers, "header", "Add this header to the requests, as Name: value (repeat for multiple headers)")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+	inetdata.AddRateLimitFlags()
+
+	inetdata.ParseFlags("inetdata-fetch")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-fetch")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-fetch")
+
+	if len(flag.Args()) != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	if *parallel < 1 || *chunk_size < 1 || *retries < 1 {
+		inetdata.Log.Errorf("-j, -chunk-size, and -retries must be at least 1")
+		usage()
+		os.Exit(1)
+	}
+
+	if len(*command) > 0 && len(*output_path) > 0 {
+		inetdata.Log.Errorf("-exec cannot be combined with -o")
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ApplyRateLimits(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	var check *inetdata.Digest
+	if len(*digest) > 0 {
+		d, e := inetdata.NewDigest(*digest)
+		if e != nil {
+			inetdata.Log.Errorf("%s", e)
+			usage()
+			os.Exit(1)
+		}
+		check = d
+	}
+
+	opts := inetdata.DefaultFetchOptions()
+	opts.Workers = *parallel
+	opts.ChunkSize = *chunk_size * 1024 * 1024
+	opts.Retries = *retries
+	opts.Backoff = *backoff
+	opts.Timeout = *timeout
+	for _, h := range headers {
+		bits := strings.SplitN(h, ":", 2)
+		opts.Header.Add(strings.TrimSpace(bits[0]), strings.TrimSpace(bits[1]))
+	}
+
+	src := flag.Args()[0]
+	name := path.Base(strings.TrimPrefix(src, RAPID7_PREFIX))
+	if strings.HasPrefix(src, RAPID7_PREFIX) {
+		u, e := rapid7URL(strings.TrimPrefix(src, RAPID7_PREFIX), *rapid7_key, *timeout)
+		if e != nil {
+			inetdata.Log.Errorf("%s", e)
+			os.Exit(1)
+		}
+		src = u
+	} else if u, e := url.Parse(src); e == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		name = path.Base(u.Path)
+	} else {
+		inetdata.Log.Errorf("Invalid URL: %s", src)
+		usage()
+		os.Exit(1)
+	}
+
+	if len(*output_path) == 0 && len(*command) == 0 {
+		if name == "/" || name == "." {
+			inetdata.Log.Errorf("Can not tell the file name of %s, use -o", src)
+			os.Exit(1)
+		}
+		*output_path = name
+	}
+
+	input, size, e := inetdata.OpenURL(src, opts)
+	if e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+	defer input.Close()
+
+	// The progress counts the bytes of the download
+	progress := inetdata.NewProgress("inetdata-fetch", nil, nil)
+	progress.Input = &progress.Bytes
+	progress.Format = *progress_format
+	progress.Unit = "bytes"
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	reader := progress.CountReader(input)
+	if check != nil {
+		reader = io.TeeReader(reader, check)
+	}
+
+	start := time.Now()
+	var n int64
+
+	// Check that the whole file arrived and that it matches the digest
+	verify := func() error {
+		if size >= 0 && n != size {
+			return fmt.Errorf("expected %d bytes, got %d", size, n)
+		}
+		if check != nil {
+			return check.Verify()
+		}
+		return nil
+	}
+
+	switch {
+	case len(*command) > 0:
+		n, e = runCommand(*command, reader)
+		if e == nil {
+			e = verify()
+		}
+
+	case *output_path == "-":
+		n, e = io.Copy(os.Stdout, reader)
+		if e == nil {
+			e = verify()
+		}
+
+	default:
+		part := *output_path + ".part"
+		fd, fe := os.Create(part)
+		if fe != nil {
+			inetdata.Log.Errorf("%s", fe)
+			os.Exit(1)
+		}
+		n, e = io.Copy(fd, reader)
+		if ce := fd.Close(); e == nil {
+			e = ce
+		}
+		if e == nil {
+			e = verify()
+		}
+		if e == nil && inetdata.Interrupted() {
+			e = fmt.Errorf("interrupted")
+		}
+		if e != nil {
+			os.Remove(part)
+		} else {
+			e = os.Rename(part, *output_path)
+		}
+	}
+
+	quit <- 0
+
+	if e == nil && inetdata.Interrupted() {
+		e = fmt.Errorf("interrupted")
+	}
+
+	if e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	elapsed := time.Since(start).Seconds()
+	inetdata.Log.Infof("Downloaded %d bytes in %.1fs (%.1f MB/s)", n, elapsed, float64(n)/elapsed/(1024*1024))
+}
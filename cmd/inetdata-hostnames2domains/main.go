@@ -4,55 +4,51 @@ import (
 	"flag"
 	"fmt"
 	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/dnsname"
 	"golang.org/x/net/publicsuffix"
+	"io"
 	"os"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
-	"time"
 )
 
 var output_count int64 = 0
 var input_count int64 = 0
 var wg sync.WaitGroup
+var output io.Writer = os.Stdout
+
+var registered_only *bool
+var show_etld *bool
+var show_depth *bool
+var normalize *bool
+var suffix_list *inetdata.PublicSuffixList
 
 func usage() {
-	fmt.Println("Usage: " + os.Args[0] + " [options]")
+	fmt.Println("Usage: " + os.Args[0] + " [options] [<input> ... <input>]")
 	fmt.Println("")
 	fmt.Println("Reads a list of hostnames from stdin and generates a list of all domain names")
 	fmt.Println("")
+	fmt.Println("With -registered, only the registered domain (eTLD+1) is emitted for each hostname.")
+	fmt.Println("The -etld and -depth options append the public suffix and the number of labels")
+	fmt.Println("below the registered domain as additional CSV fields.")
+	fmt.Println("")
+	fmt.Println("The embedded Public Suffix List is used unless -psl is specified, which can be")
+	fmt.Println("either a local file or an http(s) URL (ex: https://publicsuffix.org/list/public_suffix_list.dat)")
+	fmt.Println("")
 	fmt.Println("Options:")
 	flag.PrintDefaults()
 }
 
-func showProgress(quit chan int) {
-	start := time.Now()
-	for {
-		select {
-		case <-quit:
-			return
-		case <-time.After(time.Second * 1):
-			icount := atomic.LoadInt64(&input_count)
-			ocount := atomic.LoadInt64(&output_count)
-
-			if icount == 0 && ocount == 0 {
-				// Reset start, so that we show stats only from our first input
-				start = time.Now()
-				continue
-			}
-			elapsed := time.Since(start)
-			if elapsed.Seconds() > 1.0 {
-				fmt.Fprintf(os.Stderr, "[*] [inetdata-hostnames2domains] Read %d and wrote %d records in %d seconds (%d/s in, %d/s out)\n",
-					icount,
-					ocount,
-					int(elapsed.Seconds()),
-					int(float64(icount)/elapsed.Seconds()),
-					int(float64(ocount)/elapsed.Seconds()))
-			}
-		}
+func publicSuffix(name string) string {
+	if suffix_list != nil {
+		return suffix_list.PublicSuffix(name)
 	}
+	domain, _ := publicsuffix.PublicSuffix(name)
+	return domain
 }
 
 func inputParser(c <-chan string) {
@@ -66,29 +62,43 @@ func inputParser(c <-chan string) {
 			continue
 		}
 
-		// Remove leading dots from the name
-		for len(raw) > 2 && (raw[0:1] == ".") {
-			raw = raw[1:]
-		}
+		// Remove leading and trailing dots from the name
+		raw = dnsname.TrimDots(raw)
 
-		// Remove any trailing dots from the domain name
-		for len(raw) > 1 && raw[len(raw)-1:] == "." {
-			raw = raw[:len(raw)-1]
+		if *normalize {
+			name, err := dnsname.Normalize(raw)
+			if err != nil {
+				inetdata.Rejects.Reject(inetdata.REJECT_INVALID_NAME, raw)
+				continue
+			}
+			raw = name
 		}
 
 		// Make sure it looks like a FQHN
 		bits := strings.SplitN(raw, ".", -1)
 		if len(bits) < 2 {
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_NAME, raw)
 			continue
 		}
 
 		// Lookup the public part of the domain name
-		domain, _ := publicsuffix.PublicSuffix(raw)
+		domain := publicSuffix(raw)
 
 		atomic.AddInt64(&input_count, 1)
 
+		// The registered domain is one label longer than the public suffix
+		suffix_labels := strings.Count(domain, ".") + 1
+
+		first := 0
+		if *registered_only {
+			first = len(bits) - suffix_labels - 1
+			if first < 0 {
+				continue
+			}
+		}
+
 		// Print each component of the FQHN
-		for i := 0; i < len(bits)-1; i++ {
+		for i := first; i < len(bits)-1; i++ {
 			name := strings.Join(bits[i:], ".")
 
 			// Skip public suffixes (.com.au, .com, etc)
@@ -106,7 +116,15 @@ func inputParser(c <-chan string) {
 				continue
 			}
 
-			fmt.Println(name)
+			out := name
+			if *show_etld {
+				out += "," + domain
+			}
+			if *show_depth {
+				out += "," + strconv.Itoa(len(bits)-i-suffix_labels-1)
+			}
+
+			io.WriteString(output, out+"\n")
 			atomic.AddInt64(&output_count, 1)
 		}
 	}
@@ -119,18 +137,95 @@ func main() {
 	os.Setenv("LC_ALL", "C")
 
 	flag.Usage = func() { usage() }
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
 	version := flag.Bool("version", false, "Show the version and build timestamp")
+	registered_only = flag.Bool("registered", false, "Only emit the registered domain (eTLD+1) of each hostname")
+	show_etld = flag.Bool("etld", false, "Append the public suffix (eTLD) of each name as a CSV field")
+	show_depth = flag.Bool("depth", false, "Append the subdomain depth below the registered domain as a CSV field")
+	normalize = flag.Bool("normalize", false, "Lowercase names, encode internationalized names as punycode, and skip names with invalid labels")
+	psl_path := flag.String("psl", "", "Load the Public Suffix List from this file or URL instead of the embedded copy")
 
-	flag.Parse()
+	inetdata.AddTuningFlags()
+	inetdata.AddSampleFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-hostnames2domains")
 
 	if *version {
 		inetdata.PrintVersion("inetdata-hostnames2domains")
 		os.Exit(0)
 	}
 
+	inetdata.HandleSignals("inetdata-hostnames2domains")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	dest, de := inetdata.CreateOutput("")
+	if de != nil {
+		inetdata.Log.Errorf("%s", de)
+		os.Exit(1)
+	}
+	output = dest
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if len(*psl_path) > 0 {
+		psl, e := inetdata.OpenPublicSuffixList(*psl_path)
+		if e != nil {
+			inetdata.Log.Errorf("Failed to load the public suffix list from %s: %s", *psl_path, e)
+			os.Exit(1)
+		}
+		suffix_list = psl
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args(), *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	progress := inetdata.NewProgress("inetdata-hostnames2domains", &input_count, &output_count)
+	progress.Format = *progress_format
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
 	// Progress tracker
 	quit := make(chan int)
-	go showProgress(quit)
+	go progress.Run(quit)
 
 	// Parse stdin
 	c_inp := make(chan string)
@@ -140,12 +235,21 @@ func main() {
 	wg.Add(1)
 
 	// Reader closers c_inp on completion
-	e := inetdata.ReadLines(os.Stdin, c_inp)
+	e := inetdata.ReadLinesFromInputs(inputs, *input_compression, progress.CountReader, c_inp)
 	if e != nil {
-		fmt.Fprintf(os.Stderr, "Error reading input: %s\n", e)
+		inetdata.Log.Warnf("Failed to read input: %s", e)
 	}
 
 	wg.Wait()
+
+	if e := dest.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+	}
+
 	quit <- 0
 
+	inetdata.CloseRejects()
+
+	inetdata.ExitIfInterrupted()
+	inetdata.CheckErrorBudget(input_count)
 }
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"io"
+	"os"
+	"runtime"
+	"sync/atomic"
+)
+
+const JOIN_MODE_INNER = 0
+const JOIN_MODE_LEFT = 1
+const JOIN_MODE_OUTER = 2
+
+var join_modes = map[string]int{
+	"inner": JOIN_MODE_INNER,
+	"left":  JOIN_MODE_LEFT,
+	"outer": JOIN_MODE_OUTER,
+}
+
+var output_count int64 = 0
+var input_count int64 = 0
+var invalid_count int64 = 0
+
+var splitter *inetdata.FieldSplitter
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <left> <right>")
+	fmt.Println("")
+	fmt.Println("Performs a sort-merge join of two CSV inputs on their first field. Both inputs must be")
+	fmt.Println("sorted by the first field in byte order (LC_ALL=C sort -t , -k 1,1), which is checked")
+	fmt.Println("as they are read. Either input may be - to read from stdin.")
+	fmt.Println("")
+	fmt.Println("Each pair of matching rows is written as key,left fields,right fields. Keys that appear")
+	fmt.Println("more than once on both sides produce every combination of their rows, so only the rows")
+	fmt.Println("of the current key are kept in memory. Join modes (-mode):")
+	fmt.Println("")
+	fmt.Println("  inner : only keys present in both inputs")
+	fmt.Println("  left  : all keys of the left input, with -fill for the fields of missing right rows")
+	fmt.Println("  outer : all keys of both inputs, with -fill for the fields of the missing side")
+	fmt.Println("")
+	fmt.Println("Lines are split naively on the delimiter. With -csv-strict, the key is parsed as a CSV")
+	fmt.Println("field, so quoted keys may contain the delimiter. The remaining fields are kept as-is.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+func openSide(path string, codec string, wrap func(io.Reader) io.Reader) (io.Reader, error) {
+	if path == "-" {
+		return inetdata.OpenInputs(nil, codec, wrap)
+	}
+	return inetdata.OpenInputs([]string{path}, codec, wrap)
+}
+
+func writeRows(w io.Writer, key string, left []string, right []string) {
+	qkey := splitter.QuoteField(key)
+	for _, l := range left {
+		for _, r := range right {
+			io.WriteString(w, qkey+splitter.Delimiter+l+splitter.Delimiter+r+"\n")
+			atomic.AddInt64(&output_count, 1)
+		}
+	}
+}
+
+func join(left *inetdata.SortedKeyReader, right *inetdata.SortedKeyReader, mode int, fill string, w io.Writer) error {
+	missing := []string{fill}
+
+	if e := left.Next(); e != nil {
+		return e
+	}
+	if e := right.Next(); e != nil {
+		return e
+	}
+
+	for left.Ok() || right.Ok() {
+		switch {
+		case left.Ok() && right.Ok() && left.Key() == right.Key():
+			key, lrows, e := left.Group()
+			if e != nil {
+				return e
+			}
+			_, rrows, e := right.Group()
+			if e != nil {
+				return e
+			}
+			writeRows(w, key, lrows, rrows)
+
+		case !right.Ok() || (left.Ok() && left.Less(right)):
+			key, lrows, e := left.Group()
+			if e != nil {
+				return e
+			}
+			if mode != JOIN_MODE_INNER {
+				writeRows(w, key, lrows, missing)
+			}
+
+		default:
+			// Once the left input is finished, only an outer join needs the rest of the right
+			if !left.Ok() && mode != JOIN_MODE_OUTER {
+				return nil
+			}
+			key, rrows, e := right.Group()
+			if e != nil {
+				return e
+			}
+			if mode == JOIN_MODE_OUTER {
+				writeRows(w, key, missing, rrows)
+			}
+		}
+	}
+
+	return nil
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	selected_mode := flag.String("mode", "inner", "The join mode: inner, left, or outer")
+	fill := flag.String("fill", "", "The value to write in place of the fields of a missing row")
+	delimiter := flag.String("d", ",", "The delimiter to use as a field separator")
+	csv_strict := flag.Bool("csv-strict", false, "Parse the key as an RFC 4180 CSV field, allowing quoted keys that contain the delimiter")
+	csv_quote := flag.String("csv-quote", "\"", "The quote character for -csv-strict")
+	csv_escape := flag.String("csv-escape", "", "The escape character for quotes in -csv-strict fields (defaults to doubling the quote)")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddSampleFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-join")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-join")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-join")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	mode, ok := join_modes[*selected_mode]
+	if !ok {
+		inetdata.Log.Errorf("Invalid join mode specified: %s", *selected_mode)
+		usage()
+		os.Exit(1)
+	}
+
+	if len(flag.Args()) != 2 {
+		usage()
+		os.Exit(1)
+	}
+
+	if flag.Args()[0] == "-" && flag.Args()[1] == "-" {
+		inetdata.Log.Errorf("Only one input can be read from stdin")
+		os.Exit(1)
+	}
+
+	fs, fe := inetdata.NewFieldSplitter(inetdata.UnescapeDelimiter(*delimiter), *csv_strict, *csv_quote, *csv_escape)
+	if fe != nil {
+		inetdata.Log.Errorf("%s", fe)
+		usage()
+		os.Exit(1)
+	}
+	splitter = fs
+
+	progress := inetdata.NewProgress("inetdata-join", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.Errors = &invalid_count
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	sides := make([]*inetdata.SortedKeyReader, 2)
+	for i, path := range flag.Args() {
+		r, e := openSide(path, *input_compression, progress.CountReader)
+		if e != nil {
+			inetdata.Log.Errorf("%s", e)
+			os.Exit(1)
+		}
+		if c, ok := r.(io.Closer); ok {
+			defer c.Close()
+		}
+		name := path
+		if path == "-" {
+			name = "stdin"
+		}
+		sides[i] = inetdata.NewSortedKeyReader(name, r, splitter, &input_count, &invalid_count)
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	w, we := inetdata.CreateOutput("")
+	if we != nil {
+		inetdata.Log.Errorf("%s", we)
+		os.Exit(1)
+	}
+
+	exit_code := 0
+	if e := join(sides[0], sides[1], mode, *fill, w); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		exit_code = 1
+	}
+
+	if e := w.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+		exit_code = 1
+	}
+
+	quit <- 0
+
+	if exit_code == 0 {
+		inetdata.CloseRejects()
+
+		inetdata.ExitIfInterrupted()
+		inetdata.CheckErrorBudget(input_count)
+	}
+
+	os.Exit(exit_code)
+}
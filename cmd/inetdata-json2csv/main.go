@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const ARRAY_MODE_JOIN = 0
+const ARRAY_MODE_FIRST = 1
+const ARRAY_MODE_EXPLODE = 2
+const ARRAY_MODE_JSON = 3
+
+var array_modes = map[string]int{
+	"join":    ARRAY_MODE_JOIN,
+	"first":   ARRAY_MODE_FIRST,
+	"explode": ARRAY_MODE_EXPLODE,
+	"json":    ARRAY_MODE_JSON,
+}
+
+var output_count int64 = 0
+var input_count int64 = 0
+
+var array_mode = ARRAY_MODE_JOIN
+var array_sep string
+
+type fieldList []string
+
+func (f *fieldList) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *fieldList) Set(v string) error {
+	for _, bit := range strings.Split(v, ",") {
+		bit = strings.TrimSpace(bit)
+		if len(bit) == 0 {
+			return fmt.Errorf("empty field path in %q", v)
+		}
+		*f = append(*f, bit)
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] -f <path> ... -f <path> [<input> ... <input>]")
+	fmt.Println("       " + os.Args[0] + " [options] -profile <name> [<input> ... <input>]")
+	fmt.Println("")
+	fmt.Println("Reads JSONL from stdin and writes one CSV row per record, with a column for each")
+	fmt.Println("field path. Paths are dotted field names (ex: data.cert.subject.cn) and may include")
+	fmt.Println("numeric array indexes (ex: answers.0.value).")
+	fmt.Println("")
+	fmt.Println("Arrays that are not indexed are flattened according to -array:")
+	fmt.Println("")
+	fmt.Println("  join    : join all elements with the array separator (-array-sep)")
+	fmt.Println("  first   : use the first element only")
+	fmt.Println("  explode : emit one row per element (rows multiply across exploded columns)")
+	fmt.Println("  json    : encode the array as a JSON string")
+	fmt.Println("")
+	fmt.Println("With -profile, the columns are the commonly used fields of a known dataset, named as in the")
+	fmt.Println("list below, followed by the columns of any -f paths. Fields that moved between versions of")
+	fmt.Println("a schema are taken from the first path found. Profiles with one row per array element")
+	fmt.Println("(censys-hosts) resolve -f paths against the element, and $.<path> against the record.")
+	fmt.Println("The profiles are:")
+	fmt.Println("")
+	for _, name := range profileNames() {
+		fmt.Printf("  %-12s : %s\n", name, profiles[name].Description)
+	}
+	fmt.Println("")
+	fmt.Println("With -format parquet, the rows are written as a Parquet file with one string column per")
+	fmt.Println("field path, and -d and -header are ignored. With -format avro, they are written as an Avro")
+	fmt.Println("container file with the schema embedded, using a string field per field path or the types")
+	fmt.Println("of the fields in -avro-schema. With -avro-registry, the schema is registered with a schema")
+	fmt.Println("registry and each row is sent to a Kafka -output as a message in the registry wire format.")
+	fmt.Println("With -format pb, the rows are written as length-delimited protobuf records, see")
+	fmt.Println("proto/record.proto.")
+	fmt.Println("")
+	fmt.Println("With -input, records are consumed from a stream instead of stdin and input files, and with")
+	fmt.Println("-output, the output is written to a file or stream instead of stdout. Streams are Kafka")
+	fmt.Println("topics (ex: kafka://broker:9092/topic?group=NAME), see the README for the URL options.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+// Walk a dotted path through decoded JSON, collecting every matching value.
+// Arrays without an explicit index are traversed element by element.
+func resolvePath(v interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		return []interface{}{v}
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		child, ok := t[path[0]]
+		if !ok {
+			return nil
+		}
+		return resolvePath(child, path[1:])
+
+	case []interface{}:
+		if idx, e := strconv.Atoi(path[0]); e == nil {
+			if idx < 0 || idx >= len(t) {
+				return nil
+			}
+			return resolvePath(t[idx], path[1:])
+		}
+
+		res := []interface{}{}
+		for i := range t {
+			res = append(res, resolvePath(t[i], path)...)
+		}
+		return res
+	}
+
+	return nil
+}
+
+// Convert a decoded JSON value into its CSV representation
+func formatValue(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case json.Number:
+		return t.String()
+	case bool:
+		return strconv.FormatBool(t)
+	}
+
+	b, e := json.Marshal(v)
+	if e != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// Resolve a field path and return the list of values for the column. Every
+// mode except explode returns at most one value.
+func fieldValues(v interface{}, path []string) ([]string, bool) {
+	found := resolvePath(v, path)
+	if len(found) == 0 {
+		return nil, false
+	}
+
+	// Flatten a path that ends on an array into its elements
+	if len(found) == 1 {
+		if arr, ok := found[0].([]interface{}); ok {
+			if len(arr) == 0 {
+				return nil, false
+			}
+			found = arr
+		} else {
+			return []string{formatValue(found[0])}, true
+		}
+	}
+
+	switch array_mode {
+	case ARRAY_MODE_FIRST:
+		return []string{formatValue(found[0])}, true
+
+	case ARRAY_MODE_JSON:
+		b, e := json.Marshal(found)
+		if e != nil {
+			return nil, false
+		}
+		return []string{string(b)}, true
+	}
+
+	vals := make([]string, len(found))
+	for i := range found {
+		vals[i] = formatValue(found[i])
+	}
+
+	if array_mode == ARRAY_MODE_JOIN {
+		return []string{strings.Join(vals, array_sep)}, true
+	}
+
+	return vals, true
+}
+
+// Build the cartesian product of the column values
+func explodeRows(cols [][]string) [][]string {
+	rows := [][]string{{}}
+	for _, vals := range cols {
+		next := make([][]string, 0, len(rows)*len(vals))
+		for _, row := range rows {
+			for _, val := range vals {
+				nrow := make([]string, len(row), len(row)+1)
+				copy(nrow, row)
+				next = append(next, append(nrow, val))
+			}
+		}
+		rows = next
+	}
+	return rows
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	var fields fieldList
+
+	flag.Usage = func() { usage() }
+	flag.Var(&fields, "f", "A dotted field path to output as a column (repeat or comma-separate for multiple columns)")
+	selected_profile := flag.String("profile", "", "Output the columns of a dataset profile: "+strings.Join(profileNames(), ", "))
+	delimiter := flag.String("d", ",", "The delimiter to use as a field separator")
+	selected_array_mode := flag.String("array", "join", "The array flattening mode: join, first, explode, or json")
+	array_separator := flag.String("array-sep", ";", "The separator to use with the join array mode")
+	header := flag.Bool("header", false, "Write a header row with the field paths")
+	format := flag.String("format", "csv", "The output format: csv, parquet, avro, or pb")
+	avro_schema := flag.String("avro-schema", "", "An Avro schema file (.avsc) with a field per field path, instead of string fields")
+	avro_compression := flag.String("avro-compression", "deflate", "The avro container compression: null, deflate, or snappy")
+	avro_registry := flag.String("avro-registry", "", "Register the avro schema with this schema registry and write registry-encoded Kafka messages (ex: http://registry:8081)")
+	avro_subject := flag.String("avro-subject", "", "The schema registry subject (defaults to <topic>-value)")
+	parquet_compression := flag.String("parquet-compression", "zstd", "The parquet compression: none, snappy, gzip, or zstd")
+	parquet_row_group := flag.Int("parquet-row-group", 100000, "The maximum number of rows per parquet row group")
+	skip_missing := flag.Bool("skip-missing", false, "Skip records that are missing any of the fields instead of writing empty columns")
+	input_stream := flag.String("input", "", "Read from this stream URL instead of stdin (ex: kafka://broker:9092/topic?group=NAME)")
+	output_path := flag.String("output", "", "Write to this file or stream URL instead of stdout (ex: kafka://broker:9092/topic)")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddJSONSampleFlags("")
+	inetdata.AddOutputFlags()
+	inetdata.AddMetaFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-json2csv")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-json2csv")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-json2csv")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args(), *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	if len(*input_stream) > 0 {
+		if !inetdata.IsStreamURL(*input_stream) || len(inputs) > 0 {
+			inetdata.Log.Errorf("-input must be a stream URL and cannot be combined with input files")
+			usage()
+			os.Exit(1)
+		}
+		inputs = []string{*input_stream}
+	}
+
+	columns := []column{}
+	each := []string{}
+
+	if len(*selected_profile) > 0 {
+		p, ok := profiles[*selected_profile]
+		if !ok {
+			inetdata.Log.Errorf("Invalid profile specified: %s", *selected_profile)
+			usage()
+			os.Exit(1)
+		}
+		for _, c := range p.Columns {
+			columns = append(columns, newColumn(c.Name, c.Paths, c.Value))
+		}
+		if len(p.Each) > 0 {
+			each = strings.Split(p.Each, ".")
+		}
+	}
+
+	for _, f := range fields {
+		columns = append(columns, newColumn(f, []string{f}, ""))
+	}
+
+	if len(columns) == 0 {
+		inetdata.Log.Errorf("At least one field path (-f) or a -profile must be specified")
+		usage()
+		os.Exit(1)
+	}
+
+	names := []string{}
+	for _, c := range columns {
+		names = append(names, c.name)
+	}
+
+	switch *format {
+	case "csv":
+	case "parquet":
+		if !inetdata.ValidParquetCompression(*parquet_compression) {
+			inetdata.Log.Errorf("Invalid parquet compression specified: %s", *parquet_compression)
+			usage()
+			os.Exit(1)
+		}
+	case "avro":
+		if !inetdata.ValidAvroCompression(*avro_compression) {
+			inetdata.Log.Errorf("Invalid avro compression specified: %s", *avro_compression)
+			usage()
+			os.Exit(1)
+		}
+		if len(*avro_registry) > 0 && !strings.HasPrefix(*output_path, "kafka://") {
+			inetdata.Log.Errorf("-avro-registry requires a Kafka -output")
+			usage()
+			os.Exit(1)
+		}
+	case "pb":
+	default:
+		inetdata.Log.Errorf("Invalid output format specified: %s", *format)
+		usage()
+		os.Exit(1)
+	}
+
+	mode, ok := array_modes[*selected_array_mode]
+	if !ok {
+		inetdata.Log.Errorf("Invalid array mode specified: %s", *selected_array_mode)
+		usage()
+		os.Exit(1)
+	}
+	array_mode = mode
+	array_sep = inetdata.UnescapeDelimiter(*array_separator)
+
+	delim := []rune(inetdata.UnescapeDelimiter(*delimiter))
+	if len(delim) != 1 {
+		inetdata.Log.Errorf("The delimiter must be a single character: %q", *delimiter)
+		os.Exit(1)
+	}
+
+	progress := inetdata.NewProgress("inetdata-json2csv", &input_count, &output_count)
+	progress.Format = *progress_format
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	input, ie := inetdata.OpenInputs(inputs, *input_compression, progress.CountReader)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidMetaOutput(*output_path) {
+		inetdata.Log.Errorf("-meta requires -output with a local file")
+		usage()
+		os.Exit(1)
+	}
+
+	dest, de := inetdata.CreateOutput(*output_path)
+	if de != nil {
+		inetdata.Log.Errorf("%s", de)
+		os.Exit(1)
+	}
+
+	out := bufio.NewWriterSize(dest, 1024*1024)
+	w := csv.NewWriter(out)
+	w.Comma = delim[0]
+
+	var pw inetdata.RowWriter
+	var pe error
+
+	switch *format {
+	case "parquet":
+		pcolumns := make([]inetdata.ParquetColumn, len(names))
+		for i := range names {
+			pcolumns[i].Name = names[i]
+		}
+		pw, pe = inetdata.NewParquetWriter(out, pcolumns, *parquet_compression, *parquet_row_group)
+
+	case "avro":
+		schema := inetdata.AvroSchema("json2csv", names)
+		if len(*avro_schema) > 0 {
+			b, e := ioutil.ReadFile(*avro_schema)
+			if e != nil {
+				inetdata.Log.Errorf("%s", e)
+				os.Exit(1)
+			}
+			schema = string(b)
+		}
+
+		var aw *inetdata.AvroWriter
+		if len(*avro_registry) > 0 {
+			subject := *avro_subject
+			if len(subject) == 0 {
+				u, _ := inetdata.ParseKafkaURL(*output_path)
+				subject = u.Topic + "-value"
+			}
+			aw, pe = inetdata.NewAvroRegistryWriter(dest.(inetdata.RecordWriter), schema, *avro_registry, subject)
+		} else {
+			aw, pe = inetdata.NewAvroWriter(out, schema, *avro_compression)
+		}
+
+		if pe == nil && aw.NumFields() != len(names) {
+			pe = fmt.Errorf("the avro schema must have one field per field path, found %d", aw.NumFields())
+		}
+		pw = aw
+
+	case "pb":
+		pw = inetdata.NewProtoWriter(out)
+	}
+
+	if pe != nil {
+		inetdata.Log.Errorf("%s", pe)
+		os.Exit(1)
+	}
+
+	if *header && pw == nil {
+		w.Write(names)
+	}
+
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	scanner := bufio.NewScanner(input)
+	buf := make([]byte, 0, 1024*1024*8)
+	scanner.Buffer(buf, 1024*1024*8)
+
+	for scanner.Scan() {
+		if inetdata.Interrupted() {
+			break
+		}
+
+		raw := scanner.Bytes()
+		if len(bytes.TrimSpace(raw)) == 0 {
+			continue
+		}
+
+		var v interface{}
+
+		// Numbers are kept as-is to avoid float formatting of large integers
+		d := json.NewDecoder(bytes.NewReader(raw))
+		d.UseNumber()
+		if e := d.Decode(&v); e != nil {
+			inetdata.Log.Warnf("Invalid JSON: %v -> %v", e, string(raw))
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_JSON, string(raw))
+			continue
+		}
+
+		atomic.AddInt64(&input_count, 1)
+
+		// With a profile Each path, each element of the array is a row
+		elems := []interface{}{v}
+		if len(each) > 0 {
+			elems = resolvePath(v, each)
+			if len(elems) == 1 {
+				if arr, ok := elems[0].([]interface{}); ok {
+					elems = arr
+				}
+			}
+		}
+
+		for _, elem := range elems {
+			cols := make([][]string, len(columns))
+			missing := false
+			for i := range columns {
+				vals, found := columns[i].values(v, elem)
+				if !found {
+					missing = true
+					vals = []string{""}
+				}
+				cols[i] = vals
+			}
+
+			if missing && *skip_missing {
+				continue
+			}
+
+			for _, row := range explodeRows(cols) {
+				if pw != nil {
+					if e := pw.WriteStrings(row); e != nil {
+						inetdata.Log.Errorf("Failed to write output: %s", e)
+						os.Exit(1)
+					}
+				} else {
+					w.Write(row)
+				}
+				atomic.AddInt64(&output_count, 1)
+			}
+		}
+	}
+
+	if e := scanner.Err(); e != nil {
+		inetdata.Log.Warnf("Failed to read input: %s", e)
+	}
+
+	if pw != nil {
+		if e := pw.Close(); e != nil {
+			inetdata.Log.Warnf("Failed to write output: %s", e)
+		}
+	}
+
+	w.Flush()
+	out.Flush()
+
+	if e := dest.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+	}
+
+	quit <- 0
+
+	inetdata.CloseRejects()
+
+	inetdata.ExitIfInterrupted(*output_path)
+	inetdata.CheckErrorBudget(input_count)
+
+	if e := inetdata.WriteDatasetMeta("inetdata-json2csv", *output_path, output_count); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// A column of a profile. The value is the first of the paths that is found in
+// the record, or a constant value without paths.
+type profileColumn struct {
+	Name  string
+	Paths []string
+	Value string
+}
+
+// A profile extracts the commonly used fields of a dataset. With Each, every
+// element of the array at that path is a row, the column paths are relative
+// to the element, and paths starting with $. are relative to the record.
+type profile struct {
+	Description string
+	Each        string
+	Columns     []profileColumn
+}
+
+// The zgrab2 paths of the leaf certificate of a TLS handshake log
+const zgrab2Cert = "handshake_log.server_certificates.certificate.parsed."
+
+var profiles = map[string]profile{
+	"censys-443": {
+		Description: "Censys IPv4 records (legacy schema), the HTTPS service on port 443",
+		Columns: []profileColumn{
+			{Name: "ip", Paths: []string{"ip"}},
+			{Name: "port", Value: "443"},
+			{Name: "server", Paths: []string{"443.https.get.headers.server"}},
+			{Name: "title", Paths: []string{"443.https.get.title"}},
+			{Name: "status_code", Paths: []string{"443.https.get.status_code"}},
+			{Name: "cert_sha256", Paths: []string{"443.https.tls.certificate.parsed.fingerprint_sha256"}},
+			{Name: "cert_names", Paths: []string{"443.https.tls.certificate.parsed.names"}},
+			{Name: "cert_issuer", Paths: []string{"443.https.tls.certificate.parsed.issuer_dn"}},
+			{Name: "tls_version", Paths: []string{"443.https.tls.version"}},
+			{Name: "cipher_suite", Paths: []string{"443.https.tls.cipher_suite.name"}},
+		},
+	},
+	"censys-hosts": {
+		Description: "Censys host records (search v2 schema), one row per service",
+		Each:        "services",
+		Columns: []profileColumn{
+			{Name: "ip", Paths: []string{"$.ip"}},
+			{Name: "port", Paths: []string{"port"}},
+			{Name: "service", Paths: []string{"service_name", "extended_service_name"}},
+			{Name: "transport", Paths: []string{"transport_protocol"}},
+			{Name: "server", Paths: []string{"http.response.headers.Server", "http.response.headers.server"}},
+			{Name: "title", Paths: []string{"http.response.html_title"}},
+			{Name: "cert_sha256", Paths: []string{"tls.certificates.leaf_fp_sha_256", "certificate"}},
+			{Name: "cert_names", Paths: []string{"tls.certificates.leaf_data.names"}},
+			{Name: "ja3s", Paths: []string{"tls.ja3s"}},
+			{Name: "jarm", Paths: []string{"jarm.fingerprint"}},
+		},
+	},
+	"zgrab2-http": {
+		Description: "zgrab2 http module results",
+		Columns: []profileColumn{
+			{Name: "ip", Paths: []string{"ip"}},
+			{Name: "domain", Paths: []string{"domain"}},
+			{Name: "status", Paths: []string{"data.http.status"}},
+			{Name: "status_code", Paths: []string{"data.http.result.response.status_code"}},
+			{Name: "server", Paths: []string{"data.http.result.response.headers.server"}},
+			{Name: "location", Paths: []string{"data.http.result.response.headers.location"}},
+			{Name: "cert_sha256", Paths: []string{"data.http.result.response.request.tls_log." + zgrab2Cert + "fingerprint_sha256"}},
+			{Name: "cert_names", Paths: []string{"data.http.result.response.request.tls_log." + zgrab2Cert + "names"}},
+		},
+	},
+	"zgrab2-tls": {
+		Description: "zgrab2 tls module results",
+		Columns: []profileColumn{
+			{Name: "ip", Paths: []string{"ip"}},
+			{Name: "domain", Paths: []string{"domain"}},
+			{Name: "status", Paths: []string{"data.tls.status"}},
+			{Name: "tls_version", Paths: []string{"data.tls.result.handshake_log.server_hello.version.name"}},
+			{Name: "cipher_suite", Paths: []string{"data.tls.result.handshake_log.server_hello.cipher_suite.name"}},
+			{Name: "cert_sha256", Paths: []string{"data.tls.result." + zgrab2Cert + "fingerprint_sha256"}},
+			{Name: "cert_names", Paths: []string{"data.tls.result." + zgrab2Cert + "names"}},
+			{Name: "cert_subject", Paths: []string{"data.tls.result." + zgrab2Cert + "subject_dn"}},
+			{Name: "cert_issuer", Paths: []string{"data.tls.result." + zgrab2Cert + "issuer_dn"}},
+		},
+	},
+}
+
+// Return the profile names in lexical order
+func profileNames() []string {
+	names := []string{}
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// A column of the output: a constant value, or the first path found
+type column struct {
+	name  string
+	paths [][]string
+	value string
+	root  []bool
+}
+
+func newColumn(name string, paths []string, value string) column {
+	c := column{name: name, value: value}
+	for _, path := range paths {
+		root := strings.HasPrefix(path, "$.")
+		c.paths = append(c.paths, strings.Split(strings.TrimPrefix(path, "$."), "."))
+		c.root = append(c.root, root)
+	}
+	return c
+}
+
+// Return the values of a column for an element of a record, which is the
+// record itself without a profile Each path
+func (c *column) values(record interface{}, elem interface{}) ([]string, bool) {
+	if len(c.paths) == 0 {
+		return []string{c.value}, true
+	}
+	for i, path := range c.paths {
+		v := elem
+		if c.root[i] {
+			v = record
+		}
+		if vals, found := fieldValues(v, path); found {
+			return vals, true
+		}
+	}
+	return nil, false
+}
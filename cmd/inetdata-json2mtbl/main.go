@@ -5,59 +5,33 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"github.com/fathom6/golang-mtbl"
 	"github.com/fathom6/inetdata-parsers"
-	"github.com/peterbourgon/mergemap"
+	"github.com/fathom6/inetdata-parsers/mtbl"
+	"github.com/fathom6/inetdata-parsers/mtblutil"
 	"os"
 	"runtime"
+	"sync/atomic"
 )
 
-const MERGE_MODE_COMBINE = 0
-const MERGE_MODE_FIRST = 1
-const MERGE_MODE_LAST = 2
+var merge_func mtblutil.MergeFunc
 
-var merge_mode = MERGE_MODE_COMBINE
+var output_count int64 = 0
+var input_count int64 = 0
+var invalid_count int64 = 0
 
 func usage() {
-	fmt.Println("Usage: " + os.Args[0] + " [options]")
+	fmt.Println("Usage: " + os.Args[0] + " [options] <output.mtbl> [<input> ... <input>]")
 	fmt.Println("")
 	fmt.Println("Creates a MTBL database from a JSON input.")
 	fmt.Println("")
+	fmt.Println("With -checkpoint-file, the sorted records are committed to part files next to the output")
+	fmt.Println("every -checkpoint-interval input lines. A run restarted with the same arguments skips the")
+	fmt.Println("committed lines and merges the parts into the output when it completes.")
+	fmt.Println("")
 	fmt.Println("Options:")
 	flag.PrintDefaults()
 }
 
-func mergeFunc(key []byte, val0 []byte, val1 []byte) (mergedVal []byte) {
-
-	if merge_mode == MERGE_MODE_FIRST {
-		return val0
-	}
-
-	if merge_mode == MERGE_MODE_LAST {
-		return val1
-	}
-
-	// MERGE_MODE_COMBINE
-	var v0, v1 map[string]interface{}
-
-	if e := json.Unmarshal(val0, &v0); e != nil {
-		return val1
-	}
-
-	if e := json.Unmarshal(val1, &v1); e != nil {
-		return val0
-	}
-
-	m := mergemap.Merge(v0, v1)
-	d, e := json.Marshal(m)
-	if e != nil {
-		fmt.Fprintf(os.Stderr, "JSON merge error: %v -> %v + %v\n", e, val0, val1)
-		return val0
-	}
-
-	return d
-}
-
 func main() {
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
@@ -67,46 +41,134 @@ func main() {
 
 	kname := flag.String("k", "", "The field name to use as the key")
 	reverse_key := flag.Bool("r", false, "Store the key in reverse order")
-	compression := flag.String("c", "snappy", "The compression type to use (none, snappy, zlib, lz4, lz4hc)")
+	reverse_labels := flag.Bool("L", false, "Store the key with domain labels in reverse order (www.example.com -> com.example.www)")
+	compression := flag.String("c", "snappy", "The compression type to use (none, snappy, zlib, lz4, lz4hc, zstd)")
 	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
 	sort_mem := flag.Uint64("m", 1, "The maximum amount of memory to use, in gigabytes, for the sorting phase")
 	selected_merge_mode := flag.String("M", "combine", "The merge mode: combine, first, or last")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	checkpoint_file := flag.String("checkpoint-file", "", "Commit progress to this file and resume from it when restarted")
+	checkpoint_interval := flag.Int64("checkpoint-interval", 10000000, "The number of input lines between checkpoints")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
 	version := flag.Bool("version", false, "Show the version and build timestamp")
 
-	flag.Parse()
+	inetdata.AddTuningFlags()
+	inetdata.AddJSONSampleFlags("")
+	inetdata.AddRejectFlags()
+	inetdata.AddBloomFlags()
+	inetdata.AddMetaFlags()
+
+	inetdata.ParseFlags("inetdata-json2mtbl")
 
 	if *version {
 		inetdata.PrintVersion("inetdata-json2mtbl")
 		os.Exit(0)
 	}
 
-	if len(flag.Args()) != 1 {
+	inetdata.HandleSignals("inetdata-json2mtbl")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	// Records are sampled by their -k key unless -sample-key is set
+	if len(inetdata.SampleKeyPaths) == 0 {
+		inetdata.SampleKeyPaths = *kname
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidBloomFPR(inetdata.BloomFPR) {
+		inetdata.Log.Errorf("Invalid Bloom filter false positive rate specified: %v", inetdata.BloomFPR)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if *reverse_key && *reverse_labels {
+		inetdata.Log.Errorf("Only one of -r and -L can be specified")
+		os.Exit(1)
+	}
+
+	if len(flag.Args()) < 1 {
 		usage()
 		os.Exit(1)
 	}
 
+	inputs, ie := inetdata.InputPaths(flag.Args()[1:], *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
 	if len(*kname) == 0 {
-		fmt.Fprintf(os.Stderr, "Error: missing key name (-k) parameter\n")
+		inetdata.Log.Errorf("missing key name (-k) parameter")
 		usage()
 		os.Exit(1)
 	}
 
 	fname := flag.Args()[0]
 
+	var cp *inetdata.Checkpoint
+	var skip_lines int64 = 0
+
+	if len(*checkpoint_file) > 0 {
+		if *checkpoint_interval < 1 {
+			inetdata.Log.Errorf("-checkpoint-interval must be at least 1")
+			os.Exit(1)
+		}
+
+		var ce error
+		cp, ce = inetdata.OpenCheckpoint(*checkpoint_file, inputs)
+		if ce != nil {
+			inetdata.Log.Errorf("%s", ce)
+			os.Exit(1)
+		}
+
+		skip_lines, _ = cp.Offset("lines")
+		if cp.Resumed() {
+			inetdata.Log.Infof("Resuming from line %d with %d committed parts", skip_lines, len(cp.PartNames()))
+		}
+	}
+
 	switch *selected_merge_mode {
 	case "combine":
-		merge_mode = MERGE_MODE_COMBINE
+		merge_func = mtblutil.MergeJSONObjects
 	case "first":
-		merge_mode = MERGE_MODE_FIRST
+		merge_func = mtblutil.MergeFirst
 	case "last":
-		merge_mode = MERGE_MODE_LAST
+		merge_func = mtblutil.MergeLast
 	default:
-		fmt.Fprintf(os.Stderr, "Error: Invalid merge mode specified: %s\n", *selected_merge_mode)
+		inetdata.Log.Errorf("Invalid merge mode specified: %s", *selected_merge_mode)
 		usage()
 		os.Exit(1)
 	}
 
-	sort_opt := mtbl.SorterOptions{Merge: mergeFunc, MaxMemory: 1000000000}
+	sort_opt := mtbl.SorterOptions{Merge: mtbl.MergeFunc(merge_func), MaxMemory: 1000000000}
 	sort_opt.MaxMemory *= *sort_mem
 	if len(*sort_tmp) > 0 {
 		sort_opt.TempDir = *sort_tmp
@@ -114,58 +176,137 @@ func main() {
 
 	compression_alg, ok := inetdata.MTBLCompressionTypes[*compression]
 	if !ok {
-		fmt.Fprintf(os.Stderr, "Invalid compression algorithm: %s\n", *compression)
+		inetdata.Log.Errorf("Invalid compression algorithm: %s", *compression)
 		os.Exit(1)
 	}
 
-	s := mtbl.SorterInit(&sort_opt)
-	defer s.Destroy()
+	s := inetdata.NewMTBLPartSorter(fname, cp, sort_opt, mtbl.WriterOptions{Compression: compression_alg})
+
+	progress := inetdata.NewProgress("inetdata-json2mtbl", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.Errors = &invalid_count
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
 
-	w, we := mtbl.WriterInit(fname, &mtbl.WriterOptions{Compression: compression_alg})
-	defer w.Destroy()
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
 
-	if we != nil {
-		fmt.Fprintf(os.Stderr, "Error: %s\n", we)
+	input, ie := inetdata.OpenInputs(inputs, *input_compression, progress.CountReader)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
 		os.Exit(1)
 	}
 
-	scanner := bufio.NewScanner(os.Stdin)
+	scanner := bufio.NewScanner(input)
 	buf := make([]byte, 0, 1024*1024*8)
 	scanner.Buffer(buf, 1024*1024*8)
 
+	var lines int64 = 0
+
 	for scanner.Scan() {
+		if inetdata.Interrupted() {
+			break
+		}
+
+		lines++
+		if lines <= skip_lines {
+			continue
+		}
+
+		if cp != nil && lines%*checkpoint_interval == 0 {
+			if e := s.Commit("lines", lines-1); e != nil {
+				inetdata.Log.Errorf("Failed to commit the checkpoint: %s", e)
+				os.Exit(1)
+			}
+		}
+
 		raw := scanner.Bytes()
 		if len(raw) == 0 {
 			continue
 		}
 
+		atomic.AddInt64(&input_count, 1)
+
 		var v map[string]interface{}
 
 		if e := json.Unmarshal(raw, &v); e != nil {
-			fmt.Fprintf(os.Stderr, "Invalid JSON: %v -> %v\n", e, string(raw))
+			inetdata.Log.Warnf("Invalid JSON: %v -> %v", e, string(raw))
+			atomic.AddInt64(&invalid_count, 1)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_JSON, string(raw))
 			continue
 		}
 
 		kval, ok := v[*kname]
 		if !ok {
-			fmt.Fprintf(os.Stderr, "Missing key: %v -> %v\n", *kname, string(raw))
+			inetdata.Log.Warnf("Missing key: %v -> %v", *kname, string(raw))
+			atomic.AddInt64(&invalid_count, 1)
+			inetdata.Rejects.Reject(inetdata.REJECT_MISSING_FIELD, string(raw))
 			continue
 		}
 
 		kstr := kval.(string)
 
+		if *reverse_labels {
+			kstr = inetdata.ReverseLabels(kstr)
+		}
+
 		if *reverse_key {
 			kstr = inetdata.ReverseKey(kstr)
 		}
 
 		if e := s.Add([]byte(kstr), []byte(raw)); e != nil {
 			fmt.Printf("Failed to add %v -> %v: %v\n", kstr, raw, e)
+			continue
+		}
+		atomic.AddInt64(&output_count, 1)
+	}
+
+	if e := scanner.Err(); e != nil {
+		inetdata.Log.Errorf("Failed to read input: %s", e)
+		os.Exit(1)
+	}
+
+	// An interrupted run commits its progress for the next run to resume
+	if cp != nil && inetdata.Interrupted() {
+		if e := s.Commit("lines", lines); e != nil {
+			inetdata.Log.Errorf("Failed to commit the checkpoint: %s", e)
+			os.Exit(1)
 		}
+		inetdata.Log.Infof("Committed %d lines to %s", lines, *checkpoint_file)
+		quit <- 0
+		inetdata.CloseRejects()
+		os.Exit(inetdata.EXIT_INTERRUPTED)
+	}
+
+	if e := s.Finish(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
 
+	if cp != nil {
+		cp.Remove()
+	}
+
+	quit <- 0
+
+	inetdata.CloseRejects()
+
+	inetdata.ExitIfInterrupted(fname)
+	inetdata.CheckErrorBudget(lines)
+
+	if e := inetdata.WriteMTBLBloom(fname); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
 	}
 
-	if e := s.Write(w); e != nil {
-		fmt.Fprintf(os.Stderr, "Error: %s\n", e)
+	if e := inetdata.WriteMTBLMeta("inetdata-json2mtbl", fname); e != nil {
+		inetdata.Log.Errorf("%s", e)
 		os.Exit(1)
 	}
 }
@@ -4,47 +4,59 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
-	"github.com/fathom6/golang-mtbl"
 	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/mtbl"
+	"github.com/fathom6/inetdata-parsers/mtblutil"
+	"io"
 	"os"
 	"runtime"
-	"time"
+	"sync/atomic"
 )
 
+const MERGE_MODE_VALUE = 0
+const MERGE_MODE_COUNT = 1
+
+var merge_modes = map[string]int{
+	"value": MERGE_MODE_VALUE,
+	"count": MERGE_MODE_COUNT,
+}
+
 var merge_count int64 = 0
 var input_count int64 = 0
 
+var merge_mode = MERGE_MODE_VALUE
+
 func usage() {
-	fmt.Println("Usage: " + os.Args[0] + " [options]")
+	fmt.Println("Usage: " + os.Args[0] + " [options] <output.mtbl> [<input> ... <input>]")
+	fmt.Println("")
+	fmt.Println("Creates a MTBL database from a list of lines, using each line as a key. This is useful")
+	fmt.Println("for membership sets, such as all hostnames ever seen.")
+	fmt.Println("")
+	fmt.Println("Every key is stored with the constant value set by -v, which may be empty. Duplicate")
+	fmt.Println("lines are merged according to -M:")
+	fmt.Println("")
+	fmt.Println("  value : keep the constant value")
+	fmt.Println("  count : store the number of times the line was seen, as a decimal string")
+	fmt.Println("")
+	fmt.Println("With -S, the input must already be sorted by the stored key. Input files are read in")
+	fmt.Println("order, arguments first and then -input-glob matches in lexical order, so they must be")
+	fmt.Println("sorted as a whole: the build fails if a file starts with a key that sorts before the")
+	fmt.Println("last key of the previous file.")
 	fmt.Println("")
-	fmt.Println("Creates a MTBL database from a CSV input.")
+	fmt.Println("With -checkpoint-file, the sorted records are committed to part files next to the output")
+	fmt.Println("every -checkpoint-interval input lines. A run restarted with the same arguments skips the")
+	fmt.Println("committed lines and merges the parts into the output when it completes.")
 	fmt.Println("")
 	fmt.Println("Options:")
 	flag.PrintDefaults()
 }
 
-func showProgress(quit chan int) {
-	start := time.Now()
-	for {
-		select {
-		case <-quit:
-			return
-		case <-time.After(time.Second * 1):
-			elapsed := time.Since(start)
-			if elapsed.Seconds() > 1.0 {
-				fmt.Fprintf(os.Stderr, "[*] Processed %d records in %d seconds (%d/s) (merged: %d)\n",
-					input_count,
-					int(elapsed.Seconds()),
-					int(float64(input_count)/elapsed.Seconds()),
-					merge_count)
-			}
-		}
-	}
-}
-
 func mergeFunc(key []byte, val0 []byte, val1 []byte) (mergedVal []byte) {
-	merge_count++
-	return val0
+	atomic.AddInt64(&merge_count, 1)
+	if merge_mode == MERGE_MODE_COUNT {
+		return mtblutil.MergeCount(key, val0, val1)
+	}
+	return mtblutil.MergeFirst(key, val0, val1)
 }
 
 func main() {
@@ -55,26 +67,124 @@ func main() {
 	flag.Usage = func() { usage() }
 
 	reverse_key := flag.Bool("r", false, "Store the key in reverse order")
-	compression := flag.String("c", "snappy", "The compression type to use (none, snappy, zlib, lz4, lz4hc)")
+	reverse_labels := flag.Bool("L", false, "Store the key with domain labels in reverse order (www.example.com -> com.example.www)")
+	compression := flag.String("c", "snappy", "The compression type to use (none, snappy, zlib, lz4, lz4hc, zstd)")
+	value := flag.String("v", "1", "The constant value to store with each key, may be empty")
+	selected_merge_mode := flag.String("M", "value", "The merge mode for duplicate lines: value or count")
+	block_size := flag.Uint64("b", 0, "The MTBL block size in bytes, 0 uses the library default")
 	sort_skip := flag.Bool("S", false, "Skip the sorting phase and assume keys are in pre-sorted order")
 	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
 	sort_mem := flag.Uint64("m", 1, "The maximum amount of memory to use, in gigabytes, for the sorting phase")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	checkpoint_file := flag.String("checkpoint-file", "", "Commit progress to this file and resume from it when restarted")
+	checkpoint_interval := flag.Int64("checkpoint-interval", 10000000, "The number of input lines between checkpoints")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
 	version := flag.Bool("version", false, "Show the version and build timestamp")
 
-	flag.Parse()
+	inetdata.AddTuningFlags()
+	inetdata.AddSampleFlags()
+	inetdata.AddRejectFlags()
+	inetdata.AddBloomFlags()
+	inetdata.AddMetaFlags()
+
+	inetdata.ParseFlags("inetdata-lines2mtbl")
 
 	if *version {
 		inetdata.PrintVersion("inetdata-lines2mtbl")
 		os.Exit(0)
 	}
 
-	if len(flag.Args()) != 1 {
+	inetdata.HandleSignals("inetdata-lines2mtbl")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
 		usage()
 		os.Exit(1)
 	}
 
+	if !inetdata.ValidBloomFPR(inetdata.BloomFPR) {
+		inetdata.Log.Errorf("Invalid Bloom filter false positive rate specified: %v", inetdata.BloomFPR)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if *reverse_key && *reverse_labels {
+		inetdata.Log.Errorf("Only one of -r and -L can be specified")
+		os.Exit(1)
+	}
+
+	mode, ok := merge_modes[*selected_merge_mode]
+	if !ok {
+		inetdata.Log.Errorf("Invalid merge mode specified: %s", *selected_merge_mode)
+		usage()
+		os.Exit(1)
+	}
+	merge_mode = mode
+
+	if len(flag.Args()) < 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args()[1:], *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
 	fname := flag.Args()[0]
 
+	var cp *inetdata.Checkpoint
+	var skip_lines int64 = 0
+
+	if len(*checkpoint_file) > 0 {
+		if *sort_skip {
+			inetdata.Log.Errorf("-checkpoint-file cannot be combined with -S")
+			os.Exit(1)
+		}
+		if *checkpoint_interval < 1 {
+			inetdata.Log.Errorf("-checkpoint-interval must be at least 1")
+			os.Exit(1)
+		}
+
+		var ce error
+		cp, ce = inetdata.OpenCheckpoint(*checkpoint_file, inputs)
+		if ce != nil {
+			inetdata.Log.Errorf("%s", ce)
+			os.Exit(1)
+		}
+
+		skip_lines, _ = cp.Offset("lines")
+		if cp.Resumed() {
+			inetdata.Log.Infof("Resuming from line %d with %d committed parts", skip_lines, len(cp.PartNames()))
+		}
+	}
+
 	sort_opt := mtbl.SorterOptions{Merge: mergeFunc, MaxMemory: 1000000000}
 	sort_opt.MaxMemory *= *sort_mem
 	if len(*sort_tmp) > 0 {
@@ -83,42 +193,124 @@ func main() {
 
 	compression_alg, ok := inetdata.MTBLCompressionTypes[*compression]
 	if !ok {
-		fmt.Fprintf(os.Stderr, "Invalid compression algorithm: %s\n", *compression)
+		inetdata.Log.Errorf("Invalid compression algorithm: %s", *compression)
 		os.Exit(1)
 	}
 
-	s := mtbl.SorterInit(&sort_opt)
-	defer s.Destroy()
+	w_opt := mtbl.WriterOptions{Compression: compression_alg}
+	if *block_size > 0 {
+		w_opt.BlockSize = *block_size
+	}
 
-	w, we := mtbl.WriterInit(fname, &mtbl.WriterOptions{Compression: compression_alg})
-	defer w.Destroy()
+	s := inetdata.NewMTBLPartSorter(fname, cp, sort_opt, w_opt)
 
-	if we != nil {
-		fmt.Fprintf(os.Stderr, "Error: %s\n", we)
-		os.Exit(1)
+	// Pre-sorted input is written directly
+	var w *mtbl.Writer
+	if *sort_skip {
+		var we error
+		w, we = mtbl.WriterInit(fname, &w_opt)
+		if we != nil {
+			inetdata.Log.Errorf("%s", we)
+			os.Exit(1)
+		}
+	}
+
+	progress := inetdata.NewProgress("inetdata-lines2mtbl", &input_count, nil)
+	progress.Format = *progress_format
+	progress.AddCounter("merged", &merge_count)
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
 	}
 
 	quit := make(chan int)
-	go showProgress(quit)
+	go progress.Run(quit)
+
+	vstr := *value
+	if merge_mode == MERGE_MODE_COUNT {
+		vstr = "1"
+	}
+
+	// The key of a line as it is stored
+	lineKey := func(line string) string {
+		if *reverse_labels {
+			line = inetdata.ReverseLabels(line)
+		}
+		if *reverse_key {
+			line = inetdata.ReverseKey(line)
+		}
+		return line
+	}
+
+	// Pre-sorted files are concatenated, so they must be sorted as a whole
+	var input io.Reader
+	if *sort_skip {
+		input, ie = inetdata.OpenSortedInputs(inputs, *input_compression, progress.CountReader, func(line []byte) []byte {
+			return []byte(lineKey(string(line)))
+		})
+	} else {
+		input, ie = inetdata.OpenInputs(inputs, *input_compression, progress.CountReader)
+	}
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	// Pre-sorted input is merged here, since the writer rejects duplicate keys
+	var pkey, pval []byte
+
+	flush := func() {
+		if pkey == nil {
+			return
+		}
+		if e := w.Add(pkey, pval); e != nil {
+			fmt.Printf("Failed to add %v -> %v: %v\n", string(pkey), string(pval), e)
+		}
+		pkey = nil
+	}
+
+	scanner := bufio.NewScanner(input)
+	buf := make([]byte, 0, 1024*1024)
+	scanner.Buffer(buf, 1024*1024*8)
+
+	var lines int64 = 0
 
-	vstr := "1"
-	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
+		if inetdata.Interrupted() {
+			break
+		}
+
+		lines++
+		if lines <= skip_lines {
+			continue
+		}
+
+		if cp != nil && lines%*checkpoint_interval == 0 {
+			if e := s.Commit("lines", lines-1); e != nil {
+				inetdata.Log.Errorf("Failed to commit the checkpoint: %s", e)
+				os.Exit(1)
+			}
+		}
+
 		kstr := scanner.Text()
 
-		input_count++
+		atomic.AddInt64(&input_count, 1)
 		if len(kstr) == 0 {
 			continue
 		}
 
-		if *reverse_key {
-			kstr = inetdata.ReverseKey(kstr)
-		}
+		kstr = lineKey(kstr)
 
 		if *sort_skip {
-			if e := w.Add([]byte(kstr), []byte(vstr)); e != nil {
-				fmt.Printf("Failed to add %v -> %v: %v\n", kstr, vstr, e)
+			if pkey != nil && string(pkey) == kstr {
+				pval = mergeFunc(pkey, pval, []byte(vstr))
+				continue
 			}
+			flush()
+			pkey, pval = []byte(kstr), []byte(vstr)
 		} else {
 			if e := s.Add([]byte(kstr), []byte(vstr)); e != nil {
 				fmt.Printf("Failed to add %v -> %v: %v\n", kstr, vstr, e)
@@ -126,12 +318,53 @@ func main() {
 		}
 	}
 
-	if !*sort_skip {
-		if e := s.Write(w); e != nil {
-			fmt.Fprintf(os.Stderr, "Error: %s\n", e)
+	if e := scanner.Err(); e != nil {
+		inetdata.Log.Errorf("Failed to read input: %s", e)
+		// Including pre-sorted input files that are out of order
+		if cp != nil || *sort_skip {
+			os.Exit(1)
+		}
+	}
+
+	// An interrupted run commits its progress for the next run to resume
+	if cp != nil && inetdata.Interrupted() {
+		if e := s.Commit("lines", lines); e != nil {
+			inetdata.Log.Errorf("Failed to commit the checkpoint: %s", e)
+			os.Exit(1)
+		}
+		inetdata.Log.Infof("Committed %d lines to %s", lines, *checkpoint_file)
+		inetdata.CloseRejects()
+		os.Exit(inetdata.EXIT_INTERRUPTED)
+	}
+
+	if *sort_skip {
+		flush()
+		w.Destroy()
+	} else {
+		if e := s.Finish(); e != nil {
+			inetdata.Log.Errorf("%s", e)
 			os.Exit(1)
 		}
 	}
 
+	if cp != nil {
+		cp.Remove()
+	}
+
 	quit <- 1
+
+	inetdata.CloseRejects()
+
+	inetdata.ExitIfInterrupted(fname)
+	inetdata.CheckErrorBudget(input_count)
+
+	if e := inetdata.WriteMTBLBloom(fname); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if e := inetdata.WriteMTBLMeta("inetdata-lines2mtbl", fname); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/asnmap"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var output_count int64 = 0
+var input_count int64 = 0
+var invalid_count int64 = 0
+var wg sync.WaitGroup
+var wp sync.WaitGroup
+var wo sync.WaitGroup
+
+var withdrawals bool
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] [<mrt> ... <mrt>]")
+	fmt.Println("")
+	fmt.Println("Reads BGP RIB and UPDATE dumps in MRT format (RouteViews rib.* and updates.*, RIPE RIS")
+	fmt.Println("bview.* and updates.*) and writes a prefix,asn,as_path,timestamp line for every route.")
+	fmt.Println("The asn is the origin of the AS path, with the members of an origin AS_SET separated by")
+	fmt.Println("underscores. The as_path is separated by spaces, with sets in braces. The timestamp is")
+	fmt.Println("in Unix seconds: when the route was received for RIB entries, and when the update was")
+	fmt.Println("recorded for updates.")
+	fmt.Println("")
+	fmt.Println("The files may be compressed, and are read from stdin when none are specified. Up to -j")
+	fmt.Println("files are decompressed in parallel, and their records are parsed by -workers parsers,")
+	fmt.Println("so the lines of different records are not in input order. With -withdrawals, prefixes")
+	fmt.Println("withdrawn by updates are written with an empty asn and as_path. Records that cannot be")
+	fmt.Println("parsed are counted as errors and skipped.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+func outputWriter(fd io.Writer, c chan string) {
+	for r := range c {
+		fd.Write([]byte(r))
+		atomic.AddInt64(&output_count, 1)
+	}
+	wo.Done()
+}
+
+// Read the MRT records of a stream until it ends
+func readRecords(input io.Reader, c_records chan *asnmap.Record) error {
+	m := asnmap.NewMRTReader(input)
+	for {
+		if inetdata.Interrupted() {
+			return nil
+		}
+		rec, e := m.Next()
+		if e == io.EOF {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+		c_records <- rec
+	}
+}
+
+// Decompress and read the files from the file channel until it is closed
+func fileReader(c_files chan string, input_compression string, c_records chan *asnmap.Record, progress *inetdata.Progress) {
+	defer wg.Done()
+
+	for path := range c_files {
+		fd, e := inetdata.OpenPath(path)
+		if e != nil {
+			inetdata.Log.Warnf("Failed to open %s: %s", path, e)
+			continue
+		}
+
+		input, e := inetdata.NewInputReader(progress.CountReader(fd), input_compression)
+		if e != nil {
+			inetdata.Log.Warnf("Failed to read %s: %s", path, e)
+			fd.Close()
+			continue
+		}
+
+		if e := readRecords(input, c_records); e != nil {
+			inetdata.Log.Warnf("Failed to read %s: %s", path, e)
+		}
+		if c, ok := input.(io.Closer); ok {
+			c.Close()
+		}
+		fd.Close()
+	}
+}
+
+// Parse records from the record channel until it is closed
+func recordParser(c_records chan *asnmap.Record, c_out chan string) {
+	defer wp.Done()
+
+	for rec := range c_records {
+		atomic.AddInt64(&input_count, 1)
+
+		routes, e := asnmap.ParseRecord(rec)
+		if e != nil {
+			atomic.AddInt64(&invalid_count, 1)
+			continue
+		}
+
+		for i := range routes {
+			r := &routes[i]
+			if r.Withdrawn && !withdrawals {
+				continue
+			}
+			c_out <- r.Prefix.String() + "," + r.OriginString() + "," + r.PathString() + "," + strconv.FormatUint(uint64(r.Timestamp), 10) + "\n"
+		}
+	}
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	with_withdrawals := flag.Bool("withdrawals", false, "Also write the prefixes withdrawn by updates, with an empty asn and as_path")
+	header := flag.Bool("header", false, "Write a header row with the column names")
+	parallel := flag.Int("j", 0, "The number of files to decompress in parallel (defaults to -workers)")
+	output_compression := flag.String("output-compression", "none", "The output compression: none, gzip, zstd, or lz4")
+	compression_level := flag.Int("compression-level", -1, "The output compression level, -1 uses the default for the codec")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the files matching this glob pattern, in lexical order (ex: 'updates.*.bz2')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddOutputFlags()
+
+	inetdata.ParseFlags("inetdata-mrt2csv")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-mrt2csv")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-mrt2csv")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidOutputCompression(*output_compression) {
+		inetdata.Log.Errorf("Invalid output compression specified: %s", *output_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if *parallel < 1 {
+		*parallel = inetdata.Workers
+	}
+
+	withdrawals = *with_withdrawals
+
+	inputs, ie := inetdata.InputPaths(flag.Args(), *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	dest, de := inetdata.CreateOutput("")
+	if de != nil {
+		inetdata.Log.Errorf("%s", de)
+		os.Exit(1)
+	}
+
+	output, oe := inetdata.NewOutputWriter(dest, *output_compression, *compression_level)
+	if oe != nil {
+		inetdata.Log.Errorf("%s", oe)
+		os.Exit(1)
+	}
+
+	if *header {
+		io.WriteString(output, "prefix,asn,as_path,timestamp\n")
+	}
+
+	progress := inetdata.NewProgress("inetdata-mrt2csv", &input_count, &output_count)
+	progress.Errors = &invalid_count
+	progress.Format = *progress_format
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	// Write output
+	c_out := make(chan string, inetdata.QueueDepth)
+	progress.AddStage("routes", func() int { return len(c_out) })
+	go outputWriter(output, c_out)
+	wo.Add(1)
+
+	// Parse records
+	c_records := make(chan *asnmap.Record, inetdata.QueueDepth)
+	progress.AddStage("records", func() int { return len(c_records) })
+	for i := 0; i < inetdata.Workers; i++ {
+		go recordParser(c_records, c_out)
+		wp.Add(1)
+	}
+
+	if len(inputs) > 0 {
+		// Decompress and read the files in parallel
+		c_files := make(chan string)
+		for i := 0; i < *parallel; i++ {
+			go fileReader(c_files, *input_compression, c_records, progress)
+			wg.Add(1)
+		}
+
+		for _, path := range inputs {
+			if inetdata.Interrupted() {
+				break
+			}
+			c_files <- path
+		}
+		close(c_files)
+		wg.Wait()
+
+	} else {
+		input, e := inetdata.NewInputReader(progress.CountReader(os.Stdin), *input_compression)
+		if e != nil {
+			inetdata.Log.Errorf("Failed to read input: %s", e)
+			os.Exit(1)
+		}
+
+		if e := readRecords(input, c_records); e != nil {
+			inetdata.Log.Warnf("Failed to read input: %s", e)
+		}
+	}
+
+	// Wait for the parsers to finish
+	close(c_records)
+	wp.Wait()
+
+	// Close the output channel and wait for the writer to finish
+	close(c_out)
+	wo.Wait()
+
+	if e := output.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+	}
+
+	if e := dest.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+	}
+
+	// Stop the main process monitoring
+	quit <- 0
+
+	inetdata.ExitIfInterrupted()
+}
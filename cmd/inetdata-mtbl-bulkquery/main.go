@@ -0,0 +1,262 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var output_count int64 = 0
+var input_count int64 = 0
+var found_count int64 = 0
+var missing_count int64 = 0
+var error_count int64 = 0
+var wg sync.WaitGroup
+
+var datasets []*inetdata.MTBLDataset
+var splitter *inetdata.FieldSplitter
+var value_separator = "\x00"
+var found_only = false
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <mtbl> ... <mtbl>")
+	fmt.Println("")
+	fmt.Println("Reads keys from stdin, one per line, looks each one up in the MTBL databases, and")
+	fmt.Println("writes key,found,values CSV. The values of the databases holding the key are joined")
+	fmt.Println("with -m in the order the databases are specified. A shard manifest (<name>.shards.json,")
+	fmt.Println("see inetdata-mtbl-merge -shards) may be given in place of a database, and each key is")
+	fmt.Println("looked up in its shard.")
+	fmt.Println("")
+	fmt.Println("Hostnames are looked up in reverse form with -R, or with reversed labels with -L, to")
+	fmt.Println("match databases built with the same options. IP addresses are looked up as-is, or")
+	fmt.Println("encoded with -ip-key. Lookups are made by -workers workers, and output lines are written")
+	fmt.Println("in no particular order when more than one worker is used.")
+	fmt.Println("")
+	fmt.Println("Databases with a Bloom filter sidecar (<mtbl>.bloom, see -bloom in the *2mtbl tools)")
+	fmt.Println("answer most misses from the filter, without reading the database.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+func writeOutput(o chan string, q chan bool) {
+	w, e := inetdata.CreateOutput("")
+	if e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+	for r := range o {
+		io.WriteString(w, r)
+	}
+	if e := w.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+	}
+	q <- true
+}
+
+// Look up a key in each database, returning the values found
+func lookup(key string) []string {
+	vals := []string{}
+	for _, d := range datasets {
+		val, ok, e := d.Get(d.QueryKey(key))
+		if e != nil {
+			atomic.AddInt64(&error_count, 1)
+			inetdata.Log.Warnf("Lookup of %s in %s failed: %s", key, d.Path, e)
+			continue
+		}
+		if ok {
+			vals = append(vals, string(val))
+		}
+	}
+	return vals
+}
+
+func inputParser(c <-chan string, o chan<- string) {
+
+	for r := range c {
+
+		key := strings.TrimSpace(r)
+		if len(key) == 0 {
+			continue
+		}
+
+		atomic.AddInt64(&input_count, 1)
+
+		vals := lookup(key)
+		found := "false"
+		if len(vals) > 0 {
+			found = "true"
+			atomic.AddInt64(&found_count, 1)
+		} else {
+			atomic.AddInt64(&missing_count, 1)
+			if found_only {
+				continue
+			}
+		}
+
+		o <- splitter.Join(key, found, strings.Join(vals, value_separator)) + "\n"
+		atomic.AddInt64(&output_count, 1)
+	}
+	wg.Done()
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	rev_key := flag.Bool("R", false, "Look up hostnames in reverse form, for databases built with the default key form")
+	rev_labels := flag.Bool("L", false, "Look up hostnames with the domain labels in reverse order (www.example.com -> com.example.www)")
+	selected_ip_key := flag.String("ip-key", "none", "The IP address key encoding used by the databases: none, binary, or hex")
+	merge_sep := flag.String("m", "\\x00", "The separator to use when joining the values of several databases")
+	only_found := flag.Bool("found-only", false, "Only write the keys found in at least one database")
+	use_mmap := flag.Bool("mmap", true, "Map the databases into memory instead of reading blocks with pread")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Read keys from the input files matching this glob pattern, in lexical order, instead of stdin")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddSampleFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddRequireMetaFlags()
+
+	inetdata.ParseFlags("inetdata-mtbl-bulkquery")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-mtbl-bulkquery")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-mtbl-bulkquery")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidIPKeyFormat(*selected_ip_key) {
+		inetdata.Log.Errorf("Invalid IP key format specified: %s", *selected_ip_key)
+		usage()
+		os.Exit(1)
+	}
+
+	if *rev_key && *rev_labels {
+		inetdata.Log.Errorf("Only one of -R or -L can be specified")
+		usage()
+		os.Exit(1)
+	}
+
+	if len(flag.Args()) == 0 {
+		inetdata.Log.Errorf("At least one MTBL database must be specified")
+		usage()
+		os.Exit(1)
+	}
+
+	inputs, ie := inetdata.InputPaths(nil, *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	keys := inetdata.DATASET_KEYS_PLAIN
+	if *rev_key {
+		keys = inetdata.DATASET_KEYS_REVERSED
+	}
+	if *rev_labels {
+		keys = inetdata.DATASET_KEYS_LABELS
+	}
+
+	for _, path := range flag.Args() {
+		d, e := inetdata.OpenMTBLDataset(path, path, keys, *selected_ip_key, *use_mmap)
+		if e != nil {
+			inetdata.Log.Errorf("Failed to read %s: %s", path, e)
+			os.Exit(1)
+		}
+		defer d.Close()
+		datasets = append(datasets, d)
+	}
+
+	fs, fe := inetdata.NewFieldSplitter(",", true, "\"", "")
+	if fe != nil {
+		inetdata.Log.Errorf("%s", fe)
+		os.Exit(1)
+	}
+
+	splitter = fs
+	value_separator = inetdata.UnescapeDelimiter(*merge_sep)
+	found_only = *only_found
+
+	progress := inetdata.NewProgress("inetdata-mtbl-bulkquery", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.Errors = &error_count
+	progress.AddCounter("found", &found_count)
+	progress.AddCounter("missing", &missing_count)
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	// Output writer
+	outl := make(chan string, inetdata.QueueDepth)
+	outq := make(chan bool, 1)
+	go writeOutput(outl, outq)
+
+	// Parse stdin
+	c_inp := make(chan string, inetdata.QueueDepth)
+	progress.AddStage("input", func() int { return len(c_inp) })
+
+	for i := 0; i < inetdata.Workers; i++ {
+		go inputParser(c_inp, outl)
+		wg.Add(1)
+	}
+
+	// Reader closes c_inp on completion
+	e := inetdata.ReadLinesFromInputs(inputs, *input_compression, progress.CountReader, c_inp)
+	if e != nil {
+		inetdata.Log.Warnf("Failed to read input: %s", e)
+	}
+
+	wg.Wait()
+
+	close(outl)
+	<-outq
+
+	quit <- 0
+
+	inetdata.ExitIfInterrupted()
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/linereader"
+	"github.com/fathom6/inetdata-parsers/mtbl"
+	"github.com/fathom6/inetdata-parsers/mtblutil"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The source indexes of the merger
+const SOURCE_PREVIOUS = 0
+const SOURCE_INPUT = 1
+
+// Encode the record type of untyped address values
+var typed_values = false
+
+// The first-seen and last-seen timestamp of the input values without -timestamps
+var value_timestamp = ""
+
+// Read the first-seen,last-seen,value values of csvrollup -timestamps
+var seen_values = false
+
+// The encoding of IP address keys
+var ip_key = "none"
+
+var input_count int64 = 0
+var invalid_count int64 = 0
+var merge_count int64 = 0
+var output_count int64 = 0
+var changed_count int64 = 0
+
+type NewRecord struct {
+	Key []byte
+	Val []byte
+}
+
+var wg sync.WaitGroup
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <output.mtbl> <previous.mtbl> [<input> ... <input>]")
+	fmt.Println("")
+	fmt.Println("Updates a MTBL database built by inetdata-dns2mtbl -timestamps with a new drop, without")
+	fmt.Println("rebuilding it from every drop. The input is the name,values output of inetdata-csvrollup,")
+	fmt.Println("which is sorted and merged with the previous database into a new output database.")
+	fmt.Println("")
+	fmt.Println("Each input value is stored like dns2mtbl -timestamps, as [type, value, first, last], with")
+	fmt.Println("-timestamp as both the first-seen and last-seen timestamp. With -timestamps, the input is")
+	fmt.Println("the output of csvrollup -timestamps instead, whose values carry their own timestamps. When")
+	fmt.Println("a value is already in the previous database, the earliest first-seen and the latest")
+	fmt.Println("last-seen timestamps are kept, so values seen again have their last-seen updated and")
+	fmt.Println("other values are kept as-is.")
+	fmt.Println("")
+	fmt.Println("With -changes, the values that were not in the previous database are also written to a")
+	fmt.Println("separate MTBL database with the same keys, so that later stages can process only what is")
+	fmt.Println("new in the drop.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+func mergeFunc(key []byte, val0 []byte, val1 []byte) (mergedVal []byte) {
+	atomic.AddInt64(&merge_count, 1)
+	return mtblutil.MergeSeenArrays(key, val0, val1)
+}
+
+func writeToSorter(s *inetdata.MTBLPartSorter, c chan NewRecord, d chan bool) {
+	for r := range c {
+		if e := s.Add(r.Key, r.Val); e != nil {
+			inetdata.Log.Warnf("Failed to add key=%v (%v): %v", r.Key, r.Val, e)
+		}
+	}
+	d <- true
+}
+
+func inputParser(d chan *linereader.Line, c chan NewRecord) {
+	for l := range d {
+		rec, ok := parseLine(l.Bytes)
+		l.Recycle()
+
+		if ok {
+			c <- rec
+		}
+	}
+	wg.Done()
+}
+
+// Convert a name,values line into a record, see dns2mtbl
+func parseLine(raw []byte) (NewRecord, bool) {
+
+	bits := bytes.SplitN(raw, []byte(","), 2)
+
+	if len(bits) != 2 {
+		atomic.AddInt64(&invalid_count, 1)
+		inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, string(raw))
+		return NewRecord{}, false
+	}
+
+	atomic.AddInt64(&input_count, 1)
+
+	name := string(bits[0])
+	data := bits[1]
+
+	if len(name) == 0 || len(data) == 0 {
+		atomic.AddInt64(&invalid_count, 1)
+		inetdata.Rejects.Reject(inetdata.REJECT_MISSING_FIELD, string(raw))
+		return NewRecord{}, false
+	}
+	vals := bytes.Split(data, []byte("\x00"))
+
+	var outp [][]string
+	for i := range vals {
+		val := string(vals[i])
+
+		seen := []string{value_timestamp, value_timestamp}
+		if seen_values {
+			vbits := strings.SplitN(val, ",", 3)
+			if len(vbits) != 3 || len(vbits[0]) == 0 || len(vbits[1]) == 0 {
+				atomic.AddInt64(&invalid_count, 1)
+				inetdata.Rejects.Reject(inetdata.REJECT_MISSING_FIELD, string(raw))
+				return NewRecord{}, false
+			}
+			seen, val = vbits[:2], vbits[2]
+		}
+
+		info := strings.SplitN(val, ",", 2)
+
+		// Untyped address values, see dns2mtbl -typed
+		if len(info) == 1 && typed_values {
+			if inetdata.Match_IPv4.MatchString(val) {
+				info = []string{"a", val}
+			} else if inetdata.Match_IPv6.MatchString(val) {
+				info = []string{"aaaa", val}
+			}
+		}
+
+		outp = append(outp, append(info, seen...))
+	}
+
+	json, e := json.Marshal(outp)
+	if e != nil {
+		inetdata.Log.Warnf("Could not marshal %v: %s", outp, e)
+		return NewRecord{}, false
+	}
+
+	// Reverse the key unless its an IP address
+	key := []byte(name)
+	if !(inetdata.Match_IPv4.Match(key) || inetdata.Match_IPv6.Match(key)) {
+		key = []byte(inetdata.ReverseKey(name))
+	} else if ip_key != "none" {
+		enc, ke := inetdata.EncodeIPKeyString(name, ip_key)
+		if ke != nil {
+			atomic.AddInt64(&invalid_count, 1)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_KEY, string(raw))
+			return NewRecord{}, false
+		}
+		key = enc
+	}
+
+	return NewRecord{Key: key, Val: json}, true
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+
+	compression := flag.String("c", "snappy", "The compression type to use (none, snappy, zlib, lz4, lz4hc, zstd)")
+	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
+	sort_mem := flag.Uint64("m", 1024, "The maximum amount of memory to use, in megabytes, for the sorting phase")
+	changes_path := flag.String("changes", "", "Also write the values that were not in the previous database to this MTBL database")
+	typed := flag.Bool("typed", false, "Add the record type (a or aaaa) to address values that have no type prefix")
+	timestamp := flag.String("timestamp", "", "The first-seen and last-seen timestamp of the input values, \"now\" uses the current time (ex: 1760486400)")
+	timestamps := flag.Bool("timestamps", false, "Read the first-seen,last-seen,value values of csvrollup -timestamps")
+	selected_ip_key := flag.String("ip-key", "none", "Encode IP address keys for numeric ordering: none, binary, or hex")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddSampleFlags()
+	inetdata.AddRejectFlags()
+	inetdata.AddBloomFlags()
+	inetdata.AddMetaFlags()
+	inetdata.AddRequireMetaFlags()
+
+	inetdata.ParseFlags("inetdata-mtbl-delta")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-mtbl-delta")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-mtbl-delta")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidBloomFPR(inetdata.BloomFPR) {
+		inetdata.Log.Errorf("Invalid Bloom filter false positive rate specified: %v", inetdata.BloomFPR)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if len(flag.Args()) < 2 {
+		usage()
+		os.Exit(1)
+	}
+
+	fname := flag.Args()[0]
+	previous := flag.Args()[1]
+
+	inputs, ie := inetdata.InputPaths(flag.Args()[2:], *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	if fname == previous || fname == *changes_path || previous == *changes_path {
+		inetdata.Log.Errorf("The output, previous, and -changes databases must be different files")
+		os.Exit(1)
+	}
+
+	if *timestamps == (len(*timestamp) > 0) {
+		inetdata.Log.Errorf("Either -timestamp or -timestamps is required")
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidIPKeyFormat(*selected_ip_key) {
+		inetdata.Log.Errorf("Invalid IP key format specified: %s", *selected_ip_key)
+		usage()
+		os.Exit(1)
+	}
+
+	ip_key = *selected_ip_key
+	typed_values = *typed
+	seen_values = *timestamps
+	value_timestamp = *timestamp
+	if value_timestamp == "now" {
+		value_timestamp = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	compression_alg, ok := inetdata.MTBLCompressionTypes[*compression]
+	if !ok {
+		inetdata.Log.Errorf("Invalid compression algorithm: %s", *compression)
+		os.Exit(1)
+	}
+	w_opt := mtbl.WriterOptions{Compression: compression_alg}
+
+	if e := inetdata.CheckDatasetMeta(previous); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+	if e := inetdata.AddMetaSource(previous); e != nil {
+		inetdata.Log.Errorf("Failed to read %s: %s", previous, e)
+		os.Exit(1)
+	}
+
+	prev_r, pe := mtbl.ReaderInit(previous, &mtbl.ReaderOptions{VerifyChecksums: true})
+	if pe != nil {
+		inetdata.Log.Errorf("Failed to read %s: %s", previous, pe)
+		os.Exit(1)
+	}
+	defer prev_r.Destroy()
+
+	sort_opt := mtbl.SorterOptions{Merge: mergeFunc, MaxMemory: 1024 * 1024}
+	sort_opt.MaxMemory *= *sort_mem
+
+	if len(*sort_tmp) > 0 {
+		sort_opt.TempDir = *sort_tmp
+	}
+
+	// The input is sorted into a temporary database next to the output
+	delta_path := fname + ".delta"
+	s := inetdata.NewMTBLPartSorter(delta_path, nil, sort_opt, w_opt)
+
+	s_ch := make(chan NewRecord, inetdata.QueueDepth)
+	s_done := make(chan bool, 1)
+
+	go writeToSorter(s, s_ch, s_done)
+
+	p_ch := make(chan *linereader.Line, inetdata.QueueDepth)
+	for i := 0; i < inetdata.Workers; i++ {
+		go inputParser(p_ch, s_ch)
+		wg.Add(1)
+	}
+
+	progress := inetdata.NewProgress("inetdata-mtbl-delta", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.AddCounter("merged", &merge_count)
+	progress.AddCounter("changed", &changed_count)
+	progress.Errors = &invalid_count
+	progress.AddStage("input", func() int { return len(p_ch) })
+	progress.AddStage("sort", func() int { return len(s_ch) })
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	// Reader closes p_ch on completion
+	if e := inetdata.ReadLineBytesFromInputs(inputs, *input_compression, progress.CountReader, p_ch); e != nil {
+		inetdata.Log.Errorf("Failed to read input: %s", e)
+		os.Exit(1)
+	}
+
+	wg.Wait()
+
+	close(s_ch)
+	<-s_done
+
+	if e := s.Finish(); e != nil {
+		inetdata.Log.Warnf("Error writing MTBL: %s", e)
+		os.Remove(delta_path)
+		os.Exit(1)
+	}
+
+	if inetdata.Interrupted() {
+		quit <- 0
+		inetdata.CloseRejects()
+		os.Remove(delta_path)
+		os.Exit(inetdata.EXIT_INTERRUPTED)
+	}
+
+	delta_r, de := mtbl.ReaderInit(delta_path, &mtbl.ReaderOptions{VerifyChecksums: true})
+	if de != nil {
+		inetdata.Log.Errorf("Failed to read %s: %s", delta_path, de)
+		os.Remove(delta_path)
+		os.Exit(1)
+	}
+
+	// Both databases are read in key order, so the merge streams the previous
+	// database instead of sorting it again
+	merger := mtblutil.NewMerger([]mtblutil.Iterator{mtbl.IterAll(prev_r), mtbl.IterAll(delta_r)})
+
+	os.Remove(fname)
+	w, we := mtbl.WriterInit(fname, &w_opt)
+	if we != nil {
+		inetdata.Log.Errorf("%s", we)
+		os.Exit(1)
+	}
+
+	var cw *mtbl.Writer
+	if len(*changes_path) > 0 {
+		os.Remove(*changes_path)
+		cw, we = mtbl.WriterInit(*changes_path, &w_opt)
+		if we != nil {
+			inetdata.Log.Errorf("%s", we)
+			os.Exit(1)
+		}
+	}
+
+	exit_code := 0
+
+	for !inetdata.Interrupted() {
+		key, vals, ok := merger.Next()
+		if !ok {
+			break
+		}
+
+		// The previous value, if any, comes first
+		var prev, next []byte
+		for i, src := range merger.Sources() {
+			if src == SOURCE_PREVIOUS {
+				prev = vals[i]
+			} else {
+				next = vals[i]
+			}
+		}
+
+		val := vals[0]
+		if prev != nil && next != nil {
+			val = mergeFunc(key, prev, next)
+		}
+
+		if e := w.Add(key, val); e != nil {
+			inetdata.Log.Warnf("Failed to add key=%q: %s", key, e)
+			exit_code = 1
+			continue
+		}
+		atomic.AddInt64(&output_count, 1)
+
+		if cw == nil || next == nil {
+			continue
+		}
+
+		changes, changed := next, true
+		if prev != nil {
+			changes, changed = mtblutil.NewSeenArrays(prev, next)
+		}
+		if !changed {
+			continue
+		}
+
+		if e := cw.Add(key, changes); e != nil {
+			inetdata.Log.Warnf("Failed to add key=%q to the changes: %s", key, e)
+			exit_code = 1
+			continue
+		}
+		atomic.AddInt64(&changed_count, 1)
+	}
+
+	w.Destroy()
+	if cw != nil {
+		cw.Destroy()
+	}
+
+	delta_r.Destroy()
+	os.Remove(delta_path)
+
+	quit <- 0
+
+	inetdata.CloseRejects()
+
+	if exit_code != 0 {
+		os.Exit(exit_code)
+	}
+
+	inetdata.ExitIfInterrupted(fname, *changes_path)
+	inetdata.CheckErrorBudget(input_count)
+
+	for _, path := range []string{fname, *changes_path} {
+		if len(path) == 0 {
+			continue
+		}
+		if e := inetdata.WriteMTBLBloom(path); e != nil {
+			inetdata.Log.Errorf("%s", e)
+			os.Exit(1)
+		}
+	}
+
+	for _, path := range []string{fname, *changes_path} {
+		if len(path) == 0 {
+			continue
+		}
+		if e := inetdata.WriteMTBLMeta("inetdata-mtbl-delta", path); e != nil {
+			inetdata.Log.Errorf("%s", e)
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/mtbl"
+	"io"
+	"os"
+	"runtime"
+	"sync/atomic"
+)
+
+var input_count int64 = 0
+var output_count int64 = 0
+
+// The key transforms, applied in this order
+var ip_key = "none"
+var reverse_key = false
+var reverse_labels = false
+
+// Write every Nth record
+var sample_every int64 = 1
+
+var output_jsonl = false
+var csv_writer *csv.Writer
+var output io.Writer
+
+type OutputJSON struct {
+	Key string      `json:"key"`
+	Val interface{} `json:"val"`
+}
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <mtbl> ... <mtbl>")
+	fmt.Println("")
+	fmt.Println("Exports the records of one or more MTBL databases as key,value CSV or, with -format jsonl,")
+	fmt.Println("as {\"key\": ..., \"val\": ...} lines where values that are JSON are embedded as-is. The")
+	fmt.Println("databases are written one after another, each in key order.")
+	fmt.Println("")
+	fmt.Println("Keys are written as stored unless transformed: with -ip-key binary or hex, encoded IP")
+	fmt.Println("address keys (see csv2mtbl and dns2mtbl) are decoded, and with -R or -L the reversed keys")
+	fmt.Println("of dns2mtbl or *2mtbl -L are restored to hostnames. -prefix matches the stored keys, and")
+	fmt.Println("-range-start/-range-end take IP addresses with -ip-key.")
+	fmt.Println("")
+	fmt.Println("With -sample N, only every Nth matching record is written, for a quick look at a large")
+	fmt.Println("database. -limit stops after that many records have been written.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+// Convert a stored key for output
+func outputKey(key_bytes []byte) string {
+	key := string(key_bytes)
+
+	if ip_key != "none" {
+		if ip, ok := inetdata.DecodeIPKey(key_bytes, ip_key); ok {
+			return ip.String()
+		}
+	}
+
+	if reverse_key {
+		key = inetdata.ReverseKey(key)
+	}
+
+	if reverse_labels {
+		key = inetdata.ReverseLabels(key)
+	}
+
+	return key
+}
+
+func writeRecord(key_bytes []byte, val_bytes []byte) error {
+	key := outputKey(key_bytes)
+
+	if !output_jsonl {
+		return csv_writer.Write([]string{key, string(val_bytes)})
+	}
+
+	// Values that are not JSON encoded are written as strings
+	var v interface{}
+	if de := json.Unmarshal(val_bytes, &v); de != nil {
+		v = string(val_bytes)
+	}
+
+	b, e := json.Marshal(OutputJSON{Key: key, Val: v})
+	if e != nil {
+		inetdata.Log.Warnf("Could not marshal %q: %s", key, e)
+		return nil
+	}
+	_, e = output.Write(append(b, '\n'))
+	return e
+}
+
+// Write the sampled records of an iterator until it ends or the limit is hit
+func dump(it *mtbl.Iter, limit int64) error {
+	defer it.Destroy()
+
+	for !inetdata.Interrupted() {
+		if limit > 0 && atomic.LoadInt64(&output_count) >= limit {
+			return nil
+		}
+
+		key_bytes, val_bytes, ok := it.Next()
+		if !ok {
+			return nil
+		}
+
+		n := atomic.AddInt64(&input_count, 1)
+		if (n-1)%sample_every != 0 {
+			continue
+		}
+
+		if e := writeRecord(key_bytes, val_bytes); e != nil {
+			return e
+		}
+		atomic.AddInt64(&output_count, 1)
+	}
+	return nil
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+
+	format := flag.String("format", "csv", "The output format: csv or jsonl")
+	prefix := flag.String("prefix", "", "Only export keys with this prefix")
+	range_start := flag.String("range-start", "", "Only export keys greater than or equal to this value (requires -range-end)")
+	range_end := flag.String("range-end", "", "Only export keys less than or equal to this value (requires -range-start)")
+	selected_ip_key := flag.String("ip-key", "none", "Decode IP address keys in this encoding: none, binary, or hex")
+	rev_key := flag.Bool("R", false, "Write keys in reverse form, such as the hostname keys of dns2mtbl")
+	rev_labels := flag.Bool("L", false, "Write keys with their domain labels in reverse order (com.example.www -> www.example.com)")
+	sample := flag.Int64("sample", 1, "Only export every Nth record")
+	limit := flag.Int64("limit", 0, "Stop after exporting this many records (0 exports all)")
+	output_path := flag.String("output", "", "Write to this file instead of stdout")
+	output_compression := flag.String("output-compression", "none", "The output compression: none, gzip, zstd, or lz4")
+	compression_level := flag.Int("compression-level", -1, "The output compression level, -1 uses the default for the codec")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddOutputFlags()
+	inetdata.AddMetaFlags()
+	inetdata.AddRequireMetaFlags()
+
+	inetdata.ParseFlags("inetdata-mtbl-dump")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-mtbl-dump")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-mtbl-dump")
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if len(flag.Args()) == 0 {
+		usage()
+		os.Exit(1)
+	}
+
+	switch *format {
+	case "csv":
+		output_jsonl = false
+	case "jsonl":
+		output_jsonl = true
+	default:
+		inetdata.Log.Errorf("Invalid output format specified: %s", *format)
+		usage()
+		os.Exit(1)
+	}
+
+	if *rev_key && *rev_labels {
+		inetdata.Log.Errorf("Only one of -R or -L can be specified")
+		usage()
+		os.Exit(1)
+	}
+
+	if (len(*range_start) > 0) != (len(*range_end) > 0) {
+		inetdata.Log.Errorf("Both -range-start and -range-end must be specified")
+		usage()
+		os.Exit(1)
+	}
+
+	if len(*range_start) > 0 && len(*prefix) > 0 {
+		inetdata.Log.Errorf("Only one of -prefix or -range-start/-range-end can be specified")
+		usage()
+		os.Exit(1)
+	}
+
+	if *sample < 1 {
+		inetdata.Log.Errorf("-sample must be at least 1")
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidIPKeyFormat(*selected_ip_key) {
+		inetdata.Log.Errorf("Invalid IP key format specified: %s", *selected_ip_key)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidOutputCompression(*output_compression) {
+		inetdata.Log.Errorf("Invalid output compression specified: %s", *output_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	ip_key = *selected_ip_key
+	reverse_key = *rev_key
+	reverse_labels = *rev_labels
+	sample_every = *sample
+
+	// Convert IP address ranges to the encoded key format
+	if ip_key != "none" {
+		for _, v := range []*string{range_start, range_end} {
+			if len(*v) == 0 {
+				continue
+			}
+			enc, e := inetdata.EncodeIPKeyString(*v, ip_key)
+			if e != nil {
+				inetdata.Log.Errorf("%s", e)
+				os.Exit(1)
+			}
+			*v = string(enc)
+		}
+	}
+
+	readers := []*mtbl.Reader{}
+	for _, path := range flag.Args() {
+		if e := inetdata.CheckDatasetMeta(path); e != nil {
+			inetdata.Log.Errorf("%s", e)
+			os.Exit(1)
+		}
+		if e := inetdata.AddMetaSource(path); e != nil {
+			inetdata.Log.Errorf("Failed to read %s: %s", path, e)
+			os.Exit(1)
+		}
+
+		r, e := mtbl.ReaderInit(path, &mtbl.ReaderOptions{VerifyChecksums: true})
+		if e != nil {
+			inetdata.Log.Errorf("Failed to read %s: %s", path, e)
+			os.Exit(1)
+		}
+		defer r.Destroy()
+		readers = append(readers, r)
+	}
+
+	if !inetdata.ValidMetaOutput(*output_path) {
+		inetdata.Log.Errorf("-meta requires -output with a local file")
+		usage()
+		os.Exit(1)
+	}
+
+	dest, de := inetdata.CreateOutput(*output_path)
+	if de != nil {
+		inetdata.Log.Errorf("%s", de)
+		os.Exit(1)
+	}
+
+	w, oe := inetdata.NewOutputWriter(dest, *output_compression, *compression_level)
+	if oe != nil {
+		inetdata.Log.Errorf("%s", oe)
+		os.Exit(1)
+	}
+	output = w
+	csv_writer = csv.NewWriter(w)
+
+	progress := inetdata.NewProgress("inetdata-mtbl-dump", &input_count, &output_count)
+	progress.Format = *progress_format
+
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	exit_code := 0
+
+	for _, r := range readers {
+		var it *mtbl.Iter
+		switch {
+		case len(*prefix) > 0:
+			it = mtbl.IterPrefix(r, []byte(*prefix))
+		case len(*range_start) > 0:
+			it = mtbl.IterRange(r, []byte(*range_start), []byte(*range_end))
+		default:
+			it = mtbl.IterAll(r)
+		}
+
+		if e := dump(it, *limit); e != nil {
+			inetdata.Log.Warnf("Failed to write output: %s", e)
+			exit_code = 1
+			break
+		}
+	}
+
+	csv_writer.Flush()
+	if e := csv_writer.Error(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+		exit_code = 1
+	}
+
+	if e := w.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+		exit_code = 1
+	}
+
+	if e := dest.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+		exit_code = 1
+	}
+
+	quit <- 0
+
+	if exit_code != 0 {
+		os.Exit(exit_code)
+	}
+
+	inetdata.ExitIfInterrupted(*output_path)
+
+	if e := inetdata.WriteDatasetMeta("inetdata-mtbl-dump", *output_path, output_count); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+}
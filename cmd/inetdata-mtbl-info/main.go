@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/mtblfile"
+	"os"
+	"runtime"
+)
+
+type BlockStats struct {
+	MinStored       uint64 `json:"min_stored"`
+	MaxStored       uint64 `json:"max_stored"`
+	MinUncompressed uint64 `json:"min_uncompressed"`
+	MaxUncompressed uint64 `json:"max_uncompressed"`
+	AvgUncompressed uint64 `json:"avg_uncompressed"`
+}
+
+type OutputJSON struct {
+	Path             string      `json:"path"`
+	Size             uint64      `json:"size"`
+	FormatVersion    int         `json:"format_version"`
+	Compression      string      `json:"compression"`
+	Entries          uint64      `json:"entries"`
+	DataBlocks       uint64      `json:"data_blocks"`
+	DataBlockSize    uint64      `json:"data_block_size"`
+	BytesDataBlocks  uint64      `json:"bytes_data_blocks"`
+	BytesIndexBlock  uint64      `json:"bytes_index_block"`
+	BytesKeys        uint64      `json:"bytes_keys"`
+	BytesValues      uint64      `json:"bytes_values"`
+	FirstKey         string      `json:"first_key"`
+	LastKey          string      `json:"last_key"`
+	Blocks           *BlockStats `json:"blocks,omitempty"`
+	Verified         bool        `json:"verified"`
+	Error            string      `json:"error,omitempty"`
+	CompressionRatio float64     `json:"compression_ratio,omitempty"`
+}
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <mtbl> ... <mtbl>")
+	fmt.Println("")
+	fmt.Println("Prints the metadata of MTBL databases: the entry and block counts, sizes, compression,")
+	fmt.Println("and the first and last keys. The file is read directly, so libmtbl is not required.")
+	fmt.Println("")
+	fmt.Println("Unless -verify=false is set, every data block is also read to verify its checksum, that")
+	fmt.Println("the keys are unique and sorted, and that the blocks agree with the index and metadata,")
+	fmt.Println("which also reports the sizes of the data blocks. The exit code is 1 if any database")
+	fmt.Println("fails to open or verify, so it can gate publishing a build.")
+	fmt.Println("")
+	fmt.Println("With -json, each database is written as a single line of JSON.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+// Read the metadata of a database and optionally verify it
+func inspect(path string, verify bool) OutputJSON {
+	o := OutputJSON{Path: path}
+
+	r, e := mtblfile.Open(path, true)
+	if e != nil {
+		o.Error = e.Error()
+		return o
+	}
+	defer r.Close()
+
+	m := r.Metadata
+	o.Size = r.Size()
+	o.FormatVersion = m.FileVersion
+	o.Compression = m.CompressionName()
+	o.Entries = m.CountEntries
+	o.DataBlocks = m.CountDataBlocks
+	o.DataBlockSize = m.DataBlockSize
+	o.BytesDataBlocks = m.BytesDataBlocks
+	o.BytesIndexBlock = m.BytesIndexBlock
+	o.BytesKeys = m.BytesKeys
+	o.BytesValues = m.BytesValues
+
+	if !verify {
+		first, last, e := r.KeyRange()
+		if e != nil {
+			o.Error = e.Error()
+		}
+		o.FirstKey, o.LastKey = string(first), string(last)
+		return o
+	}
+
+	s, e := r.Verify()
+	o.FirstKey, o.LastKey = string(s.FirstKey), string(s.LastKey)
+	if s.DataBlocks > 0 {
+		o.Blocks = &BlockStats{
+			MinStored:       s.MinStoredBlock,
+			MaxStored:       s.MaxStoredBlock,
+			MinUncompressed: s.MinUncompressedBlock,
+			MaxUncompressed: s.MaxUncompressedBlock,
+			AvgUncompressed: s.BytesUncompressed / s.DataBlocks,
+		}
+	}
+	if m.BytesDataBlocks > 0 {
+		o.CompressionRatio = float64(s.BytesUncompressed) / float64(m.BytesDataBlocks)
+	}
+
+	if e != nil {
+		o.Error = e.Error()
+		return o
+	}
+	o.Verified = true
+	return o
+}
+
+func writeText(o OutputJSON, verify bool) {
+	fmt.Printf("%s:\n", o.Path)
+	if o.Size == 0 {
+		fmt.Printf("  error:             %s\n", o.Error)
+		return
+	}
+
+	fmt.Printf("  size:              %d bytes\n", o.Size)
+	fmt.Printf("  format version:    %d\n", o.FormatVersion)
+	fmt.Printf("  compression:       %s\n", o.Compression)
+	fmt.Printf("  entries:           %d\n", o.Entries)
+	fmt.Printf("  data blocks:       %d\n", o.DataBlocks)
+	fmt.Printf("  data block size:   %d\n", o.DataBlockSize)
+	fmt.Printf("  data block bytes:  %d\n", o.BytesDataBlocks)
+	fmt.Printf("  index block bytes: %d\n", o.BytesIndexBlock)
+	fmt.Printf("  key bytes:         %d\n", o.BytesKeys)
+	fmt.Printf("  value bytes:       %d\n", o.BytesValues)
+	fmt.Printf("  first key:         %q\n", o.FirstKey)
+	fmt.Printf("  last key:          %q\n", o.LastKey)
+
+	if o.Blocks != nil {
+		fmt.Printf("  stored blocks:     %d to %d bytes\n", o.Blocks.MinStored, o.Blocks.MaxStored)
+		fmt.Printf("  blocks:            %d to %d bytes, %d on average\n", o.Blocks.MinUncompressed, o.Blocks.MaxUncompressed, o.Blocks.AvgUncompressed)
+	}
+	if o.CompressionRatio > 0 {
+		fmt.Printf("  compression ratio: %.2f\n", o.CompressionRatio)
+	}
+
+	switch {
+	case len(o.Error) > 0:
+		fmt.Printf("  error:             %s\n", o.Error)
+	case verify:
+		fmt.Printf("  verified:          ok\n")
+	}
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+
+	verify := flag.Bool("verify", true, "Read every block to verify the checksums, key order, index, and metadata")
+	as_json := flag.Bool("json", false, "Print each database as a single line of JSON")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.ParseFlags("inetdata-mtbl-info")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-mtbl-info")
+		os.Exit(0)
+	}
+
+	if len(flag.Args()) == 0 {
+		usage()
+		os.Exit(1)
+	}
+
+	exit_code := 0
+
+	for _, path := range flag.Args() {
+		o := inspect(path, *verify)
+		if len(o.Error) > 0 {
+			exit_code = 1
+		}
+
+		if !*as_json {
+			writeText(o, *verify)
+			continue
+		}
+
+		b, e := json.Marshal(o)
+		if e != nil {
+			inetdata.Log.Warnf("Could not marshal %s: %s", path, e)
+			exit_code = 1
+			continue
+		}
+		fmt.Println(string(b))
+	}
+
+	os.Exit(exit_code)
+}
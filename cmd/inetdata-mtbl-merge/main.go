@@ -0,0 +1,361 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/mtbl"
+	"github.com/fathom6/inetdata-parsers/mtblfile"
+	"github.com/fathom6/inetdata-parsers/mtblutil"
+	"os"
+	"plugin"
+	"runtime"
+	"sync/atomic"
+	"text/template"
+)
+
+const MERGE_MODE_CONCAT = 0
+const MERGE_MODE_NEWEST = 1
+const MERGE_MODE_ALL = 2
+const MERGE_MODE_TEMPLATE = 3
+const MERGE_MODE_PLUGIN = 4
+
+var merge_modes = map[string]int{
+	"concat":   MERGE_MODE_CONCAT,
+	"newest":   MERGE_MODE_NEWEST,
+	"all":      MERGE_MODE_ALL,
+	"template": MERGE_MODE_TEMPLATE,
+	"plugin":   MERGE_MODE_PLUGIN,
+}
+
+var merge_count int64 = 0
+var input_count int64 = 0
+var output_count int64 = 0
+
+var merge_plugin func(key []byte, vals [][]byte) []byte
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <output.mtbl> <input.mtbl> ... <input.mtbl>")
+	fmt.Println("")
+	fmt.Println("Merges one or more MTBL databases into a new MTBL database. Values for duplicate keys")
+	fmt.Println("are merged using the selected mode:")
+	fmt.Println("")
+	fmt.Println("  concat   : join all values with the separator (-s)")
+	fmt.Println("  newest   : keep the value with the highest timestamp, read from the JSON field set by -ts-field")
+	fmt.Println("  all      : emit a JSON array containing every value (applied to unique keys as well)")
+	fmt.Println("  template : render a Go text/template (-template) with .Key and .Values")
+	fmt.Println("  plugin   : call the exported Merge(key []byte, vals [][]byte) []byte in a Go plugin (-plugin)")
+	fmt.Println("")
+	fmt.Println("With -shards, the output is written as that many MTBL files, <base>-NNNNN.mtbl, listed in")
+	fmt.Println("the manifest <base>.shards.json given as the output. Keys are assigned to the shards by")
+	fmt.Println("-shard-by:")
+	fmt.Println("")
+	fmt.Println("  hash   : the FNV-1a hash of the key modulo -shards")
+	fmt.Println("  prefix : consecutive key ranges of about the same number of keys, so that prefix and")
+	fmt.Println("           subdomain scans read few shards")
+	fmt.Println("")
+	fmt.Println("The query tools and inetdata-serve accept the manifest in place of a MTBL file and route")
+	fmt.Println("each lookup to its shard.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+func mergePlugin(key []byte, vals [][]byte) ([]byte, error) {
+	return merge_plugin(key, vals), nil
+}
+
+func loadPlugin(path string) error {
+	p, e := plugin.Open(path)
+	if e != nil {
+		return e
+	}
+
+	sym, e := p.Lookup("Merge")
+	if e != nil {
+		return e
+	}
+
+	fn, ok := sym.(func([]byte, [][]byte) []byte)
+	if !ok {
+		return fmt.Errorf("%s: Merge has type %T, expected func([]byte, [][]byte) []byte", path, sym)
+	}
+
+	merge_plugin = fn
+	return nil
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+
+	selected_merge_mode := flag.String("M", "concat", "The merge mode: concat, newest, all, template, or plugin")
+	separator := flag.String("s", "\\x00", "The separator to use with the concat merge mode")
+	timestamp_field := flag.String("ts-field", "timestamp", "The JSON field holding the timestamp for the newest merge mode")
+	template_text := flag.String("template", "", "The Go text/template to use with the template merge mode")
+	plugin_path := flag.String("plugin", "", "The Go plugin (.so) to use with the plugin merge mode")
+	compression := flag.String("c", "snappy", "The compression type to use (none, snappy, zlib, lz4, lz4hc, zstd)")
+	block_size := flag.Uint64("b", 0, "The MTBL block size in bytes, 0 uses the library default")
+	shard_count := flag.Int("shards", 0, "Write the output as this many MTBL shards and a manifest, the output must end in .shards.json")
+	shard_by := flag.String("shard-by", "hash", "The sharding mode for -shards: hash or prefix")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddBloomFlags()
+	inetdata.AddMetaFlags()
+	inetdata.AddRequireMetaFlags()
+
+	inetdata.ParseFlags("inetdata-mtbl-merge")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-mtbl-merge")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-mtbl-merge")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidBloomFPR(inetdata.BloomFPR) {
+		inetdata.Log.Errorf("Invalid Bloom filter false positive rate specified: %v", inetdata.BloomFPR)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if len(flag.Args()) < 2 {
+		usage()
+		os.Exit(1)
+	}
+
+	if *shard_count < 0 {
+		inetdata.Log.Errorf("-shards must not be negative")
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidShardMode(*shard_by) {
+		inetdata.Log.Errorf("Invalid sharding mode specified: %s", *shard_by)
+		usage()
+		os.Exit(1)
+	}
+
+	merge_mode, ok := merge_modes[*selected_merge_mode]
+	if !ok {
+		inetdata.Log.Errorf("Invalid merge mode specified: %s", *selected_merge_mode)
+		usage()
+		os.Exit(1)
+	}
+
+	var merge mtblutil.ValuesMergeFunc
+
+	switch merge_mode {
+	case MERGE_MODE_CONCAT:
+		merge = mtblutil.Concat([]byte(inetdata.UnescapeDelimiter(*separator)))
+
+	case MERGE_MODE_NEWEST:
+		merge = mtblutil.Newest(*timestamp_field)
+
+	case MERGE_MODE_ALL:
+		merge = mtblutil.All
+
+	case MERGE_MODE_TEMPLATE:
+		if len(*template_text) == 0 {
+			inetdata.Log.Errorf("The template merge mode requires -template")
+			os.Exit(1)
+		}
+		t, e := template.New("merge").Parse(*template_text)
+		if e != nil {
+			inetdata.Log.Errorf("Invalid template: %s", e)
+			os.Exit(1)
+		}
+		merge = mtblutil.Template(t)
+
+	case MERGE_MODE_PLUGIN:
+		if len(*plugin_path) == 0 {
+			inetdata.Log.Errorf("The plugin merge mode requires -plugin")
+			os.Exit(1)
+		}
+		if e := loadPlugin(*plugin_path); e != nil {
+			inetdata.Log.Errorf("Could not load plugin: %s", e)
+			os.Exit(1)
+		}
+		merge = mergePlugin
+	}
+
+	compression_alg, ok := inetdata.MTBLCompressionTypes[*compression]
+	if !ok {
+		inetdata.Log.Errorf("Invalid compression algorithm: %s", *compression)
+		os.Exit(1)
+	}
+
+	fname := flag.Args()[0]
+	inputs := flag.Args()[1:]
+
+	for i := range inputs {
+		if inputs[i] == fname {
+			inetdata.Log.Errorf("The output file can not also be an input: %s", fname)
+			os.Exit(1)
+		}
+	}
+
+	iters := []mtblutil.Iterator{}
+	for i := range inputs {
+		if e := inetdata.CheckDatasetMeta(inputs[i]); e != nil {
+			inetdata.Log.Errorf("%s", e)
+			os.Exit(1)
+		}
+		if e := inetdata.AddMetaSource(inputs[i]); e != nil {
+			inetdata.Log.Errorf("Failed to read %s: %s", inputs[i], e)
+			os.Exit(1)
+		}
+
+		r, e := mtbl.ReaderInit(inputs[i], &mtbl.ReaderOptions{VerifyChecksums: true})
+		if e != nil {
+			inetdata.Log.Errorf("Failed to read %s: %s", inputs[i], e)
+			os.Exit(1)
+		}
+		defer r.Destroy()
+
+		iters = append(iters, mtbl.IterAll(r))
+	}
+	merger := mtblutil.NewMerger(iters)
+
+	_ = os.Remove(fname)
+
+	w_opt := mtbl.WriterOptions{Compression: compression_alg}
+	if *block_size > 0 {
+		w_opt.BlockSize = *block_size
+	}
+
+	var w *mtbl.Writer
+	var sw *inetdata.MTBLShardWriter
+	var add func(key []byte, val []byte) error
+
+	if *shard_count > 0 {
+		// Prefix shards are sized from the entries of the inputs
+		var entries uint64
+		if *shard_by == inetdata.SHARD_BY_PREFIX {
+			for i := range inputs {
+				r, e := mtblfile.Open(inputs[i], false)
+				if e != nil {
+					inetdata.Log.Errorf("Failed to read %s: %s", inputs[i], e)
+					os.Exit(1)
+				}
+				entries += r.Metadata.CountEntries
+				r.Close()
+			}
+		}
+
+		var we error
+		sw, we = inetdata.NewMTBLShardWriter(fname, *shard_by, *shard_count, entries, w_opt)
+		if we != nil {
+			inetdata.Log.Errorf("%s", we)
+			os.Exit(1)
+		}
+		add = sw.Add
+	} else {
+		var we error
+		w, we = mtbl.WriterInit(fname, &w_opt)
+		if we != nil {
+			inetdata.Log.Errorf("%s", we)
+			os.Exit(1)
+		}
+		add = w.Add
+	}
+
+	progress := inetdata.NewProgress("inetdata-mtbl-merge", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.AddCounter("merged", &merge_count)
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	exit_code := 0
+
+	for !inetdata.Interrupted() {
+		key, vals, ok := merger.Next()
+		if !ok {
+			break
+		}
+		atomic.AddInt64(&input_count, int64(len(vals)))
+
+		val := vals[0]
+		if len(vals) > 1 || merge_mode == MERGE_MODE_ALL {
+			atomic.AddInt64(&merge_count, 1)
+			merged, e := merge(key, vals)
+			if e != nil {
+				inetdata.Log.Warnf("Failed to merge key=%q: %s", key, e)
+				exit_code = 1
+				continue
+			}
+			val = merged
+		}
+
+		if e := add(key, val); e != nil {
+			inetdata.Log.Warnf("Failed to add key=%q: %s", key, e)
+			exit_code = 1
+			continue
+		}
+		atomic.AddInt64(&output_count, 1)
+	}
+
+	quit <- 0
+
+	outputs := []string{fname}
+
+	switch {
+	case sw == nil:
+		w.Destroy()
+
+	case inetdata.Interrupted():
+		sw.Destroy()
+		outputs = append(outputs, sw.Paths()...)
+
+	default:
+		if e := sw.Close(); e != nil {
+			inetdata.Log.Errorf("%s", e)
+			exit_code = 1
+		}
+		outputs = sw.Paths()
+	}
+
+	if exit_code != 0 {
+		os.Exit(exit_code)
+	}
+
+	inetdata.ExitIfInterrupted(outputs...)
+
+	for _, path := range outputs {
+		if e := inetdata.WriteMTBLBloom(path); e != nil {
+			inetdata.Log.Errorf("%s", e)
+			os.Exit(1)
+		}
+	}
+
+	if e := inetdata.WriteMTBLMeta("inetdata-mtbl-merge", fname); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/dnsname"
+	"github.com/fathom6/inetdata-parsers/mtbl"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+)
+
+var output_count int64 = 0
+var input_count int64 = 0
+var invalid_count int64 = 0
+
+// The number of keys seen before, in the state or in -seen-mtbl
+var seen_count int64 = 0
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] -state <dir> [<input> ... <input>]")
+	fmt.Println("")
+	fmt.Println("Reads records and writes only those whose key was never seen before, such as the newly")
+	fmt.Println("observed domains of a daily zone, CT, or FDNS feed. The keys that were seen are kept in")
+	fmt.Println("the -state directory across runs, exactly or as a Bloom filter with -filter bloom, and")
+	fmt.Println("the keys of each run are added once its output is written.")
+	fmt.Println("")
+	fmt.Println("The key is the field -k of each line, or the whole line for inputs such as hostname lists.")
+	fmt.Println("With -normalize, keys are normalized as hostnames and invalid names are rejected. Keys in")
+	fmt.Println("the MTBL files of -seen-mtbl, such as a historical dataset, also count as seen, looked up")
+	fmt.Println("in reverse form with -R or with reversed labels with -L.")
+	fmt.Println("")
+	fmt.Println("With -no-update, the new records are written without adding their keys to the state.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	state_dir := flag.String("state", "", "The directory of the set of seen keys, created if it does not exist")
+	filter := flag.String("filter", "exact", "The kind of seen set: exact, or bloom to use less memory and drop a fraction of new keys")
+	capacity := flag.Uint64("capacity", 100000000, "The number of keys to size a new -filter bloom for")
+	fpr := flag.Float64("fpr", 0.001, "The false positive rate of a new -filter bloom")
+	no_update := flag.Bool("no-update", false, "Write the new records without adding their keys to the state")
+	index_key := flag.Int("k", 0, "The field index to use as the key, or 0 for the whole line")
+	normalized := flag.Bool("normalize", false, "Normalize keys as hostnames and reject invalid names")
+	seen_mtbl := flag.String("seen-mtbl", "", "Also treat the keys of these comma-separated MTBL files as seen")
+	rev_key := flag.Bool("R", false, "Look up keys in -seen-mtbl in reverse form, for databases built with the default key form")
+	rev_labels := flag.Bool("L", false, "Look up keys in -seen-mtbl with the domain labels in reverse order")
+	delimiter := flag.String("d", ",", "The delimiter to use as a field separator")
+	csv_strict := flag.Bool("csv-strict", false, "Parse the input as RFC 4180 CSV, allowing quoted fields that contain the delimiter")
+	csv_quote := flag.String("csv-quote", "\"", "The quote character for -csv-strict")
+	csv_escape := flag.String("csv-escape", "", "The escape character for quotes in -csv-strict fields (defaults to doubling the quote)")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-newkeys")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-newkeys")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-newkeys")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if len(*state_dir) == 0 {
+		inetdata.Log.Errorf("The -state directory is required")
+		usage()
+		os.Exit(1)
+	}
+
+	if *index_key < 0 {
+		inetdata.Log.Errorf("Invalid key index specified: %d", *index_key)
+		usage()
+		os.Exit(1)
+	}
+
+	if *rev_key && *rev_labels {
+		inetdata.Log.Errorf("Only one of -R and -L can be used")
+		usage()
+		os.Exit(1)
+	}
+
+	splitter, fe := inetdata.NewFieldSplitter(inetdata.UnescapeDelimiter(*delimiter), *csv_strict, *csv_quote, *csv_escape)
+	if fe != nil {
+		inetdata.Log.Errorf("%s", fe)
+		usage()
+		os.Exit(1)
+	}
+
+	seen, se := inetdata.OpenDedupSet(*state_dir, *filter, *capacity, *fpr)
+	if se != nil {
+		inetdata.Log.Errorf("Failed to open the state in %s: %s", *state_dir, se)
+		os.Exit(1)
+	}
+	inetdata.Log.Infof("Loaded %d seen keys from %s", seen.Len(), *state_dir)
+
+	readers := []*mtbl.Reader{}
+	for _, path := range strings.Split(*seen_mtbl, ",") {
+		if len(path) == 0 {
+			continue
+		}
+		r, e := mtbl.ReaderInit(path, &mtbl.ReaderOptions{VerifyChecksums: true})
+		if e != nil {
+			inetdata.Log.Errorf("Failed to open %s: %s", path, e)
+			os.Exit(1)
+		}
+		defer r.Destroy()
+		readers = append(readers, r)
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args(), *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	progress := inetdata.NewProgress("inetdata-newkeys", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.Errors = &invalid_count
+	progress.AddCounter("seen", &seen_count)
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	w, we := inetdata.CreateOutput("")
+	if we != nil {
+		inetdata.Log.Errorf("%s", we)
+		os.Exit(1)
+	}
+
+	// Return true if a key is in one of the -seen-mtbl files
+	inMTBL := func(key string) bool {
+		switch {
+		case *rev_key:
+			key = dnsname.Reverse(key)
+		case *rev_labels:
+			key = dnsname.ReverseLabels(key)
+		}
+		for _, r := range readers {
+			if _, ok := mtbl.Get(r, []byte(key)); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	// The keys are checked in input order by one reader, so that the first
+	// record of a new key is the one written
+	c_inp := make(chan string, inetdata.QueueDepth)
+	done := make(chan bool)
+	progress.AddStage("input", func() int { return len(c_inp) })
+
+	// With -no-update the keys of this run are tracked in memory only
+	run, _ := inetdata.OpenDedupSet("", "exact", 0, 0)
+
+	go func() {
+		for line := range c_inp {
+			raw := strings.TrimRight(line, "\r")
+			if len(raw) == 0 {
+				continue
+			}
+
+			atomic.AddInt64(&input_count, 1)
+
+			key := raw
+			if *index_key > 0 {
+				bits, e := splitter.Split(raw, *index_key+1)
+				if e != nil || len(bits) < *index_key {
+					atomic.AddInt64(&invalid_count, 1)
+					inetdata.Rejects.Reject(inetdata.REJECT_MISSING_FIELD, raw)
+					continue
+				}
+				key = bits[*index_key-1]
+			}
+
+			if *normalized {
+				n, e := dnsname.Normalize(key)
+				if e != nil {
+					atomic.AddInt64(&invalid_count, 1)
+					inetdata.Rejects.Reject(inetdata.REJECT_INVALID_NAME, raw)
+					continue
+				}
+				key = n
+			}
+
+			if len(key) == 0 {
+				atomic.AddInt64(&invalid_count, 1)
+				inetdata.Rejects.Reject(inetdata.REJECT_MISSING_FIELD, raw)
+				continue
+			}
+
+			is_new := false
+			if *no_update {
+				is_new = !seen.Contains([]byte(key)) && run.Add([]byte(key))
+			} else {
+				is_new = seen.Add([]byte(key))
+			}
+
+			if !is_new || inMTBL(key) {
+				atomic.AddInt64(&seen_count, 1)
+				continue
+			}
+
+			io.WriteString(w, raw+"\n")
+			atomic.AddInt64(&output_count, 1)
+		}
+		done <- true
+	}()
+
+	e := inetdata.ReadLinesFromInputs(inputs, *input_compression, progress.CountReader, c_inp)
+	if e != nil {
+		inetdata.Log.Warnf("Failed to read input: %s", e)
+	}
+	<-done
+
+	failed := false
+	if e := w.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+		failed = true
+	}
+
+	quit <- 0
+
+	// The keys are saved once their records are written, so that a failed
+	// write does not hide them from the next run
+	if !failed && !*no_update {
+		if e := seen.Save(); e != nil {
+			inetdata.Log.Errorf("Failed to save the state in %s: %s", *state_dir, e)
+			failed = true
+		} else {
+			inetdata.Log.Infof("Wrote %d new keys, %d keys are now in %s", output_count, seen.Len(), *state_dir)
+		}
+	}
+
+	inetdata.CloseRejects()
+
+	if failed {
+		os.Exit(1)
+	}
+
+	inetdata.ExitIfInterrupted()
+	inetdata.CheckErrorBudget(input_count)
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/dnsname"
+	"github.com/miekg/dns"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var output_count int64 = 0
+var input_count int64 = 0
+var invalid_count int64 = 0
+
+// The number of hashes loaded and cracked
+var hash_count int64 = 0
+var cracked_count int64 = 0
+
+var wg sync.WaitGroup
+
+// The length of an NSEC3 hash in base32hex
+const NSEC3_HASH_LENGTH = 32
+
+// A zone and NSEC3 parameters, with the hashed owner labels to crack
+type nsec3Zone struct {
+	zone       string
+	iterations uint16
+	salt       string
+	hashes     map[string]bool
+}
+
+// The zones to crack, by zone and parameters
+var zones = map[string]*nsec3Zone{}
+var zone_list []*nsec3Zone
+
+// The hashes that were cracked, by owner name
+var cracked = map[string]bool{}
+var cracked_lock sync.Mutex
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] -hashes <file> [<wordlist> ... <wordlist>]")
+	fmt.Println("")
+	fmt.Println("Recovers the names behind the hashed owner names of NSEC3 signed zones. The hashes are")
+	fmt.Println("read from the -hashes file, which is either the output of inetdata-zone2csv, where the")
+	fmt.Println("owner and next hashes of the nsec3 records are used with their zone, iterations, and salt,")
+	fmt.Println("or a list of hashes or hashed owner names with the parameters given by -zone, -iterations,")
+	fmt.Println("and -salt.")
+	fmt.Println("")
+	fmt.Println("The candidates are read from the wordlists, or stdin, one per line, and hashed on every")
+	fmt.Println("core. A candidate within a zone (ex: www.example.com for example.com) is hashed as it is,")
+	fmt.Println("and any other candidate is taken as labels under the zone (ex: www -> www.example.com),")
+	fmt.Println("so that both label wordlists and hostname datasets can be used. Each cracked hash is")
+	fmt.Println("written once as owner,name.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+// Return a hash in lowercase base32hex, or an empty string if it is invalid
+func normalizeHash(hash string) string {
+	hash = strings.ToLower(hash)
+	if len(hash) != NSEC3_HASH_LENGTH {
+		return ""
+	}
+	for _, c := range hash {
+		if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'v')) {
+			return ""
+		}
+	}
+	return hash
+}
+
+// Add a hash to the set of a zone and parameters
+func addHash(zone string, iterations uint16, salt string, hash string) {
+	if salt == "-" {
+		salt = ""
+	}
+
+	key := fmt.Sprintf("%s/%d/%s", zone, iterations, salt)
+	z, ok := zones[key]
+	if !ok {
+		z = &nsec3Zone{zone: zone, iterations: iterations, salt: salt, hashes: map[string]bool{}}
+		zones[key] = z
+		zone_list = append(zone_list, z)
+	}
+
+	if !z.hashes[hash] {
+		z.hashes[hash] = true
+		hash_count++
+	}
+}
+
+// Split a hashed owner name into its hash and zone
+func splitOwner(owner string) (string, string) {
+	bits := strings.SplitN(dnsname.TrimDots(strings.ToLower(owner)), ".", 2)
+	if len(bits) == 1 {
+		return normalizeHash(bits[0]), ""
+	}
+	return normalizeHash(bits[0]), bits[1]
+}
+
+// Load the hashes of the nsec3 records in inetdata-zone2csv output, or of a
+// list of hashes with the default parameters
+func loadHashes(r io.Reader, zone string, iterations uint16, salt string) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 8*1024*1024)
+
+	for scanner.Scan() {
+		raw := strings.TrimSpace(scanner.Text())
+		if len(raw) == 0 {
+			continue
+		}
+
+		bits := strings.SplitN(raw, ",", 3)
+
+		// A hash or a hashed owner name, with the default parameters
+		if len(bits) == 1 {
+			hash, owner_zone := splitOwner(raw)
+			if len(owner_zone) == 0 {
+				owner_zone = zone
+			}
+			if len(hash) == 0 || len(owner_zone) == 0 {
+				inetdata.Rejects.Reject(inetdata.REJECT_INVALID_ENTRY, raw)
+				atomic.AddInt64(&invalid_count, 1)
+				continue
+			}
+			addHash(owner_zone, iterations, salt, hash)
+			continue
+		}
+
+		if len(bits) != 3 || bits[1] != "nsec3" {
+			continue
+		}
+
+		// The value is: hash algorithm, flags, iterations, salt, next hash, types
+		fields := strings.Fields(bits[2])
+		hash, owner_zone := splitOwner(bits[0])
+		if len(fields) < 5 || len(hash) == 0 || len(owner_zone) == 0 {
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_ENTRY, raw)
+			atomic.AddInt64(&invalid_count, 1)
+			continue
+		}
+
+		// SHA-1 is the only NSEC3 hash algorithm
+		if fields[0] != strconv.Itoa(int(dns.SHA1)) {
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_ENTRY, raw)
+			atomic.AddInt64(&invalid_count, 1)
+			continue
+		}
+
+		iter, e := strconv.ParseUint(fields[2], 10, 16)
+		next := normalizeHash(fields[4])
+		if e != nil || len(next) == 0 {
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_ENTRY, raw)
+			atomic.AddInt64(&invalid_count, 1)
+			continue
+		}
+
+		addHash(owner_zone, uint16(iter), fields[3], hash)
+		addHash(owner_zone, uint16(iter), fields[3], next)
+	}
+
+	return scanner.Err()
+}
+
+// Return the name to hash for a candidate in a zone
+func candidateName(candidate string, zone string) string {
+	if candidate == zone || strings.HasSuffix(candidate, "."+zone) {
+		return candidate
+	}
+	return candidate + "." + zone
+}
+
+func inputParser(c chan string, o chan string) {
+	for r := range c {
+		if inetdata.Interrupted() {
+			continue
+		}
+
+		candidate := dnsname.TrimDots(strings.ToLower(strings.TrimSpace(r)))
+		if len(candidate) == 0 {
+			continue
+		}
+
+		atomic.AddInt64(&input_count, 1)
+
+		for _, z := range zone_list {
+			name := candidateName(candidate, z.zone)
+			hash := strings.ToLower(dns.HashName(dns.Fqdn(name), dns.SHA1, z.iterations, z.salt))
+			if len(hash) == 0 {
+				inetdata.Rejects.Reject(inetdata.REJECT_INVALID_NAME, r)
+				atomic.AddInt64(&invalid_count, 1)
+				break
+			}
+
+			if !z.hashes[hash] {
+				continue
+			}
+
+			owner := hash + "." + z.zone
+			cracked_lock.Lock()
+			found := cracked[owner]
+			cracked[owner] = true
+			cracked_lock.Unlock()
+
+			if !found {
+				atomic.AddInt64(&cracked_count, 1)
+				o <- owner + "," + name + "\n"
+			}
+		}
+	}
+	wg.Done()
+}
+
+func outputWriter(w io.Writer, o chan string, done chan bool) {
+	for r := range o {
+		io.WriteString(w, r)
+		atomic.AddInt64(&output_count, 1)
+	}
+	done <- true
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	hashes_path := flag.String("hashes", "", "The NSEC3 records from inetdata-zone2csv, or a list of hashes, to crack")
+	zone := flag.String("zone", "", "The zone of hashes listed without their zone")
+	iterations := flag.Uint("iterations", 0, "The NSEC3 iterations of listed hashes")
+	salt := flag.String("salt", "-", "The NSEC3 salt of listed hashes in hex, or - for none")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the wordlists matching this glob pattern, in lexical order (ex: 'words-*.txt.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-nsec3crack")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-nsec3crack")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-nsec3crack")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if len(*hashes_path) == 0 {
+		inetdata.Log.Errorf("The -hashes file is required")
+		usage()
+		os.Exit(1)
+	}
+
+	if *iterations > 65535 {
+		inetdata.Log.Errorf("Invalid iterations specified: %d", *iterations)
+		usage()
+		os.Exit(1)
+	}
+
+	if *salt != "-" {
+		if _, e := hex.DecodeString(*salt); e != nil {
+			inetdata.Log.Errorf("Invalid salt specified: %s", *salt)
+			usage()
+			os.Exit(1)
+		}
+	}
+
+	hr, he := inetdata.OpenInputs([]string{*hashes_path}, *input_compression, nil)
+	if he != nil {
+		inetdata.Log.Errorf("%s", he)
+		os.Exit(1)
+	}
+	if e := loadHashes(hr, dnsname.TrimDots(strings.ToLower(*zone)), uint16(*iterations), *salt); e != nil {
+		inetdata.Log.Errorf("Failed to read %s: %s", *hashes_path, e)
+		os.Exit(1)
+	}
+	if c, ok := hr.(io.Closer); ok {
+		c.Close()
+	}
+
+	if hash_count == 0 {
+		inetdata.Log.Errorf("No NSEC3 hashes were found in %s", *hashes_path)
+		os.Exit(1)
+	}
+	inetdata.Log.Infof("Loaded %d hashes in %d zones from %s", hash_count, len(zone_list), *hashes_path)
+
+	inputs, ie := inetdata.InputPaths(flag.Args(), *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	progress := inetdata.NewProgress("inetdata-nsec3crack", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.Errors = &invalid_count
+	progress.AddCounter("cracked", &cracked_count)
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	w, we := inetdata.CreateOutput("")
+	if we != nil {
+		inetdata.Log.Errorf("%s", we)
+		os.Exit(1)
+	}
+
+	// Write output
+	c_out := make(chan string, inetdata.QueueDepth)
+	done := make(chan bool)
+	go outputWriter(w, c_out, done)
+
+	// Hash the candidates on every worker
+	c_inp := make(chan string, inetdata.QueueDepth)
+	progress.AddStage("input", func() int { return len(c_inp) })
+
+	for i := 0; i < inetdata.Workers; i++ {
+		go inputParser(c_inp, c_out)
+		wg.Add(1)
+	}
+
+	// Reader closes c_inp on completion
+	e := inetdata.ReadLinesFromInputs(inputs, *input_compression, progress.CountReader, c_inp)
+	if e != nil {
+		inetdata.Log.Warnf("Failed to read input: %s", e)
+	}
+
+	wg.Wait()
+	close(c_out)
+	<-done
+
+	if e := w.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+	}
+
+	quit <- 0
+
+	inetdata.Log.Infof("Cracked %d of %d hashes", cracked_count, hash_count)
+
+	inetdata.CloseRejects()
+
+	inetdata.ExitIfInterrupted()
+	inetdata.CheckErrorBudget(input_count)
+}
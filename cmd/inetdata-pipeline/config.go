@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The config of a pipeline, read from YAML or JSON
+type config struct {
+	// The directory the commands run in, relative to the config file
+	Workdir string `yaml:"workdir"`
+
+	// The parent of the temporary directory of each job
+	Tmpdir string `yaml:"tmpdir"`
+
+	// The checkpoint file of completed jobs, relative to the workdir
+	State string `yaml:"state"`
+
+	// Variables that may be used in the commands, inputs, and outputs
+	Vars map[string]string `yaml:"vars"`
+
+	// Environment variables set for every command
+	Env map[string]string `yaml:"env"`
+
+	Stages []*stage `yaml:"stages"`
+}
+
+// A stage runs a shell command once, or once for each input file
+type stage struct {
+	Name string `yaml:"name"`
+	Run  string `yaml:"run"`
+
+	// The stages that must complete first, by default the previous stage
+	After []string `yaml:"after"`
+
+	// Glob patterns of the input files, matched when the stage starts
+	Inputs []string `yaml:"inputs"`
+
+	// The files written by each job, which must exist once it completes
+	Outputs []string `yaml:"outputs"`
+
+	// The number of inputs processed at once
+	Jobs int `yaml:"jobs"`
+
+	// The -workers of the inetdata tools, set with INETDATA_WORKERS
+	Workers int `yaml:"workers"`
+
+	// Environment variables set for the commands of this stage
+	Env map[string]string `yaml:"env"`
+
+	// Closed once the stage has finished, and whether it completed
+	done chan bool
+	ok   bool
+}
+
+var stage_name = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Read and validate a config file. YAML is a superset of JSON, so both are
+// parsed by the YAML decoder.
+func loadConfig(path string) (*config, error) {
+	fd, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer fd.Close()
+
+	cfg := &config{}
+	dec := yaml.NewDecoder(fd)
+	dec.KnownFields(true)
+	if e := dec.Decode(cfg); e != nil {
+		return nil, fmt.Errorf("invalid config %s: %s", path, e)
+	}
+
+	// Variables may refer to the environment, but not to each other
+	for k, v := range cfg.Vars {
+		cfg.Vars[k] = os.ExpandEnv(v)
+	}
+
+	if len(cfg.Workdir) == 0 {
+		cfg.Workdir = "."
+	}
+	cfg.Workdir = os.ExpandEnv(cfg.Workdir)
+	if !filepath.IsAbs(cfg.Workdir) {
+		cfg.Workdir = filepath.Join(filepath.Dir(path), cfg.Workdir)
+	}
+
+	if len(cfg.Tmpdir) == 0 {
+		cfg.Tmpdir = os.TempDir()
+	}
+	cfg.Tmpdir = os.ExpandEnv(cfg.Tmpdir)
+
+	if len(cfg.State) == 0 {
+		cfg.State = ".inetdata-pipeline.json"
+	}
+
+	if len(cfg.Stages) == 0 {
+		return nil, fmt.Errorf("invalid config %s: no stages", path)
+	}
+
+	seen := map[string]bool{}
+	for i, s := range cfg.Stages {
+		if !stage_name.MatchString(s.Name) {
+			return nil, fmt.Errorf("invalid config %s: stage %d has an invalid name: %q", path, i+1, s.Name)
+		}
+		if seen[s.Name] {
+			return nil, fmt.Errorf("invalid config %s: duplicate stage %s", path, s.Name)
+		}
+		if len(strings.TrimSpace(s.Run)) == 0 {
+			return nil, fmt.Errorf("invalid config %s: stage %s has no command", path, s.Name)
+		}
+
+		// Dependencies must be listed earlier, which rules out cycles
+		if s.After == nil && i > 0 {
+			s.After = []string{cfg.Stages[i-1].Name}
+		}
+		for _, dep := range s.After {
+			if !seen[dep] {
+				return nil, fmt.Errorf("invalid config %s: stage %s runs after %s, which is not an earlier stage", path, s.Name, dep)
+			}
+		}
+
+		if s.Jobs == 0 {
+			s.Jobs = 1
+		}
+		if s.Jobs < 0 || s.Workers < 0 {
+			return nil, fmt.Errorf("invalid config %s: stage %s has a negative jobs or workers", path, s.Name)
+		}
+		seen[s.Name] = true
+	}
+
+	return cfg, nil
+}
+
+// Return the stages that depend on a stage, directly or not, including itself
+func (cfg *config) dependents(name string) map[string]bool {
+	res := map[string]bool{name: true}
+	for _, s := range cfg.Stages {
+		for _, dep := range s.After {
+			if res[dep] {
+				res[s.Name] = true
+			}
+		}
+	}
+	return res
+}
+
+var variable = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Expand the ${name} variables of a command or path. The job variables come
+// first, then the config variables. Other names, and the $name form, are
+// left for the shell.
+func (cfg *config) expand(s string, vars map[string]string) string {
+	return variable.ReplaceAllStringFunc(s, func(m string) string {
+		name := m[2 : len(m)-1]
+		if v, ok := vars[name]; ok {
+			return v
+		}
+		if v, ok := cfg.Vars[name]; ok {
+			return v
+		}
+		return m
+	})
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var jobs_run int64 = 0
+var jobs_skipped int64 = 0
+var jobs_failed int64 = 0
+
+var dry_run = false
+
+// The checkpoint key of a job, its stage and its input
+func jobKey(s *stage, input string) string {
+	return s.Name + "/" + input
+}
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <config>")
+	fmt.Println("")
+	fmt.Println("Runs the stages of a pipeline, such as fetch, parse, rollup, and MTBL builds, from a")
+	fmt.Println("YAML or JSON config. Each stage is a shell command, run once, or once for each file")
+	fmt.Println("matching its inputs, with up to jobs of them at a time. A stage starts once the")
+	fmt.Println("stages it runs after have completed, by default the previous stage, so that")
+	fmt.Println("independent stages run in parallel.")
+	fmt.Println("")
+	fmt.Println("Completed jobs are recorded in a state file in the workdir. After a failure or an")
+	fmt.Println("interrupt, running the pipeline again skips them and resumes with the rest, and")
+	fmt.Println("a pipeline that has completed only runs the jobs of new input files. Each job gets")
+	fmt.Println("its own temporary directory, as ${tmpdir} and TMPDIR, which is removed afterwards.")
+	fmt.Println("")
+	fmt.Println("Example config:")
+	fmt.Println("")
+	fmt.Println("  workdir: /data/fdns")
+	fmt.Println("  tmpdir: /data/tmp")
+	fmt.Println("  vars:")
+	fmt.Println("    date: 2025-10-01")
+	fmt.Println("  stages:")
+	fmt.Println("    - name: fetch")
+	fmt.Println("      run: inetdata-fetch -o ${date}-fdns_a.json.gz https://example.com/${date}-fdns_a.json.gz")
+	fmt.Println("      outputs: [\"${date}-fdns_a.json.gz\"]")
+	fmt.Println("    - name: split")
+	fmt.Println("      inputs: [\"*-fdns_a.json.gz\"]")
+	fmt.Println("      run: inetdata-sonardnsv2-split ${stem} ${input}")
+	fmt.Println("      workers: 8")
+	fmt.Println("    - name: mtbl")
+	fmt.Println("      inputs: [\"*-names.gz\"]")
+	fmt.Println("      run: pigz -dc ${input} | inetdata-dns2mtbl -t ${tmpdir} ${stem}.mtbl")
+	fmt.Println("      outputs: [\"${stem}.mtbl\"]")
+	fmt.Println("      jobs: 2")
+	fmt.Println("")
+	fmt.Println("The commands, inputs, outputs, and env of a stage may use the vars of the config and")
+	fmt.Println("${stage}, ${workdir}, ${tmpdir}, and for each input, ${input}, ${name} (its file name),")
+	fmt.Println("and ${stem} (its file name up to the first dot). Other ${...} variables and the $var")
+	fmt.Println("form are left to the shell.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+// Run a job and record it in the checkpoint once it completes
+func runJob(cfg *config, s *stage, input string, cp *inetdata.Checkpoint) bool {
+	key := jobKey(s, input)
+	label := strings.TrimSuffix(key, "/")
+
+	vars := map[string]string{
+		"stage":   s.Name,
+		"workdir": cfg.Workdir,
+		"tmpdir":  cfg.Tmpdir,
+	}
+	if len(input) > 0 {
+		name := filepath.Base(input)
+		vars["input"] = input
+		vars["name"] = name
+		vars["stem"] = strings.SplitN(name, ".", 2)[0]
+	}
+
+	outputs := []string{}
+	for _, o := range s.Outputs {
+		outputs = append(outputs, cfg.expand(o, vars))
+	}
+
+	// A completed job is run again if its outputs have since been removed
+	if _, ok := cp.Offset(key); ok && missingOutput(outputs) == "" {
+		atomic.AddInt64(&jobs_skipped, 1)
+		return true
+	}
+
+	if dry_run {
+		fmt.Println(cfg.expand(s.Run, vars))
+		atomic.AddInt64(&jobs_run, 1)
+		return true
+	}
+
+	tmp, e := ioutil.TempDir(cfg.Tmpdir, "inetdata-pipeline-"+s.Name+"-")
+	if e != nil {
+		inetdata.Log.Warnf("%s failed: %s", label, e)
+		atomic.AddInt64(&jobs_failed, 1)
+		return false
+	}
+	defer os.RemoveAll(tmp)
+	vars["tmpdir"] = tmp
+
+	env := os.Environ()
+	for k, v := range cfg.Env {
+		env = append(env, k+"="+cfg.expand(v, vars))
+	}
+	for k, v := range s.Env {
+		env = append(env, k+"="+cfg.expand(v, vars))
+	}
+	if s.Workers > 0 {
+		env = append(env, "INETDATA_WORKERS="+strconv.Itoa(s.Workers))
+	}
+	env = append(env, "TMPDIR="+tmp)
+
+	cmd := exec.Command("sh", "-c", cfg.expand(s.Run, vars))
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// The commands get a single interrupt from the pipeline, see forwardInterrupt
+	inetdata.DetachSignals(cmd)
+
+	inetdata.Log.Infof("Starting %s", label)
+	start := time.Now()
+
+	if e := cmd.Start(); e != nil {
+		inetdata.Log.Warnf("%s failed: %s", label, e)
+		atomic.AddInt64(&jobs_failed, 1)
+		return false
+	}
+
+	done := make(chan bool)
+	go forwardInterrupt(cmd, done)
+	e = cmd.Wait()
+	close(done)
+
+	elapsed := time.Since(start).Seconds()
+	if e == nil {
+		if missing := missingOutput(outputs); len(missing) > 0 {
+			e = fmt.Errorf("the output %s was not written", missing)
+		}
+	}
+	if e != nil {
+		inetdata.Log.Warnf("%s failed after %.1fs: %s", label, elapsed, e)
+		atomic.AddInt64(&jobs_failed, 1)
+		return false
+	}
+
+	cp.SetOffset(key, time.Now().Unix())
+	if e := cp.Commit(); e != nil {
+		inetdata.Log.Warnf("Failed to write the state file: %s", e)
+		atomic.AddInt64(&jobs_failed, 1)
+		return false
+	}
+
+	inetdata.Log.Infof("Completed %s in %.1fs", label, elapsed)
+	atomic.AddInt64(&jobs_run, 1)
+	return true
+}
+
+// Send an interrupt to the process group of a command once the pipeline is
+// interrupted, so that the tools finish the records they have read
+func forwardInterrupt(cmd *exec.Cmd, done chan bool) {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if inetdata.Interrupted() {
+				syscall.Kill(-cmd.Process.Pid, syscall.SIGINT)
+				return
+			}
+		}
+	}
+}
+
+// Return the first output that does not exist
+func missingOutput(outputs []string) string {
+	for _, o := range outputs {
+		if _, e := os.Stat(o); e != nil {
+			return o
+		}
+	}
+	return ""
+}
+
+// Run the jobs of a stage, up to s.Jobs at a time. Once a job fails, no more
+// jobs are started, and the stage fails after the running jobs finish.
+func runStage(cfg *config, s *stage, cp *inetdata.Checkpoint) bool {
+	inputs := []string{}
+	for _, pattern := range s.Inputs {
+		pattern = cfg.expand(pattern, nil)
+		paths, e := inetdata.InputPaths(nil, pattern)
+		if e != nil && dry_run {
+			// The inputs of later stages do not exist before a dry run
+			fmt.Printf("# %s: the inputs %s are matched when the stage runs\n", s.Name, pattern)
+			continue
+		}
+		if e != nil {
+			inetdata.Log.Warnf("%s failed: %s", s.Name, e)
+			atomic.AddInt64(&jobs_failed, 1)
+			return false
+		}
+		inputs = append(inputs, paths...)
+	}
+	if len(s.Inputs) == 0 {
+		inputs = append(inputs, "")
+	}
+
+	c_inputs := make(chan string)
+	var failed int32 = 0
+	var stage_wg sync.WaitGroup
+
+	for i := 0; i < s.Jobs; i++ {
+		stage_wg.Add(1)
+		go func() {
+			defer stage_wg.Done()
+			for input := range c_inputs {
+				if atomic.LoadInt32(&failed) == 1 || inetdata.Interrupted() {
+					continue
+				}
+				if !runJob(cfg, s, input, cp) {
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+
+	for _, input := range inputs {
+		c_inputs <- input
+	}
+	close(c_inputs)
+	stage_wg.Wait()
+
+	return atomic.LoadInt32(&failed) == 0 && !inetdata.Interrupted()
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	from := flag.String("from", "", "Run this stage, and the stages that depend on it, again")
+	restart := flag.Bool("restart", false, "Ignore the state file and run every stage again")
+	flag.BoolVar(&dry_run, "dry-run", false, "Print the commands of the jobs that would run, without running them")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.ParseFlags("inetdata-pipeline")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-pipeline")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-pipeline")
+
+	if len(flag.Args()) != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	cfg, e := loadConfig(flag.Args()[0])
+	if e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if len(*from) > 0 {
+		found := false
+		for _, s := range cfg.Stages {
+			found = found || s.Name == *from
+		}
+		if !found {
+			inetdata.Log.Errorf("Unknown stage: %s", *from)
+			usage()
+			os.Exit(1)
+		}
+	}
+
+	if e := os.MkdirAll(cfg.Workdir, 0755); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+	if e := os.Chdir(cfg.Workdir); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+	if e := os.MkdirAll(cfg.Tmpdir, 0755); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	cp, e := inetdata.LoadCheckpoint(cfg.State)
+	if e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+	if *restart {
+		cp.ClearOffsets("")
+	}
+	if len(*from) > 0 {
+		for name := range cfg.dependents(*from) {
+			cp.ClearOffsets(name + "/")
+		}
+	}
+
+	// The progress counts the completed jobs
+	progress := inetdata.NewProgress("inetdata-pipeline", &jobs_run, nil)
+	progress.Format = *progress_format
+	progress.Unit = "jobs"
+	progress.Errors = &jobs_failed
+	progress.AddCounter("skipped", &jobs_skipped)
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	start := time.Now()
+
+	// Each stage waits for the stages it runs after, and is skipped if any
+	// of them failed
+	stages := map[string]*stage{}
+	for _, s := range cfg.Stages {
+		s.done = make(chan bool)
+		stages[s.Name] = s
+	}
+
+	var wg sync.WaitGroup
+	for _, s := range cfg.Stages {
+		wg.Add(1)
+		go func(s *stage) {
+			defer wg.Done()
+			defer close(s.done)
+
+			for _, dep := range s.After {
+				<-stages[dep].done
+				if !stages[dep].ok {
+					inetdata.Log.Warnf("Skipping %s, since %s did not complete", s.Name, dep)
+					return
+				}
+			}
+			s.ok = runStage(cfg, s, cp)
+		}(s)
+	}
+	wg.Wait()
+
+	quit <- 0
+
+	if inetdata.Interrupted() {
+		inetdata.Log.Infof("Interrupted, run the pipeline again to resume")
+		os.Exit(inetdata.EXIT_INTERRUPTED)
+	}
+
+	inetdata.Log.Infof("Ran %d jobs, skipped %d completed jobs, and %d failed in %.1fs",
+		jobs_run, jobs_skipped, jobs_failed, time.Since(start).Seconds())
+
+	if jobs_failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/dnsname"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var output_count int64 = 0
+var input_count int64 = 0
+var invalid_count int64 = 0
+var wg sync.WaitGroup
+
+// Quotes the fields of every output
+var splitter *inetdata.FieldSplitter
+
+// The outputs, see output_keys
+var domains, nameservers, entities, domain_entities *inetdata.SortedOutput
+
+var output_keys = []string{"domains", "nameservers", "entities", "domain-entities"}
+
+// The search result arrays of RDAP search responses
+var search_results = []string{"domainSearchResults", "nameserverSearchResults", "entitySearchResults"}
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <base> [<input> ... <input>]")
+	fmt.Println("")
+	fmt.Println("Reads RDAP JSON responses, one per line, and writes four sorted and deduplicated CSVs:")
+	fmt.Println("")
+	fmt.Println("  <base>-domains.csv.gz         : domain,handle,registrar,registrar_id,created,expires,")
+	fmt.Println("                                  updated,status,nameservers")
+	fmt.Println("  <base>-nameservers.csv.gz     : name,handle,ipv4,ipv6")
+	fmt.Println("  <base>-entities.csv.gz        : handle,roles,kind,name,org,email,phone,country,address")
+	fmt.Println("  <base>-domain-entities.csv.gz : domain,role,handle,name,org,email,country")
+	fmt.Println("")
+	fmt.Println("Domain, nameserver, and entity objects are read, including the results of searches and")
+	fmt.Println("the entities and nameservers nested in other objects. The vCard of each entity is")
+	fmt.Println("flattened into its name, organization, email, phone, country, and address, and entities")
+	fmt.Println("without a handle, such as redacted registrants, are only written as domain-entities.")
+	fmt.Println("Dates are written as YYYY-MM-DD, and lists are separated by semicolons.")
+	fmt.Println("")
+	fmt.Println("Error responses and lines that are not RDAP objects are skipped, and written to the")
+	fmt.Println("-rejects file.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+func reject(reason string, line string) {
+	atomic.AddInt64(&invalid_count, 1)
+	inetdata.Rejects.Reject(reason, line)
+}
+
+// Return a string member of an object
+func str(obj map[string]interface{}, key string) string {
+	s, _ := obj[key].(string)
+	return clean(s)
+}
+
+// Return the objects of an array member of an object
+func objects(obj map[string]interface{}, key string) []map[string]interface{} {
+	res := []map[string]interface{}{}
+	arr, _ := obj[key].([]interface{})
+	for _, v := range arr {
+		if o, ok := v.(map[string]interface{}); ok {
+			res = append(res, o)
+		}
+	}
+	return res
+}
+
+// Return the strings of an array member of an object
+func strs(obj map[string]interface{}, key string) []string {
+	res := []string{}
+	arr, _ := obj[key].([]interface{})
+	for _, v := range arr {
+		if s, ok := v.(string); ok && len(clean(s)) > 0 {
+			res = append(res, clean(s))
+		}
+	}
+	return res
+}
+
+// Return the name of an object, lowercased and encoded as punycode
+func objectName(obj map[string]interface{}) (string, bool) {
+	name := str(obj, "ldhName")
+	if len(name) == 0 {
+		name = str(obj, "unicodeName")
+	}
+	n, e := dnsname.Normalize(name)
+	return n, e == nil && len(n) > 0
+}
+
+// Return the date of the first event with the action as YYYY-MM-DD
+func eventDate(obj map[string]interface{}, action string) string {
+	for _, ev := range objects(obj, "events") {
+		if !strings.EqualFold(str(ev, "eventAction"), action) {
+			continue
+		}
+		if t, e := time.Parse(time.RFC3339, str(ev, "eventDate")); e == nil {
+			return t.UTC().Format("2006-01-02")
+		}
+	}
+	return ""
+}
+
+// Return the identifier of the public ID of the type
+func publicID(obj map[string]interface{}, id_type string) string {
+	for _, id := range objects(obj, "publicIds") {
+		if strings.EqualFold(str(id, "type"), id_type) {
+			return str(id, "identifier")
+		}
+	}
+	return ""
+}
+
+// Return the addresses of a nameserver that are valid
+func nameserverAddresses(obj map[string]interface{}, family string) []string {
+	addrs, _ := obj["ipAddresses"].(map[string]interface{})
+	res := []string{}
+	for _, a := range strs(addrs, family) {
+		if ip := net.ParseIP(a); ip != nil {
+			res = append(res, ip.String())
+		}
+	}
+	return res
+}
+
+// Write a nameserver and return its name
+func parseNameserver(obj map[string]interface{}) (string, bool) {
+	name, ok := objectName(obj)
+	if !ok {
+		return "", false
+	}
+	nameservers.Add(splitter.Join(
+		name,
+		str(obj, "handle"),
+		strings.Join(nameserverAddresses(obj, "v4"), ";"),
+		strings.Join(nameserverAddresses(obj, "v6"), ";")))
+	return name, true
+}
+
+// Write an entity and the entities nested in it, calling found for each
+func parseEntity(obj map[string]interface{}, found func(map[string]interface{}, vcard)) {
+	card := parseVCard(obj["vcardArray"])
+	if handle := str(obj, "handle"); len(handle) > 0 {
+		entities.Add(splitter.Join(
+			handle,
+			strings.Join(strs(obj, "roles"), ";"),
+			card.Kind,
+			card.Name,
+			card.Org,
+			card.Email,
+			card.Phone,
+			card.Country,
+			card.Address))
+	}
+	if found != nil {
+		found(obj, card)
+	}
+
+	for _, nested := range objects(obj, "entities") {
+		parseEntity(nested, found)
+	}
+}
+
+func parseDomain(obj map[string]interface{}) bool {
+	domain, ok := objectName(obj)
+	if !ok {
+		return false
+	}
+
+	registrar, registrar_id := "", ""
+	link := func(ent map[string]interface{}, card vcard) {
+		for _, role := range strs(ent, "roles") {
+			role = strings.ToLower(role)
+			if role == "registrar" && len(registrar) == 0 {
+				registrar = card.Name
+				if len(registrar) == 0 {
+					registrar = card.Org
+				}
+				registrar_id = publicID(ent, "IANA Registrar ID")
+			}
+			domain_entities.Add(splitter.Join(domain, role, str(ent, "handle"), card.Name, card.Org, card.Email, card.Country))
+		}
+	}
+	for _, ent := range objects(obj, "entities") {
+		parseEntity(ent, link)
+	}
+
+	ns := []string{}
+	for _, n := range objects(obj, "nameservers") {
+		if name, ok := parseNameserver(n); ok {
+			ns = append(ns, name)
+		}
+	}
+
+	domains.Add(splitter.Join(
+		domain,
+		str(obj, "handle"),
+		registrar,
+		registrar_id,
+		eventDate(obj, "registration"),
+		eventDate(obj, "expiration"),
+		eventDate(obj, "last changed"),
+		strings.ToLower(strings.Join(strs(obj, "status"), ";")),
+		strings.Join(ns, ";")))
+	return true
+}
+
+// Parse an RDAP object, returning false if it is not one
+func parseObject(obj map[string]interface{}) bool {
+	switch strings.ToLower(str(obj, "objectClassName")) {
+	case "domain":
+		return parseDomain(obj)
+	case "nameserver":
+		for _, ent := range objects(obj, "entities") {
+			parseEntity(ent, nil)
+		}
+		_, ok := parseNameserver(obj)
+		return ok
+	case "entity":
+		parseEntity(obj, nil)
+		return true
+	case "":
+		return false
+	}
+
+	// Other objects, such as IP networks and autnums, are skipped
+	return true
+}
+
+func inputParser(c <-chan string) {
+	defer wg.Done()
+
+	for r := range c {
+		raw := strings.TrimSpace(r)
+		if len(raw) == 0 {
+			continue
+		}
+
+		obj := map[string]interface{}{}
+		if e := json.Unmarshal([]byte(raw), &obj); e != nil {
+			reject(inetdata.REJECT_INVALID_JSON, raw)
+			continue
+		}
+
+		if _, ok := obj["errorCode"]; ok {
+			reject(inetdata.REJECT_INVALID_ENTRY, raw)
+			continue
+		}
+
+		atomic.AddInt64(&input_count, 1)
+
+		found := false
+		for _, key := range search_results {
+			if _, ok := obj[key]; !ok {
+				continue
+			}
+			found = true
+			for _, res := range objects(obj, key) {
+				if !parseObject(res) {
+					reject(inetdata.REJECT_INVALID_ENTRY, raw)
+				}
+			}
+		}
+
+		if !found && !parseObject(obj) {
+			reject(inetdata.REJECT_INVALID_ENTRY, raw)
+		}
+	}
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
+	sort_mem := flag.Uint64("sort-mem", 1, "The maximum amount of memory to use, in gigabytes, for the sorting phase of each output")
+	output_compression := flag.String("output-compression", "gzip", "The output compression: none, gzip, zstd, or lz4")
+	compression_level := flag.Int("compression-level", -1, "The output compression level, -1 uses the default for the codec")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'rdap-*.json.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddJSONSampleFlags("ldhName,handle")
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-rdap2csv")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-rdap2csv")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-rdap2csv")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidOutputCompression(*output_compression) {
+		inetdata.Log.Errorf("Invalid output compression specified: %s", *output_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	splitter, _ = inetdata.NewFieldSplitter(",", true, "\"", "")
+
+	if len(flag.Args()) < 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args()[1:], *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	if len(*sort_tmp) == 0 {
+		*sort_tmp = os.Getenv("HOME")
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	base := flag.Args()[0]
+	ext := ".csv" + inetdata.OutputCompressionExtension(*output_compression)
+	out_names := []string{}
+
+	outputs := []*inetdata.SortedOutput{}
+	for _, key := range output_keys {
+		name := base + "-" + key + ext
+		o, e := inetdata.NewSortedOutput(name, *output_compression, *compression_level, *sort_tmp, *sort_mem*1024*1024*1024, &output_count)
+		if e != nil {
+			inetdata.Log.Errorf("failed to create %s: %s", name, e)
+			os.Exit(1)
+		}
+		outputs = append(outputs, o)
+		out_names = append(out_names, name)
+	}
+	domains, nameservers, entities, domain_entities = outputs[0], outputs[1], outputs[2], outputs[3]
+
+	progress := inetdata.NewProgress("inetdata-rdap2csv", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.Errors = &invalid_count
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	// Parse the inputs
+	c_inp := make(chan string, inetdata.QueueDepth)
+	progress.AddStage("input", func() int { return len(c_inp) })
+
+	for i := 0; i < inetdata.Workers; i++ {
+		go inputParser(c_inp)
+		wg.Add(1)
+	}
+
+	// Reader closes c_inp on completion
+	e := inetdata.ReadLinesFromInputs(inputs, *input_compression, progress.CountReader, c_inp)
+	if e != nil {
+		inetdata.Log.Warnf("Failed to read input: %s", e)
+	}
+
+	wg.Wait()
+
+	// The sorters write their output once their input is closed
+	failed := false
+	for _, o := range outputs {
+		if e := o.Close(); e != nil {
+			inetdata.Log.Warnf("Failed to write %s: %s", o.Path, e)
+			failed = true
+		}
+	}
+
+	quit <- 0
+
+	inetdata.CloseRejects()
+
+	if failed {
+		os.Exit(1)
+	}
+
+	inetdata.ExitIfInterrupted(out_names...)
+	inetdata.CheckErrorBudget(input_count)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"strings"
+)
+
+// The flattened properties of a jCard (RFC 7095), the vcardArray of an RDAP
+// entity
+type vcard struct {
+	Kind    string
+	Name    string
+	Org     string
+	Email   string
+	Phone   string
+	Address string
+	Country string
+}
+
+// Return a string from a value, joining the strings of arrays with separator
+func flatValue(v interface{}, sep string) string {
+	switch t := v.(type) {
+	case string:
+		return clean(t)
+	case []interface{}:
+		bits := []string{}
+		for _, e := range t {
+			if s := flatValue(e, " "); len(s) > 0 {
+				bits = append(bits, s)
+			}
+		}
+		return strings.Join(bits, sep)
+	}
+	return ""
+}
+
+// Collapse the whitespace of a value, including newlines, so that it stays on
+// one line of the output
+func clean(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// Flatten a vcardArray: ["vcard", [[name, params, type, value], ...]]. The
+// first value of each property is kept, except that a property with a "pref"
+// parameter of 1 takes precedence.
+func parseVCard(v interface{}) vcard {
+	var card vcard
+
+	arr, ok := v.([]interface{})
+	if !ok || len(arr) < 2 {
+		return card
+	}
+	props, ok := arr[1].([]interface{})
+	if !ok {
+		return card
+	}
+
+	set := func(field *string, value string, params map[string]interface{}) {
+		if len(value) == 0 {
+			return
+		}
+		if len(*field) == 0 || flatValue(params["pref"], "") == "1" {
+			*field = value
+		}
+	}
+
+	for _, p := range props {
+		prop, ok := p.([]interface{})
+		if !ok || len(prop) < 4 {
+			continue
+		}
+		name, _ := prop[0].(string)
+		params, _ := prop[1].(map[string]interface{})
+		values := prop[3:]
+
+		switch strings.ToLower(name) {
+		case "kind":
+			set(&card.Kind, strings.ToLower(flatValue(values, " ")), params)
+		case "fn":
+			set(&card.Name, flatValue(values, " "), params)
+		case "org":
+			set(&card.Org, flatValue(values, " "), params)
+		case "email":
+			set(&card.Email, strings.ToLower(flatValue(values, " ")), params)
+		case "tel":
+			set(&card.Phone, strings.TrimPrefix(flatValue(values, " "), "tel:"), params)
+		case "adr":
+			set(&card.Address, vcardAddress(values, params), params)
+			set(&card.Country, vcardCountry(values, params), params)
+		}
+	}
+	return card
+}
+
+// Return an address from its label parameter, or its components: the post
+// office box, extended address, street, locality, region, postal code, and
+// country name
+func vcardAddress(values []interface{}, params map[string]interface{}) string {
+	if label := flatValue(params["label"], " "); len(label) > 0 {
+		return label
+	}
+	if len(values) == 0 {
+		return ""
+	}
+	parts, ok := values[0].([]interface{})
+	if !ok {
+		return flatValue(values[0], " ")
+	}
+	bits := []string{}
+	for _, part := range parts {
+		if s := flatValue(part, " "); len(s) > 0 {
+			bits = append(bits, s)
+		}
+	}
+	return strings.Join(bits, ", ")
+}
+
+// Return the country of an address: the ISO 3166 code of the cc parameter
+// (RFC 8605), or the country name component
+func vcardCountry(values []interface{}, params map[string]interface{}) string {
+	if cc := flatValue(params["cc"], ""); len(cc) > 0 {
+		return strings.ToUpper(cc)
+	}
+	if len(values) == 0 {
+		return ""
+	}
+	if parts, ok := values[0].([]interface{}); ok && len(parts) == 7 {
+		return flatValue(parts[6], " ")
+	}
+	return ""
+}
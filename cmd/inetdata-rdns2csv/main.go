@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/dnsname"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var output_count int64 = 0
+var input_count int64 = 0
+var invalid_count int64 = 0
+var wg sync.WaitGroup
+
+var ip_key = "hex"
+var collapse_arpa bool
+var normalize bool
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <base> [<input> ... <input>]")
+	fmt.Println("")
+	fmt.Println("Reads a Sonar RDNS (PTR) JSONL dataset and writes two sorted and deduplicated CSVs:")
+	fmt.Println("<base>-ptr.csv.gz with ip,name lines and <base>-ptr-inverse.csv.gz with name,ip lines.")
+	fmt.Println("")
+	fmt.Println("The IP keys of the ptr output are encoded with -ip-key. The default hex encoding sorts")
+	fmt.Println("addresses numerically, IPv4 before IPv6, so that the output can be merged and looked up")
+	fmt.Println("by range; inetdata-mtbl-dump -ip-key hex decodes them. With -ip-key none, addresses are")
+	fmt.Println("written as text and sort lexically. The inverse output always has textual addresses.")
+	fmt.Println("")
+	fmt.Println("Records are keyed by IP address. With -collapse-arpa, in-addr.arpa and ip6.arpa names")
+	fmt.Println("(4.3.2.1.in-addr.arpa) are converted to their addresses, otherwise records whose name")
+	fmt.Println("is not an address are rejected. Records of types other than ptr are skipped.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+func inputParser(c <-chan string, ptr *inetdata.SortedOutput, inverse *inetdata.SortedOutput) {
+	defer wg.Done()
+
+	for r := range c {
+		raw := strings.TrimSpace(r)
+		if len(raw) == 0 {
+			continue
+		}
+
+		mapped := map[string]string{}
+		if e := json.Unmarshal([]byte(raw), &mapped); e != nil {
+			atomic.AddInt64(&invalid_count, 1)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_JSON, raw)
+			continue
+		}
+
+		name, has_name := mapped["name"]
+		value, has_value := mapped["value"]
+		if !has_name || !has_value {
+			atomic.AddInt64(&invalid_count, 1)
+			inetdata.Rejects.Reject(inetdata.REJECT_MISSING_FIELD, raw)
+			continue
+		}
+
+		if rtype, ok := mapped["type"]; ok && strings.ToLower(strings.TrimSpace(rtype)) != "ptr" {
+			continue
+		}
+
+		atomic.AddInt64(&input_count, 1)
+
+		name = strings.TrimSpace(name)
+		ip := net.ParseIP(name)
+		if ip == nil && collapse_arpa {
+			ip, _ = dnsname.ParseArpa(name)
+		}
+		if ip == nil {
+			atomic.AddInt64(&invalid_count, 1)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_NAME, raw)
+			continue
+		}
+
+		host := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(value), "."))
+		if normalize {
+			n, e := dnsname.Normalize(host)
+			if e != nil {
+				atomic.AddInt64(&invalid_count, 1)
+				inetdata.Rejects.Reject(inetdata.REJECT_INVALID_NAME, raw)
+				continue
+			}
+			host = n
+		}
+
+		// Skip empty names and names that are the address itself
+		if len(host) == 0 || strings.Contains(host, ",") || host == ip.String() {
+			continue
+		}
+
+		ptr.Add(string(inetdata.EncodeIPKey(ip, ip_key)) + "," + host)
+		inverse.Add(host + "," + ip.String())
+	}
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
+	sort_mem := flag.Uint64("sort-mem", 1, "The maximum amount of memory to use, in gigabytes, for the sorting phase of each output")
+	selected_ip_key := flag.String("ip-key", ip_key, "Encode the IP keys of the ptr output in this encoding: none or hex")
+	collapse := flag.Bool("collapse-arpa", false, "Convert in-addr.arpa and ip6.arpa names to their addresses")
+	normalized := flag.Bool("normalize", false, "Encode internationalized names as punycode and skip records with invalid names")
+	output_compression := flag.String("output-compression", "gzip", "The output compression: none, gzip, zstd, or lz4")
+	compression_level := flag.Int("compression-level", -1, "The output compression level, -1 uses the default for the codec")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddJSONSampleFlags("name")
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-rdns2csv")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-rdns2csv")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-rdns2csv")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidOutputCompression(*output_compression) {
+		inetdata.Log.Errorf("Invalid output compression specified: %s", *output_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	// Binary keys may contain commas and newlines
+	if *selected_ip_key != "none" && *selected_ip_key != "hex" {
+		inetdata.Log.Errorf("Invalid IP key format specified: %s", *selected_ip_key)
+		usage()
+		os.Exit(1)
+	}
+
+	ip_key = *selected_ip_key
+	collapse_arpa = *collapse
+	normalize = *normalized
+
+	if len(flag.Args()) < 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args()[1:], *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	if len(*sort_tmp) == 0 {
+		*sort_tmp = os.Getenv("HOME")
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	base := flag.Args()[0]
+	ext := ".csv" + inetdata.OutputCompressionExtension(*output_compression)
+	out_names := []string{base + "-ptr" + ext, base + "-ptr-inverse" + ext}
+
+	outputs := []*inetdata.SortedOutput{}
+	for _, name := range out_names {
+		o, e := inetdata.NewSortedOutput(name, *output_compression, *compression_level, *sort_tmp, *sort_mem*1024*1024*1024, &output_count)
+		if e != nil {
+			inetdata.Log.Errorf("failed to create %s: %s", name, e)
+			os.Exit(1)
+		}
+		outputs = append(outputs, o)
+	}
+
+	progress := inetdata.NewProgress("inetdata-rdns2csv", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.Errors = &invalid_count
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	// Parse stdin
+	c_inp := make(chan string, inetdata.QueueDepth)
+	progress.AddStage("input", func() int { return len(c_inp) })
+
+	for i := 0; i < inetdata.Workers; i++ {
+		go inputParser(c_inp, outputs[0], outputs[1])
+		wg.Add(1)
+	}
+
+	// Reader closes c_inp on completion
+	e := inetdata.ReadLinesFromInputs(inputs, *input_compression, progress.CountReader, c_inp)
+	if e != nil {
+		inetdata.Log.Warnf("Failed to read input: %s", e)
+	}
+
+	wg.Wait()
+
+	// The sorters write their output once their input is closed
+	failed := false
+	for _, o := range outputs {
+		if e := o.Close(); e != nil {
+			inetdata.Log.Warnf("Failed to write %s: %s", o.Path, e)
+			failed = true
+		}
+	}
+
+	quit <- 0
+
+	inetdata.CloseRejects()
+
+	if failed {
+		os.Exit(1)
+	}
+
+	inetdata.ExitIfInterrupted(out_names...)
+	inetdata.CheckErrorBudget(input_count)
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+var output_count int64 = 0
+var input_count int64 = 0
+
+var type_order = map[string]int{
+	"ipv4": 0,
+	"ipv6": 1,
+	"asn":  2,
+}
+
+var csv_header = []string{"registry", "type", "start", "end", "cidr", "cc", "status", "opaque_id", "date"}
+
+type RIRRecord struct {
+	Registry string
+	Type     string
+	Start    string
+	End      string
+	CIDR     string
+	CC       string
+	Status   string
+	OpaqueID string
+	Date     string
+
+	// Big-endian start address or AS number, used to sort merged output
+	key []byte
+}
+
+func (r *RIRRecord) Fields() []string {
+	return []string{r.Registry, r.Type, r.Start, r.End, r.CIDR, r.CC, r.Status, r.OpaqueID, r.Date}
+}
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] [<delegated-file> ... <delegated-file>]")
+	fmt.Println("")
+	fmt.Println("Parses RIR delegated and delegated-extended statistics files (AFRINIC, APNIC, ARIN,")
+	fmt.Println("LACNIC, RIPE NCC) from the arguments or stdin and writes normalized CSV:")
+	fmt.Println("")
+	fmt.Println("  " + strings.Join(csv_header, ","))
+	fmt.Println("")
+	fmt.Println("IPv4 and IPv6 ranges are expanded into one row per CIDR. AS number ranges are written")
+	fmt.Println("as a single row with an empty cidr field. With -merge, all inputs are combined into a")
+	fmt.Println("single dataset sorted by type (ipv4, ipv6, asn) and start address.")
+	fmt.Println("")
+	fmt.Println("With -output, the CSV is written to a file, object, or table instead of stdout")
+	fmt.Println("(ex: postgres://host:5432/db?table=rir&columns=" + strings.Join(csv_header, ",") + "&create=1),")
+	fmt.Println("see the README for the URL options.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+// Normalize the YYYYMMDD allocation date to YYYY-MM-DD, leaving unknown dates empty
+func normalizeDate(date string) string {
+	if len(date) != 8 || date == "00000000" {
+		return ""
+	}
+	if _, e := strconv.Atoi(date); e != nil {
+		return ""
+	}
+	return date[0:4] + "-" + date[4:6] + "-" + date[6:8]
+}
+
+// Parse a single record line, returning one record per CIDR for address ranges
+func parseLine(line string) ([]*RIRRecord, error) {
+	bits := strings.Split(line, "|")
+
+	// Summary lines have a * in place of the country and start
+	if len(bits) < 7 || bits[1] == "*" || bits[3] == "*" {
+		return nil, nil
+	}
+
+	// The version line starts with the numeric format version
+	if _, e := strconv.ParseFloat(bits[0], 64); e == nil {
+		return nil, nil
+	}
+
+	base := RIRRecord{
+		Registry: strings.ToLower(bits[0]),
+		Type:     strings.ToLower(bits[2]),
+		CC:       strings.ToUpper(bits[1]),
+		Date:     normalizeDate(bits[5]),
+		Status:   strings.ToLower(bits[6]),
+	}
+
+	// Delegated-extended files add an opaque-id for the holder
+	if len(bits) > 7 {
+		base.OpaqueID = bits[7]
+	}
+
+	switch base.Type {
+	case "ipv4", "ipv6":
+		start := net.ParseIP(bits[3])
+		if start == nil {
+			return nil, fmt.Errorf("invalid start address: %q", bits[3])
+		}
+
+		count, e := strconv.ParseUint(bits[4], 10, 64)
+		if e != nil || count == 0 {
+			return nil, fmt.Errorf("invalid value: %q", bits[4])
+		}
+
+		var end net.IP
+		if base.Type == "ipv4" {
+			// The value is the number of addresses
+			start = start.To4()
+			if start == nil {
+				return nil, fmt.Errorf("invalid ipv4 address: %q", bits[3])
+			}
+			s := uint64(binary.BigEndian.Uint32(start))
+			if s+count-1 > 0xffffffff {
+				return nil, fmt.Errorf("range exceeds the address space: %s+%d", bits[3], count)
+			}
+			end = make(net.IP, 4)
+			binary.BigEndian.PutUint32(end, uint32(s+count-1))
+		} else {
+			// The value is the prefix length
+			if count > 128 {
+				return nil, fmt.Errorf("invalid ipv6 prefix length: %q", bits[4])
+			}
+			mask := net.CIDRMask(int(count), 128)
+			start = start.To16().Mask(mask)
+			end = make(net.IP, 16)
+			for i := range end {
+				end[i] = start[i] | ^mask[i]
+			}
+		}
+
+		cidrs, e := inetdata.IPRange2CIDRs(start, end)
+		if e != nil {
+			return nil, e
+		}
+
+		recs := make([]*RIRRecord, 0, len(cidrs))
+		for _, cidr := range cidrs {
+			rec := base
+			rec.CIDR = cidr.String()
+			rec.Start = cidr.IP.String()
+			rec.End = lastAddress(cidr).String()
+			rec.key = cidr.IP.To16()
+			recs = append(recs, &rec)
+		}
+		return recs, nil
+
+	case "asn":
+		start, e := strconv.ParseUint(bits[3], 10, 32)
+		if e != nil {
+			return nil, fmt.Errorf("invalid start asn: %q", bits[3])
+		}
+
+		count, e := strconv.ParseUint(bits[4], 10, 32)
+		if e != nil || count == 0 {
+			return nil, fmt.Errorf("invalid value: %q", bits[4])
+		}
+
+		rec := base
+		rec.Start = strconv.FormatUint(start, 10)
+		rec.End = strconv.FormatUint(start+count-1, 10)
+		rec.key = make([]byte, 8)
+		binary.BigEndian.PutUint64(rec.key, start)
+		return []*RIRRecord{&rec}, nil
+	}
+
+	return nil, fmt.Errorf("unknown record type: %q", bits[2])
+}
+
+// Return the last address in a CIDR block
+func lastAddress(n *net.IPNet) net.IP {
+	ip := make(net.IP, len(n.IP))
+	for i := range n.IP {
+		ip[i] = n.IP[i] | ^n.Mask[i]
+	}
+	return ip
+}
+
+// Parse a delegated file, calling emit for every record
+func parseInput(input io.Reader, name string, emit func(*RIRRecord)) error {
+	scanner := bufio.NewScanner(input)
+	line_no := 0
+
+	for scanner.Scan() {
+		if inetdata.Interrupted() {
+			break
+		}
+
+		line_no++
+
+		raw := strings.TrimSpace(scanner.Text())
+		if len(raw) == 0 || strings.HasPrefix(raw, "#") {
+			continue
+		}
+
+		recs, e := parseLine(raw)
+		if e != nil {
+			inetdata.Log.Warnf("%s:%d: %s", name, line_no, e)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_LINE, raw)
+			continue
+		}
+
+		if len(recs) == 0 {
+			continue
+		}
+
+		atomic.AddInt64(&input_count, 1)
+
+		for i := range recs {
+			emit(recs[i])
+		}
+	}
+
+	return scanner.Err()
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	merge := flag.Bool("merge", false, "Combine all inputs into a single dataset sorted by start address")
+	header := flag.Bool("header", false, "Write a header row")
+	output_path := flag.String("output", "", "Write to this file or URL instead of stdout (ex: postgres://host:5432/db?table=rir)")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the delegated files matching this glob pattern (ex: 'delegated-*-extended-latest')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddMetaFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-rir2csv")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-rir2csv")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-rir2csv")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args(), *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidMetaOutput(*output_path) {
+		inetdata.Log.Errorf("-meta requires -output with a local file")
+		usage()
+		os.Exit(1)
+	}
+
+	dest, de := inetdata.CreateOutput(*output_path)
+	if de != nil {
+		inetdata.Log.Errorf("%s", de)
+		os.Exit(1)
+	}
+
+	out := bufio.NewWriterSize(dest, 1024*1024)
+	w := csv.NewWriter(out)
+
+	if *header {
+		w.Write(csv_header)
+	}
+
+	progress := inetdata.NewProgress("inetdata-rir2csv", &input_count, &output_count)
+	progress.Format = *progress_format
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	merged := []*RIRRecord{}
+
+	emit := func(rec *RIRRecord) {
+		if *merge {
+			merged = append(merged, rec)
+			return
+		}
+		w.Write(rec.Fields())
+		atomic.AddInt64(&output_count, 1)
+	}
+
+	exit_code := 0
+
+	read := func(fd io.Reader, name string) {
+		input, e := inetdata.NewInputReader(progress.CountReader(fd), *input_compression)
+		if e != nil {
+			inetdata.Log.Warnf("Failed to read %s: %s", name, e)
+			exit_code = 1
+			return
+		}
+		if e := parseInput(input, name, emit); e != nil {
+			inetdata.Log.Warnf("Failed to read %s: %s", name, e)
+			exit_code = 1
+		}
+	}
+
+	if len(inputs) == 0 {
+		read(os.Stdin, "stdin")
+	}
+
+	for _, path := range inputs {
+		if inetdata.Interrupted() {
+			break
+		}
+
+		fd, e := inetdata.OpenPath(path)
+		if e != nil {
+			inetdata.Log.Errorf("%s", e)
+			exit_code = 1
+			continue
+		}
+		read(fd, path)
+		fd.Close()
+	}
+
+	if *merge {
+		sort.SliceStable(merged, func(i, j int) bool {
+			ti, tj := type_order[merged[i].Type], type_order[merged[j].Type]
+			if ti != tj {
+				return ti < tj
+			}
+			return bytes.Compare(merged[i].key, merged[j].key) < 0
+		})
+
+		for _, rec := range merged {
+			w.Write(rec.Fields())
+			atomic.AddInt64(&output_count, 1)
+		}
+	}
+
+	w.Flush()
+	out.Flush()
+
+	quit <- 0
+
+	if e := w.Error(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+		exit_code = 1
+	}
+
+	if e := dest.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+		exit_code = 1
+	}
+
+	if exit_code == 0 {
+		inetdata.CloseRejects()
+
+		inetdata.ExitIfInterrupted(*output_path)
+		inetdata.CheckErrorBudget(input_count)
+
+		if e := inetdata.WriteDatasetMeta("inetdata-rir2csv", *output_path, output_count); e != nil {
+			inetdata.Log.Errorf("%s", e)
+			os.Exit(1)
+		}
+	}
+
+	os.Exit(exit_code)
+}
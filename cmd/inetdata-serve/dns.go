@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/dnsname"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+var dns_query_count int64 = 0
+var dns_nxdomain_count int64 = 0
+
+// A record of a dns2mtbl value: the record type, if the value is typed, and
+// the data, followed by any timestamps
+type pdnsRecord struct {
+	rtype  string
+	data   string
+	fields []string
+}
+
+// Parse a value into records. The values of dns2mtbl are JSON arrays of
+// [type, value, ...] or [value, ...] arrays, and other values are split on
+// null bytes.
+func parseRecords(val []byte) []pdnsRecord {
+	// Timestamps are kept as written rather than as floats
+	var arrays [][]interface{}
+	dec := json.NewDecoder(bytes.NewReader(val))
+	dec.UseNumber()
+	if e := dec.Decode(&arrays); e != nil {
+		var out []pdnsRecord
+		for _, v := range bytes.Split(val, []byte{0}) {
+			if len(v) > 0 {
+				out = append(out, pdnsRecord{data: string(v), fields: []string{string(v)}})
+			}
+		}
+		return out
+	}
+
+	out := make([]pdnsRecord, 0, len(arrays))
+	for _, arr := range arrays {
+		if len(arr) == 0 {
+			continue
+		}
+		rec := pdnsRecord{}
+		for _, f := range arr {
+			rec.fields = append(rec.fields, fmt.Sprint(f))
+		}
+
+		// Untyped values start with the data, typed values with a record type
+		rec.data = rec.fields[0]
+		if len(rec.fields) > 1 && dns.StringToType[strings.ToUpper(rec.fields[0])] != 0 {
+			rec.rtype = strings.ToLower(rec.fields[0])
+			rec.data = rec.fields[1]
+		}
+		out = append(out, rec)
+	}
+	return out
+}
+
+// Split a string into the 255-byte character strings of a TXT record
+func txtStrings(s string) []string {
+	var out []string
+	for len(s) > 255 {
+		out = append(out, s[:255])
+		s = s[255:]
+	}
+	return append(out, s)
+}
+
+// dnsHandler answers queries for <name>.<dataset>.<zone>, or for <name> from
+// the default dataset
+type dnsHandler struct {
+	datasets map[string]*inetdata.MTBLDataset
+	zone     string
+	fallback string
+	ttl      uint32
+}
+
+// Find the dataset and the name being looked up
+func (h *dnsHandler) route(qname string) (*inetdata.MTBLDataset, string) {
+	name := strings.TrimSuffix(strings.ToLower(qname), ".")
+
+	if len(h.zone) > 0 && strings.HasSuffix(name, "."+h.zone) {
+		rest := strings.TrimSuffix(name, "."+h.zone)
+		if i := strings.LastIndex(rest, "."); i > 0 {
+			if d, ok := h.datasets[rest[i+1:]]; ok {
+				return d, rest[:i]
+			}
+		}
+	}
+
+	if d, ok := h.datasets[h.fallback]; ok {
+		return d, name
+	}
+	return nil, ""
+}
+
+func (h *dnsHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	atomic.AddInt64(&request_count, 1)
+	atomic.AddInt64(&dns_query_count, 1)
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+
+	if len(req.Question) != 1 {
+		atomic.AddInt64(&error_count, 1)
+		m.SetRcodeFormatError(req)
+		w.WriteMsg(m)
+		return
+	}
+
+	q := req.Question[0]
+	rcode, e := h.answer(m, q)
+	if e != nil {
+		atomic.AddInt64(&error_count, 1)
+		inetdata.Log.Warnf("DNS query %s %s: %s", q.Name, dns.TypeToString[q.Qtype], e)
+		rcode = dns.RcodeServerFailure
+	}
+	if rcode == dns.RcodeNameError {
+		atomic.AddInt64(&dns_nxdomain_count, 1)
+	}
+	m.Rcode = rcode
+	atomic.AddInt64(&result_count, int64(len(m.Answer)))
+
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		m.Truncate(size)
+	}
+	w.WriteMsg(m)
+}
+
+// Add the answers of a question, returning the response code
+func (h *dnsHandler) answer(m *dns.Msg, q dns.Question) (int, error) {
+	d, name := h.route(q.Name)
+	if d == nil {
+		return dns.RcodeRefused, nil
+	}
+
+	var key []byte
+	ip, is_arpa := dnsname.ParseArpa(name)
+	if is_arpa {
+		key = inetdata.EncodeIPKey(ip, d.IPKey)
+	} else {
+		key = d.HostKey(name)
+	}
+
+	val, ok, e := d.Get(key)
+	if e != nil {
+		return 0, e
+	}
+	if !ok {
+		return dns.RcodeNameError, nil
+	}
+
+	hdr := func(rtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: q.Name, Rrtype: rtype, Class: dns.ClassINET, Ttl: h.ttl}
+	}
+
+	for _, rec := range parseRecords(val) {
+		if len(m.Answer) == max_results {
+			break
+		}
+
+		switch q.Qtype {
+		case dns.TypeTXT, dns.TypeANY:
+			m.Answer = append(m.Answer, &dns.TXT{Hdr: hdr(dns.TypeTXT), Txt: txtStrings(strings.Join(rec.fields, " "))})
+
+		case dns.TypeA, dns.TypeAAAA:
+			addr := net.ParseIP(rec.data)
+			if is_arpa || addr == nil || (rec.rtype != "" && rec.rtype != "a" && rec.rtype != "aaaa") {
+				continue
+			}
+			if ip4 := addr.To4(); ip4 != nil && q.Qtype == dns.TypeA {
+				m.Answer = append(m.Answer, &dns.A{Hdr: hdr(dns.TypeA), A: ip4})
+			} else if ip4 == nil && q.Qtype == dns.TypeAAAA {
+				m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: addr})
+			}
+
+		case dns.TypePTR:
+			if !is_arpa || net.ParseIP(rec.data) != nil || (rec.rtype != "" && rec.rtype != "ptr") {
+				continue
+			}
+			if _, ok := dns.IsDomainName(rec.data); ok {
+				m.Answer = append(m.Answer, &dns.PTR{Hdr: hdr(dns.TypePTR), Ptr: dns.Fqdn(rec.data)})
+			}
+		}
+	}
+	return dns.RcodeSuccess, nil
+}
+
+// newDNSServers returns a UDP and a TCP server of the datasets on the address
+func newDNSServers(addr string, h *dnsHandler) ([]*dns.Server, error) {
+	pc, e := net.ListenPacket("udp", addr)
+	if e != nil {
+		return nil, e
+	}
+	ln, e := net.Listen("tcp", addr)
+	if e != nil {
+		pc.Close()
+		return nil, e
+	}
+
+	return []*dns.Server{
+		{PacketConn: pc, Handler: h},
+		{Listener: ln, Handler: h},
+	}, nil
+}
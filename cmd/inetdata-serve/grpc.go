@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// The messages of proto/lookup.proto, encoded by hand like inetdata.Record
+type pbMessage interface {
+	marshal() []byte
+	unmarshal(b []byte) error
+}
+
+type LookupRequest struct {
+	Dataset string
+	Name    string
+	IP      string
+	Key     []byte
+}
+
+type LookupResponse struct {
+	Dataset string
+	Key     []byte
+	Found   bool
+	Value   []byte
+	Error   string
+}
+
+type PrefixScanRequest struct {
+	Dataset string
+	Prefix  []byte
+	Domain  string
+	Limit   uint32
+}
+
+type Entry struct {
+	Key   []byte
+	Name  string
+	Value []byte
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// Call fn with each bytes and varint field of a message, skipping others
+func consumeFields(b []byte, fn func(num protowire.Number, v []byte, x uint64)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			fn(num, v, 0)
+			b = b[n:]
+		case protowire.VarintType:
+			x, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			fn(num, nil, x)
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+func (m *LookupRequest) marshal() []byte {
+	b := appendBytes(nil, 1, []byte(m.Dataset))
+	b = appendBytes(b, 2, []byte(m.Name))
+	b = appendBytes(b, 3, []byte(m.IP))
+	return appendBytes(b, 4, m.Key)
+}
+
+func (m *LookupRequest) unmarshal(b []byte) error {
+	*m = LookupRequest{}
+	return consumeFields(b, func(num protowire.Number, v []byte, x uint64) {
+		switch num {
+		case 1:
+			m.Dataset = string(v)
+		case 2:
+			m.Name = string(v)
+		case 3:
+			m.IP = string(v)
+		case 4:
+			m.Key = append([]byte{}, v...)
+		}
+	})
+}
+
+func (m *LookupResponse) marshal() []byte {
+	b := appendBytes(nil, 1, []byte(m.Dataset))
+	b = appendBytes(b, 2, m.Key)
+	if m.Found {
+		b = appendVarint(b, 3, 1)
+	}
+	b = appendBytes(b, 4, m.Value)
+	return appendBytes(b, 5, []byte(m.Error))
+}
+
+func (m *LookupResponse) unmarshal(b []byte) error {
+	*m = LookupResponse{}
+	return consumeFields(b, func(num protowire.Number, v []byte, x uint64) {
+		switch num {
+		case 1:
+			m.Dataset = string(v)
+		case 2:
+			m.Key = append([]byte{}, v...)
+		case 3:
+			m.Found = x != 0
+		case 4:
+			m.Value = append([]byte{}, v...)
+		case 5:
+			m.Error = string(v)
+		}
+	})
+}
+
+func (m *PrefixScanRequest) marshal() []byte {
+	b := appendBytes(nil, 1, []byte(m.Dataset))
+	b = appendBytes(b, 2, m.Prefix)
+	b = appendBytes(b, 3, []byte(m.Domain))
+	return appendVarint(b, 4, uint64(m.Limit))
+}
+
+func (m *PrefixScanRequest) unmarshal(b []byte) error {
+	*m = PrefixScanRequest{}
+	return consumeFields(b, func(num protowire.Number, v []byte, x uint64) {
+		switch num {
+		case 1:
+			m.Dataset = string(v)
+		case 2:
+			m.Prefix = append([]byte{}, v...)
+		case 3:
+			m.Domain = string(v)
+		case 4:
+			m.Limit = uint32(x)
+		}
+	})
+}
+
+func (m *Entry) marshal() []byte {
+	b := appendBytes(nil, 1, m.Key)
+	b = appendBytes(b, 2, []byte(m.Name))
+	return appendBytes(b, 3, m.Value)
+}
+
+func (m *Entry) unmarshal(b []byte) error {
+	*m = Entry{}
+	return consumeFields(b, func(num protowire.Number, v []byte, x uint64) {
+		switch num {
+		case 1:
+			m.Key = append([]byte{}, v...)
+		case 2:
+			m.Name = string(v)
+		case 3:
+			m.Value = append([]byte{}, v...)
+		}
+	})
+}
+
+// pbCodec encodes the hand-written messages. The wire format is plain
+// protobuf, so clients generated from proto/lookup.proto work unchanged.
+type pbCodec struct{}
+
+func (pbCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(pbMessage)
+	if !ok {
+		return nil, fmt.Errorf("unsupported message type %T", v)
+	}
+	return m.marshal(), nil
+}
+
+func (pbCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(pbMessage)
+	if !ok {
+		return fmt.Errorf("unsupported message type %T", v)
+	}
+	return m.unmarshal(data)
+}
+
+func (pbCodec) String() string {
+	return "proto"
+}
+
+// LookupServer is the Lookup service of proto/lookup.proto
+type LookupServer interface {
+	Lookup(ctx context.Context, req *LookupRequest) (*LookupResponse, error)
+	PrefixScan(req *PrefixScanRequest, stream grpc.ServerStream) error
+	BulkLookup(stream grpc.ServerStream) error
+}
+
+var lookupServiceDesc = grpc.ServiceDesc{
+	ServiceName: "inetdata.Lookup",
+	HandlerType: (*LookupServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Lookup",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &LookupRequest{}
+				if e := dec(req); e != nil {
+					return nil, e
+				}
+				handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(LookupServer).Lookup(ctx, req.(*LookupRequest))
+				}
+				if interceptor == nil {
+					return handler(ctx, req)
+				}
+				return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/inetdata.Lookup/Lookup"}, handler)
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "PrefixScan",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				req := &PrefixScanRequest{}
+				if e := stream.RecvMsg(req); e != nil {
+					return e
+				}
+				return srv.(LookupServer).PrefixScan(req, stream)
+			},
+			ServerStreams: true,
+		},
+		{
+			StreamName: "BulkLookup",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(LookupServer).BulkLookup(stream)
+			},
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "proto/lookup.proto",
+}
+
+// The call and error counters of each method, exported as metrics
+type methodCounters struct {
+	calls  int64
+	errors int64
+}
+
+var grpc_method_names = []string{"Lookup", "PrefixScan", "BulkLookup"}
+
+var grpc_methods = map[string]*methodCounters{}
+
+// Register the method counters as grpc_<method>_calls and _errors
+func addMethodCounters(progress *inetdata.Progress) {
+	for _, name := range grpc_method_names {
+		c := &methodCounters{}
+		grpc_methods["/inetdata.Lookup/"+name] = c
+		progress.AddCounter("grpc_"+strings.ToLower(name)+"_calls", &c.calls)
+		progress.AddCounter("grpc_"+strings.ToLower(name)+"_errors", &c.errors)
+	}
+}
+
+func countCall(method string, e error) {
+	atomic.AddInt64(&request_count, 1)
+	c, ok := grpc_methods[method]
+	if !ok {
+		return
+	}
+	atomic.AddInt64(&c.calls, 1)
+	if e != nil {
+		atomic.AddInt64(&c.errors, 1)
+		atomic.AddInt64(&error_count, 1)
+	}
+}
+
+func unaryCounter(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	res, e := handler(ctx, req)
+	countCall(info.FullMethod, e)
+	return res, e
+}
+
+func streamCounter(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	e := handler(srv, stream)
+	countCall(info.FullMethod, e)
+	return e
+}
+
+// newGRPCServer returns a server of the Lookup service. Each connection may
+// have up to max_streams concurrent calls.
+func newGRPCServer(datasets map[string]*inetdata.MTBLDataset, max_streams uint32) *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.CustomCodec(pbCodec{}),
+		grpc.MaxConcurrentStreams(max_streams),
+		grpc.UnaryInterceptor(unaryCounter),
+		grpc.StreamInterceptor(streamCounter),
+	)
+	srv.RegisterService(&lookupServiceDesc, &lookupServer{datasets: datasets})
+	return srv
+}
+
+type lookupServer struct {
+	datasets map[string]*inetdata.MTBLDataset
+}
+
+// Convert an HTTP API error to a gRPC status
+func grpcError(e error) error {
+	if re, ok := e.(*requestError); ok {
+		if re.status == http.StatusNotFound {
+			return status.Error(codes.NotFound, re.msg)
+		}
+		return status.Error(codes.InvalidArgument, re.msg)
+	}
+	return status.Error(codes.Internal, e.Error())
+}
+
+func (s *lookupServer) dataset(name string) (*inetdata.MTBLDataset, error) {
+	d, ok := s.datasets[name]
+	if !ok {
+		return nil, &requestError{http.StatusNotFound, fmt.Sprintf("unknown dataset %q", name)}
+	}
+	return d, nil
+}
+
+// Find the key of a request, which has exactly one of a name, IP, or key
+func requestKey(d *inetdata.MTBLDataset, req *LookupRequest) ([]byte, error) {
+	set := 0
+	for _, ok := range []bool{len(req.Name) > 0, len(req.IP) > 0, len(req.Key) > 0} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, badRequest("exactly one of name, ip, or key is required")
+	}
+
+	switch {
+	case len(req.Name) > 0:
+		return d.HostKey(req.Name), nil
+	case len(req.IP) > 0:
+		ip := net.ParseIP(req.IP)
+		if ip == nil {
+			return nil, badRequest("invalid IP address %q", req.IP)
+		}
+		return inetdata.EncodeIPKey(ip, d.IPKey), nil
+	}
+	return req.Key, nil
+}
+
+func (s *lookupServer) lookup(req *LookupRequest) (*LookupResponse, error) {
+	d, e := s.dataset(req.Dataset)
+	if e != nil {
+		return nil, e
+	}
+
+	key, e := requestKey(d, req)
+	if e != nil {
+		return nil, e
+	}
+	atomic.AddInt64(&lookup_count, 1)
+
+	val, ok, e := d.Get(key)
+	if e != nil {
+		return nil, e
+	}
+
+	res := &LookupResponse{Dataset: d.Name, Key: key, Found: ok}
+	if ok {
+		res.Value = append([]byte{}, val...)
+		atomic.AddInt64(&result_count, 1)
+	}
+	return res, nil
+}
+
+func (s *lookupServer) Lookup(ctx context.Context, req *LookupRequest) (*LookupResponse, error) {
+	res, e := s.lookup(req)
+	if e != nil {
+		return nil, grpcError(e)
+	}
+	return res, nil
+}
+
+func (s *lookupServer) PrefixScan(req *PrefixScanRequest, stream grpc.ServerStream) error {
+	d, e := s.dataset(req.Dataset)
+	if e != nil {
+		return grpcError(e)
+	}
+
+	if (len(req.Prefix) > 0) == (len(req.Domain) > 0) {
+		return grpcError(badRequest("exactly one of prefix or domain is required"))
+	}
+	if len(req.Domain) > 0 && d.Keys == inetdata.DATASET_KEYS_PLAIN {
+		return grpcError(badRequest("dataset %s does not have reversed hostname keys", d.Name))
+	}
+
+	limit := max_results
+	if req.Limit > 0 && int(req.Limit) < limit {
+		limit = int(req.Limit)
+	}
+	atomic.AddInt64(&subdomain_count, 1)
+
+	count := 0
+	var send_err error
+	send := func(ent *Entry) bool {
+		if count == limit {
+			return false
+		}
+		if send_err = stream.SendMsg(ent); send_err != nil {
+			return false
+		}
+		count++
+		return true
+	}
+
+	if len(req.Domain) > 0 {
+		e = d.Subdomains(req.Domain, func(name string, val []byte) bool {
+			return send(&Entry{Key: d.HostKey(name), Name: name, Value: val})
+		})
+	} else {
+		e = d.Scan(req.Prefix, func(key []byte, val []byte) bool {
+			if !bytes.HasPrefix(key, req.Prefix) {
+				return false
+			}
+			return send(&Entry{Key: key, Name: d.KeyName(key), Value: val})
+		})
+	}
+
+	atomic.AddInt64(&result_count, int64(count))
+	if send_err != nil {
+		return send_err
+	}
+	if e != nil {
+		return grpcError(e)
+	}
+	return nil
+}
+
+func (s *lookupServer) BulkLookup(stream grpc.ServerStream) error {
+	for {
+		req := &LookupRequest{}
+		if e := stream.RecvMsg(req); e != nil {
+			if e == io.EOF {
+				return nil
+			}
+			return e
+		}
+
+		res, e := s.lookup(req)
+		if e != nil {
+			if _, ok := e.(*requestError); !ok {
+				return grpcError(e)
+			}
+			// Invalid requests are answered without ending the stream
+			res = &LookupResponse{Dataset: req.Dataset, Error: e.Error()}
+		}
+
+		if e := stream.SendMsg(res); e != nil {
+			return e
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+type DatasetJSON struct {
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	Keys        string `json:"keys"`
+	IPKey       string `json:"ip_key"`
+	Size        uint64 `json:"size"`
+	Entries     uint64 `json:"entries"`
+	Shards      int    `json:"shards"`
+	Compression string `json:"compression"`
+}
+
+type HostJSON struct {
+	Name  string          `json:"name"`
+	Value json.RawMessage `json:"value"`
+}
+
+type IPJSON struct {
+	IP    string          `json:"ip"`
+	Value json.RawMessage `json:"value"`
+}
+
+type LookupJSON struct {
+	Dataset string          `json:"dataset"`
+	Name    string          `json:"name"`
+	Found   bool            `json:"found"`
+	Value   json.RawMessage `json:"value,omitempty"`
+}
+
+type IPLookupJSON struct {
+	Dataset   string   `json:"dataset"`
+	Query     string   `json:"query"`
+	Results   []IPJSON `json:"results"`
+	Truncated bool     `json:"truncated"`
+}
+
+type SubdomainsJSON struct {
+	Dataset   string     `json:"dataset"`
+	Domain    string     `json:"domain"`
+	Results   []HostJSON `json:"results"`
+	Truncated bool       `json:"truncated"`
+}
+
+type ErrorJSON struct {
+	Error string `json:"error"`
+}
+
+// An error with the HTTP status of the response
+type requestError struct {
+	status int
+	msg    string
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &requestError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+// Values that are not JSON encoded are returned as strings
+func jsonValue(val []byte) json.RawMessage {
+	if json.Valid(val) {
+		return json.RawMessage(append([]byte{}, val...))
+	}
+	b, _ := json.Marshal(string(val))
+	return json.RawMessage(b)
+}
+
+type handler struct {
+	datasets map[string]*inetdata.MTBLDataset
+	progress *inetdata.Progress
+	mux      *http.ServeMux
+}
+
+func newHandler(datasets map[string]*inetdata.MTBLDataset, progress *inetdata.Progress) http.Handler {
+	h := &handler{datasets: datasets, progress: progress, mux: http.NewServeMux()}
+
+	h.mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		progress.WriteMetrics(w)
+	})
+	h.mux.HandleFunc("/datasets", h.wrap(h.list))
+	h.mux.HandleFunc("/datasets/", h.wrap(h.dataset))
+	return h.mux
+}
+
+// Count the request and write the response or error as JSON
+func (h *handler) wrap(fn func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&request_count, 1)
+		w.Header().Set("Content-Type", "application/json")
+
+		var res interface{}
+		e := badRequest("only GET requests are supported")
+		if r.Method == http.MethodGet {
+			res, e = fn(r)
+		}
+
+		if e != nil {
+			atomic.AddInt64(&error_count, 1)
+			status := http.StatusInternalServerError
+			if re, ok := e.(*requestError); ok {
+				status = re.status
+			} else {
+				inetdata.Log.Warnf("%s: %s", r.URL, e)
+			}
+			w.WriteHeader(status)
+			res = ErrorJSON{Error: e.Error()}
+		}
+
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+func (h *handler) list(r *http.Request) (interface{}, error) {
+	out := []DatasetJSON{}
+	for _, name := range inetdata.SortedDatasetNames(h.datasets) {
+		d := h.datasets[name]
+		out = append(out, DatasetJSON{
+			Name:        d.Name,
+			Path:        d.Path,
+			Keys:        d.Keys,
+			IPKey:       d.IPKey,
+			Size:        d.Size(),
+			Entries:     d.Entries(),
+			Shards:      len(d.Shards),
+			Compression: d.Compression(),
+		})
+	}
+	return out, nil
+}
+
+// Route /datasets/<name>/<query> to the dataset
+func (h *handler) dataset(r *http.Request) (interface{}, error) {
+	bits := strings.Split(strings.TrimPrefix(r.URL.Path, "/datasets/"), "/")
+	if len(bits) != 2 {
+		return nil, &requestError{http.StatusNotFound, "expected /datasets/<name>/<lookup|ip|subdomains>"}
+	}
+
+	d, ok := h.datasets[bits[0]]
+	if !ok {
+		return nil, &requestError{http.StatusNotFound, fmt.Sprintf("unknown dataset %q", bits[0])}
+	}
+
+	limit := max_results
+	if v := r.URL.Query().Get("limit"); len(v) > 0 {
+		n, e := strconv.Atoi(v)
+		if e != nil || n < 1 {
+			return nil, badRequest("invalid limit %q", v)
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+
+	q := r.URL.Query()
+	switch bits[1] {
+	case "lookup":
+		return lookup(d, q.Get("name"))
+	case "ip":
+		return lookupIP(d, q.Get("ip"), limit)
+	case "subdomains":
+		return subdomains(d, q.Get("domain"), limit)
+	}
+	return nil, &requestError{http.StatusNotFound, fmt.Sprintf("unknown query %q", bits[1])}
+}
+
+func lookup(d *inetdata.MTBLDataset, name string) (interface{}, error) {
+	if len(name) == 0 {
+		return nil, badRequest("the name parameter is required")
+	}
+	atomic.AddInt64(&lookup_count, 1)
+
+	res := LookupJSON{Dataset: d.Name, Name: name}
+	val, ok, e := d.Get(d.HostKey(name))
+	if e != nil {
+		return nil, e
+	}
+	if ok {
+		res.Found = true
+		res.Value = jsonValue(val)
+		atomic.AddInt64(&result_count, 1)
+	}
+	return res, nil
+}
+
+func lookupIP(d *inetdata.MTBLDataset, query string, limit int) (interface{}, error) {
+	if len(query) == 0 {
+		return nil, badRequest("the ip parameter is required")
+	}
+	atomic.AddInt64(&ip_lookup_count, 1)
+
+	cidr := query
+	if !strings.Contains(cidr, "/") {
+		if strings.Contains(cidr, ":") {
+			cidr = cidr + "/128"
+		} else {
+			cidr = cidr + "/32"
+		}
+	}
+
+	_, n, e := net.ParseCIDR(cidr)
+	if e != nil {
+		return nil, badRequest("invalid IP address or CIDR %q", query)
+	}
+	if ones, size := n.Mask.Size(); ones != size && d.IPKey == "none" {
+		return nil, badRequest("dataset %s does not have encoded IP keys for network lookups", d.Name)
+	}
+
+	res := IPLookupJSON{Dataset: d.Name, Query: query, Results: []IPJSON{}}
+	e = d.Addresses(n, func(ip net.IP, val []byte) bool {
+		if len(res.Results) == limit {
+			res.Truncated = true
+			return false
+		}
+		res.Results = append(res.Results, IPJSON{IP: ip.String(), Value: jsonValue(val)})
+		return true
+	})
+	if e != nil {
+		return nil, e
+	}
+
+	atomic.AddInt64(&result_count, int64(len(res.Results)))
+	return res, nil
+}
+
+func subdomains(d *inetdata.MTBLDataset, domain string, limit int) (interface{}, error) {
+	if len(domain) == 0 {
+		return nil, badRequest("the domain parameter is required")
+	}
+	if d.Keys == inetdata.DATASET_KEYS_PLAIN {
+		return nil, badRequest("dataset %s does not have reversed hostname keys", d.Name)
+	}
+	atomic.AddInt64(&subdomain_count, 1)
+
+	res := SubdomainsJSON{Dataset: d.Name, Domain: domain, Results: []HostJSON{}}
+	e := d.Subdomains(domain, func(name string, val []byte) bool {
+		if len(res.Results) == limit {
+			res.Truncated = true
+			return false
+		}
+		res.Results = append(res.Results, HostJSON{Name: name, Value: jsonValue(val)})
+		return true
+	})
+	if e != nil {
+		return nil, e
+	}
+
+	atomic.AddInt64(&result_count, int64(len(res.Results)))
+	return res, nil
+}
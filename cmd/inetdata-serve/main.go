@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"github.com/miekg/dns"
+	"golang.org/x/net/netutil"
+	"google.golang.org/grpc"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The number of seconds to wait for requests in progress on shutdown
+const SHUTDOWN_TIMEOUT = 10
+
+var request_count int64 = 0
+var result_count int64 = 0
+var error_count int64 = 0
+
+var lookup_count int64 = 0
+var ip_lookup_count int64 = 0
+var subdomain_count int64 = 0
+
+var max_results int
+
+// The key forms of a dataset that differ from the defaults, from -dataset
+type datasetOptions struct {
+	keys   string
+	ip_key string
+}
+
+type datasetList map[string]datasetOptions
+
+func (d *datasetList) String() string {
+	var out []string
+	for name, o := range *d {
+		out = append(out, name+":"+o.keys+":"+o.ip_key)
+	}
+	return strings.Join(out, ",")
+}
+
+func (d *datasetList) Get() interface{} {
+	out := []string{}
+	for name, o := range *d {
+		out = append(out, name+":"+o.keys+":"+o.ip_key)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (d *datasetList) Set(v string) error {
+	bits := strings.Split(v, ":")
+	if len(bits) != 3 || len(bits[0]) == 0 {
+		return fmt.Errorf("expected name:keys:ip-key, got %q", v)
+	}
+	if !inetdata.ValidDatasetKeyForm(bits[1]) {
+		return fmt.Errorf("invalid key form %q in %q", bits[1], v)
+	}
+	if !inetdata.ValidIPKeyFormat(bits[2]) {
+		return fmt.Errorf("invalid IP key format %q in %q", bits[2], v)
+	}
+	(*d)[bits[0]] = datasetOptions{keys: bits[1], ip_key: bits[2]}
+	return nil
+}
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <directory>")
+	fmt.Println("")
+	fmt.Println("Serves the MTBL databases in a directory over an HTTP/JSON API. Each <name>.mtbl file, or")
+	fmt.Println("<name>.shards.json manifest of a sharded dataset (see inetdata-mtbl-merge -shards), is a")
+	fmt.Println("dataset, mapped into memory with mmap and shared by all requests:")
+	fmt.Println("")
+	fmt.Println("  GET /datasets                                    List the datasets and their metadata")
+	fmt.Println("  GET /datasets/<name>/lookup?name=<hostname>       Look up the value of a hostname")
+	fmt.Println("  GET /datasets/<name>/ip?ip=<address or CIDR>      Look up the values of IP addresses")
+	fmt.Println("  GET /datasets/<name>/subdomains?domain=<domain>   List a domain and its subdomains")
+	fmt.Println("  GET /metrics                                      Prometheus metrics")
+	fmt.Println("")
+	fmt.Println("With -grpc-listen, the same datasets are also served by the gRPC Lookup service of")
+	fmt.Println("proto/lookup.proto: Lookup, PrefixScan, and BulkLookup, a stream of lookups answered in")
+	fmt.Println("order. Each connection may run -grpc-max-streams calls at once, and -grpc-max-connections")
+	fmt.Println("limits the number of connections. The calls and errors of each method are exported as")
+	fmt.Println("metrics.")
+	fmt.Println("")
+	fmt.Println("With -dns-listen, DNS queries over UDP and TCP are answered from the datasets. A query for")
+	fmt.Println("<name>.<dataset>.<zone> (ex: www.example.com.fdns.inetdata) looks up the name in the")
+	fmt.Println("dataset, and other names are looked up in the -dns-dataset, if set. TXT queries return a")
+	fmt.Println("record per stored value, with its type and timestamps, A and AAAA queries return the")
+	fmt.Println("stored addresses, and PTR queries for in-addr.arpa and ip6.arpa names return the stored")
+	fmt.Println("hostnames of the address. Unknown names are answered with NXDOMAIN.")
+	fmt.Println("")
+	fmt.Println("Hostname keys are stored reversed by default, as written by the *2mtbl tools, and IP address")
+	fmt.Println("keys as text. Use -keys and -ip-key to change the defaults, and -dataset name:keys:ip-key")
+	fmt.Println("for datasets that differ (ex: -dataset ct:labels:none -dataset rdns:plain:binary).")
+	fmt.Println("Network lookups require encoded IP keys (see csv2mtbl -ip-key).")
+	fmt.Println("")
+	fmt.Println("Values that are JSON are returned as JSON, and other values as strings. Subdomain and")
+	fmt.Println("network lookups return at most -max-results records, or fewer with a limit parameter.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+// Open every database in the directory
+func openDatasets(dir string, keys string, ip_key string, overrides datasetList, mmap bool) (map[string]*inetdata.MTBLDataset, error) {
+	paths, e := inetdata.FindMTBLDatasets(dir)
+	if e != nil {
+		return nil, e
+	}
+
+	for name := range overrides {
+		if _, ok := paths[name]; !ok {
+			return nil, fmt.Errorf("dataset %s was not found in %s", name, dir)
+		}
+	}
+
+	datasets := make(map[string]*inetdata.MTBLDataset)
+	for name, path := range paths {
+		d_keys, d_ip_key := keys, ip_key
+		if o, ok := overrides[name]; ok {
+			d_keys, d_ip_key = o.keys, o.ip_key
+		}
+
+		d, e := inetdata.OpenMTBLDataset(name, path, d_keys, d_ip_key, mmap)
+		if e != nil {
+			for _, d := range datasets {
+				d.Close()
+			}
+			return nil, e
+		}
+		datasets[name] = d
+	}
+	return datasets, nil
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+
+	overrides := datasetList{}
+
+	listen := flag.String("listen", "127.0.0.1:8080", "The address to serve the HTTP API on")
+	keys := flag.String("keys", inetdata.DATASET_KEYS_REVERSED, "The default hostname key form: reversed, labels, or plain")
+	ip_key := flag.String("ip-key", "none", "The default IP address key encoding: none, binary, or hex")
+	flag.Var(&overrides, "dataset", "The key forms of a dataset, as name:keys:ip-key (repeat for multiple datasets)")
+	mmap := flag.Bool("mmap", true, "Map the databases into memory instead of reading them with system calls")
+	grpc_listen := flag.String("grpc-listen", "", "Also serve the gRPC Lookup service on this address (ex: :9000)")
+	grpc_max_streams := flag.Uint("grpc-max-streams", 100, "The maximum number of concurrent gRPC calls per connection")
+	grpc_max_conns := flag.Int("grpc-max-connections", 0, "The maximum number of gRPC connections, 0 for no limit")
+	dns_listen := flag.String("dns-listen", "", "Also answer DNS queries over UDP and TCP on this address (ex: :5353)")
+	dns_zone := flag.String("dns-zone", "inetdata", "The zone of DNS queries that name a dataset, as <name>.<dataset>.<zone>")
+	dns_dataset := flag.String("dns-dataset", "", "The dataset of DNS queries outside of -dns-zone")
+	dns_ttl := flag.Uint("dns-ttl", 300, "The TTL of DNS answers")
+	max_results_flag := flag.Int("max-results", 10000, "The maximum number of records returned by a subdomain or network lookup")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddRequireMetaFlags()
+
+	inetdata.ParseFlags("inetdata-serve")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-serve")
+		os.Exit(0)
+	}
+
+	if len(flag.Args()) != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidDatasetKeyForm(*keys) {
+		inetdata.Log.Errorf("Invalid key form specified: %s", *keys)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidIPKeyFormat(*ip_key) {
+		inetdata.Log.Errorf("Invalid IP key format specified: %s", *ip_key)
+		usage()
+		os.Exit(1)
+	}
+
+	if *max_results_flag < 1 {
+		inetdata.Log.Errorf("-max-results must be at least 1")
+		usage()
+		os.Exit(1)
+	}
+	max_results = *max_results_flag
+
+	if *grpc_max_streams < 1 || *grpc_max_conns < 0 {
+		inetdata.Log.Errorf("-grpc-max-streams must be at least 1 and -grpc-max-connections not negative")
+		usage()
+		os.Exit(1)
+	}
+
+	datasets, e := openDatasets(flag.Args()[0], *keys, *ip_key, overrides, *mmap)
+	if e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+	if len(datasets) == 0 {
+		inetdata.Log.Errorf("No .mtbl files or shard manifests were found in %s", flag.Args()[0])
+		os.Exit(1)
+	}
+
+	if _, ok := datasets[*dns_dataset]; len(*dns_dataset) > 0 && !ok {
+		inetdata.Log.Errorf("The -dns-dataset %s was not found", *dns_dataset)
+		os.Exit(1)
+	}
+
+	for _, name := range inetdata.SortedDatasetNames(datasets) {
+		d := datasets[name]
+		inetdata.Log.Infof("Serving %s from %s (%d entries, %s keys, %s IP keys)", name, d.Path, d.Entries(), d.Keys, d.IPKey)
+	}
+
+	progress := inetdata.NewProgress("inetdata-serve", &request_count, &result_count)
+	progress.Errors = &error_count
+	progress.AddCounter("lookups", &lookup_count)
+	progress.AddCounter("ip_lookups", &ip_lookup_count)
+	progress.AddCounter("subdomain_scans", &subdomain_count)
+	addMethodCounters(progress)
+	progress.AddCounter("dns_queries", &dns_query_count)
+	progress.AddCounter("dns_nxdomain", &dns_nxdomain_count)
+
+	srv := &http.Server{Handler: newHandler(datasets, progress)}
+
+	ln, e := net.Listen("tcp", *listen)
+	if e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+	inetdata.Log.Infof("Listening on http://%s", ln.Addr())
+
+	var grpc_srv *grpc.Server
+	if len(*grpc_listen) > 0 {
+		grpc_ln, e := net.Listen("tcp", *grpc_listen)
+		if e != nil {
+			inetdata.Log.Errorf("%s", e)
+			os.Exit(1)
+		}
+		if *grpc_max_conns > 0 {
+			grpc_ln = netutil.LimitListener(grpc_ln, *grpc_max_conns)
+		}
+
+		grpc_srv = newGRPCServer(datasets, uint32(*grpc_max_streams))
+		go func() {
+			if e := grpc_srv.Serve(grpc_ln); e != nil {
+				inetdata.Log.Warnf("gRPC server failed: %s", e)
+			}
+		}()
+		inetdata.Log.Infof("Listening for gRPC on %s", grpc_ln.Addr())
+	}
+
+	var dns_srvs []*dns.Server
+	if len(*dns_listen) > 0 {
+		h := &dnsHandler{
+			datasets: datasets,
+			zone:     strings.Trim(strings.ToLower(*dns_zone), "."),
+			fallback: *dns_dataset,
+			ttl:      uint32(*dns_ttl),
+		}
+		if dns_srvs, e = newDNSServers(*dns_listen, h); e != nil {
+			inetdata.Log.Errorf("%s", e)
+			os.Exit(1)
+		}
+		for _, s := range dns_srvs {
+			go func(s *dns.Server) {
+				if e := s.ActivateAndServe(); e != nil {
+					inetdata.Log.Warnf("DNS server failed: %s", e)
+				}
+			}(s)
+		}
+		inetdata.Log.Infof("Listening for DNS on %s", *dns_listen)
+	}
+
+	// Finish the requests in progress on SIGINT or SIGTERM. The databases
+	// stay mapped until the process exits, in case a request outlives the
+	// shutdown timeout.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		sig := <-sigs
+		inetdata.Log.Infof("inetdata-serve received %s, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT*time.Second)
+		defer cancel()
+		if grpc_srv != nil {
+			go grpc_srv.GracefulStop()
+		}
+		for _, s := range dns_srvs {
+			go s.ShutdownContext(ctx)
+		}
+		srv.Shutdown(ctx)
+	}()
+
+	if e := srv.Serve(ln); e != nil && e != http.ErrServerClosed {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+	<-stopped
+}
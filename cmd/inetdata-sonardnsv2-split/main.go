@@ -5,6 +5,8 @@ import (
 	"flag"
 	"fmt"
 	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/dnsname"
+	"github.com/fathom6/inetdata-parsers/linereader"
 	"io"
 	"os"
 	"os/exec"
@@ -12,15 +14,41 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
-	"time"
 )
 
 var output_count int64 = 0
 var input_count int64 = 0
+var invalid_count int64 = 0
 var stdout_lock sync.Mutex
 var wg1 sync.WaitGroup
 var wg2 sync.WaitGroup
 
+// Counts the input lines and parsed records that have not been written
+var inflight sync.WaitGroup
+
+// Record types that receive their own output files in split mode
+var split_types = []string{"a", "aaaa", "cname", "mx", "ns", "ptr", "txt", "soa"}
+
+// Record types that also produce an inverse (value to name) output
+var inverse_types = map[string]bool{
+	"a":     true,
+	"aaaa":  true,
+	"cname": true,
+	"mx":    true,
+	"ns":    true,
+	"ptr":   true,
+}
+
+var split_by_type bool
+var normalize bool
+
+// Filters, see -only-types, -drop-invalid, and -max-name-length
+var only_types map[string]bool
+var drop_invalid bool
+var max_name_length int
+var outputs = map[string]chan string{}
+var sinks = map[string]io.Writer{}
+
 type OutputKey struct {
 	Key  string
 	Vals []string
@@ -34,143 +62,361 @@ type DNSRecord struct {
 }
 
 func usage() {
-	fmt.Println("Usage: " + os.Args[0] + " [options]")
+	fmt.Println("Usage: " + os.Args[0] + " [options] <base> [<input> ... <input>]")
 	fmt.Println("")
 	fmt.Println("Reads an unsorted Sonar v2 FDNS/RDNS JSONL from stdin, writes out sorted and merged normal and inverse CSVs.")
 	fmt.Println("")
+	fmt.Println("By default two files are created, <base>-names.gz and <base>-names-inverse.gz. With -split-types,")
+	fmt.Println("each record type is written to <base>-<type>.gz (" + strings.Join(split_types, ", ") + "), with")
+	fmt.Println("inverse records in <base>-<type>-inverse.gz and all remaining types in <base>-other.gz.")
+	fmt.Println("")
+	fmt.Println("With -only-types, records of other types are skipped. With -drop-invalid, records with")
+	fmt.Println("invalid UTF-8, empty or overlong labels, or illegal characters in their names, or control")
+	fmt.Println("characters in their values, are dropped. -max-name-length drops records with longer names.")
+	fmt.Println("With -rejects, the dropped records and unparseable lines are written to a compressed file,")
+	fmt.Println("each prefixed with its reason code and a tab.")
+	fmt.Println("")
+	fmt.Println("With -checkpoint-file, the parsed records are committed to compressed part files next to")
+	fmt.Println("the outputs every -checkpoint-interval input lines, and sorted once the input is complete.")
+	fmt.Println("A run restarted with the same arguments skips the committed lines.")
+	fmt.Println("")
 	fmt.Println("Options:")
 	flag.PrintDefaults()
 }
 
-func showProgress(quit chan int) {
-	start := time.Now()
-	for {
-		select {
-		case <-quit:
-			return
-		case <-time.After(time.Second * 1):
-			icount := atomic.LoadInt64(&input_count)
-			ocount := atomic.LoadInt64(&output_count)
-
-			if icount == 0 && ocount == 0 {
-				// Reset start, so that we show stats only from our first input
-				start = time.Now()
-				continue
-			}
-			elapsed := time.Since(start)
-			if elapsed.Seconds() > 1.0 {
-				fmt.Fprintf(os.Stderr, "[*] [inetdata-sonardnsv2-split] Read %d and wrote %d records in %d seconds (%d/s in, %d/s out)\n",
-					icount,
-					ocount,
-					int(elapsed.Seconds()),
-					int(float64(icount)/elapsed.Seconds()),
-					int(float64(ocount)/elapsed.Seconds()))
+func outputWriter(key string, c chan string) {
+	for r := range c {
+		sinks[key].Write([]byte(r))
+		atomic.AddInt64(&output_count, 1)
+		inflight.Done()
+	}
+	wg1.Done()
+}
+
+// A part file of the records of one output, used with -checkpoint-file
+type spoolFile struct {
+	fd *os.File
+	w  io.WriteCloser
+}
+
+func createSpool(path string) (*spoolFile, error) {
+	fd, e := os.Create(path)
+	if e != nil {
+		return nil, e
+	}
+
+	w, e := inetdata.NewOutputWriter(fd, "gzip", -1)
+	if e != nil {
+		fd.Close()
+		return nil, e
+	}
+	return &spoolFile{fd: fd, w: w}, nil
+}
+
+func (s *spoolFile) Write(b []byte) (int, error) {
+	return s.w.Write(b)
+}
+
+// Close flushes the part file to disk
+func (s *spoolFile) Close() error {
+	e := s.w.Close()
+	if se := s.fd.Sync(); e == nil {
+		e = se
+	}
+	if ce := s.fd.Close(); e == nil {
+		e = ce
+	}
+	return e
+}
+
+// Return the part file of an output for a chunk of the input
+func spoolPath(base string, key string, chunk int64) string {
+	return fmt.Sprintf("%s-%s.gz.part-%05d", base, key, chunk)
+}
+
+// Route a CSV line to the output for the record type
+func emit(rtype string, inverse bool, line string) {
+	key := "names"
+	if split_by_type {
+		key = "other"
+		for i := range split_types {
+			if split_types[i] == rtype {
+				key = rtype
+				break
 			}
 		}
 	}
+	if inverse {
+		key += "-inverse"
+	}
+	inflight.Add(1)
+	outputs[key] <- line
 }
 
-func outputWriter(fd io.WriteCloser, c chan string) {
-	for r := range c {
-		fd.Write([]byte(r))
-		atomic.AddInt64(&output_count, 1)
+func inputParser(c chan *linereader.Line) {
+	for l := range c {
+		parseRecord(l.Bytes)
+		l.Recycle()
+		inflight.Done()
 	}
-	wg1.Done()
+	wg2.Done()
 }
 
-func inputParser(c chan string, c_names chan string, c_inverse chan string) {
-
-	for r := range c {
+// Return the reason a record should be dropped with -drop-invalid or
+// -max-name-length, or an empty string to keep it
+func invalidReason(rec *DNSRecord) string {
+	if max_name_length > 0 && len(rec.Name) > max_name_length {
+		return dnsname.REASON_NAME_TOO_LONG
+	}
+	if !drop_invalid {
+		return ""
+	}
 
-		rec := DNSRecord{}
+	if reason := dnsname.CheckName(rec.Name, max_name_length); len(reason) > 0 {
+		return reason
+	}
 
-		mapped := map[string]string{}
-		err := json.Unmarshal([]byte(r), &mapped)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Bad JSON: %s\n", r)
-			continue
+	// Check the names in the values of name records
+	switch rec.Type {
+	case "cname", "ns", "ptr":
+		return dnsname.CheckName(rec.Value, max_name_length)
+	case "mx":
+		if parts := strings.SplitN(rec.Value, " ", 2); len(parts) == 2 {
+			return dnsname.CheckName(parts[1], max_name_length)
 		}
+	}
 
-		if val, ok := mapped["name"]; ok {
-			rec.Name = strings.TrimSpace(val)
-		} else {
-			continue
+	return dnsname.CheckValue(rec.Value)
+}
+
+// Parse a JSON record and emit its CSV lines
+func parseRecord(r []byte) {
+
+	rec := DNSRecord{}
+
+	mapped := map[string]string{}
+	err := json.Unmarshal(r, &mapped)
+	if err != nil {
+		inetdata.Log.Warnf("Bad JSON: %s", r)
+		atomic.AddInt64(&invalid_count, 1)
+		inetdata.Rejects.Reject(inetdata.REJECT_INVALID_JSON, string(r))
+		return
+	}
+
+	for _, field := range []string{"name", "type", "value", "timestamp"} {
+		if _, ok := mapped[field]; !ok {
+			atomic.AddInt64(&invalid_count, 1)
+			inetdata.Rejects.Reject(inetdata.REJECT_MISSING_FIELD, string(r))
+			return
 		}
+	}
 
-		if val, ok := mapped["type"]; ok {
-			rec.Type = strings.TrimSpace(val)
-		} else {
-			continue
+	rec.Name = strings.TrimSpace(mapped["name"])
+	rec.Type = strings.TrimSpace(mapped["type"])
+	rec.Value = strings.TrimSpace(mapped["value"])
+	rec.Timestamp = strings.TrimSpace(mapped["timestamp"])
+
+	if only_types != nil && !only_types[rec.Type] {
+		return
+	}
+
+	if reason := invalidReason(&rec); len(reason) > 0 {
+		atomic.AddInt64(&invalid_count, 1)
+		inetdata.Rejects.Reject(reason, string(r))
+		return
+	}
+
+	// Canonicalize the names with -normalize, skipping records with invalid names
+	if normalize {
+		if rec.Name, err = dnsname.Normalize(rec.Name); err != nil {
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_NAME, string(r))
+			return
 		}
 
-		if val, ok := mapped["value"]; ok {
-			rec.Value = strings.TrimSpace(val)
-		} else {
-			continue
+		switch rec.Type {
+		case "cname", "ns", "ptr":
+			if rec.Value, err = dnsname.Normalize(rec.Value); err != nil {
+				inetdata.Rejects.Reject(inetdata.REJECT_INVALID_NAME, string(r))
+				return
+			}
+		case "mx":
+			if parts := strings.SplitN(rec.Value, " ", 2); len(parts) == 2 {
+				mx, err := dnsname.Normalize(parts[1])
+				if err != nil {
+					inetdata.Rejects.Reject(inetdata.REJECT_INVALID_NAME, string(r))
+					return
+				}
+				rec.Value = parts[0] + " " + mx
+			}
 		}
+	}
 
-		if val, ok := mapped["timestamp"]; ok {
-			rec.Timestamp = strings.TrimSpace(val)
-		} else {
-			continue
+	// Skip any record that refers to itself
+	if rec.Value == rec.Name {
+		return
+	}
+
+	// Skip any record with an empty value
+	if len(rec.Value) == 0 || len(rec.Name) == 0 {
+		return
+	}
+
+	if rec.Type == "ptr" {
+		// Determine the field type based on pattern
+		if inetdata.Match_IPv4.Match([]byte(rec.Name)) {
+			rec.Type = "a"
+		} else if inetdata.Match_IPv6.Match([]byte(rec.Name)) {
+			rec.Type = "aaaa"
 		}
+	}
 
-		// Skip any record that refers to itself
-		if rec.Value == rec.Name {
-			continue
+	atomic.AddInt64(&input_count, 1)
+
+	switch rec.Type {
+	case "a":
+		// Skip invalid IPv4 records (TODO: verify logic)
+		if !(inetdata.Match_IPv4.Match([]byte(rec.Value)) || inetdata.Match_IPv4.Match([]byte(rec.Name))) {
+			return
 		}
+		emit(rec.Type, false, fmt.Sprintf("%s,%s,%s\n", rec.Name, rec.Type, rec.Value))
+		emit(rec.Type, true, fmt.Sprintf("%s,r-%s,%s\n", rec.Value, rec.Type, rec.Name))
 
-		// Skip any record with an empty value
-		if len(rec.Value) == 0 || len(rec.Name) == 0 {
-			continue
+	case "aaaa":
+		// Skip invalid IPv6 records (TODO: verify logic)
+		if !(inetdata.Match_IPv6.Match([]byte(rec.Value)) || inetdata.Match_IPv6.Match([]byte(rec.Name))) {
+			return
 		}
+		emit(rec.Type, false, fmt.Sprintf("%s,%s,%s\n", rec.Name, rec.Type, rec.Value))
+		emit(rec.Type, true, fmt.Sprintf("%s,r-%s,%s\n", rec.Value, rec.Type, rec.Name))
 
-		if rec.Type == "ptr" {
-			// Determine the field type based on pattern
-			if inetdata.Match_IPv4.Match([]byte(rec.Name)) {
-				rec.Type = "a"
-			} else if inetdata.Match_IPv6.Match([]byte(rec.Name)) {
-				rec.Type = "aaaa"
-			}
+	case "cname", "ns", "ptr":
+		emit(rec.Type, false, fmt.Sprintf("%s,%s,%s\n", rec.Name, rec.Type, rec.Value))
+		emit(rec.Type, true, fmt.Sprintf("%s,r-%s,%s\n", rec.Value, rec.Type, rec.Name))
+
+	case "mx":
+		parts := strings.SplitN(rec.Value, " ", 2)
+		if len(parts) != 2 || len(parts[1]) == 0 {
+			return
 		}
+		emit(rec.Type, false, fmt.Sprintf("%s,%s,%s\n", rec.Name, rec.Type, parts[1]))
+		emit(rec.Type, true, fmt.Sprintf("%s,r-%s,%s\n", parts[1], rec.Type, rec.Name))
 
-		atomic.AddInt64(&input_count, 1)
+	default:
+		// No inverse output for other record types (TXT, DNSSEC, etc)
+		emit(rec.Type, false, fmt.Sprintf("%s,%s,%s\n", rec.Name, rec.Type, rec.Value))
+	}
+}
 
-		switch rec.Type {
-		case "a":
-			// Skip invalid IPv4 records (TODO: verify logic)
-			if !(inetdata.Match_IPv4.Match([]byte(rec.Value)) || inetdata.Match_IPv4.Match([]byte(rec.Name))) {
-				continue
-			}
-			c_names <- fmt.Sprintf("%s,%s,%s\n", rec.Name, rec.Type, rec.Value)
-			c_inverse <- fmt.Sprintf("%s,r-%s,%s\n", rec.Value, rec.Type, rec.Name)
+// Start the sort, rollup, sort, and pigz pipeline that feeds the output file
+func startPipeline(out_fd io.Writer, sort_tmp string, sort_mem uint64) (io.WriteCloser, []*exec.Cmd) {
+	subprocs := []*exec.Cmd{}
 
-		case "aaaa":
-			// Skip invalid IPv6 records (TODO: verify logic)
-			if !(inetdata.Match_IPv6.Match([]byte(rec.Value)) || inetdata.Match_IPv6.Match([]byte(rec.Name))) {
-				continue
-			}
-			c_names <- fmt.Sprintf("%s,%s,%s\n", rec.Name, rec.Type, rec.Value)
-			c_inverse <- fmt.Sprintf("%s,r-%s,%s\n", rec.Value, rec.Type, rec.Name)
+	// Create a sort process
+	sort_proc := exec.Command("nice",
+		"sort",
+		"-u",
+		"--key=1",
+		"--field-separator=,",
+		"--compress-program=pigz",
+		fmt.Sprintf("--parallel=%d", inetdata.Workers),
+		fmt.Sprintf("--temporary-directory=%s", sort_tmp),
+		fmt.Sprintf("--buffer-size=%dG", sort_mem))
+
+	// Configure stdio
+	sort_stdin, sie := sort_proc.StdinPipe()
+	if sie != nil {
+		inetdata.Log.Errorf("failed to create sort stdin pipe: %s", sie)
+		os.Exit(1)
+	}
 
-		case "cname", "ns", "ptr":
-			c_names <- fmt.Sprintf("%s,%s,%s\n", rec.Name, rec.Type, rec.Value)
-			c_inverse <- fmt.Sprintf("%s,r-%s,%s\n", rec.Value, rec.Type, rec.Name)
+	sort_stdout, soe := sort_proc.StdoutPipe()
+	if soe != nil {
+		inetdata.Log.Errorf("failed to create sort stdout pipe: %s", soe)
+		os.Exit(1)
+	}
 
-		case "mx":
-			parts := strings.SplitN(rec.Value, " ", 2)
-			if len(parts) != 2 || len(parts[1]) == 0 {
-				continue
-			}
-			c_names <- fmt.Sprintf("%s,%s,%s\n", rec.Name, rec.Type, parts[1])
-			c_inverse <- fmt.Sprintf("%s,r-%s,%s\n", parts[1], rec.Type, rec.Name)
+	sort_proc.Stderr = os.Stderr
+	subprocs = append(subprocs, sort_proc)
 
-		default:
-			// No inverse output for other record types (TXT, DNSSEC, etc)
-			c_names <- fmt.Sprintf("%s,%s,%s\n", rec.Name, rec.Type, rec.Value)
-		}
+	// Start the sort process
+	inetdata.DetachSignals(sort_proc)
+	if e := sort_proc.Start(); e != nil {
+		inetdata.Log.Errorf("failed to execute the sort command: %s", e)
+		os.Exit(1)
 	}
-	wg2.Done()
+
+	// Create the inetdata-csvrollup process
+	roll_proc := exec.Command("nice", "inetdata-csvrollup")
+
+	// Configure stdio
+	roll_stdout, roe := roll_proc.StdoutPipe()
+	if roe != nil {
+		inetdata.Log.Errorf("failed to create sort stdout pipe: %s", roe)
+		os.Exit(1)
+	}
+
+	roll_proc.Stderr = os.Stderr
+	roll_proc.Stdin = sort_stdout
+	subprocs = append(subprocs, roll_proc)
+
+	// Start the rollup process
+	inetdata.DetachSignals(roll_proc)
+	if e := roll_proc.Start(); e != nil {
+		inetdata.Log.Errorf("failed to execute the inetdata-csvrollup command: %s", e)
+		os.Exit(1)
+	}
+
+	// Create a second sort process
+	sort2_proc := exec.Command("nice",
+		"sort",
+		"-u",
+		"--key=1",
+		"--field-separator=,",
+		"--compress-program=pigz",
+		fmt.Sprintf("--parallel=%d", inetdata.Workers),
+		fmt.Sprintf("--temporary-directory=%s", sort_tmp),
+		fmt.Sprintf("--buffer-size=%dG", sort_mem))
+
+	sort2_stdout, ssoe := sort2_proc.StdoutPipe()
+	if ssoe != nil {
+		inetdata.Log.Errorf("failed to create sort stdout pipe: %s", ssoe)
+		os.Exit(1)
+	}
+	sort2_proc.Stdin = roll_stdout
+	sort2_proc.Stderr = os.Stderr
+
+	subprocs = append(subprocs, sort2_proc)
+
+	// Start the sort process
+	inetdata.DetachSignals(sort2_proc)
+	if e := sort2_proc.Start(); e != nil {
+		inetdata.Log.Errorf("failed to execute the second sort command: %s", e)
+		os.Exit(1)
+	}
+
+	// Create a pigz compressor process
+	pigz_proc := exec.Command("nice", "pigz", "-c")
+
+	// Configure stdio
+	pigz_proc.Stderr = os.Stderr
+
+	// Feed output file with pigz output
+	pigz_proc.Stdout = out_fd
+
+	// Feed pigz with sort output
+	pigz_proc.Stdin = sort2_stdout
+
+	// Start the pigz process
+	inetdata.DetachSignals(pigz_proc)
+	e := pigz_proc.Start()
+	if e != nil {
+		inetdata.Log.Errorf("failed to execute the pigz command: %s", e)
+		os.Exit(1)
+	}
+
+	subprocs = append(subprocs, pigz_proc)
+
+	return sort_stdin, subprocs
 }
 
 func main() {
@@ -180,21 +426,88 @@ func main() {
 
 	flag.Usage = func() { usage() }
 	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
-	sort_mem := flag.Uint64("m", 1, "The maximum amount of memory to use, in gigabytes, for each of the six sort processes")
+	sort_mem := flag.Uint64("m", 1, "The maximum amount of memory to use, in gigabytes, for each sort process")
+	split := flag.Bool("split-types", false, "Write each record type to a separate set of output files")
+	normalized := flag.Bool("normalize", false, "Encode internationalized names as punycode and skip records with invalid names")
+	selected_types := flag.String("only-types", "", "Only split these comma-separated record types (ex: a,aaaa,cname)")
+	invalid := flag.Bool("drop-invalid", false, "Drop records with malformed names or values")
+	max_name := flag.Int("max-name-length", 0, "Drop records with names longer than this many bytes (0 for no limit, or 253 with -drop-invalid)")
+	reject_file := flag.String("reject-file", "", "An alias of -rejects")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	checkpoint_file := flag.String("checkpoint-file", "", "Commit progress to this file and resume from it when restarted")
+	checkpoint_interval := flag.Int64("checkpoint-interval", 10000000, "The number of input lines between checkpoints")
 	version := flag.Bool("version", false, "Show the version and build timestamp")
 
-	flag.Parse()
+	inetdata.AddTuningFlags()
+	inetdata.AddJSONSampleFlags("name")
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-sonardnsv2-split")
 
 	if *version {
 		inetdata.PrintVersion("inetdata-sonardnsv2-split")
 		os.Exit(0)
 	}
 
-	if len(flag.Args()) != 1 {
+	inetdata.HandleSignals("inetdata-sonardnsv2-split")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	split_by_type = *split
+	normalize = *normalized
+	drop_invalid = *invalid
+	max_name_length = *max_name
+
+	if max_name_length < 0 {
+		inetdata.Log.Errorf("-max-name-length must not be negative")
+		usage()
+		os.Exit(1)
+	}
+
+	if len(*selected_types) > 0 {
+		only_types = make(map[string]bool)
+		for _, t := range strings.Split(strings.ToLower(*selected_types), ",") {
+			only_types[strings.TrimSpace(t)] = true
+		}
+	}
+
+	if len(flag.Args()) < 1 {
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	inputs, ie := inetdata.InputPaths(flag.Args()[1:], *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
 	if len(*sort_tmp) == 0 {
 		*sort_tmp = os.Getenv("HOME")
 	}
@@ -206,160 +519,233 @@ func main() {
 
 	// Output files
 	base := flag.Args()[0]
-	out_fds := []*os.File{}
 
-	suffix := []string{"-names.gz", "-names-inverse.gz"}
-	for i := range suffix {
-		fd, e := os.Create(base + suffix[i])
-		if e != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to create %s: %s\n", base+suffix[i], e)
-			os.Exit(1)
+	keys := []string{"names", "names-inverse"}
+	if split_by_type {
+		keys = []string{}
+		for _, t := range split_types {
+			keys = append(keys, t)
+			if inverse_types[t] {
+				keys = append(keys, t+"-inverse")
+			}
 		}
-		out_fds = append(out_fds, fd)
-		defer fd.Close()
+		keys = append(keys, "other")
 	}
 
-	// Sort and compression pipes
-	sort_input := [2]io.WriteCloser{}
-	subprocs := []*exec.Cmd{}
+	if len(*reject_file) > 0 && len(inetdata.RejectsPath) == 0 {
+		inetdata.RejectsPath = *reject_file
+	}
 
-	for i := range out_fds {
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
 
-		// Create a sort process
-		sort_proc := exec.Command("nice",
-			"sort",
-			"-u",
-			"--key=1",
-			"--field-separator=,",
-			"--compress-program=pigz",
-			fmt.Sprintf("--parallel=%d", runtime.NumCPU()),
-			fmt.Sprintf("--temporary-directory=%s", *sort_tmp),
-			fmt.Sprintf("--buffer-size=%dG", *sort_mem))
-
-		// Configure stdio
-		sort_stdin, sie := sort_proc.StdinPipe()
-		if sie != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to create sort stdin pipe: %s\n", sie)
-			os.Exit(1)
-		}
+	var cp *inetdata.Checkpoint
+	var skip_lines int64 = 0
+	var chunk int64 = 0
 
-		sort_stdout, soe := sort_proc.StdoutPipe()
-		if soe != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to create sort stdout pipe: %s\n", soe)
+	if len(*checkpoint_file) > 0 {
+		if *checkpoint_interval < 1 {
+			inetdata.Log.Errorf("-checkpoint-interval must be at least 1")
 			os.Exit(1)
 		}
 
-		sort_proc.Stderr = os.Stderr
-		sort_input[i] = sort_stdin
-		subprocs = append(subprocs, sort_proc)
-
-		// Start the sort process
-		if e := sort_proc.Start(); e != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to execute the sort command: %s\n", e)
+		var ce error
+		cp, ce = inetdata.OpenCheckpoint(*checkpoint_file, inputs)
+		if ce != nil {
+			inetdata.Log.Errorf("%s", ce)
 			os.Exit(1)
 		}
 
-		// Create the inetdata-csvrollup process
-		roll_proc := exec.Command("nice", "inetdata-csvrollup")
-
-		// Configure stdio
-		roll_stdout, roe := roll_proc.StdoutPipe()
-		if roe != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to create sort stdout pipe: %s\n", roe)
-			os.Exit(1)
+		skip_lines, _ = cp.Offset("lines")
+		chunk, _ = cp.Offset("chunks")
+		if cp.Resumed() {
+			inetdata.Log.Infof("Resuming from line %d with %d committed parts", skip_lines, len(cp.PartNames()))
 		}
+	}
 
-		roll_proc.Stderr = os.Stderr
-		roll_proc.Stdin = sort_stdout
-		subprocs = append(subprocs, roll_proc)
+	out_fds := []io.WriteCloser{}
+	sort_input := []io.WriteCloser{}
+	subprocs := []*exec.Cmd{}
 
-		// Start the rollup process
-		if e := roll_proc.Start(); e != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to execute the inetdata-csvrollup command: %s\n", e)
-			os.Exit(1)
-		}
+	// Start the sort pipelines, which read the part files instead of the
+	// parsers when checkpointing
+	startOutputs := func() {
+		for _, key := range keys {
+			fname := base + "-" + key + ".gz"
+			fd, e := inetdata.CreateOutput(fname)
+			if e != nil {
+				inetdata.Log.Errorf("failed to create %s: %s", fname, e)
+				os.Exit(1)
+			}
+			out_fds = append(out_fds, fd)
 
-		// Create a second sort process
-		sort2_proc := exec.Command("nice",
-			"sort",
-			"-u",
-			"--key=1",
-			"--field-separator=,",
-			"--compress-program=pigz",
-			fmt.Sprintf("--parallel=%d", runtime.NumCPU()),
-			fmt.Sprintf("--temporary-directory=%s", *sort_tmp),
-			fmt.Sprintf("--buffer-size=%dG", *sort_mem))
-
-		sort2_stdout, ssoe := sort2_proc.StdoutPipe()
-		if ssoe != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to create sort stdout pipe: %s\n", ssoe)
-			os.Exit(1)
+			// Sort and compression pipes
+			sort_stdin, procs := startPipeline(fd, *sort_tmp, *sort_mem)
+			sort_input = append(sort_input, sort_stdin)
+			subprocs = append(subprocs, procs...)
+			sinks[key] = sort_stdin
 		}
-		sort2_proc.Stdin = roll_stdout
-		sort2_proc.Stderr = os.Stderr
+	}
 
-		subprocs = append(subprocs, sort2_proc)
+	spools := map[string]*spoolFile{}
 
-		// Start the sort process
-		if e := sort2_proc.Start(); e != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to execute the second sort command: %s\n", e)
-			os.Exit(1)
+	// Open the part files for the current chunk
+	openSpools := func() {
+		for _, key := range keys {
+			sf, e := createSpool(spoolPath(base, key, chunk))
+			if e != nil {
+				inetdata.Log.Errorf("failed to create part file: %s", e)
+				os.Exit(1)
+			}
+			spools[key] = sf
+			sinks[key] = sf
 		}
+	}
 
-		// Create a pigz compressor process
-		pigz_proc := exec.Command("nice", "pigz", "-c")
+	// Close the part files of the current chunk and record them
+	closeSpools := func() {
+		for _, key := range keys {
+			if e := spools[key].Close(); e != nil {
+				inetdata.Log.Errorf("failed to write part file: %s", e)
+				os.Exit(1)
+			}
+			cp.AddPart(spoolPath(base, key, chunk))
+		}
+		chunk++
+	}
 
-		// Configure stdio
-		pigz_proc.Stderr = os.Stderr
+	if cp == nil {
+		startOutputs()
+	} else {
+		openSpools()
+	}
 
-		// Feed output file with pigz output
-		pigz_proc.Stdout = out_fds[i]
+	for _, key := range keys {
+		outputs[key] = make(chan string, inetdata.QueueDepth)
+		go outputWriter(key, outputs[key])
+		wg1.Add(1)
+	}
 
-		// Feed pigz with sort output
-		pigz_proc.Stdin = sort2_stdout
+	progress := inetdata.NewProgress("inetdata-sonardnsv2-split", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.Errors = &invalid_count
 
-		// Start the pigz process
-		e := pigz_proc.Start()
-		if e != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to execute the pigz command: %s\n", e)
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
 			os.Exit(1)
 		}
-
-		subprocs = append(subprocs, pigz_proc)
 	}
 
-	c_names := make(chan string, 1000)
-	c_inverse := make(chan string, 1000)
-
-	go outputWriter(sort_input[0], c_names)
-	go outputWriter(sort_input[1], c_inverse)
-	wg1.Add(2)
-
 	// Progress tracker
 	quit := make(chan int)
-	go showProgress(quit)
+	go progress.Run(quit)
 
 	// Parse stdin
-	c_inp := make(chan string, 1000)
-	go inputParser(c_inp, c_names, c_inverse)
-	go inputParser(c_inp, c_names, c_inverse)
+	c_inp := make(chan *linereader.Line, inetdata.QueueDepth)
+	progress.AddStage("input", func() int { return len(c_inp) })
+	go inputParser(c_inp)
+	go inputParser(c_inp)
 	wg2.Add(2)
 
-	// Reader closes c_inp on completion
-	e := inetdata.ReadLines(os.Stdin, c_inp)
-	if e != nil {
-		fmt.Fprintf(os.Stderr, "Error reading input: %s\n", e)
+	// Reader closes l_ch on completion
+	l_ch := make(chan *linereader.Line, inetdata.QueueDepth)
+	r_err := make(chan error, 1)
+	go func() {
+		r_err <- inetdata.ReadLineBytesFromInputs(inputs, *input_compression, progress.CountReader, l_ch)
+	}()
+
+	var lines int64 = 0
+
+	for l := range l_ch {
+		lines++
+		if lines <= skip_lines {
+			l.Recycle()
+			continue
+		}
+
+		// Wait for the parsed records to reach the part files before committing
+		if cp != nil && lines%*checkpoint_interval == 0 {
+			inflight.Wait()
+			closeSpools()
+			cp.SetOffset("lines", lines-1)
+			cp.SetOffset("chunks", chunk)
+			if e := cp.Commit(); e != nil {
+				inetdata.Log.Errorf("Failed to commit the checkpoint: %s", e)
+				os.Exit(1)
+			}
+			openSpools()
+		}
+
+		inflight.Add(1)
+		c_inp <- l
+	}
+	close(c_inp)
+
+	if e := <-r_err; e != nil {
+		inetdata.Log.Errorf("Failed to read input: %s", e)
+		if cp != nil {
+			os.Exit(1)
+		}
 	}
 
 	// Wait for the input parsers to finish
 	wg2.Wait()
 
-	close(c_names)
-	close(c_inverse)
+	inetdata.CloseRejects()
+
+	for _, c := range outputs {
+		close(c)
+	}
 
 	// Wait for the channel writers to finish
 	wg1.Wait()
 
+	// An interrupted run commits its progress for the next run to resume
+	if cp != nil && inetdata.Interrupted() {
+		closeSpools()
+		cp.SetOffset("lines", lines)
+		cp.SetOffset("chunks", chunk)
+		if e := cp.Commit(); e != nil {
+			inetdata.Log.Errorf("Failed to commit the checkpoint: %s", e)
+			os.Exit(1)
+		}
+		quit <- 0
+		inetdata.Log.Infof("Committed %d lines to %s", lines, *checkpoint_file)
+		os.Exit(inetdata.EXIT_INTERRUPTED)
+	}
+
+	if cp != nil {
+		closeSpools()
+		startOutputs()
+
+		// Feed each sort pipeline with the part files of its output
+		parts := cp.PartNames()
+		var wf sync.WaitGroup
+		for _, key := range keys {
+			key_parts := []string{}
+			prefix := base + "-" + key + ".gz.part-"
+			for _, path := range parts {
+				if strings.HasPrefix(path, prefix) {
+					key_parts = append(key_parts, path)
+				}
+			}
+
+			wf.Add(1)
+			go func(key string, key_parts []string) {
+				defer wf.Done()
+				r := inetdata.NewMultiInputReader(key_parts, "gzip", nil)
+				if _, e := io.Copy(sinks[key], r); e != nil {
+					inetdata.Log.Errorf("failed to read the part files of %s: %s", key, e)
+					os.Exit(1)
+				}
+			}(key, key_parts)
+		}
+		wf.Wait()
+	}
+
 	for i := range sort_input {
 		sort_input[i].Close()
 	}
@@ -372,7 +758,27 @@ func main() {
 		subprocs[i].Wait()
 	}
 
+	out_names := []string{}
+	for _, key := range keys {
+		out_names = append(out_names, base+"-"+key+".gz")
+	}
+
+	failed := false
 	for i := range out_fds {
-		out_fds[i].Close()
+		if e := out_fds[i].Close(); e != nil {
+			inetdata.Log.Warnf("Failed to write output: %s", e)
+			failed = true
+		}
+	}
+
+	// Keep the part files if the outputs need to be written again
+	if cp != nil && !failed {
+		for _, path := range cp.PartNames() {
+			os.Remove(path)
+		}
+		cp.Remove()
 	}
+
+	inetdata.ExitIfInterrupted(out_names...)
+	inetdata.CheckErrorBudget(input_count)
 }
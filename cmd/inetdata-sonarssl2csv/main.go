@@ -0,0 +1,430 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/dnsname"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var output_count int64 = 0
+var input_count int64 = 0
+var invalid_count int64 = 0
+var wg sync.WaitGroup
+
+var ip_key = "hex"
+var normalize bool
+
+// The kinds of study files
+var input_kinds = []string{"certs", "hosts", "names"}
+
+// Quotes the issuer and subject of the cert-info output
+var info_splitter *inetdata.FieldSplitter
+
+// The outputs, see output_keys
+var cert_names, host_certs, cert_info *inetdata.SortedOutput
+
+var output_keys = []string{"cert-names", "host-certs", "cert-info"}
+
+// A line of a study file of a kind
+type studyLine struct {
+	kind string
+	line string
+}
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <base> [<input> ... <input>]")
+	fmt.Println("")
+	fmt.Println("Reads the files of a Sonar SSL certificate study and writes three linked, sorted, and")
+	fmt.Println("deduplicated CSVs, keyed by the SHA1 hash of each certificate:")
+	fmt.Println("")
+	fmt.Println("  <base>-cert-names.csv.gz : sha1,name for the names of the names files, and the")
+	fmt.Println("                             subject CN, DNS SANs, and IP SANs of the certs files")
+	fmt.Println("  <base>-host-certs.csv.gz : ip,sha1 for the hosts files, with the IP encoded by -ip-key")
+	fmt.Println("  <base>-cert-info.csv.gz  : sha1,not_before,not_after,issuer,subject for the certs")
+	fmt.Println("                             files, with Unix timestamps and quoted distinguished names")
+	fmt.Println("")
+	fmt.Println("The kind of each input is taken from its file name (20131030_certs.gz, _hosts, _names),")
+	fmt.Println("or set for all inputs with -type. Certs files have sha1,<base64 DER certificate> lines,")
+	fmt.Println("hosts files ip,sha1 lines, and names files sha1,name lines.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+// Return the kind of a study file from its name, or an empty string
+func inputKind(path string) string {
+	name := strings.ToLower(filepath.Base(path))
+	for _, kind := range input_kinds {
+		if strings.Contains(name, "_"+kind) {
+			return kind
+		}
+	}
+	return ""
+}
+
+// Return the lowercase hash of a line, or false if it is not a SHA1 hash
+func parseHash(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	if !inetdata.Match_SHA1.MatchString(s) {
+		return "", false
+	}
+	if _, e := hex.DecodeString(s); e != nil {
+		return "", false
+	}
+	return strings.ToLower(s), true
+}
+
+// Return a certificate name in canonical form, or false to skip it
+func certName(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+	if len(name) == 0 || strings.ContainsAny(name, " ,\n") {
+		return "", false
+	}
+	if !normalize {
+		return name, true
+	}
+	n, e := dnsname.Normalize(name)
+	return n, e == nil
+}
+
+func reject(reason string, line string) {
+	atomic.AddInt64(&invalid_count, 1)
+	inetdata.Rejects.Reject(reason, line)
+}
+
+func parseCert(raw string) {
+	bits := strings.SplitN(raw, ",", 2)
+	if len(bits) != 2 {
+		reject(inetdata.REJECT_INVALID_LINE, raw)
+		return
+	}
+
+	der, e := base64.StdEncoding.DecodeString(strings.TrimSpace(bits[1]))
+	if e != nil {
+		reject(inetdata.REJECT_INVALID_CERT, raw)
+		return
+	}
+
+	cert, e := inetdata.ParseCertificate(der)
+	if e != nil {
+		reject(inetdata.REJECT_INVALID_CERT, raw)
+		return
+	}
+
+	hash, ok := parseHash(bits[0])
+	if !ok {
+		sum := sha1.Sum(der)
+		hash = hex.EncodeToString(sum[:])
+	}
+
+	atomic.AddInt64(&input_count, 1)
+
+	names := map[string]bool{}
+	if inetdata.Match_IPv4.MatchString(cert.Subject.CommonName) || dnsname.ValidHostname(strings.TrimPrefix(cert.Subject.CommonName, "*.")) {
+		if n, ok := certName(cert.Subject.CommonName); ok {
+			names[n] = true
+		}
+	}
+	for _, alt := range cert.DNSNames {
+		if n, ok := certName(alt); ok {
+			names[n] = true
+		}
+	}
+	for _, ip := range cert.IPAddresses {
+		names[ip.String()] = true
+	}
+
+	for n := range names {
+		cert_names.Add(hash + "," + n)
+	}
+
+	cert_info.Add(info_splitter.Join(
+		hash,
+		strconv.FormatInt(cert.NotBefore.Unix(), 10),
+		strconv.FormatInt(cert.NotAfter.Unix(), 10),
+		cert.Issuer.String(),
+		cert.Subject.String()))
+}
+
+func parseHost(raw string) {
+	bits := strings.Split(raw, ",")
+	if len(bits) < 2 {
+		reject(inetdata.REJECT_INVALID_LINE, raw)
+		return
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(bits[0]))
+	hash, ok := parseHash(bits[1])
+	if ip == nil || !ok {
+		reject(inetdata.REJECT_INVALID_LINE, raw)
+		return
+	}
+
+	atomic.AddInt64(&input_count, 1)
+	host_certs.Add(string(inetdata.EncodeIPKey(ip, ip_key)) + "," + hash)
+}
+
+func parseName(raw string) {
+	bits := strings.SplitN(raw, ",", 2)
+	if len(bits) != 2 {
+		reject(inetdata.REJECT_INVALID_LINE, raw)
+		return
+	}
+
+	hash, ok := parseHash(bits[0])
+	if !ok {
+		reject(inetdata.REJECT_INVALID_LINE, raw)
+		return
+	}
+
+	name, ok := certName(bits[1])
+	if !ok {
+		reject(inetdata.REJECT_INVALID_NAME, raw)
+		return
+	}
+
+	atomic.AddInt64(&input_count, 1)
+	cert_names.Add(hash + "," + name)
+}
+
+func inputParser(c <-chan studyLine) {
+	defer wg.Done()
+
+	for r := range c {
+		raw := strings.TrimRight(r.line, "\r")
+		if len(raw) == 0 {
+			continue
+		}
+
+		switch r.kind {
+		case "certs":
+			parseCert(raw)
+		case "hosts":
+			parseHost(raw)
+		case "names":
+			parseName(raw)
+		}
+	}
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	input_type := flag.String("type", "", "The kind of every input: certs, hosts, or names (default from the file names)")
+	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
+	sort_mem := flag.Uint64("sort-mem", 1, "The maximum amount of memory to use, in gigabytes, for the sorting phase of each output")
+	selected_ip_key := flag.String("ip-key", ip_key, "Encode the IP keys of the host-certs output in this encoding: none or hex")
+	normalized := flag.Bool("normalize", false, "Encode internationalized names as punycode and skip invalid names")
+	output_compression := flag.String("output-compression", "gzip", "The output compression: none, gzip, zstd, or lz4")
+	compression_level := flag.Int("compression-level", -1, "The output compression level, -1 uses the default for the codec")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the input files matching this glob pattern, in lexical order (ex: 'part-*.csv.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddSampleFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+	inetdata.AddCertParseFlags()
+
+	inetdata.ParseFlags("inetdata-sonarssl2csv")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-sonarssl2csv")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-sonarssl2csv")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.ValidSampleFlags(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidOutputCompression(*output_compression) {
+		inetdata.Log.Errorf("Invalid output compression specified: %s", *output_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	// Binary keys may contain commas and newlines
+	if *selected_ip_key != "none" && *selected_ip_key != "hex" {
+		inetdata.Log.Errorf("Invalid IP key format specified: %s", *selected_ip_key)
+		usage()
+		os.Exit(1)
+	}
+
+	if len(*input_type) > 0 && inputKind("_"+*input_type) != *input_type {
+		inetdata.Log.Errorf("Invalid input type specified: %s", *input_type)
+		usage()
+		os.Exit(1)
+	}
+
+	ip_key = *selected_ip_key
+	normalize = *normalized
+	info_splitter, _ = inetdata.NewFieldSplitter(",", true, "\"", "")
+
+	if len(flag.Args()) < 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args()[1:], *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	// Group the inputs by kind, in the order they are given
+	kinds := []string{}
+	by_kind := map[string][]string{}
+	for _, path := range inputs {
+		kind := *input_type
+		if len(kind) == 0 {
+			kind = inputKind(path)
+		}
+		if len(kind) == 0 {
+			inetdata.Log.Errorf("Can not tell the kind of %s, use -type", path)
+			os.Exit(1)
+		}
+		if _, ok := by_kind[kind]; !ok {
+			kinds = append(kinds, kind)
+		}
+		by_kind[kind] = append(by_kind[kind], path)
+	}
+
+	if len(*sort_tmp) == 0 {
+		*sort_tmp = os.Getenv("HOME")
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if e := inetdata.ApplyCertParse(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	base := flag.Args()[0]
+	ext := ".csv" + inetdata.OutputCompressionExtension(*output_compression)
+	out_names := []string{}
+
+	outputs := []*inetdata.SortedOutput{}
+	for _, key := range output_keys {
+		name := base + "-" + key + ext
+		o, e := inetdata.NewSortedOutput(name, *output_compression, *compression_level, *sort_tmp, *sort_mem*1024*1024*1024, &output_count)
+		if e != nil {
+			inetdata.Log.Errorf("failed to create %s: %s", name, e)
+			os.Exit(1)
+		}
+		outputs = append(outputs, o)
+		out_names = append(out_names, name)
+	}
+	cert_names, host_certs, cert_info = outputs[0], outputs[1], outputs[2]
+
+	progress := inetdata.NewProgress("inetdata-sonarssl2csv", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.Errors = &invalid_count
+	progress.AddCounter("lenient", inetdata.LenientCount())
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	// Parse the inputs
+	c_inp := make(chan studyLine, inetdata.QueueDepth)
+	progress.AddStage("input", func() int { return len(c_inp) })
+
+	for i := 0; i < inetdata.Workers; i++ {
+		go inputParser(c_inp)
+		wg.Add(1)
+	}
+
+	// Read each kind of input in turn, tagging its lines with the kind
+	for _, kind := range kinds {
+		c_raw := make(chan string, inetdata.QueueDepth)
+		done := make(chan bool)
+		go func(kind string) {
+			for line := range c_raw {
+				c_inp <- studyLine{kind: kind, line: line}
+			}
+			done <- true
+		}(kind)
+
+		e := inetdata.ReadLinesFromInputs(by_kind[kind], *input_compression, progress.CountReader, c_raw)
+		<-done
+		if e != nil {
+			inetdata.Log.Warnf("Failed to read input: %s", e)
+		}
+	}
+	close(c_inp)
+
+	wg.Wait()
+
+	// The sorters write their output once their input is closed
+	failed := false
+	for _, o := range outputs {
+		if e := o.Close(); e != nil {
+			inetdata.Log.Warnf("Failed to write %s: %s", o.Path, e)
+			failed = true
+		}
+	}
+
+	quit <- 0
+
+	inetdata.ReportLenientCerts()
+	inetdata.CloseRejects()
+
+	if failed {
+		os.Exit(1)
+	}
+
+	inetdata.ExitIfInterrupted(out_names...)
+	inetdata.CheckErrorBudget(input_count)
+}
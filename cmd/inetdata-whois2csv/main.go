@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/dnsname"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var output_count int64 = 0
+var input_count int64 = 0
+var invalid_count int64 = 0
+
+var csv_header = []string{"domain", "registrar", "created", "expires", "nameservers", "registrant_country", "template"}
+
+// The layouts of WHOIS dates, tried in order on the first word of a value
+var date_layouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	"02-Jan-2006",
+	"2006/01/02",
+	"2006.01.02",
+	"02.01.2006",
+	"20060102",
+}
+
+// The largest record that is kept, larger records are rejected
+const MAX_RECORD_LINES = 10000
+
+type whoisField struct {
+	key   string
+	value string
+}
+
+// A WHOIS record: its key/value pairs in order and its raw lines
+type whoisRecord struct {
+	fields []whoisField
+	raw    []string
+}
+
+// Return the non-empty values of the keys, in record order
+func (r *whoisRecord) values(keys []string) []string {
+	res := []string{}
+	for _, f := range r.fields {
+		if len(f.value) == 0 {
+			continue
+		}
+		for _, key := range keys {
+			if f.key == key {
+				res = append(res, f.value)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// Return the first non-empty value of the keys
+func (r *whoisRecord) first(keys []string) string {
+	if vals := r.values(keys); len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+// Return true if the record has any of the keys
+func (r *whoisRecord) has(keys []string) bool {
+	for _, f := range r.fields {
+		for _, key := range keys {
+			if f.key == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] [<whois-dump> ... <whois-dump>]")
+	fmt.Println("")
+	fmt.Println("Parses bulk domain WHOIS text dumps from the arguments or stdin, which may be compressed,")
+	fmt.Println("and writes a normalized CSV row for each domain:")
+	fmt.Println("")
+	fmt.Println("  " + strings.Join(csv_header, ","))
+	fmt.Println("")
+	fmt.Println("A record starts at the domain line of a registry format and ends at the next one, or at")
+	fmt.Println("a '>>> Last update' line. The format of each record is detected, or set with -template:")
+	fmt.Println("")
+	for _, name := range templateNames() {
+		fmt.Printf("  %-10s %s\n", name, templates[name].Description)
+	}
+	fmt.Println("")
+	fmt.Println("Domains and name servers are lowercased and internationalized names are encoded as")
+	fmt.Println("punycode. Dates are written as YYYY-MM-DD, and name servers are separated by semicolons.")
+	fmt.Println("Fields that a format does not have are left empty. Records of an unknown format or with")
+	fmt.Println("an invalid domain are skipped, and written to the -rejects file with their lines escaped.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+// Split a line into a lowercase key and a value. Keys end at a colon that is
+// followed by whitespace or the end of the line, so that URLs and IPv6
+// addresses are values, and JPRS keys are in brackets.
+func splitLine(line string) (string, string, bool) {
+	t := strings.TrimSpace(line)
+
+	if strings.HasPrefix(t, "[") {
+		if i := strings.Index(t, "]"); i > 1 {
+			return "[" + normalizeKey(t[1:i]) + "]", strings.TrimSpace(t[i+1:]), true
+		}
+		return "", t, false
+	}
+
+	for i := 1; i < len(t); i++ {
+		if t[i] != ':' {
+			continue
+		}
+		if i+1 < len(t) && t[i+1] != ' ' && t[i+1] != '\t' {
+			continue
+		}
+		key := normalizeKey(t[:i])
+		if strings.ContainsAny(key, ".") {
+			return "", t, false
+		}
+		return key, strings.TrimSpace(t[i+1:]), true
+	}
+	return "", t, false
+}
+
+// Lowercase a key and collapse its whitespace
+func normalizeKey(key string) string {
+	return strings.ToLower(strings.Join(strings.Fields(key), " "))
+}
+
+// Return the indentation of a line
+func indentation(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " \t"))
+}
+
+// Normalize a date to YYYY-MM-DD, or return an empty string
+func normalizeDate(value string) string {
+	bits := strings.Fields(value)
+	if len(bits) == 0 {
+		return ""
+	}
+	for _, layout := range date_layouts {
+		if t, e := time.Parse(layout, bits[0]); e == nil {
+			return t.Format("2006-01-02")
+		}
+	}
+	return ""
+}
+
+// Normalize the name servers: the first word of each value (without glue
+// addresses), lowercased and deduplicated
+func normalizeNameServers(values []string) string {
+	seen := map[string]bool{}
+	res := []string{}
+	for _, v := range values {
+		bits := strings.Fields(v)
+		if len(bits) == 0 {
+			continue
+		}
+		ns, e := dnsname.Normalize(bits[0])
+		if e != nil || seen[ns] {
+			continue
+		}
+		seen[ns] = true
+		res = append(res, ns)
+	}
+	return strings.Join(res, ";")
+}
+
+// Return a two-letter country code, uppercased, or an empty string
+func normalizeCountry(value string) string {
+	if len(value) != 2 {
+		return ""
+	}
+	for _, c := range value {
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')) {
+			return ""
+		}
+	}
+	return strings.ToUpper(value)
+}
+
+// Return the name of the template of a record, or an empty string
+func detectTemplate(r *whoisRecord, names []string) string {
+	for _, name := range names {
+		t := templates[name]
+		if t.matches(r) {
+			return name
+		}
+	}
+	return ""
+}
+
+// Convert a record to a CSV row with its template
+func convertRecord(r *whoisRecord, names []string) ([]string, string) {
+	name := detectTemplate(r, names)
+	if len(name) == 0 {
+		return nil, inetdata.REJECT_INVALID_ENTRY
+	}
+	t := templates[name]
+
+	domain, e := dnsname.Normalize(r.first(t.Domain))
+	if e != nil || len(domain) == 0 {
+		return nil, inetdata.REJECT_INVALID_NAME
+	}
+
+	// Nominet registrars end with their tag, such as "Gandi [Tag = GANDI]"
+	registrar := r.first(t.Registrar)
+	if i := strings.Index(registrar, " [Tag"); i > 0 {
+		registrar = registrar[:i]
+	}
+
+	return []string{
+		domain,
+		strings.TrimSpace(registrar),
+		normalizeDate(r.first(t.Created)),
+		normalizeDate(r.first(t.Expires)),
+		normalizeNameServers(r.values(t.NameServers)),
+		normalizeCountry(r.first(t.Country)),
+		name,
+	}, ""
+}
+
+// Parse a WHOIS dump, calling emit for every record
+func parseInput(input io.Reader, names []string, emit func([]string)) error {
+	scanner := bufio.NewScanner(input)
+	buf := make([]byte, 0, 1024*1024)
+	scanner.Buffer(buf, 1024*1024)
+
+	starts := domainKeys(names)
+
+	var rec *whoisRecord
+	section := ""
+	section_indent := 0
+
+	flush := func() {
+		if rec == nil {
+			return
+		}
+		atomic.AddInt64(&input_count, 1)
+
+		row, reason := convertRecord(rec, names)
+		if len(reason) > 0 {
+			atomic.AddInt64(&invalid_count, 1)
+			inetdata.Rejects.Reject(reason, strings.Join(rec.raw, "\n"))
+		} else {
+			emit(row)
+		}
+		rec = nil
+	}
+
+	for scanner.Scan() {
+		if inetdata.Interrupted() {
+			break
+		}
+
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		trimmed := strings.TrimSpace(line)
+
+		// The ICANN format ends records with the database update time,
+		// followed by the terms of use
+		if strings.HasPrefix(trimmed, ">>>") {
+			flush()
+			continue
+		}
+
+		if len(trimmed) == 0 || trimmed[0] == '%' || trimmed[0] == '#' {
+			section = ""
+			if rec != nil && len(trimmed) > 0 {
+				rec.raw = append(rec.raw, line)
+			}
+			continue
+		}
+
+		indent := indentation(line)
+		key, value, ok := splitLine(line)
+
+		// The lines of a section are indented more than its key
+		if len(section) > 0 && indent > section_indent {
+			if rec != nil {
+				if ok {
+					key = section + "/" + key
+				} else {
+					key, value = section, trimmed
+				}
+				rec.fields = append(rec.fields, whoisField{key: key, value: value})
+				rec.raw = append(rec.raw, line)
+			}
+			continue
+		}
+		section = ""
+
+		if !ok {
+			if rec != nil {
+				rec.raw = append(rec.raw, line)
+			}
+			continue
+		}
+
+		// A domain key starts the next record, lines before the first are skipped
+		if starts[key] {
+			flush()
+			rec = &whoisRecord{}
+		}
+		if rec == nil {
+			continue
+		}
+
+		if len(rec.raw) >= MAX_RECORD_LINES {
+			atomic.AddInt64(&invalid_count, 1)
+			inetdata.Rejects.Reject(inetdata.REJECT_TOO_LARGE, strings.Join(rec.raw[:1], "\n"))
+			rec = nil
+			continue
+		}
+
+		if len(value) == 0 {
+			section, section_indent = key, indent
+		}
+		rec.fields = append(rec.fields, whoisField{key: key, value: value})
+		rec.raw = append(rec.raw, line)
+	}
+
+	flush()
+	return scanner.Err()
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	selected_template := flag.String("template", "auto", "The registry format: auto, "+strings.Join(templateNames(), ", "))
+	header := flag.Bool("header", false, "Write a header row")
+	output_path := flag.String("output", "", "Write to this file or URL instead of stdout (ex: whois.csv.gz)")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	input_glob := flag.String("input-glob", "", "Also read the dumps matching this glob pattern, in lexical order (ex: 'whois-*.txt.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddMetaFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-whois2csv")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-whois2csv")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-whois2csv")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	names := template_order
+	if *selected_template != "auto" {
+		if _, ok := templates[*selected_template]; !ok {
+			inetdata.Log.Errorf("Invalid template specified: %s", *selected_template)
+			usage()
+			os.Exit(1)
+		}
+		names = []string{*selected_template}
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args(), *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidMetaOutput(*output_path) {
+		inetdata.Log.Errorf("-meta requires -output with a local file")
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	dest, de := inetdata.CreateOutput(*output_path)
+	if de != nil {
+		inetdata.Log.Errorf("%s", de)
+		os.Exit(1)
+	}
+
+	out := bufio.NewWriterSize(dest, 1024*1024)
+	w := csv.NewWriter(out)
+
+	if *header {
+		w.Write(csv_header)
+	}
+
+	progress := inetdata.NewProgress("inetdata-whois2csv", &input_count, &output_count)
+	progress.Errors = &invalid_count
+	progress.Format = *progress_format
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	emit := func(row []string) {
+		w.Write(row)
+		atomic.AddInt64(&output_count, 1)
+	}
+
+	exit_code := 0
+
+	read := func(fd io.Reader, name string) {
+		input, e := inetdata.NewInputReader(progress.CountReader(fd), *input_compression)
+		if e != nil {
+			inetdata.Log.Warnf("Failed to read %s: %s", name, e)
+			exit_code = 1
+			return
+		}
+		if e := parseInput(input, names, emit); e != nil {
+			inetdata.Log.Warnf("Failed to read %s: %s", name, e)
+			exit_code = 1
+		}
+	}
+
+	if len(inputs) == 0 {
+		read(os.Stdin, "stdin")
+	}
+
+	for _, path := range inputs {
+		if inetdata.Interrupted() {
+			break
+		}
+
+		fd, e := inetdata.OpenPath(path)
+		if e != nil {
+			inetdata.Log.Errorf("%s", e)
+			exit_code = 1
+			continue
+		}
+		read(fd, path)
+		fd.Close()
+	}
+
+	w.Flush()
+	out.Flush()
+
+	quit <- 0
+
+	if e := w.Error(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+		exit_code = 1
+	}
+
+	if e := dest.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+		exit_code = 1
+	}
+
+	inetdata.CloseRejects()
+
+	if exit_code == 0 {
+		inetdata.ExitIfInterrupted(*output_path)
+		inetdata.CheckErrorBudget(input_count)
+
+		if e := inetdata.WriteDatasetMeta("inetdata-whois2csv", *output_path, output_count); e != nil {
+			inetdata.Log.Errorf("%s", e)
+			os.Exit(1)
+		}
+	}
+
+	os.Exit(exit_code)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sort"
+)
+
+// A template maps the keys of a registry's WHOIS format to the columns.
+// Keys are lowercase with single spaces, and the lines of a section (a key
+// without a value, followed by more indented lines) are keyed by the section
+// and their own key, such as "relevant dates/registered on", or by the
+// section alone for lines without a key. JPRS keys keep their brackets.
+type template struct {
+	Description string
+
+	// The key of the first line of a record, and whether the domain is on the
+	// next line instead of after the key
+	Domain  []string
+	Section bool
+
+	// Keys that tell apart formats that share a domain key, one is enough
+	Requires []string
+
+	Registrar   []string
+	Created     []string
+	Expires     []string
+	NameServers []string
+	Country     []string
+}
+
+// The templates are detected in this order
+var template_order = []string{"jprs", "nominet", "icann", "afnic", "eurid", "denic"}
+
+var templates = map[string]template{
+	"icann": {
+		Description: "The ICANN RDDS format of gTLD registries and registrars, and many ccTLDs",
+		Domain:      []string{"domain name"},
+		Registrar:   []string{"registrar", "sponsoring registrar"},
+		Created:     []string{"creation date", "created on", "registered on"},
+		Expires:     []string{"registry expiry date", "registrar registration expiration date", "expiration date", "expiry date"},
+		NameServers: []string{"name server", "nameserver"},
+		Country:     []string{"registrant country", "registrant country/economy"},
+	},
+	"nominet": {
+		Description: "Nominet (.uk), with indented sections",
+		Domain:      []string{"domain name"},
+		Section:     true,
+		Registrar:   []string{"registrar"},
+		Created:     []string{"relevant dates/registered on"},
+		Expires:     []string{"relevant dates/expiry date"},
+		NameServers: []string{"name servers"},
+	},
+	"afnic": {
+		Description: "AFNIC (.fr, .re, .pm, .tf, .wf, .yt), RIPE-style with contact blocks",
+		Domain:      []string{"domain"},
+		Requires:    []string{"holder-c", "nic-hdl"},
+		Registrar:   []string{"registrar"},
+		Created:     []string{"created"},
+		Expires:     []string{"expiry date"},
+		NameServers: []string{"nserver"},
+	},
+	"eurid": {
+		Description: "EURid (.eu), with indented sections",
+		Domain:      []string{"domain"},
+		Requires:    []string{"registrar/name", "name servers"},
+		Registrar:   []string{"registrar/name"},
+		NameServers: []string{"name servers"},
+	},
+	"denic": {
+		Description: "DENIC (.de) and other registries without registrar or date fields",
+		Domain:      []string{"domain"},
+		NameServers: []string{"nserver"},
+	},
+	"jprs": {
+		Description: "JPRS (.jp), with bracketed keys",
+		Domain:      []string{"[domain name]"},
+		Created:     []string{"[created on]", "[registered date]"},
+		Expires:     []string{"[expires on]"},
+		NameServers: []string{"[name server]"},
+	},
+}
+
+// Return the template names in lexical order
+func templateNames() []string {
+	names := []string{}
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Return the domain keys of the templates, which start records
+func domainKeys(names []string) map[string]bool {
+	keys := map[string]bool{}
+	for _, name := range names {
+		for _, key := range templates[name].Domain {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// Return true if a record is in the format of the template
+func (t *template) matches(r *whoisRecord) bool {
+	if len(r.fields) == 0 {
+		return false
+	}
+
+	first := r.fields[0]
+	found := false
+	for _, key := range t.Domain {
+		if first.key == key {
+			found = true
+		}
+	}
+	if !found || t.Section != (len(first.value) == 0) {
+		return false
+	}
+
+	return len(t.Requires) == 0 || r.has(t.Requires)
+}
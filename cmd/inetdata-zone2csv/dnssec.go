@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/fathom6/inetdata-parsers"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// The DNSSEC record types, which are written with normalized values
+var dnssec_types = map[string]bool{
+	"dnskey":     true,
+	"cdnskey":    true,
+	"ds":         true,
+	"cds":        true,
+	"rrsig":      true,
+	"nsec":       true,
+	"nsec3":      true,
+	"nsec3param": true,
+}
+
+// The base32 encoding with the extended hex alphabet of NSEC3 hashes, which
+// are written in lowercase
+var nsec3_encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// Return true if the fields are unsigned integers of at most bits bits
+func validInts(fields []string, bits int) bool {
+	for _, f := range fields {
+		if _, e := strconv.ParseUint(f, 10, bits); e != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Return a hex payload in lowercase, or an empty string if it is invalid.
+// The payload may be split over several fields.
+func normalizeHex(fields []string) string {
+	payload := strings.ToLower(strings.Join(fields, ""))
+	if len(payload) == 0 {
+		return ""
+	}
+	if _, e := hex.DecodeString(payload); e != nil {
+		return ""
+	}
+	return payload
+}
+
+// Return a base64 payload with standard padding, or an empty string if it is
+// invalid. The payload may be split over several fields.
+func normalizeBase64(fields []string) string {
+	payload := strings.TrimRight(strings.Join(fields, ""), "=")
+	b, e := base64.RawStdEncoding.DecodeString(payload)
+	if e != nil || len(b) == 0 {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// Return an NSEC3 salt in lowercase hex, keeping "-" for an empty salt, or an
+// empty string if it is invalid
+func normalizeSalt(salt string) string {
+	if salt == "-" {
+		return salt
+	}
+	return normalizeHex([]string{salt})
+}
+
+// Return an NSEC3 next hashed owner name in lowercase base32hex, or an empty
+// string if it is invalid
+func normalizeHash(hash string) string {
+	hash = strings.ToUpper(hash)
+	if _, e := nsec3_encoding.DecodeString(hash); e != nil || len(hash) == 0 {
+		return ""
+	}
+	return strings.ToLower(hash)
+}
+
+// Return the type bitmap of an NSEC or NSEC3 record as lowercase types
+func normalizeTypes(fields []string) string {
+	return strings.ToLower(strings.Join(fields, " "))
+}
+
+// Return the normalized value of a DNSSEC record from the fields of its
+// record data in presentation format, or an empty string if it is malformed.
+// Names are completed and normalized with the name function, hex payloads are
+// lowercased, and base64 payloads split over several fields are joined.
+func dnssecValue(rtype string, fields []string, name func(string) string) string {
+	switch rtype {
+	case "ds", "cds":
+		// key tag, algorithm, digest type, digest
+		if len(fields) < 4 || !validInts(fields[0:1], 16) || !validInts(fields[1:3], 8) {
+			return ""
+		}
+		digest := normalizeHex(fields[3:])
+		if len(digest) == 0 {
+			return ""
+		}
+		return strings.Join(fields[0:3], " ") + " " + digest
+
+	case "dnskey", "cdnskey":
+		// flags, protocol, algorithm, public key
+		if len(fields) < 4 || !validInts(fields[0:1], 16) || !validInts(fields[1:3], 8) {
+			return ""
+		}
+		key := normalizeBase64(fields[3:])
+		if len(key) == 0 {
+			return ""
+		}
+		return strings.Join(fields[0:3], " ") + " " + key
+
+	case "rrsig":
+		// type covered, algorithm, labels, original TTL, expiration,
+		// inception, key tag, signer, signature
+		if len(fields) < 9 || !validInts(fields[1:3], 8) || !validInts(fields[3:6], 64) || !validInts(fields[6:7], 16) {
+			return ""
+		}
+		signer := name(strings.ToLower(fields[7]))
+		signature := normalizeBase64(fields[8:])
+		if len(signer) == 0 || len(signature) == 0 {
+			return ""
+		}
+		return strings.ToLower(fields[0]) + " " + strings.Join(fields[1:7], " ") + " " + signer + " " + signature
+
+	case "nsec":
+		// next name, type bitmap
+		if len(fields) < 1 {
+			return ""
+		}
+		next := name(strings.ToLower(fields[0]))
+		if len(next) == 0 {
+			return ""
+		}
+		return strings.TrimSpace(next + " " + normalizeTypes(fields[1:]))
+
+	case "nsec3":
+		// hash algorithm, flags, iterations, salt, next hash, type bitmap
+		if len(fields) < 5 || !validInts(fields[0:2], 8) || !validInts(fields[2:3], 16) {
+			return ""
+		}
+		salt := normalizeSalt(fields[3])
+		next := normalizeHash(fields[4])
+		if len(salt) == 0 || len(next) == 0 {
+			return ""
+		}
+		return strings.TrimSpace(strings.Join(fields[0:3], " ") + " " + salt + " " + next + " " + normalizeTypes(fields[5:]))
+
+	case "nsec3param":
+		// hash algorithm, flags, iterations, salt
+		if len(fields) != 4 || !validInts(fields[0:2], 8) || !validInts(fields[2:3], 16) {
+			return ""
+		}
+		salt := normalizeSalt(fields[3])
+		if len(salt) == 0 {
+			return ""
+		}
+		return strings.Join(fields[0:3], " ") + " " + salt
+	}
+
+	return ""
+}
+
+// Write a DNSSEC record from the fields of a TLD zone line, returning false if
+// the line is not a DNSSEC record. The record data of DNSSEC records spans a
+// varying number of fields and keeps the case of its base64 payloads.
+func parseZoneDNSSEC(raw string, bits []string, name_idx int, type_idx int, c_names chan string) bool {
+	if len(bits) <= type_idx+1 {
+		return false
+	}
+
+	rtype := strings.ToLower(bits[type_idx])
+	if !dnssec_types[rtype] {
+		return false
+	}
+
+	if only_types != nil && !only_types[rtype] {
+		return true
+	}
+
+	value := dnssecValue(rtype, bits[type_idx+1:], normalizeName)
+	if len(value) == 0 {
+		atomic.AddInt64(&invalid_count, 1)
+		inetdata.Rejects.Reject(inetdata.REJECT_INVALID_ENTRY, raw)
+		return true
+	}
+
+	writeRecord(c_names, raw, normalizeName(strings.ToLower(bits[name_idx])), rtype, value)
+	return true
+}
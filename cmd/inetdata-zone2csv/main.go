@@ -4,13 +4,17 @@ import (
 	"flag"
 	"fmt"
 	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/dnsname"
+	"github.com/miekg/dns"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
-	"time"
 )
 
 const ZONE_MODE_UNKNOWN = 0
@@ -24,10 +28,25 @@ var zone_mode = 0
 var zone_name = ""
 var zone_matched = false
 
+var master_origin string
+
+// Normalize names with dnsname.Normalize and skip records with invalid names
+var normalize = false
+
+// The policy for wildcard owner names, see dnsname.Wildcards
+var wildcard_mode = dnsname.WILDCARD_KEEP
+
+// Filters, see -only-types, -drop-invalid, and -max-name-length
+var only_types map[string]bool
+var drop_invalid = false
+var max_name_length = 0
+
 var output_count int64 = 0
 var input_count int64 = 0
+var invalid_count int64 = 0
 var stdout_lock sync.Mutex
 var wg sync.WaitGroup
+var wo sync.WaitGroup
 
 type OutputKey struct {
 	Key  string
@@ -42,117 +61,182 @@ type OutputChannels struct {
 }
 
 func usage() {
-	fmt.Println("Usage: " + os.Args[0] + " [options]")
+	fmt.Println("Usage: " + os.Args[0] + " [options] [<zone-file> ... <zone-file>]")
 	fmt.Println("")
 	fmt.Println("Reads a zone file from stdin, generates CSV files keyed off domain names, including ")
 	fmt.Println("forward, inverse, and glue addresses for IPv4 and IPv6.")
 	fmt.Println("")
+	fmt.Println("When zone files are specified, or -master is set, the input is parsed as a standard")
+	fmt.Println("DNS master file, including $ORIGIN, $TTL, and $INCLUDE directives and relative names,")
+	fmt.Println("and every record is emitted as name,type,value. Zone files may be compressed and are")
+	fmt.Println("parsed in parallel. The origin defaults to the file name without its extensions")
+	fmt.Println("(ex: com.zone.gz -> com) and can be set with -origin.")
+	fmt.Println("")
+	fmt.Println("With -only-types, records of other types are skipped. With -drop-invalid, records with")
+	fmt.Println("invalid UTF-8, empty or overlong labels, or illegal characters in their names, or control")
+	fmt.Println("characters in their values, are dropped. -max-name-length drops records with longer names.")
+	fmt.Println("With -rejects, the dropped records are written to a compressed file, each prefixed with its")
+	fmt.Println("reason code and a tab.")
+	fmt.Println("")
+	fmt.Println("DNSSEC records (DNSKEY, CDNSKEY, DS, CDS, RRSIG, NSEC, NSEC3, and NSEC3PARAM) are written")
+	fmt.Println("with normalized values: hex digests and salts are lowercased, NSEC3 hashes are written in")
+	fmt.Println("lowercase base32hex, base64 keys and signatures split over several fields are joined, and")
+	fmt.Println("names in the values are completed like owner names. Records with malformed DNSSEC values")
+	fmt.Println("are rejected. With -dnssec-only, only DNSSEC records are written.")
+	fmt.Println("")
+	fmt.Println("Records with wildcard owner names (*.example.com) are kept, stripped to their parent name,")
+	fmt.Println("dropped, or written for both the wildcard and the parent name, according to -wildcards.")
+	fmt.Println("")
+	fmt.Println("With -format parquet, the records are written as a Parquet file with name, type, and")
+	fmt.Println("value columns, compressed with -parquet-compression instead of -output-compression.")
+	fmt.Println("With -format avro, they are written as an Avro container file with the schema embedded,")
+	fmt.Println("using string fields or the types of the fields in -avro-schema. With -format pb, they are")
+	fmt.Println("written as length-delimited protobuf records (proto/record.proto) with the columns as fields.")
+	fmt.Println("")
 	fmt.Println("Options:")
 	flag.PrintDefaults()
 }
 
-func showProgress(quit chan int) {
-	start := time.Now()
-	for {
-		select {
-		case <-quit:
-			return
-		case <-time.After(time.Second * 1):
-			icount := atomic.LoadInt64(&input_count)
-			ocount := atomic.LoadInt64(&output_count)
+func outputWriter(fd io.Writer, c chan string) {
+	for r := range c {
+		fd.Write([]byte(r))
+		atomic.AddInt64(&output_count, 1)
+	}
+	wo.Done()
+}
 
-			if icount == 0 && ocount == 0 {
-				// Reset start, so that we show stats only from our first input
-				start = time.Now()
-				continue
-			}
-			elapsed := time.Since(start)
-			if elapsed.Seconds() > 1.0 {
-				fmt.Fprintf(os.Stderr, "[*] [inetdata-zone2csv] Read %d and wrote %d records in %d seconds (%d/s in, %d/s out)\n",
-					icount,
-					ocount,
-					int(elapsed.Seconds()),
-					int(float64(icount)/elapsed.Seconds()),
-					int(float64(ocount)/elapsed.Seconds()))
-			}
+// Return the reason a record should be dropped with -drop-invalid or
+// -max-name-length, or an empty string to keep it
+func invalidReason(name string, rtype string, value string) string {
+	if max_name_length > 0 && len(name) > max_name_length {
+		return dnsname.REASON_NAME_TOO_LONG
+	}
+	if !drop_invalid {
+		return ""
+	}
+
+	if reason := dnsname.CheckName(name, max_name_length); len(reason) > 0 {
+		return reason
+	}
+
+	// Check the names in the values of name records
+	switch rtype {
+	case "ns", "cname", "ptr", "dname":
+		return dnsname.CheckName(value, max_name_length)
+	case "mx":
+		if bits := strings.SplitN(value, " ", 2); len(bits) == 2 {
+			return dnsname.CheckName(bits[1], max_name_length)
 		}
 	}
+
+	return dnsname.CheckValue(value)
 }
 
-func outputWriter(fd *os.File, c chan string) {
-	for r := range c {
-		fd.Write([]byte(r))
-		atomic.AddInt64(&output_count, 1)
+// Apply -only-types and the validation filters to a record, returning true
+// if it should be written. Dropped records are sent to the reject file.
+func keepRecord(raw string, name string, rtype string, value string) bool {
+	if only_types != nil && !only_types[rtype] {
+		return false
 	}
-	wg.Done()
+
+	if reason := invalidReason(name, rtype, value); len(reason) > 0 {
+		atomic.AddInt64(&invalid_count, 1)
+		inetdata.Rejects.Reject(reason, raw)
+		return false
+	}
+	return true
 }
 
-func writeRecord(c_names chan string, name string, rtype string, value string) {
-	switch rtype {
-	case "ns":
-		c_names <- fmt.Sprintf("%s,%s,%s\n", name, rtype, value)
+func writeRecord(c_names chan string, raw string, name string, rtype string, value string) {
+	if len(name) == 0 || len(value) == 0 {
+		if normalize {
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_NAME, raw)
+		}
+		return
+	}
 
+	if !keepRecord(raw, name, rtype, value) {
+		return
+	}
+
+	switch rtype {
 	case "a":
-		if inetdata.Match_IPv4.Match([]byte(value)) {
-			c_names <- fmt.Sprintf("%s,%s,%s\n", name, rtype, value)
+		if !inetdata.Match_IPv4.Match([]byte(value)) {
+			return
 		}
-
 	case "aaaa":
-		if inetdata.Match_IPv6.Match([]byte(value)) {
-			c_names <- fmt.Sprintf("%s,%s,%s\n", name, rtype, value)
+		if !inetdata.Match_IPv6.Match([]byte(value)) {
+			return
 		}
+	case "ns":
+	default:
+		if !dnssec_types[rtype] {
+			return
+		}
+	}
+
+	for _, n := range dnsname.Wildcards(name, wildcard_mode) {
+		c_names <- fmt.Sprintf("%s,%s,%s\n", n, rtype, value)
 	}
 }
 
 func normalizeName(name string) string {
-	// Leave empty names alone
-	if len(name) == 0 {
-		return name
-	}
+	return canonicalName(dnsname.Qualify(name, zone_name))
+}
 
-	// Leave IP addresses alone
-	if inetdata.Match_IPv4.Match([]byte(name)) || inetdata.Match_IPv6.Match([]byte(name)) {
+// Return the canonical form of a name with -normalize, or an empty name if it
+// is invalid
+func canonicalName(name string) string {
+	if !normalize || len(name) == 0 {
 		return name
 	}
-
-	if name[len(name)-1:] == "." {
-		// Remove the trailing dot
-		name = name[:len(name)-1]
-	} else {
-		// Add the domain to complete the name
-		name = fmt.Sprintf("%s.%s", name, zone_name)
+	cname, err := dnsname.Normalize(name)
+	if err != nil {
+		return ""
 	}
-	return name
+	return cname
 }
 
 func parseZoneCOM(raw string, c_names chan string) {
-	bits := inetdata.Split_WS.Split(strings.ToLower(raw), -1)
+	bits := inetdata.Split_WS.Split(raw, -1)
+	if parseZoneDNSSEC(raw, bits, 0, 1, c_names) {
+		return
+	}
+
 	if len(bits) != 3 {
 		return
 	}
 
-	name, rtype, value := normalizeName(bits[0]), bits[1], normalizeName(bits[2])
-	writeRecord(c_names, name, rtype, value)
+	name, rtype, value := normalizeName(strings.ToLower(bits[0])), strings.ToLower(bits[1]), normalizeName(strings.ToLower(bits[2]))
+	writeRecord(c_names, raw, name, rtype, value)
 }
 
 func parseZoneBIZ(raw string, c_names chan string) {
-	bits := inetdata.Split_WS.Split(strings.ToLower(raw), -1)
+	bits := inetdata.Split_WS.Split(raw, -1)
+	if parseZoneDNSSEC(raw, bits, 0, 3, c_names) {
+		return
+	}
+
 	if len(bits) != 5 {
 		return
 	}
 
-	name, rtype, value := normalizeName(bits[0]), bits[3], normalizeName(bits[4])
-	writeRecord(c_names, name, rtype, value)
+	name, rtype, value := normalizeName(strings.ToLower(bits[0])), strings.ToLower(bits[3]), normalizeName(strings.ToLower(bits[4]))
+	writeRecord(c_names, raw, name, rtype, value)
 }
 
 func parseZoneUS(raw string, c_names chan string) {
-	bits := inetdata.Split_WS.Split(strings.ToLower(raw), -1)
+	bits := inetdata.Split_WS.Split(raw, -1)
+	if parseZoneDNSSEC(raw, bits, 0, 2, c_names) {
+		return
+	}
+
 	if len(bits) != 4 {
 		return
 	}
 
-	name, rtype, value := normalizeName(bits[0]), bits[2], normalizeName(bits[3])
-	writeRecord(c_names, name, rtype, value)
+	name, rtype, value := normalizeName(strings.ToLower(bits[0])), strings.ToLower(bits[2]), normalizeName(strings.ToLower(bits[3]))
+	writeRecord(c_names, raw, name, rtype, value)
 }
 
 func parseZoneSK(raw string, c_names chan string) {
@@ -169,30 +253,161 @@ func parseZoneSK(raw string, c_names chan string) {
 	ns1, ns2, ns3, ns4 := normalizeName(bits[5]), normalizeName(bits[6]), normalizeName(bits[7]), normalizeName(bits[8])
 
 	if len(ns1) > 0 {
-		writeRecord(c_names, name, "ns", ns1)
+		writeRecord(c_names, raw, name, "ns", ns1)
 	}
 
 	if len(ns2) > 0 {
-		writeRecord(c_names, name, "ns", ns2)
+		writeRecord(c_names, raw, name, "ns", ns2)
 	}
 
 	if len(ns3) > 0 {
-		writeRecord(c_names, name, "ns", ns3)
+		writeRecord(c_names, raw, name, "ns", ns3)
 	}
 
 	if len(ns4) > 0 {
-		writeRecord(c_names, name, "ns", ns4)
+		writeRecord(c_names, raw, name, "ns", ns4)
 	}
 }
 
 func parseZoneCZDS(raw string, c_names chan string) {
-	bits := inetdata.Split_WS.Split(strings.ToLower(raw), -1)
+	bits := inetdata.Split_WS.Split(raw, -1)
+	if parseZoneDNSSEC(raw, bits, 0, 3, c_names) {
+		return
+	}
+
 	if len(bits) != 5 {
 		return
 	}
 
-	name, rtype, value := normalizeName(bits[0]), bits[3], normalizeName(bits[4])
-	writeRecord(c_names, name, rtype, value)
+	name, rtype, value := normalizeName(strings.ToLower(bits[0])), strings.ToLower(bits[3]), normalizeName(strings.ToLower(bits[4]))
+	writeRecord(c_names, raw, name, rtype, value)
+}
+
+// Strip the trailing dot and lowercase a domain name from a resource record
+func normalizeRRName(name string) string {
+	return canonicalName(strings.ToLower(strings.TrimSuffix(name, ".")))
+}
+
+// Format the record data of a resource record as a CSV value
+func masterValue(rr dns.RR) string {
+	switch t := rr.(type) {
+	case *dns.A:
+		return t.A.String()
+	case *dns.AAAA:
+		return t.AAAA.String()
+	case *dns.NS:
+		return normalizeRRName(t.Ns)
+	case *dns.CNAME:
+		return normalizeRRName(t.Target)
+	case *dns.PTR:
+		return normalizeRRName(t.Ptr)
+	case *dns.DNAME:
+		return normalizeRRName(t.Target)
+	case *dns.MX:
+		mx := normalizeRRName(t.Mx)
+		if len(mx) == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%d %s", t.Preference, mx)
+	case *dns.SRV:
+		target := normalizeRRName(t.Target)
+		if len(target) == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%d %d %d %s", t.Priority, t.Weight, t.Port, target)
+	case *dns.TXT:
+		return strings.Join(t.Txt, "")
+	case *dns.SOA:
+		return fmt.Sprintf("%s %s %d %d %d %d %d", normalizeRRName(t.Ns), normalizeRRName(t.Mbox),
+			t.Serial, t.Refresh, t.Retry, t.Expire, t.Minttl)
+	}
+
+	// Use the presentation format of the record data for other types
+	rdata := strings.TrimSpace(strings.TrimPrefix(rr.String(), rr.Header().String()))
+
+	rtype := strings.ToLower(dns.TypeToString[rr.Header().Rrtype])
+	if dnssec_types[rtype] {
+		return dnssecValue(rtype, strings.Fields(rdata), normalizeRRName)
+	}
+	return rdata
+}
+
+// Derive the zone origin from a file name (com.zone.gz -> com)
+func originFromPath(path string) string {
+	name := filepath.Base(path)
+	for _, ext := range []string{".gz", ".bz2", ".xz", ".zst", ".lz4", ".zone", ".txt", ".db"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return name
+}
+
+// Parse a zone in master file format, writing every record to the output
+func parseMasterFile(input io.Reader, origin string, fname string, c_names chan string) error {
+	zp := dns.NewZoneParser(input, dns.Fqdn(origin), fname)
+	zp.SetIncludeAllowed(true)
+
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if inetdata.Interrupted() {
+			return nil
+		}
+		atomic.AddInt64(&input_count, 1)
+
+		rtype := strings.ToLower(dns.TypeToString[rr.Header().Rrtype])
+
+		name := normalizeRRName(rr.Header().Name)
+		value := masterValue(rr)
+		if len(value) == 0 && dnssec_types[rtype] && (only_types == nil || only_types[rtype]) {
+			atomic.AddInt64(&invalid_count, 1)
+			inetdata.Rejects.Reject(inetdata.REJECT_INVALID_ENTRY, rr.String())
+			continue
+		}
+		if len(name) == 0 || len(value) == 0 {
+			if normalize && (only_types == nil || only_types[rtype]) {
+				inetdata.Rejects.Reject(inetdata.REJECT_INVALID_NAME, rr.String())
+			}
+			continue
+		}
+
+		if !keepRecord(rr.String(), name, rtype, value) {
+			continue
+		}
+
+		for _, n := range dnsname.Wildcards(name, wildcard_mode) {
+			c_names <- fmt.Sprintf("%s,%s,%s\n", n, rtype, value)
+		}
+	}
+
+	return zp.Err()
+}
+
+// Parse zone files from the file channel until it is closed
+func masterFileParser(c_files chan string, input_compression string, c_names chan string, progress *inetdata.Progress) {
+	defer wg.Done()
+
+	for path := range c_files {
+		fd, e := inetdata.OpenPath(path)
+		if e != nil {
+			inetdata.Log.Warnf("Failed to open %s: %s", path, e)
+			continue
+		}
+
+		input, e := inetdata.NewInputReader(progress.CountReader(fd), input_compression)
+		if e != nil {
+			inetdata.Log.Warnf("Failed to read %s: %s", path, e)
+			fd.Close()
+			continue
+		}
+
+		origin := master_origin
+		if len(origin) == 0 {
+			origin = originFromPath(path)
+		}
+
+		if e := parseMasterFile(input, origin, path, c_names); e != nil {
+			inetdata.Log.Warnf("Failed to parse %s: %s", path, e)
+		}
+		fd.Close()
+	}
 }
 
 func inputParser(c chan string, c_names chan string) {
@@ -212,7 +427,7 @@ func inputParser(c chan string, c_names chan string) {
 			zone_matched = true
 
 			// Spawn more parsers
-			for i := 0; i < runtime.NumCPU()-1; i++ {
+			for i := 0; i < inetdata.Workers-1; i++ {
 				go inputParser(c, c_names)
 				wg.Add(1)
 			}
@@ -289,7 +504,7 @@ func inputParser(c chan string, c_names chan string) {
 			lines_read++
 
 			if lines_read > 100 {
-				fmt.Fprintf(os.Stderr, "[-] Could not determine zone format, giving up: %s\n", raw)
+				inetdata.Log.Errorf("Could not determine zone format, giving up: %s", raw)
 				os.Exit(1)
 			}
 
@@ -322,44 +537,306 @@ func main() {
 	os.Setenv("LC_ALL", "C")
 
 	flag.Usage = func() { usage() }
+	format := flag.String("format", "csv", "The output format: csv, parquet, avro, or pb")
+	avro_schema := flag.String("avro-schema", "", "An Avro schema file (.avsc) with a field per column, instead of string fields")
+	avro_compression := flag.String("avro-compression", "deflate", "The avro container compression: null, deflate, or snappy")
+	parquet_compression := flag.String("parquet-compression", "zstd", "The parquet compression: none, snappy, gzip, or zstd")
+	parquet_row_group := flag.Int("parquet-row-group", 100000, "The maximum number of rows per parquet row group")
+	output_compression := flag.String("output-compression", "none", "The output compression: none, gzip, zstd, or lz4")
+	compression_level := flag.Int("compression-level", -1, "The output compression level, -1 uses the default for the codec")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	master := flag.Bool("master", false, "Parse stdin as a standard DNS master file instead of detecting the TLD zone format")
+	origin := flag.String("origin", "", "The origin to use for relative names in master files (defaults to the file name)")
+	normalized := flag.Bool("normalize", false, "Encode internationalized names as punycode and skip records with invalid names")
+	types := flag.String("types", "", "An alias of -only-types")
+	selected_types := flag.String("only-types", "", "Only emit these comma-separated record types (ex: a,aaaa,ns)")
+	dnssec_only := flag.Bool("dnssec-only", false, "Only emit DNSSEC records: dnskey, cdnskey, ds, cds, rrsig, nsec, nsec3, and nsec3param")
+	invalid := flag.Bool("drop-invalid", false, "Drop records with malformed names or values")
+	wildcards := flag.String("wildcards", wildcard_mode, "The wildcard owner name handling mode: keep, strip, drop, or expand-base")
+	max_name := flag.Int("max-name-length", 0, "Drop records with names longer than this many bytes (0 for no limit, or 253 with -drop-invalid)")
+	reject_file := flag.String("reject-file", "", "An alias of -rejects")
+	parallel := flag.Int("j", 0, "The number of zone files to parse in parallel (defaults to -workers)")
+	input_glob := flag.String("input-glob", "", "Also parse the zone files matching this glob pattern (ex: 'zones/*.zone.gz')")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
 	version := flag.Bool("version", false, "Show the version and build timestamp")
 
-	flag.Parse()
+	inetdata.AddTuningFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-zone2csv")
 
 	if *version {
 		inetdata.PrintVersion("inetdata-zone2csv")
 		os.Exit(0)
 	}
 
+	inetdata.HandleSignals("inetdata-zone2csv")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !dnsname.ValidWildcardPolicy(*wildcards) {
+		inetdata.Log.Errorf("Invalid wildcard mode specified: %s", *wildcards)
+		usage()
+		os.Exit(1)
+	}
+
+	master_origin = strings.TrimSuffix(*origin, ".")
+	normalize = *normalized
+	wildcard_mode = *wildcards
+	drop_invalid = *invalid
+	max_name_length = *max_name
+
+	if max_name_length < 0 {
+		inetdata.Log.Errorf("-max-name-length must not be negative")
+		usage()
+		os.Exit(1)
+	}
+
+	if len(*selected_types) == 0 {
+		selected_types = types
+	}
+
+	if len(*selected_types) > 0 {
+		only_types = make(map[string]bool)
+		for _, t := range strings.Split(strings.ToLower(*selected_types), ",") {
+			only_types[strings.TrimSpace(t)] = true
+		}
+	}
+
+	// With -only-types, only the DNSSEC types that were selected are kept
+	if *dnssec_only {
+		selected := make(map[string]bool)
+		for t := range dnssec_types {
+			if only_types == nil || only_types[t] {
+				selected[t] = true
+			}
+		}
+		if len(selected) == 0 {
+			inetdata.Log.Errorf("-only-types does not select any DNSSEC record types")
+			usage()
+			os.Exit(1)
+		}
+		only_types = selected
+	}
+
+	if len(*reject_file) > 0 && len(inetdata.RejectsPath) == 0 {
+		inetdata.RejectsPath = *reject_file
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if *parallel < 1 {
+		*parallel = inetdata.Workers
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidOutputCompression(*output_compression) {
+		inetdata.Log.Errorf("Invalid output compression specified: %s", *output_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	switch *format {
+	case "csv":
+	case "parquet":
+		if *output_compression != "none" {
+			inetdata.Log.Errorf("parquet output is compressed with -parquet-compression, not -output-compression")
+			usage()
+			os.Exit(1)
+		}
+		if !inetdata.ValidParquetCompression(*parquet_compression) {
+			inetdata.Log.Errorf("Invalid parquet compression specified: %s", *parquet_compression)
+			usage()
+			os.Exit(1)
+		}
+	case "avro":
+		if *output_compression != "none" {
+			inetdata.Log.Errorf("avro output is compressed with -avro-compression, not -output-compression")
+			usage()
+			os.Exit(1)
+		}
+		if !inetdata.ValidAvroCompression(*avro_compression) {
+			inetdata.Log.Errorf("Invalid avro compression specified: %s", *avro_compression)
+			usage()
+			os.Exit(1)
+		}
+	case "pb":
+	default:
+		inetdata.Log.Errorf("Invalid output format specified: %s", *format)
+		usage()
+		os.Exit(1)
+	}
+
+	inputs, ie := inetdata.InputPaths(flag.Args(), *input_glob)
+	if ie != nil {
+		inetdata.Log.Errorf("%s", ie)
+		os.Exit(1)
+	}
+
+	dest, de := inetdata.CreateOutput("")
+	if de != nil {
+		inetdata.Log.Errorf("%s", de)
+		os.Exit(1)
+	}
+
+	var output io.WriteCloser
+	var oe error
+
+	// Protobuf records are compressed with -output-compression
+	var compressed io.WriteCloser
+
+	switch *format {
+	case "parquet":
+		columns := []inetdata.ParquetColumn{{Name: "name"}, {Name: "type"}, {Name: "value"}}
+		pw, pe := inetdata.NewParquetWriter(dest, columns, *parquet_compression, *parquet_row_group)
+		if pe == nil {
+			output = inetdata.NewLineRowWriter(pw, len(columns), ",")
+		}
+		oe = pe
+	case "avro":
+		columns := []string{"name", "type", "value"}
+		schema := inetdata.AvroSchema("zone", columns)
+		if len(*avro_schema) > 0 {
+			b, e := ioutil.ReadFile(*avro_schema)
+			if e != nil {
+				inetdata.Log.Errorf("%s", e)
+				os.Exit(1)
+			}
+			schema = string(b)
+		}
+
+		aw, ae := inetdata.NewAvroWriter(dest, schema, *avro_compression)
+		if ae == nil && aw.NumFields() != len(columns) {
+			ae = fmt.Errorf("the avro schema must have %d fields: %s", len(columns), strings.Join(columns, ","))
+		}
+		if ae == nil {
+			output = inetdata.NewLineRowWriter(aw, len(columns), ",")
+		}
+		oe = ae
+	case "pb":
+		compressed, oe = inetdata.NewOutputWriter(dest, *output_compression, *compression_level)
+		if oe == nil {
+			output = inetdata.NewLineRowWriter(inetdata.NewProtoWriter(compressed), 3, ",")
+		}
+	default:
+		output, oe = inetdata.NewOutputWriter(dest, *output_compression, *compression_level)
+	}
+	if oe != nil {
+		inetdata.Log.Errorf("%s", oe)
+		os.Exit(1)
+	}
+
+	progress := inetdata.NewProgress("inetdata-zone2csv", &input_count, &output_count)
+	progress.Errors = &invalid_count
+	progress.Format = *progress_format
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
 	// Progress tracker
 	quit := make(chan int)
-	go showProgress(quit)
+	go progress.Run(quit)
 
 	// Write output
-	c_names := make(chan string, 1000)
-	go outputWriter(os.Stdout, c_names)
+	c_names := make(chan string, inetdata.QueueDepth)
+	progress.AddStage("names", func() int { return len(c_names) })
+	go outputWriter(output, c_names)
+	wo.Add(1)
+
+	switch {
+	case len(inputs) > 0:
+		// Parse the zone files in parallel
+		c_files := make(chan string)
+		for i := 0; i < *parallel; i++ {
+			go masterFileParser(c_files, *input_compression, c_names, progress)
+			wg.Add(1)
+		}
 
-	// Read input
-	c_inp := make(chan string, 1000)
-	go inputParser(c_inp, c_names)
-	wg.Add(1)
+		for _, path := range inputs {
+			if inetdata.Interrupted() {
+				break
+			}
+			c_files <- path
+		}
+		close(c_files)
+
+	case *master:
+		input, e := inetdata.NewInputReader(progress.CountReader(os.Stdin), *input_compression)
+		if e != nil {
+			inetdata.Log.Errorf("Failed to read input: %s", e)
+			os.Exit(1)
+		}
+
+		if e := parseMasterFile(input, master_origin, "", c_names); e != nil {
+			inetdata.Log.Warnf("Failed to parse input: %s", e)
+		}
 
-	// Reader closers c_inp on completion
-	e := inetdata.ReadLines(os.Stdin, c_inp)
-	if e != nil {
-		fmt.Fprintf(os.Stderr, "Error reading input: %s\n", e)
+	default:
+		// Read input
+		c_inp := make(chan string, inetdata.QueueDepth)
+		progress.AddStage("input", func() int { return len(c_inp) })
+		go inputParser(c_inp, c_names)
+		wg.Add(1)
+
+		// Reader closers c_inp on completion
+		e := inetdata.ReadLinesCompressed(progress.CountReader(os.Stdin), *input_compression, c_inp)
+		if e != nil {
+			inetdata.Log.Warnf("Failed to read input: %s", e)
+		}
 	}
 
 	// Wait for the input parser to finish
 	wg.Wait()
 
+	inetdata.CloseRejects()
+
 	// Close the output channel
 	close(c_names)
 
 	// Wait for the channel writers to finish
-	wg.Add(1)
-	wg.Wait()
+	wo.Wait()
+
+	if e := output.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+	}
+
+	if compressed != nil {
+		if e := compressed.Close(); e != nil {
+			inetdata.Log.Warnf("Failed to write output: %s", e)
+		}
+	}
+
+	if e := dest.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+	}
 
 	// Stop the main process monitoring
 	quit <- 0
+
+	inetdata.ExitIfInterrupted()
+	inetdata.CheckErrorBudget(input_count)
 }
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers"
+	"io"
+	"os"
+	"runtime"
+	"sync/atomic"
+)
+
+var output_count int64 = 0
+var input_count int64 = 0
+var invalid_count int64 = 0
+
+// The number of names that were added, removed, or changed
+var added_count int64 = 0
+var removed_count int64 = 0
+var changed_count int64 = 0
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " [options] <old> <new>")
+	fmt.Println("")
+	fmt.Println("Compares two snapshots of a zone in the name,type,value CSV format of inetdata-zone2csv")
+	fmt.Println("and writes the records that differ, grouped by name, as name,change,type,value:")
+	fmt.Println("")
+	fmt.Println("  added        : a record of a name that is not in the old snapshot")
+	fmt.Println("  removed      : a record of a name that is not in the new snapshot")
+	fmt.Println("  changed-from : a record of a name in both snapshots that is only in the old one")
+	fmt.Println("  changed-to   : a record of a name in both snapshots that is only in the new one")
+	fmt.Println("")
+	fmt.Println("With -summary, one name,change line is written for each name that was added, removed,")
+	fmt.Println("or changed instead.")
+	fmt.Println("")
+	fmt.Println("The snapshots are sorted and deduplicated first, spilling to -t, and then compared in a")
+	fmt.Println("single streaming pass, so only the records of one name are kept in memory. With -S, the")
+	fmt.Println("inputs must already be sorted in byte order (LC_ALL=C sort -u), which is checked as they")
+	fmt.Println("are read. Either input may be - to read from stdin.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+}
+
+// Write the records of a name with a change
+func writeRecords(w io.Writer, key string, change string, records []string) {
+	for _, r := range records {
+		io.WriteString(w, key+","+change+","+r+"\n")
+		atomic.AddInt64(&output_count, 1)
+	}
+}
+
+// Write a name with a change for -summary
+func writeSummary(w io.Writer, key string, change string) {
+	io.WriteString(w, key+","+change+"\n")
+	atomic.AddInt64(&output_count, 1)
+}
+
+// Compare the records of a name in both snapshots, which are sorted
+func compareRecords(w io.Writer, key string, old []string, cur []string, summary bool) {
+	from := []string{}
+	to := []string{}
+
+	i, j := 0, 0
+	for i < len(old) || j < len(cur) {
+		switch {
+		case j == len(cur) || (i < len(old) && old[i] < cur[j]):
+			from = append(from, old[i])
+			i++
+		case i == len(old) || cur[j] < old[i]:
+			to = append(to, cur[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+
+	if len(from) == 0 && len(to) == 0 {
+		return
+	}
+
+	atomic.AddInt64(&changed_count, 1)
+	if summary {
+		writeSummary(w, key, "changed")
+		return
+	}
+	writeRecords(w, key, "changed-from", from)
+	writeRecords(w, key, "changed-to", to)
+}
+
+func diff(old *inetdata.SortedKeyReader, cur *inetdata.SortedKeyReader, summary bool, w io.Writer) error {
+	if e := old.Next(); e != nil {
+		return e
+	}
+	if e := cur.Next(); e != nil {
+		return e
+	}
+
+	for old.Ok() || cur.Ok() {
+		if inetdata.Interrupted() {
+			return nil
+		}
+
+		switch {
+		case old.Ok() && cur.Ok() && old.Key() == cur.Key():
+			key, old_records, e := old.Group()
+			if e != nil {
+				return e
+			}
+			_, cur_records, e := cur.Group()
+			if e != nil {
+				return e
+			}
+			compareRecords(w, key, old_records, cur_records, summary)
+
+		case !cur.Ok() || (old.Ok() && old.Less(cur)):
+			key, records, e := old.Group()
+			if e != nil {
+				return e
+			}
+			atomic.AddInt64(&removed_count, 1)
+			if summary {
+				writeSummary(w, key, "removed")
+			} else {
+				writeRecords(w, key, "removed", records)
+			}
+
+		default:
+			key, records, e := cur.Group()
+			if e != nil {
+				return e
+			}
+			atomic.AddInt64(&added_count, 1)
+			if summary {
+				writeSummary(w, key, "added")
+			} else {
+				writeRecords(w, key, "added", records)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Read a snapshot into a channel, sorted and deduplicated unless it is
+// presorted
+func readSnapshot(path string, codec string, wrap func(io.Reader) io.Reader, presorted bool, tmpdir string, max_mem uint64) <-chan string {
+	paths := []string{path}
+	if path == "-" {
+		paths = nil
+	}
+
+	c_sorted := make(chan string, inetdata.QueueDepth)
+	if presorted {
+		go func() {
+			if e := inetdata.ReadLinesFromInputs(paths, codec, wrap, c_sorted); e != nil {
+				inetdata.Log.Errorf("Failed to read %s: %s", path, e)
+				os.Exit(1)
+			}
+		}()
+		return c_sorted
+	}
+
+	c_raw := make(chan string, inetdata.QueueDepth)
+	go func() {
+		if e := inetdata.ExternalSort(c_raw, c_sorted, tmpdir, max_mem); e != nil {
+			inetdata.Log.Errorf("Failed to sort %s: %s", path, e)
+			os.Exit(1)
+		}
+	}()
+	go func() {
+		if e := inetdata.ReadLinesFromInputs(paths, codec, wrap, c_raw); e != nil {
+			inetdata.Log.Errorf("Failed to read %s: %s", path, e)
+			os.Exit(1)
+		}
+	}()
+	return c_sorted
+}
+
+func main() {
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	os.Setenv("LC_ALL", "C")
+
+	flag.Usage = func() { usage() }
+	summary := flag.Bool("summary", false, "Write one name,change line per added, removed, or changed name instead of the records")
+	sort_skip := flag.Bool("S", false, "Skip the sorting phase and assume the inputs are sorted and deduplicated")
+	sort_tmp := flag.String("t", "", "The temporary directory to use for the sorting phase")
+	sort_mem := flag.Uint64("m", 1, "The maximum amount of memory to use, in gigabytes, for the sorting phase of each input")
+	input_compression := flag.String("input-compression", "auto", "The input compression: auto, none, gzip, bzip2, xz, zstd, or lz4")
+	metrics_listen := flag.String("metrics-listen", "", "Expose Prometheus metrics at /metrics on this address (ex: :9090)")
+	progress_format := flag.String("progress-format", "text", "The progress output format: text or json")
+	version := flag.Bool("version", false, "Show the version and build timestamp")
+
+	inetdata.AddTuningFlags()
+	inetdata.AddOutputFlags()
+	inetdata.AddRejectFlags()
+
+	inetdata.ParseFlags("inetdata-zonediff")
+
+	if *version {
+		inetdata.PrintVersion("inetdata-zonediff")
+		os.Exit(0)
+	}
+
+	inetdata.HandleSignals("inetdata-zonediff")
+
+	if e := inetdata.ApplyTuning(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		usage()
+		os.Exit(1)
+	}
+
+	if e := inetdata.OpenRejects(); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidProgressFormat(*progress_format) {
+		inetdata.Log.Errorf("Invalid progress format specified: %s", *progress_format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidInputCompression(*input_compression) {
+		inetdata.Log.Errorf("Invalid input compression specified: %s", *input_compression)
+		usage()
+		os.Exit(1)
+	}
+
+	if len(flag.Args()) != 2 {
+		usage()
+		os.Exit(1)
+	}
+
+	if flag.Args()[0] == "-" && flag.Args()[1] == "-" {
+		inetdata.Log.Errorf("Only one input can be read from stdin")
+		os.Exit(1)
+	}
+
+	if len(*sort_tmp) == 0 {
+		*sort_tmp = os.Getenv("HOME")
+	}
+
+	progress := inetdata.NewProgress("inetdata-zonediff", &input_count, &output_count)
+	progress.Format = *progress_format
+	progress.Errors = &invalid_count
+	progress.AddCounter("added", &added_count)
+	progress.AddCounter("removed", &removed_count)
+	progress.AddCounter("changed", &changed_count)
+
+	if len(*metrics_listen) > 0 {
+		if e := progress.ServeMetrics(*metrics_listen); e != nil {
+			inetdata.Log.Errorf("Failed to start the metrics listener: %s", e)
+			os.Exit(1)
+		}
+	}
+
+	// The names are split naively on the first comma, and the snapshots
+	// are sorted as whole lines
+	fs, fe := inetdata.NewFieldSplitter(",", false, "\"", "")
+	if fe != nil {
+		inetdata.Log.Errorf("%s", fe)
+		os.Exit(1)
+	}
+
+	sides := make([]*inetdata.SortedKeyReader, 2)
+	for i, path := range flag.Args() {
+		name := path
+		if path == "-" {
+			name = "stdin"
+		}
+		c := readSnapshot(path, *input_compression, progress.CountReader, *sort_skip, *sort_tmp, *sort_mem*1024*1024*1024)
+		sides[i] = inetdata.NewSortedKeyLineReader(name, c, fs, &input_count, &invalid_count)
+		sides[i].LineOrder = true
+		sides[i].RequireValue = true
+	}
+
+	// Progress tracker
+	quit := make(chan int)
+	go progress.Run(quit)
+
+	w, we := inetdata.CreateOutput("")
+	if we != nil {
+		inetdata.Log.Errorf("%s", we)
+		os.Exit(1)
+	}
+
+	exit_code := 0
+	if e := diff(sides[0], sides[1], *summary, w); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		exit_code = 1
+	}
+
+	if e := w.Close(); e != nil {
+		inetdata.Log.Warnf("Failed to write output: %s", e)
+		exit_code = 1
+	}
+
+	quit <- 0
+
+	if exit_code == 0 {
+		inetdata.Log.Infof("Found %d added, %d removed, and %d changed names", added_count, removed_count, changed_count)
+
+		inetdata.CloseRejects()
+
+		inetdata.ExitIfInterrupted()
+		inetdata.CheckErrorBudget(input_count)
+	}
+
+	os.Exit(exit_code)
+}
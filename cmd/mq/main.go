@@ -2,11 +2,14 @@ package main
 
 import (
 	"bytes"
+	"encoding/csv"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"github.com/fathom6/golang-mtbl"
 	"github.com/fathom6/inetdata-parsers"
+	"github.com/fathom6/inetdata-parsers/bloom"
+	"github.com/fathom6/inetdata-parsers/mtbl"
+	"github.com/fathom6/inetdata-parsers/mtblfile"
 	"io/ioutil"
 	"math"
 	"net"
@@ -20,17 +23,35 @@ var val_only *bool
 var prefix *string
 var rev_prefix *string
 var rev_key *bool
+var label_domain *string
+var rev_labels *bool
 var no_quotes *bool
 var as_json *bool
+var as_csv *bool
+var exact_key *string
+var range_start *string
+var range_end *string
+var csv_writer *csv.Writer
 var version *bool
 var domain *string
 var cidr *string
+var ip_key *string
 
 func usage() {
 	fmt.Println("Usage: " + os.Args[0] + " [options] <mtbl> ... <mtbl>")
 	fmt.Println("")
 	fmt.Println("Queries one or more MTBL databases")
 	fmt.Println("")
+	fmt.Println("Databases with IP address keys encoded by -ip-key binary or hex (see csv2mtbl and dns2mtbl)")
+	fmt.Println("are queried with the same -ip-key format. Encoded keys are displayed as IP addresses,")
+	fmt.Println("-key and -range-start/-range-end take IP addresses, and -cidr supports IPv6.")
+	fmt.Println("")
+	fmt.Println("-key lookups consult the Bloom filter sidecar of a database (<mtbl>.bloom, see -bloom in")
+	fmt.Println("the *2mtbl tools) first, and skip the databases that can not hold the key.")
+	fmt.Println("")
+	fmt.Println("A shard manifest (<name>.shards.json, see inetdata-mtbl-merge -shards) queries the shards of")
+	fmt.Println("the dataset, or only the shard that holds the -key.")
+	fmt.Println("")
 	fmt.Println("Options:")
 	flag.PrintDefaults()
 }
@@ -41,10 +62,19 @@ func findPaths(args []string) []string {
 		path := args[i]
 		info, e := os.Stat(path)
 		if e != nil {
-			fmt.Fprintf(os.Stderr, "Error: Path %s : %v\n", path, e)
+			inetdata.Log.Errorf("Path %s : %v", path, e)
 			os.Exit(1)
 		}
 
+		if info.Mode().IsRegular() {
+			requireMeta(path)
+		}
+
+		if info.Mode().IsRegular() && inetdata.IsShardManifest(path) {
+			paths = append(paths, shardPaths(path)...)
+			continue
+		}
+
 		if info.Mode().IsRegular() {
 			paths = append(paths, path)
 			continue
@@ -53,8 +83,14 @@ func findPaths(args []string) []string {
 		if info.Mode().IsDir() {
 			if files, e := ioutil.ReadDir(path); e == nil {
 				for _, f := range files {
+					// Shards are read as files of the directory
+					if strings.HasSuffix(f.Name(), bloom.EXTENSION) || strings.HasSuffix(f.Name(), inetdata.META_EXTENSION) ||
+						inetdata.IsShardManifest(f.Name()) {
+						continue
+					}
 					if f.Mode().IsRegular() {
 						npath := path + string(os.PathSeparator) + f.Name()
+						requireMeta(npath)
 						paths = append(paths, npath)
 					}
 				}
@@ -64,22 +100,60 @@ func findPaths(args []string) []string {
 	return paths
 }
 
+// Exit if a database has no provenance file with -require-meta
+func requireMeta(path string) {
+	if e := inetdata.CheckDatasetMeta(path); e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+}
+
+// Return the shard files of a manifest, or only the shard that holds the
+// -key being looked up
+func shardPaths(path string) []string {
+	m, e := inetdata.ReadShardManifest(path)
+	if e != nil {
+		inetdata.Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if len(*exact_key) > 0 {
+		return []string{m.ShardPath(m.Route([]byte(*exact_key)))}
+	}
+
+	paths := []string{}
+	for i := range m.Shards {
+		paths = append(paths, m.ShardPath(i))
+	}
+	return paths
+}
+
 func writeOutput(key_bytes []byte, val_bytes []byte) {
 
 	key := string(key_bytes)
 	val := string(val_bytes)
 
+	if *ip_key != "none" {
+		if ip, ok := inetdata.DecodeIPKey(key_bytes, *ip_key); ok {
+			key = ip.String()
+		}
+	}
+
 	if *rev_key {
 		key = inetdata.ReverseKey(key)
 	}
 
+	if *rev_labels {
+		key = inetdata.ReverseLabels(key)
+	}
+
 	if *as_json {
 		o := make(map[string]interface{})
-		v := make([][]string, 1)
+		var v interface{}
 
+		// Values that are not JSON encoded are emitted as strings
 		if de := json.Unmarshal([]byte(val), &v); de != nil {
-			fmt.Fprintf(os.Stderr, "Could not unmarshal %s -> %s as json: %s\n", key, val, de)
-			return
+			v = val
 		}
 
 		o["key"] = string(key)
@@ -87,11 +161,20 @@ func writeOutput(key_bytes []byte, val_bytes []byte) {
 
 		b, je := json.Marshal(o)
 		if je != nil {
-			fmt.Fprintf(os.Stderr, "Could not marshal %s -> %s as json: %s\n", key, val, je)
+			inetdata.Log.Warnf("Could not marshal %s -> %s as json: %s", key, val, je)
 			return
 		}
 		fmt.Println(string(b))
 
+	} else if *as_csv {
+		if *key_only {
+			csv_writer.Write([]string{key})
+		} else if *val_only {
+			csv_writer.Write([]string{val})
+		} else {
+			csv_writer.Write([]string{key, val})
+		}
+
 	} else if *key_only {
 		fmt.Printf("%s\n", key)
 	} else if *val_only {
@@ -120,6 +203,40 @@ func searchPrefix(r *mtbl.Reader, prefix string) {
 	}
 }
 
+// Check the Bloom filter sidecar of a database, if it has one, returning false
+// if the key is certainly not in the database
+func mayContain(path string, key string) bool {
+	r, e := mtblfile.Open(path, false)
+	if e != nil {
+		return true
+	}
+	defer r.Close()
+
+	f, e := inetdata.LoadMTBLBloom(path, r)
+	if e != nil {
+		inetdata.Log.Warnf("Ignoring the Bloom filter of %s: %s", path, e)
+		return true
+	}
+	return f == nil || f.MayContain([]byte(key))
+}
+
+func searchKey(r *mtbl.Reader, key string) {
+	if val_bytes, ok := mtbl.Get(r, []byte(key)); ok {
+		writeOutput([]byte(key), val_bytes)
+	}
+}
+
+func searchRange(r *mtbl.Reader, start string, end string) {
+	it := mtbl.IterRange(r, []byte(start), []byte(end))
+	for {
+		key_bytes, val_bytes, ok := it.Next()
+		if !ok {
+			break
+		}
+		writeOutput(key_bytes, val_bytes)
+	}
+}
+
 func searchAll(r *mtbl.Reader) {
 	it := mtbl.IterAll(r)
 	for {
@@ -152,6 +269,26 @@ func searchDomain(r *mtbl.Reader, domain string) {
 	}
 }
 
+func searchLabelDomain(r *mtbl.Reader, domain string) {
+	rdomain := []byte(inetdata.ReverseLabels(domain))
+
+	// Label domain searches always display the original name
+	*rev_labels = true
+
+	dot_rdomain := append(rdomain, '.')
+	it := mtbl.IterPrefix(r, rdomain)
+	for {
+		key_bytes, val_bytes, ok := it.Next()
+		if !ok {
+			break
+		}
+
+		if bytes.Equal(key_bytes, rdomain) || bytes.HasPrefix(key_bytes, dot_rdomain) {
+			writeOutput(key_bytes, val_bytes)
+		}
+	}
+}
+
 func searchPrefixIPv4(r *mtbl.Reader, prefix string) {
 	it := mtbl.IterPrefix(r, []byte(prefix))
 	for {
@@ -184,20 +321,20 @@ func searchCIDR(r *mtbl.Reader, cidr string) {
 	// Parse CIDR into base address + mask
 	ip, net, err := net.ParseCIDR(cidr)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Invalid CIDR %s: %s\n", cidr, err.Error())
+		inetdata.Log.Warnf("Invalid CIDR %s: %s", cidr, err.Error())
 		return
 	}
 
 	// Verify IPv4 for now
 	ip4 := net.IP.To4()
 	if ip4 == nil {
-		fmt.Fprintf(os.Stderr, "Invalid IPv4 CIDR %s\n", cidr)
+		inetdata.Log.Warnf("Invalid IPv4 CIDR %s", cidr)
 		return
 	}
 
 	net_base, err := inetdata.IPv4_to_UInt(net.IP.String())
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Invalid IPv4 Address %s: %s\n", ip.String(), err.Error())
+		inetdata.Log.Warnf("Invalid IPv4 Address %s: %s", ip.String(), err.Error())
 		return
 	}
 
@@ -251,6 +388,37 @@ func searchCIDR(r *mtbl.Reader, cidr string) {
 	}
 }
 
+// Search a database with encoded IP address keys, where a CIDR is a single range
+func searchCIDRKey(r *mtbl.Reader, cidr string) {
+	if !strings.Contains(cidr, "/") {
+		if strings.Contains(cidr, ":") {
+			cidr = cidr + "/128"
+		} else {
+			cidr = cidr + "/32"
+		}
+	}
+
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		inetdata.Log.Warnf("Invalid CIDR %s: %s", cidr, err.Error())
+		return
+	}
+
+	s_ip, e_ip := inetdata.CIDRRange(n)
+
+	start := inetdata.EncodeIPKey(s_ip, *ip_key)
+	end := inetdata.EncodeIPKey(e_ip, *ip_key)
+
+	it := mtbl.IterRange(r, start, end)
+	for {
+		key_bytes, val_bytes, ok := it.Next()
+		if !ok {
+			break
+		}
+		writeOutput(key_bytes, val_bytes)
+	}
+}
+
 func main() {
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
@@ -263,13 +431,22 @@ func main() {
 	prefix = flag.String("p", "", "Only return keys with this prefix")
 	rev_prefix = flag.String("r", "", "Only return keys with this prefix in reverse form")
 	rev_key = flag.Bool("R", false, "Display matches with the key in reverse form")
+	rev_labels = flag.Bool("L", false, "Display matches with the key domain labels in reverse order (com.example.www -> www.example.com)")
+	label_domain = flag.String("l", "", "Search for all matches for a specified domain in a database with label-reversed keys (-L in *2mtbl)")
 	no_quotes = flag.Bool("n", false, "Print raw values, not quoted values")
 	as_json = flag.Bool("j", false, "Print each record as a single line of JSON")
+	as_csv = flag.Bool("csv", false, "Print each record as a CSV row")
+	exact_key = flag.String("key", "", "Only return the record with this exact key")
+	range_start = flag.String("range-start", "", "Return keys greater than or equal to this value (requires -range-end)")
+	range_end = flag.String("range-end", "", "Return keys less than or equal to this value (requires -range-start)")
 	version = flag.Bool("version", false, "Show the version and build timestamp")
 	domain = flag.String("domain", "", "Search for all matches for a specified domain")
 	cidr = flag.String("cidr", "", "Search for all matches for the specified CIDR")
+	ip_key = flag.String("ip-key", "none", "The IP address key encoding used by the database: none, binary, or hex")
 
-	flag.Parse()
+	inetdata.AddRequireMetaFlags()
+
+	inetdata.ParseFlags("mq")
 
 	if *version {
 		inetdata.PrintVersion("mq")
@@ -282,29 +459,65 @@ func main() {
 	}
 
 	if *key_only && *val_only {
-		fmt.Fprintf(os.Stderr, "Error: Only one of -k or -v can be specified\n")
+		inetdata.Log.Errorf("Only one of -k or -v can be specified")
 		usage()
 		os.Exit(1)
 	}
 
-	if len(*prefix) > 0 && len(*rev_prefix) > 0 {
-		fmt.Fprintf(os.Stderr, "Error: Only one of -p or -r can be specified\n")
+	if *rev_key && *rev_labels {
+		inetdata.Log.Errorf("Only one of -R or -L can be specified")
 		usage()
 		os.Exit(1)
 	}
 
-	if len(*domain) > 0 && (len(*prefix) > 0 || len(*rev_prefix) > 0 || len(*cidr) > 0) {
-		fmt.Fprintf(os.Stderr, "Error: Only one of -p, -r, -domain, or -cidr can be specified\n")
+	if *as_json && *as_csv {
+		inetdata.Log.Errorf("Only one of -j or -csv can be specified")
 		usage()
 		os.Exit(1)
 	}
 
-	if len(*cidr) > 0 && (len(*prefix) > 0 || len(*rev_prefix) > 0 || len(*domain) > 0) {
-		fmt.Fprintf(os.Stderr, "Error: Only one of -p, -r, -domain, or -cidr can be specified\n")
+	if (len(*range_start) > 0) != (len(*range_end) > 0) {
+		inetdata.Log.Errorf("Both -range-start and -range-end must be specified")
 		usage()
 		os.Exit(1)
 	}
 
+	search_modes := 0
+	for _, v := range []string{*prefix, *rev_prefix, *exact_key, *range_start, *domain, *label_domain, *cidr} {
+		if len(v) > 0 {
+			search_modes++
+		}
+	}
+
+	if search_modes > 1 {
+		inetdata.Log.Errorf("Only one of -p, -r, -key, -range-start/-range-end, -domain, -l, or -cidr can be specified")
+		usage()
+		os.Exit(1)
+	}
+
+	if !inetdata.ValidIPKeyFormat(*ip_key) {
+		inetdata.Log.Errorf("Invalid IP key format specified: %s", *ip_key)
+		usage()
+		os.Exit(1)
+	}
+
+	// Convert IP address queries to the encoded key format
+	if *ip_key != "none" {
+		for _, v := range []*string{exact_key, range_start, range_end} {
+			if len(*v) == 0 {
+				continue
+			}
+			enc, e := inetdata.EncodeIPKeyString(*v, *ip_key)
+			if e != nil {
+				inetdata.Log.Errorf("%s", e)
+				os.Exit(1)
+			}
+			*v = string(enc)
+		}
+	}
+
+	csv_writer = csv.NewWriter(os.Stdout)
+
 	paths := findPaths(flag.Args())
 
 	exit_code := 0
@@ -313,9 +526,13 @@ func main() {
 
 		path := paths[i]
 
+		if len(*exact_key) > 0 && !mayContain(path, *exact_key) {
+			continue
+		}
+
 		r, e := mtbl.ReaderInit(path, &mtbl.ReaderOptions{VerifyChecksums: true})
 		if e != nil {
-			fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", path, e)
+			inetdata.Log.Warnf("Failed to read %s: %s", path, e)
 			exit_code = 1
 			continue
 		}
@@ -327,8 +544,27 @@ func main() {
 			continue
 		}
 
+		if len(*label_domain) > 0 {
+			searchLabelDomain(r, *label_domain)
+			continue
+		}
+
 		if len(*cidr) > 0 {
-			searchCIDR(r, *cidr)
+			if *ip_key != "none" {
+				searchCIDRKey(r, *cidr)
+			} else {
+				searchCIDR(r, *cidr)
+			}
+			continue
+		}
+
+		if len(*exact_key) > 0 {
+			searchKey(r, *exact_key)
+			continue
+		}
+
+		if len(*range_start) > 0 {
+			searchRange(r, *range_start, *range_end)
 			continue
 		}
 
@@ -346,5 +582,7 @@ func main() {
 		searchAll(r)
 	}
 
+	csv_writer.Flush()
+
 	os.Exit(exit_code)
 }
@@ -0,0 +1,177 @@
+package inetdata
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+	"io"
+)
+
+var InputCompressionTypes = []string{"auto", "none", "gzip", "bzip2", "xz", "zstd", "lz4"}
+
+var OutputCompressionTypes = []string{"none", "gzip", "zstd", "lz4"}
+
+var lz4_levels = []lz4.CompressionLevel{
+	lz4.Fast,
+	lz4.Level1,
+	lz4.Level2,
+	lz4.Level3,
+	lz4.Level4,
+	lz4.Level5,
+	lz4.Level6,
+	lz4.Level7,
+	lz4.Level8,
+	lz4.Level9,
+}
+
+var magic_gzip = []byte{0x1f, 0x8b}
+var magic_bzip2 = []byte("BZh")
+var magic_xz = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+var magic_zstd = []byte{0x28, 0xb5, 0x2f, 0xfd}
+var magic_lz4 = []byte{0x04, 0x22, 0x4d, 0x18}
+
+// DetectCompression identifies the compression format of a stream from its
+// leading magic bytes, returning "none" when no known format matches.
+func DetectCompression(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, magic_gzip):
+		return "gzip"
+	case bytes.HasPrefix(head, magic_xz):
+		return "xz"
+	case bytes.HasPrefix(head, magic_zstd):
+		return "zstd"
+	case bytes.HasPrefix(head, magic_lz4):
+		return "lz4"
+	case len(head) >= 4 && bytes.HasPrefix(head, magic_bzip2) && head[3] >= '1' && head[3] <= '9':
+		return "bzip2"
+	}
+	return "none"
+}
+
+// NewInputReader wraps an input stream with a decompressor. The codec is one
+// of InputCompressionTypes; "auto" selects the codec based on magic bytes.
+func NewInputReader(input io.Reader, codec string) (io.Reader, error) {
+
+	r := bufio.NewReaderSize(input, ReaderBuffer)
+
+	if codec == "auto" {
+		// Peek returns a short read with an error for small inputs
+		head, _ := r.Peek(6)
+		codec = DetectCompression(head)
+	}
+
+	switch codec {
+	case "none":
+		return r, nil
+	case "gzip":
+		return pgzip.NewReader(r)
+	case "bzip2":
+		return bzip2.NewReader(r), nil
+	case "xz":
+		return xz.NewReader(r)
+	case "zstd":
+		d, e := zstd.NewReader(r)
+		if e != nil {
+			return nil, e
+		}
+		return d.IOReadCloser(), nil
+	case "lz4":
+		return lz4.NewReader(r), nil
+	}
+
+	return nil, fmt.Errorf("unsupported input compression: %s", codec)
+}
+
+// ValidInputCompression returns true if the codec name is supported
+func ValidInputCompression(codec string) bool {
+	for i := range InputCompressionTypes {
+		if InputCompressionTypes[i] == codec {
+			return true
+		}
+	}
+	return false
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// NewOutputWriter wraps an output stream with a compressor that encodes blocks
+// in parallel across Workers CPUs. The codec is one of OutputCompressionTypes
+// and a level of -1 selects the default level for the codec. Close must be
+// called to flush the compressed stream; it does not close the underlying
+// writer.
+func NewOutputWriter(output io.Writer, codec string, level int) (io.WriteCloser, error) {
+
+	switch codec {
+	case "none":
+		return nopWriteCloser{output}, nil
+
+	case "gzip":
+		if level < 0 {
+			level = pgzip.DefaultCompression
+		}
+		w, e := pgzip.NewWriterLevel(output, level)
+		if e != nil {
+			return nil, e
+		}
+		if e = w.SetConcurrency(1024*1024, Workers*2); e != nil {
+			return nil, e
+		}
+		return w, nil
+
+	case "zstd":
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(Workers)}
+		if level >= 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(output, opts...)
+
+	case "lz4":
+		w := lz4.NewWriter(output)
+		opts := []lz4.Option{lz4.ConcurrencyOption(Workers)}
+		if level >= 0 {
+			if level >= len(lz4_levels) {
+				return nil, fmt.Errorf("invalid lz4 compression level: %d", level)
+			}
+			opts = append(opts, lz4.CompressionLevelOption(lz4_levels[level]))
+		}
+		if e := w.Apply(opts...); e != nil {
+			return nil, e
+		}
+		return w, nil
+	}
+
+	return nil, fmt.Errorf("unsupported output compression: %s", codec)
+}
+
+// ValidOutputCompression returns true if the codec name is supported
+func ValidOutputCompression(codec string) bool {
+	for i := range OutputCompressionTypes {
+		if OutputCompressionTypes[i] == codec {
+			return true
+		}
+	}
+	return false
+}
+
+// OutputCompressionExtension returns the conventional file extension for an
+// output codec, including the leading dot, or an empty string for none
+func OutputCompressionExtension(codec string) string {
+	switch codec {
+	case "gzip":
+		return ".gz"
+	case "zstd":
+		return ".zst"
+	case "lz4":
+		return ".lz4"
+	}
+	return ""
+}
@@ -0,0 +1,201 @@
+package inetdata
+
+import (
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The flags that control the configuration itself, which are never read from
+// a config file or the environment
+var config_flags = map[string]bool{
+	"config":       true,
+	"print-config": true,
+	"version":      true,
+}
+
+// ParseFlags parses the command line like flag.Parse, registering the
+// -config, -print-config, -log-level, and -log-format flags first. Flags that
+// are not given on the command line are then read from the environment, as
+// INETDATA_<NAME> with dashes replaced by underscores (such as
+// INETDATA_OUTPUT_COMPRESSION), and otherwise from the config file. Log is
+// configured with the tool as its component. With -print-config, the
+// effective values are printed as a config file and the tool exits.
+func ParseFlags(app string) {
+	config := flag.String("config", os.Getenv("INETDATA_CONFIG"), "Read the flags not given on the command line from this YAML or JSON file (env: INETDATA_CONFIG)")
+	print_config := flag.Bool("print-config", false, "Print the effective configuration as a config file and exit")
+	log_level := flag.String("log-level", "info", "Write the messages of this level and above: debug, info, warn, or error")
+	log_format := flag.String("log-format", "text", "The format of the messages on stderr: text or json")
+	flag.Parse()
+
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	values := map[string][]string{}
+	if len(*config) > 0 {
+		v, e := LoadFlagConfig(*config, app)
+		if e != nil {
+			Log.Errorf("%s", e)
+			os.Exit(1)
+		}
+		values = v
+	}
+
+	// The environment takes precedence over the config file
+	flag.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(FlagEnvName(f.Name)); ok && !config_flags[f.Name] {
+			values[f.Name] = []string{v}
+		}
+	})
+
+	names := []string{}
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if given[name] {
+			continue
+		}
+		for _, v := range values[name] {
+			if e := flag.Set(name, v); e != nil {
+				Log.Errorf("Invalid value %q for -%s: %s", v, name, e)
+				os.Exit(1)
+			}
+		}
+	}
+
+	if e := Log.Configure(*log_level, *log_format, app); e != nil {
+		Log.Errorf("%s", e)
+		os.Exit(1)
+	}
+
+	if *print_config {
+		if e := WriteFlagConfig(os.Stdout, app); e != nil {
+			Log.Errorf("%s", e)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+}
+
+// FlagEnvName returns the environment variable of a flag
+func FlagEnvName(name string) string {
+	return "INETDATA_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// LoadFlagConfig reads the flag values of a tool from a YAML or JSON config
+// file. The top level maps flag names to values, and applies to every tool
+// that has the flag, while a section named after a tool, such as
+// inetdata-csvrollup, applies to that tool only and takes precedence. A list
+// sets a flag once for each element. Flags in the section of the tool that it
+// does not have are an error, since they are likely typos.
+func LoadFlagConfig(path string, app string) (map[string][]string, error) {
+	b, e := ioutil.ReadFile(path)
+	if e != nil {
+		return nil, e
+	}
+
+	doc := map[string]interface{}{}
+	if e := yaml.Unmarshal(b, &doc); e != nil {
+		return nil, fmt.Errorf("invalid config %s: %s", path, e)
+	}
+
+	res := map[string][]string{}
+	var section map[string]interface{}
+
+	for k, v := range doc {
+		if m, ok := v.(map[string]interface{}); ok {
+			if k == app {
+				section = m
+			}
+			continue
+		}
+		if flag.Lookup(k) == nil || config_flags[k] {
+			continue
+		}
+		vals, e := configValues(v)
+		if e != nil {
+			return nil, fmt.Errorf("invalid config %s: %s: %s", path, k, e)
+		}
+		res[k] = vals
+	}
+
+	for k, v := range section {
+		if flag.Lookup(k) == nil || config_flags[k] {
+			return nil, fmt.Errorf("invalid config %s: %s has no flag -%s", path, app, k)
+		}
+		vals, e := configValues(v)
+		if e != nil {
+			return nil, fmt.Errorf("invalid config %s: %s: %s", path, k, e)
+		}
+		res[k] = vals
+	}
+
+	return res, nil
+}
+
+// Return the flag values of a config value, a scalar or a list of scalars
+func configValues(v interface{}) ([]string, error) {
+	switch t := v.(type) {
+	case nil:
+		return []string{}, nil
+	case []interface{}:
+		res := []string{}
+		for _, e := range t {
+			vals, err := configValues(e)
+			if err != nil {
+				return nil, err
+			}
+			if len(vals) != 1 {
+				return nil, fmt.Errorf("lists may only hold values")
+			}
+			res = append(res, vals...)
+		}
+		return res, nil
+	case map[string]interface{}:
+		return nil, fmt.Errorf("expected a value or a list")
+	}
+	return []string{fmt.Sprint(v)}, nil
+}
+
+// Return the value of a flag for a config file. Durations and custom flags
+// are written as they are given on the command line, except for repeated
+// flags whose Get returns a []string, which are written as lists.
+func flagConfigValue(f *flag.Flag) interface{} {
+	if g, ok := f.Value.(flag.Getter); ok {
+		switch v := g.Get().(type) {
+		case bool, int, int64, uint, uint64, float64, string, []string:
+			return v
+		}
+	}
+	return f.Value.String()
+}
+
+// WriteFlagConfig writes the current values of the flags of a tool as a
+// config file, in the section of the tool, which LoadFlagConfig reads back
+func WriteFlagConfig(w io.Writer, app string) error {
+	values := map[string]interface{}{}
+	flag.VisitAll(func(f *flag.Flag) {
+		if !config_flags[f.Name] {
+			values[f.Name] = flagConfigValue(f)
+		}
+	})
+
+	b, e := yaml.Marshal(map[string]interface{}{app: values})
+	if e != nil {
+		return e
+	}
+
+	fmt.Fprintf(w, "# %s v%s\n", app, Version)
+	_, e = w.Write(b)
+	return e
+}
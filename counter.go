@@ -0,0 +1,214 @@
+package inetdata
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// Approximate per-item overhead of a map entry holding a count
+const counterItemOverhead = 48
+
+// Counter counts items in a hash table. Once the items use max_mem bytes, the
+// counts are sorted and spilled to a temporary file in tmpdir, like the runs
+// of ExternalSort, and the runs are merged by Emit. A Counter is not safe for
+// concurrent use.
+type Counter struct {
+	tmpdir  string
+	max_mem uint64
+	used    uint64
+	counts  map[string]int64
+	runs    []string
+}
+
+// NewCounter returns a counter that spills once max_mem bytes are used
+func NewCounter(tmpdir string, max_mem uint64) *Counter {
+	return &Counter{tmpdir: tmpdir, max_mem: max_mem, counts: make(map[string]int64)}
+}
+
+// Add n to the count of an item
+func (c *Counter) Add(item string, n int64) error {
+	if _, ok := c.counts[item]; !ok {
+		c.used += uint64(len(item) + counterItemOverhead)
+	}
+	c.counts[item] += n
+
+	if c.used < c.max_mem {
+		return nil
+	}
+	return c.spill()
+}
+
+// Spills returns the number of runs written so far
+func (c *Counter) Spills() int {
+	return len(c.runs)
+}
+
+// Return the items in order
+func (c *Counter) sorted() []string {
+	items := make([]string, 0, len(c.counts))
+	for item := range c.counts {
+		items = append(items, item)
+	}
+	sort.Strings(items)
+	return items
+}
+
+// Write the counts to a run as length-prefixed items followed by varint
+// counts, since items may hold any byte
+func (c *Counter) spill() error {
+	fd, err := ioutil.TempFile(c.tmpdir, "inetdata-count-")
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriterSize(fd, 1024*1024)
+	buf := make([]byte, binary.MaxVarintLen64)
+	for _, item := range c.sorted() {
+		w.Write(buf[:binary.PutUvarint(buf, uint64(len(item)))])
+		w.WriteString(item)
+		if _, err = w.Write(buf[:binary.PutVarint(buf, c.counts[item])]); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+		return err
+	}
+
+	c.runs = append(c.runs, fd.Name())
+	c.counts = make(map[string]int64)
+	c.used = 0
+	return nil
+}
+
+type countRun struct {
+	name  string
+	r     *bufio.Reader
+	item  string
+	count int64
+}
+
+func (s *countRun) next() (bool, error) {
+	n, err := binary.ReadUvarint(s.r)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("%s: %s", s.name, err)
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(s.r, buf); err != nil {
+		return false, fmt.Errorf("%s: %s", s.name, err)
+	}
+	count, err := binary.ReadVarint(s.r)
+	if err != nil {
+		return false, fmt.Errorf("%s: %s", s.name, err)
+	}
+
+	s.item = string(buf)
+	s.count = count
+	return true, nil
+}
+
+type countRunHeap []*countRun
+
+func (h countRunHeap) Len() int            { return len(h) }
+func (h countRunHeap) Less(i, j int) bool  { return h[i].item < h[j].item }
+func (h countRunHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *countRunHeap) Push(x interface{}) { *h = append(*h, x.(*countRun)) }
+func (h *countRunHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+// Emit calls fn with each item and its total count. Without spills, items are
+// emitted in no particular order; otherwise the runs are merged and items are
+// emitted in byte order. The runs are removed once they are merged.
+func (c *Counter) Emit(fn func(item string, count int64) error) error {
+	if len(c.runs) == 0 {
+		for item, count := range c.counts {
+			if err := fn(item, count); err != nil {
+				return err
+			}
+		}
+		c.counts = make(map[string]int64)
+		return nil
+	}
+
+	defer c.Close()
+
+	if len(c.counts) > 0 {
+		if err := c.spill(); err != nil {
+			return err
+		}
+	}
+
+	h := &countRunHeap{}
+	for _, name := range c.runs {
+		fd, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+
+		run := &countRun{name: name, r: bufio.NewReaderSize(fd, 256*1024)}
+		ok, err := run.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			*h = append(*h, run)
+		}
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		item := (*h)[0].item
+		var total int64
+
+		for h.Len() > 0 && (*h)[0].item == item {
+			run := (*h)[0]
+			total += run.count
+
+			ok, err := run.next()
+			if err != nil {
+				return err
+			}
+			if ok {
+				heap.Fix(h, 0)
+			} else {
+				heap.Pop(h)
+			}
+		}
+
+		if err := fn(item, total); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close removes the spilled runs
+func (c *Counter) Close() {
+	for _, name := range c.runs {
+		os.Remove(name)
+	}
+	c.runs = nil
+}
@@ -0,0 +1,227 @@
+package inetdata
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var ErrUnterminatedQuote = errors.New("unterminated quoted field")
+var ErrBareQuote = errors.New("bare quote in unquoted field")
+var ErrQuoteGarbage = errors.New("extraneous data after quoted field")
+
+// FieldSplitter splits lines into delimited fields. By default lines are split
+// naively on every delimiter, which is fast but corrupts quoted fields that
+// contain the delimiter. In strict mode fields are parsed as RFC 4180 CSV:
+// fields may be enclosed in the quote character, and inside a quoted field
+// the escape character protects the following quote or escape character.
+// When the escape is the quote itself, a doubled quote stands for one quote.
+// Quoted fields may not span lines.
+type FieldSplitter struct {
+	Delimiter string
+	Strict    bool
+	Quote     byte
+	Escape    byte
+}
+
+// NewFieldSplitter creates a splitter. The quote and escape are single
+// characters; an empty escape uses the quote character.
+func NewFieldSplitter(delimiter string, strict bool, quote string, escape string) (*FieldSplitter, error) {
+	if len(delimiter) == 0 {
+		return nil, errors.New("the delimiter must not be empty")
+	}
+
+	if len(escape) == 0 {
+		escape = quote
+	}
+
+	if len(quote) != 1 {
+		return nil, fmt.Errorf("the quote must be a single character: %q", quote)
+	}
+
+	if len(escape) != 1 {
+		return nil, fmt.Errorf("the escape must be a single character: %q", escape)
+	}
+
+	if strings.Contains(delimiter, quote) {
+		return nil, fmt.Errorf("the delimiter %q must not contain the quote %q", delimiter, quote)
+	}
+
+	return &FieldSplitter{Delimiter: delimiter, Strict: strict, Quote: quote[0], Escape: escape[0]}, nil
+}
+
+// Split splits a line into at most n fields, with the same semantics as
+// strings.SplitN. In strict mode the fields are unquoted, except that the last
+// of n fields holds the remainder of the line as-is.
+func (s *FieldSplitter) Split(line string, n int) ([]string, error) {
+	if !s.Strict {
+		return strings.SplitN(line, s.Delimiter, n), nil
+	}
+
+	if n == 0 {
+		return nil, nil
+	}
+
+	fields := []string{}
+	for {
+		if n > 0 && len(fields) == n-1 {
+			return append(fields, line), nil
+		}
+
+		field, rest, more, err := s.next(line)
+		if err != nil {
+			return nil, err
+		}
+
+		fields = append(fields, field)
+		if !more {
+			return fields, nil
+		}
+		line = rest
+	}
+}
+
+// Parse the first field of the line, returning it with the rest of the line
+// after the delimiter, if there is one
+func (s *FieldSplitter) next(line string) (string, string, bool, error) {
+
+	if len(line) == 0 || line[0] != s.Quote {
+		idx := strings.Index(line, s.Delimiter)
+		field, rest, more := line, "", false
+		if idx >= 0 {
+			field, rest, more = line[:idx], line[idx+len(s.Delimiter):], true
+		}
+		if strings.IndexByte(field, s.Quote) >= 0 {
+			return "", "", false, ErrBareQuote
+		}
+		return field, rest, more, nil
+	}
+
+	var b strings.Builder
+
+	i := 1
+	for {
+		if i >= len(line) {
+			return "", "", false, ErrUnterminatedQuote
+		}
+
+		c := line[i]
+
+		// An escaped quote or escape character, or a doubled quote
+		if c == s.Escape && i+1 < len(line) && (line[i+1] == s.Quote || line[i+1] == s.Escape) {
+			b.WriteByte(line[i+1])
+			i += 2
+			continue
+		}
+
+		if c == s.Quote {
+			i++
+			break
+		}
+
+		b.WriteByte(c)
+		i++
+	}
+
+	rest := line[i:]
+	if len(rest) == 0 {
+		return b.String(), "", false, nil
+	}
+
+	if !strings.HasPrefix(rest, s.Delimiter) {
+		return "", "", false, ErrQuoteGarbage
+	}
+
+	return b.String(), rest[len(s.Delimiter):], true, nil
+}
+
+// QuoteField encodes a field for output. In strict mode, fields containing
+// the delimiter, quote, escape, or line breaks are quoted; otherwise the field
+// is returned unchanged.
+func (s *FieldSplitter) QuoteField(field string) string {
+	if !s.Strict {
+		return field
+	}
+
+	if !strings.Contains(field, s.Delimiter) && strings.IndexByte(field, s.Quote) < 0 &&
+		strings.IndexByte(field, s.Escape) < 0 && !strings.ContainsAny(field, "\r\n") {
+		return field
+	}
+
+	var b strings.Builder
+	b.WriteByte(s.Quote)
+	for i := 0; i < len(field); i++ {
+		if field[i] == s.Quote || (field[i] == s.Escape && s.Escape != s.Quote) {
+			b.WriteByte(s.Escape)
+		}
+		b.WriteByte(field[i])
+	}
+	b.WriteByte(s.Quote)
+	return b.String()
+}
+
+// Join encodes and joins fields with the delimiter
+func (s *FieldSplitter) Join(fields ...string) string {
+	out := make([]string, len(fields))
+	for i := range fields {
+		out[i] = s.QuoteField(fields[i])
+	}
+	return strings.Join(out, s.Delimiter)
+}
+
+// RowWriter is implemented by outputs that take rows of fields rather than
+// lines, such as Parquet and Avro files
+type RowWriter interface {
+	WriteStrings(row []string) error
+	Close() error
+}
+
+type lineRowWriter struct {
+	w         RowWriter
+	fields    int
+	delimiter string
+	pending   []byte
+}
+
+// NewLineRowWriter returns a writer that converts delimited lines written to it
+// into rows. Each line is split into at most the given number of fields, with
+// the last field holding the remainder of the line. Closing it closes the
+// row writer.
+func NewLineRowWriter(w RowWriter, fields int, delimiter string) io.WriteCloser {
+	return &lineRowWriter{w: w, fields: fields, delimiter: delimiter}
+}
+
+func (l *lineRowWriter) Write(b []byte) (int, error) {
+	l.pending = append(l.pending, b...)
+
+	for {
+		idx := bytes.IndexByte(l.pending, '\n')
+		if idx < 0 {
+			break
+		}
+
+		line := strings.TrimRight(string(l.pending[:idx]), "\r")
+		l.pending = l.pending[idx+1:]
+		if len(line) == 0 {
+			continue
+		}
+
+		if e := l.w.WriteStrings(strings.SplitN(line, l.delimiter, l.fields)); e != nil {
+			return 0, e
+		}
+	}
+
+	return len(b), nil
+}
+
+// Close writes any final unterminated line and closes the row writer
+func (l *lineRowWriter) Close() error {
+	if len(l.pending) > 0 {
+		if _, e := l.Write([]byte("\n")); e != nil {
+			return e
+		}
+	}
+	return l.w.Close()
+}
@@ -0,0 +1,195 @@
+package inetdata
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The log lists of the CT programs of Google and Apple, in the v3 schema
+const (
+	CT_LOG_LIST_GOOGLE = "https://www.gstatic.com/ct/log_list/v3/all_logs_list.json"
+	CT_LOG_LIST_APPLE  = "https://valid.apple.com/ct/log_list/current_log_list.json"
+)
+
+// CTLogStates are the states of a log in a log list. Usable and qualified
+// logs accept new entries, readonly logs are frozen at a final tree head, and
+// retired logs may no longer be served.
+var CTLogStates = []string{"pending", "qualified", "usable", "readonly", "retired", "rejected"}
+
+// CTLog is a log from a log list
+type CTLog struct {
+	URL         string
+	Description string
+	Operator    string
+	State       string
+
+	// The DER encoded public key of the log, if it is listed
+	Key []byte
+
+	// The size of the final tree head of a readonly log
+	FinalTreeSize int64
+}
+
+// Matches returns true if the url, description, or operator of the log
+// contain a pattern, ignoring case
+func (l CTLog) Matches(patterns []string) bool {
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		for _, v := range []string{l.URL, l.Description, l.Operator} {
+			if strings.Contains(strings.ToLower(v), p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type ctLogListV3 struct {
+	Operators []struct {
+		Name string `json:"name"`
+		Logs []struct {
+			Description string `json:"description"`
+			URL         string `json:"url"`
+			Key         []byte `json:"key"`
+			State       map[string]struct {
+				FinalTreeHead struct {
+					TreeSize int64 `json:"tree_size"`
+				} `json:"final_tree_head"`
+			} `json:"state"`
+		} `json:"logs"`
+	} `json:"operators"`
+}
+
+// ParseCTLogList parses a log list in the v3 schema. Logs without a state
+// are pending. Tiled logs are not listed, since they do not serve the RFC
+// 6962 API.
+func ParseCTLogList(b []byte) ([]CTLog, error) {
+	var list ctLogListV3
+	if e := json.Unmarshal(b, &list); e != nil {
+		return nil, fmt.Errorf("invalid log list: %s", e)
+	}
+
+	logs := []CTLog{}
+	for _, op := range list.Operators {
+		for _, l := range op.Logs {
+			if len(l.URL) == 0 {
+				continue
+			}
+			log := CTLog{
+				URL:         strings.TrimRight(l.URL, "/"),
+				Description: l.Description,
+				Operator:    op.Name,
+				State:       "pending",
+				Key:         l.Key,
+			}
+			for state, info := range l.State {
+				log.State = state
+				log.FinalTreeSize = info.FinalTreeHead.TreeSize
+			}
+			logs = append(logs, log)
+		}
+	}
+
+	if len(logs) == 0 {
+		return nil, fmt.Errorf("no logs found in log list")
+	}
+	return logs, nil
+}
+
+// The name of the cached copy of a log list
+func ctLogListCachePath(dir string, source string) string {
+	name := regexp.MustCompile(`[^A-Za-z0-9.-]+`).ReplaceAllString(source, "_")
+	return filepath.Join(dir, "ct-"+strings.Trim(name, "_"))
+}
+
+// DefaultCTLogListCache returns the directory of the cached log lists under
+// the cache directory of the user, or an empty string without one
+func DefaultCTLogListCache() string {
+	dir, e := os.UserCacheDir()
+	if e != nil {
+		return ""
+	}
+	return filepath.Join(dir, "inetdata")
+}
+
+// Read a log list from a file or an http(s) URL
+func readCTLogList(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return ioutil.ReadFile(source)
+	}
+
+	client := &http.Client{Timeout: time.Minute, Transport: LimitTransport(nil)}
+	resp, e := client.Get(source)
+	if e != nil {
+		return nil, e
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s: %s", source, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// LoadCTLogList reads log lists from files or URLs, such as CT_LOG_LIST_GOOGLE
+// and CT_LOG_LIST_APPLE. A log in several lists is returned once, with the
+// state of the first. With a cache directory, each list that is read is
+// saved there, and the saved copy is used when the list cannot be read.
+func LoadCTLogList(sources []string, cache string) ([]CTLog, error) {
+	logs := []CTLog{}
+	seen := map[string]bool{}
+
+	for _, source := range sources {
+		b, e := readCTLogList(source)
+		list := []CTLog{}
+		if e == nil {
+			list, e = ParseCTLogList(b)
+		}
+
+		if len(cache) > 0 {
+			path := ctLogListCachePath(cache, source)
+			if e == nil {
+				if we := writeCTLogListCache(path, b); we != nil {
+					Log.Warnf("Failed to cache the log list %s: %s", source, we)
+				}
+			} else if cb, ce := ioutil.ReadFile(path); ce == nil {
+				if cl, pe := ParseCTLogList(cb); pe == nil {
+					Log.Warnf("Failed to read the log list %s, using the copy in %s: %s", source, path, e)
+					list, e = cl, nil
+				}
+			}
+		}
+
+		if e != nil {
+			return nil, fmt.Errorf("%s: %s", source, e)
+		}
+
+		for _, l := range list {
+			if !seen[l.URL] {
+				seen[l.URL] = true
+				logs = append(logs, l)
+			}
+		}
+	}
+	return logs, nil
+}
+
+// Replace a cached log list atomically, so that a reader never finds a
+// truncated copy
+func writeCTLogListCache(path string, b []byte) error {
+	if e := os.MkdirAll(filepath.Dir(path), 0755); e != nil {
+		return e
+	}
+	tmp := path + ".tmp"
+	if e := ioutil.WriteFile(tmp, b, 0644); e != nil {
+		return e
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,356 @@
+package inetdata
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers/bloom"
+	"github.com/fathom6/inetdata-parsers/mtblfile"
+	"github.com/fathom6/inetdata-parsers/mtblutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The forms of the hostname keys of a MTBL dataset: reversed bytes (the
+// default of the *2mtbl tools), reversed labels (-L), or stored as-is
+const DATASET_KEYS_REVERSED = "reversed"
+const DATASET_KEYS_LABELS = "labels"
+const DATASET_KEYS_PLAIN = "plain"
+
+var DatasetKeyForms = []string{DATASET_KEYS_REVERSED, DATASET_KEYS_LABELS, DATASET_KEYS_PLAIN}
+
+// ValidDatasetKeyForm returns true if the hostname key form is supported
+func ValidDatasetKeyForm(form string) bool {
+	for i := range DatasetKeyForms {
+		if DatasetKeyForms[i] == form {
+			return true
+		}
+	}
+	return false
+}
+
+// MTBLDataset is a MTBL database, or the shards of one listed in a shard
+// manifest, with the forms of its hostname and IP address keys, so that it
+// can be queried by name and address. Lookups are safe for concurrent use,
+// and consult the Bloom filter sidecar of a file first if it has one.
+type MTBLDataset struct {
+	Name     string
+	Path     string
+	Keys     string
+	IPKey    string
+	Shards   []*MTBLShard
+	Manifest *ShardManifest
+}
+
+// MTBLShard is a file of a dataset, the only one of an unsharded dataset
+type MTBLShard struct {
+	Path   string
+	Reader *mtblfile.Reader
+	Bloom  *bloom.Filter
+}
+
+// Open a file of a dataset with its Bloom filter
+func openMTBLShard(path string, mmap bool) (*MTBLShard, error) {
+	var r *mtblfile.Reader
+	var e error
+	if mmap {
+		r, e = mtblfile.OpenMmap(path, false)
+	} else {
+		r, e = mtblfile.Open(path, false)
+	}
+	if e != nil {
+		return nil, e
+	}
+
+	f, e := LoadMTBLBloom(path, r)
+	if e != nil {
+		r.Close()
+		return nil, e
+	}
+	return &MTBLShard{Path: path, Reader: r, Bloom: f}, nil
+}
+
+// OpenMTBLDataset opens a MTBL database or a shard manifest (see
+// IsShardManifest), mapping the files into memory with mmap
+func OpenMTBLDataset(name string, path string, keys string, ip_key string, mmap bool) (*MTBLDataset, error) {
+	if !ValidDatasetKeyForm(keys) {
+		return nil, fmt.Errorf("invalid key form: %s", keys)
+	}
+	if !ValidIPKeyFormat(ip_key) {
+		return nil, fmt.Errorf("invalid IP key format: %s", ip_key)
+	}
+
+	if e := CheckDatasetMeta(path); e != nil {
+		return nil, e
+	}
+
+	d := &MTBLDataset{Name: name, Path: path, Keys: keys, IPKey: ip_key}
+
+	paths := []string{path}
+	if IsShardManifest(path) {
+		m, e := ReadShardManifest(path)
+		if e != nil {
+			return nil, e
+		}
+		d.Manifest = m
+
+		paths = []string{}
+		for i := range m.Shards {
+			paths = append(paths, m.ShardPath(i))
+		}
+	}
+
+	for _, p := range paths {
+		s, e := openMTBLShard(p, mmap)
+		if e != nil {
+			d.Close()
+			return nil, e
+		}
+		d.Shards = append(d.Shards, s)
+	}
+	return d, nil
+}
+
+// FindMTBLDatasets returns the paths of the .mtbl files and shard manifests
+// in a directory, by dataset name, which is the file name without the
+// extension. The shards of the manifests are not datasets of their own.
+func FindMTBLDatasets(dir string) (map[string]string, error) {
+	files, e := os.ReadDir(dir)
+	if e != nil {
+		return nil, e
+	}
+
+	paths := make(map[string]string)
+	shards := make(map[string]bool)
+	for _, f := range files {
+		if !f.Type().IsRegular() {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+
+		switch {
+		case IsShardManifest(f.Name()):
+			m, e := ReadShardManifest(path)
+			if e != nil {
+				return nil, e
+			}
+			for i := range m.Shards {
+				shards[m.ShardPath(i)] = true
+			}
+			paths[strings.TrimSuffix(f.Name(), SHARD_MANIFEST_EXTENSION)] = path
+
+		case strings.HasSuffix(f.Name(), ".mtbl"):
+			paths[strings.TrimSuffix(f.Name(), ".mtbl")] = path
+		}
+	}
+
+	for name, path := range paths {
+		if shards[path] {
+			delete(paths, name)
+		}
+	}
+	return paths, nil
+}
+
+// SortedDatasetNames returns the names of the datasets in order
+func SortedDatasetNames(datasets map[string]*MTBLDataset) []string {
+	names := make([]string, 0, len(datasets))
+	for name := range datasets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close the files of the database
+func (d *MTBLDataset) Close() error {
+	var err error
+	for _, s := range d.Shards {
+		if e := s.Reader.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Size returns the total size in bytes of the files of the database
+func (d *MTBLDataset) Size() uint64 {
+	var n uint64
+	for _, s := range d.Shards {
+		n += s.Reader.Size()
+	}
+	return n
+}
+
+// Entries returns the number of entries of the database
+func (d *MTBLDataset) Entries() uint64 {
+	var n uint64
+	for _, s := range d.Shards {
+		n += s.Reader.Metadata.CountEntries
+	}
+	return n
+}
+
+// Compression returns the compression of the database, or of its first shard
+func (d *MTBLDataset) Compression() string {
+	return d.Shards[0].Reader.Metadata.CompressionName()
+}
+
+// Return the index of the shard that holds a key
+func (d *MTBLDataset) route(key []byte) int {
+	if d.Manifest == nil {
+		return 0
+	}
+	return d.Manifest.Route(key)
+}
+
+// HostKey returns the key of a hostname
+func (d *MTBLDataset) HostKey(name string) []byte {
+	switch d.Keys {
+	case DATASET_KEYS_REVERSED:
+		return []byte(ReverseKey(name))
+	case DATASET_KEYS_LABELS:
+		return []byte(ReverseLabels(name))
+	}
+	return []byte(name)
+}
+
+// HostName returns the hostname of a key, see HostKey
+func (d *MTBLDataset) HostName(key []byte) string {
+	switch d.Keys {
+	case DATASET_KEYS_REVERSED:
+		return ReverseKey(string(key))
+	case DATASET_KEYS_LABELS:
+		return ReverseLabels(string(key))
+	}
+	return string(key)
+}
+
+// KeyName returns the IP address of a key in the IP key format of the
+// database, or else its hostname
+func (d *MTBLDataset) KeyName(key []byte) string {
+	if ip, ok := DecodeIPKey(key, d.IPKey); ok {
+		return ip.String()
+	}
+	return d.HostName(key)
+}
+
+// QueryKey returns the key of a hostname or IP address
+func (d *MTBLDataset) QueryKey(query string) []byte {
+	if ip := net.ParseIP(query); ip != nil {
+		return EncodeIPKey(ip, d.IPKey)
+	}
+	return d.HostKey(query)
+}
+
+// Get returns the value of a key
+func (d *MTBLDataset) Get(key []byte) ([]byte, bool, error) {
+	s := d.Shards[d.route(key)]
+	if s.Bloom != nil && !s.Bloom.MayContain(key) {
+		return nil, false, nil
+	}
+	return s.Reader.Get(key)
+}
+
+// Scan calls fn with the keys and values from the start key in order, until
+// fn returns false. The key is only valid during the call. The shards of a
+// hash manifest are merged, and the shards of a prefix manifest are read in
+// turn from the shard of the start key.
+func (d *MTBLDataset) Scan(start []byte, fn func(key []byte, val []byte) bool) error {
+	if d.Manifest != nil && d.Manifest.ShardBy == SHARD_BY_HASH {
+		iters := []*mtblfile.Iter{}
+		sources := []mtblutil.Iterator{}
+		for _, s := range d.Shards {
+			it := s.Reader.Iter(start)
+			iters = append(iters, it)
+			sources = append(sources, it)
+		}
+
+		m := mtblutil.NewMerger(sources)
+		for {
+			key, vals, ok := m.Next()
+			if !ok || !fn(key, vals[0]) {
+				break
+			}
+		}
+
+		for _, it := range iters {
+			if e := it.Err(); e != nil {
+				return e
+			}
+		}
+		return nil
+	}
+
+	for i := d.route(start); i < len(d.Shards); i++ {
+		it := d.Shards[i].Reader.Iter(start)
+		for {
+			key, val, ok := it.Next()
+			if !ok {
+				break
+			}
+			if !fn(key, val) {
+				return it.Err()
+			}
+		}
+		if e := it.Err(); e != nil {
+			return e
+		}
+		start = nil
+	}
+	return nil
+}
+
+// Subdomains calls fn with the name and value of the domain and each of its
+// subdomains, until fn returns false. Databases with plain keys can not be
+// scanned by suffix.
+func (d *MTBLDataset) Subdomains(domain string, fn func(name string, val []byte) bool) error {
+	if d.Keys == DATASET_KEYS_PLAIN {
+		return fmt.Errorf("dataset %s does not have reversed hostname keys", d.Name)
+	}
+
+	key := d.HostKey(domain)
+	dot_key := append(append([]byte{}, key...), '.')
+
+	return d.Scan(key, func(k []byte, v []byte) bool {
+		if !bytes.HasPrefix(k, key) {
+			return false
+		}
+		if bytes.Equal(k, key) || bytes.HasPrefix(k, dot_key) {
+			return fn(d.HostName(k), v)
+		}
+		return true
+	})
+}
+
+// Addresses calls fn with each address of the network found in the database
+// and its value, until fn returns false. Without encoded IP keys, only single
+// addresses can be looked up, since textual addresses do not sort numerically.
+func (d *MTBLDataset) Addresses(n *net.IPNet, fn func(ip net.IP, val []byte) bool) error {
+	s_ip, e_ip := CIDRRange(n)
+
+	if d.IPKey == "none" {
+		if !s_ip.Equal(e_ip) {
+			return fmt.Errorf("dataset %s does not have encoded IP keys for network lookups", d.Name)
+		}
+		val, ok, e := d.Get(EncodeIPKey(s_ip, d.IPKey))
+		if ok {
+			fn(s_ip, val)
+		}
+		return e
+	}
+
+	end := EncodeIPKey(e_ip, d.IPKey)
+	return d.Scan(EncodeIPKey(s_ip, d.IPKey), func(k []byte, v []byte) bool {
+		if bytes.Compare(k, end) > 0 {
+			return false
+		}
+		ip, ok := DecodeIPKey(k, d.IPKey)
+		if !ok {
+			return true
+		}
+		return fn(ip, v)
+	})
+}
@@ -0,0 +1,197 @@
+package inetdata
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers/bloom"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DedupFilters are the kinds of DedupSet: exact keeps a hash of each key, and
+// bloom keeps a Bloom filter that drops a small fraction of new keys as seen
+var DedupFilters = []string{"exact", "bloom"}
+
+// The size in bytes of the key hashes of an exact set
+const DEDUP_HASH_SIZE = 16
+
+// The files of a dedup state directory
+const (
+	DEDUP_KEYS_FILE   = "keys"
+	DEDUP_FILTER_FILE = "filter.bloom"
+)
+
+// DedupSet remembers the keys of the records that were written, so that the
+// records of a key seen before are dropped. The set is kept in a state
+// directory and loaded again by the next run, see Save.
+type DedupSet struct {
+	dir    string
+	filter *bloom.Filter
+	keys   map[[DEDUP_HASH_SIZE]byte]struct{}
+
+	// The exact hashes added since the last Save
+	pending [][DEDUP_HASH_SIZE]byte
+
+	lock sync.Mutex
+}
+
+// OpenDedupSet loads the set in a state directory, or starts an empty one. A
+// new Bloom filter is sized for capacity keys with the false positive rate
+// fpr, while a loaded filter keeps its size. An empty directory keeps the set
+// in memory only.
+func OpenDedupSet(dir string, kind string, capacity uint64, fpr float64) (*DedupSet, error) {
+	d := &DedupSet{dir: dir}
+
+	keys_path := filepath.Join(dir, DEDUP_KEYS_FILE)
+	filter_path := filepath.Join(dir, DEDUP_FILTER_FILE)
+
+	if len(dir) > 0 {
+		if e := os.MkdirAll(dir, 0755); e != nil {
+			return nil, e
+		}
+		other := filter_path
+		if kind == "bloom" {
+			other = keys_path
+		}
+		if _, e := os.Stat(other); e == nil {
+			return nil, fmt.Errorf("the dedup state in %s was not made with a %s filter", dir, kind)
+		}
+	}
+
+	switch kind {
+	case "exact":
+		d.keys = map[[DEDUP_HASH_SIZE]byte]struct{}{}
+		if len(dir) == 0 {
+			break
+		}
+		b, e := ioutil.ReadFile(keys_path)
+		if e != nil && !os.IsNotExist(e) {
+			return nil, e
+		}
+		// A partial hash at the end was cut short by a crash
+		for i := 0; i+DEDUP_HASH_SIZE <= len(b); i += DEDUP_HASH_SIZE {
+			var h [DEDUP_HASH_SIZE]byte
+			copy(h[:], b[i:])
+			d.keys[h] = struct{}{}
+		}
+		if n := len(b) % DEDUP_HASH_SIZE; n > 0 {
+			if e := os.Truncate(keys_path, int64(len(b)-n)); e != nil {
+				return nil, e
+			}
+		}
+
+	case "bloom":
+		if len(dir) > 0 {
+			f, e := bloom.Load(filter_path)
+			if e == nil {
+				d.filter = f
+				break
+			}
+			if !os.IsNotExist(e) {
+				return nil, e
+			}
+		}
+		f, e := bloom.New(capacity, fpr)
+		if e != nil {
+			return nil, e
+		}
+		d.filter = f
+
+	default:
+		return nil, fmt.Errorf("invalid dedup filter %q, expected exact or bloom", kind)
+	}
+	return d, nil
+}
+
+// Add adds a key to the set and returns true if it was not seen before
+func (d *DedupSet) Add(key []byte) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.filter != nil {
+		if d.filter.MayContain(key) {
+			return false
+		}
+		d.filter.Add(key)
+		// The entry count of the filter holds the number of keys added
+		d.filter.TableEntries++
+		return true
+	}
+
+	var h [DEDUP_HASH_SIZE]byte
+	sum := sha256.Sum256(key)
+	copy(h[:], sum[:])
+	if _, ok := d.keys[h]; ok {
+		return false
+	}
+	d.keys[h] = struct{}{}
+	if len(d.dir) > 0 {
+		d.pending = append(d.pending, h)
+	}
+	return true
+}
+
+// Contains returns true if a key was seen before, without adding it
+func (d *DedupSet) Contains(key []byte) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.filter != nil {
+		return d.filter.MayContain(key)
+	}
+
+	var h [DEDUP_HASH_SIZE]byte
+	sum := sha256.Sum256(key)
+	copy(h[:], sum[:])
+	_, ok := d.keys[h]
+	return ok
+}
+
+// Len returns the number of keys in the set
+func (d *DedupSet) Len() uint64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.filter != nil {
+		return d.filter.TableEntries
+	}
+	return uint64(len(d.keys))
+}
+
+// Save writes the set to its state directory. The records of the keys that
+// were added must be written first, since the next run drops them.
+func (d *DedupSet) Save() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if len(d.dir) == 0 {
+		return nil
+	}
+
+	if d.filter != nil {
+		return d.filter.Save(filepath.Join(d.dir, DEDUP_FILTER_FILE))
+	}
+
+	if len(d.pending) == 0 {
+		return nil
+	}
+	fd, e := os.OpenFile(filepath.Join(d.dir, DEDUP_KEYS_FILE), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if e != nil {
+		return e
+	}
+	buf := make([]byte, 0, len(d.pending)*DEDUP_HASH_SIZE)
+	for _, h := range d.pending {
+		buf = append(buf, h[:]...)
+	}
+	if _, e := fd.Write(buf); e != nil {
+		fd.Close()
+		return e
+	}
+	if e := fd.Close(); e != nil {
+		return e
+	}
+	d.pending = d.pending[:0]
+	return nil
+}
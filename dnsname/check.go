@@ -0,0 +1,79 @@
+package dnsname
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The reasons returned by CheckName and CheckValue, which are also the reason
+// codes of rejected records
+const REASON_INVALID_UTF8 = "invalid-utf8"
+const REASON_NAME_TOO_LONG = "name-too-long"
+const REASON_INVALID_LABEL = "invalid-label"
+const REASON_ILLEGAL_CHARACTER = "illegal-character"
+
+// The longest name and label allowed in DNS, in bytes
+const MAX_NAME_LENGTH = 253
+const MAX_LABEL_LENGTH = 63
+
+// CheckName returns the reason a record name is malformed, or an empty string
+// if it is acceptable. Names must be valid UTF-8, at most max bytes long (or
+// MAX_NAME_LENGTH when max is 0), have no empty or overlong labels, and only
+// contain letters, digits, and the -_*/ characters, unless they are IP
+// addresses. Unlike ValidHostname, uppercase, single-label, and
+// internationalized names are accepted, as are the / of classless reverse
+// delegations (0/25.2.0.192.in-addr.arpa).
+func CheckName(name string, max int) string {
+	if !utf8.ValidString(name) {
+		return REASON_INVALID_UTF8
+	}
+
+	if max == 0 {
+		max = MAX_NAME_LENGTH
+	}
+	if len(name) > max {
+		return REASON_NAME_TOO_LONG
+	}
+
+	// IP addresses are the names of PTR records in FDNS
+	if IsIP(name) {
+		return ""
+	}
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > MAX_LABEL_LENGTH {
+			return REASON_INVALID_LABEL
+		}
+		for _, ch := range label {
+			if ch < utf8.RuneSelf {
+				if !((ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9') ||
+					ch == '-' || ch == '_' || ch == '*' || ch == '/') {
+					return REASON_ILLEGAL_CHARACTER
+				}
+				continue
+			}
+			if !(unicode.IsLetter(ch) || unicode.IsDigit(ch) || unicode.IsMark(ch)) {
+				return REASON_ILLEGAL_CHARACTER
+			}
+		}
+	}
+
+	return ""
+}
+
+// CheckValue returns the reason a record value is malformed, or an empty
+// string if it is acceptable. Values may hold any text, such as TXT records,
+// but must be valid UTF-8 without control characters, which would break the
+// line-based outputs.
+func CheckValue(value string) string {
+	if !utf8.ValidString(value) {
+		return REASON_INVALID_UTF8
+	}
+	for _, ch := range value {
+		if unicode.IsControl(ch) {
+			return REASON_ILLEGAL_CHARACTER
+		}
+	}
+	return ""
+}
@@ -0,0 +1,150 @@
+// Package dnsname transforms domain names and hostnames the same way as the
+// inetdata tools, such as the reversed keys of MTBL files and the names of
+// zone file records.
+package dnsname
+
+import (
+	"net"
+	"strings"
+)
+
+// Reverse reverses the bytes of a name, turning www.example.com into
+// moc.elpmaxe.www. This is the key format of names in MTBL files, where a
+// prefix scan on "moc.elpmaxe." returns every subdomain.
+func Reverse(s string) string {
+	b := make([]byte, len(s))
+	var j int = len(s) - 1
+	for i := 0; i <= j; i++ {
+		b[j-i] = s[i]
+	}
+	return string(b)
+}
+
+// ReverseLabels reverses the label order of a domain name, turning
+// www.example.com into com.example.www. Keys stored in this form sort by
+// their parent domain, so a prefix scan on "com.example." returns every
+// subdomain. The transform is its own inverse.
+func ReverseLabels(s string) string {
+	labels := strings.Split(strings.TrimSuffix(s, "."), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, ".")
+}
+
+// IsIP returns true if the name is an IPv4 or IPv6 address, which may have
+// an IPv6 zone (ex: fe80::1%eth0)
+func IsIP(name string) bool {
+	if idx := strings.IndexByte(name, '%'); idx > 0 && strings.Contains(name, ":") {
+		name = name[:idx]
+	}
+	return net.ParseIP(name) != nil
+}
+
+// ParseArpa returns the address of an in-addr.arpa or ip6.arpa name, such as
+// 4.3.2.1.in-addr.arpa for 1.2.3.4, and false for other names, including
+// partial and classless delegations
+func ParseArpa(name string) (net.IP, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != 4 {
+			return nil, false
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		ip := net.ParseIP(strings.Join(labels, ".")).To4()
+		return ip, ip != nil
+
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(nibbles) != 32 {
+			return nil, false
+		}
+		var b strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			if len(nibbles[i]) != 1 {
+				return nil, false
+			}
+			b.WriteString(nibbles[i])
+			if i%4 == 0 && i > 0 {
+				b.WriteByte(':')
+			}
+		}
+		ip := net.ParseIP(b.String())
+		return ip, ip != nil
+	}
+	return nil, false
+}
+
+// Qualify completes a name from a zone file. Names ending with a dot are
+// fully qualified and have the dot removed, other names are relative to the
+// origin, which is appended. Empty names and IP addresses are left alone.
+func Qualify(name string, origin string) string {
+	if len(name) == 0 || IsIP(name) {
+		return name
+	}
+
+	if strings.HasSuffix(name, ".") {
+		return name[:len(name)-1]
+	}
+	return name + "." + strings.TrimSuffix(origin, ".")
+}
+
+// TrimDots removes leading and trailing dots from a name, leaving at least
+// one byte of a name made only of dots
+func TrimDots(name string) string {
+	for len(name) > 2 && name[0] == '.' {
+		name = name[1:]
+	}
+	for len(name) > 1 && name[len(name)-1] == '.' {
+		name = name[:len(name)-1]
+	}
+	return name
+}
+
+// ValidHostname returns true if the name is a syntactically valid hostname of
+// at least two labels. Labels may contain underscores, and a single leading
+// wildcard label is allowed. The name must be lowercase and have no trailing
+// dot.
+func ValidHostname(name string) bool {
+	return validLabels(name, 2)
+}
+
+// Return true if a lowercase name without a trailing dot has at least min
+// labels, all of them valid
+func validLabels(name string, min int) bool {
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+
+	labels := strings.Split(name, ".")
+	if len(labels) < min {
+		return false
+	}
+
+	for i, label := range labels {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		if label == "*" {
+			if i != 0 {
+				return false
+			}
+			continue
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, ch := range label {
+			if !((ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9') || ch == '-' || ch == '_') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,59 @@
+package dnsname
+
+import (
+	"fmt"
+	"golang.org/x/net/idna"
+	"strings"
+)
+
+// The IDNA2008 profile used to convert names. Unlike idna.Lookup, it allows
+// the underscores of service names (_dmarc, _sip._tcp) and wildcard labels,
+// which are checked by validLabels instead.
+var profile = idna.New(
+	idna.MapForLookup(),
+	idna.BidiRule(),
+	idna.Transitional(false),
+	idna.StrictDomainName(false),
+)
+
+// Normalize returns the canonical form of a hostname, so that names from CT
+// logs, zone files, and FDNS compare equal: surrounding whitespace and the
+// trailing dot are removed, the name is lowercased, and internationalized
+// labels are encoded as IDNA2008 punycode (xn--). An error is returned for
+// names with empty, overlong, or invalid labels, including punycode labels
+// that do not decode. IP addresses are returned lowercased.
+func Normalize(name string) (string, error) {
+	name = strings.TrimSuffix(strings.TrimSpace(name), ".")
+	if IsIP(name) {
+		return strings.ToLower(name), nil
+	}
+
+	ascii, err := ToASCII(name)
+	if err != nil {
+		return "", err
+	}
+
+	if !validLabels(ascii, 1) {
+		return "", fmt.Errorf("invalid hostname: %q", name)
+	}
+	return ascii, nil
+}
+
+// ToASCII encodes the internationalized labels of a name as IDNA2008
+// punycode and lowercases the rest
+func ToASCII(name string) (string, error) {
+	ascii, err := profile.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid hostname: %q: %s", name, err)
+	}
+	return strings.ToLower(ascii), nil
+}
+
+// ToUnicode decodes the punycode labels of a name for display
+func ToUnicode(name string) (string, error) {
+	uname, err := profile.ToUnicode(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid hostname: %q: %s", name, err)
+	}
+	return uname, nil
+}
@@ -0,0 +1,42 @@
+package dnsname
+
+import "strings"
+
+// The policies of Wildcards for names with a leading wildcard label
+const WILDCARD_KEEP = "keep"
+const WILDCARD_STRIP = "strip"
+const WILDCARD_DROP = "drop"
+const WILDCARD_EXPAND_BASE = "expand-base"
+
+// WildcardPolicies are the values of the -wildcards flag of the tools
+var WildcardPolicies = []string{WILDCARD_KEEP, WILDCARD_STRIP, WILDCARD_DROP, WILDCARD_EXPAND_BASE}
+
+// ValidWildcardPolicy returns true if the policy is one of WildcardPolicies
+func ValidWildcardPolicy(policy string) bool {
+	for _, p := range WildcardPolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// Wildcards returns the names to emit for a name under a wildcard policy.
+// Names without a leading wildcard label are returned as they are. A
+// wildcard name (*.example.com) is kept as it is, stripped to its base name
+// (example.com), dropped, or expanded to both the wildcard and the base name.
+func Wildcards(name string, policy string) []string {
+	if !strings.HasPrefix(name, "*.") {
+		return []string{name}
+	}
+
+	switch policy {
+	case WILDCARD_STRIP:
+		return []string{name[2:]}
+	case WILDCARD_DROP:
+		return nil
+	case WILDCARD_EXPAND_BASE:
+		return []string{name, name[2:]}
+	}
+	return []string{name}
+}
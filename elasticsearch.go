@@ -0,0 +1,409 @@
+package inetdata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ElasticsearchURL describes an index as es://[user:pass@]host:port/index?options
+//
+//	tls     : connect with https (default 0)
+//	op      : the bulk operation, index or create (default index)
+//	id      : derive document IDs from the key: none, key, or sha1 (default none)
+//	fields  : comma-separated names for the fields of CSV lines, the last field
+//	          holds the remainder of the line (default key,value)
+//	delimiter : the field delimiter for CSV lines (default ,)
+//	batch   : the maximum number of documents per bulk request (default 1000)
+//	linger  : the maximum time to wait for a batch to fill (default 1s)
+//	workers : the number of concurrent bulk requests (default 2)
+//	retries : the number of retries for rejected requests and documents (default 5)
+//
+// Lines that are JSON objects are indexed as-is and their key is the value of
+// the first field name. Other lines are split into the named fields.
+type ElasticsearchURL struct {
+	Endpoint  string
+	Index     string
+	User      string
+	Password  string
+	Op        string
+	IDMode    string
+	Fields    []string
+	Delimiter string
+	BatchSize int
+	Linger    time.Duration
+	Workers   int
+	Retries   int
+}
+
+// ParseElasticsearchURL parses an es:// URL
+func ParseElasticsearchURL(s string) (*ElasticsearchURL, error) {
+	p, e := url.Parse(s)
+	if e != nil || p.Scheme != "es" {
+		return nil, fmt.Errorf("not an elasticsearch URL: %s", s)
+	}
+
+	index := strings.Trim(p.Path, "/")
+	if len(p.Host) == 0 || len(index) == 0 || strings.Contains(index, "/") {
+		return nil, fmt.Errorf("invalid elasticsearch URL, expected es://host:port/index: %s", s)
+	}
+
+	u := &ElasticsearchURL{
+		Index:     index,
+		Op:        "index",
+		IDMode:    "none",
+		Fields:    []string{"key", "value"},
+		Delimiter: ",",
+		BatchSize: 1000,
+		Linger:    time.Second,
+		Workers:   2,
+		Retries:   5,
+	}
+
+	if p.User != nil {
+		u.User = p.User.Username()
+		u.Password, _ = p.User.Password()
+	}
+
+	scheme := "http"
+	for k := range p.Query() {
+		v := p.Query().Get(k)
+		switch k {
+		case "tls":
+			if v == "1" || v == "true" {
+				scheme = "https"
+			}
+		case "op":
+			if v != "index" && v != "create" {
+				e = errors.New("expected index or create")
+			}
+			u.Op = v
+		case "id":
+			if v != "none" && v != "key" && v != "sha1" {
+				e = errors.New("expected none, key, or sha1")
+			}
+			u.IDMode = v
+		case "fields":
+			u.Fields = strings.Split(v, ",")
+		case "delimiter":
+			u.Delimiter = UnescapeDelimiter(v)
+		case "batch":
+			u.BatchSize, e = strconv.Atoi(v)
+			if e == nil && u.BatchSize < 1 {
+				e = errors.New("must be positive")
+			}
+		case "linger":
+			u.Linger, e = time.ParseDuration(v)
+		case "workers":
+			u.Workers, e = strconv.Atoi(v)
+			if e == nil && u.Workers < 1 {
+				e = errors.New("must be positive")
+			}
+		case "retries":
+			u.Retries, e = strconv.Atoi(v)
+		default:
+			e = errors.New("unknown option")
+		}
+
+		if e != nil {
+			return nil, fmt.Errorf("invalid elasticsearch URL option %s=%q: %s", k, v, e)
+		}
+	}
+
+	u.Endpoint = scheme + "://" + p.Host + "/_bulk"
+	return u, nil
+}
+
+type esWriter struct {
+	sync.Mutex
+	u       *ElasticsearchURL
+	client  *http.Client
+	pending []byte
+	batch   [][]byte
+	queue   chan [][]byte
+	quit    chan bool
+	wg      sync.WaitGroup
+	failed  int64
+	err     atomic.Value
+}
+
+// NewElasticsearchWriter returns a writer that indexes each line written to it
+// as a document using the bulk API. Batches are sent by a fixed number of
+// workers; writes block while all workers are busy. Rejected requests and
+// documents (HTTP 429 and 5xx) are retried with a backoff.
+func NewElasticsearchWriter(u *ElasticsearchURL) io.WriteCloser {
+	w := &esWriter{
+		u:      u,
+		client: &http.Client{Timeout: 5 * time.Minute},
+		queue:  make(chan [][]byte),
+		quit:   make(chan bool),
+	}
+
+	for i := 0; i < u.Workers; i++ {
+		w.wg.Add(1)
+		go w.worker()
+	}
+
+	// Send partial batches after the linger time
+	go func() {
+		t := time.NewTicker(u.Linger)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				w.Lock()
+				w.flush()
+				w.Unlock()
+			case <-w.quit:
+				return
+			}
+		}
+	}()
+
+	return w
+}
+
+// Build the bulk action and document lines for a record
+func (w *esWriter) document(line string) ([]byte, error) {
+	var doc map[string]interface{}
+	var key string
+
+	if strings.HasPrefix(line, "{") {
+		if e := json.Unmarshal([]byte(line), &doc); e != nil {
+			return nil, e
+		}
+		if v, ok := doc[w.u.Fields[0]]; ok {
+			key = fmt.Sprint(v)
+		}
+	} else {
+		bits := strings.SplitN(line, w.u.Delimiter, len(w.u.Fields))
+		doc = make(map[string]interface{}, len(bits))
+		for i := range bits {
+			doc[w.u.Fields[i]] = bits[i]
+		}
+		key = bits[0]
+	}
+
+	meta := map[string]string{"_index": w.u.Index}
+	switch w.u.IDMode {
+	case "key":
+		meta["_id"] = key
+	case "sha1":
+		sum := sha1.Sum([]byte(key))
+		meta["_id"] = hex.EncodeToString(sum[:])
+	}
+
+	if id, ok := meta["_id"]; ok && len(id) == 0 {
+		return nil, errors.New("empty document ID")
+	}
+
+	action, e := json.Marshal(map[string]interface{}{w.u.Op: meta})
+	if e != nil {
+		return nil, e
+	}
+
+	body, e := json.Marshal(doc)
+	if e != nil {
+		return nil, e
+	}
+
+	return append(append(append(action, '\n'), body...), '\n'), nil
+}
+
+func (w *esWriter) failure() error {
+	if e, ok := w.err.Load().(error); ok {
+		return e
+	}
+	return nil
+}
+
+func (w *esWriter) Write(b []byte) (int, error) {
+	if e := w.failure(); e != nil {
+		return 0, e
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	w.pending = append(w.pending, b...)
+
+	for {
+		idx := bytes.IndexByte(w.pending, '\n')
+		if idx < 0 {
+			break
+		}
+
+		line := strings.TrimSpace(string(w.pending[:idx]))
+		w.pending = w.pending[idx+1:]
+		if len(line) == 0 {
+			continue
+		}
+
+		item, e := w.document(line)
+		if e != nil {
+			Log.Warnf("Elasticsearch: skipping invalid record %q: %s", line, e)
+			atomic.AddInt64(&w.failed, 1)
+			continue
+		}
+
+		w.batch = append(w.batch, item)
+		if len(w.batch) >= w.u.BatchSize {
+			w.flush()
+		}
+	}
+
+	return len(b), nil
+}
+
+// Hand the current batch to a worker, the lock must be held
+func (w *esWriter) flush() {
+	if len(w.batch) == 0 {
+		return
+	}
+	w.queue <- w.batch
+	w.batch = nil
+}
+
+func (w *esWriter) worker() {
+	defer w.wg.Done()
+	for items := range w.queue {
+		if e := w.send(items); e != nil {
+			w.err.Store(e)
+		}
+	}
+}
+
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// Send a batch, retrying the whole request or the rejected documents
+func (w *esWriter) send(items [][]byte) error {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<uint(attempt-1)) * time.Second)
+		}
+
+		retry, e := w.bulk(items)
+		if e == nil && len(retry) == 0 {
+			return nil
+		}
+
+		if attempt >= w.u.Retries {
+			if e == nil {
+				e = fmt.Errorf("%d documents were rejected", len(retry))
+			}
+			return fmt.Errorf("elasticsearch bulk request failed after %d retries: %s", attempt, e)
+		}
+
+		if e != nil {
+			Log.Warnf("Elasticsearch: retrying bulk request: %s", e)
+			continue
+		}
+		items = retry
+	}
+}
+
+// Perform one bulk request, returning the documents that should be retried.
+// An error means the whole request should be retried.
+func (w *esWriter) bulk(items [][]byte) ([][]byte, error) {
+	req, e := http.NewRequest("POST", w.u.Endpoint, bytes.NewReader(bytes.Join(items, nil)))
+	if e != nil {
+		return nil, e
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if len(w.u.User) > 0 {
+		req.SetBasicAuth(w.u.User, w.u.Password)
+	}
+
+	resp, e := w.client.Do(req)
+	if e != nil {
+		return nil, e
+	}
+	defer resp.Body.Close()
+
+	body, e := ioutil.ReadAll(resp.Body)
+	if e != nil {
+		return nil, e
+	}
+
+	if resp.StatusCode == 429 || resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	if resp.StatusCode != 200 {
+		w.err.Store(fmt.Errorf("elasticsearch bulk request failed: HTTP %d: %s", resp.StatusCode, body))
+		return nil, nil
+	}
+
+	var res esBulkResponse
+	if e := json.Unmarshal(body, &res); e != nil {
+		return nil, fmt.Errorf("invalid bulk response: %s", e)
+	}
+
+	if !res.Errors {
+		return nil, nil
+	}
+
+	retry := [][]byte{}
+	for i, item := range res.Items {
+		for _, r := range item {
+			switch {
+			case r.Status == 429 || r.Status >= 500:
+				if i < len(items) {
+					retry = append(retry, items[i])
+				}
+			case r.Status >= 300:
+				Log.Warnf("Elasticsearch: document rejected: HTTP %d: %s", r.Status, r.Error)
+				atomic.AddInt64(&w.failed, 1)
+			}
+		}
+	}
+	return retry, nil
+}
+
+// Close sends the remaining documents and waits for all requests to finish
+func (w *esWriter) Close() error {
+	w.Lock()
+	if len(w.pending) > 0 {
+		w.pending = append(w.pending, '\n')
+	}
+	w.Unlock()
+
+	if _, e := w.Write(nil); e != nil {
+		return e
+	}
+
+	close(w.quit)
+
+	w.Lock()
+	w.flush()
+	close(w.queue)
+	w.Unlock()
+
+	w.wg.Wait()
+
+	if e := w.failure(); e != nil {
+		return e
+	}
+	if n := atomic.LoadInt64(&w.failed); n > 0 {
+		return fmt.Errorf("%d documents could not be indexed", n)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package inetdata
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FetchOptions configures the ranged downloads of OpenURL
+type FetchOptions struct {
+	// The number of chunks fetched at once, and the size of each chunk
+	Workers   int
+	ChunkSize int64
+
+	// The number of attempts of each chunk, and the delay before the second
+	// attempt, which doubles with each attempt
+	Retries int
+	Backoff time.Duration
+
+	// Headers added to every request, such as API keys
+	Header http.Header
+
+	// The time limit of each request, or 0 for no limit
+	Timeout time.Duration
+}
+
+// DefaultFetchOptions returns the options of the object readers: 8 chunks of
+// 16MB in flight, and 3 attempts with a one second backoff
+func DefaultFetchOptions() FetchOptions {
+	return FetchOptions{
+		Workers:   object_workers,
+		ChunkSize: object_chunk_size,
+		Retries:   object_retries,
+		Backoff:   time.Second,
+		Header:    http.Header{},
+	}
+}
+
+// A file on a web server that supports range requests
+type httpObject struct {
+	url    string
+	header http.Header
+	client *http.Client
+}
+
+func (o *httpObject) request(ctx context.Context, offset int64, last int64) (*http.Response, error) {
+	req, e := http.NewRequest("GET", o.url, nil)
+	if e != nil {
+		return nil, e
+	}
+	for k, v := range o.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, last))
+	return o.client.Do(req.WithContext(ctx))
+}
+
+// The size is read from the Content-Range of a request of the first byte,
+// since signed URLs are often only valid for GET requests
+func (o *httpObject) size(ctx context.Context) (int64, error) {
+	resp, e := o.request(ctx, 0, 0)
+	if e != nil {
+		return 0, e
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return -1, nil
+	}
+
+	cr := resp.Header.Get("Content-Range")
+	idx := strings.LastIndex(cr, "/")
+	if idx < 0 {
+		return -1, nil
+	}
+	size, e := strconv.ParseInt(cr[idx+1:], 10, 64)
+	if e != nil {
+		return -1, nil
+	}
+	return size, nil
+}
+
+func (o *httpObject) readRange(ctx context.Context, offset int64, length int64) ([]byte, error) {
+	resp, e := o.request(ctx, offset, offset+length-1)
+	if e != nil {
+		return nil, e
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("range request failed: %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (o *httpObject) upload(ctx context.Context, r io.Reader) error {
+	return fmt.Errorf("uploads are not supported")
+}
+
+// OpenURL returns a reader over an HTTP or HTTPS URL and its size. When the
+// server supports range requests, chunks are fetched in parallel, retried on
+// failure, and returned in order, like OpenObject. Otherwise the URL is read
+// with a single request and the size is -1. The requests are subject to the
+// rate limits of ApplyRateLimits.
+func OpenURL(url string, opts FetchOptions) (io.ReadCloser, int64, error) {
+	client := &http.Client{Timeout: opts.Timeout, Transport: LimitTransport(nil)}
+	o := &httpObject{url: url, header: opts.Header, client: client}
+
+	size, e := o.size(context.Background())
+	if e != nil {
+		return nil, 0, fmt.Errorf("%s: %s", url, e)
+	}
+
+	if size >= 0 {
+		r, e := newObjectReader(o, url, opts.Workers, opts.ChunkSize, opts.Retries, opts.Backoff)
+		return r, size, e
+	}
+
+	req, e := http.NewRequest("GET", url, nil)
+	if e != nil {
+		return nil, 0, e
+	}
+	for k, v := range opts.Header {
+		req.Header[k] = v
+	}
+	resp, e := o.client.Do(req)
+	if e != nil {
+		return nil, 0, fmt.Errorf("%s: %s", url, e)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return resp.Body, -1, nil
+}
+
+// Digest checks the contents written to it against an expected checksum
+type Digest struct {
+	Algorithm string
+	Sum       []byte
+	h         hash.Hash
+}
+
+// The hash functions of digests, by name and by the length of their sums
+var digest_algorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+var digest_lengths = map[int]string{
+	md5.Size:    "md5",
+	sha1.Size:   "sha1",
+	sha256.Size: "sha256",
+	sha512.Size: "sha512",
+}
+
+// NewDigest parses an expected checksum: an algorithm (md5, sha1, sha256,
+// or sha512), a colon, and the hex sum, such as "sha256:9f86d0...". The
+// algorithm may be left out and is then told from the length of the sum.
+func NewDigest(spec string) (*Digest, error) {
+	algorithm, sum := "", strings.TrimSpace(spec)
+	if idx := strings.Index(sum, ":"); idx >= 0 {
+		algorithm, sum = strings.ToLower(sum[:idx]), sum[idx+1:]
+	}
+
+	b, e := hex.DecodeString(sum)
+	if e != nil {
+		return nil, fmt.Errorf("invalid digest: %q", spec)
+	}
+	if len(algorithm) == 0 {
+		algorithm = digest_lengths[len(b)]
+	}
+
+	f, ok := digest_algorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported digest: %q", spec)
+	}
+	h := f()
+	if h.Size() != len(b) {
+		return nil, fmt.Errorf("invalid %s digest length: %q", algorithm, spec)
+	}
+	return &Digest{Algorithm: algorithm, Sum: b, h: h}, nil
+}
+
+func (d *Digest) Write(b []byte) (int, error) {
+	return d.h.Write(b)
+}
+
+// Verify returns an error if the contents written do not match the sum
+func (d *Digest) Verify() error {
+	sum := d.h.Sum(nil)
+	if !bytes.Equal(sum, d.Sum) {
+		return fmt.Errorf("%s mismatch: expected %x, got %x", d.Algorithm, d.Sum, sum)
+	}
+	return nil
+}
@@ -0,0 +1,574 @@
+package inetdata
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// FilterKey is the -filter-key regular expression that keys must match, see
+// AddSampleFlags
+var FilterKey = ""
+
+// FilterValue is the -filter-value regular expression that values must match
+var FilterValue = ""
+
+// FilterExpr is the -filter expression that records must satisfy
+var FilterExpr = ""
+
+// RecordFilter selects input lines by their key, the text before the first
+// -key-delimiter, and their value, the rest of the line. The key of JSON
+// inputs is the -sample-key field and the value is the whole record, see
+// RecordKey. All of the filters that are set must match. A RecordFilter is
+// not safe for concurrent use.
+type RecordFilter struct {
+	delimiter string
+	paths     [][]string
+	key       *regexp.Regexp
+	value     *regexp.Regexp
+	expr      filterNode
+}
+
+// NewRecordFilter returns a filter of the filter flags, or nil if none are set
+func NewRecordFilter() (*RecordFilter, error) {
+	if len(FilterKey) == 0 && len(FilterValue) == 0 && len(FilterExpr) == 0 {
+		return nil, nil
+	}
+
+	f := &RecordFilter{delimiter: KeyDelimiter, paths: sample_key_paths}
+
+	if len(FilterKey) > 0 {
+		re, e := regexp.Compile(FilterKey)
+		if e != nil {
+			return nil, fmt.Errorf("-filter-key: %s", e)
+		}
+		f.key = re
+	}
+
+	if len(FilterValue) > 0 {
+		re, e := regexp.Compile(FilterValue)
+		if e != nil {
+			return nil, fmt.Errorf("-filter-value: %s", e)
+		}
+		f.value = re
+	}
+
+	if len(FilterExpr) > 0 {
+		expr, e := parseFilterExpr(FilterExpr)
+		if e != nil {
+			return nil, fmt.Errorf("-filter: %s", e)
+		}
+		f.expr = expr
+	}
+	return f, nil
+}
+
+// Match returns true if a line, without its line ending, passes the filter
+func (f *RecordFilter) Match(line string) bool {
+	rec := newFilterRecord(line, f.delimiter, f.paths)
+
+	if f.key != nil && !f.key.MatchString(rec.key) {
+		return false
+	}
+	if f.value != nil && !f.value.MatchString(rec.value) {
+		return false
+	}
+	if f.expr != nil && !truthy(f.expr.eval(&rec)) {
+		return false
+	}
+	return true
+}
+
+// The record an expression is evaluated against
+type filterRecord struct {
+	line      string
+	key       string
+	value     string
+	delimiter string
+	fields    []string
+}
+
+// Split a line into its key and value, see RecordKey
+func newFilterRecord(line string, delimiter string, paths [][]string) filterRecord {
+	key, value := RecordKey([]byte(line), []byte(delimiter), paths)
+	return filterRecord{line: line, key: string(key), value: string(value), delimiter: delimiter}
+}
+
+func (r *filterRecord) field(i int) string {
+	if r.fields == nil {
+		r.fields = strings.Split(r.line, r.delimiter)
+	}
+	if i < 1 || i > len(r.fields) {
+		return ""
+	}
+	return r.fields[i-1]
+}
+
+// A node of a parsed expression. Nodes evaluate to a string, a float64, or a
+// bool.
+type filterNode interface {
+	eval(r *filterRecord) interface{}
+}
+
+type literalNode struct{ v interface{} }
+
+func (n *literalNode) eval(r *filterRecord) interface{} { return n.v }
+
+// key, value, line, or fN for the Nth field
+type identNode struct {
+	name  string
+	field int
+}
+
+func (n *identNode) eval(r *filterRecord) interface{} {
+	switch n.name {
+	case "key":
+		return r.key
+	case "value":
+		return r.value
+	case "line":
+		return r.line
+	}
+	return r.field(n.field)
+}
+
+// The functions of expressions and their number of arguments, -1 for any
+var filterFuncs = map[string]int{
+	"len":        1,
+	"lower":      1,
+	"upper":      1,
+	"trim":       1,
+	"replace":    3,
+	"trimprefix": 2,
+	"trimsuffix": 2,
+	"regsub":     3,
+	"if":         3,
+	"concat":     -1,
+}
+
+type callNode struct {
+	name string
+	args []filterNode
+
+	// The compiled pattern of regsub with a literal pattern
+	re *regexp.Regexp
+}
+
+func (n *callNode) eval(r *filterRecord) interface{} {
+	if n.name == "if" {
+		if truthy(n.args[0].eval(r)) {
+			return n.args[1].eval(r)
+		}
+		return n.args[2].eval(r)
+	}
+
+	args := make([]string, len(n.args))
+	for i := range n.args {
+		args[i] = toString(n.args[i].eval(r))
+	}
+
+	switch n.name {
+	case "len":
+		return float64(len(args[0]))
+	case "lower":
+		return strings.ToLower(args[0])
+	case "upper":
+		return strings.ToUpper(args[0])
+	case "trim":
+		return strings.TrimSpace(args[0])
+	case "replace":
+		return strings.ReplaceAll(args[0], args[1], args[2])
+	case "trimprefix":
+		return strings.TrimPrefix(args[0], args[1])
+	case "trimsuffix":
+		return strings.TrimSuffix(args[0], args[1])
+	case "regsub":
+		re := n.re
+		if re == nil {
+			var e error
+			if re, e = regexp.Compile(args[1]); e != nil {
+				return args[0]
+			}
+		}
+		return re.ReplaceAllString(args[0], args[2])
+	}
+	return strings.Join(args, "")
+}
+
+type notNode struct{ x filterNode }
+
+func (n *notNode) eval(r *filterRecord) interface{} { return !truthy(n.x.eval(r)) }
+
+type logicNode struct {
+	and  bool
+	l, r filterNode
+}
+
+func (n *logicNode) eval(r *filterRecord) interface{} {
+	if n.and {
+		return truthy(n.l.eval(r)) && truthy(n.r.eval(r))
+	}
+	return truthy(n.l.eval(r)) || truthy(n.r.eval(r))
+}
+
+type compareNode struct {
+	op   string
+	l, r filterNode
+
+	// The compiled pattern of matches with a literal pattern
+	re *regexp.Regexp
+}
+
+func (n *compareNode) eval(r *filterRecord) interface{} {
+	lv, rv := n.l.eval(r), n.r.eval(r)
+
+	switch n.op {
+	case "contains":
+		return strings.Contains(toString(lv), toString(rv))
+	case "startswith":
+		return strings.HasPrefix(toString(lv), toString(rv))
+	case "endswith":
+		return strings.HasSuffix(toString(lv), toString(rv))
+	case "matches":
+		re := n.re
+		if re == nil {
+			var e error
+			if re, e = regexp.Compile(toString(rv)); e != nil {
+				return false
+			}
+		}
+		return re.MatchString(toString(lv))
+	}
+
+	// Compare as numbers when both sides are numbers, otherwise as strings
+	c := 0
+	ln, lok := toNumber(lv)
+	rn, rok := toNumber(rv)
+	if lok && rok {
+		switch {
+		case ln < rn:
+			c = -1
+		case ln > rn:
+			c = 1
+		}
+	} else {
+		c = strings.Compare(toString(lv), toString(rv))
+	}
+
+	switch n.op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case bool:
+		return t
+	case float64:
+		return t != 0
+	case string:
+		return len(t) > 0
+	}
+	return false
+}
+
+func toString(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	}
+	return ""
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case float64:
+		return t, true
+	case string:
+		n, e := strconv.ParseFloat(strings.TrimSpace(t), 64)
+		return n, e == nil
+	}
+	return 0, false
+}
+
+// The comparison operators
+var filterCompareOps = []string{"contains", "startswith", "endswith", "matches", "==", "!=", "<=", ">=", "<", ">"}
+
+type filterParser struct {
+	toks []string
+	pos  int
+}
+
+// Parse a filter expression. Expressions compare key, value, line, and fN
+// (the Nth field) with string and number literals, using ==, !=, <, <=, >,
+// >=, contains, startswith, endswith, and matches (a regular expression),
+// combined with &&, ||, !, and parentheses. Values are compared as numbers
+// when both sides are numbers. The functions of filterFuncs transform values:
+// len, lower, upper, trim, replace(s, old, new), trimprefix(s, prefix),
+// trimsuffix(s, suffix), regsub(s, pattern, replacement), if(cond, a, b), and
+// concat(a, b, ...).
+func parseFilterExpr(s string) (filterNode, error) {
+	toks, e := tokenizeFilter(s)
+	if e != nil {
+		return nil, e
+	}
+
+	p := &filterParser{toks: toks}
+	n, e := p.parseOr()
+	if e != nil {
+		return nil, e
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q", p.toks[p.pos])
+	}
+	return n, nil
+}
+
+func tokenizeFilter(s string) ([]string, error) {
+	toks := []string{}
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			toks = append(toks, s[i:j+1])
+			i = j + 1
+
+		case strings.HasPrefix(s[i:], "&&") || strings.HasPrefix(s[i:], "||") ||
+			strings.HasPrefix(s[i:], "==") || strings.HasPrefix(s[i:], "!=") ||
+			strings.HasPrefix(s[i:], "<=") || strings.HasPrefix(s[i:], ">="):
+			toks = append(toks, s[i:i+2])
+			i += 2
+
+		case strings.IndexByte("()<>!,=;", c) >= 0:
+			toks = append(toks, s[i:i+1])
+			i++
+
+		case c == '-' || c == '.' || unicode.IsDigit(rune(c)) || unicode.IsLetter(rune(c)) || c == '_':
+			j := i + 1
+			for j < len(s) && (s[j] == '.' || s[j] == '_' || unicode.IsDigit(rune(s[j])) || unicode.IsLetter(rune(s[j]))) {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+
+		default:
+			return nil, fmt.Errorf("unexpected character %q", c)
+		}
+	}
+	return toks, nil
+}
+
+// Unquote a string literal. Only \" and \\ are escapes, other backslashes are
+// kept, so that regular expressions can be written as-is.
+func unquoteFilter(t string) string {
+	t = t[1 : len(t)-1]
+	var b strings.Builder
+	for i := 0; i < len(t); i++ {
+		if t[i] == '\\' && i+1 < len(t) && (t[i+1] == '"' || t[i+1] == '\\') {
+			i++
+		}
+		b.WriteByte(t[i])
+	}
+	return b.String()
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	l, e := p.parseAnd()
+	if e != nil {
+		return nil, e
+	}
+	for p.peek() == "||" {
+		p.next()
+		r, e := p.parseAnd()
+		if e != nil {
+			return nil, e
+		}
+		l = &logicNode{l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	l, e := p.parseNot()
+	if e != nil {
+		return nil, e
+	}
+	for p.peek() == "&&" {
+		p.next()
+		r, e := p.parseNot()
+		if e != nil {
+			return nil, e
+		}
+		l = &logicNode{and: true, l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	if p.peek() == "!" {
+		p.next()
+		x, e := p.parseNot()
+		if e != nil {
+			return nil, e
+		}
+		return &notNode{x: x}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *filterParser) parseCompare() (filterNode, error) {
+	l, e := p.parsePrimary()
+	if e != nil {
+		return nil, e
+	}
+
+	op := p.peek()
+	for _, o := range filterCompareOps {
+		if op != o {
+			continue
+		}
+		p.next()
+
+		r, e := p.parsePrimary()
+		if e != nil {
+			return nil, e
+		}
+
+		n := &compareNode{op: op, l: l, r: r}
+		if lit, ok := r.(*literalNode); ok && op == "matches" {
+			if n.re, e = regexp.Compile(toString(lit.v)); e != nil {
+				return nil, e
+			}
+		}
+		return n, nil
+	}
+	return l, nil
+}
+
+func (p *filterParser) parsePrimary() (filterNode, error) {
+	t := p.next()
+	switch {
+	case len(t) == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+
+	case t == "(":
+		n, e := p.parseOr()
+		if e != nil {
+			return nil, e
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return n, nil
+
+	case t[0] == '"':
+		return &literalNode{v: unquoteFilter(t)}, nil
+
+	case t == "key" || t == "value" || t == "line":
+		return &identNode{name: t}, nil
+
+	case filterFuncs[t] != 0:
+		return p.parseCall(t)
+
+	case t[0] == 'f' && len(t) > 1:
+		i, e := strconv.Atoi(t[1:])
+		if e != nil || i < 1 {
+			return nil, fmt.Errorf("unknown identifier %q", t)
+		}
+		return &identNode{name: "field", field: i}, nil
+	}
+
+	n, e := strconv.ParseFloat(t, 64)
+	if e != nil {
+		return nil, fmt.Errorf("unknown identifier %q", t)
+	}
+	return &literalNode{v: n}, nil
+}
+
+// Parse the arguments of a function
+func (p *filterParser) parseCall(name string) (filterNode, error) {
+	if p.next() != "(" {
+		return nil, fmt.Errorf("missing ( after %s", name)
+	}
+
+	n := &callNode{name: name}
+	if p.peek() == ")" {
+		p.next()
+	} else {
+		for {
+			arg, e := p.parseOr()
+			if e != nil {
+				return nil, e
+			}
+			n.args = append(n.args, arg)
+
+			t := p.next()
+			if t == ")" {
+				break
+			}
+			if t != "," {
+				return nil, fmt.Errorf("missing ) after the arguments of %s", name)
+			}
+		}
+	}
+
+	if want := filterFuncs[name]; want >= 0 && len(n.args) != want {
+		return nil, fmt.Errorf("%s takes %d arguments, not %d", name, want, len(n.args))
+	}
+
+	if name == "regsub" {
+		if lit, ok := n.args[1].(*literalNode); ok {
+			re, e := regexp.Compile(toString(lit.v))
+			if e != nil {
+				return nil, e
+			}
+			n.re = re
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,252 @@
+// Package hll implements HyperLogLog sketches, which estimate the number of
+// distinct items of a stream in a fixed amount of memory. Sketches built over
+// different parts of a dataset can be merged, and saved to files so that the
+// sketches of separate runs can be combined later.
+package hll
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+)
+
+// The magic number at the start of each sketch in a file
+const MAGIC = "INETHLL1"
+
+// The size in bytes of the sketch header, before the name
+const HEADER_SIZE = 16
+
+// The extension of sketch files
+const EXTENSION = ".hll"
+
+// The range of precisions, the number of index bits. A sketch has 2^p
+// registers and a standard error of about 1.04/sqrt(2^p).
+const MIN_PRECISION = 4
+const MAX_PRECISION = 18
+
+// The default precision, 16KiB per sketch with a standard error of 0.8%
+const DEFAULT_PRECISION = 14
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// Sketch is a HyperLogLog sketch. It is not safe for concurrent use.
+type Sketch struct {
+	// The name of what the sketch counts, saved with the sketch
+	Name string
+
+	p    uint8
+	regs []uint8
+}
+
+// New returns an empty sketch with the precision p
+func New(name string, p int) (*Sketch, error) {
+	if p < MIN_PRECISION || p > MAX_PRECISION {
+		return nil, fmt.Errorf("invalid precision %d, must be between %d and %d", p, MIN_PRECISION, MAX_PRECISION)
+	}
+	return &Sketch{Name: name, p: uint8(p), regs: make([]uint8, 1<<uint(p))}, nil
+}
+
+// Precision returns the precision of the sketch
+func (s *Sketch) Precision() int {
+	return int(s.p)
+}
+
+// A FNV-1a hash with a splitmix64 finalizer, since HyperLogLog needs all bits
+// of the hash to be well mixed
+func hash(item []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(item)
+	x := h.Sum64() + 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// Add an item to the sketch
+func (s *Sketch) Add(item []byte) {
+	x := hash(item)
+	idx := x >> (64 - s.p)
+
+	// The position of the first set bit of the rest of the hash
+	rank := uint8(bits.LeadingZeros64(x<<s.p|1<<(s.p-1)) + 1)
+	if rank > s.regs[idx] {
+		s.regs[idx] = rank
+	}
+}
+
+// AddString adds a string item to the sketch
+func (s *Sketch) AddString(item string) {
+	s.Add([]byte(item))
+}
+
+// Merge adds the items of another sketch of the same precision
+func (s *Sketch) Merge(o *Sketch) error {
+	if o.p != s.p {
+		return fmt.Errorf("can not merge sketches of precision %d and %d", s.p, o.p)
+	}
+	for i, r := range o.regs {
+		if r > s.regs[i] {
+			s.regs[i] = r
+		}
+	}
+	return nil
+}
+
+// Estimate returns the estimated number of distinct items. Small counts are
+// estimated by linear counting of the empty registers.
+func (s *Sketch) Estimate() uint64 {
+	m := float64(len(s.regs))
+
+	sum := 0.0
+	zeros := 0
+	for _, r := range s.regs {
+		sum += 1.0 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	var alpha float64
+	switch len(s.regs) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+
+	est := alpha * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		est = m * math.Log(m/float64(zeros))
+	}
+	return uint64(est + 0.5)
+}
+
+// WriteTo writes the sketch: the header, the name, the registers, and a
+// crc32c checksum of the name and registers
+func (s *Sketch) WriteTo(w io.Writer) (int64, error) {
+	hdr := make([]byte, 0, HEADER_SIZE)
+	hdr = append(hdr, MAGIC...)
+	hdr = append(hdr, s.p, 0, 0, 0)
+	hdr = binary.LittleEndian.AppendUint32(hdr, uint32(len(s.Name)))
+
+	crc := crc32.New(crc32c)
+	crc.Write([]byte(s.Name))
+	crc.Write(s.regs)
+
+	total := int64(0)
+	for _, b := range [][]byte{hdr, []byte(s.Name), s.regs, binary.LittleEndian.AppendUint32(nil, crc.Sum32())} {
+		n, e := w.Write(b)
+		total += int64(n)
+		if e != nil {
+			return total, e
+		}
+	}
+	return total, nil
+}
+
+// Read reads a sketch written by WriteTo, returning io.EOF if there are no
+// more sketches
+func Read(r io.Reader) (*Sketch, error) {
+	hdr := make([]byte, HEADER_SIZE)
+	if _, e := io.ReadFull(r, hdr); e != nil {
+		if e == io.EOF {
+			return nil, e
+		}
+		return nil, fmt.Errorf("failed to read the header: %s", e)
+	}
+	if string(hdr[:8]) != MAGIC {
+		return nil, fmt.Errorf("not a HyperLogLog sketch")
+	}
+
+	p := int(hdr[8])
+	if p < MIN_PRECISION || p > MAX_PRECISION {
+		return nil, fmt.Errorf("invalid precision %d", p)
+	}
+	name_len := binary.LittleEndian.Uint32(hdr[12:])
+	if name_len > 64*1024 {
+		return nil, fmt.Errorf("invalid name length %d", name_len)
+	}
+
+	name := make([]byte, name_len)
+	if _, e := io.ReadFull(r, name); e != nil {
+		return nil, fmt.Errorf("failed to read the name: %s", e)
+	}
+
+	s, _ := New(string(name), p)
+	if _, e := io.ReadFull(r, s.regs); e != nil {
+		return nil, fmt.Errorf("failed to read the registers: %s", e)
+	}
+
+	var sum [4]byte
+	if _, e := io.ReadFull(r, sum[:]); e != nil {
+		return nil, fmt.Errorf("failed to read the checksum: %s", e)
+	}
+
+	crc := crc32.New(crc32c)
+	crc.Write(name)
+	crc.Write(s.regs)
+	if binary.LittleEndian.Uint32(sum[:]) != crc.Sum32() {
+		return nil, fmt.Errorf("checksum mismatch in sketch %q", s.Name)
+	}
+	return s, nil
+}
+
+// Save writes sketches to a file, replacing it atomically
+func Save(path string, sketches []*Sketch) error {
+	tmp := path + ".tmp"
+	fd, e := os.Create(tmp)
+	if e != nil {
+		return e
+	}
+
+	bw := bufio.NewWriter(fd)
+	for _, s := range sketches {
+		if _, e = s.WriteTo(bw); e != nil {
+			break
+		}
+	}
+	if e == nil {
+		e = bw.Flush()
+	}
+	if ce := fd.Close(); e == nil {
+		e = ce
+	}
+	if e != nil {
+		os.Remove(tmp)
+		return e
+	}
+	return os.Rename(tmp, path)
+}
+
+// Load reads the sketches of a file
+func Load(path string) ([]*Sketch, error) {
+	fd, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer fd.Close()
+
+	br := bufio.NewReader(fd)
+	sketches := []*Sketch{}
+	for {
+		s, e := Read(br)
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return nil, fmt.Errorf("%s: %s", path, e)
+		}
+		sketches = append(sketches, s)
+	}
+	return sketches, nil
+}
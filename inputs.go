@@ -0,0 +1,327 @@
+package inetdata
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers/linereader"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// InputPaths returns the explicit input paths, in the order given, followed by
+// the files matching the glob pattern in lexical order. An empty pattern adds
+// nothing; a pattern that matches no files is an error. Stream and object
+// URLs (see IsRemotePath) are passed through without checking.
+func InputPaths(paths []string, pattern string) ([]string, error) {
+	res := []string{}
+
+	for _, path := range paths {
+		if IsRemotePath(path) {
+			res = append(res, path)
+			continue
+		}
+		if _, e := os.Stat(path); e != nil {
+			return nil, e
+		}
+		res = append(res, path)
+	}
+
+	if len(pattern) == 0 {
+		return res, nil
+	}
+
+	matches, e := filepath.Glob(pattern)
+	if e != nil {
+		return nil, fmt.Errorf("invalid input glob %q: %s", pattern, e)
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no input files match %q", pattern)
+	}
+
+	// Glob already sorts, but the ordering is part of the contract
+	sort.Strings(matches)
+
+	return append(res, matches...), nil
+}
+
+type multiInputReader struct {
+	paths []string
+	codec string
+	wrap  func(io.Reader) io.Reader
+
+	fd   io.Closer
+	cur  io.Reader
+	path string
+	last byte
+	pad  bool
+
+	// With a key function, the order of the files is checked, see
+	// NewSortedInputReader
+	key       func([]byte) []byte
+	first     bool
+	part      []byte
+	line      []byte
+	prev_key  []byte
+	prev_path string
+}
+
+// NewMultiInputReader returns a reader over the concatenated contents of the
+// files, in order. Each file is opened only when the previous one is finished
+// and is decompressed on its own, so compressed and plain files can be mixed
+// with the "auto" codec. A newline is inserted after any file that does not
+// end in one so that lines never span files. The optional wrap function is
+// applied to each raw file stream, for example Progress.CountReader. Paths may
+// also be stream or object URLs; streams are read until they end.
+func NewMultiInputReader(paths []string, codec string, wrap func(io.Reader) io.Reader) io.ReadCloser {
+	return &multiInputReader{paths: paths, codec: codec, wrap: wrap}
+}
+
+// NewSortedInputReader is NewMultiInputReader for tools that require their
+// input in key order. The files are still concatenated rather than merged, so
+// they must be sorted as a whole, as with range-partitioned parts. The reader
+// fails when the first key of a file sorts before the last key of the previous
+// file. The key function returns the key of a line, without its line ending,
+// or nil for lines that have no key and are ignored by the check.
+func NewSortedInputReader(paths []string, codec string, wrap func(io.Reader) io.Reader, key func([]byte) []byte) io.ReadCloser {
+	return &multiInputReader{paths: paths, codec: codec, wrap: wrap, key: key}
+}
+
+func (m *multiInputReader) next() error {
+	path := m.paths[0]
+	m.paths = m.paths[1:]
+
+	fd, e := OpenPath(path)
+	if e != nil {
+		return e
+	}
+
+	raw := trackMetaSource(path, fd)
+	if m.wrap != nil {
+		raw = m.wrap(raw)
+	}
+
+	r, e := NewInputReader(raw, m.codec)
+	if e != nil {
+		fd.Close()
+		return fmt.Errorf("%s: %s", path, e)
+	}
+
+	m.fd = fd
+	m.cur = r
+	m.path = path
+	m.last = '\n'
+	m.first = true
+	return nil
+}
+
+// Check the first keyed line of the current file against the last key of the
+// previous file, and remember the last line for the next file
+func (m *multiInputReader) checkOrder(b []byte) error {
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			m.part = append(m.part, b...)
+			return nil
+		}
+
+		line := b[:i]
+		if len(m.part) > 0 {
+			m.part = append(m.part, line...)
+			line = m.part
+		}
+		if e := m.endLine(line); e != nil {
+			return e
+		}
+		m.part = m.part[:0]
+		b = b[i+1:]
+	}
+	return nil
+}
+
+func (m *multiInputReader) endLine(line []byte) error {
+	line = bytes.TrimRight(line, "\r")
+	if len(line) == 0 {
+		return nil
+	}
+
+	if m.first {
+		k := m.key(line)
+		if k == nil {
+			return nil
+		}
+		m.first = false
+		if m.prev_key != nil && bytes.Compare(k, m.prev_key) < 0 {
+			return fmt.Errorf("input files are not in order: %s starts with %q, which sorts before %q at the end of %s",
+				m.path, k, m.prev_key, m.prev_path)
+		}
+	}
+
+	m.line = append(m.line[:0], line...)
+	return nil
+}
+
+// Record the last key of the current file, which has ended
+func (m *multiInputReader) finishOrder() error {
+	if len(m.part) > 0 {
+		if e := m.endLine(m.part); e != nil {
+			return e
+		}
+		m.part = m.part[:0]
+	}
+
+	// An empty file keeps the last key of the file before it
+	if len(m.line) > 0 {
+		if k := m.key(m.line); k != nil {
+			m.prev_key = append(m.prev_key[:0], k...)
+		} else {
+			m.prev_key = nil
+		}
+		m.prev_path = m.path
+		m.line = m.line[:0]
+	}
+	return nil
+}
+
+func (m *multiInputReader) Read(b []byte) (int, error) {
+	for {
+		if m.pad {
+			if len(b) == 0 {
+				return 0, nil
+			}
+			m.pad = false
+			b[0] = '\n'
+			return 1, nil
+		}
+
+		if m.cur == nil {
+			if len(m.paths) == 0 {
+				return 0, io.EOF
+			}
+			if e := m.next(); e != nil {
+				return 0, e
+			}
+		}
+
+		n, e := m.cur.Read(b)
+		if n > 0 {
+			m.last = b[n-1]
+			if m.key != nil {
+				if oe := m.checkOrder(b[:n]); oe != nil {
+					return 0, oe
+				}
+			}
+		}
+
+		if e == io.EOF {
+			m.pad = m.last != '\n'
+			if m.key != nil {
+				if oe := m.finishOrder(); oe != nil {
+					return 0, oe
+				}
+			}
+			m.closeCurrent()
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+
+		return n, e
+	}
+}
+
+func (m *multiInputReader) closeCurrent() {
+	if c, ok := m.cur.(io.Closer); ok {
+		c.Close()
+	}
+	if m.fd != nil {
+		m.fd.Close()
+	}
+	m.fd = nil
+	m.cur = nil
+}
+
+func (m *multiInputReader) Close() error {
+	m.closeCurrent()
+	m.paths = nil
+	return nil
+}
+
+// OpenInputs returns a reader over the named input files, or over stdin when
+// no files are given. See NewMultiInputReader for how files are combined.
+// Only the lines selected by the sampling flags are read, see NewSampleReader.
+func OpenInputs(paths []string, codec string, wrap func(io.Reader) io.Reader) (io.Reader, error) {
+	return openInputs(paths, codec, wrap, nil)
+}
+
+// OpenSortedInputs is OpenInputs for tools that require their input in key
+// order. The files must be sorted as a whole, and the reader fails at the
+// first file that starts before the previous one ended, see
+// NewSortedInputReader.
+func OpenSortedInputs(paths []string, codec string, wrap func(io.Reader) io.Reader, key func([]byte) []byte) (io.Reader, error) {
+	return openInputs(paths, codec, wrap, key)
+}
+
+func openInputs(paths []string, codec string, wrap func(io.Reader) io.Reader, key func([]byte) []byte) (io.Reader, error) {
+	if len(paths) > 0 {
+		if key != nil {
+			return NewSampleReader(NewSortedInputReader(paths, codec, wrap, key)), nil
+		}
+		return NewSampleReader(NewMultiInputReader(paths, codec, wrap)), nil
+	}
+
+	raw := trackMetaSource("-", os.Stdin)
+	if wrap != nil {
+		raw = wrap(raw)
+	}
+	r, err := NewInputReader(raw, codec)
+	if err != nil {
+		return nil, err
+	}
+	return NewSampleReader(r), nil
+}
+
+// ReadLinesFromInputs splits the input files, or stdin when no files are
+// given, into lines. The output channel is closed on completion, on error, or
+// at the next line after a signal (see HandleSignals).
+func ReadLinesFromInputs(paths []string, codec string, wrap func(io.Reader) io.Reader, out chan<- string) error {
+	r, err := OpenInputs(paths, codec, wrap)
+	if err != nil {
+		close(out)
+		return err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	return readLines(r, out, true)
+}
+
+// ReadSortedLinesFromInputs is ReadLinesFromInputs over OpenSortedInputs.
+func ReadSortedLinesFromInputs(paths []string, codec string, wrap func(io.Reader) io.Reader, key func([]byte) []byte, out chan<- string) error {
+	r, err := OpenSortedInputs(paths, codec, wrap, key)
+	if err != nil {
+		close(out)
+		return err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	return readLines(r, out, true)
+}
+
+// ReadLineBytesFromInputs is ReadLinesFromInputs for the hot path of large
+// inputs. Lines are sent in buffers from LinePool instead of as strings, and
+// the receiver must Recycle each line once it is done with it.
+func ReadLineBytesFromInputs(paths []string, codec string, wrap func(io.Reader) io.Reader, out chan<- *linereader.Line) error {
+	r, err := OpenInputs(paths, codec, wrap)
+	if err != nil {
+		close(out)
+		return err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	return readLineBytes(r, out, true)
+}
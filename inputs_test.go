@@ -0,0 +1,121 @@
+package inetdata
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write each content to a file in a temporary directory, returning the paths
+func writeInputs(t *testing.T, contents ...string) []string {
+	dir := t.TempDir()
+	paths := []string{}
+	for i, content := range contents {
+		path := filepath.Join(dir, "part-"+string(rune('a'+i)))
+		if e := ioutil.WriteFile(path, []byte(content), 0644); e != nil {
+			t.Fatal(e)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// The text before the first comma, or nil for a comment
+func csvKey(line []byte) []byte {
+	if bytes.HasPrefix(line, []byte("#")) {
+		return nil
+	}
+	if i := bytes.IndexByte(line, ','); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+func readSorted(paths []string) (string, error) {
+	r := NewSortedInputReader(paths, "none", nil, csvKey)
+	defer r.Close()
+
+	// A small buffer splits lines across reads
+	out := []byte{}
+	buf := make([]byte, 3)
+	for {
+		n, e := r.Read(buf)
+		out = append(out, buf[:n]...)
+		if e != nil {
+			if e == io.EOF {
+				return string(out), nil
+			}
+			return string(out), e
+		}
+	}
+}
+
+func TestSortedInputReader(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+	}{
+		{"ordered", []string{"a,1\nb,2\n", "c,3\nd,4\n"}},
+		{"equal keys across files", []string{"a,1\nb,2\n", "b,3\nc,4\n"}},
+		{"no final newline", []string{"a,1\nb,2", "c,3\n"}},
+		{"empty file", []string{"a,1\nb,2\n", "", "c,3\n"}},
+		{"blank lines", []string{"a,1\nb,2\n\n\r\n", "\nc,3\n"}},
+		{"lines without a key", []string{"a,1\nb,2\n", "# header\nc,3\n"}},
+		{"crlf", []string{"a,1\r\nb,2\r\n", "c,3\r\n"}},
+	}
+
+	for _, tt := range tests {
+		out, e := readSorted(writeInputs(t, tt.files...))
+		if e != nil {
+			t.Errorf("%s: %s", tt.name, e)
+			continue
+		}
+		want := strings.Join(tt.files, "")
+		if !strings.HasSuffix(tt.files[0], "\n") {
+			want = tt.files[0] + "\n" + strings.Join(tt.files[1:], "")
+		}
+		if out != want {
+			t.Errorf("%s: read %q, want %q", tt.name, out, want)
+		}
+	}
+}
+
+func TestSortedInputReaderOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+	}{
+		{"regression", []string{"a,1\nc,2\n", "b,3\nd,4\n"}},
+		{"after an empty file", []string{"a,1\nc,2\n", "", "b,3\n"}},
+		{"no final newline", []string{"a,1\nc,2", "b,3"}},
+		{"after lines without a key", []string{"a,1\nc,2\n", "# header\nb,3\n"}},
+		{"later file", []string{"a,1\n", "b,2\n", "a,3\n"}},
+	}
+
+	for _, tt := range tests {
+		paths := writeInputs(t, tt.files...)
+		_, e := readSorted(paths)
+		if e == nil {
+			t.Errorf("%s: read files that are out of order", tt.name)
+			continue
+		}
+		if !strings.Contains(e.Error(), "not in order") || !strings.Contains(e.Error(), paths[len(paths)-1]) {
+			t.Errorf("%s: unexpected error %q", tt.name, e)
+		}
+	}
+
+	// Only the boundaries between files are checked
+	if _, e := readSorted(writeInputs(t, "b,1\na,2\n", "c,3\n")); e != nil {
+		t.Errorf("the order within a file was checked: %s", e)
+	}
+
+	// The plain multi-file reader concatenates files in any order
+	r := NewMultiInputReader(writeInputs(t, "b,1\n", "a,2\n"), "none", nil)
+	defer r.Close()
+	if b, e := ioutil.ReadAll(r); e != nil || string(b) != "b,1\na,2\n" {
+		t.Errorf("NewMultiInputReader read %q, %v", b, e)
+	}
+}
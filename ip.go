@@ -2,8 +2,10 @@ package inetdata
 
 import (
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"math/big"
 	"net"
 	"regexp"
 )
@@ -120,40 +122,178 @@ func IPv4Range2CIDRs(s_ip string, e_ip string) ([]string, error) {
 func IPv4UIntRange2CIDRs(s_i uint32, e_i uint32) []string {
 	cidrs := []string{}
 
-	// Ranges are inclusive
-	size := e_i - s_i + 1
-
-	if size == 0 {
+	if s_i > e_i {
 		return cidrs
 	}
 
-	for i := range IPv4_Mask_Sizes {
+	// Ranges are inclusive, use 64 bits so that 0.0.0.0-255.255.255.255 fits
+	start := uint64(s_i)
+	end := uint64(e_i)
+
+	for start <= end {
+		size := end - start + 1
+
+		for i := range IPv4_Mask_Sizes {
+			mask_size := uint64(IPv4_Mask_Sizes[i])
 
-		mask_size := IPv4_Mask_Sizes[i]
+			// Use the biggest block that fits and is aligned on its own size
+			if mask_size > size || start%mask_size != 0 {
+				continue
+			}
 
-		if mask_size > size {
-			continue
+			cidrs = append(cidrs, fmt.Sprintf("%s/%d", UInt_to_IPv4(uint32(start)), IPv4_Masks[uint32(mask_size)]))
+			start += mask_size
+			break
 		}
+	}
+	return cidrs
+}
+
+// IPRange2CIDRs converts an inclusive range of IPv4 or IPv6 addresses into the
+// smallest list of CIDR blocks that covers it exactly
+func IPRange2CIDRs(s_ip net.IP, e_ip net.IP) ([]*net.IPNet, error) {
+	bits := 128
+	if s4, e4 := s_ip.To4(), e_ip.To4(); s4 != nil && e4 != nil {
+		s_ip, e_ip, bits = s4, e4, 32
+	} else {
+		s_ip, e_ip = s_ip.To16(), e_ip.To16()
+	}
+
+	if s_ip == nil || e_ip == nil {
+		return nil, errors.New("Invalid IP address")
+	}
+
+	start := new(big.Int).SetBytes(s_ip)
+	end := new(big.Int).SetBytes(e_ip)
+
+	if start.Cmp(end) > 0 {
+		return nil, errors.New("Start address is bigger than end address")
+	}
+
+	one := big.NewInt(1)
+	cidrs := []*net.IPNet{}
+
+	for start.Cmp(end) <= 0 {
+		// The largest block is limited by the alignment of the start address
+		host_bits := int(start.TrailingZeroBits())
+		if start.Sign() == 0 || host_bits > bits {
+			host_bits = bits
+		}
+
+		// And by the number of addresses remaining in the range
+		remaining := new(big.Int).Sub(end, start)
+		remaining.Add(remaining, one)
+		for host_bits > 0 && new(big.Int).Lsh(one, uint(host_bits)).Cmp(remaining) > 0 {
+			host_bits--
+		}
+
+		ip := make(net.IP, bits/8)
+		start.FillBytes(ip)
+		cidrs = append(cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits-host_bits, bits)})
+
+		start.Add(start, new(big.Int).Lsh(one, uint(host_bits)))
+	}
+
+	return cidrs, nil
+}
 
-		// Exact match of the block size
-		if mask_size == size {
-			cidrs = append(cidrs, fmt.Sprintf("%s/%d", UInt_to_IPv4(s_i), IPv4_Masks[mask_size]))
+// CIDRRange returns the first and last address of a network. IPv4 networks
+// are returned as 4-byte addresses.
+func CIDRRange(n *net.IPNet) (net.IP, net.IP) {
+	s_ip := n.IP
+	if ip4 := s_ip.To4(); ip4 != nil && len(n.Mask) == net.IPv4len {
+		s_ip = ip4
+	}
+
+	e_ip := make(net.IP, len(s_ip))
+	for i := range s_ip {
+		e_ip[i] = s_ip[i] | ^n.Mask[i]
+	}
+	return s_ip, e_ip
+}
+
+// NextIP returns the address following ip, wrapping around to zero after the
+// last address of the family
+func NextIP(ip net.IP) net.IP {
+	next := append(net.IP{}, ip...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
 			break
 		}
+	}
+	return next
+}
 
-		// Chop off the biggest block that fits
-		cidrs = append(cidrs, fmt.Sprintf("%s/%d", UInt_to_IPv4(s_i), IPv4_Masks[mask_size]))
-		s_i = s_i + mask_size
+// IP address keys are encoded as a family tag followed by the address in
+// network byte order, so that byte order equals numeric order and all IPv4
+// keys sort before all IPv6 keys. The hex format encodes the same bytes as
+// lowercase hex for use in text files.
+const IP_KEY_TAG_V4 = 0x04
+const IP_KEY_TAG_V6 = 0x06
 
-		// Look for additional blocks
-		new_cidrs := IPv4UIntRange2CIDRs(s_i, e_i)
+var IPKeyFormats = []string{"none", "binary", "hex"}
 
-		// Merge those blocks into out results
-		for x := range new_cidrs {
-			cidrs = append(cidrs, new_cidrs[x])
+// ValidIPKeyFormat returns true if the IP key format name is supported
+func ValidIPKeyFormat(format string) bool {
+	for i := range IPKeyFormats {
+		if IPKeyFormats[i] == format {
+			return true
 		}
-		break
+	}
+	return false
+}
 
+// EncodeIPKey encodes an IP address as a sort key in the specified format.
+// The none format returns the textual address.
+func EncodeIPKey(ip net.IP, format string) []byte {
+	if format == "none" {
+		return []byte(ip.String())
 	}
-	return cidrs
+
+	var key []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		key = append([]byte{IP_KEY_TAG_V4}, ip4...)
+	} else {
+		key = append([]byte{IP_KEY_TAG_V6}, ip.To16()...)
+	}
+
+	if format == "hex" {
+		return []byte(hex.EncodeToString(key))
+	}
+	return key
+}
+
+// EncodeIPKeyString parses a textual IP address and encodes it as a sort key
+func EncodeIPKeyString(s string, format string) ([]byte, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address: %q", s)
+	}
+	return EncodeIPKey(ip, format), nil
+}
+
+// DecodeIPKey decodes a sort key in the specified format, returning false if
+// the key is not an encoded IP address
+func DecodeIPKey(key []byte, format string) (net.IP, bool) {
+	switch format {
+	case "none":
+		ip := net.ParseIP(string(key))
+		return ip, ip != nil
+	case "hex":
+		raw := make([]byte, hex.DecodedLen(len(key)))
+		if _, e := hex.Decode(raw, key); e != nil {
+			return nil, false
+		}
+		key = raw
+	}
+
+	switch {
+	case len(key) == 5 && key[0] == IP_KEY_TAG_V4:
+		return net.IP(append([]byte{}, key[1:]...)), true
+	case len(key) == 17 && key[0] == IP_KEY_TAG_V6:
+		return net.IP(append([]byte{}, key[1:]...)), true
+	}
+
+	return nil, false
 }
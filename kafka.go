@@ -0,0 +1,279 @@
+package inetdata
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var kafka_compression_types = map[string]kafka.Compression{
+	"gzip":   kafka.Gzip,
+	"snappy": kafka.Snappy,
+	"lz4":    kafka.Lz4,
+	"zstd":   kafka.Zstd,
+}
+
+// KafkaURL describes a topic as kafka://broker[,broker...]/topic?options
+//
+// Consumer options:
+//
+//	group     : the consumer group, offsets are committed as messages are read
+//	partition : the partition to read without a group (default 0)
+//	offset    : where to start without committed offsets, first or last (default first)
+//
+// Producer options:
+//
+//	compression : none, gzip, snappy, lz4, or zstd (default none)
+//	batch       : the maximum number of messages per batch (default 1000)
+//	linger      : the maximum time to wait for a batch to fill (default 100ms)
+//	key         : partition messages by this 1-based field of each line (default 0, round-robin)
+//	delimiter   : the field delimiter for key (default ,)
+type KafkaURL struct {
+	Brokers      []string
+	Topic        string
+	Group        string
+	Partition    int
+	StartOffset  int64
+	Compression  string
+	BatchSize    int
+	BatchTimeout time.Duration
+	KeyField     int
+	Delimiter    string
+}
+
+// ParseKafkaURL parses a kafka:// URL
+func ParseKafkaURL(s string) (*KafkaURL, error) {
+	if !strings.HasPrefix(s, "kafka://") {
+		return nil, fmt.Errorf("not a kafka URL: %s", s)
+	}
+
+	// The brokers are a comma-separated list, which net/url rejects as a host
+	rest := strings.TrimPrefix(s, "kafka://")
+	query := ""
+	if idx := strings.Index(rest, "?"); idx >= 0 {
+		rest, query = rest[:idx], rest[idx+1:]
+	}
+
+	bits := strings.SplitN(rest, "/", 2)
+	if len(bits) != 2 || len(bits[0]) == 0 || len(bits[1]) == 0 || strings.Contains(bits[1], "/") {
+		return nil, fmt.Errorf("invalid kafka URL, expected kafka://broker/topic: %s", s)
+	}
+
+	u := &KafkaURL{
+		Brokers:      strings.Split(bits[0], ","),
+		Topic:        bits[1],
+		StartOffset:  kafka.FirstOffset,
+		Compression:  "none",
+		BatchSize:    1000,
+		BatchTimeout: 100 * time.Millisecond,
+		Delimiter:    ",",
+	}
+
+	opts, e := url.ParseQuery(query)
+	if e != nil {
+		return nil, fmt.Errorf("invalid kafka URL options: %s", e)
+	}
+
+	for k := range opts {
+		v := opts.Get(k)
+		switch k {
+		case "group":
+			u.Group = v
+		case "partition":
+			u.Partition, e = strconv.Atoi(v)
+		case "offset":
+			switch v {
+			case "first":
+				u.StartOffset = kafka.FirstOffset
+			case "last":
+				u.StartOffset = kafka.LastOffset
+			default:
+				e = errors.New("expected first or last")
+			}
+		case "compression":
+			if _, ok := kafka_compression_types[v]; !ok && v != "none" {
+				e = errors.New("expected none, gzip, snappy, lz4, or zstd")
+			}
+			u.Compression = v
+		case "batch":
+			u.BatchSize, e = strconv.Atoi(v)
+			if e == nil && u.BatchSize < 1 {
+				e = errors.New("must be positive")
+			}
+		case "linger":
+			u.BatchTimeout, e = time.ParseDuration(v)
+		case "key":
+			u.KeyField, e = strconv.Atoi(v)
+			if e == nil && u.KeyField < 0 {
+				e = errors.New("must not be negative")
+			}
+		case "delimiter":
+			u.Delimiter = UnescapeDelimiter(v)
+		default:
+			e = errors.New("unknown option")
+		}
+
+		if e != nil {
+			return nil, fmt.Errorf("invalid kafka URL option %s=%q: %s", k, v, e)
+		}
+	}
+
+	return u, nil
+}
+
+type kafkaReader struct {
+	r   *kafka.Reader
+	buf []byte
+}
+
+// NewKafkaReader returns a reader that consumes the topic as a stream of lines,
+// one per message. The stream does not end until the reader is closed.
+func NewKafkaReader(u *KafkaURL) io.ReadCloser {
+	cfg := kafka.ReaderConfig{
+		Brokers:     u.Brokers,
+		Topic:       u.Topic,
+		GroupID:     u.Group,
+		StartOffset: u.StartOffset,
+		MinBytes:    1,
+		MaxBytes:    16 * 1024 * 1024,
+	}
+	if len(u.Group) == 0 {
+		cfg.Partition = u.Partition
+	}
+	return &kafkaReader{r: kafka.NewReader(cfg)}
+}
+
+func (k *kafkaReader) Read(b []byte) (int, error) {
+	for len(k.buf) == 0 {
+		m, e := k.r.ReadMessage(context.Background())
+		if e != nil {
+			return 0, e
+		}
+		k.buf = append(bytes.TrimRight(m.Value, "\r\n"), '\n')
+	}
+
+	n := copy(b, k.buf)
+	k.buf = k.buf[n:]
+	return n, nil
+}
+
+func (k *kafkaReader) Close() error {
+	return k.r.Close()
+}
+
+type kafkaWriter struct {
+	u       *KafkaURL
+	w       *kafka.Writer
+	pending []byte
+	err     atomic.Value
+}
+
+// NewKafkaWriter returns a writer that produces each line written to it as a
+// message. Messages are sent in the background in batches of up to BatchSize
+// messages, or after BatchTimeout, and are partitioned by the key field when
+// one is configured. Delivery errors are returned by the next Write or Close.
+func NewKafkaWriter(u *KafkaURL) io.WriteCloser {
+	k := &kafkaWriter{u: u}
+
+	w := &kafka.Writer{
+		Addr:         kafka.TCP(u.Brokers...),
+		Topic:        u.Topic,
+		Balancer:     &kafka.RoundRobin{},
+		BatchSize:    u.BatchSize,
+		BatchTimeout: u.BatchTimeout,
+		RequiredAcks: kafka.RequireAll,
+		Async:        true,
+		Completion: func(messages []kafka.Message, e error) {
+			if e != nil {
+				k.err.Store(e)
+			}
+		},
+	}
+
+	if u.KeyField > 0 {
+		w.Balancer = &kafka.Hash{}
+	}
+
+	if c, ok := kafka_compression_types[u.Compression]; ok {
+		w.Compression = c
+	}
+
+	k.w = w
+	return k
+}
+
+func (k *kafkaWriter) failed() error {
+	if e, ok := k.err.Load().(error); ok {
+		return e
+	}
+	return nil
+}
+
+func (k *kafkaWriter) Write(b []byte) (int, error) {
+	if e := k.failed(); e != nil {
+		return 0, e
+	}
+
+	k.pending = append(k.pending, b...)
+
+	batch := []kafka.Message{}
+	for {
+		idx := bytes.IndexByte(k.pending, '\n')
+		if idx < 0 {
+			break
+		}
+
+		line := string(k.pending[:idx])
+		k.pending = k.pending[idx+1:]
+
+		m := kafka.Message{Value: []byte(line)}
+		if k.u.KeyField > 0 {
+			bits := strings.SplitN(line, k.u.Delimiter, k.u.KeyField+1)
+			if len(bits) >= k.u.KeyField {
+				m.Key = []byte(bits[k.u.KeyField-1])
+			}
+		}
+		batch = append(batch, m)
+	}
+
+	if len(batch) > 0 {
+		if e := k.w.WriteMessages(context.Background(), batch...); e != nil {
+			return 0, e
+		}
+	}
+
+	return len(b), nil
+}
+
+// WriteRecord produces a binary record as a single message, without splitting
+// it into lines. Records are distributed round-robin.
+func (k *kafkaWriter) WriteRecord(b []byte) error {
+	if e := k.failed(); e != nil {
+		return e
+	}
+	return k.w.WriteMessages(context.Background(), kafka.Message{Value: b})
+}
+
+// Close sends any remaining messages, including a final unterminated line
+func (k *kafkaWriter) Close() error {
+	if len(k.pending) > 0 {
+		if _, e := k.Write([]byte("\n")); e != nil {
+			return e
+		}
+	}
+
+	// Close waits for the background batches to be delivered
+	e := k.w.Close()
+	if fe := k.failed(); fe != nil {
+		e = fe
+	}
+	return e
+}
@@ -0,0 +1,135 @@
+// Package linereader splits large inputs into lines the same way as the
+// inetdata tools, without allocating a string for every line. Lines are read
+// into buffers that are recycled once the consumer is done with them, which
+// keeps the garbage collector idle on inputs with billions of records.
+package linereader
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// The initial capacity of a pooled line, which fits most records without
+// growing the buffer
+const LINE_BUFFER_SIZE = 512
+
+// Lines longer than this are not returned to the pool, so that one huge
+// record does not pin its buffer for the rest of the run
+const MAX_POOLED_LINE = 64 * 1024
+
+// Line is a line of input without its trailing newline. The bytes are only
+// valid until Recycle is called, so a consumer that keeps any part of a line
+// must copy it first.
+type Line struct {
+	Bytes []byte
+	pool  *Pool
+}
+
+// String returns a copy of the line
+func (l *Line) String() string {
+	return string(l.Bytes)
+}
+
+// Recycle returns the line buffer to its pool. The line must not be used
+// afterwards.
+func (l *Line) Recycle() {
+	if l.pool == nil {
+		return
+	}
+	if cap(l.Bytes) <= MAX_POOLED_LINE {
+		l.pool.p.Put(l)
+	}
+}
+
+// Pool holds recycled line buffers
+type Pool struct {
+	p sync.Pool
+}
+
+// NewPool returns an empty pool of line buffers
+func NewPool() *Pool {
+	p := &Pool{}
+	p.p.New = func() interface{} {
+		return &Line{Bytes: make([]byte, 0, LINE_BUFFER_SIZE), pool: p}
+	}
+	return p
+}
+
+// Get returns a line holding a copy of b
+func (p *Pool) Get(b []byte) *Line {
+	l := p.p.Get().(*Line)
+	l.Bytes = append(l.Bytes[:0], b...)
+	return l
+}
+
+// Reader splits an input into lines. Empty lines are skipped.
+type Reader struct {
+	r    *bufio.Reader
+	pred []byte
+	err  error
+
+	// Stop is checked before each line when set, and ends the input early
+	// when it returns true, such as after a signal
+	Stop func() bool
+}
+
+// NewReader returns a reader that buffers size bytes of the input. Lines
+// longer than the buffer are assembled in a separate buffer.
+func NewReader(input io.Reader, size int) *Reader {
+	return &Reader{r: bufio.NewReaderSize(input, size)}
+}
+
+// Scan returns the next line, which is a slice of the read buffer and is only
+// valid until the next call. At the end of the input, Scan returns io.EOF or
+// the read error.
+func (r *Reader) Scan() ([]byte, error) {
+	for r.err == nil {
+		if r.Stop != nil && r.Stop() {
+			r.err = io.EOF
+			break
+		}
+
+		buf, err := r.r.ReadSlice('\n')
+
+		if err == bufio.ErrBufferFull {
+			r.pred = append(r.pred, buf...)
+			continue
+		}
+
+		if len(r.pred) > 0 {
+			buf, r.pred = append(r.pred, buf...), r.pred[:0]
+		}
+
+		if len(buf) > 0 && buf[len(buf)-1] == '\n' {
+			buf = buf[:len(buf)-1]
+		}
+
+		// Stop on EOF or a read error instead of retrying the failed read
+		r.err = err
+
+		if len(buf) > 0 {
+			return buf, nil
+		}
+	}
+	return nil, r.err
+}
+
+// Send copies each line into a buffer from the pool and sends it to the
+// channel, which is closed at the end of the input. The receiver recycles
+// each line when it is done with it. Send returns nil at the end of the
+// input, or the read error.
+func (r *Reader) Send(pool *Pool, out chan<- *Line) error {
+	defer close(out)
+
+	for {
+		buf, err := r.Scan()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		out <- pool.Get(buf)
+	}
+}
@@ -0,0 +1,175 @@
+package inetdata
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers/mtbl"
+	"github.com/fathom6/inetdata-parsers/mtblutil"
+	"github.com/fathom6/inetdata-parsers/rollup"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The levels of log messages, from the most to the least verbose
+const (
+	LOG_DEBUG = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+)
+
+var log_level_names = []string{"debug", "info", "warn", "error"}
+
+// The prefixes of the levels in the text format, which keep the messages of
+// the tools as they were before they were logged
+var log_text_prefixes = []string{"[D] ", "[*] ", "[-] ", "Error: "}
+
+// Logger writes the messages of a tool to stderr, as text lines or as JSON
+// objects with the time, level, component, message, and the fields added
+// with With. Messages below the level are dropped.
+type Logger struct {
+	out    *logOutput
+	fields map[string]interface{}
+}
+
+// The settings shared by a logger and the loggers derived from it with With
+type logOutput struct {
+	w         io.Writer
+	level     int
+	format    string
+	component string
+	lock      sync.Mutex
+}
+
+// Log is the logger of the tools, configured by ParseFlags with -log-level
+// and -log-format and the name of the tool as the component
+var Log = NewLogger(os.Stderr)
+
+func init() {
+	// The library packages report through the logger of the tools
+	mtbl.Warnf = func(format string, args ...interface{}) { Log.Warnf(format, args...) }
+	mtblutil.Warnf = func(format string, args ...interface{}) { Log.Warnf(format, args...) }
+	rollup.Warnf = func(format string, args ...interface{}) { Log.Warnf(format, args...) }
+}
+
+// NewLogger returns a text logger at the info level
+func NewLogger(w io.Writer) *Logger {
+	return &Logger{out: &logOutput{w: w, level: LOG_INFO, format: "text"}, fields: map[string]interface{}{}}
+}
+
+// ValidLogFormat returns true for the formats of -log-format
+func ValidLogFormat(format string) bool {
+	return format == "text" || format == "json"
+}
+
+// ParseLogLevel returns the level of a name of -log-level
+func ParseLogLevel(name string) (int, error) {
+	for i, n := range log_level_names {
+		if strings.ToLower(name) == n {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level %q, expected debug, info, warn, or error", name)
+}
+
+// Configure sets the level, format, and component of the logger
+func (l *Logger) Configure(level string, format string, component string) error {
+	lvl, e := ParseLogLevel(level)
+	if e != nil {
+		return e
+	}
+	if !ValidLogFormat(format) {
+		return fmt.Errorf("invalid log format %q, expected text or json", format)
+	}
+
+	l.out.lock.Lock()
+	defer l.out.lock.Unlock()
+	l.out.level = lvl
+	l.out.format = format
+	l.out.component = component
+	return nil
+}
+
+// With returns a logger that adds a field to each message
+func (l *Logger) With(key string, value interface{}) *Logger {
+	c := &Logger{out: l.out, fields: map[string]interface{}{key: value}}
+	for k, v := range l.fields {
+		if k != key {
+			c.fields[k] = v
+		}
+	}
+	return c
+}
+
+// Enabled returns true if messages of a level are written
+func (l *Logger) Enabled(level int) bool {
+	l.out.lock.Lock()
+	defer l.out.lock.Unlock()
+	return level >= l.out.level
+}
+
+// Debugf logs a debug message
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.write(LOG_DEBUG, fmt.Sprintf(format, args...))
+}
+
+// Infof logs an info message
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.write(LOG_INFO, fmt.Sprintf(format, args...))
+}
+
+// Warnf logs a warning message
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.write(LOG_WARN, fmt.Sprintf(format, args...))
+}
+
+// Errorf logs an error message
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.write(LOG_ERROR, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) write(level int, msg string) {
+	o := l.out
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if level < o.level {
+		return
+	}
+	msg = strings.TrimRight(msg, "\n")
+
+	keys := []string{}
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if o.format == "json" {
+		rec := map[string]interface{}{}
+		for k, v := range l.fields {
+			rec[k] = v
+		}
+		rec["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+		rec["level"] = log_level_names[level]
+		rec["msg"] = msg
+		if len(o.component) > 0 {
+			rec["component"] = o.component
+		}
+		b, e := json.Marshal(rec)
+		if e != nil {
+			b, _ = json.Marshal(map[string]string{"level": log_level_names[level], "msg": msg})
+		}
+		o.w.Write(append(b, '\n'))
+		return
+	}
+
+	line := log_text_prefixes[level] + msg
+	for _, k := range keys {
+		line += fmt.Sprintf(" %s=%v", k, l.fields[k])
+	}
+	io.WriteString(o.w, line+"\n")
+}
@@ -0,0 +1,143 @@
+// Package merkle verifies the Merkle tree proofs of Certificate Transparency
+// logs, as specified by RFC 6962 and RFC 9162. An inclusion proof shows that
+// an entry is in a tree head published by a log, and a consistency proof
+// shows that a later tree head extends an earlier one, so that a log has not
+// removed or changed the entries it published.
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+)
+
+// The prefixes of the hashes of leaves and of interior nodes
+const (
+	LEAF_PREFIX = 0x00
+	NODE_PREFIX = 0x01
+)
+
+// The root hash of an empty tree
+var EmptyRoot = sha256.New().Sum(nil)
+
+// LeafHash returns the hash of a leaf, such as the leaf_input of a log entry
+func LeafHash(leaf []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{LEAF_PREFIX})
+	h.Write(leaf)
+	return h.Sum(nil)
+}
+
+// NodeHash returns the hash of an interior node from its children
+func NodeHash(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{NODE_PREFIX})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// Shift both numbers right until the lowest bit of fn is set or it is zero
+func shiftUntilSet(fn uint64, sn uint64) (uint64, uint64) {
+	for fn&1 == 0 && fn != 0 {
+		fn >>= 1
+		sn >>= 1
+	}
+	return fn, sn
+}
+
+// VerifyInclusion checks that the leaf hash is the entry at index of the tree
+// of size entries with the root hash
+func VerifyInclusion(index uint64, size uint64, leaf_hash []byte, proof [][]byte, root []byte) error {
+	if index >= size {
+		return fmt.Errorf("index %d is beyond the tree size %d", index, size)
+	}
+
+	fn, sn := index, size-1
+	r := leaf_hash
+	for _, p := range proof {
+		if sn == 0 {
+			return fmt.Errorf("the inclusion proof is too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			r = NodeHash(p, r)
+			if fn&1 == 0 {
+				fn, sn = shiftUntilSet(fn, sn)
+			}
+		} else {
+			r = NodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return fmt.Errorf("the inclusion proof is too short")
+	}
+	if !bytes.Equal(r, root) {
+		return fmt.Errorf("the inclusion proof of index %d does not match the root hash of size %d", index, size)
+	}
+	return nil
+}
+
+// VerifyConsistency checks that the tree of size2 entries with root2 extends
+// the tree of size1 entries with root1
+func VerifyConsistency(size1 uint64, size2 uint64, root1 []byte, root2 []byte, proof [][]byte) error {
+	switch {
+	case size1 > size2:
+		return fmt.Errorf("the tree size shrank from %d to %d", size1, size2)
+	case size1 == size2:
+		if len(proof) > 0 {
+			return fmt.Errorf("the consistency proof of a tree with itself must be empty")
+		}
+		if !bytes.Equal(root1, root2) {
+			return fmt.Errorf("the root hash of size %d changed", size1)
+		}
+		return nil
+	case size1 == 0:
+		// Every tree extends the empty tree
+		return nil
+	case len(proof) == 0:
+		return fmt.Errorf("the consistency proof is empty")
+	}
+
+	// The first tree is a complete subtree when its size is a power of 2
+	if size1&(size1-1) == 0 {
+		proof = append([][]byte{root1}, proof...)
+	}
+
+	fn, sn := size1-1, size2-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return fmt.Errorf("the consistency proof is too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = NodeHash(c, fr)
+			sr = NodeHash(c, sr)
+			if fn&1 == 0 {
+				fn, sn = shiftUntilSet(fn, sn)
+			}
+		} else {
+			sr = NodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return fmt.Errorf("the consistency proof is too short")
+	}
+	if !bytes.Equal(fr, root1) {
+		return fmt.Errorf("the consistency proof does not match the root hash of size %d", size1)
+	}
+	if !bytes.Equal(sr, root2) {
+		return fmt.Errorf("the consistency proof does not match the root hash of size %d", size2)
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package merkle
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// The leaves of the 8 entry reference tree of RFC 6962, as used by the
+// certificate-transparency test suites
+var leaves = []string{
+	"",
+	"00",
+	"10",
+	"2021",
+	"3031",
+	"40414243",
+	"5051525354555657",
+	"606162636465666768696a6b6c6d6e6f",
+}
+
+// The root hashes of the first 1 to 8 leaves
+var roots = []string{
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+var inclusionProofs = []struct {
+	index uint64
+	size  uint64
+	proof []string
+}{
+	{0, 1, []string{}},
+	{0, 8, []string{
+		"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+	}},
+	{5, 8, []string{
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+		"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	}},
+	{2, 3, []string{
+		"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	}},
+	{1, 5, []string{
+		"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+	}},
+}
+
+var consistencyProofs = []struct {
+	size1 uint64
+	size2 uint64
+	proof []string
+}{
+	{1, 1, []string{}},
+	{1, 8, []string{
+		"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+	}},
+	{6, 8, []string{
+		"0ebc5d3437fbe2db158b9f126a1d118e308181031d0a949f8dededebc558ef6a",
+		"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	}},
+	{2, 5, []string{
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+	}},
+}
+
+// An inclusion proof that must not verify
+type badInclusion struct {
+	name  string
+	index uint64
+	size  uint64
+	leaf  []byte
+	proof [][]byte
+	root  []byte
+}
+
+// A consistency proof that must not verify
+type badConsistency struct {
+	name  string
+	size1 uint64
+	size2 uint64
+	root1 []byte
+	root2 []byte
+	proof [][]byte
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, e := hex.DecodeString(s)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return b
+}
+
+func decodeProof(t *testing.T, proof []string) [][]byte {
+	t.Helper()
+	out := [][]byte{}
+	for _, p := range proof {
+		out = append(out, decodeHex(t, p))
+	}
+	return out
+}
+
+func leafHash(t *testing.T, index uint64) []byte {
+	return LeafHash(decodeHex(t, leaves[index]))
+}
+
+func root(t *testing.T, size uint64) []byte {
+	return decodeHex(t, roots[size-1])
+}
+
+// The largest power of 2 less than n
+func split(n int) int {
+	k := 1
+	for k*2 < n {
+		k *= 2
+	}
+	return k
+}
+
+// The Merkle tree hash of the leaf hashes, see RFC 6962 section 2.1
+func treeHash(hashes [][]byte) []byte {
+	if len(hashes) == 1 {
+		return hashes[0]
+	}
+	k := split(len(hashes))
+	return NodeHash(treeHash(hashes[:k]), treeHash(hashes[k:]))
+}
+
+func TestRoots(t *testing.T) {
+	hashes := [][]byte{}
+	for i := range leaves {
+		hashes = append(hashes, leafHash(t, uint64(i)))
+		if got := hex.EncodeToString(treeHash(hashes)); got != roots[i] {
+			t.Errorf("the root of size %d is %s, want %s", i+1, got, roots[i])
+		}
+	}
+}
+
+func TestVerifyInclusion(t *testing.T) {
+	for _, tt := range inclusionProofs {
+		proof := decodeProof(t, tt.proof)
+		leaf := leafHash(t, tt.index)
+		r := root(t, tt.size)
+
+		if e := VerifyInclusion(tt.index, tt.size, leaf, proof, r); e != nil {
+			t.Errorf("index %d of size %d: %s", tt.index, tt.size, e)
+		}
+
+		bad := []badInclusion{
+			{"wrong root", tt.index, tt.size, leaf, proof, EmptyRoot},
+			{"wrong leaf", tt.index, tt.size, LeafHash([]byte("x")), proof, r},
+			{"wrong index", tt.index ^ 1, tt.size, leaf, proof, r},
+			{"index beyond the size", tt.size, tt.size, leaf, proof, r},
+			{"larger size", tt.index, tt.size * 2, leaf, proof, r},
+			{"extra proof element", tt.index, tt.size, leaf, append(append([][]byte{}, proof...), EmptyRoot), r},
+		}
+		if len(proof) > 0 {
+			changed := append([][]byte{}, proof...)
+			changed[0] = EmptyRoot
+			bad = append(bad,
+				badInclusion{"truncated proof", tt.index, tt.size, leaf, proof[:len(proof)-1], r},
+				badInclusion{"changed proof element", tt.index, tt.size, leaf, changed, r})
+		}
+
+		for _, b := range bad {
+			if e := VerifyInclusion(b.index, b.size, b.leaf, b.proof, b.root); e == nil {
+				t.Errorf("index %d of size %d: the proof verified with a %s", tt.index, tt.size, b.name)
+			}
+		}
+	}
+}
+
+func TestVerifyConsistency(t *testing.T) {
+	for _, tt := range consistencyProofs {
+		proof := decodeProof(t, tt.proof)
+		r1, r2 := root(t, tt.size1), root(t, tt.size2)
+
+		if e := VerifyConsistency(tt.size1, tt.size2, r1, r2, proof); e != nil {
+			t.Errorf("size %d to %d: %s", tt.size1, tt.size2, e)
+		}
+
+		bad := []badConsistency{
+			{"wrong first root", tt.size1, tt.size2, EmptyRoot, r2, proof},
+			{"wrong second root", tt.size1, tt.size2, r1, EmptyRoot, proof},
+			{"size1 > size2", tt.size2 + 1, tt.size2, r1, r2, proof},
+			{"extra proof element", tt.size1, tt.size2, r1, r2, append(append([][]byte{}, proof...), EmptyRoot)},
+		}
+		if tt.size1 != tt.size2 {
+			bad = append(bad, badConsistency{"swapped sizes", tt.size2, tt.size1, r2, r1, proof})
+		}
+		if len(proof) > 0 {
+			changed := append([][]byte{}, proof...)
+			changed[len(changed)-1] = EmptyRoot
+			bad = append(bad,
+				badConsistency{"truncated proof", tt.size1, tt.size2, r1, r2, proof[:len(proof)-1]},
+				badConsistency{"changed proof element", tt.size1, tt.size2, r1, r2, changed})
+		}
+
+		for _, b := range bad {
+			if e := VerifyConsistency(b.size1, b.size2, b.root1, b.root2, b.proof); e == nil {
+				t.Errorf("size %d to %d: the proof verified with a %s", tt.size1, tt.size2, b.name)
+			}
+		}
+	}
+}
+
+// Every inclusion and consistency proof of the reference tree, built from
+// the definitions of RFC 6962 section 2.1, verifies
+func TestAllProofs(t *testing.T) {
+	hashes := [][]byte{}
+	for i := range leaves {
+		hashes = append(hashes, leafHash(t, uint64(i)))
+	}
+
+	var path func(m int, d [][]byte) [][]byte
+	path = func(m int, d [][]byte) [][]byte {
+		if len(d) == 1 {
+			return [][]byte{}
+		}
+		k := split(len(d))
+		if m < k {
+			return append(path(m, d[:k]), treeHash(d[k:]))
+		}
+		return append(path(m-k, d[k:]), treeHash(d[:k]))
+	}
+
+	var subproof func(m int, d [][]byte, complete bool) [][]byte
+	subproof = func(m int, d [][]byte, complete bool) [][]byte {
+		if m == len(d) {
+			if complete {
+				return [][]byte{}
+			}
+			return [][]byte{treeHash(d)}
+		}
+		k := split(len(d))
+		if m <= k {
+			return append(subproof(m, d[:k], complete), treeHash(d[k:]))
+		}
+		return append(subproof(m-k, d[k:], false), treeHash(d[:k]))
+	}
+
+	for n := 1; n <= len(hashes); n++ {
+		r := treeHash(hashes[:n])
+		for m := 0; m < n; m++ {
+			if e := VerifyInclusion(uint64(m), uint64(n), hashes[m], path(m, hashes[:n]), r); e != nil {
+				t.Errorf("index %d of size %d: %s", m, n, e)
+			}
+		}
+		for m := 1; m < n; m++ {
+			if e := VerifyConsistency(uint64(m), uint64(n), treeHash(hashes[:m]), r, subproof(m, hashes[:n], true)); e != nil {
+				t.Errorf("size %d to %d: %s", m, n, e)
+			}
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package inetdata
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers/mtblfile"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// The extension of the provenance file written next to an output
+const META_EXTENSION = ".meta.json"
+
+// WriteMeta is set with -meta, see AddMetaFlags
+var WriteMeta = false
+
+// RequireMeta is set with -require-meta, see AddRequireMetaFlags
+var RequireMeta = false
+
+// DatasetMeta is the provenance of an output: how, when, and from what it was
+// built
+type DatasetMeta struct {
+	Tool    string            `json:"tool"`
+	Version string            `json:"version"`
+	Built   time.Time         `json:"built"`
+	Flags   map[string]string `json:"flags"`
+	Args    []string          `json:"args"`
+	Sources []MetaSource      `json:"sources"`
+	Records int64             `json:"records"`
+	Output  MetaSource        `json:"output"`
+}
+
+// MetaSource is an input or output file with its size and SHA-256 checksum.
+// Inputs are checksummed as read, before decompression.
+type MetaSource struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// An input being checksummed, or already checksummed with sum set
+type metaSource struct {
+	path string
+	size int64
+	h    hash.Hash
+	sum  string
+}
+
+func (s *metaSource) Write(b []byte) (int, error) {
+	s.size += int64(len(b))
+	return s.h.Write(b)
+}
+
+var meta_lock sync.Mutex
+var meta_sources []*metaSource
+
+// AddMetaFlags registers the -meta flag of the tools that write an output
+// file, see WriteDatasetMeta
+func AddMetaFlags() {
+	flag.BoolVar(&WriteMeta, "meta", WriteMeta, "Write the provenance of the output (sources, checksums, records, version, flags) to <output>"+META_EXTENSION)
+}
+
+// AddRequireMetaFlags registers the -require-meta flag of the tools that read
+// datasets, see CheckDatasetMeta
+func AddRequireMetaFlags() {
+	flag.BoolVar(&RequireMeta, "require-meta", RequireMeta, "Refuse to read datasets without a "+META_EXTENSION+" provenance file that matches the dataset")
+}
+
+// MetaPath returns the path of the provenance file of an output
+func MetaPath(path string) string {
+	return path + META_EXTENSION
+}
+
+// ValidMetaOutput returns false if -meta is set and the output is not a local
+// file, which the provenance file could be written next to
+func ValidMetaOutput(path string) bool {
+	return !WriteMeta || localOutput(path)
+}
+
+// Checksum an input as it is read with -meta
+func trackMetaSource(path string, r io.Reader) io.Reader {
+	if !WriteMeta {
+		return r
+	}
+
+	s := &metaSource{path: path, h: sha256.New()}
+	meta_lock.Lock()
+	meta_sources = append(meta_sources, s)
+	meta_lock.Unlock()
+
+	return io.TeeReader(r, s)
+}
+
+// Checksum a file
+func fileMetaSource(path string) (MetaSource, error) {
+	fd, e := os.Open(path)
+	if e != nil {
+		return MetaSource{}, e
+	}
+	defer fd.Close()
+
+	h := sha256.New()
+	n, e := io.Copy(h, fd)
+	if e != nil {
+		return MetaSource{}, e
+	}
+	return MetaSource{Path: path, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// AddMetaSource checksums an input that is not read through OpenInputs, such
+// as a MTBL database, with -meta
+func AddMetaSource(path string) error {
+	if !WriteMeta {
+		return nil
+	}
+
+	src, e := fileMetaSource(path)
+	if e != nil {
+		return e
+	}
+
+	meta_lock.Lock()
+	meta_sources = append(meta_sources, &metaSource{path: path, size: src.Size, sum: src.SHA256})
+	meta_lock.Unlock()
+	return nil
+}
+
+// WriteDatasetMeta writes the provenance of a finished output file with -meta:
+// the inputs read so far with their checksums, the number of records, the
+// version and flags of the tool, and the checksum of the output
+func WriteDatasetMeta(tool string, output string, records int64) error {
+	if !WriteMeta {
+		return nil
+	}
+	if !localOutput(output) {
+		return fmt.Errorf("-meta requires a local output file")
+	}
+
+	m := DatasetMeta{
+		Tool:    tool,
+		Version: Version,
+		Built:   time.Now().UTC(),
+		Flags:   make(map[string]string),
+		Args:    flag.Args(),
+		Sources: []MetaSource{},
+		Records: records,
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		m.Flags[f.Name] = f.Value.String()
+	})
+
+	meta_lock.Lock()
+	for _, s := range meta_sources {
+		sum := s.sum
+		if len(sum) == 0 {
+			sum = hex.EncodeToString(s.h.Sum(nil))
+		}
+		m.Sources = append(m.Sources, MetaSource{Path: s.path, Size: s.size, SHA256: sum})
+	}
+	meta_lock.Unlock()
+
+	out, e := fileMetaSource(output)
+	if e != nil {
+		return e
+	}
+	m.Output = out
+
+	raw, e := json.MarshalIndent(m, "", "  ")
+	if e != nil {
+		return e
+	}
+
+	tmp := MetaPath(output) + ".tmp"
+	if e := os.WriteFile(tmp, append(raw, '\n'), 0644); e != nil {
+		return e
+	}
+	return os.Rename(tmp, MetaPath(output))
+}
+
+// WriteMTBLMeta writes the provenance of a finished MTBL file or shard
+// manifest with -meta, with its number of entries as the records
+func WriteMTBLMeta(tool string, path string) error {
+	if !WriteMeta {
+		return nil
+	}
+
+	var entries uint64
+	if IsShardManifest(path) {
+		m, e := ReadShardManifest(path)
+		if e != nil {
+			return e
+		}
+		for _, s := range m.Shards {
+			entries += s.Entries
+		}
+	} else {
+		r, e := mtblfile.Open(path, false)
+		if e != nil {
+			return e
+		}
+		entries = r.Metadata.CountEntries
+		r.Close()
+	}
+	return WriteDatasetMeta(tool, path, int64(entries))
+}
+
+// ReadDatasetMeta reads the provenance file of a dataset
+func ReadDatasetMeta(path string) (*DatasetMeta, error) {
+	raw, e := os.ReadFile(MetaPath(path))
+	if e != nil {
+		return nil, e
+	}
+
+	m := &DatasetMeta{}
+	if e := json.Unmarshal(raw, m); e != nil {
+		return nil, fmt.Errorf("invalid provenance file %s: %s", MetaPath(path), e)
+	}
+	return m, nil
+}
+
+// CheckDatasetMeta returns an error with -require-meta if a dataset has no
+// provenance file, or if the dataset is not the size it records. The checksum
+// is not verified, since reading a large dataset in full would delay every
+// consumer; use the recorded sha256 for a full check.
+func CheckDatasetMeta(path string) error {
+	if !RequireMeta {
+		return nil
+	}
+
+	m, e := ReadDatasetMeta(path)
+	if e != nil {
+		if os.IsNotExist(e) {
+			return fmt.Errorf("%s has no provenance file (%s)", path, MetaPath(path))
+		}
+		return e
+	}
+
+	info, e := os.Stat(path)
+	if e != nil {
+		return e
+	}
+	if info.Size() != m.Output.Size {
+		return fmt.Errorf("%s is %d bytes, but its provenance file records %d bytes", path, info.Size(), m.Output.Size)
+	}
+	return nil
+}
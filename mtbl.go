@@ -0,0 +1,141 @@
+package inetdata
+
+import (
+	"fmt"
+	"github.com/fathom6/inetdata-parsers/mtbl"
+	"os"
+)
+
+// MTBLPartSorter sorts records like an mtbl.Sorter, but can commit the records
+// added so far to a numbered part file next to the output and record it in a
+// checkpoint. A build resumed from the checkpoint keeps the committed parts,
+// which Finish merges into the output with the sorter merge function.
+type MTBLPartSorter struct {
+	output   string
+	cp       *Checkpoint
+	sort_opt mtbl.SorterOptions
+	w_opt    mtbl.WriterOptions
+	s        *mtbl.Sorter
+	added    int64
+}
+
+// NewMTBLPartSorter returns a sorter that writes the MTBL output. Without a
+// checkpoint, Commit does nothing and Finish writes the output directly.
+func NewMTBLPartSorter(output string, cp *Checkpoint, sort_opt mtbl.SorterOptions, w_opt mtbl.WriterOptions) *MTBLPartSorter {
+	return &MTBLPartSorter{
+		output:   output,
+		cp:       cp,
+		sort_opt: sort_opt,
+		w_opt:    w_opt,
+		s:        mtbl.SorterInit(&sort_opt),
+	}
+}
+
+// Add a record to the current part
+func (p *MTBLPartSorter) Add(key []byte, val []byte) error {
+	p.added++
+	return p.s.Add(key, val)
+}
+
+// Write the records of the current part to a file and start a new part
+func (p *MTBLPartSorter) writePart(path string) error {
+	os.Remove(path)
+
+	w, e := mtbl.WriterInit(path, &p.w_opt)
+	if e != nil {
+		return e
+	}
+
+	e = p.s.Write(w)
+	w.Destroy()
+	p.s.Destroy()
+
+	p.s = mtbl.SorterInit(&p.sort_opt)
+	p.added = 0
+	return e
+}
+
+// Commit writes the current part and saves the checkpoint with the position
+// of the input that the committed parts cover
+func (p *MTBLPartSorter) Commit(name string, offset int64) error {
+	if p.cp == nil {
+		return nil
+	}
+
+	if p.added > 0 {
+		path := fmt.Sprintf("%s.part-%05d", p.output, len(p.cp.PartNames()))
+		if e := p.writePart(path); e != nil {
+			return e
+		}
+		p.cp.AddPart(path)
+	}
+
+	p.cp.SetOffset(name, offset)
+	return p.cp.Commit()
+}
+
+// Finish writes the output. Committed parts are merged with the records that
+// were added since the last commit, and then removed.
+func (p *MTBLPartSorter) Finish() error {
+	defer p.s.Destroy()
+
+	parts := []string{}
+	if p.cp != nil {
+		parts = p.cp.PartNames()
+	}
+
+	os.Remove(p.output)
+
+	if len(parts) == 0 {
+		w, e := mtbl.WriterInit(p.output, &p.w_opt)
+		if e != nil {
+			return e
+		}
+		defer w.Destroy()
+		return p.s.Write(w)
+	}
+
+	if p.added > 0 {
+		path := fmt.Sprintf("%s.part-%05d", p.output, len(parts))
+		if e := p.writePart(path); e != nil {
+			return e
+		}
+		parts = append(parts, path)
+	}
+
+	m := mtbl.MergerInit(&mtbl.MergerOptions{Merge: p.sort_opt.Merge})
+	defer m.Destroy()
+
+	for _, path := range parts {
+		r, e := mtbl.ReaderInit(path, &mtbl.ReaderOptions{VerifyChecksums: true})
+		if e != nil {
+			return fmt.Errorf("failed to read part %s: %s", path, e)
+		}
+		defer r.Destroy()
+		m.AddSource(r)
+	}
+
+	w, e := mtbl.WriterInit(p.output, &p.w_opt)
+	if e != nil {
+		return e
+	}
+
+	it := mtbl.IterAll(m)
+	for {
+		key, val, ok := it.Next()
+		if !ok {
+			break
+		}
+		if e := w.Add(key, val); e != nil {
+			w.Destroy()
+			return e
+		}
+	}
+	it.Destroy()
+	w.Destroy()
+
+	for _, path := range parts {
+		os.Remove(path)
+	}
+	return nil
+}
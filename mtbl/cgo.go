@@ -0,0 +1,61 @@
+//go:build cgo_mtbl
+
+package mtbl
+
+import (
+	cmtbl "github.com/fathom6/golang-mtbl"
+)
+
+const COMPRESSION_NONE = cmtbl.COMPRESSION_NONE
+const COMPRESSION_SNAPPY = cmtbl.COMPRESSION_SNAPPY
+const COMPRESSION_ZLIB = cmtbl.COMPRESSION_ZLIB
+const COMPRESSION_LZ4 = cmtbl.COMPRESSION_LZ4
+const COMPRESSION_LZ4HC = cmtbl.COMPRESSION_LZ4HC
+
+type MergeFunc = cmtbl.MergeFunc
+type Source = cmtbl.Source
+type Iter = cmtbl.Iter
+
+type ReaderOptions = cmtbl.ReaderOptions
+type Reader = cmtbl.Reader
+
+type WriterOptions = cmtbl.WriterOptions
+type Writer = cmtbl.Writer
+
+type SorterOptions = cmtbl.SorterOptions
+type Sorter = cmtbl.Sorter
+
+type MergerOptions = cmtbl.MergerOptions
+type Merger = cmtbl.Merger
+
+func ReaderInit(fname string, opt *ReaderOptions) (*Reader, error) {
+	return cmtbl.ReaderInit(fname, opt)
+}
+
+func WriterInit(fname string, opt *WriterOptions) (*Writer, error) {
+	return cmtbl.WriterInit(fname, opt)
+}
+
+func SorterInit(opt *SorterOptions) *Sorter {
+	return cmtbl.SorterInit(opt)
+}
+
+func MergerInit(opt *MergerOptions) *Merger {
+	return cmtbl.MergerInit(opt)
+}
+
+func IterAll(s Source) *Iter {
+	return cmtbl.IterAll(s)
+}
+
+func IterPrefix(s Source, p []byte) *Iter {
+	return cmtbl.IterPrefix(s, p)
+}
+
+func IterRange(s Source, k0 []byte, k1 []byte) *Iter {
+	return cmtbl.IterRange(s, k0, k1)
+}
+
+func Get(s Source, key []byte) ([]byte, bool) {
+	return cmtbl.Get(s, key)
+}
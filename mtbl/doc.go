@@ -0,0 +1,7 @@
+// Package mtbl provides the API of the golang-mtbl bindings used by the tools:
+// readers, writers, sorters, mergers and iterators of MTBL files.
+//
+// By default it is implemented in pure Go on top of mtblfile, so the tools
+// build without cgo or libmtbl and cross-compile to any platform. Building
+// with -tags cgo_mtbl uses the libmtbl bindings instead.
+package mtbl
@@ -0,0 +1,385 @@
+//go:build !cgo_mtbl
+
+package mtbl
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers/mtblfile"
+	"github.com/fathom6/inetdata-parsers/mtblutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The compression algorithms, numbered as in libmtbl
+const COMPRESSION_NONE = mtblfile.COMPRESSION_NONE
+const COMPRESSION_SNAPPY = mtblfile.COMPRESSION_SNAPPY
+const COMPRESSION_ZLIB = mtblfile.COMPRESSION_ZLIB
+const COMPRESSION_LZ4 = mtblfile.COMPRESSION_LZ4
+const COMPRESSION_LZ4HC = mtblfile.COMPRESSION_LZ4HC
+const COMPRESSION_ZSTD = mtblfile.COMPRESSION_ZSTD
+
+// The defaults of libmtbl for the memory and temporary directory of a sorter
+const DEFAULT_SORTER_MEMORY = 1024 * 1024 * 1024
+const DEFAULT_SORTER_TEMP_DIR = "/var/tmp"
+
+// The approximate memory used by a sorter entry, besides its key and value
+const SORTER_ENTRY_OVERHEAD = 64
+
+// MergeFunc combines two values of the same key
+type MergeFunc func(key []byte, val0 []byte, val1 []byte) []byte
+
+// Source is a Reader or Merger that can be iterated
+type Source interface {
+	iter(start []byte) mtblutil.Iterator
+}
+
+func warn(e error) {
+	Warnf("mtbl: %s", e)
+}
+
+// Iter returns the entries of a source in key order
+type Iter struct {
+	it     mtblutil.Iterator
+	prefix []byte
+	end    []byte
+	done   bool
+}
+
+// Next returns copies of the next key and value
+func (it *Iter) Next() ([]byte, []byte, bool) {
+	if it.done {
+		return nil, nil, false
+	}
+
+	key, val, ok := it.it.Next()
+	if ok && it.prefix != nil && !bytes.HasPrefix(key, it.prefix) {
+		ok = false
+	}
+	if ok && it.end != nil && bytes.Compare(key, it.end) > 0 {
+		ok = false
+	}
+
+	if !ok {
+		it.done = true
+		if fi, is_file := it.it.(*mtblfile.Iter); is_file && fi.Err() != nil {
+			warn(fi.Err())
+		}
+		return nil, nil, false
+	}
+	return append([]byte{}, key...), append([]byte{}, val...), true
+}
+
+func (it *Iter) Destroy() {
+	it.done = true
+}
+
+// IterAll returns every entry of the source
+func IterAll(s Source) *Iter {
+	return &Iter{it: s.iter(nil)}
+}
+
+// IterPrefix returns the entries whose keys start with the prefix
+func IterPrefix(s Source, p []byte) *Iter {
+	return &Iter{it: s.iter(p), prefix: append([]byte{}, p...)}
+}
+
+// IterRange returns the entries with keys from k0 to k1, inclusive
+func IterRange(s Source, k0 []byte, k1 []byte) *Iter {
+	return &Iter{it: s.iter(k0), end: append([]byte{}, k1...)}
+}
+
+// Get returns the value of a key
+func Get(s Source, key []byte) ([]byte, bool) {
+	it := s.iter(key)
+	k, v, ok := it.Next()
+	if !ok || !bytes.Equal(k, key) {
+		return nil, false
+	}
+	return append([]byte{}, v...), true
+}
+
+type ReaderOptions struct {
+	VerifyChecksums bool
+}
+
+// Reader reads a MTBL file
+type Reader struct {
+	r *mtblfile.Reader
+}
+
+func ReaderInit(fname string, opt *ReaderOptions) (*Reader, error) {
+	r, e := mtblfile.Open(fname, opt != nil && opt.VerifyChecksums)
+	if e != nil {
+		return nil, e
+	}
+	return &Reader{r: r}, nil
+}
+
+func (r *Reader) iter(start []byte) mtblutil.Iterator {
+	return r.r.Iter(start)
+}
+
+func (r *Reader) Destroy() {
+	r.r.Close()
+}
+
+type WriterOptions struct {
+	Compression          int
+	BlockSize            uint64
+	BlockRestartInterval uint64
+}
+
+// Writer writes a MTBL file. The file is complete once it is destroyed.
+type Writer struct {
+	w *mtblfile.Writer
+}
+
+func WriterInit(fname string, opt *WriterOptions) (*Writer, error) {
+	w_opt := mtblfile.WriterOptions{}
+	if opt != nil {
+		w_opt = mtblfile.WriterOptions{
+			Compression:          uint64(opt.Compression),
+			BlockSize:            opt.BlockSize,
+			BlockRestartInterval: opt.BlockRestartInterval,
+		}
+	}
+
+	w, e := mtblfile.Create(fname, w_opt)
+	if e != nil {
+		return nil, e
+	}
+	return &Writer{w: w}, nil
+}
+
+func (w *Writer) Add(key []byte, val []byte) error {
+	return w.w.Add(key, val)
+}
+
+func (w *Writer) Destroy() {
+	if e := w.w.Close(); e != nil {
+		warn(e)
+	}
+}
+
+type MergerOptions struct {
+	Merge MergeFunc
+}
+
+// Merger iterates over several sources at once, combining the values of
+// identical keys with the merge function
+type Merger struct {
+	merge   MergeFunc
+	sources []Source
+}
+
+func MergerInit(opt *MergerOptions) *Merger {
+	return &Merger{merge: opt.Merge}
+}
+
+func (m *Merger) AddSource(s Source) {
+	m.sources = append(m.sources, s)
+}
+
+func (m *Merger) iter(start []byte) mtblutil.Iterator {
+	iters := make([]mtblutil.Iterator, len(m.sources))
+	for i, s := range m.sources {
+		iters[i] = s.iter(start)
+	}
+	return &mergeIter{m: mtblutil.NewMerger(iters), merge: m.merge}
+}
+
+func (m *Merger) Destroy() {
+	m.sources = nil
+}
+
+// mergeIter folds the values of each key from a k-way merge
+type mergeIter struct {
+	m     *mtblutil.Merger
+	merge MergeFunc
+}
+
+func (it *mergeIter) Next() ([]byte, []byte, bool) {
+	key, vals, ok := it.m.Next()
+	if !ok {
+		return nil, nil, false
+	}
+	return key, foldValues(it.merge, key, vals), true
+}
+
+// Combine the values of a key in order. Without a merge function, the first
+// value is kept.
+func foldValues(merge MergeFunc, key []byte, vals [][]byte) []byte {
+	val := vals[0]
+	if merge == nil {
+		return val
+	}
+	for _, v := range vals[1:] {
+		val = merge(key, val, v)
+	}
+	return val
+}
+
+type SorterOptions struct {
+	TempDir   string
+	MaxMemory uint64
+	Merge     MergeFunc
+}
+
+type sorterEntry struct {
+	key []byte
+	val []byte
+}
+
+// Sorter accepts entries in any order and writes them sorted, with the values
+// of duplicate keys combined by the merge function. Once the entries exceed
+// the memory limit, they are sorted and written to a temporary MTBL file, and
+// the files are merged when the sorter is written.
+type Sorter struct {
+	opt     SorterOptions
+	entries []sorterEntry
+	memory  uint64
+	dir     string
+	chunks  []string
+	err     error
+}
+
+func SorterInit(opt *SorterOptions) *Sorter {
+	s := &Sorter{}
+	if opt != nil {
+		s.opt = *opt
+	}
+	if s.opt.MaxMemory == 0 {
+		s.opt.MaxMemory = DEFAULT_SORTER_MEMORY
+	}
+	if s.opt.TempDir == "" {
+		s.opt.TempDir = DEFAULT_SORTER_TEMP_DIR
+	}
+	return s
+}
+
+func (s *Sorter) Add(key []byte, val []byte) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	s.entries = append(s.entries, sorterEntry{append([]byte{}, key...), append([]byte{}, val...)})
+	s.memory += uint64(len(key)+len(val)) + SORTER_ENTRY_OVERHEAD
+
+	if s.memory >= s.opt.MaxMemory {
+		s.err = s.spill()
+	}
+	return s.err
+}
+
+// Sort the entries in memory and combine the values of duplicate keys, which
+// stay in the order they were added
+func (s *Sorter) sorted() []sorterEntry {
+	sort.SliceStable(s.entries, func(i, j int) bool {
+		return bytes.Compare(s.entries[i].key, s.entries[j].key) < 0
+	})
+
+	out := s.entries[:0]
+	for _, ent := range s.entries {
+		if n := len(out); n > 0 && bytes.Equal(out[n-1].key, ent.key) {
+			out[n-1].val = foldValues(s.opt.Merge, ent.key, [][]byte{out[n-1].val, ent.val})
+			continue
+		}
+		out = append(out, ent)
+	}
+	return out
+}
+
+// Write the entries in memory to a temporary file
+func (s *Sorter) spill() error {
+	if s.dir == "" {
+		dir, e := os.MkdirTemp(s.opt.TempDir, "mtbl-sorter-")
+		if e != nil {
+			return e
+		}
+		s.dir = dir
+	}
+
+	path := filepath.Join(s.dir, fmt.Sprintf("chunk-%06d.mtbl", len(s.chunks)))
+	w, e := mtblfile.Create(path, mtblfile.WriterOptions{Compression: COMPRESSION_SNAPPY})
+	if e != nil {
+		return e
+	}
+	s.chunks = append(s.chunks, path)
+
+	for _, ent := range s.sorted() {
+		if e := w.Add(ent.key, ent.val); e != nil {
+			w.Close()
+			return e
+		}
+	}
+
+	s.entries = nil
+	s.memory = 0
+	return w.Close()
+}
+
+// Write the sorted entries to a writer
+func (s *Sorter) Write(w *Writer) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	if len(s.chunks) == 0 {
+		for _, ent := range s.sorted() {
+			if e := w.Add(ent.key, ent.val); e != nil {
+				return e
+			}
+		}
+		s.entries = nil
+		s.memory = 0
+		return nil
+	}
+
+	if len(s.entries) > 0 {
+		if e := s.spill(); e != nil {
+			return e
+		}
+	}
+
+	files := make([]*mtblfile.Iter, len(s.chunks))
+	iters := make([]mtblutil.Iterator, len(s.chunks))
+	for i, path := range s.chunks {
+		r, e := mtblfile.Open(path, false)
+		if e != nil {
+			return e
+		}
+		defer r.Close()
+		files[i] = r.Iter(nil)
+		iters[i] = files[i]
+	}
+
+	it := &mergeIter{m: mtblutil.NewMerger(iters), merge: s.opt.Merge}
+	for {
+		key, val, ok := it.Next()
+		if !ok {
+			break
+		}
+		if e := w.Add(key, val); e != nil {
+			return e
+		}
+	}
+
+	for _, fi := range files {
+		if e := fi.Err(); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Destroy releases the entries and removes the temporary files
+func (s *Sorter) Destroy() {
+	s.entries = nil
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+		s.dir = ""
+	}
+	s.chunks = nil
+}
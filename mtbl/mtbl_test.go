@@ -0,0 +1,166 @@
+package mtbl
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Write the names in a file, each with its own name as the value
+func writeNames(t *testing.T, path string, names []string) {
+	w, e := WriterInit(path, &WriterOptions{Compression: COMPRESSION_SNAPPY, BlockSize: 256})
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, name := range names {
+		if e := w.Add([]byte(name), []byte("v:"+name)); e != nil {
+			t.Fatal(e)
+		}
+	}
+	w.Destroy()
+}
+
+// Return the keys of an iterator, checking their values
+func iterKeys(t *testing.T, it *Iter) []string {
+	t.Helper()
+	defer it.Destroy()
+
+	keys := []string{}
+	for {
+		k, v, ok := it.Next()
+		if !ok {
+			return keys
+		}
+		if string(v) != "v:"+string(k) {
+			t.Fatalf("the value of %q is %q", k, v)
+		}
+		keys = append(keys, string(k))
+	}
+}
+
+func testNames() []string {
+	names := []string{}
+	for _, d := range []string{"com.example", "com.example-cdn", "com.examples", "net.example", "org.example"} {
+		for i := 0; i < 40; i++ {
+			names = append(names, fmt.Sprintf("%s.host%02d", d, i))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestIterPrefix(t *testing.T) {
+	names := testNames()
+	path := filepath.Join(t.TempDir(), "prefix.mtbl")
+	writeNames(t, path, names)
+
+	r, e := ReaderInit(path, &ReaderOptions{VerifyChecksums: true})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer r.Destroy()
+
+	for _, prefix := range []string{"", "com.example.", "com.example", "com.examples.host3", "net.", "org.example.host39", "com.example.host40", "a", "zz"} {
+		want := []string{}
+		for _, name := range names {
+			if strings.HasPrefix(name, prefix) {
+				want = append(want, name)
+			}
+		}
+
+		got := iterKeys(t, IterPrefix(r, []byte(prefix)))
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("IterPrefix(%q) returned %d keys %v, want %d keys", prefix, len(got), got, len(want))
+		}
+	}
+}
+
+func TestIterRange(t *testing.T) {
+	names := testNames()
+	path := filepath.Join(t.TempDir(), "range.mtbl")
+	writeNames(t, path, names)
+
+	r, e := ReaderInit(path, &ReaderOptions{VerifyChecksums: true})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer r.Destroy()
+
+	ranges := [][2]string{
+		{"com.example.host00", "com.example.host39"},
+		{"com.example.host05", "com.example.host05"},
+		{"com.example.host05a", "com.example.host07"},
+		{"com.example-cdn", "com.examples.host01"},
+		{"a", "z"},
+		{"net", "net.example.host10"},
+		{"org.example.host39", "zz"},
+		{"com.example.host10", "com.example.host09"},
+		{"zz", "zzz"},
+	}
+	for _, rng := range ranges {
+		want := []string{}
+		for _, name := range names {
+			if name >= rng[0] && name <= rng[1] {
+				want = append(want, name)
+			}
+		}
+
+		got := iterKeys(t, IterRange(r, []byte(rng[0]), []byte(rng[1])))
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("IterRange(%q, %q) returned %d keys %v, want %d keys", rng[0], rng[1], len(got), got, len(want))
+		}
+	}
+}
+
+func TestGetAndMerge(t *testing.T) {
+	names := testNames()
+	dir := t.TempDir()
+
+	// Split the names between two files, with a few in both
+	a, b := []string{}, []string{}
+	for i, name := range names {
+		if i%2 == 0 || i%7 == 0 {
+			a = append(a, name)
+		}
+		if i%2 == 1 || i%7 == 0 {
+			b = append(b, name)
+		}
+	}
+	writeNames(t, filepath.Join(dir, "a.mtbl"), a)
+	writeNames(t, filepath.Join(dir, "b.mtbl"), b)
+
+	m := MergerInit(&MergerOptions{Merge: func(key []byte, val0 []byte, val1 []byte) []byte {
+		if !bytes.Equal(val0, val1) {
+			t.Errorf("merged different values %q and %q of %q", val0, val1, key)
+		}
+		return val0
+	}})
+	defer m.Destroy()
+
+	for _, name := range []string{"a.mtbl", "b.mtbl"} {
+		r, e := ReaderInit(filepath.Join(dir, name), nil)
+		if e != nil {
+			t.Fatal(e)
+		}
+		defer r.Destroy()
+		m.AddSource(r)
+	}
+
+	for _, name := range names {
+		v, ok := Get(m, []byte(name))
+		if !ok || string(v) != "v:"+name {
+			t.Fatalf("Get(%q) = %q, %v", name, v, ok)
+		}
+	}
+	if v, ok := Get(m, []byte("com.example.host40")); ok {
+		t.Errorf("Get of a missing key returned %q", v)
+	}
+
+	got := iterKeys(t, IterPrefix(m, []byte("com.examples.")))
+	if len(got) != 40 || got[0] != "com.examples.host00" || got[39] != "com.examples.host39" {
+		t.Errorf("IterPrefix of the merger returned %v", got)
+	}
+}
@@ -0,0 +1,13 @@
+package mtbl
+
+import (
+	"fmt"
+	"os"
+)
+
+// Warnf reports the errors that the libmtbl API has no way to return. It
+// writes to stderr, and the tools replace it with their logger. It is
+// defined for both implementations, since the tools set it either way.
+var Warnf = func(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "[-] "+format+"\n", args...)
+}
@@ -0,0 +1,117 @@
+package mtblfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// A decoded block: entries whose keys share a prefix with the previous key,
+// followed by the offsets of the restart points, where a full key is stored,
+// and the number of restart points
+type block struct {
+	data     []byte
+	restarts []uint64
+	size     uint64
+}
+
+// Parse the restart array at the end of a block. Blocks larger than 4 GiB use
+// 64-bit restart offsets.
+func newBlock(data []byte) (*block, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("truncated block")
+	}
+
+	n := uint64(binary.LittleEndian.Uint32(data[len(data)-4:]))
+	width := uint64(4)
+	if uint64(len(data)) > 1<<32 {
+		width = 8
+	}
+
+	if n*width > uint64(len(data)-4) {
+		return nil, fmt.Errorf("invalid block restart count %d", n)
+	}
+	end := uint64(len(data)-4) - n*width
+
+	b := &block{data: data[:end], restarts: make([]uint64, n), size: uint64(len(data))}
+	for i := range b.restarts {
+		p := data[end+uint64(i)*width:]
+		if width == 8 {
+			b.restarts[i] = binary.LittleEndian.Uint64(p)
+		} else {
+			b.restarts[i] = uint64(binary.LittleEndian.Uint32(p))
+		}
+		if b.restarts[i] > end {
+			return nil, fmt.Errorf("invalid block restart offset %d", b.restarts[i])
+		}
+	}
+	return b, nil
+}
+
+// blockIter walks the entries of a block in order
+type blockIter struct {
+	b   *block
+	off uint64
+	key []byte
+	val []byte
+	err error
+}
+
+func (b *block) iter() *blockIter {
+	return &blockIter{b: b}
+}
+
+// Decode the entry at the current offset
+func (it *blockIter) next() bool {
+	if it.err != nil || it.off >= uint64(len(it.b.data)) {
+		return false
+	}
+
+	p := it.b.data[it.off:]
+	var lens [3]uint64
+	for i := range lens {
+		v, n := binary.Uvarint(p)
+		if n <= 0 {
+			it.err = fmt.Errorf("invalid block entry at offset %d", it.off)
+			return false
+		}
+		lens[i] = v
+		p = p[n:]
+	}
+
+	shared, non_shared, val_len := lens[0], lens[1], lens[2]
+	if shared > uint64(len(it.key)) || non_shared+val_len > uint64(len(p)) {
+		it.err = fmt.Errorf("invalid block entry at offset %d", it.off)
+		return false
+	}
+
+	it.key = append(it.key[:shared], p[:non_shared]...)
+	it.val = p[non_shared : non_shared+val_len]
+	it.off = uint64(len(it.b.data)) - uint64(len(p)) + non_shared + val_len
+	return true
+}
+
+// Position the iterator at the restart point before the first key that is
+// greater than or equal to the target, so that next() reaches it
+func (it *blockIter) seek(target []byte) {
+	lo, hi := 0, len(it.b.restarts)-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		probe := &blockIter{b: it.b, off: it.b.restarts[mid]}
+		if !probe.next() {
+			it.err = probe.err
+			return
+		}
+		if bytes.Compare(probe.key, target) < 0 {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+
+	it.key = it.key[:0]
+	it.off = 0
+	if len(it.b.restarts) > 0 {
+		it.off = it.b.restarts[lo]
+	}
+}
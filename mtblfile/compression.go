@@ -0,0 +1,54 @@
+package mtblfile
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"io/ioutil"
+)
+
+// A zstd decoder shared by all readers, which is safe for concurrent use
+var zstd_decoder, _ = zstd.NewReader(nil)
+
+// Decompress the contents of a data block. LZ4 blocks are prefixed with their
+// uncompressed size as a 32-bit integer, as in libmtbl.
+func decompress(algorithm uint64, data []byte) ([]byte, error) {
+	switch algorithm {
+	case COMPRESSION_NONE:
+		return data, nil
+
+	case COMPRESSION_SNAPPY:
+		return snappy.Decode(nil, data)
+
+	case COMPRESSION_ZLIB:
+		r, e := zlib.NewReader(bytes.NewReader(data))
+		if e != nil {
+			return nil, e
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+
+	case COMPRESSION_LZ4, COMPRESSION_LZ4HC:
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated lz4 block")
+		}
+		out := make([]byte, binary.LittleEndian.Uint32(data))
+		n, e := lz4.UncompressBlock(data[4:], out)
+		if e != nil {
+			return nil, e
+		}
+		if n != len(out) {
+			return nil, fmt.Errorf("lz4 block is %d bytes instead of %d", n, len(out))
+		}
+		return out, nil
+
+	case COMPRESSION_ZSTD:
+		return zstd_decoder.DecodeAll(data, nil)
+	}
+
+	return nil, fmt.Errorf("unknown compression algorithm %d", algorithm)
+}
@@ -0,0 +1,123 @@
+// Package mtblfile reads and writes the MTBL file format of libmtbl in pure Go,
+// without cgo. A file is a series of data blocks in key order, followed by an
+// index block holding the last key and offset of each data block, and a fixed
+// size metadata trailer.
+package mtblfile
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The magic numbers at the end of the metadata trailer
+const MAGIC = 0x4D54424C
+const MAGIC_V1 = 0x77846676
+
+// The size in bytes of the metadata trailer
+const METADATA_SIZE = 512
+
+// The file format versions. Version 1 files use fixed 32-bit block lengths.
+const FORMAT_V1 = 1
+const FORMAT_V2 = 2
+
+// The block compression algorithms, numbered as in libmtbl
+const COMPRESSION_NONE = 0
+const COMPRESSION_SNAPPY = 1
+const COMPRESSION_ZLIB = 2
+const COMPRESSION_LZ4 = 3
+const COMPRESSION_LZ4HC = 4
+const COMPRESSION_ZSTD = 5
+
+// CompressionNames maps the compression algorithms to the names accepted by
+// the -c option of the *2mtbl tools
+var CompressionNames = map[uint64]string{
+	COMPRESSION_NONE:   "none",
+	COMPRESSION_SNAPPY: "snappy",
+	COMPRESSION_ZLIB:   "zlib",
+	COMPRESSION_LZ4:    "lz4",
+	COMPRESSION_LZ4HC:  "lz4hc",
+	COMPRESSION_ZSTD:   "zstd",
+}
+
+// Metadata is the trailer of a MTBL file, which describes its contents
+type Metadata struct {
+	FileVersion          int
+	IndexBlockOffset     uint64
+	DataBlockSize        uint64
+	CompressionAlgorithm uint64
+	CountEntries         uint64
+	CountDataBlocks      uint64
+	BytesDataBlocks      uint64
+	BytesIndexBlock      uint64
+	BytesKeys            uint64
+	BytesValues          uint64
+}
+
+// CompressionName returns the name of the compression algorithm
+func (m *Metadata) CompressionName() string {
+	if name, ok := CompressionNames[m.CompressionAlgorithm]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown (%d)", m.CompressionAlgorithm)
+}
+
+// ParseMetadata decodes a metadata trailer of METADATA_SIZE bytes
+func ParseMetadata(buf []byte) (*Metadata, error) {
+	if len(buf) != METADATA_SIZE {
+		return nil, fmt.Errorf("invalid metadata size %d", len(buf))
+	}
+
+	m := &Metadata{}
+	switch binary.LittleEndian.Uint32(buf[METADATA_SIZE-4:]) {
+	case MAGIC:
+		m.FileVersion = FORMAT_V2
+	case MAGIC_V1:
+		m.FileVersion = FORMAT_V1
+	default:
+		return nil, fmt.Errorf("not a MTBL file (bad magic)")
+	}
+
+	fields := []*uint64{
+		&m.IndexBlockOffset,
+		&m.DataBlockSize,
+		&m.CompressionAlgorithm,
+		&m.CountEntries,
+		&m.CountDataBlocks,
+		&m.BytesDataBlocks,
+		&m.BytesIndexBlock,
+		&m.BytesKeys,
+		&m.BytesValues,
+	}
+	for i, f := range fields {
+		*f = binary.LittleEndian.Uint64(buf[i*8:])
+	}
+
+	return m, nil
+}
+
+// Bytes encodes the metadata as a trailer of METADATA_SIZE bytes
+func (m *Metadata) Bytes() []byte {
+	buf := make([]byte, METADATA_SIZE)
+
+	fields := []uint64{
+		m.IndexBlockOffset,
+		m.DataBlockSize,
+		m.CompressionAlgorithm,
+		m.CountEntries,
+		m.CountDataBlocks,
+		m.BytesDataBlocks,
+		m.BytesIndexBlock,
+		m.BytesKeys,
+		m.BytesValues,
+	}
+	for i, f := range fields {
+		binary.LittleEndian.PutUint64(buf[i*8:], f)
+	}
+
+	magic := uint32(MAGIC)
+	if m.FileVersion == FORMAT_V1 {
+		magic = MAGIC_V1
+	}
+	binary.LittleEndian.PutUint32(buf[METADATA_SIZE-4:], magic)
+	return buf
+}
@@ -0,0 +1,100 @@
+package mtblfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Iter walks the entries of a file in key order
+type Iter struct {
+	r     *Reader
+	index *blockIter
+	block *blockIter
+	start []byte
+	err   error
+}
+
+// Iter returns an iterator over the entries with keys greater than or equal to
+// start, or over every entry if start is empty
+func (r *Reader) Iter(start []byte) *Iter {
+	it := &Iter{r: r, index: r.index.iter(), start: start}
+	if len(start) > 0 {
+		it.index.seek(start)
+		it.err = it.index.err
+	}
+	return it
+}
+
+// Move to the next data block, positioned at the first key that is not less
+// than the start key
+func (it *Iter) nextBlock() bool {
+	for it.index.next() {
+		// The index key is at least the last key of its block
+		if len(it.start) > 0 && bytes.Compare(it.index.key, it.start) < 0 {
+			continue
+		}
+
+		off, n := binary.Uvarint(it.index.val)
+		if n <= 0 {
+			it.err = fmt.Errorf("invalid index entry %q", it.index.key)
+			return false
+		}
+
+		b, _, e := it.r.readBlock(off)
+		if e != nil {
+			it.err = e
+			return false
+		}
+
+		it.block = b.iter()
+		if len(it.start) > 0 {
+			it.block.seek(it.start)
+		}
+		return true
+	}
+	it.err = it.index.err
+	return false
+}
+
+// Next returns the next key and value. The key is only valid until the next
+// call, while the value is not modified.
+func (it *Iter) Next() ([]byte, []byte, bool) {
+	for it.err == nil {
+		if it.block == nil && !it.nextBlock() {
+			return nil, nil, false
+		}
+
+		if !it.block.next() {
+			if it.err = it.block.err; it.err == nil {
+				it.block = nil
+			}
+			continue
+		}
+
+		if len(it.start) > 0 {
+			if bytes.Compare(it.block.key, it.start) < 0 {
+				continue
+			}
+			// Every later key is greater
+			it.start = nil
+		}
+		return it.block.key, it.block.val, true
+	}
+	return nil, nil, false
+}
+
+// Err returns the error that ended the iteration, if any
+func (it *Iter) Err() error {
+	return it.err
+}
+
+// Get returns the value of a key
+func (r *Reader) Get(key []byte) ([]byte, bool, error) {
+	it := r.Iter(key)
+	k, v, ok := it.Next()
+	if !ok || !bytes.Equal(k, key) {
+		return nil, false, it.Err()
+	}
+	return v, true, nil
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package mtblfile
+
+import (
+	"io"
+	"os"
+)
+
+// Platforms without mmap read the file directly
+func mmapFile(f *os.File) (io.ReaderAt, func() error, error) {
+	return f, func() error { return nil }, nil
+}
@@ -0,0 +1,30 @@
+//go:build unix
+
+package mtblfile
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"syscall"
+)
+
+// Map a file read-only into memory, returning a reader of the mapping and a
+// function that unmaps it
+func mmapFile(f *os.File) (io.ReaderAt, func() error, error) {
+	info, e := f.Stat()
+	if e != nil {
+		return nil, nil, e
+	}
+
+	// Empty files can not be mapped, and are rejected by newReader anyway
+	if info.Size() == 0 {
+		return f, func() error { return nil }, nil
+	}
+
+	data, e := syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if e != nil {
+		return nil, nil, e
+	}
+	return bytes.NewReader(data), func() error { return syscall.Munmap(data) }, nil
+}
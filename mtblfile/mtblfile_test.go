@@ -0,0 +1,253 @@
+package mtblfile
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+type entry struct {
+	key []byte
+	val []byte
+}
+
+// Entries with shared key prefixes, in key order
+func testEntries(n int) []entry {
+	entries := []entry{}
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("com.example.%05d", i*2)
+		val := fmt.Sprintf("192.0.2.%d,%s", i%256, bytes.Repeat([]byte{'v'}, i%40))
+		entries = append(entries, entry{[]byte(key), []byte(val)})
+	}
+	return entries
+}
+
+func writeFile(t *testing.T, path string, opt WriterOptions, entries []entry) {
+	w, e := Create(path, opt)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, ent := range entries {
+		if e := w.Add(ent.key, ent.val); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := w.Close(); e != nil {
+		t.Fatal(e)
+	}
+}
+
+// Check that an iterator returns the entries, in order, and nothing else
+func checkIter(t *testing.T, it *Iter, want []entry) {
+	t.Helper()
+	i := 0
+	for {
+		k, v, ok := it.Next()
+		if !ok {
+			break
+		}
+		if i >= len(want) {
+			t.Fatalf("unexpected entry %q after %d entries", k, len(want))
+		}
+		if !bytes.Equal(k, want[i].key) || !bytes.Equal(v, want[i].val) {
+			t.Fatalf("entry %d is %q = %q, want %q = %q", i, k, v, want[i].key, want[i].val)
+		}
+		i++
+	}
+	if e := it.Err(); e != nil {
+		t.Fatal(e)
+	}
+	if i != len(want) {
+		t.Fatalf("got %d entries, want %d", i, len(want))
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	entries := testEntries(3000)
+
+	for algorithm, name := range CompressionNames {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name+".mtbl")
+			writeFile(t, path, WriterOptions{Compression: algorithm, BlockSize: 1024}, entries)
+
+			for _, open := range []func(string, bool) (*Reader, error){Open, OpenMmap} {
+				r, e := open(path, true)
+				if e != nil {
+					t.Fatal(e)
+				}
+
+				m := r.Metadata
+				if m.FileVersion != FORMAT_V2 || m.CompressionAlgorithm != algorithm || m.CountEntries != uint64(len(entries)) {
+					t.Errorf("metadata is version %d, %s, %d entries", m.FileVersion, m.CompressionName(), m.CountEntries)
+				}
+				if m.CountDataBlocks < 2 {
+					t.Errorf("wrote %d data blocks, want several", m.CountDataBlocks)
+				}
+
+				checkIter(t, r.Iter(nil), entries)
+
+				s, e := r.Verify()
+				if e != nil {
+					t.Fatal(e)
+				}
+				if s.Entries != uint64(len(entries)) || s.DataBlocks != m.CountDataBlocks {
+					t.Errorf("verified %d entries in %d blocks", s.Entries, s.DataBlocks)
+				}
+
+				first, last, e := r.KeyRange()
+				if e != nil {
+					t.Fatal(e)
+				}
+				if !bytes.Equal(first, entries[0].key) || !bytes.Equal(last, entries[len(entries)-1].key) {
+					t.Errorf("key range is %q to %q", first, last)
+				}
+
+				r.Close()
+			}
+		})
+	}
+}
+
+func TestGet(t *testing.T) {
+	entries := testEntries(1000)
+	path := filepath.Join(t.TempDir(), "get.mtbl")
+	writeFile(t, path, WriterOptions{Compression: COMPRESSION_SNAPPY, BlockSize: 512}, entries)
+
+	r, e := Open(path, true)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer r.Close()
+
+	for _, ent := range entries {
+		v, ok, e := r.Get(ent.key)
+		if e != nil || !ok || !bytes.Equal(v, ent.val) {
+			t.Fatalf("Get(%q) = %q, %v, %v", ent.key, v, ok, e)
+		}
+	}
+
+	// Odd numbers fall between the keys
+	for _, key := range []string{"a", "com.example.00001", "com.example.00999", "com.example.99999", "z"} {
+		if v, ok, e := r.Get([]byte(key)); ok || e != nil {
+			t.Errorf("Get(%q) = %q, %v, %v, want no entry", key, v, ok, e)
+		}
+	}
+}
+
+func TestIterStart(t *testing.T) {
+	entries := testEntries(1000)
+	path := filepath.Join(t.TempDir(), "iter.mtbl")
+	writeFile(t, path, WriterOptions{Compression: COMPRESSION_NONE, BlockSize: 512, BlockRestartInterval: 4}, entries)
+
+	r, e := Open(path, true)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer r.Close()
+
+	for _, start := range []string{"", "a", "com.example.00000", "com.example.00001", "com.example.00500", "com.example.00501", "com.example.01998", "com.example.01999", "z"} {
+		i := sort.Search(len(entries), func(i int) bool { return bytes.Compare(entries[i].key, []byte(start)) >= 0 })
+		t.Run(start, func(t *testing.T) {
+			checkIter(t, r.Iter([]byte(start)), entries[i:])
+		})
+	}
+}
+
+func TestWriterOrder(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "order.mtbl")
+
+	w, e := Create(path, WriterOptions{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e := w.Add([]byte("b"), []byte("1")); e != nil {
+		t.Fatal(e)
+	}
+	if e := w.Add([]byte("b"), []byte("2")); e == nil {
+		t.Error("a duplicate key was added")
+	}
+	if e := w.Add([]byte("a"), []byte("3")); e == nil {
+		t.Error("a key less than the previous key was added")
+	}
+	if e := w.Close(); e != nil {
+		t.Fatal(e)
+	}
+
+	if _, e := Create(path, WriterOptions{}); e == nil {
+		t.Error("Create replaced an existing file")
+	}
+	if _, e := Create(filepath.Join(dir, "bad.mtbl"), WriterOptions{Compression: 99}); e == nil {
+		t.Error("Create accepted an unknown compression algorithm")
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.mtbl")
+	writeFile(t, path, WriterOptions{}, nil)
+
+	r, e := Open(path, true)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer r.Close()
+
+	checkIter(t, r.Iter(nil), nil)
+	if _, e := r.Verify(); e != nil {
+		t.Error(e)
+	}
+	if first, last, e := r.KeyRange(); first != nil || last != nil || e != nil {
+		t.Errorf("key range of an empty file is %q to %q, %v", first, last, e)
+	}
+}
+
+// The entries of the testdata files, see testdata/README
+func libmtblEntries() []entry {
+	entries := []entry{}
+	for i := 0; i < 100; i++ {
+		entries = append(entries, entry{[]byte(fmt.Sprintf("com.example.%03d", i*3)), []byte(fmt.Sprintf("192.0.2.%d", i))})
+	}
+	return append(entries, entry{[]byte("com.example.\xff\xff"), []byte("last")})
+}
+
+// Files laid out by libmtbl have index keys that are separators between the
+// blocks rather than their last keys, and a final index key past the last key
+func TestLibmtblLayout(t *testing.T) {
+	entries := libmtblEntries()
+
+	for _, name := range []string{"libmtbl-layout-none.mtbl", "libmtbl-layout-zlib.mtbl"} {
+		t.Run(name, func(t *testing.T) {
+			r, e := Open(filepath.Join("testdata", name), true)
+			if e != nil {
+				t.Fatal(e)
+			}
+			defer r.Close()
+
+			if r.Metadata.CountDataBlocks < 2 {
+				t.Errorf("the file has %d data blocks, want several", r.Metadata.CountDataBlocks)
+			}
+
+			checkIter(t, r.Iter(nil), entries)
+
+			if _, e := r.Verify(); e != nil {
+				t.Error(e)
+			}
+
+			for _, ent := range entries {
+				if v, ok, e := r.Get(ent.key); e != nil || !ok || !bytes.Equal(v, ent.val) {
+					t.Errorf("Get(%q) = %q, %v, %v", ent.key, v, ok, e)
+				}
+			}
+
+			// Every start key, including the separators of the index, which
+			// are not keys of the file
+			for i := 0; i < 300; i++ {
+				start := []byte(fmt.Sprintf("com.example.%03d", i))
+				j := sort.Search(len(entries), func(j int) bool { return bytes.Compare(entries[j].key, start) >= 0 })
+				checkIter(t, r.Iter(start), entries[j:])
+			}
+		})
+	}
+}
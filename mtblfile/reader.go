@@ -0,0 +1,185 @@
+package mtblfile
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// Reader reads a MTBL file. It is safe for concurrent use.
+type Reader struct {
+	Metadata *Metadata
+
+	f      *os.File
+	src    io.ReaderAt
+	unmap  func() error
+	size   uint64
+	verify bool
+	index  *block
+}
+
+// Open reads the metadata and index of a MTBL file. With verify, the
+// checksum of every block is checked as it is read.
+func Open(path string, verify bool) (*Reader, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+
+	r, e := newReader(f, f, verify)
+	if e != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", path, e)
+	}
+	return r, nil
+}
+
+// OpenMmap opens a MTBL file like Open, but maps it into memory, so that
+// reads are served from the page cache without a system call. On platforms
+// without mmap, the file is read normally.
+func OpenMmap(path string, verify bool) (*Reader, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+
+	src, unmap, e := mmapFile(f)
+	if e != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", path, e)
+	}
+
+	r, e := newReader(f, src, verify)
+	if e != nil {
+		unmap()
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", path, e)
+	}
+	r.unmap = unmap
+	return r, nil
+}
+
+func newReader(f *os.File, src io.ReaderAt, verify bool) (*Reader, error) {
+	info, e := f.Stat()
+	if e != nil {
+		return nil, e
+	}
+
+	r := &Reader{f: f, src: src, size: uint64(info.Size()), verify: verify}
+	if r.size < METADATA_SIZE {
+		return nil, fmt.Errorf("file is too small (%d bytes)", r.size)
+	}
+
+	buf := make([]byte, METADATA_SIZE)
+	if _, e := src.ReadAt(buf, int64(r.size-METADATA_SIZE)); e != nil {
+		return nil, e
+	}
+
+	if r.Metadata, e = ParseMetadata(buf); e != nil {
+		return nil, e
+	}
+
+	if r.Metadata.IndexBlockOffset >= r.size-METADATA_SIZE {
+		return nil, fmt.Errorf("invalid index block offset %d", r.Metadata.IndexBlockOffset)
+	}
+
+	// The index block is never compressed
+	data, _, e := r.readRaw(r.Metadata.IndexBlockOffset, r.verify)
+	if e != nil {
+		return nil, fmt.Errorf("index block: %s", e)
+	}
+	if r.index, e = newBlock(data); e != nil {
+		return nil, fmt.Errorf("index block: %s", e)
+	}
+	return r, nil
+}
+
+// Close unmaps and closes the file
+func (r *Reader) Close() error {
+	if r.unmap != nil {
+		r.unmap()
+	}
+	return r.f.Close()
+}
+
+// Size returns the size of the file in bytes
+func (r *Reader) Size() uint64 {
+	return r.size
+}
+
+// Read the length prefix, checksum, and contents of the block at an offset,
+// returning the contents and the offset of the next block. The checksum is
+// checked with verify.
+func (r *Reader) readRaw(off uint64, verify bool) ([]byte, uint64, error) {
+	end := r.size - METADATA_SIZE
+
+	var hdr [binary.MaxVarintLen64 + 4]byte
+	n, e := r.src.ReadAt(hdr[:], int64(off))
+	if e != nil && e != io.EOF {
+		return nil, 0, e
+	}
+
+	var size uint64
+	var len_len int
+	if r.Metadata.FileVersion == FORMAT_V1 {
+		if n < 8 {
+			return nil, 0, fmt.Errorf("truncated block at offset %d", off)
+		}
+		size, len_len = uint64(binary.LittleEndian.Uint32(hdr[:])), 4
+	} else {
+		size, len_len = binary.Uvarint(hdr[:n])
+		if len_len <= 0 || n < len_len+4 {
+			return nil, 0, fmt.Errorf("invalid block length at offset %d", off)
+		}
+	}
+
+	start := off + uint64(len_len) + 4
+	if start > end || size > end-start {
+		return nil, 0, fmt.Errorf("block at offset %d overruns the file", off)
+	}
+
+	data := make([]byte, size)
+	if _, e := r.src.ReadAt(data, int64(start)); e != nil {
+		return nil, 0, e
+	}
+
+	if verify {
+		if crc32.Checksum(data, crc32c) != binary.LittleEndian.Uint32(hdr[len_len:]) {
+			return nil, 0, fmt.Errorf("checksum mismatch in block at offset %d", off)
+		}
+	}
+
+	return data, start + size, nil
+}
+
+// Read and decompress the data block at an offset
+func (r *Reader) readBlock(off uint64) (*block, uint64, error) {
+	data, next, e := r.readRaw(off, r.verify)
+	if e != nil {
+		return nil, 0, e
+	}
+
+	b, e := r.decodeBlock(data, off)
+	if e != nil {
+		return nil, 0, e
+	}
+	return b, next, nil
+}
+
+// Decompress and decode the contents of the data block at an offset
+func (r *Reader) decodeBlock(data []byte, off uint64) (*block, error) {
+	data, e := decompress(r.Metadata.CompressionAlgorithm, data)
+	if e != nil {
+		return nil, fmt.Errorf("block at offset %d: %s", off, e)
+	}
+
+	b, e := newBlock(data)
+	if e != nil {
+		return nil, fmt.Errorf("block at offset %d: %s", off, e)
+	}
+	return b, nil
+}
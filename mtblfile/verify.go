@@ -0,0 +1,174 @@
+package mtblfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Stats describes the data blocks of a file, as found by Verify
+type Stats struct {
+	Entries     uint64
+	DataBlocks  uint64
+	BytesKeys   uint64
+	BytesValues uint64
+
+	// The stored and uncompressed sizes of the data blocks
+	MinStoredBlock       uint64
+	MaxStoredBlock       uint64
+	MinUncompressedBlock uint64
+	MaxUncompressedBlock uint64
+	BytesUncompressed    uint64
+
+	FirstKey []byte
+	LastKey  []byte
+}
+
+// KeyRange returns the first and last keys of the file from the first and
+// last data blocks, without reading the others
+func (r *Reader) KeyRange() ([]byte, []byte, error) {
+	if r.Metadata.CountEntries == 0 || len(r.index.restarts) == 0 {
+		return nil, nil, nil
+	}
+
+	b, _, e := r.readBlock(0)
+	if e != nil {
+		return nil, nil, e
+	}
+	it := b.iter()
+	if !it.next() {
+		return nil, nil, fmt.Errorf("empty first data block")
+	}
+	first := append([]byte{}, it.key...)
+
+	// The last index entry holds the offset of the last data block
+	idx := r.index.iter()
+	idx.off = r.index.restarts[len(r.index.restarts)-1]
+	var off uint64
+	for idx.next() {
+		off, _ = binary.Uvarint(idx.val)
+	}
+	if idx.err != nil {
+		return nil, nil, idx.err
+	}
+
+	if b, _, e = r.readBlock(off); e != nil {
+		return nil, nil, e
+	}
+	it = b.iter()
+	for it.next() {
+	}
+	if it.err != nil {
+		return nil, nil, it.err
+	}
+	return first, append([]byte{}, it.key...), nil
+}
+
+// Verify reads every data block, checking the block checksums and that the
+// keys are unique and in order, and that the blocks agree with the index and
+// the metadata. The statistics of the blocks read are returned with the
+// first problem found.
+func (r *Reader) Verify() (*Stats, error) {
+	s := &Stats{}
+	m := r.Metadata
+
+	if _, _, e := r.readRaw(m.IndexBlockOffset, true); e != nil {
+		return s, fmt.Errorf("index block: %s", e)
+	}
+
+	idx := r.index.iter()
+
+	var off uint64
+	var prev []byte
+	for off < m.IndexBlockOffset {
+		raw, next, e := r.readRaw(off, true)
+		if e != nil {
+			return s, e
+		}
+
+		b, e := r.decodeBlock(raw, off)
+		if e != nil {
+			return s, e
+		}
+
+		s.DataBlocks++
+		stored, size := uint64(len(raw)), b.size
+		if s.DataBlocks == 1 || stored < s.MinStoredBlock {
+			s.MinStoredBlock = stored
+		}
+		if stored > s.MaxStoredBlock {
+			s.MaxStoredBlock = stored
+		}
+		if s.DataBlocks == 1 || size < s.MinUncompressedBlock {
+			s.MinUncompressedBlock = size
+		}
+		if size > s.MaxUncompressedBlock {
+			s.MaxUncompressedBlock = size
+		}
+		s.BytesUncompressed += size
+
+		it := b.iter()
+		for it.next() {
+			if prev != nil && bytes.Compare(it.key, prev) <= 0 {
+				return s, fmt.Errorf("key %q in block at offset %d is not greater than the previous key %q", it.key, off, prev)
+			}
+			if s.FirstKey == nil {
+				s.FirstKey = append([]byte{}, it.key...)
+			}
+			prev = append(prev[:0], it.key...)
+
+			s.Entries++
+			s.BytesKeys += uint64(len(it.key))
+			s.BytesValues += uint64(len(it.val))
+		}
+		if it.err != nil {
+			return s, fmt.Errorf("block at offset %d: %s", off, it.err)
+		}
+
+		// Each data block has an index entry with its offset and a key that is
+		// at least its last key
+		if !idx.next() {
+			if idx.err != nil {
+				return s, fmt.Errorf("index block: %s", idx.err)
+			}
+			return s, fmt.Errorf("block at offset %d has no index entry", off)
+		}
+		if ioff, _ := binary.Uvarint(idx.val); ioff != off {
+			return s, fmt.Errorf("index entry %q points to offset %d instead of %d", idx.key, ioff, off)
+		}
+		if prev != nil && bytes.Compare(idx.key, prev) < 0 {
+			return s, fmt.Errorf("index entry %q is less than the last key %q of its block", idx.key, prev)
+		}
+
+		off = next
+	}
+
+	if prev != nil {
+		s.LastKey = append([]byte{}, prev...)
+	}
+
+	if off != m.IndexBlockOffset {
+		return s, fmt.Errorf("the data blocks end at offset %d instead of the index at %d", off, m.IndexBlockOffset)
+	}
+	if idx.next() {
+		return s, fmt.Errorf("index entry %q has no data block", idx.key)
+	}
+
+	counts := []struct {
+		name  string
+		meta  uint64
+		found uint64
+	}{
+		{"entries", m.CountEntries, s.Entries},
+		{"data blocks", m.CountDataBlocks, s.DataBlocks},
+		{"key bytes", m.BytesKeys, s.BytesKeys},
+		{"value bytes", m.BytesValues, s.BytesValues},
+	}
+	for _, c := range counts {
+		if c.meta != c.found {
+			return s, fmt.Errorf("the metadata has %d %s, but %d were found", c.meta, c.name, c.found)
+		}
+	}
+
+	return s, nil
+}
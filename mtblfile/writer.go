@@ -0,0 +1,268 @@
+package mtblfile
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"hash/crc32"
+	"os"
+)
+
+// The defaults of libmtbl for the data block size and the number of entries
+// between restart points
+const DEFAULT_BLOCK_SIZE = 8192
+const DEFAULT_BLOCK_RESTART_INTERVAL = 16
+
+// WriterOptions are the options of a new file
+type WriterOptions struct {
+	Compression          uint64
+	BlockSize            uint64
+	BlockRestartInterval uint64
+}
+
+// Writer writes a MTBL file. Keys must be added in strictly increasing order.
+type Writer struct {
+	f   *os.File
+	w   *bufio.Writer
+	opt WriterOptions
+	m   Metadata
+
+	data     *blockBuilder
+	index    *blockBuilder
+	last_key []byte
+	offset   uint64
+	zstd     *zstd.Encoder
+}
+
+// Create starts a new MTBL file. Like libmtbl, it fails if the file exists.
+func Create(path string, opt WriterOptions) (*Writer, error) {
+	if _, ok := CompressionNames[opt.Compression]; !ok {
+		return nil, fmt.Errorf("unknown compression algorithm %d", opt.Compression)
+	}
+	if opt.BlockSize == 0 {
+		opt.BlockSize = DEFAULT_BLOCK_SIZE
+	}
+	if opt.BlockRestartInterval == 0 {
+		opt.BlockRestartInterval = DEFAULT_BLOCK_RESTART_INTERVAL
+	}
+
+	f, e := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if e != nil {
+		return nil, e
+	}
+
+	w := &Writer{
+		f:     f,
+		w:     bufio.NewWriterSize(f, 1024*1024),
+		opt:   opt,
+		data:  newBlockBuilder(opt.BlockRestartInterval),
+		index: newBlockBuilder(1),
+		m: Metadata{
+			FileVersion:          FORMAT_V2,
+			DataBlockSize:        opt.BlockSize,
+			CompressionAlgorithm: opt.Compression,
+		},
+	}
+
+	if opt.Compression == COMPRESSION_ZSTD {
+		if w.zstd, e = zstd.NewWriter(nil); e != nil {
+			f.Close()
+			return nil, e
+		}
+	}
+	return w, nil
+}
+
+// Add a key and value, which must sort after the previous key
+func (w *Writer) Add(key []byte, val []byte) error {
+	if w.m.CountEntries > 0 && bytes.Compare(key, w.last_key) <= 0 {
+		return fmt.Errorf("key %q is not greater than the previous key %q", key, w.last_key)
+	}
+
+	w.data.add(key, val)
+	w.last_key = append(w.last_key[:0], key...)
+
+	w.m.CountEntries++
+	w.m.BytesKeys += uint64(len(key))
+	w.m.BytesValues += uint64(len(val))
+
+	if uint64(w.data.size()) >= w.opt.BlockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+// Write the pending data block and add its last key and offset to the index
+func (w *Writer) flushBlock() error {
+	if w.data.empty() {
+		return nil
+	}
+
+	stored, e := w.compress(w.data.finish())
+	if e != nil {
+		return e
+	}
+
+	off := w.offset
+	if e := w.writeRaw(stored); e != nil {
+		return e
+	}
+
+	w.index.add(w.last_key, binary.AppendUvarint(nil, off))
+	w.data.reset()
+	w.m.CountDataBlocks++
+	return nil
+}
+
+// Write a block with its length prefix and checksum
+func (w *Writer) writeRaw(data []byte) error {
+	hdr := binary.AppendUvarint(nil, uint64(len(data)))
+	hdr = binary.LittleEndian.AppendUint32(hdr, crc32.Checksum(data, crc32c))
+
+	if _, e := w.w.Write(hdr); e != nil {
+		return e
+	}
+	if _, e := w.w.Write(data); e != nil {
+		return e
+	}
+	w.offset += uint64(len(hdr) + len(data))
+	return nil
+}
+
+// Compress the contents of a data block, see decompress
+func (w *Writer) compress(data []byte) ([]byte, error) {
+	switch w.opt.Compression {
+	case COMPRESSION_SNAPPY:
+		return snappy.Encode(nil, data), nil
+
+	case COMPRESSION_ZLIB:
+		var b bytes.Buffer
+		z := zlib.NewWriter(&b)
+		if _, e := z.Write(data); e != nil {
+			return nil, e
+		}
+		if e := z.Close(); e != nil {
+			return nil, e
+		}
+		return b.Bytes(), nil
+
+	case COMPRESSION_LZ4, COMPRESSION_LZ4HC:
+		out := make([]byte, 4+lz4.CompressBlockBound(len(data)))
+		binary.LittleEndian.PutUint32(out, uint32(len(data)))
+
+		var n int
+		var e error
+		if w.opt.Compression == COMPRESSION_LZ4HC {
+			n, e = lz4.CompressBlockHC(data, out[4:], lz4.Level9, nil, nil)
+		} else {
+			n, e = lz4.CompressBlock(data, out[4:], nil)
+		}
+		if e != nil {
+			return nil, e
+		}
+		return out[:4+n], nil
+
+	case COMPRESSION_ZSTD:
+		return w.zstd.EncodeAll(data, nil), nil
+	}
+
+	// Uncompressed blocks are copied, since the builder buffer is reused
+	return append([]byte{}, data...), nil
+}
+
+// Close writes the last data block, the index, and the metadata, and closes
+// the file
+func (w *Writer) Close() error {
+	e := w.flushBlock()
+
+	if e == nil {
+		w.m.IndexBlockOffset = w.offset
+		w.m.BytesDataBlocks = w.offset
+
+		index := w.index.finish()
+		w.m.BytesIndexBlock = uint64(len(index))
+		e = w.writeRaw(index)
+	}
+
+	if e == nil {
+		_, e = w.w.Write(w.m.Bytes())
+	}
+	if e == nil {
+		e = w.w.Flush()
+	}
+
+	if w.zstd != nil {
+		w.zstd.Close()
+	}
+	if ce := w.f.Close(); e == nil {
+		e = ce
+	}
+	return e
+}
+
+// Builds a block of prefix-compressed entries, see block
+type blockBuilder struct {
+	buf      []byte
+	restarts []uint32
+	interval uint64
+	count    uint64
+	last     []byte
+}
+
+func newBlockBuilder(interval uint64) *blockBuilder {
+	return &blockBuilder{interval: interval}
+}
+
+func (b *blockBuilder) empty() bool {
+	return b.count == 0
+}
+
+// The size of the finished block
+func (b *blockBuilder) size() int {
+	return len(b.buf) + 4*len(b.restarts) + 4
+}
+
+func (b *blockBuilder) add(key []byte, val []byte) {
+	shared := 0
+	if b.count%b.interval == 0 {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+	} else {
+		for shared < len(b.last) && shared < len(key) && b.last[shared] == key[shared] {
+			shared++
+		}
+	}
+
+	b.buf = binary.AppendUvarint(b.buf, uint64(shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(key)-shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(val)))
+	b.buf = append(b.buf, key[shared:]...)
+	b.buf = append(b.buf, val...)
+
+	b.last = append(b.last[:0], key...)
+	b.count++
+}
+
+// Append the restart array and return the block, which is only valid until
+// the next reset
+func (b *blockBuilder) finish() []byte {
+	if len(b.restarts) == 0 {
+		b.restarts = append(b.restarts, 0)
+	}
+	for _, r := range b.restarts {
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, r)
+	}
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(b.restarts)))
+	return b.buf
+}
+
+func (b *blockBuilder) reset() {
+	b.buf = b.buf[:0]
+	b.restarts = b.restarts[:0]
+	b.last = b.last[:0]
+	b.count = 0
+}
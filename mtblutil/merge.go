@@ -0,0 +1,247 @@
+// Package mtblutil provides the merge functions and the k-way merge of sorted
+// sources used by the inetdata MTBL tools. It does not depend on libmtbl; merge
+// functions are converted to mtbl.MergeFunc for use with mtbl.SorterOptions.
+package mtblutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers/rollup"
+	"github.com/peterbourgon/mergemap"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Warnf reports values that can not be merged. It writes to stderr, and the
+// tools replace it with their logger.
+var Warnf = func(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "[-] "+format+"\n", args...)
+}
+
+// MergeFunc combines two values of the same key
+type MergeFunc func(key []byte, val0 []byte, val1 []byte) []byte
+
+// MergeFirst keeps the first value
+func MergeFirst(key []byte, val0 []byte, val1 []byte) []byte {
+	return val0
+}
+
+// MergeLast keeps the last value
+func MergeLast(key []byte, val0 []byte, val1 []byte) []byte {
+	return val1
+}
+
+// MergeSpace joins the values with a space
+func MergeSpace(key []byte, val0 []byte, val1 []byte) []byte {
+	return []byte(string(val0) + " " + string(val1))
+}
+
+// MergeCount adds values that are decimal counts
+func MergeCount(key []byte, val0 []byte, val1 []byte) []byte {
+	c0, _ := strconv.ParseUint(string(val0), 10, 64)
+	c1, _ := strconv.ParseUint(string(val1), 10, 64)
+	return []byte(strconv.FormatUint(c0+c1, 10))
+}
+
+// MergeJSONArrays combines values that are JSON arrays of string arrays, such
+// as [["type","value"]], keeping the unique arrays. If either value is not
+// valid, the other value is kept.
+func MergeJSONArrays(key []byte, val0 []byte, val1 []byte) []byte {
+	var unique = make(map[string]bool)
+	var v0, v1, m [][]string
+
+	if e := json.Unmarshal(val0, &v0); e != nil {
+		return val1
+	}
+
+	if e := json.Unmarshal(val1, &v1); e != nil {
+		return val0
+	}
+
+	for i := range v0 {
+		if len(v0[i]) == 0 {
+			continue
+		}
+		unique[strings.Join(v0[i], "\x00")] = true
+	}
+
+	for i := range v1 {
+		if len(v1[i]) == 0 {
+			continue
+		}
+		unique[strings.Join(v1[i], "\x00")] = true
+	}
+
+	for i := range unique {
+		m = append(m, strings.SplitN(i, "\x00", 2))
+	}
+
+	d, e := json.Marshal(m)
+	if e != nil {
+		Warnf("JSON merge error: %v -> %v + %v", e, val0, val1)
+		return val0
+	}
+
+	return d
+}
+
+// MergeTimestampedArrays returns a merge function like MergeJSONArrays for
+// arrays whose last element is a timestamp when timestamped is set. Arrays are
+// then unique by their other elements, and the most recent timestamp is kept.
+func MergeTimestampedArrays(timestamped bool) MergeFunc {
+	return func(key []byte, val0 []byte, val1 []byte) []byte {
+		var v0, v1, m [][]string
+
+		if e := json.Unmarshal(val0, &v0); e != nil {
+			return val1
+		}
+
+		if e := json.Unmarshal(val1, &v1); e != nil {
+			return val0
+		}
+
+		unique := make(map[string][]string)
+		for _, v := range append(v0, v1...) {
+			if len(v) == 0 {
+				continue
+			}
+
+			id := v
+			if timestamped && len(v) > 1 {
+				id = v[:len(v)-1]
+			}
+			k := strings.Join(id, "\x00")
+
+			if prev, ok := unique[k]; ok && prev[len(prev)-1] >= v[len(v)-1] {
+				continue
+			}
+			unique[k] = v
+		}
+
+		for _, v := range unique {
+			m = append(m, v)
+		}
+
+		d, e := json.Marshal(m)
+		if e != nil {
+			Warnf("JSON merge error: %v -> %v + %v", e, val0, val1)
+			return val0
+		}
+
+		return d
+	}
+}
+
+// MergeSeenArrays combines values like MergeJSONArrays for arrays whose last
+// two elements are the first-seen and last-seen timestamps of the others, as
+// written by dns2mtbl -timestamps. Arrays are unique by their other elements,
+// and the earliest first-seen and latest last-seen timestamps are kept.
+func MergeSeenArrays(key []byte, val0 []byte, val1 []byte) []byte {
+	var v0, v1, m [][]string
+
+	if e := json.Unmarshal(val0, &v0); e != nil {
+		return val1
+	}
+
+	if e := json.Unmarshal(val1, &v1); e != nil {
+		return val0
+	}
+
+	unique := make(map[string][]string)
+	order := []string{}
+	for _, v := range append(v0, v1...) {
+		if len(v) < 3 {
+			continue
+		}
+
+		k := strings.Join(v[:len(v)-2], "\x00")
+		prev, ok := unique[k]
+		if !ok {
+			unique[k] = append([]string{}, v...)
+			order = append(order, k)
+			continue
+		}
+
+		seen := rollup.Seen{First: prev[len(prev)-2], Last: prev[len(prev)-1]}
+		seen.Add(v[len(v)-2])
+		seen.Add(v[len(v)-1])
+		prev[len(prev)-2], prev[len(prev)-1] = seen.First, seen.Last
+	}
+
+	for _, k := range order {
+		m = append(m, unique[k])
+	}
+
+	d, e := json.Marshal(m)
+	if e != nil {
+		Warnf("JSON merge error: %v -> %v + %v", e, val0, val1)
+		return val0
+	}
+
+	return d
+}
+
+// NewSeenArrays returns the arrays of val1 whose elements other than the
+// first-seen and last-seen timestamps are not in val0, see MergeSeenArrays.
+// False is returned if there are none or val1 is not valid.
+func NewSeenArrays(val0 []byte, val1 []byte) ([]byte, bool) {
+	var v0, v1, m [][]string
+
+	if e := json.Unmarshal(val1, &v1); e != nil {
+		return nil, false
+	}
+
+	// An invalid previous value is replaced by the merge, so all values are new
+	if e := json.Unmarshal(val0, &v0); e != nil {
+		v0 = nil
+	}
+
+	known := make(map[string]bool)
+	for _, v := range v0 {
+		if len(v) >= 3 {
+			known[strings.Join(v[:len(v)-2], "\x00")] = true
+		}
+	}
+
+	for _, v := range v1 {
+		if len(v) < 3 || known[strings.Join(v[:len(v)-2], "\x00")] {
+			continue
+		}
+		m = append(m, v)
+	}
+
+	if len(m) == 0 {
+		return nil, false
+	}
+
+	d, e := json.Marshal(m)
+	if e != nil {
+		return nil, false
+	}
+	return d, true
+}
+
+// MergeJSONObjects deep merges values that are JSON objects, where the fields
+// of the second value win. If either value is not valid, the other value is
+// kept.
+func MergeJSONObjects(key []byte, val0 []byte, val1 []byte) []byte {
+	var v0, v1 map[string]interface{}
+
+	if e := json.Unmarshal(val0, &v0); e != nil {
+		return val1
+	}
+
+	if e := json.Unmarshal(val1, &v1); e != nil {
+		return val0
+	}
+
+	m := mergemap.Merge(v0, v1)
+	d, e := json.Marshal(m)
+	if e != nil {
+		Warnf("JSON merge error: %v -> %v + %v", e, val0, val1)
+		return val0
+	}
+
+	return d
+}
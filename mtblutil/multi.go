@@ -0,0 +1,199 @@
+package mtblutil
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/json"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+// ValuesMergeFunc combines all the values of a key at once, in source order
+type ValuesMergeFunc func(key []byte, vals [][]byte) ([]byte, error)
+
+// Concat returns a merge function that joins the values with the separator
+func Concat(sep []byte) ValuesMergeFunc {
+	return func(key []byte, vals [][]byte) ([]byte, error) {
+		return bytes.Join(vals, sep), nil
+	}
+}
+
+// ValueTimestamp extracts a timestamp from a field of a JSON object value,
+// accepting numbers, numeric strings and RFC 3339 strings
+func ValueTimestamp(val []byte, field string) (float64, bool) {
+	var obj map[string]interface{}
+	if e := json.Unmarshal(val, &obj); e != nil {
+		return 0, false
+	}
+
+	switch ts := obj[field].(type) {
+	case float64:
+		return ts, true
+	case string:
+		if f, e := strconv.ParseFloat(ts, 64); e == nil {
+			return f, true
+		}
+		if t, e := time.Parse(time.RFC3339, ts); e == nil {
+			return float64(t.Unix()), true
+		}
+	}
+	return 0, false
+}
+
+// Newest returns a merge function that keeps the value with the highest
+// timestamp in the field, see ValueTimestamp. Later values win ties, and the
+// first value is kept if none have a timestamp.
+func Newest(field string) ValuesMergeFunc {
+	return func(key []byte, vals [][]byte) ([]byte, error) {
+		best := vals[0]
+		best_ts, best_ok := ValueTimestamp(best, field)
+
+		for _, v := range vals[1:] {
+			ts, ok := ValueTimestamp(v, field)
+			if !ok {
+				continue
+			}
+			if !best_ok || ts >= best_ts {
+				best, best_ts, best_ok = v, ts, true
+			}
+		}
+		return best, nil
+	}
+}
+
+// All returns a JSON array of the values. Values that are not valid JSON are
+// encoded as strings.
+func All(key []byte, vals [][]byte) ([]byte, error) {
+	out := make([]json.RawMessage, len(vals))
+	for i, v := range vals {
+		if json.Valid(v) {
+			out[i] = json.RawMessage(v)
+			continue
+		}
+		b, e := json.Marshal(string(v))
+		if e != nil {
+			return nil, e
+		}
+		out[i] = json.RawMessage(b)
+	}
+	return json.Marshal(out)
+}
+
+// TemplateRecord is the data passed to the template of Template
+type TemplateRecord struct {
+	Key    string
+	Values []string
+}
+
+// Template returns a merge function that renders the template with a
+// TemplateRecord
+func Template(t *template.Template) ValuesMergeFunc {
+	return func(key []byte, vals [][]byte) ([]byte, error) {
+		rec := TemplateRecord{Key: string(key), Values: make([]string, len(vals))}
+		for i, v := range vals {
+			rec.Values[i] = string(v)
+		}
+
+		var buf bytes.Buffer
+		if e := t.Execute(&buf, rec); e != nil {
+			return nil, e
+		}
+		return buf.Bytes(), nil
+	}
+}
+
+// Iterator returns key, value pairs in key order, such as an *mtbl.Iter
+type Iterator interface {
+	Next() ([]byte, []byte, bool)
+}
+
+type mergeSource struct {
+	it  Iterator
+	idx int
+	key []byte
+	val []byte
+}
+
+func (s *mergeSource) next() bool {
+	key, val, ok := s.it.Next()
+	if !ok {
+		return false
+	}
+	s.key = key
+	s.val = val
+	return true
+}
+
+type mergeHeap []*mergeSource
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	c := bytes.Compare(h[i].key, h[j].key)
+	if c == 0 {
+		// Preserve the order of sources for identical keys
+		return h[i].idx < h[j].idx
+	}
+	return c < 0
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeSource)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+// Merger performs a k-way merge of sorted sources, grouping the values of
+// identical keys
+type Merger struct {
+	h    mergeHeap
+	srcs []int
+}
+
+// NewMerger returns a merger of the iterators, whose values for identical
+// keys are returned in the order of the iterators
+func NewMerger(iters []Iterator) *Merger {
+	m := &Merger{}
+	for i := range iters {
+		src := &mergeSource{it: iters[i], idx: i}
+		if src.next() {
+			m.h = append(m.h, src)
+		}
+	}
+	heap.Init(&m.h)
+	return m
+}
+
+// Next returns the next key and the values of every source that holds it.
+// The key and values are copies, since iterators may reuse their buffers.
+func (m *Merger) Next() ([]byte, [][]byte, bool) {
+	if m.h.Len() == 0 {
+		return nil, nil, false
+	}
+
+	key := append([]byte{}, m.h[0].key...)
+	vals := [][]byte{}
+	m.srcs = m.srcs[:0]
+
+	for m.h.Len() > 0 && bytes.Equal(m.h[0].key, key) {
+		src := m.h[0]
+		vals = append(vals, append([]byte{}, src.val...))
+		m.srcs = append(m.srcs, src.idx)
+		if src.next() {
+			heap.Fix(&m.h, 0)
+		} else {
+			heap.Pop(&m.h)
+		}
+	}
+
+	return key, vals, true
+}
+
+// Sources returns the indexes of the iterators that held the key returned by
+// the last call to Next, in the order of its values
+func (m *Merger) Sources() []int {
+	return m.srcs
+}
@@ -0,0 +1,295 @@
+package inetdata
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Objects are read in chunks of this size, with up to object_workers ranged
+// requests in flight, and written in multipart uploads with parts of this size
+const object_chunk_size = 16 * 1024 * 1024
+const object_workers = 8
+const object_retries = 3
+
+// An object in S3 or GCS
+type objectStore interface {
+	size(ctx context.Context) (int64, error)
+	readRange(ctx context.Context, offset int64, length int64) ([]byte, error)
+	upload(ctx context.Context, r io.Reader) error
+}
+
+var s3_client *s3.Client
+var s3_once sync.Once
+var s3_err error
+
+var gcs_client *storage.Client
+var gcs_once sync.Once
+var gcs_err error
+
+// IsObjectURL returns true if the path names an object in S3 (s3://bucket/key)
+// or Google Cloud Storage (gs://bucket/key)
+func IsObjectURL(path string) bool {
+	return strings.HasPrefix(path, "s3://") || strings.HasPrefix(path, "gs://")
+}
+
+// Create a client for the bucket and key of an object URL. S3 credentials and
+// the region are read from the standard AWS environment and configuration
+// files, GCS credentials from the application default credentials.
+func openObject(path string) (objectStore, error) {
+	idx := strings.Index(path, "://")
+	scheme, rest := path[:idx], path[idx+3:]
+
+	bits := strings.SplitN(rest, "/", 2)
+	if len(bits) != 2 || len(bits[0]) == 0 || len(bits[1]) == 0 {
+		return nil, fmt.Errorf("invalid object URL, expected %s://bucket/key: %s", scheme, path)
+	}
+
+	if scheme == "s3" {
+		s3_once.Do(func() {
+			cfg, e := config.LoadDefaultConfig(context.Background())
+			if e != nil {
+				s3_err = e
+				return
+			}
+			s3_client = s3.NewFromConfig(cfg)
+		})
+		if s3_err != nil {
+			return nil, s3_err
+		}
+		return &s3Object{bucket: bits[0], key: bits[1]}, nil
+	}
+
+	gcs_once.Do(func() {
+		gcs_client, gcs_err = storage.NewClient(context.Background())
+	})
+	if gcs_err != nil {
+		return nil, gcs_err
+	}
+	return &gcsObject{obj: gcs_client.Bucket(bits[0]).Object(bits[1])}, nil
+}
+
+type s3Object struct {
+	bucket string
+	key    string
+}
+
+func (o *s3Object) size(ctx context.Context) (int64, error) {
+	head, e := s3_client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(o.bucket), Key: aws.String(o.key)})
+	if e != nil {
+		return 0, e
+	}
+	return aws.ToInt64(head.ContentLength), nil
+}
+
+func (o *s3Object) readRange(ctx context.Context, offset int64, length int64) ([]byte, error) {
+	res, e := s3_client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(o.bucket),
+		Key:    aws.String(o.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if e != nil {
+		return nil, e
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(res.Body)
+}
+
+func (o *s3Object) upload(ctx context.Context, r io.Reader) error {
+	uploader := manager.NewUploader(s3_client, func(u *manager.Uploader) {
+		u.PartSize = object_chunk_size
+		u.Concurrency = object_workers
+	})
+	_, e := uploader.Upload(ctx, &s3.PutObjectInput{Bucket: aws.String(o.bucket), Key: aws.String(o.key), Body: r})
+	return e
+}
+
+type gcsObject struct {
+	obj *storage.ObjectHandle
+}
+
+func (o *gcsObject) size(ctx context.Context) (int64, error) {
+	attrs, e := o.obj.Attrs(ctx)
+	if e != nil {
+		return 0, e
+	}
+	return attrs.Size, nil
+}
+
+func (o *gcsObject) readRange(ctx context.Context, offset int64, length int64) ([]byte, error) {
+	r, e := o.obj.NewRangeReader(ctx, offset, length)
+	if e != nil {
+		return nil, e
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (o *gcsObject) upload(ctx context.Context, r io.Reader) error {
+	w := o.obj.NewWriter(ctx)
+	w.ChunkSize = object_chunk_size
+	if _, e := io.Copy(w, r); e != nil {
+		w.Close()
+		return e
+	}
+	return w.Close()
+}
+
+type objectChunk struct {
+	data []byte
+	err  error
+}
+
+type objectReader struct {
+	cancel context.CancelFunc
+	chunks chan chan objectChunk
+	cur    []byte
+	err    error
+}
+
+// OpenObject returns a reader over an object. Chunks of the object are
+// fetched in parallel with ranged requests, retried on failure, and returned
+// in order.
+func OpenObject(path string) (io.ReadCloser, error) {
+	o, e := openObject(path)
+	if e != nil {
+		return nil, e
+	}
+	return newObjectReader(o, path, object_workers, object_chunk_size, object_retries, time.Second)
+}
+
+// Return a reader over an object that fetches up to workers chunks at once.
+// Failed chunks are retried after a delay that starts at backoff and doubles
+// with each attempt.
+func newObjectReader(o objectStore, path string, workers int, chunk_size int64, retries int, backoff time.Duration) (*objectReader, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	size, e := o.size(ctx)
+	if e != nil {
+		cancel()
+		return nil, fmt.Errorf("%s: %s", path, e)
+	}
+
+	r := &objectReader{cancel: cancel, chunks: make(chan chan objectChunk, workers)}
+
+	go func() {
+		defer close(r.chunks)
+		for offset := int64(0); offset < size; offset += chunk_size {
+			length := size - offset
+			if length > chunk_size {
+				length = chunk_size
+			}
+
+			c := make(chan objectChunk, 1)
+			select {
+			case r.chunks <- c:
+			case <-ctx.Done():
+				return
+			}
+
+			go func(offset int64, length int64) {
+				var data []byte
+				var e error
+				for attempt := 0; attempt < retries; attempt++ {
+					if attempt > 0 {
+						select {
+						case <-time.After(backoff << uint(attempt-1)):
+						case <-ctx.Done():
+						}
+					}
+					data, e = o.readRange(ctx, offset, length)
+					if e == nil && int64(len(data)) != length {
+						e = fmt.Errorf("short read at offset %d", offset)
+					}
+					if e == nil || ctx.Err() != nil {
+						break
+					}
+				}
+				if e != nil {
+					e = fmt.Errorf("%s: %s", path, e)
+				}
+				c <- objectChunk{data: data, err: e}
+			}(offset, length)
+		}
+	}()
+
+	return r, nil
+}
+
+func (r *objectReader) Read(b []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		c, ok := <-r.chunks
+		if !ok {
+			r.err = io.EOF
+			continue
+		}
+
+		chunk := <-c
+		if chunk.err != nil {
+			r.err = chunk.err
+			continue
+		}
+		r.cur = chunk.data
+	}
+
+	n := copy(b, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+func (r *objectReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+type objectWriter struct {
+	w    *io.PipeWriter
+	done chan error
+}
+
+// CreateObject returns a writer that uploads an object. The upload is
+// streamed as a multipart upload and is only complete once Close returns
+// without an error.
+func CreateObject(path string) (io.WriteCloser, error) {
+	o, e := openObject(path)
+	if e != nil {
+		return nil, e
+	}
+
+	pr, pw := io.Pipe()
+	w := &objectWriter{w: pw, done: make(chan error, 1)}
+
+	go func() {
+		e := o.upload(context.Background(), pr)
+		if e != nil {
+			e = fmt.Errorf("%s: %s", path, e)
+		}
+		// Unblock any pending writes when the upload fails
+		pr.CloseWithError(e)
+		w.done <- e
+	}()
+
+	return w, nil
+}
+
+func (w *objectWriter) Write(b []byte) (int, error) {
+	return w.w.Write(b)
+}
+
+func (w *objectWriter) Close() error {
+	w.w.Close()
+	return <-w.done
+}
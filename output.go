@@ -0,0 +1,128 @@
+package inetdata
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OutputBuffer is the size in bytes of the buffer in front of each local
+// output, or 0 to write every record directly
+var OutputBuffer = 1024 * 1024
+
+// FlushInterval flushes buffered outputs periodically when set, so that a
+// slow producer such as a followed CT log does not hold records back
+var FlushInterval time.Duration = 0
+
+// FsyncOnClose syncs output files to disk before they are closed
+var FsyncOnClose = false
+
+// AddOutputFlags registers the -output-buffer, -flush-interval, and
+// -fsync-on-close flags for the outputs opened with CreateOutput
+func AddOutputFlags() {
+	flag.IntVar(&OutputBuffer, "output-buffer", envInt("INETDATA_OUTPUT_BUFFER", OutputBuffer), "The size in bytes of the output write buffer, 0 disables buffering (env: INETDATA_OUTPUT_BUFFER)")
+	flag.DurationVar(&FlushInterval, "flush-interval", FlushInterval, "Flush the buffered output at this interval, such as 1s (default only when full or closed)")
+	flag.BoolVar(&FsyncOnClose, "fsync-on-close", FsyncOnClose, "Sync output files to disk before closing them")
+}
+
+// BufferedOutput buffers the writes to an output, which are flushed when the
+// buffer fills, at an optional interval, and on Close. Writes block while the
+// buffer is flushed, so a slow output slows the tool down instead of growing
+// its memory use.
+type BufferedOutput struct {
+	w     io.WriteCloser
+	buf   *bufio.Writer
+	fsync bool
+	lock  sync.Mutex
+	done  chan bool
+	err   error
+}
+
+// NewBufferedOutput wraps an output with a buffer of size bytes. A size of 0
+// writes directly to the output, and an interval of 0 disables periodic
+// flushes. With fsync, Close syncs outputs that support it, such as files.
+func NewBufferedOutput(w io.WriteCloser, size int, interval time.Duration, fsync bool) *BufferedOutput {
+	b := &BufferedOutput{w: w, fsync: fsync}
+	if size > 0 {
+		b.buf = bufio.NewWriterSize(w, size)
+	}
+
+	if b.buf != nil && interval > 0 {
+		b.done = make(chan bool)
+		go b.flusher(interval)
+	}
+	return b
+}
+
+func (b *BufferedOutput) flusher(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			b.Flush()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (b *BufferedOutput) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.buf == nil {
+		return b.w.Write(p)
+	}
+	return b.buf.Write(p)
+}
+
+// Flush writes any buffered data to the output
+func (b *BufferedOutput) Flush() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.buf == nil || b.err != nil {
+		return b.err
+	}
+	if e := b.buf.Flush(); e != nil {
+		b.err = e
+	}
+	return b.err
+}
+
+// Close flushes the buffer, syncs the output if requested, and closes it
+func (b *BufferedOutput) Close() error {
+	if b.done != nil {
+		close(b.done)
+		b.done = nil
+	}
+
+	e := b.Flush()
+
+	if b.fsync {
+		if s, ok := b.w.(interface{ Sync() error }); ok {
+			if se := s.Sync(); e == nil {
+				e = se
+			}
+		}
+	}
+
+	if ce := b.w.Close(); e == nil {
+		e = ce
+	}
+	return e
+}
+
+// Return true if an output path is buffered by CreateOutput. Streams and
+// object stores batch their writes, so only files and stdout are buffered.
+func bufferedOutputPath(path string) bool {
+	return !IsRemotePath(path) || strings.HasPrefix(path, "file://") || strings.HasPrefix(path, "stdout://")
+}
@@ -0,0 +1,122 @@
+package inetdata
+
+import (
+	"fmt"
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+	"io"
+	"reflect"
+	"strings"
+)
+
+var ParquetCompressionTypes = []string{"none", "snappy", "gzip", "zstd"}
+
+var parquet_codecs = map[string]compress.Codec{
+	"none":   &parquet.Uncompressed,
+	"snappy": &parquet.Snappy,
+	"gzip":   &parquet.Gzip,
+	"zstd":   &parquet.Zstd,
+}
+
+// ValidParquetCompression returns true if the codec is a supported Parquet compression
+func ValidParquetCompression(codec string) bool {
+	_, ok := parquet_codecs[codec]
+	return ok
+}
+
+// A string column of a Parquet file. Columns with a ListSeparator are lists of
+// strings, and line values are split on the separator.
+type ParquetColumn struct {
+	Name          string
+	ListSeparator string
+}
+
+// ParquetWriter writes rows of string and string list columns to a Parquet file.
+// Rows are buffered in memory until a row group is complete.
+type ParquetWriter struct {
+	w       *parquet.Writer
+	columns []ParquetColumn
+	row     reflect.Type
+}
+
+// NewParquetWriter returns a writer for the columns, using the compression codec
+// and up to row_group_size rows per row group. The file is complete once Close
+// returns; the output itself is not closed.
+func NewParquetWriter(output io.Writer, columns []ParquetColumn, codec string, row_group_size int) (*ParquetWriter, error) {
+	c, ok := parquet_codecs[codec]
+	if !ok {
+		return nil, fmt.Errorf("invalid parquet compression: %s", codec)
+	}
+
+	if row_group_size < 1 {
+		return nil, fmt.Errorf("invalid parquet row group size: %d", row_group_size)
+	}
+
+	// The schema is built from a struct type, which keeps the columns in order
+	fields := make([]reflect.StructField, len(columns))
+	for i, col := range columns {
+		name := strings.Replace(col.Name, ",", "_", -1)
+		if len(name) == 0 {
+			return nil, fmt.Errorf("empty parquet column name")
+		}
+
+		fields[i] = reflect.StructField{Name: fmt.Sprintf("F%d", i), Type: reflect.TypeOf("")}
+		fields[i].Tag = reflect.StructTag(fmt.Sprintf(`parquet:"%s"`, name))
+		if len(col.ListSeparator) > 0 {
+			fields[i].Type = reflect.TypeOf([]string{})
+			fields[i].Tag = reflect.StructTag(fmt.Sprintf(`parquet:"%s,list"`, name))
+		}
+	}
+
+	row := reflect.StructOf(fields)
+	schema := parquet.SchemaOf(reflect.New(row).Interface())
+
+	return &ParquetWriter{
+		w:       parquet.NewWriter(output, schema, parquet.Compression(c), parquet.MaxRowsPerRowGroup(int64(row_group_size))),
+		columns: columns,
+		row:     row,
+	}, nil
+}
+
+// Write a row with one value per column: a string, or a string or []string for
+// list columns. Missing trailing values are written as empty.
+func (p *ParquetWriter) Write(vals ...interface{}) error {
+	if len(vals) > len(p.columns) {
+		return fmt.Errorf("too many parquet values: %d > %d", len(vals), len(p.columns))
+	}
+
+	row := reflect.New(p.row).Elem()
+	for i, v := range vals {
+		switch t := v.(type) {
+		case string:
+			if len(p.columns[i].ListSeparator) > 0 {
+				row.Field(i).Set(reflect.ValueOf(strings.Split(t, p.columns[i].ListSeparator)))
+			} else {
+				row.Field(i).SetString(t)
+			}
+		case []string:
+			if len(p.columns[i].ListSeparator) == 0 {
+				return fmt.Errorf("parquet column %s is not a list", p.columns[i].Name)
+			}
+			row.Field(i).Set(reflect.ValueOf(t))
+		default:
+			return fmt.Errorf("invalid parquet value type %T", v)
+		}
+	}
+
+	return p.w.Write(row.Addr().Interface())
+}
+
+// WriteStrings writes a row of string values, see Write
+func (p *ParquetWriter) WriteStrings(row []string) error {
+	vals := make([]interface{}, len(row))
+	for i := range row {
+		vals[i] = row[i]
+	}
+	return p.Write(vals...)
+}
+
+// Close writes the remaining rows and the file footer
+func (p *ParquetWriter) Close() error {
+	return p.w.Close()
+}
@@ -0,0 +1,167 @@
+// Package pipeline connects record sources and sinks through a registry keyed
+// by URL scheme. Every tool opens its inputs and outputs through Open and
+// Create, so a backend registered here is available to all of them.
+//
+// Local files, file://, stdin://, stdout://, http:// and https:// are built
+// in. Importing the inetdata package registers kafka://, es://, clickhouse://,
+// postgres://, redis://, s3:// and gs://.
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// Reader is a source of records
+type Reader interface {
+	// Next returns the next record, or io.EOF at the end of the input. The
+	// record is only valid until the next call.
+	Next() ([]byte, error)
+	Close() error
+}
+
+// Writer is a sink of records
+type Writer interface {
+	WriteRecord(rec []byte) error
+	Close() error
+}
+
+// Transformer converts a record into zero or more records
+type Transformer interface {
+	Transform(rec []byte) ([][]byte, error)
+}
+
+// TransformFunc adapts a function to the Transformer interface
+type TransformFunc func(rec []byte) ([][]byte, error)
+
+func (f TransformFunc) Transform(rec []byte) ([][]byte, error) {
+	return f(rec)
+}
+
+// Run reads every record from the reader, passes it through the transformers
+// in order, and writes the results. Neither the reader nor the writer is
+// closed.
+func Run(r Reader, w Writer, transformers ...Transformer) error {
+	for {
+		rec, e := r.Next()
+		if e == io.EOF {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+
+		recs := [][]byte{rec}
+		for _, t := range transformers {
+			next := [][]byte{}
+			for _, rec := range recs {
+				out, e := t.Transform(rec)
+				if e != nil {
+					return e
+				}
+				next = append(next, out...)
+			}
+			recs = next
+		}
+
+		for _, rec := range recs {
+			if e := w.WriteRecord(rec); e != nil {
+				return e
+			}
+		}
+	}
+}
+
+type lineReader struct {
+	r   *bufio.Reader
+	c   io.Closer
+	buf []byte
+}
+
+// NewLineReader returns a reader of the lines of the input, without their
+// line endings. Close closes the input if it is an io.Closer.
+func NewLineReader(input io.Reader) Reader {
+	l := &lineReader{r: bufio.NewReaderSize(input, 1024*1024)}
+	if c, ok := input.(io.Closer); ok {
+		l.c = c
+	}
+	return l
+}
+
+func (l *lineReader) Next() ([]byte, error) {
+	l.buf = l.buf[:0]
+	for {
+		chunk, e := l.r.ReadSlice('\n')
+		l.buf = append(l.buf, chunk...)
+
+		if e == bufio.ErrBufferFull {
+			continue
+		}
+		if e == io.EOF && len(l.buf) > 0 {
+			break
+		}
+		if e != nil {
+			return nil, e
+		}
+		break
+	}
+	return bytes.TrimRight(l.buf, "\r\n"), nil
+}
+
+func (l *lineReader) Close() error {
+	if l.c != nil {
+		return l.c.Close()
+	}
+	return nil
+}
+
+type lineWriter struct {
+	w *bufio.Writer
+	c io.Closer
+}
+
+// NewLineWriter returns a writer of records as lines of the output. Close
+// flushes the lines and closes the output if it is an io.Closer.
+func NewLineWriter(output io.Writer) Writer {
+	l := &lineWriter{w: bufio.NewWriterSize(output, 1024*1024)}
+	if c, ok := output.(io.Closer); ok {
+		l.c = c
+	}
+	return l
+}
+
+func (l *lineWriter) WriteRecord(rec []byte) error {
+	if _, e := l.w.Write(rec); e != nil {
+		return e
+	}
+	return l.w.WriteByte('\n')
+}
+
+func (l *lineWriter) Close() error {
+	e := l.w.Flush()
+	if l.c != nil {
+		if ce := l.c.Close(); e == nil {
+			e = ce
+		}
+	}
+	return e
+}
+
+// OpenReader opens a path with Open and returns a reader of its lines
+func OpenReader(path string) (Reader, error) {
+	r, e := Open(path)
+	if e != nil {
+		return nil, e
+	}
+	return NewLineReader(r), nil
+}
+
+// CreateWriter opens a path with Create and returns a writer of lines
+func CreateWriter(path string) (Writer, error) {
+	w, e := Create(path)
+	if e != nil {
+		return nil, e
+	}
+	return NewLineWriter(w), nil
+}
@@ -0,0 +1,230 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// OpenFunc opens a URL for reading
+type OpenFunc func(path string) (io.ReadCloser, error)
+
+// CreateFunc opens a URL for writing
+type CreateFunc func(path string) (io.WriteCloser, error)
+
+// Scheme is the backend for the URLs of a scheme. Either function may be nil
+// for backends that can only be read or only be written.
+type Scheme struct {
+	Open   OpenFunc
+	Create CreateFunc
+}
+
+var schemes = map[string]Scheme{}
+var schemes_lock sync.RWMutex
+
+var match_scheme = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9+.-]*)://`)
+
+func init() {
+	Register("file", Scheme{Open: openFile, Create: createFile})
+	Register("stdin", Scheme{Open: openStdin})
+	Register("stdout", Scheme{Create: createStdout})
+	Register("http", Scheme{Open: openHTTP, Create: createHTTP})
+	Register("https", Scheme{Open: openHTTP, Create: createHTTP})
+}
+
+// Register sets the backend for URLs of a scheme (ex: "kafka" for kafka://),
+// replacing any existing backend. Packages usually register their schemes in
+// an init function.
+func Register(scheme string, s Scheme) {
+	schemes_lock.Lock()
+	defer schemes_lock.Unlock()
+	schemes[strings.ToLower(scheme)] = s
+}
+
+// Schemes returns the registered schemes in lexical order
+func Schemes() []string {
+	schemes_lock.RLock()
+	defer schemes_lock.RUnlock()
+
+	res := make([]string, 0, len(schemes))
+	for k := range schemes {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Return the scheme of a URL, or an empty string for a local path
+func schemeOf(path string) string {
+	m := match_scheme.FindStringSubmatch(path)
+	if m == nil {
+		return ""
+	}
+	return strings.ToLower(m[1])
+}
+
+// Lookup returns the backend for the scheme of a URL
+func Lookup(path string) (Scheme, bool) {
+	schemes_lock.RLock()
+	defer schemes_lock.RUnlock()
+
+	s, ok := schemes[schemeOf(path)]
+	return s, ok
+}
+
+// IsURL returns true if the path is a URL with a registered scheme
+func IsURL(path string) bool {
+	_, ok := Lookup(path)
+	return ok
+}
+
+// Open opens a path for reading: stdin when the path is empty or "-", the
+// registered backend for a URL, and otherwise a local file
+func Open(path string) (io.ReadCloser, error) {
+	if len(path) == 0 || path == "-" {
+		return openStdin(path)
+	}
+
+	scheme := schemeOf(path)
+	if len(scheme) == 0 {
+		return os.Open(path)
+	}
+
+	s, ok := Lookup(path)
+	if !ok {
+		return nil, fmt.Errorf("unsupported URL scheme %s: %s", scheme, path)
+	}
+	if s.Open == nil {
+		return nil, fmt.Errorf("%s can only be used as an output: %s", scheme, path)
+	}
+	return s.Open(path)
+}
+
+// Create opens a path for writing: stdout when the path is empty or "-", the
+// registered backend for a URL, and otherwise a new local file
+func Create(path string) (io.WriteCloser, error) {
+	if len(path) == 0 || path == "-" {
+		return createStdout(path)
+	}
+
+	scheme := schemeOf(path)
+	if len(scheme) == 0 {
+		return os.Create(path)
+	}
+
+	s, ok := Lookup(path)
+	if !ok {
+		return nil, fmt.Errorf("unsupported URL scheme %s: %s", scheme, path)
+	}
+	if s.Create == nil {
+		return nil, fmt.Errorf("%s can only be used as an input: %s", scheme, path)
+	}
+	return s.Create(path)
+}
+
+// Return the local path of a file:// URL
+func filePath(path string) (string, error) {
+	u, e := url.Parse(path)
+	if e != nil || len(u.Path) == 0 || (len(u.Host) > 0 && u.Host != "localhost") {
+		return "", fmt.Errorf("invalid file URL, expected file:///path: %s", path)
+	}
+	return u.Path, nil
+}
+
+func openFile(path string) (io.ReadCloser, error) {
+	p, e := filePath(path)
+	if e != nil {
+		return nil, e
+	}
+	return os.Open(p)
+}
+
+func createFile(path string) (io.WriteCloser, error) {
+	p, e := filePath(path)
+	if e != nil {
+		return nil, e
+	}
+	return os.Create(p)
+}
+
+type nopCloser struct {
+	io.Reader
+}
+
+func (nopCloser) Close() error { return nil }
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Standard input and output are left open when closed, since a tool may
+// still write errors or a summary
+func openStdin(path string) (io.ReadCloser, error) {
+	return nopCloser{os.Stdin}, nil
+}
+
+func createStdout(path string) (io.WriteCloser, error) {
+	return nopWriteCloser{os.Stdout}, nil
+}
+
+// Read the body of a GET request
+func openHTTP(path string) (io.ReadCloser, error) {
+	resp, e := http.Get(path)
+	if e != nil {
+		return nil, e
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download %s: %s", path, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+type httpWriter struct {
+	*io.PipeWriter
+	path string
+	done chan error
+}
+
+// Stream the output as the body of a POST request, which is complete once
+// Close returns
+func createHTTP(path string) (io.WriteCloser, error) {
+	if _, e := url.Parse(path); e != nil {
+		return nil, fmt.Errorf("invalid URL %s: %s", path, e)
+	}
+
+	r, w := io.Pipe()
+	h := &httpWriter{PipeWriter: w, path: path, done: make(chan error, 1)}
+
+	go func() {
+		resp, e := http.Post(path, "application/octet-stream", r)
+		if e != nil {
+			r.CloseWithError(e)
+			h.done <- e
+			return
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			e = fmt.Errorf("failed to upload %s: %s", path, resp.Status)
+			r.CloseWithError(e)
+		}
+		h.done <- e
+	}()
+
+	return h, nil
+}
+
+func (h *httpWriter) Close() error {
+	h.PipeWriter.Close()
+	return <-h.done
+}
@@ -0,0 +1,56 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// TransformerFactory creates a transformer from the argument of its spec, see
+// NewTransformer
+type TransformerFactory func(arg string) (Transformer, error)
+
+var transformers = map[string]TransformerFactory{}
+var transformers_lock sync.RWMutex
+
+// RegisterTransformer sets the factory of a named transformer, replacing any
+// existing one. Tools built with a package that registers a transformer in
+// an init function can apply it to their input with -transform plugin:<name>.
+func RegisterTransformer(name string, f TransformerFactory) {
+	transformers_lock.Lock()
+	defer transformers_lock.Unlock()
+	transformers[strings.ToLower(name)] = f
+}
+
+// Transformers returns the names of the registered transformers in lexical
+// order
+func Transformers() []string {
+	transformers_lock.RLock()
+	defer transformers_lock.RUnlock()
+
+	res := make([]string, 0, len(transformers))
+	for k := range transformers {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// NewTransformer creates a registered transformer from a spec of the form
+// name or name:arg
+func NewTransformer(spec string) (Transformer, error) {
+	name, arg := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		name, arg = spec[:i], spec[i+1:]
+	}
+
+	transformers_lock.RLock()
+	f, ok := transformers[strings.ToLower(name)]
+	transformers_lock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown transformer %q, registered: %s", name, strings.Join(Transformers(), ", "))
+	}
+	return f(arg)
+}
@@ -0,0 +1,323 @@
+package inetdata
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PostgresURL describes a table as postgres://[user:pass@]host:port/database?table=NAME&options
+//
+//	schema    : the schema of the table (default public)
+//	table     : the table to copy into (required)
+//	columns   : comma-separated column names for the fields of each line, the
+//	            last column holds the remainder of the line (default key,value)
+//	delimiter : the field delimiter (default ,)
+//	create    : create the table if it does not exist, with text columns (default 0)
+//	merge     : update existing rows on a conflict on the first column, which
+//	            must have a unique index; created tables use it as the primary key (default 0)
+//	batch     : the maximum number of rows per COPY (default 100000)
+//	linger    : the maximum time to wait for a batch to fill (default 5s)
+//
+// Other options, such as sslmode, are passed to the connection.
+type PostgresURL struct {
+	ConnString string
+	Schema     string
+	Table      string
+	Columns    []string
+	Delimiter  string
+	Create     bool
+	Merge      bool
+	BatchSize  int
+	Linger     time.Duration
+}
+
+// IsPostgresURL returns true if the path is a postgres:// or postgresql:// URL
+func IsPostgresURL(path string) bool {
+	return strings.HasPrefix(path, "postgres://") || strings.HasPrefix(path, "postgresql://")
+}
+
+// ParsePostgresURL parses a postgres:// URL
+func ParsePostgresURL(s string) (*PostgresURL, error) {
+	p, e := url.Parse(s)
+	if e != nil || !IsPostgresURL(s) {
+		return nil, fmt.Errorf("not a postgres URL: %s", s)
+	}
+
+	u := &PostgresURL{
+		Schema:    "public",
+		Columns:   []string{"key", "value"},
+		Delimiter: ",",
+		BatchSize: 100000,
+		Linger:    5 * time.Second,
+	}
+
+	flag := func(v string) bool {
+		return v == "1" || v == "true"
+	}
+
+	// Remove our options, leaving the connection parameters
+	q := p.Query()
+	for k := range p.Query() {
+		v := q.Get(k)
+		switch k {
+		case "schema":
+			u.Schema = v
+		case "table":
+			u.Table = v
+		case "columns":
+			u.Columns = strings.Split(v, ",")
+			for i := range u.Columns {
+				if len(u.Columns[i]) == 0 {
+					e = errors.New("empty column name")
+				}
+			}
+		case "delimiter":
+			u.Delimiter = UnescapeDelimiter(v)
+		case "create":
+			u.Create = flag(v)
+		case "merge":
+			u.Merge = flag(v)
+		case "batch":
+			u.BatchSize, e = strconv.Atoi(v)
+			if e == nil && u.BatchSize < 1 {
+				e = errors.New("must be positive")
+			}
+		case "linger":
+			u.Linger, e = time.ParseDuration(v)
+		default:
+			continue
+		}
+
+		if e != nil {
+			return nil, fmt.Errorf("invalid postgres URL option %s=%q: %s", k, v, e)
+		}
+		q.Del(k)
+	}
+
+	if len(u.Table) == 0 || len(u.Schema) == 0 {
+		return nil, fmt.Errorf("invalid postgres URL, expected postgres://host:port/database?table=NAME: %s", s)
+	}
+
+	p.RawQuery = q.Encode()
+	u.ConnString = p.String()
+	return u, nil
+}
+
+// PostgresTableDDL returns the statement that creates the table for the URL
+func PostgresTableDDL(u *PostgresURL) string {
+	cols := make([]string, len(u.Columns))
+	for i := range u.Columns {
+		cols[i] = pgx.Identifier{u.Columns[i]}.Sanitize() + " text"
+		if i == 0 && u.Merge {
+			cols[i] += " PRIMARY KEY"
+		}
+	}
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)",
+		pgx.Identifier{u.Schema, u.Table}.Sanitize(), strings.Join(cols, ", "))
+}
+
+// Build the statement that merges the staging table into the target table.
+// Rows with the same key in one batch would conflict with each other, so
+// only one of them is kept.
+func postgresMergeSQL(u *PostgresURL, stage string) string {
+	cols := make([]string, len(u.Columns))
+	for i := range u.Columns {
+		cols[i] = pgx.Identifier{u.Columns[i]}.Sanitize()
+	}
+
+	action := "NOTHING"
+	if len(cols) > 1 {
+		sets := make([]string, len(cols)-1)
+		for i := range cols[1:] {
+			sets[i] = cols[i+1] + " = EXCLUDED." + cols[i+1]
+		}
+		action = "UPDATE SET " + strings.Join(sets, ", ")
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (%s) SELECT DISTINCT ON (%s) %s FROM %s ON CONFLICT (%s) DO %s",
+		pgx.Identifier{u.Schema, u.Table}.Sanitize(), strings.Join(cols, ", "), cols[0], strings.Join(cols, ", "),
+		pgx.Identifier{stage}.Sanitize(), cols[0], action)
+}
+
+type postgresWriter struct {
+	sync.Mutex
+	u       *PostgresURL
+	conn    *pgx.Conn
+	pending []byte
+	rows    [][]interface{}
+	quit    chan bool
+	failed  int64
+	err     error
+}
+
+// NewPostgresWriter connects to Postgres and returns a writer that copies each
+// line written to it into the table as a row. Rows are sent in batches using
+// the COPY protocol, with each batch in its own transaction; writes block
+// while a batch is sent.
+func NewPostgresWriter(u *PostgresURL) (io.WriteCloser, error) {
+	conn, e := pgx.Connect(context.Background(), u.ConnString)
+	if e != nil {
+		return nil, e
+	}
+
+	if u.Create {
+		if _, e := conn.Exec(context.Background(), PostgresTableDDL(u)); e != nil {
+			conn.Close(context.Background())
+			return nil, fmt.Errorf("failed to create table %s: %s", u.Table, e)
+		}
+	}
+
+	w := &postgresWriter{
+		u:    u,
+		conn: conn,
+		quit: make(chan bool),
+	}
+
+	// Send partial batches after the linger time
+	go func() {
+		t := time.NewTicker(u.Linger)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				w.Lock()
+				w.flush()
+				w.Unlock()
+			case <-w.quit:
+				return
+			}
+		}
+	}()
+
+	return w, nil
+}
+
+func (w *postgresWriter) Write(b []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	w.pending = append(w.pending, b...)
+
+	for {
+		idx := bytes.IndexByte(w.pending, '\n')
+		if idx < 0 {
+			break
+		}
+
+		line := strings.TrimRight(string(w.pending[:idx]), "\r")
+		w.pending = w.pending[idx+1:]
+		if len(line) == 0 {
+			continue
+		}
+
+		// Postgres text values can not contain NUL bytes
+		if strings.IndexByte(line, 0) >= 0 {
+			Log.Warnf("Postgres: skipping record with a NUL byte %q, use a different merge separator", line)
+			w.failed++
+			continue
+		}
+
+		bits := strings.SplitN(line, w.u.Delimiter, len(w.u.Columns))
+		row := make([]interface{}, len(w.u.Columns))
+		for i := range row {
+			row[i] = ""
+			if i < len(bits) {
+				row[i] = bits[i]
+			}
+		}
+		w.rows = append(w.rows, row)
+
+		if len(w.rows) >= w.u.BatchSize {
+			if e := w.flush(); e != nil {
+				return 0, e
+			}
+		}
+	}
+
+	return len(b), nil
+}
+
+// Copy the buffered rows in a transaction, the lock must be held
+func (w *postgresWriter) flush() error {
+	if len(w.rows) == 0 || w.err != nil {
+		return w.err
+	}
+
+	rows := w.rows
+	w.rows = nil
+
+	if e := w.copyRows(rows); e != nil {
+		w.err = fmt.Errorf("postgres copy into %s failed: %s", w.u.Table, e)
+	}
+	return w.err
+}
+
+func (w *postgresWriter) copyRows(rows [][]interface{}) error {
+	ctx := context.Background()
+
+	tx, e := w.conn.Begin(ctx)
+	if e != nil {
+		return e
+	}
+	defer tx.Rollback(ctx)
+
+	target := pgx.Identifier{w.u.Schema, w.u.Table}
+	if w.u.Merge {
+		target = pgx.Identifier{"inetdata_stage"}
+		ddl := fmt.Sprintf("CREATE TEMP TABLE IF NOT EXISTS %s (LIKE %s) ON COMMIT DELETE ROWS",
+			target.Sanitize(), pgx.Identifier{w.u.Schema, w.u.Table}.Sanitize())
+		if _, e := tx.Exec(ctx, ddl); e != nil {
+			return e
+		}
+	}
+
+	if _, e := tx.CopyFrom(ctx, target, w.u.Columns, pgx.CopyFromRows(rows)); e != nil {
+		return e
+	}
+
+	if w.u.Merge {
+		if _, e := tx.Exec(ctx, postgresMergeSQL(w.u, target[0])); e != nil {
+			return e
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Close copies the remaining rows and closes the connection
+func (w *postgresWriter) Close() error {
+	close(w.quit)
+
+	w.Lock()
+	if len(w.pending) > 0 {
+		w.pending = append(w.pending, '\n')
+	}
+	w.Unlock()
+
+	w.Write(nil)
+
+	w.Lock()
+	defer w.Unlock()
+
+	e := w.flush()
+	if ce := w.conn.Close(context.Background()); e == nil {
+		e = ce
+	}
+	if e == nil && w.failed > 0 {
+		e = fmt.Errorf("%d records could not be copied", w.failed)
+	}
+	return e
+}
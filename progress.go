@@ -0,0 +1,331 @@
+package inetdata
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type progressCounter struct {
+	name  string
+	value *int64
+}
+
+type progressLabeledCounter struct {
+	name  string
+	label string
+	key   string
+	value *int64
+}
+
+type progressStage struct {
+	name  string
+	depth func() int
+}
+
+// Progress tracks the record counters of a command. Run reports them to
+// stderr once per second and ServeMetrics exposes them to Prometheus. The
+// counters are owned by the command and must be updated atomically.
+type Progress struct {
+	Name   string
+	Input  *int64
+	Output *int64
+	Errors *int64
+
+	// The progress line format, text or json
+	Format string
+
+	// What the input and output counters count in the progress line, such
+	// as bytes for a download
+	Unit string
+
+	// Bytes read through CountReader
+	Bytes int64
+
+	lock     sync.Mutex
+	counters []progressCounter
+	labeled  []progressLabeledCounter
+	stages   []progressStage
+}
+
+// Validate a progress format name
+func ValidProgressFormat(name string) bool {
+	return name == "text" || name == "json"
+}
+
+// NewProgress creates a tracker for the input and output record counters of
+// a command. The output counter may be nil for commands without output.
+func NewProgress(name string, input *int64, output *int64) *Progress {
+	return &Progress{Name: name, Input: input, Output: output, Format: "text", Unit: "records"}
+}
+
+// AddCounter registers an additional counter, shown in the progress line and
+// exported as inetdata_<name>_total.
+func (p *Progress) AddCounter(name string, value *int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.counters = append(p.counters, progressCounter{name: name, value: value})
+}
+
+// AddLabeledCounter registers a counter of one of a set of like things, such
+// as the errors of each CT log, exported as inetdata_<name>_total with the
+// label set to key. Labeled counters are not shown in the progress line.
+func (p *Progress) AddLabeledCounter(name string, label string, key string, value *int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.labeled = append(p.labeled, progressLabeledCounter{name: name, label: label, key: key, value: value})
+}
+
+// AddStage registers a pipeline stage whose queue depth, typically the length
+// of a channel, is exported as a gauge.
+func (p *Progress) AddStage(name string, depth func() int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.stages = append(p.stages, progressStage{name: name, depth: depth})
+}
+
+type countingReader struct {
+	r     io.Reader
+	count *int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	atomic.AddInt64(c.count, int64(n))
+	return n, err
+}
+
+// CountReader wraps an input stream so that bytes read are tracked
+func (p *Progress) CountReader(r io.Reader) io.Reader {
+	return &countingReader{r: r, count: &p.Bytes}
+}
+
+func loadCounter(v *int64) int64 {
+	if v == nil {
+		return 0
+	}
+	return atomic.LoadInt64(v)
+}
+
+// Run writes a progress line to stderr every second until quit receives,
+// unless -log-level is above info
+func (p *Progress) Run(quit chan int) {
+	start := time.Now()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-time.After(time.Second * 1):
+			icount := loadCounter(p.Input)
+			ocount := loadCounter(p.Output)
+
+			if icount == 0 && ocount == 0 {
+				// Reset start, so that we show stats only from our first input
+				start = time.Now()
+				continue
+			}
+			elapsed := time.Since(start)
+			if elapsed.Seconds() > 1.0 && Log.Enabled(LOG_INFO) {
+				if p.Format == "json" {
+					fmt.Fprintln(os.Stderr, p.formatJSON(icount, ocount, elapsed))
+				} else {
+					fmt.Fprintln(os.Stderr, p.formatText(icount, ocount, elapsed))
+				}
+			}
+		}
+	}
+}
+
+func (p *Progress) formatText(icount int64, ocount int64, elapsed time.Duration) string {
+	var line string
+
+	if p.Output == nil {
+		line = fmt.Sprintf("[*] [%s] Read %d %s in %d seconds (%d/s)",
+			p.Name,
+			icount,
+			p.Unit,
+			int(elapsed.Seconds()),
+			int(float64(icount)/elapsed.Seconds()))
+	} else {
+		line = fmt.Sprintf("[*] [%s] Read %d and wrote %d %s in %d seconds (%d/s in, %d/s out)",
+			p.Name,
+			icount,
+			ocount,
+			p.Unit,
+			int(elapsed.Seconds()),
+			int(float64(icount)/elapsed.Seconds()),
+			int(float64(ocount)/elapsed.Seconds()))
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	extra := []string{}
+	for _, c := range p.counters {
+		extra = append(extra, fmt.Sprintf("%s: %d", c.name, loadCounter(c.value)))
+	}
+	if p.Errors != nil {
+		extra = append(extra, fmt.Sprintf("errors: %d", loadCounter(p.Errors)))
+	}
+
+	if len(extra) > 0 {
+		line += " (" + strings.Join(extra, ", ") + ")"
+	}
+
+	return line
+}
+
+type progressRecord struct {
+	Timestamp    string           `json:"timestamp"`
+	Tool         string           `json:"tool"`
+	Elapsed      float64          `json:"elapsed"`
+	InputCount   int64            `json:"input"`
+	OutputCount  *int64           `json:"output,omitempty"`
+	InputRate    float64          `json:"input_rate"`
+	OutputRate   *float64         `json:"output_rate,omitempty"`
+	InputBytes   int64            `json:"input_bytes"`
+	Errors       *int64           `json:"errors,omitempty"`
+	Counters     map[string]int64 `json:"counters,omitempty"`
+	MemoryAlloc  uint64           `json:"memory_alloc"`
+	MemorySystem uint64           `json:"memory_sys"`
+}
+
+func (p *Progress) formatJSON(icount int64, ocount int64, elapsed time.Duration) string {
+	rec := progressRecord{
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+		Tool:       p.Name,
+		Elapsed:    elapsed.Seconds(),
+		InputCount: icount,
+		InputRate:  float64(icount) / elapsed.Seconds(),
+		InputBytes: atomic.LoadInt64(&p.Bytes),
+	}
+
+	if p.Output != nil {
+		orate := float64(ocount) / elapsed.Seconds()
+		rec.OutputCount = &ocount
+		rec.OutputRate = &orate
+	}
+
+	if p.Errors != nil {
+		ecount := loadCounter(p.Errors)
+		rec.Errors = &ecount
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	rec.MemoryAlloc = mem.Alloc
+	rec.MemorySystem = mem.Sys
+
+	p.lock.Lock()
+	if len(p.counters) > 0 {
+		rec.Counters = make(map[string]int64)
+		for _, c := range p.counters {
+			rec.Counters[c.name] = loadCounter(c.value)
+		}
+	}
+	p.lock.Unlock()
+
+	b, _ := json.Marshal(rec)
+	return string(b)
+}
+
+// Convert a command or counter name into a valid Prometheus name component
+func metricName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// WriteMetrics writes the counters in the Prometheus text exposition format
+func (p *Progress) WriteMetrics(w io.Writer) {
+	tool := fmt.Sprintf("{tool=%q}", p.Name)
+
+	metric := func(name string, mtype string, help string, labels string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s%s %d\n", name, help, name, mtype, name, labels, value)
+	}
+
+	metric("inetdata_input_records_total", "counter", "Records read.", tool, loadCounter(p.Input))
+	if p.Output != nil {
+		metric("inetdata_output_records_total", "counter", "Records written.", tool, loadCounter(p.Output))
+	}
+	metric("inetdata_input_bytes_total", "counter", "Bytes of input read.", tool, atomic.LoadInt64(&p.Bytes))
+	metric("inetdata_errors_total", "counter", "Records that could not be processed.", tool, loadCounter(p.Errors))
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	metric("inetdata_memory_alloc_bytes", "gauge", "Bytes of allocated heap objects.", tool, int64(mem.Alloc))
+	metric("inetdata_memory_sys_bytes", "gauge", "Bytes of memory obtained from the OS.", tool, int64(mem.Sys))
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, c := range p.counters {
+		metric("inetdata_"+metricName(c.name)+"_total", "counter", "Records counted as "+c.name+".", tool, loadCounter(c.value))
+	}
+
+	if len(p.labeled) > 0 {
+		labeled := append([]progressLabeledCounter{}, p.labeled...)
+		sort.Slice(labeled, func(i, j int) bool {
+			if labeled[i].name != labeled[j].name {
+				return labeled[i].name < labeled[j].name
+			}
+			return labeled[i].key < labeled[j].key
+		})
+
+		for i, c := range labeled {
+			name := "inetdata_" + metricName(c.name) + "_total"
+			if i == 0 || labeled[i-1].name != c.name {
+				fmt.Fprintf(w, "# HELP %s Records counted as %s, by %s.\n# TYPE %s counter\n", name, c.name, c.label, name)
+			}
+			fmt.Fprintf(w, "%s{tool=%q,%s=%q} %d\n", name, p.Name, metricName(c.label), c.key, loadCounter(c.value))
+		}
+	}
+
+	if len(p.stages) > 0 {
+		stages := append([]progressStage{}, p.stages...)
+		sort.Slice(stages, func(i, j int) bool { return stages[i].name < stages[j].name })
+
+		fmt.Fprintf(w, "# HELP inetdata_stage_queue_depth Records queued between pipeline stages.\n")
+		fmt.Fprintf(w, "# TYPE inetdata_stage_queue_depth gauge\n")
+		for _, s := range stages {
+			fmt.Fprintf(w, "inetdata_stage_queue_depth{tool=%q,stage=%q} %d\n", p.Name, s.name, s.depth())
+		}
+	}
+}
+
+// ServeMetrics exposes the counters at /metrics on the listen address. The
+// listener is opened before returning so that address errors are reported.
+func (p *Progress) ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		p.WriteMetrics(w)
+	})
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			Log.Warnf("[%s] Metrics server failed: %s", p.Name, err)
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,158 @@
+package inetdata
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+)
+
+// Field numbers of the Record message in proto/record.proto
+const pb_record_fields = 1
+const pb_record_values = 2
+
+// The largest record accepted by RecordReader
+const pb_max_record_size = 256 * 1024 * 1024
+
+// Record is a record written with -format pb, see proto/record.proto
+type Record struct {
+	Fields []string
+	Values []string
+}
+
+// MarshalRecord encodes a record as a Record message
+func MarshalRecord(buf []byte, rec *Record) []byte {
+	for _, f := range rec.Fields {
+		buf = protowire.AppendTag(buf, pb_record_fields, protowire.BytesType)
+		buf = protowire.AppendString(buf, f)
+	}
+	for _, v := range rec.Values {
+		buf = protowire.AppendTag(buf, pb_record_values, protowire.BytesType)
+		buf = protowire.AppendString(buf, v)
+	}
+	return buf
+}
+
+// UnmarshalRecord decodes a Record message, skipping unknown fields
+func UnmarshalRecord(b []byte) (*Record, error) {
+	rec := &Record{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if typ == protowire.BytesType && (num == pb_record_fields || num == pb_record_values) {
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+
+			if num == pb_record_fields {
+				rec.Fields = append(rec.Fields, string(v))
+			} else {
+				rec.Values = append(rec.Values, string(v))
+			}
+			continue
+		}
+
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return rec, nil
+}
+
+// ProtoWriter writes length-delimited Record messages
+type ProtoWriter struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+// NewProtoWriter returns a writer of length-delimited records. The output is
+// buffered until Close, which does not close the output itself.
+func NewProtoWriter(output io.Writer) *ProtoWriter {
+	return &ProtoWriter{w: bufio.NewWriterSize(output, 1024*1024)}
+}
+
+// Write a record preceded by its length
+func (p *ProtoWriter) Write(rec *Record) error {
+	p.buf = MarshalRecord(p.buf[:0], rec)
+	if _, e := p.w.Write(protowire.AppendVarint(nil, uint64(len(p.buf)))); e != nil {
+		return e
+	}
+	_, e := p.w.Write(p.buf)
+	return e
+}
+
+// WriteStrings writes a record with the fields of a row
+func (p *ProtoWriter) WriteStrings(row []string) error {
+	return p.Write(&Record{Fields: row})
+}
+
+// Close flushes the buffered records
+func (p *ProtoWriter) Close() error {
+	return p.w.Flush()
+}
+
+// RecordReader reads length-delimited Record messages
+type RecordReader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+// NewRecordReader returns a reader of length-delimited records, such as the
+// output of a tool run with -format pb
+func NewRecordReader(input io.Reader) *RecordReader {
+	return &RecordReader{r: bufio.NewReaderSize(input, 1024*1024)}
+}
+
+// Next returns the next record, or io.EOF at the end of the input
+func (r *RecordReader) Next() (*Record, error) {
+	size, e := readUvarint(r.r)
+	if e != nil {
+		return nil, e
+	}
+
+	if size > pb_max_record_size {
+		return nil, fmt.Errorf("record too large: %d bytes", size)
+	}
+
+	if uint64(cap(r.buf)) < size {
+		r.buf = make([]byte, size)
+	}
+	r.buf = r.buf[:size]
+
+	if _, e := io.ReadFull(r.r, r.buf); e != nil {
+		if e == io.EOF {
+			e = io.ErrUnexpectedEOF
+		}
+		return nil, e
+	}
+
+	return UnmarshalRecord(r.buf)
+}
+
+// Read a varint length, returning io.EOF only when no bytes were read
+func readUvarint(r io.ByteReader) (uint64, error) {
+	var v uint64
+	for i := uint(0); i < 10; i++ {
+		b, e := r.ReadByte()
+		if e != nil {
+			if e == io.EOF && i > 0 {
+				e = io.ErrUnexpectedEOF
+			}
+			return 0, e
+		}
+		v |= uint64(b&0x7f) << (7 * i)
+		if b < 0x80 {
+			return v, nil
+		}
+	}
+	return 0, errors.New("invalid record length")
+}
@@ -0,0 +1,133 @@
+package inetdata
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// The kinds of rules of a name, as a bitmask since a name may have several
+// (ex: platform.sh and *.platform.sh)
+const (
+	pslRuleNormal = 1 << iota
+	pslRuleWildcard
+	pslRuleException
+)
+
+// PublicSuffixList holds the rules from a public_suffix_list.dat file and can
+// be used in place of the list embedded in golang.org/x/net/publicsuffix.
+type PublicSuffixList struct {
+	rules map[string]int
+}
+
+// LoadPublicSuffixList parses the rules in the Public Suffix List format:
+// one rule per line, with comments starting with //, wildcard rules starting
+// with *. and exception rules starting with !.
+func LoadPublicSuffixList(input io.Reader) (*PublicSuffixList, error) {
+	psl := &PublicSuffixList{rules: make(map[string]int)}
+
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		// Rules end at the first whitespace
+		rule := strings.ToLower(strings.Fields(line)[0])
+
+		switch {
+		case strings.HasPrefix(rule, "!"):
+			psl.rules[rule[1:]] |= pslRuleException
+		case strings.HasPrefix(rule, "*."):
+			psl.rules[rule[2:]] |= pslRuleWildcard
+		default:
+			psl.rules[rule] |= pslRuleNormal
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(psl.rules) == 0 {
+		return nil, fmt.Errorf("no rules found in public suffix list")
+	}
+
+	return psl, nil
+}
+
+// OpenPublicSuffixList loads the list from a file path or an http(s) URL
+func OpenPublicSuffixList(path string) (*PublicSuffixList, error) {
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		resp, err := http.Get(path)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to download %s: %s", path, resp.Status)
+		}
+		return LoadPublicSuffixList(resp.Body)
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	return LoadPublicSuffixList(fd)
+}
+
+// PublicSuffix returns the public suffix of the domain, following the
+// algorithm of publicsuffix.org: a matching exception rule prevails, and
+// otherwise the matching normal or wildcard rule with the most labels. As
+// with the golang.org/x/net/publicsuffix package, names without a matching
+// rule use the implicit "*" rule and return their last label.
+func (psl *PublicSuffixList) PublicSuffix(domain string) string {
+	domain = strings.ToLower(domain)
+	labels := strings.Split(domain, ".")
+
+	// The suffix is an exception rule minus its leftmost label
+	for i := range labels {
+		if psl.rules[strings.Join(labels[i:], ".")]&pslRuleException != 0 {
+			return strings.Join(labels[i+1:], ".")
+		}
+	}
+
+	// Walk from the longest candidate to the shortest, the first match wins
+	for i := range labels {
+		candidate := strings.Join(labels[i:], ".")
+		if psl.rules[candidate]&pslRuleNormal != 0 {
+			return candidate
+		}
+
+		// A wildcard rule on the parent makes this label part of the suffix
+		if i+1 < len(labels) && psl.rules[strings.Join(labels[i+1:], ".")]&pslRuleWildcard != 0 {
+			return candidate
+		}
+	}
+
+	return labels[len(labels)-1]
+}
+
+// EffectiveTLDPlusOne returns the registered domain for a name, or an error
+// if the name is itself a public suffix.
+func (psl *PublicSuffixList) EffectiveTLDPlusOne(domain string) (string, error) {
+	suffix := psl.PublicSuffix(domain)
+	if len(domain) <= len(suffix) {
+		return "", fmt.Errorf("cannot derive eTLD+1 for domain %q", domain)
+	}
+
+	i := len(domain) - len(suffix) - 1
+	if domain[i] != '.' {
+		return "", fmt.Errorf("invalid public suffix %q for domain %q", suffix, domain)
+	}
+
+	return domain[1+strings.LastIndex(domain[:i], "."):], nil
+}
@@ -0,0 +1,114 @@
+package inetdata
+
+import (
+	"strings"
+	"testing"
+)
+
+// Rules from public_suffix_list.dat, including names with more than one kind
+// of rule, in both orders
+const testSuffixList = `// ===BEGIN ICANN DOMAINS===
+com
+uk
+co.uk
+jp
+kawasaki.jp
+*.kawasaki.jp
+!city.kawasaki.jp
+ck
+*.ck
+!www.ck
+// ===BEGIN PRIVATE DOMAINS===
+platform.sh
+*.platform.sh
+*.example.net
+example.net
+sh
+!www.example.net
+www.example.net
+`
+
+func TestPublicSuffix(t *testing.T) {
+	psl, e := LoadPublicSuffixList(strings.NewReader(testSuffixList))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	tests := []struct {
+		domain string
+		suffix string
+	}{
+		{"com", "com"},
+		{"example.com", "com"},
+		{"www.example.com", "com"},
+		{"example.co.uk", "co.uk"},
+		{"example.uk", "uk"},
+		{"example", "example"},
+		{"example.test", "test"},
+		{"kawasaki.jp", "kawasaki.jp"},
+		{"test.kawasaki.jp", "test.kawasaki.jp"},
+		{"www.test.kawasaki.jp", "test.kawasaki.jp"},
+		{"city.kawasaki.jp", "kawasaki.jp"},
+		{"www.city.kawasaki.jp", "kawasaki.jp"},
+		{"ck", "ck"},
+		{"test.ck", "test.ck"},
+		{"b.test.ck", "test.ck"},
+		{"www.ck", "ck"},
+		{"www.www.ck", "ck"},
+
+		// A normal rule followed by a wildcard rule on the same name
+		{"platform.sh", "platform.sh"},
+		{"app.platform.sh", "app.platform.sh"},
+		{"www.app.platform.sh", "app.platform.sh"},
+		{"example.sh", "sh"},
+
+		// A wildcard rule followed by a normal rule, and an exception rule
+		// followed by a normal rule on the same name
+		{"example.net", "example.net"},
+		{"test.example.net", "test.example.net"},
+		{"www.example.net", "example.net"},
+		{"a.www.example.net", "example.net"},
+
+		{"WWW.Example.COM", "com"},
+	}
+
+	for _, tt := range tests {
+		if got := psl.PublicSuffix(tt.domain); got != tt.suffix {
+			t.Errorf("PublicSuffix(%q) = %q, want %q", tt.domain, got, tt.suffix)
+		}
+	}
+}
+
+func TestEffectiveTLDPlusOne(t *testing.T) {
+	psl, e := LoadPublicSuffixList(strings.NewReader(testSuffixList))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	tests := []struct {
+		domain string
+		etld1  string
+	}{
+		{"www.example.com", "example.com"},
+		{"www.example.co.uk", "example.co.uk"},
+		{"www.app.platform.sh", "www.app.platform.sh"},
+		{"a.b.app.platform.sh", "b.app.platform.sh"},
+		{"www.city.kawasaki.jp", "city.kawasaki.jp"},
+		{"a.www.example.net", "www.example.net"},
+	}
+	for _, tt := range tests {
+		if got, e := psl.EffectiveTLDPlusOne(tt.domain); e != nil || got != tt.etld1 {
+			t.Errorf("EffectiveTLDPlusOne(%q) = %q, %v, want %q", tt.domain, got, e, tt.etld1)
+		}
+	}
+
+	for _, domain := range []string{"com", "co.uk", "platform.sh", "app.platform.sh", "test.kawasaki.jp"} {
+		if got, e := psl.EffectiveTLDPlusOne(domain); e == nil {
+			t.Errorf("EffectiveTLDPlusOne(%q) = %q for a public suffix", domain, got)
+		}
+	}
+
+	if _, e := LoadPublicSuffixList(strings.NewReader("// only a comment\n")); e == nil {
+		t.Error("loaded a list without rules")
+	}
+}
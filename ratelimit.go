@@ -0,0 +1,205 @@
+package inetdata
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is the number of requests per second sent to each host, or 0 for
+// no limit, see AddRateLimitFlags
+var RateLimit float64 = 0
+
+// BandwidthLimit is the number of bytes per second read from all hosts, such
+// as 10M, or empty for no limit
+var BandwidthLimit = ""
+
+// The buckets of ApplyRateLimits, nil without limits
+var request_buckets = map[string]*TokenBucket{}
+var request_lock sync.Mutex
+var bandwidth_bucket *TokenBucket
+
+// AddRateLimitFlags registers the -rate-limit and -bandwidth-limit flags of
+// the tools that download from network sources, which are applied to their
+// requests by LimitTransport
+func AddRateLimitFlags() {
+	flag.Float64Var(&RateLimit, "rate-limit", RateLimit, "The maximum number of requests per second to each host, such as 0.5 (0 for no limit)")
+	flag.StringVar(&BandwidthLimit, "bandwidth-limit", BandwidthLimit, "The maximum download rate in bytes per second, with an optional K, M, or G suffix, such as 10M (default no limit)")
+}
+
+// ApplyRateLimits validates the rate limit flags after they are parsed
+func ApplyRateLimits() error {
+	if RateLimit < 0 {
+		return fmt.Errorf("-rate-limit must not be negative")
+	}
+
+	bandwidth_bucket = nil
+	if len(BandwidthLimit) > 0 {
+		n, e := ParseByteSize(BandwidthLimit)
+		if e != nil || n < 1 {
+			return fmt.Errorf("invalid -bandwidth-limit %q", BandwidthLimit)
+		}
+		// A second of transfer may be read at once
+		bandwidth_bucket = NewTokenBucket(float64(n), float64(n))
+	}
+	return nil
+}
+
+// ParseByteSize parses a number of bytes with an optional K, M, or G suffix
+// for kibibytes, mebibytes, or gibibytes, such as 512K or 1.5G
+func ParseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(s, "B")
+
+	mult := 1.0
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+
+	f, e := strconv.ParseFloat(s, 64)
+	if e != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(f * mult), nil
+}
+
+// TokenBucket limits the rate of an operation. Tokens are added at rate per
+// second, up to burst, and each operation takes its cost from the bucket.
+// Operations that find the bucket short wait in the order they arrived.
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+// NewTokenBucket returns a full bucket
+func NewTokenBucket(rate float64, burst float64) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Wait takes n tokens, waiting until they have been added, or returns the
+// error of the context if it is done first. A cost above the burst takes the
+// whole burst.
+func (b *TokenBucket) Wait(ctx context.Context, n float64) error {
+	if n > b.burst {
+		n = b.burst
+	}
+
+	b.lock.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	// The tokens are taken now, so that the next caller waits behind us
+	b.tokens -= n
+	delay := time.Duration(0)
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.lock.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Return the request bucket of a host, or nil without -rate-limit
+func requestBucket(host string) *TokenBucket {
+	if RateLimit <= 0 {
+		return nil
+	}
+
+	request_lock.Lock()
+	defer request_lock.Unlock()
+
+	b, ok := request_buckets[host]
+	if !ok {
+		b = NewTokenBucket(RateLimit, 1)
+		request_buckets[host] = b
+	}
+	return b
+}
+
+type limitedTransport struct {
+	base http.RoundTripper
+}
+
+// LimitTransport wraps a transport, or http.DefaultTransport when nil, so
+// that its requests wait for -rate-limit and its response bodies are read no
+// faster than -bandwidth-limit
+func LimitTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &limitedTransport{base: base}
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if b := requestBucket(req.URL.Host); b != nil {
+		if e := b.Wait(req.Context(), 1); e != nil {
+			return nil, e
+		}
+	}
+
+	resp, e := t.base.RoundTrip(req)
+	if e != nil || bandwidth_bucket == nil {
+		return resp, e
+	}
+	resp.Body = &limitedBody{body: resp.Body, ctx: req.Context(), bucket: bandwidth_bucket}
+	return resp, nil
+}
+
+// A response body that takes a token from the bandwidth bucket for each byte
+type limitedBody struct {
+	body   io.ReadCloser
+	ctx    context.Context
+	bucket *TokenBucket
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if max := int(l.bucket.burst); len(p) > max {
+		p = p[:max]
+	}
+	n, e := l.body.Read(p)
+	if n > 0 {
+		if we := l.bucket.Wait(l.ctx, float64(n)); we != nil && e == nil {
+			e = we
+		}
+	}
+	return n, e
+}
+
+func (l *limitedBody) Close() error {
+	return l.body.Close()
+}
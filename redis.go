@@ -0,0 +1,238 @@
+package inetdata
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RedisURL describes a keyspace as redis://[user:pass@]host:port/db?options,
+// or rediss:// to connect with TLS
+//
+//	prefix    : a prefix for every key (default none)
+//	ttl       : expire keys after this duration (default 0, never)
+//	hash      : write the keys as fields of this hash with HSET instead of
+//	            as string keys with MSET; ttl applies to the whole hash
+//	delimiter : the delimiter between the key and the value (default ,)
+//	batch     : the maximum number of keys per pipeline (default 1000)
+//	linger    : the maximum time to wait for a batch to fill (default 1s)
+//
+// Other options, such as dial_timeout, are passed to the client. This works
+// with any server that speaks the Redis protocol, such as KeyDB.
+type RedisURL struct {
+	Options   *redis.Options
+	Prefix    string
+	TTL       time.Duration
+	Hash      string
+	Delimiter string
+	BatchSize int
+	Linger    time.Duration
+}
+
+// IsRedisURL returns true if the path is a redis:// or rediss:// URL
+func IsRedisURL(path string) bool {
+	return strings.HasPrefix(path, "redis://") || strings.HasPrefix(path, "rediss://")
+}
+
+// ParseRedisURL parses a redis:// URL
+func ParseRedisURL(s string) (*RedisURL, error) {
+	p, e := url.Parse(s)
+	if e != nil || !IsRedisURL(s) {
+		return nil, fmt.Errorf("not a redis URL: %s", s)
+	}
+
+	u := &RedisURL{
+		Delimiter: ",",
+		BatchSize: 1000,
+		Linger:    time.Second,
+	}
+
+	// Remove our options, leaving the client options
+	q := p.Query()
+	for k := range p.Query() {
+		v := q.Get(k)
+		switch k {
+		case "prefix":
+			u.Prefix = v
+		case "ttl":
+			u.TTL, e = time.ParseDuration(v)
+			if e == nil && u.TTL < 0 {
+				e = errors.New("must not be negative")
+			}
+		case "hash":
+			u.Hash = v
+		case "delimiter":
+			u.Delimiter = UnescapeDelimiter(v)
+		case "batch":
+			u.BatchSize, e = strconv.Atoi(v)
+			if e == nil && u.BatchSize < 1 {
+				e = errors.New("must be positive")
+			}
+		case "linger":
+			u.Linger, e = time.ParseDuration(v)
+		default:
+			continue
+		}
+
+		if e != nil {
+			return nil, fmt.Errorf("invalid redis URL option %s=%q: %s", k, v, e)
+		}
+		q.Del(k)
+	}
+
+	p.RawQuery = q.Encode()
+	u.Options, e = redis.ParseURL(p.String())
+	if e != nil {
+		return nil, fmt.Errorf("invalid redis URL: %s", e)
+	}
+
+	return u, nil
+}
+
+type redisWriter struct {
+	sync.Mutex
+	u       *RedisURL
+	client  *redis.Client
+	pending []byte
+	pairs   []interface{}
+	quit    chan bool
+	err     error
+}
+
+// NewRedisWriter connects to Redis and returns a writer that stores each
+// key,value line written to it. Keys are written in pipelines of up to
+// BatchSize keys; writes block while a pipeline is sent.
+func NewRedisWriter(u *RedisURL) (io.WriteCloser, error) {
+	client := redis.NewClient(u.Options)
+
+	if e := client.Ping(context.Background()).Err(); e != nil {
+		client.Close()
+		return nil, e
+	}
+
+	w := &redisWriter{
+		u:      u,
+		client: client,
+		quit:   make(chan bool),
+	}
+
+	// Send partial batches after the linger time
+	go func() {
+		t := time.NewTicker(u.Linger)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				w.Lock()
+				w.flush()
+				w.Unlock()
+			case <-w.quit:
+				return
+			}
+		}
+	}()
+
+	return w, nil
+}
+
+func (w *redisWriter) Write(b []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	w.pending = append(w.pending, b...)
+
+	for {
+		idx := bytes.IndexByte(w.pending, '\n')
+		if idx < 0 {
+			break
+		}
+
+		line := strings.TrimRight(string(w.pending[:idx]), "\r")
+		w.pending = w.pending[idx+1:]
+		if len(line) == 0 {
+			continue
+		}
+
+		bits := strings.SplitN(line, w.u.Delimiter, 2)
+		val := ""
+		if len(bits) > 1 {
+			val = bits[1]
+		}
+		w.pairs = append(w.pairs, w.u.Prefix+bits[0], val)
+
+		if len(w.pairs)/2 >= w.u.BatchSize {
+			if e := w.flush(); e != nil {
+				return 0, e
+			}
+		}
+	}
+
+	return len(b), nil
+}
+
+// Send the buffered keys in one pipeline, the lock must be held
+func (w *redisWriter) flush() error {
+	if len(w.pairs) == 0 || w.err != nil {
+		return w.err
+	}
+
+	pairs := w.pairs
+	w.pairs = nil
+
+	ctx := context.Background()
+	pipe := w.client.Pipeline()
+
+	switch {
+	case len(w.u.Hash) > 0:
+		pipe.HSet(ctx, w.u.Hash, pairs...)
+		if w.u.TTL > 0 {
+			pipe.Expire(ctx, w.u.Hash, w.u.TTL)
+		}
+	case w.u.TTL > 0:
+		// MSET can not set an expiry, so each key is set individually
+		for i := 0; i < len(pairs); i += 2 {
+			pipe.Set(ctx, pairs[i].(string), pairs[i+1], w.u.TTL)
+		}
+	default:
+		pipe.MSet(ctx, pairs...)
+	}
+
+	if _, e := pipe.Exec(ctx); e != nil {
+		w.err = fmt.Errorf("redis write failed: %s", e)
+	}
+	return w.err
+}
+
+// Close sends the remaining keys and closes the connection
+func (w *redisWriter) Close() error {
+	close(w.quit)
+
+	w.Lock()
+	if len(w.pending) > 0 {
+		w.pending = append(w.pending, '\n')
+	}
+	w.Unlock()
+
+	w.Write(nil)
+
+	w.Lock()
+	defer w.Unlock()
+
+	e := w.flush()
+	if ce := w.client.Close(); e == nil {
+		e = ce
+	}
+	return e
+}
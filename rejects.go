@@ -0,0 +1,218 @@
+package inetdata
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The reason codes of rejected lines. Malformed DNS names and values use the
+// codes of dnsname.CheckName and dnsname.CheckValue.
+const REJECT_INVALID_LINE = "invalid-line"
+const REJECT_INVALID_JSON = "invalid-json"
+const REJECT_MISSING_FIELD = "missing-field"
+const REJECT_INVALID_NAME = "invalid-name"
+const REJECT_INVALID_NETWORK = "invalid-network"
+const REJECT_INVALID_KEY = "invalid-key"
+const REJECT_INVALID_ENTRY = "invalid-entry"
+const REJECT_INVALID_CERT = "invalid-cert"
+const REJECT_TOO_LARGE = "too-large"
+
+// EXIT_ERROR_BUDGET is the exit status of a tool that rejected more records
+// than -max-errors or -max-error-rate allow
+const EXIT_ERROR_BUDGET = 3
+
+// RejectsPath is the reject file set with -rejects, see AddRejectFlags
+var RejectsPath = ""
+
+// MaxErrors is the number of rejected records allowed, or -1 for no limit
+var MaxErrors int64 = -1
+
+// MaxErrorRate is the fraction of the input records that may be rejected, or
+// 0 for no limit
+var MaxErrorRate float64 = 0
+
+// The number of records rejected, whether or not they are written to a file
+var rejected_count int64 = 0
+
+// The number of records rejected with each reason code
+var reject_reasons = map[string]int64{}
+var reject_reasons_lock sync.Mutex
+
+// Rejects is the reject file opened by OpenRejects, or nil without -rejects
+var Rejects *RejectWriter
+
+// RejectWriter records the input lines that a tool skips, one per line as
+// the reason code, a tab, and the line, so that the records dropped from a
+// dataset can be audited. A nil RejectWriter discards the lines, so tools can
+// call Reject whether or not a reject file was requested.
+type RejectWriter struct {
+	w     io.WriteCloser
+	z     io.WriteCloser
+	lock  sync.Mutex
+	count int64
+}
+
+// AddRejectFlags registers the -rejects flag, which is opened by OpenRejects,
+// and the -max-errors and -max-error-rate flags of CheckErrorBudget
+func AddRejectFlags() {
+	flag.StringVar(&RejectsPath, "rejects", RejectsPath, "Write rejected input lines with their reason codes to this compressed file (ex: rejects.gz)")
+	flag.Int64Var(&MaxErrors, "max-errors", MaxErrors, "Exit with status 3 if more than this many records are rejected (-1 for no limit)")
+	flag.Float64Var(&MaxErrorRate, "max-error-rate", MaxErrorRate, "Exit with status 3 if more than this fraction of the records are rejected, such as 0.01 (0 for no limit)")
+}
+
+// Return the codec of a reject file from its extension, gzip by default
+func rejectsCompression(path string) string {
+	for _, codec := range []string{"zstd", "lz4"} {
+		if strings.HasSuffix(path, OutputCompressionExtension(codec)) {
+			return codec
+		}
+	}
+	return "gzip"
+}
+
+// CreateRejects opens a reject file, see CreateOutput. The file is compressed
+// with zstd or lz4 when the path has their extension, and with gzip
+// otherwise. An empty path returns a nil RejectWriter.
+func CreateRejects(path string) (*RejectWriter, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+
+	w, e := CreateOutput(path)
+	if e != nil {
+		return nil, e
+	}
+
+	z, e := NewOutputWriter(w, rejectsCompression(path), -1)
+	if e != nil {
+		w.Close()
+		return nil, e
+	}
+	return &RejectWriter{w: w, z: z}, nil
+}
+
+// OpenRejects validates the error budget and opens the -rejects file as
+// Rejects
+func OpenRejects() error {
+	if MaxErrorRate < 0 || MaxErrorRate > 1 {
+		return fmt.Errorf("-max-error-rate must be between 0 and 1")
+	}
+
+	r, e := CreateRejects(RejectsPath)
+	if e != nil {
+		return fmt.Errorf("failed to open the rejects file: %s", e)
+	}
+	Rejects = r
+	return nil
+}
+
+// CloseRejects closes Rejects and reports the number of rejected lines, with
+// the number rejected for each reason
+func CloseRejects() {
+	if n := RejectedCount(); n > 0 {
+		Log.Infof("Rejected %d records%s", n, formatCounts(RejectedReasons()))
+	}
+
+	if Rejects == nil {
+		return
+	}
+
+	if e := Rejects.Close(); e != nil {
+		Log.Warnf("Failed to write the rejects file: %s", e)
+	}
+	if n := Rejects.Count(); n > 0 {
+		Log.Infof("Wrote %d rejected lines to %s", n, RejectsPath)
+	}
+	Rejects = nil
+}
+
+// Reject writes a rejected line with its reason code. Newlines in the line
+// are escaped, so that each rejected record stays on one line.
+func (r *RejectWriter) Reject(reason string, line string) {
+	atomic.AddInt64(&rejected_count, 1)
+
+	reject_reasons_lock.Lock()
+	reject_reasons[reason]++
+	reject_reasons_lock.Unlock()
+
+	if r == nil {
+		return
+	}
+
+	line = strings.Replace(strings.Replace(line, "\r", "\\r", -1), "\n", "\\n", -1)
+
+	r.lock.Lock()
+	io.WriteString(r.z, reason+"\t"+line+"\n")
+	r.lock.Unlock()
+
+	atomic.AddInt64(&r.count, 1)
+}
+
+// Count returns the number of rejected lines
+func (r *RejectWriter) Count() int64 {
+	if r == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&r.count)
+}
+
+// Close flushes and closes the reject file
+func (r *RejectWriter) Close() error {
+	if r == nil {
+		return nil
+	}
+
+	e := r.z.Close()
+	if ce := r.w.Close(); e == nil {
+		e = ce
+	}
+	return e
+}
+
+// RejectedCount returns the number of records rejected so far, including
+// those not written to a reject file
+func RejectedCount() int64 {
+	return atomic.LoadInt64(&rejected_count)
+}
+
+// RejectedReasons returns the number of records rejected so far with each
+// reason code
+func RejectedReasons() map[string]int64 {
+	reject_reasons_lock.Lock()
+	defer reject_reasons_lock.Unlock()
+
+	counts := make(map[string]int64, len(reject_reasons))
+	for r, n := range reject_reasons {
+		counts[r] = n
+	}
+	return counts
+}
+
+// CheckErrorBudget is called once a tool has closed its outputs, with the
+// number of input records. If more records were rejected than -max-errors
+// allows, or a larger fraction of the inputs than -max-error-rate, it exits
+// with EXIT_ERROR_BUDGET, so that a scheduler can tell a corrupted dataset
+// from a successful run with a near-empty output.
+func CheckErrorBudget(inputs int64) {
+	n := RejectedCount()
+
+	if MaxErrors >= 0 && n > MaxErrors {
+		Log.Errorf("Rejected %d records, more than the -max-errors of %d", n, MaxErrors)
+		os.Exit(EXIT_ERROR_BUDGET)
+	}
+
+	// Tools that count input lines rather than records may count fewer
+	if inputs < n {
+		inputs = n
+	}
+	if MaxErrorRate > 0 && n > 0 && float64(n)/float64(inputs) > MaxErrorRate {
+		Log.Errorf("Rejected %d of %d records (%.4f), more than the -max-error-rate of %g",
+			n, inputs, float64(n)/float64(inputs), MaxErrorRate)
+		os.Exit(EXIT_ERROR_BUDGET)
+	}
+}
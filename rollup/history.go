@@ -0,0 +1,94 @@
+package rollup
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Seen is the first and last timestamps at which a value was observed
+type Seen struct {
+	First string
+	Last  string
+}
+
+// CompareTimestamps compares two timestamps numerically when both parse as
+// integers, such as Unix times, lexically otherwise, which orders RFC 3339
+// timestamps of the same time zone
+func CompareTimestamps(a string, b string) int {
+	ai, ae := strconv.ParseInt(a, 10, 64)
+	bi, be := strconv.ParseInt(b, 10, 64)
+	if ae == nil && be == nil {
+		switch {
+		case ai < bi:
+			return -1
+		case ai > bi:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+// Add widens the span to include a timestamp
+func (s *Seen) Add(ts string) {
+	if len(s.First) == 0 || CompareTimestamps(ts, s.First) < 0 {
+		s.First = ts
+	}
+	if len(s.Last) == 0 || CompareTimestamps(ts, s.Last) > 0 {
+		s.Last = ts
+	}
+}
+
+// History tracks the first and last timestamps of each value of a key, as in
+// passive DNS. Memory grows with the number of unique values, not records.
+type History struct {
+	Key  string
+	seen map[string]*Seen
+}
+
+// NewHistory returns an empty history for a key
+func NewHistory(key string) *History {
+	return &History{Key: key, seen: make(map[string]*Seen)}
+}
+
+// Add records that a value was seen at a timestamp
+func (h *History) Add(ts string, val string) {
+	s, ok := h.seen[val]
+	if !ok {
+		s = &Seen{}
+		h.seen[val] = s
+	}
+	s.Add(ts)
+}
+
+// Len returns the number of unique values
+func (h *History) Len() int {
+	return len(h.seen)
+}
+
+// Values returns each unique value as first, last, and value joined by the
+// delimiter, ordered by value using one of the SORT_VALUES modes. Values are
+// ordered by when they were first seen with SORT_VALUES_NONE.
+func (h *History) Values(sort_mode int, delimiter string) []string {
+	vals := make([]string, 0, len(h.seen))
+	for v := range h.seen {
+		vals = append(vals, v)
+	}
+
+	if sort_mode == SORT_VALUES_NONE {
+		SortValues(vals, SORT_VALUES_LEXICAL)
+		sort.SliceStable(vals, func(i, j int) bool {
+			return CompareTimestamps(h.seen[vals[i]].First, h.seen[vals[j]].First) < 0
+		})
+	} else {
+		SortValues(vals, sort_mode)
+	}
+
+	out := make([]string, len(vals))
+	for i, v := range vals {
+		s := h.seen[v]
+		out[i] = s.First + delimiter + s.Last + delimiter + v
+	}
+	return out
+}
@@ -0,0 +1,310 @@
+// Package rollup merges or aggregates the values of sorted key, value records
+// the same way as inetdata-csvrollup.
+package rollup
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Warnf reports values that can not be aggregated. It writes to stderr, and
+// the tools replace it with their logger.
+var Warnf = func(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "[-] "+format+"\n", args...)
+}
+
+const AGG_MODE_MERGE = 0
+const AGG_MODE_COUNT = 1
+const AGG_MODE_FIRST = 2
+const AGG_MODE_LAST = 3
+const AGG_MODE_MIN = 4
+const AGG_MODE_MAX = 5
+const AGG_MODE_SUM = 6
+
+// AggModes maps the names accepted by csvrollup -agg to aggregation modes
+var AggModes = map[string]int{
+	"merge": AGG_MODE_MERGE,
+	"count": AGG_MODE_COUNT,
+	"first": AGG_MODE_FIRST,
+	"last":  AGG_MODE_LAST,
+	"min":   AGG_MODE_MIN,
+	"max":   AGG_MODE_MAX,
+	"sum":   AGG_MODE_SUM,
+}
+
+const SORT_VALUES_NONE = 0
+const SORT_VALUES_LEXICAL = 1
+const SORT_VALUES_NUMERIC = 2
+
+// Parse a value as a number, NaN is not one since it does not compare
+func parseNumber(v string) (float64, bool) {
+	f, e := strconv.ParseFloat(v, 64)
+	return f, e == nil && !math.IsNaN(f)
+}
+
+// CompareValues compares two values with numbers first, by value, followed by
+// the other values in byte order. Numbers with the same value, such as 1 and
+// 1.0, are compared in byte order, so that the order is total.
+func CompareValues(a string, b string) int {
+	af, an := parseNumber(a)
+	bf, bn := parseNumber(b)
+	switch {
+	case an && bn:
+		if af < bf {
+			return -1
+		}
+		if af > bf {
+			return 1
+		}
+	case an:
+		return -1
+	case bn:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// Compare two fields with IP addresses first, IPv4 before IPv6, followed by
+// numbers and other values as in CompareValues
+func compareField(a string, b string) int {
+	aip, bip := net.ParseIP(a), net.ParseIP(b)
+	switch {
+	case aip != nil && bip != nil:
+		a4, b4 := aip.To4() != nil, bip.To4() != nil
+		if a4 != b4 {
+			if a4 {
+				return -1
+			}
+			return 1
+		}
+		if c := bytes.Compare(aip.To16(), bip.To16()); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	case aip != nil:
+		return -1
+	case bip != nil:
+		return 1
+	}
+	return CompareValues(a, b)
+}
+
+// CompareNumeric compares two merged values field by field, where fields are
+// separated by commas. IP addresses sort before numbers, which sort before
+// other fields, and IP addresses and numbers are compared by value, so that
+// 10.0.0.2 sorts before 10.0.0.10 and a,9 before a,10. Keeping each kind of
+// field apart makes the order total, so sorting gives the same order for any
+// order of the input.
+func CompareNumeric(a string, b string) int {
+	af := strings.Split(a, ",")
+	bf := strings.Split(b, ",")
+
+	for i := 0; i < len(af) && i < len(bf); i++ {
+		if c := compareField(af[i], bf[i]); c != 0 {
+			return c
+		}
+	}
+
+	// The fields are the same, so fewer fields sort first
+	return len(af) - len(bf)
+}
+
+// SortValues sorts values in place using one of the SORT_VALUES modes
+func SortValues(vals []string, mode int) {
+	switch mode {
+	case SORT_VALUES_LEXICAL:
+		sort.Strings(vals)
+	case SORT_VALUES_NUMERIC:
+		sort.Slice(vals, func(i, j int) bool { return CompareNumeric(vals[i], vals[j]) < 0 })
+	}
+}
+
+// Aggregator aggregates the values of a key as they arrive, so that keys with
+// any number of values use constant memory
+type Aggregator struct {
+	Key   string
+	Mode  int
+	count int
+	res   string
+	sum   float64
+}
+
+// NewAggregator returns an aggregator for the values of a key
+func NewAggregator(key string, mode int) *Aggregator {
+	return &Aggregator{Key: key, Mode: mode}
+}
+
+// Add a value. Non-numeric values are reported and ignored by AGG_MODE_SUM.
+func (a *Aggregator) Add(v string) {
+	a.count++
+
+	switch a.Mode {
+	case AGG_MODE_FIRST:
+		if a.count == 1 {
+			a.res = v
+		}
+
+	case AGG_MODE_LAST:
+		a.res = v
+
+	case AGG_MODE_MIN, AGG_MODE_MAX:
+		if a.count == 1 {
+			a.res = v
+			return
+		}
+		c := CompareValues(v, a.res)
+		if (a.Mode == AGG_MODE_MIN && c < 0) || (a.Mode == AGG_MODE_MAX && c > 0) {
+			a.res = v
+		}
+
+	case AGG_MODE_SUM:
+		f, e := strconv.ParseFloat(v, 64)
+		if e != nil {
+			Warnf("Non-numeric value for key %q: %q", a.Key, v)
+			return
+		}
+		a.sum += f
+	}
+}
+
+// Result returns the aggregated value
+func (a *Aggregator) Result() string {
+	switch a.Mode {
+	case AGG_MODE_COUNT:
+		return strconv.Itoa(a.count)
+	case AGG_MODE_SUM:
+		return strconv.FormatFloat(a.sum, 'f', -1, 64)
+	}
+	return a.res
+}
+
+// Aggregate returns the aggregate of all the values of a key
+func Aggregate(key string, vals []string, mode int) string {
+	a := NewAggregator(key, mode)
+	for _, v := range vals {
+		a.Add(v)
+	}
+	return a.Result()
+}
+
+// CleanDNSValue cleans up common scan artifacts in a type,value DNS record
+// value of a name, returning false for records that should be ignored: empty
+// values, values identical to the key (except NS records), and mangled TXT
+// records. This is not comprehensive.
+func CleanDNSValue(key string, val string) (string, bool) {
+	if len(val) >= len(key) {
+		parts := strings.SplitN(val, ",", 2)
+		if len(parts) == 2 && parts[0] != "ns" {
+			if len(parts[1]) == 0 || key == parts[1] {
+				return "", false
+			}
+		}
+	}
+
+	// TXT records start with an erroneous pipe character
+	if len(val) > 5 && val[0:5] == "txt,|" {
+		val = "txt," + val[5:]
+	}
+
+	// DNSSEC-related TXT records often have trailing bytes
+	if len(val) >= 38 && (val[0:6] == "txt,31" || val[0:6] == "txt,00" || val[0:6] == "txt,aa") {
+		val = val[0:38]
+	}
+
+	// Mangled TXT value, ignore
+	if len(val) >= 5 && len(val) <= 10 && val[0:5] == "txt,~" {
+		return "", false
+	}
+
+	return val, true
+}
+
+// Rollup combines the values of each key. Values may themselves hold several
+// values joined by the Separator, as in the output of an earlier rollup.
+type Rollup struct {
+	// The aggregation mode, AGG_MODE_MERGE by default
+	Mode int
+
+	// The order of merged values, SORT_VALUES_NONE by default
+	Sort int
+
+	// The separator between merged values
+	Separator string
+
+	// Called with each key and its combined values by Add and Flush
+	Emit func(key string, vals []string) error
+
+	key  string
+	vals []string
+}
+
+// New returns a rollup that merges values joined by the separator
+func New(mode int, sort_mode int, separator string) *Rollup {
+	return &Rollup{Mode: mode, Sort: sort_mode, Separator: separator}
+}
+
+// Values returns the combined values of a key: the unique values in merge
+// mode, otherwise a single aggregate value. Nil is returned if there are no
+// values.
+func (r *Rollup) Values(key string, vals []string) []string {
+	if r.Mode != AGG_MODE_MERGE {
+		split := []string{}
+		for i := range vals {
+			split = append(split, strings.Split(vals[i], r.Separator)...)
+		}
+		if len(split) == 0 {
+			return nil
+		}
+		return []string{Aggregate(key, split, r.Mode)}
+	}
+
+	unique := map[string]bool{}
+	for i := range vals {
+		for _, v := range strings.Split(vals[i], r.Separator) {
+			unique[v] = true
+		}
+	}
+	if len(unique) == 0 {
+		return nil
+	}
+
+	out := make([]string, 0, len(unique))
+	for v := range unique {
+		out = append(out, v)
+	}
+	SortValues(out, r.Sort)
+	return out
+}
+
+// Add a record of a key sorted input. Each key is emitted with its combined
+// values once a record with a different key is added.
+func (r *Rollup) Add(key string, val string) error {
+	if key != r.key {
+		if e := r.Flush(); e != nil {
+			return e
+		}
+		r.key = key
+	}
+	r.vals = append(r.vals, val)
+	return nil
+}
+
+// Flush emits the current key, which must be called after the last record
+func (r *Rollup) Flush() error {
+	if len(r.vals) == 0 {
+		return nil
+	}
+
+	key, vals := r.key, r.Values(r.key, r.vals)
+	r.vals = nil
+	if vals == nil || r.Emit == nil {
+		return nil
+	}
+	return r.Emit(key, vals)
+}
@@ -0,0 +1,77 @@
+package rollup
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestCompareNumeric(t *testing.T) {
+	// Each value sorts before the next
+	ordered := []string{
+		"10.0.0.2",
+		"10.0.0.10",
+		"::1",
+		"2001:db8::1",
+		"-1",
+		"9",
+		"9.0",
+		"10",
+		"1e3",
+		"10a",
+		"1a",
+		"9a",
+		"NaN",
+		"a",
+		"a,9",
+		"a,10",
+		"a,10,1",
+		"a,1a",
+		"b",
+	}
+
+	for i := range ordered {
+		for j := range ordered {
+			c := CompareNumeric(ordered[i], ordered[j])
+			switch {
+			case i < j && c >= 0, i > j && c <= 0, i == j && c != 0:
+				t.Errorf("CompareNumeric(%q, %q) = %d", ordered[i], ordered[j], c)
+			}
+		}
+	}
+}
+
+func TestSortValuesDeterministic(t *testing.T) {
+	// Numbers and values that are not numbers, compared by value and by bytes
+	// alone, do not have a total order: 9 < 10, "10" < "1a", and "1a" < "9"
+	vals := []string{"9", "10", "1a", "1", "1.0", "2001:db8::1", "192.0.2.1", "a,10", "a,9", "a,x", "NaN", "inf"}
+
+	for _, mode := range []int{SORT_VALUES_LEXICAL, SORT_VALUES_NUMERIC} {
+		want := ""
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 200; i++ {
+			r.Shuffle(len(vals), func(i, j int) { vals[i], vals[j] = vals[j], vals[i] })
+			SortValues(vals, mode)
+			got := strings.Join(vals, " ")
+			if i == 0 {
+				want = got
+			} else if got != want {
+				t.Fatalf("mode %d sorted the values as %q, and before as %q", mode, got, want)
+			}
+		}
+	}
+}
+
+func TestAggregatorMinMax(t *testing.T) {
+	for _, order := range [][]string{{"9", "10", "1a"}, {"1a", "10", "9"}, {"10", "1a", "9"}} {
+		min := NewAggregator("k", AGG_MODE_MIN)
+		max := NewAggregator("k", AGG_MODE_MAX)
+		for _, v := range order {
+			min.Add(v)
+			max.Add(v)
+		}
+		if min.Result() != "9" || max.Result() != "1a" {
+			t.Errorf("the min and max of %v are %q and %q, want 9 and 1a", order, min.Result(), max.Result())
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package inetdata
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The time format of the periods in the names of rotated files
+const ROTATE_TIME_FORMAT = "20060102T150405Z"
+
+// RotatingOutput writes to a series of local files, one per period of time
+// such as an hour, which are compressed with an output codec. Each file is
+// written with a .part suffix, which is removed once its period ends, so a
+// file without the suffix is complete and may be picked up by another job.
+// Files are named by a template, where {time} is the UTC start of the period,
+// see RotatedName.
+type RotatingOutput struct {
+	template string
+	period   time.Duration
+	codec    string
+	level    int
+
+	fd   *os.File
+	z    io.WriteCloser
+	buf  *bufio.Writer
+	name string
+	end  time.Time
+
+	lock sync.Mutex
+	done chan bool
+	err  error
+}
+
+// NewRotatingOutput returns an output that rotates its files every period. The
+// first file is created on the first write, and files are closed at the end
+// of their period even when no records arrive.
+func NewRotatingOutput(template string, period time.Duration, codec string, level int) (*RotatingOutput, error) {
+	if len(template) == 0 || template == "-" || IsRemotePath(template) {
+		return nil, fmt.Errorf("rotated outputs must be local files: %q", template)
+	}
+	if period < time.Second {
+		return nil, fmt.Errorf("the rotation period must be at least 1s")
+	}
+	if !ValidOutputCompression(codec) {
+		return nil, fmt.Errorf("unsupported output compression: %s", codec)
+	}
+
+	r := &RotatingOutput{template: template, period: period, codec: codec, level: level, done: make(chan bool)}
+	go r.rotator()
+	return r, nil
+}
+
+// RotatedName returns the name of the file of a period. The {time} in the
+// template is replaced with the start of the period, or the time is added
+// before the extension of a template without it, such that ct.jsonl becomes
+// ct-20060102T150405Z.jsonl. The extension of the codec is added unless the
+// template already ends with it.
+func RotatedName(template string, start time.Time, codec string) string {
+	stamp := start.UTC().Format(ROTATE_TIME_FORMAT)
+
+	name := template
+	if strings.Contains(name, "{time}") {
+		name = strings.Replace(name, "{time}", stamp, -1)
+	} else {
+		dir, base := filepath.Split(name)
+		if i := strings.Index(base, "."); i > 0 {
+			base = base[:i] + "-" + stamp + base[i:]
+		} else {
+			base = base + "-" + stamp
+		}
+		name = dir + base
+	}
+
+	if ext := OutputCompressionExtension(codec); !strings.HasSuffix(name, ext) {
+		name += ext
+	}
+	return name
+}
+
+// Return true if a file or its partial file exists
+func rotatedExists(name string) bool {
+	for _, path := range []string{name, name + ".part"} {
+		if _, e := os.Stat(path); e == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Open the file of the current period. A file left by an earlier run in the
+// same period is kept, and the new file is numbered after it.
+func (r *RotatingOutput) open() error {
+	start := time.Now().UTC().Truncate(r.period)
+
+	name := RotatedName(r.template, start, r.codec)
+	ext := OutputCompressionExtension(r.codec)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; rotatedExists(name); i++ {
+		name = fmt.Sprintf("%s.%d%s", base, i, ext)
+	}
+
+	if dir := filepath.Dir(name); dir != "." {
+		if e := os.MkdirAll(dir, 0755); e != nil {
+			return e
+		}
+	}
+
+	fd, e := os.Create(name + ".part")
+	if e != nil {
+		return e
+	}
+
+	z, e := NewOutputWriter(fd, r.codec, r.level)
+	if e != nil {
+		fd.Close()
+		os.Remove(name + ".part")
+		return e
+	}
+
+	r.fd = fd
+	r.z = z
+	r.buf = bufio.NewWriterSize(z, 1024*1024)
+	r.name = name
+	r.end = start.Add(r.period)
+	return nil
+}
+
+// Flush the buffer and the compressor of the current file
+func (r *RotatingOutput) flush() error {
+	if r.fd == nil {
+		return nil
+	}
+	if e := r.buf.Flush(); e != nil {
+		return e
+	}
+	if f, ok := r.z.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Close the current file and remove its .part suffix
+func (r *RotatingOutput) finish() error {
+	if r.fd == nil {
+		return nil
+	}
+
+	e := r.buf.Flush()
+	if ce := r.z.Close(); e == nil {
+		e = ce
+	}
+	if FsyncOnClose && e == nil {
+		e = r.fd.Sync()
+	}
+	if ce := r.fd.Close(); e == nil {
+		e = ce
+	}
+	if e == nil {
+		e = os.Rename(r.name+".part", r.name)
+	}
+	if e == nil {
+		Log.Debugf("Rotated %s", r.name)
+	}
+
+	r.fd = nil
+	r.z = nil
+	r.buf = nil
+	return e
+}
+
+// Close the file of a period that has ended, so that idle periods do not
+// leave a file open until the next record
+func (r *RotatingOutput) rotator() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			r.lock.Lock()
+			if r.fd != nil && r.err == nil && !time.Now().Before(r.end) {
+				if e := r.finish(); e != nil {
+					Log.Warnf("Failed to rotate %s: %s", r.name, e)
+					r.err = e
+				}
+			}
+			r.lock.Unlock()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *RotatingOutput) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	if r.fd != nil && !time.Now().Before(r.end) {
+		if e := r.finish(); e != nil {
+			r.err = e
+			return 0, e
+		}
+	}
+
+	if r.fd == nil {
+		if e := r.open(); e != nil {
+			r.err = e
+			return 0, e
+		}
+	}
+	return r.buf.Write(p)
+}
+
+// Flush writes the buffered records to the current file, as a complete block
+// of its codec
+func (r *RotatingOutput) Flush() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+	if e := r.flush(); e != nil {
+		r.err = e
+	}
+	return r.err
+}
+
+// Close closes the current file, which is renamed to its final name even
+// though its period has not ended
+func (r *RotatingOutput) Close() error {
+	if r.done != nil {
+		close(r.done)
+		r.done = nil
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	e := r.finish()
+	if r.err != nil {
+		return r.err
+	}
+	return e
+}
@@ -0,0 +1,317 @@
+package inetdata
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers/pipeline"
+	"hash/fnv"
+	"io"
+	"math"
+	"strings"
+)
+
+// SampleRate is the fraction of keys to keep, set with -sample-rate
+var SampleRate = 1.0
+
+// SampleLimit is the number of lines to keep before the input ends, set with
+// -limit, 0 keeps all lines
+var SampleLimit int64 = 0
+
+// SampleSkip is the number of input lines to skip, set with -skip
+var SampleSkip int64 = 0
+
+// KeyDelimiter ends the key of input lines that are sampled or filtered, set
+// with -key-delimiter
+var KeyDelimiter = ","
+
+// SampleKeyPaths are the comma-separated dotted paths of the key of JSON input
+// lines, set with -sample-key by the tools that register AddJSONSampleFlags.
+// The key of a record is the first path that it has, and an empty list keys
+// each record by its whole line.
+var SampleKeyPaths = ""
+
+// The parsed SampleKeyPaths of a JSON input, or nil for delimited lines
+var sample_key_paths [][]string
+
+// Set by AddJSONSampleFlags for tools whose input lines are JSON records
+var sample_json = false
+
+// AddSampleFlags registers the flags that select and rewrite the lines of line
+// inputs: -skip, -limit, -sample-rate, -key-delimiter, -filter-key,
+// -filter-value, -filter, and -transform, see NewSampler, NewRecordFilter, and
+// NewInputTransformer
+func AddSampleFlags() {
+	flag.StringVar(&KeyDelimiter, "key-delimiter", KeyDelimiter, "The delimiter after the key of each line for -sample-rate and the filters, lines without it are all key")
+	addSampleFlags()
+}
+
+// AddJSONSampleFlags registers the sampling flags of AddSampleFlags for JSON
+// line inputs, which take the key of each record for -sample-rate and
+// -filter-key from the -sample-key fields instead of -key-delimiter. The keys
+// are the default -sample-key paths, such as "name" for Sonar DNS records.
+func AddJSONSampleFlags(keys string) {
+	sample_json = true
+	SampleKeyPaths = keys
+	flag.StringVar(&SampleKeyPaths, "sample-key", SampleKeyPaths, "The comma-separated JSON field paths of the key of each record for -sample-rate and -filter-key, the first one present is used (ex: data.name)")
+	addSampleFlags()
+}
+
+func addSampleFlags() {
+	flag.Float64Var(&SampleRate, "sample-rate", SampleRate, "Only process the lines of this fraction of keys, chosen by the hash of the key (ex: 0.01)")
+	flag.Int64Var(&SampleLimit, "limit", SampleLimit, "Stop reading the input after this many lines are processed (0 reads all lines)")
+	flag.Int64Var(&SampleSkip, "skip", SampleSkip, "Skip this many lines at the start of the input")
+	flag.StringVar(&FilterKey, "filter-key", FilterKey, "Only process the lines whose key matches this regular expression")
+	flag.StringVar(&FilterValue, "filter-value", FilterValue, "Only process the lines whose value (the rest of the line after the key) matches this regular expression")
+	flag.StringVar(&FilterExpr, "filter", FilterExpr, "Only process the lines for which this expression is true (ex: 'len(key) > 3 && value contains \".gov\"')")
+	flag.StringVar(&TransformScript, "transform", TransformScript, "Rewrite each kept line with these ;-separated assignments, or a registered plugin:<name>[:<arg>] (ex: 'key = lower(key); f3 = \"\"')")
+}
+
+// ValidSampleFlags returns an error if the sampling flags are out of range or
+// a filter or transform does not compile
+func ValidSampleFlags() error {
+	if SampleRate <= 0 || SampleRate > 1 {
+		return fmt.Errorf("-sample-rate must be greater than 0 and at most 1")
+	}
+	if SampleLimit < 0 || SampleSkip < 0 {
+		return fmt.Errorf("-limit and -skip must not be negative")
+	}
+	KeyDelimiter = UnescapeDelimiter(KeyDelimiter)
+	if len(KeyDelimiter) == 0 {
+		return fmt.Errorf("-key-delimiter must not be empty")
+	}
+	sample_key_paths = nil
+	if sample_json {
+		sample_key_paths = [][]string{}
+		for _, path := range strings.Split(SampleKeyPaths, ",") {
+			path = strings.TrimSpace(path)
+			if len(path) == 0 {
+				continue
+			}
+			sample_key_paths = append(sample_key_paths, strings.Split(path, "."))
+		}
+	}
+	if _, e := NewRecordFilter(); e != nil {
+		return e
+	}
+	_, e := NewInputTransformer()
+	return e
+}
+
+// Sampler selects the lines of an input with the sampling flags: the first
+// -skip lines are dropped, then the lines that pass the filters and whose key
+// hashes below -sample-rate are kept, until -limit lines are kept. Since the
+// decision only depends on the key, the lines of a key are kept or dropped
+// together, in every input and every run. The key is the text before the
+// first -key-delimiter, or for JSON inputs the -sample-key field, see
+// RecordKey. A Sampler is not safe for concurrent use.
+//
+// The lines that are kept are then rewritten by the -transform transformer, if
+// any, which sees the lines without their line endings.
+type Sampler struct {
+	filter    *RecordFilter
+	transform pipeline.Transformer
+	delimiter []byte
+	paths     [][]string
+	threshold uint64
+	hash      bool
+	skip      int64
+	limit     int64
+	kept      int64
+}
+
+// NewSampler returns a sampler of the sampling, filter, and transform flags,
+// or nil if they keep every line as-is. The flags must have been checked with
+// ValidSampleFlags.
+func NewSampler() *Sampler {
+	filter, _ := NewRecordFilter()
+	transform, _ := NewInputTransformer()
+	if SampleRate >= 1 && SampleLimit == 0 && SampleSkip == 0 && filter == nil && transform == nil {
+		return nil
+	}
+
+	s := &Sampler{
+		filter:    filter,
+		transform: transform,
+		delimiter: []byte(KeyDelimiter),
+		paths:     sample_key_paths,
+		hash:      SampleRate < 1,
+		skip:      SampleSkip,
+		limit:     SampleLimit,
+	}
+	if s.hash {
+		s.threshold = uint64(SampleRate * math.MaxUint64)
+	}
+	return s
+}
+
+// Keep returns whether to keep a line, and false for more once the limit is
+// reached and no further lines will be kept
+func (s *Sampler) Keep(line []byte) (keep bool, more bool) {
+	if s.limit > 0 && s.kept >= s.limit {
+		return false, false
+	}
+
+	if s.skip > 0 {
+		s.skip--
+		return false, true
+	}
+
+	if s.filter != nil && !s.filter.Match(string(bytes.TrimRight(line, "\r\n"))) {
+		return false, true
+	}
+
+	if s.hash {
+		key, _ := RecordKey(bytes.TrimRight(line, "\r\n"), s.delimiter, s.paths)
+
+		h := fnv.New64a()
+		h.Write(key)
+		if h.Sum64() >= s.threshold {
+			return false, true
+		}
+	}
+
+	s.kept++
+	return true, s.limit == 0 || s.kept < s.limit
+}
+
+// RecordKey splits a line, without its line ending, into the key that it is
+// sampled and filtered by and its value. The key of a delimited line is the
+// text before the first delimiter and the value is the rest of the line. With
+// JSON paths, the key is the value of the first path that the record has,
+// unquoted if it is a string, and the value is the whole line. A record that
+// has none of the paths, or is not a JSON object, has an empty key, and an
+// empty list of paths keys a record by the whole line.
+func RecordKey(line []byte, delimiter []byte, paths [][]string) (key []byte, value []byte) {
+	if paths == nil {
+		if i := bytes.Index(line, delimiter); i >= 0 {
+			return line[:i], line[i+len(delimiter):]
+		}
+		return line, nil
+	}
+
+	if len(paths) == 0 {
+		return line, line
+	}
+
+	for _, path := range paths {
+		if v, ok := jsonPath(line, path); ok {
+			return v, line
+		}
+	}
+	return []byte{}, line
+}
+
+// Return the raw value of a dotted path of a JSON object, unquoted if it is a
+// string
+func jsonPath(raw []byte, path []string) ([]byte, bool) {
+	for _, name := range path {
+		var obj map[string]json.RawMessage
+		if e := json.Unmarshal(raw, &obj); e != nil {
+			return nil, false
+		}
+		v, ok := obj[name]
+		if !ok {
+			return nil, false
+		}
+		raw = v
+	}
+
+	if len(raw) > 0 && raw[0] == '"' {
+		var s string
+		if e := json.Unmarshal(raw, &s); e != nil {
+			return nil, false
+		}
+		return []byte(s), true
+	}
+	return raw, true
+}
+
+// KeepString is Keep for a line read as a string
+func (s *Sampler) KeepString(line string) (keep bool, more bool) {
+	return s.Keep([]byte(line))
+}
+
+// Transform returns the lines that a kept line is rewritten to, each with a
+// trailing newline. Lines that fail to transform are reported to stderr and
+// the rejects file, and dropped.
+func (s *Sampler) Transform(line []byte) []byte {
+	if s.transform == nil {
+		return line
+	}
+
+	raw := bytes.TrimRight(line, "\r\n")
+	recs, e := s.transform.Transform(raw)
+	if e != nil {
+		Log.Warnf("Transform failed for %q: %s", raw, e)
+		Rejects.Reject(REJECT_INVALID_LINE, string(raw))
+		return nil
+	}
+
+	out := []byte{}
+	for _, rec := range recs {
+		out = append(out, rec...)
+		out = append(out, '\n')
+	}
+	return out
+}
+
+type sampleReader struct {
+	r    *bufio.Reader
+	c    io.Closer
+	s    *Sampler
+	buf  []byte
+	done bool
+}
+
+// NewSampleReader returns a reader of the lines of r that the sampling flags
+// keep, which ends once -limit lines are read. It returns r itself when the
+// flags keep every line.
+func NewSampleReader(r io.Reader) io.Reader {
+	s := NewSampler()
+	if s == nil {
+		return r
+	}
+	sr := &sampleReader{r: bufio.NewReaderSize(r, ReaderBuffer), s: s}
+	if c, ok := r.(io.Closer); ok {
+		sr.c = c
+	}
+	return sr
+}
+
+func (r *sampleReader) Read(b []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		line, err := r.r.ReadBytes('\n')
+		if len(line) > 0 {
+			keep, more := r.s.Keep(line)
+			if keep {
+				r.buf = r.s.Transform(line)
+			}
+			r.done = !more
+		}
+
+		if err == io.EOF {
+			r.done = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Close closes the underlying reader, if it can be closed
+func (r *sampleReader) Close() error {
+	if r.c == nil {
+		return nil
+	}
+	return r.c.Close()
+}
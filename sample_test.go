@@ -0,0 +1,100 @@
+package inetdata
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Set the sampling flags of a JSON input for a test, restoring them after
+func setJSONSampleFlags(t *testing.T, keys string, rate float64) {
+	saved_json, saved_keys, saved_rate := sample_json, SampleKeyPaths, SampleRate
+	t.Cleanup(func() {
+		sample_json, SampleKeyPaths, SampleRate = saved_json, saved_keys, saved_rate
+		sample_key_paths = nil
+	})
+
+	sample_json, SampleKeyPaths, SampleRate = true, keys, rate
+	if e := ValidSampleFlags(); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestRecordKey(t *testing.T) {
+	tests := []struct {
+		line  string
+		paths [][]string
+		key   string
+		value string
+	}{
+		{"www.example.com,a,192.0.2.1", nil, "www.example.com", "a,192.0.2.1"},
+		{"www.example.com", nil, "www.example.com", ""},
+		{`{"name":"www.example.com","type":"a"}`, [][]string{{"name"}}, "www.example.com", `{"name":"www.example.com","type":"a"}`},
+		{`{"data":{"name":"www.example.com"}}`, [][]string{{"data", "name"}}, "www.example.com", `{"data":{"name":"www.example.com"}}`},
+		{`{"names":["a.example.com","b.example.com"]}`, [][]string{{"leaf_input"}, {"names"}}, `["a.example.com","b.example.com"]`, `{"names":["a.example.com","b.example.com"]}`},
+		{`{"port":443}`, [][]string{{"port"}}, "443", `{"port":443}`},
+		{`{"type":"a"}`, [][]string{{"name"}}, "", `{"type":"a"}`},
+		{`{"data":"www.example.com"}`, [][]string{{"data", "name"}}, "", `{"data":"www.example.com"}`},
+		{`not json`, [][]string{{"name"}}, "", `not json`},
+		{`{"name":"www.example.com"}`, [][]string{}, `{"name":"www.example.com"}`, `{"name":"www.example.com"}`},
+	}
+
+	for _, tt := range tests {
+		key, value := RecordKey([]byte(tt.line), []byte(","), tt.paths)
+		if string(key) != tt.key || string(value) != tt.value {
+			t.Errorf("RecordKey(%q, %v) = %q, %q, want %q, %q", tt.line, tt.paths, key, value, tt.key, tt.value)
+		}
+	}
+}
+
+func TestSamplerJSONKey(t *testing.T) {
+	setJSONSampleFlags(t, "name", 0.5)
+
+	s := NewSampler()
+	if s == nil {
+		t.Fatal("NewSampler returned nil with -sample-rate 0.5")
+	}
+
+	// The records of a name differ before the first comma, so keying them by
+	// the delimiter would sample each record on its own
+	kept_names := 0
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("host%d.example.com", i)
+		kept := 0
+		for j := 0; j < 4; j++ {
+			line := fmt.Sprintf(`{"timestamp":"%d","name":"%s","type":"a","value":"192.0.2.%d"}`+"\n", 1600000000+j, name, j)
+			if keep, _ := s.Keep([]byte(line)); keep {
+				kept++
+			}
+		}
+		if kept != 0 && kept != 4 {
+			t.Fatalf("kept %d of the 4 records of %s, want all or none", kept, name)
+		}
+		if kept == 4 {
+			kept_names++
+		}
+	}
+
+	if kept_names < 60 || kept_names > 140 {
+		t.Errorf("kept %d of 200 names at -sample-rate 0.5", kept_names)
+	}
+}
+
+func TestRecordFilterJSONKey(t *testing.T) {
+	saved := FilterKey
+	defer func() { FilterKey = saved }()
+	FilterKey = `\.gov$`
+
+	setJSONSampleFlags(t, "name", 1)
+
+	f, e := NewRecordFilter()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if !f.Match(`{"timestamp":"1","name":"www.example.gov","type":"a"}`) {
+		t.Error("the filter did not match the name of a record")
+	}
+	if f.Match(`{"timestamp":"1","name":"www.example.com","type":"a","value":"x.gov"}`) {
+		t.Error("the filter matched a record by a field other than its key")
+	}
+}
@@ -0,0 +1,87 @@
+package inetdata
+
+import (
+	"flag"
+	"fmt"
+)
+
+// SelectFields is the -select list of fields to keep, in output order
+var SelectFields = ""
+
+// DropFields is the -drop-fields list of fields to remove
+var DropFields = ""
+
+// AddSelectFlags registers the -select and -drop-fields flags of the CSV
+// tools, see NewFieldSelector
+func AddSelectFlags() {
+	flag.StringVar(&SelectFields, "select", SelectFields, "Only keep these comma-separated fields of each input line, in this order, before processing it (ex: 1,3,2)")
+	flag.StringVar(&DropFields, "drop-fields", DropFields, "Remove these comma-separated fields from each input line before processing it (ex: 4,5)")
+}
+
+// FieldSelector projects and reorders the fields of input lines with the
+// -select and -drop-fields flags, so that the rest of a tool sees the fields
+// as if the input had been rewritten with cut. In strict mode, the selected
+// fields are quoted again as needed.
+type FieldSelector struct {
+	splitter *FieldSplitter
+	keep     []int
+	drop     map[int]bool
+}
+
+// NewFieldSelector returns a selector of the -select and -drop-fields flags
+// for lines split with the splitter, or nil if neither is set
+func NewFieldSelector(splitter *FieldSplitter) (*FieldSelector, error) {
+	if len(SelectFields) == 0 && len(DropFields) == 0 {
+		return nil, nil
+	}
+	if len(SelectFields) > 0 && len(DropFields) > 0 {
+		return nil, fmt.Errorf("-select and -drop-fields are mutually exclusive")
+	}
+
+	f := &FieldSelector{splitter: splitter}
+
+	if len(SelectFields) > 0 {
+		keep, e := ParseFieldList(SelectFields)
+		if e != nil {
+			return nil, fmt.Errorf("-select: %s", e)
+		}
+		f.keep = keep
+		return f, nil
+	}
+
+	drop, e := ParseFieldList(DropFields)
+	if e != nil {
+		return nil, fmt.Errorf("-drop-fields: %s", e)
+	}
+	f.drop = make(map[int]bool)
+	for _, i := range drop {
+		f.drop[i] = true
+	}
+	return f, nil
+}
+
+// Apply returns the line with the selected fields. It returns an error if the
+// line can not be split, or has fewer fields than -select requires.
+func (f *FieldSelector) Apply(line string) (string, error) {
+	fields, e := f.splitter.Split(line, -1)
+	if e != nil {
+		return "", e
+	}
+
+	out := []string{}
+	if f.keep != nil {
+		for _, i := range f.keep {
+			if i > len(fields) {
+				return "", fmt.Errorf("missing field %d", i)
+			}
+			out = append(out, fields[i-1])
+		}
+	} else {
+		for i := range fields {
+			if !f.drop[i+1] {
+				out = append(out, fields[i])
+			}
+		}
+	}
+	return f.splitter.Join(out...), nil
+}
@@ -0,0 +1,252 @@
+package inetdata
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/fathom6/inetdata-parsers/mtbl"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The ways of splitting a dataset into shards: by the FNV-1a hash of the key,
+// or into consecutive key ranges, which keeps the keys sharing a prefix
+// together for prefix and subdomain scans
+const SHARD_BY_HASH = "hash"
+const SHARD_BY_PREFIX = "prefix"
+
+var ShardModes = []string{SHARD_BY_HASH, SHARD_BY_PREFIX}
+
+// The extension of shard manifests, which replaces .mtbl for sharded datasets
+const SHARD_MANIFEST_EXTENSION = ".shards.json"
+
+// The version of the manifest format
+const SHARD_MANIFEST_VERSION = 1
+
+// ValidShardMode returns true if the sharding mode is supported
+func ValidShardMode(mode string) bool {
+	for i := range ShardModes {
+		if ShardModes[i] == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// ShardManifest lists the MTBL files of a sharded dataset and how keys are
+// routed to them
+type ShardManifest struct {
+	Version int         `json:"version"`
+	ShardBy string      `json:"shard_by"`
+	Shards  []ShardInfo `json:"shards"`
+
+	// The directory of the manifest, which shard paths are relative to
+	dir string
+}
+
+// ShardInfo is a shard of a manifest. The shards of a prefix manifest are in
+// key order, and each holds the keys from its start key up to the start key
+// of the next.
+type ShardInfo struct {
+	Path    string `json:"path"`
+	Start   []byte `json:"start,omitempty"`
+	Entries uint64 `json:"entries"`
+}
+
+// IsShardManifest returns true if a path names a shard manifest
+func IsShardManifest(path string) bool {
+	return strings.HasSuffix(path, SHARD_MANIFEST_EXTENSION)
+}
+
+// ShardHash returns the shard of a key in a hash manifest of n shards
+func ShardHash(key []byte, n int) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(n))
+}
+
+// ReadShardManifest reads and checks a shard manifest
+func ReadShardManifest(path string) (*ShardManifest, error) {
+	raw, e := os.ReadFile(path)
+	if e != nil {
+		return nil, e
+	}
+
+	m := &ShardManifest{}
+	if e := json.Unmarshal(raw, m); e != nil {
+		return nil, fmt.Errorf("invalid shard manifest %s: %s", path, e)
+	}
+	m.dir = filepath.Dir(path)
+
+	if m.Version != SHARD_MANIFEST_VERSION {
+		return nil, fmt.Errorf("unsupported shard manifest version %d in %s", m.Version, path)
+	}
+	if !ValidShardMode(m.ShardBy) {
+		return nil, fmt.Errorf("invalid sharding mode %q in %s", m.ShardBy, path)
+	}
+	if len(m.Shards) == 0 {
+		return nil, fmt.Errorf("shard manifest %s has no shards", path)
+	}
+	if m.ShardBy == SHARD_BY_PREFIX {
+		for i := 1; i < len(m.Shards); i++ {
+			if bytes.Compare(m.Shards[i-1].Start, m.Shards[i].Start) >= 0 {
+				return nil, fmt.Errorf("the shards of %s are not in key order", path)
+			}
+		}
+	}
+	return m, nil
+}
+
+// Write the manifest, replacing it atomically
+func (m *ShardManifest) Write(path string) error {
+	raw, e := json.MarshalIndent(m, "", "  ")
+	if e != nil {
+		return e
+	}
+
+	tmp := path + ".tmp"
+	if e := os.WriteFile(tmp, append(raw, '\n'), 0644); e != nil {
+		return e
+	}
+	return os.Rename(tmp, path)
+}
+
+// ShardPath returns the path of a shard file
+func (m *ShardManifest) ShardPath(i int) string {
+	if filepath.IsAbs(m.Shards[i].Path) {
+		return m.Shards[i].Path
+	}
+	return filepath.Join(m.dir, m.Shards[i].Path)
+}
+
+// Route returns the index of the shard that holds a key
+func (m *ShardManifest) Route(key []byte) int {
+	if m.ShardBy == SHARD_BY_HASH {
+		return ShardHash(key, len(m.Shards))
+	}
+
+	i := sort.Search(len(m.Shards), func(i int) bool {
+		return bytes.Compare(m.Shards[i].Start, key) > 0
+	})
+	if i > 0 {
+		i--
+	}
+	return i
+}
+
+// MTBLShardWriter writes records in key order to the MTBL shards of a
+// dataset and its manifest. Shard files are named after the manifest, as
+// <base>-NNNNN.mtbl.
+type MTBLShardWriter struct {
+	path      string
+	base      string
+	opt       mtbl.WriterOptions
+	count     int
+	per_shard uint64
+	writers   []*mtbl.Writer
+	m         *ShardManifest
+}
+
+// NewMTBLShardWriter returns a writer of count shards. Prefix shards are
+// filled in turn with about entries/count records each, so a prefix dataset
+// may have fewer shards if the estimate of entries is too high.
+func NewMTBLShardWriter(path string, mode string, count int, entries uint64, opt mtbl.WriterOptions) (*MTBLShardWriter, error) {
+	if !IsShardManifest(path) {
+		return nil, fmt.Errorf("the shard manifest must have the %s extension: %s", SHARD_MANIFEST_EXTENSION, path)
+	}
+	if !ValidShardMode(mode) {
+		return nil, fmt.Errorf("invalid sharding mode: %s", mode)
+	}
+	if count < 1 {
+		return nil, fmt.Errorf("invalid number of shards: %d", count)
+	}
+
+	w := &MTBLShardWriter{
+		path:      path,
+		base:      strings.TrimSuffix(path, SHARD_MANIFEST_EXTENSION),
+		opt:       opt,
+		count:     count,
+		per_shard: (entries + uint64(count) - 1) / uint64(count),
+		m:         &ShardManifest{Version: SHARD_MANIFEST_VERSION, ShardBy: mode, dir: filepath.Dir(path)},
+	}
+
+	if mode == SHARD_BY_HASH {
+		for i := 0; i < count; i++ {
+			if e := w.open(nil); e != nil {
+				w.Destroy()
+				return nil, e
+			}
+		}
+	}
+	return w, nil
+}
+
+// Start a new shard file
+func (w *MTBLShardWriter) open(start []byte) error {
+	path := fmt.Sprintf("%s-%05d.mtbl", w.base, len(w.writers))
+	os.Remove(path)
+
+	mw, e := mtbl.WriterInit(path, &w.opt)
+	if e != nil {
+		return e
+	}
+
+	w.writers = append(w.writers, mw)
+	w.m.Shards = append(w.m.Shards, ShardInfo{Path: filepath.Base(path), Start: start})
+	return nil
+}
+
+// Add a record. Records must be added in key order.
+func (w *MTBLShardWriter) Add(key []byte, val []byte) error {
+	var i int
+	if w.m.ShardBy == SHARD_BY_HASH {
+		i = ShardHash(key, w.count)
+	} else {
+		i = len(w.writers) - 1
+		if i < 0 || (w.m.Shards[i].Entries >= w.per_shard && len(w.writers) < w.count) {
+			if e := w.open(append([]byte{}, key...)); e != nil {
+				return e
+			}
+			i++
+		}
+	}
+
+	if e := w.writers[i].Add(key, val); e != nil {
+		return e
+	}
+	w.m.Shards[i].Entries++
+	return nil
+}
+
+// Paths returns the paths of the shard files written so far
+func (w *MTBLShardWriter) Paths() []string {
+	paths := []string{}
+	for i := range w.m.Shards {
+		paths = append(paths, w.m.ShardPath(i))
+	}
+	return paths
+}
+
+// Destroy closes the shard files without writing the manifest
+func (w *MTBLShardWriter) Destroy() {
+	for _, mw := range w.writers {
+		mw.Destroy()
+	}
+	w.writers = nil
+}
+
+// Close finishes the shard files and writes the manifest
+func (w *MTBLShardWriter) Close() error {
+	w.Destroy()
+
+	if len(w.m.Shards) == 0 {
+		if e := w.open(nil); e != nil {
+			return e
+		}
+		w.Destroy()
+	}
+	return w.m.Write(w.path)
+}
@@ -0,0 +1,95 @@
+package inetdata
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// EXIT_INTERRUPTED is the exit status of a tool that stopped early on SIGINT
+// or SIGTERM, after writing the records it had already read
+const EXIT_INTERRUPTED = 130
+
+var interrupted int32 = 0
+
+// HandleSignals stops a tool gracefully on SIGINT or SIGTERM. The input
+// readers stop at the next line, so the tool drains its channels and flushes
+// its outputs as if the input had ended. A second signal exits immediately.
+func HandleSignals(app string) {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-c
+		atomic.StoreInt32(&interrupted, 1)
+		Log.Infof("%s received %s, writing the records read so far (repeat to exit now)", app, sig)
+
+		<-c
+		Log.Warnf("%s exiting without finishing the output", app)
+		os.Exit(EXIT_INTERRUPTED)
+	}()
+}
+
+// Interrupted returns true once HandleSignals has received a signal
+func Interrupted() bool {
+	return atomic.LoadInt32(&interrupted) == 1
+}
+
+// DetachSignals starts a subprocess in its own process group, so that an
+// interrupt from the terminal does not kill a sort pipeline before the tool
+// has closed its input
+func DetachSignals(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// PartialMarker describes an output written by an interrupted run
+type PartialMarker struct {
+	Output      string `json:"output"`
+	Interrupted string `json:"interrupted"`
+}
+
+// Return true if a path names a local output file that can have a marker
+func localOutput(path string) bool {
+	return len(path) > 0 && path != "-" && !IsRemotePath(path)
+}
+
+// ExitIfInterrupted is called once a tool has flushed and closed its outputs.
+// After an interrupt, it writes a <path>.partial marker next to each local
+// output path and exits with EXIT_INTERRUPTED. Otherwise it removes markers
+// left by an earlier interrupted run, since the outputs are now complete.
+func ExitIfInterrupted(paths ...string) {
+	if !Interrupted() {
+		for _, path := range paths {
+			if localOutput(path) {
+				os.Remove(path + ".partial")
+			}
+		}
+		return
+	}
+
+	for _, path := range paths {
+		if !localOutput(path) {
+			continue
+		}
+
+		b, _ := json.MarshalIndent(PartialMarker{
+			Output:      path,
+			Interrupted: time.Now().UTC().Format(time.RFC3339),
+		}, "", "  ")
+
+		if e := ioutil.WriteFile(path+".partial", append(b, '\n'), 0644); e != nil {
+			Log.Warnf("Failed to write the partial marker for %s: %s", path, e)
+		}
+	}
+
+	Log.Infof("Interrupted, the output is incomplete")
+	os.Exit(EXIT_INTERRUPTED)
+}
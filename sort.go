@@ -0,0 +1,265 @@
+package inetdata
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// Approximate per-line overhead of a buffered string (header + slice slot)
+const sortLineOverhead = 24
+
+type sortRun struct {
+	name string
+	r    *bufio.Reader
+	line string
+}
+
+type sortRunHeap []*sortRun
+
+func (h sortRunHeap) Len() int            { return len(h) }
+func (h sortRunHeap) Less(i, j int) bool  { return h[i].line < h[j].line }
+func (h sortRunHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sortRunHeap) Push(x interface{}) { *h = append(*h, x.(*sortRun)) }
+func (h *sortRunHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+func (s *sortRun) next() bool {
+	line, err := s.r.ReadString('\n')
+	if len(line) > 0 && line[len(line)-1] == '\n' {
+		line = line[:len(line)-1]
+	}
+	if err != nil && len(line) == 0 {
+		return false
+	}
+	s.line = line
+	return true
+}
+
+func sortUnique(lines []string) []string {
+	sort.Strings(lines)
+	out := lines[:0]
+	for i := range lines {
+		if i > 0 && lines[i] == lines[i-1] {
+			continue
+		}
+		out = append(out, lines[i])
+	}
+	return out
+}
+
+func writeSortRun(lines []string, tmpdir string) (string, error) {
+	fd, err := ioutil.TempFile(tmpdir, "inetdata-sort-")
+	if err != nil {
+		return "", err
+	}
+
+	w := bufio.NewWriterSize(fd, 1024*1024)
+	for i := range lines {
+		if _, err = io.WriteString(w, lines[i]); err == nil {
+			err = w.WriteByte('\n')
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(fd.Name())
+		return "", err
+	}
+
+	return fd.Name(), nil
+}
+
+// ExternalSort reads lines from input and writes them to output in byte order
+// with duplicates removed, similar to `LC_ALL=C sort -u`. Once max_mem bytes
+// of input are buffered, the buffer is sorted and spilled to a temporary file
+// in tmpdir; the spilled runs are merged on completion. The output channel
+// is always closed and the input channel is always drained.
+func ExternalSort(input <-chan string, output chan<- string, tmpdir string, max_mem uint64) error {
+
+	var (
+		lines []string
+		runs  []string
+		used  uint64
+		err   error
+	)
+
+	defer close(output)
+
+	defer func() {
+		for i := range runs {
+			os.Remove(runs[i])
+		}
+	}()
+
+	for line := range input {
+		if err != nil {
+			// Keep draining the input so that the reader can finish
+			continue
+		}
+
+		lines = append(lines, line)
+		used += uint64(len(line) + sortLineOverhead)
+
+		if used < max_mem {
+			continue
+		}
+
+		name, werr := writeSortRun(sortUnique(lines), tmpdir)
+		if werr != nil {
+			err = werr
+			lines = nil
+			continue
+		}
+
+		runs = append(runs, name)
+		lines = nil
+		used = 0
+	}
+
+	if err != nil {
+		return err
+	}
+
+	lines = sortUnique(lines)
+
+	// Everything fit in memory
+	if len(runs) == 0 {
+		for i := range lines {
+			output <- lines[i]
+		}
+		return nil
+	}
+
+	if len(lines) > 0 {
+		name, werr := writeSortRun(lines, tmpdir)
+		if werr != nil {
+			return werr
+		}
+		runs = append(runs, name)
+		lines = nil
+	}
+
+	merge := []*sortRun{}
+	for i := range runs {
+		fd, oerr := os.Open(runs[i])
+		if oerr != nil {
+			return oerr
+		}
+		defer fd.Close()
+
+		merge = append(merge, &sortRun{name: runs[i], r: bufio.NewReaderSize(fd, 256*1024)})
+	}
+
+	return mergeSortRuns(merge, output, true, nil)
+}
+
+// Merge sorted runs into the output, optionally dropping duplicate lines and
+// the lines not selected by the sampler, which may be nil. The kept lines are
+// transformed by the sampler, so a -transform that rewrites keys may reorder
+// the output. An error is returned if a run is found to be out of order.
+func mergeSortRuns(runs []*sortRun, output chan<- string, unique bool, sampler *Sampler) error {
+	h := &sortRunHeap{}
+	for i := range runs {
+		if runs[i].next() {
+			*h = append(*h, runs[i])
+		}
+	}
+	heap.Init(h)
+
+	last := ""
+	first := true
+	for h.Len() > 0 {
+		run := (*h)[0]
+		if first || !unique || run.line != last {
+			keep, more := true, true
+			if sampler != nil {
+				keep, more = sampler.KeepString(run.line)
+			}
+			if keep && sampler != nil {
+				out := sampler.Transform([]byte(run.line))
+				for len(out) > 0 {
+					i := bytes.IndexByte(out, '\n')
+					output <- string(out[:i])
+					out = out[i+1:]
+				}
+			} else if keep {
+				output <- run.line
+			}
+			if !more {
+				return nil
+			}
+			last = run.line
+			first = false
+		}
+
+		prev := run.line
+		if run.next() {
+			if run.line < prev {
+				return fmt.Errorf("input is not sorted: %s", run.name)
+			}
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+
+	return nil
+}
+
+// MergeSortedInputs performs a streaming k-way merge of pre-sorted input
+// files, similar to `LC_ALL=C sort -m`. Each file is decompressed with the
+// codec (see NewInputReader) and the optional wrap function is applied to the
+// raw file stream. Duplicate lines are kept, and the merged lines are sampled
+// with the sampling flags (see NewSampler). The output channel is always
+// closed.
+func MergeSortedInputs(paths []string, codec string, wrap func(io.Reader) io.Reader, output chan<- string) error {
+
+	defer close(output)
+
+	runs := []*sortRun{}
+	for _, path := range paths {
+		fd, err := OpenPath(path)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+
+		var raw io.Reader = fd
+		if wrap != nil {
+			raw = wrap(raw)
+		}
+
+		r, err := NewInputReader(raw, codec)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		if c, ok := r.(io.Closer); ok {
+			defer c.Close()
+		}
+
+		runs = append(runs, &sortRun{name: path, r: bufio.NewReaderSize(r, 256*1024)})
+	}
+
+	return mergeSortRuns(runs, output, false, NewSampler())
+}
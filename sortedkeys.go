@@ -0,0 +1,165 @@
+package inetdata
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// SortedKeyReader reads a CSV input sorted by its first field in byte order
+// (LC_ALL=C sort -t , -k 1,1) one group of rows with the same key at a time,
+// for tools that merge two sorted inputs such as inetdata-join,
+// inetdata-csvdiff, and inetdata-zonediff. The order is checked as the input
+// is read.
+//
+// With LineOrder, the input is instead sorted and deduplicated as whole lines
+// (LC_ALL=C sort -u), as from ExternalSort: the order is checked on the lines,
+// duplicate lines are skipped, and the rows of a key are in order. Keys then
+// compare with their delimiter, see Less. With RequireValue, rows without a
+// value after the key are invalid.
+type SortedKeyReader struct {
+	Name         string
+	LineOrder    bool
+	RequireValue bool
+	next         func() (string, bool)
+	err          func() error
+	splitter     *FieldSplitter
+	key          string
+	rest         string
+	ok           bool
+	last         string
+	started      bool
+	lines        *int64
+	invalid      *int64
+}
+
+// NewSortedKeyReader returns a reader of the rows of r, split into the key and
+// the rest of the row by the splitter. The name identifies the input in
+// errors and warnings. The number of rows read, and of invalid rows, which
+// are rejected and skipped, are added to lines and invalid, if not nil.
+func NewSortedKeyReader(name string, r io.Reader, splitter *FieldSplitter, lines *int64, invalid *int64) *SortedKeyReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 8*1024*1024)
+
+	s := &SortedKeyReader{Name: name, splitter: splitter, lines: lines, invalid: invalid}
+	s.next = func() (string, bool) {
+		if !scanner.Scan() {
+			return "", false
+		}
+		return scanner.Text(), true
+	}
+	s.err = scanner.Err
+	return s
+}
+
+// NewSortedKeyLineReader is NewSortedKeyReader for the lines of a channel,
+// such as the output of ExternalSort or ReadLinesFromInputs
+func NewSortedKeyLineReader(name string, c <-chan string, splitter *FieldSplitter, lines *int64, invalid *int64) *SortedKeyReader {
+	s := &SortedKeyReader{Name: name, splitter: splitter, lines: lines, invalid: invalid}
+	s.next = func() (string, bool) {
+		line, ok := <-c
+		return line, ok
+	}
+	s.err = func() error { return nil }
+	return s
+}
+
+// Next advances to the next valid row. It returns an error if the row's key,
+// or the line with LineOrder, sorts before the previous one. At the end of
+// the input, or after a signal (see HandleSignals), Ok returns false.
+func (s *SortedKeyReader) Next() error {
+	for {
+		line, more := s.next()
+		if !more || Interrupted() {
+			break
+		}
+
+		raw := strings.TrimRight(line, "\r")
+		if len(raw) == 0 {
+			continue
+		}
+
+		if s.LineOrder && s.started {
+			if raw < s.last {
+				return fmt.Errorf("input is not sorted: %s (%q after %q)", s.Name, raw, s.last)
+			}
+			if raw == s.last {
+				continue
+			}
+		}
+		if s.LineOrder {
+			s.last = raw
+			s.started = true
+		}
+
+		if s.lines != nil {
+			atomic.AddInt64(s.lines, 1)
+		}
+
+		bits, e := s.splitter.Split(raw, 2)
+		if e != nil || len(bits[0]) == 0 || (s.RequireValue && (len(bits) < 2 || len(bits[1]) == 0)) {
+			Log.Warnf("Invalid line in %s: %q", s.Name, raw)
+			Rejects.Reject(REJECT_INVALID_LINE, raw)
+			if s.invalid != nil {
+				atomic.AddInt64(s.invalid, 1)
+			}
+			continue
+		}
+
+		if !s.LineOrder {
+			if s.started && bits[0] < s.last {
+				return fmt.Errorf("input is not sorted: %s (%q after %q)", s.Name, bits[0], s.last)
+			}
+			s.last = bits[0]
+			s.started = true
+		}
+
+		s.key = bits[0]
+		s.rest = ""
+		if len(bits) > 1 {
+			s.rest = bits[1]
+		}
+		s.ok = true
+		return nil
+	}
+
+	s.ok = false
+	return s.err()
+}
+
+// Ok reports whether the reader is at a row
+func (s *SortedKeyReader) Ok() bool {
+	return s.ok
+}
+
+// Key returns the key of the current row
+func (s *SortedKeyReader) Key() string {
+	return s.key
+}
+
+// Less reports whether the current key sorts before the current key of
+// another reader of the same order. With LineOrder, the keys are compared
+// with their delimiter, in the order of the sorted lines, since "a," sorts
+// before "a-b," but after "a!b,".
+func (s *SortedKeyReader) Less(o *SortedKeyReader) bool {
+	if s.LineOrder {
+		return s.key+s.splitter.Delimiter < o.key+o.splitter.Delimiter
+	}
+	return s.key < o.key
+}
+
+// Group reads the rest of all rows with the current key, leaving the reader
+// at the next key
+func (s *SortedKeyReader) Group() (string, []string, error) {
+	key := s.key
+	rows := []string{}
+	for s.ok && s.key == key {
+		rows = append(rows, s.rest)
+		if e := s.Next(); e != nil {
+			return key, rows, e
+		}
+	}
+	return key, rows, nil
+}
@@ -0,0 +1,133 @@
+package inetdata
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSortedKeyReader(t *testing.T) {
+	fs, e := NewFieldSplitter(",", true, "\"", "")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	input := "a,1\r\n\nb,2\nb,3,x\n,4\n\"c,d\",5\ne\n"
+	var lines, invalid int64
+	r := NewSortedKeyReader("test", strings.NewReader(input), fs, &lines, &invalid)
+
+	if e := r.Next(); e != nil {
+		t.Fatal(e)
+	}
+
+	want := []struct {
+		key  string
+		rows string
+	}{
+		{"a", "1"},
+		{"b", "2|3,x"},
+		{"c,d", "5"},
+		{"e", ""},
+	}
+	for _, w := range want {
+		if !r.Ok() || r.Key() != w.key {
+			t.Fatalf("at key %q, %v, want %q", r.Key(), r.Ok(), w.key)
+		}
+		key, rows, e := r.Group()
+		if e != nil {
+			t.Fatal(e)
+		}
+		if key != w.key || strings.Join(rows, "|") != w.rows {
+			t.Errorf("group %q has rows %q, want %q", key, rows, w.rows)
+		}
+	}
+	if r.Ok() {
+		t.Errorf("the reader is at key %q after the last row", r.Key())
+	}
+
+	// The row without a key is rejected, and blank lines are not counted
+	if lines != 6 || invalid != 1 {
+		t.Errorf("read %d lines and %d invalid, want 6 and 1", lines, invalid)
+	}
+}
+
+func TestSortedKeyReaderOrder(t *testing.T) {
+	fs, e := NewFieldSplitter(",", false, "\"", "")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	r := NewSortedKeyReader("unsorted.csv", strings.NewReader("a,1\nc,2\nc,3\nb,4\n"), fs, nil, nil)
+	if e := r.Next(); e != nil {
+		t.Fatal(e)
+	}
+	if _, _, e := r.Group(); e != nil {
+		t.Fatal(e)
+	}
+
+	// The error is returned with the rows of the key read so far
+	key, rows, e := r.Group()
+	if e == nil || !strings.Contains(e.Error(), "unsorted.csv") {
+		t.Errorf("read an unsorted input, error %v", e)
+	}
+	if key != "c" || len(rows) != 2 {
+		t.Errorf("group %q has rows %q", key, rows)
+	}
+}
+
+func TestSortedKeyReaderLineOrder(t *testing.T) {
+	fs, e := NewFieldSplitter(",", false, "\"", "")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// Sorted as whole lines, "a!b," sorts before "a," and "a," before "a-b,"
+	read := func(lines ...string) *SortedKeyReader {
+		c := make(chan string, len(lines))
+		for _, line := range lines {
+			c <- line
+		}
+		close(c)
+		r := NewSortedKeyLineReader("zone", c, fs, nil, nil)
+		r.LineOrder = true
+		r.RequireValue = true
+		if e := r.Next(); e != nil {
+			t.Fatal(e)
+		}
+		return r
+	}
+
+	var invalid int64
+	old := read("a!b,a,1", "a,a,1", "a,a,1", "a,a,2", "a-b,a,1", "b")
+	cur := read("a,a,1", "a-b,a,2")
+	old.invalid = &invalid
+
+	if !old.Less(cur) || cur.Less(old) {
+		t.Errorf("%q and %q are not in line order", old.Key(), cur.Key())
+	}
+	if _, _, e := old.Group(); e != nil {
+		t.Fatal(e)
+	}
+
+	// Duplicate lines are skipped
+	key, rows, e := old.Group()
+	if e != nil || key != "a" || strings.Join(rows, "|") != "a,1|a,2" {
+		t.Errorf("group %q has rows %q, %v", key, rows, e)
+	}
+	if _, _, e := cur.Group(); e != nil {
+		t.Fatal(e)
+	}
+	if old.Less(cur) || cur.Less(old) || old.Key() != "a-b" {
+		t.Errorf("at keys %q and %q", old.Key(), cur.Key())
+	}
+
+	// The line without a value is invalid
+	if _, _, e := old.Group(); e != nil || old.Ok() || invalid != 1 {
+		t.Errorf("read %d invalid lines, %v", invalid, e)
+	}
+
+	// The order is checked on the lines rather than the keys
+	r := read("a,a,2", "a,a,1")
+	if _, _, e := r.Group(); e == nil {
+		t.Error("read lines that are out of order")
+	}
+}
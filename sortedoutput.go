@@ -0,0 +1,91 @@
+package inetdata
+
+import (
+	"bufio"
+	"io"
+	"sync/atomic"
+)
+
+// SortedOutput is an output file whose lines are sorted and deduplicated
+// with ExternalSort before they are compressed and written, for tools that
+// split one input into several sorted CSVs. Add may be called concurrently.
+type SortedOutput struct {
+	Path  string
+	c     chan string
+	fd    io.WriteCloser
+	out   io.WriteCloser
+	buf   *bufio.Writer
+	done  chan error
+	count *int64
+}
+
+// NewSortedOutput creates the output path, compressed with the codec, and
+// starts its sorter, which spills to tmpdir once max_mem bytes of lines are
+// buffered. The number of lines written is added to count, if not nil.
+func NewSortedOutput(path string, codec string, level int, tmpdir string, max_mem uint64, count *int64) (*SortedOutput, error) {
+	fd, e := CreateOutput(path)
+	if e != nil {
+		return nil, e
+	}
+
+	out, e := NewOutputWriter(fd, codec, level)
+	if e != nil {
+		fd.Close()
+		return nil, e
+	}
+
+	s := &SortedOutput{
+		Path:  path,
+		c:     make(chan string, QueueDepth),
+		fd:    fd,
+		out:   out,
+		buf:   bufio.NewWriterSize(out, 256*1024),
+		done:  make(chan error, 1),
+		count: count,
+	}
+
+	sorted := make(chan string, QueueDepth)
+	sort_err := make(chan error, 1)
+	go func() {
+		sort_err <- ExternalSort(s.c, sorted, tmpdir, max_mem)
+	}()
+	go func() {
+		var err error
+		for line := range sorted {
+			if err != nil {
+				continue
+			}
+			if _, err = s.buf.WriteString(line + "\n"); err == nil && s.count != nil {
+				atomic.AddInt64(s.count, 1)
+			}
+		}
+		if se := <-sort_err; se != nil {
+			err = se
+		}
+		s.done <- err
+	}()
+
+	return s, nil
+}
+
+// Add queues a line, without its line ending, for the output
+func (s *SortedOutput) Add(line string) {
+	s.c <- line
+}
+
+// Close ends the input of the sorter, waits for the sorted lines to be
+// written, and closes the output file
+func (s *SortedOutput) Close() error {
+	close(s.c)
+	e := <-s.done
+	if fe := s.buf.Flush(); e == nil {
+		e = fe
+	}
+	if ce := s.out.Close(); e == nil {
+		e = ce
+	}
+	if ce := s.fd.Close(); e == nil {
+		e = ce
+	}
+	return e
+}
@@ -0,0 +1,112 @@
+package inetdata
+
+import (
+	"fmt"
+	"github.com/fathom6/inetdata-parsers/pipeline"
+	"io"
+	"strings"
+)
+
+func init() {
+	for _, scheme := range []string{"kafka", "es", "clickhouse", "postgres", "postgresql", "redis", "rediss"} {
+		pipeline.Register(scheme, pipeline.Scheme{Open: OpenStream, Create: CreateStream})
+	}
+	for _, scheme := range []string{"s3", "gs"} {
+		pipeline.Register(scheme, pipeline.Scheme{Open: OpenObject, Create: CreateObject})
+	}
+}
+
+// IsStreamURL returns true if the path names a stream, such as a Kafka topic,
+// an Elasticsearch index, a ClickHouse or Postgres table, or a Redis keyspace,
+// rather than a local file
+func IsStreamURL(path string) bool {
+	return strings.HasPrefix(path, "kafka://") || strings.HasPrefix(path, "es://") ||
+		strings.HasPrefix(path, "clickhouse://") || IsPostgresURL(path) || IsRedisURL(path)
+}
+
+// OpenStream opens a stream URL for reading
+func OpenStream(path string) (io.ReadCloser, error) {
+	switch {
+	case strings.HasPrefix(path, "es://"):
+		return nil, fmt.Errorf("elasticsearch can only be used as an output: %s", path)
+	case strings.HasPrefix(path, "clickhouse://"):
+		return nil, fmt.Errorf("clickhouse can only be used as an output: %s", path)
+	case IsPostgresURL(path):
+		return nil, fmt.Errorf("postgres can only be used as an output: %s", path)
+	case IsRedisURL(path):
+		return nil, fmt.Errorf("redis can only be used as an output: %s", path)
+	}
+
+	u, e := ParseKafkaURL(path)
+	if e != nil {
+		return nil, e
+	}
+	return NewKafkaReader(u), nil
+}
+
+// CreateStream opens a stream URL for writing
+func CreateStream(path string) (io.WriteCloser, error) {
+	if strings.HasPrefix(path, "es://") {
+		u, e := ParseElasticsearchURL(path)
+		if e != nil {
+			return nil, e
+		}
+		return NewElasticsearchWriter(u), nil
+	}
+
+	if strings.HasPrefix(path, "clickhouse://") {
+		u, e := ParseClickHouseURL(path)
+		if e != nil {
+			return nil, e
+		}
+		return NewClickHouseWriter(u)
+	}
+
+	if IsPostgresURL(path) {
+		u, e := ParsePostgresURL(path)
+		if e != nil {
+			return nil, e
+		}
+		return NewPostgresWriter(u)
+	}
+
+	if IsRedisURL(path) {
+		u, e := ParseRedisURL(path)
+		if e != nil {
+			return nil, e
+		}
+		return NewRedisWriter(u)
+	}
+
+	u, e := ParseKafkaURL(path)
+	if e != nil {
+		return nil, e
+	}
+	return NewKafkaWriter(u), nil
+}
+
+// IsRemotePath returns true if the path is a URL with a registered scheme,
+// such as a stream or object URL, see pipeline.Register
+func IsRemotePath(path string) bool {
+	return pipeline.IsURL(path)
+}
+
+// OpenPath opens a local file or URL for reading, see pipeline.Open
+func OpenPath(path string) (io.ReadCloser, error) {
+	return pipeline.Open(path)
+}
+
+// CreateOutput opens the output for a tool: stdout when the path is empty or
+// "-", a stream or object for a URL, and otherwise a new file. Files and stdout
+// are buffered, see AddOutputFlags.
+func CreateOutput(path string) (io.WriteCloser, error) {
+	w, e := pipeline.Create(path)
+	if e != nil {
+		return nil, e
+	}
+
+	if !bufferedOutputPath(path) {
+		return w, nil
+	}
+	return NewBufferedOutput(w, OutputBuffer, FlushInterval, FsyncOnClose), nil
+}
@@ -0,0 +1,113 @@
+package inetdata
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// The number of counters a TopK keeps for each item it reports, more
+// counters make the counts of the top items more accurate
+const TOPK_CAPACITY_FACTOR = 10
+
+// TopKItem is a heavy hitter with its estimated count. The count may be
+// overestimated by up to Error, but never underestimated.
+type TopKItem struct {
+	Item  string
+	Count int64
+	Error int64
+	index int
+}
+
+// TopK finds the most frequent items of a stream in one pass and bounded
+// memory with the Space-Saving algorithm: once all counters are in use, a new
+// item replaces the item with the lowest count and inherits its count. A TopK
+// is not safe for concurrent use.
+type TopK struct {
+	n     int
+	items map[string]*TopKItem
+	h     topKHeap
+}
+
+// NewTopK returns a TopK that reports the top n items, using
+// n*TOPK_CAPACITY_FACTOR counters
+func NewTopK(n int) *TopK {
+	return &TopK{n: n, items: make(map[string]*TopKItem)}
+}
+
+// Add n to the count of an item
+func (t *TopK) Add(item string, n int64) {
+	if e, ok := t.items[item]; ok {
+		e.Count += n
+		heap.Fix(&t.h, e.index)
+		return
+	}
+
+	if len(t.h) < t.n*TOPK_CAPACITY_FACTOR {
+		e := &TopKItem{Item: item, Count: n}
+		t.items[item] = e
+		heap.Push(&t.h, e)
+		return
+	}
+
+	// Replace the item with the lowest count
+	e := t.h[0]
+	delete(t.items, e.Item)
+	e.Item = item
+	e.Error = e.Count
+	e.Count += n
+	t.items[item] = e
+	heap.Fix(&t.h, 0)
+}
+
+// Top returns up to n items, highest count first
+func (t *TopK) Top() []TopKItem {
+	return TopKItems(t.Items(), t.n)
+}
+
+// Items returns all counted items, in no particular order
+func (t *TopK) Items() []TopKItem {
+	items := make([]TopKItem, 0, len(t.h))
+	for _, e := range t.h {
+		items = append(items, *e)
+	}
+	return items
+}
+
+// TopKItems returns up to n items, highest count first. Ties are ordered by
+// item so that the output is stable. It combines the items of several TopKs
+// that counted disjoint items, such as hash partitions of a stream.
+func TopKItems(items []TopKItem, n int) []TopKItem {
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Count != items[j].Count {
+			return items[i].Count > items[j].Count
+		}
+		return items[i].Item < items[j].Item
+	})
+	if len(items) > n {
+		items = items[:n]
+	}
+	return items
+}
+
+// A min-heap of counters by count
+type topKHeap []*TopKItem
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *topKHeap) Push(x interface{}) {
+	e := x.(*TopKItem)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *topKHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
@@ -0,0 +1,148 @@
+package inetdata
+
+import (
+	"fmt"
+	"github.com/fathom6/inetdata-parsers/pipeline"
+	"strconv"
+	"strings"
+)
+
+// TransformScript is the -transform script or plugin applied to the lines
+// that the sampling flags keep, see NewInputTransformer
+var TransformScript = ""
+
+// The prefix of -transform values that name a registered transformer
+const TRANSFORM_PLUGIN_PREFIX = "plugin:"
+
+func init() {
+	pipeline.RegisterTransformer("script", NewScriptTransformer)
+	pipeline.RegisterTransformer("lower", func(arg string) (pipeline.Transformer, error) {
+		return pipeline.TransformFunc(func(rec []byte) ([][]byte, error) {
+			return [][]byte{[]byte(strings.ToLower(string(rec)))}, nil
+		}), nil
+	})
+}
+
+// NewInputTransformer returns the transformer of the -transform flag, or nil
+// if it is not set. Values of the form plugin:<name>[:<arg>] create a
+// transformer registered with pipeline.RegisterTransformer, anything else is
+// a script, see NewScriptTransformer.
+func NewInputTransformer() (pipeline.Transformer, error) {
+	if len(TransformScript) == 0 {
+		return nil, nil
+	}
+	if strings.HasPrefix(TransformScript, TRANSFORM_PLUGIN_PREFIX) {
+		t, e := pipeline.NewTransformer(TransformScript[len(TRANSFORM_PLUGIN_PREFIX):])
+		if e != nil {
+			return nil, fmt.Errorf("-transform: %s", e)
+		}
+		return t, nil
+	}
+	t, e := NewScriptTransformer(TransformScript)
+	if e != nil {
+		return nil, fmt.Errorf("-transform: %s", e)
+	}
+	return t, nil
+}
+
+// A target = expression statement of a script
+type scriptAssignment struct {
+	target string
+	field  int
+	expr   filterNode
+}
+
+// NewScriptTransformer compiles a script of ;-separated assignments, such as
+// 'key = lower(key); value = regsub(value, ":[0-9]+$", "")', that rewrite
+// each line in order. The targets are key, value, line, and fN (the Nth
+// field), and the expressions are those of -filter, see parseFilterExpr.
+// Lines are split on -key-delimiter.
+func NewScriptTransformer(script string) (pipeline.Transformer, error) {
+	toks, e := tokenizeFilter(script)
+	if e != nil {
+		return nil, e
+	}
+
+	assignments := []scriptAssignment{}
+	for len(toks) > 0 {
+		end := 0
+		depth := 0
+		for end < len(toks) && (toks[end] != ";" || depth > 0) {
+			switch toks[end] {
+			case "(":
+				depth++
+			case ")":
+				depth--
+			}
+			end++
+		}
+		stmt := toks[:end]
+		if end < len(toks) {
+			end++
+		}
+		toks = toks[end:]
+
+		if len(stmt) == 0 {
+			continue
+		}
+		if len(stmt) < 3 || stmt[1] != "=" {
+			return nil, fmt.Errorf("expected <target> = <expression>, not %q", strings.Join(stmt, " "))
+		}
+
+		a := scriptAssignment{target: stmt[0]}
+		switch {
+		case a.target == "key" || a.target == "value" || a.target == "line":
+		case a.target[0] == 'f' && len(a.target) > 1:
+			i, e := strconv.Atoi(a.target[1:])
+			if e != nil || i < 1 {
+				return nil, fmt.Errorf("unknown target %q", a.target)
+			}
+			a.target, a.field = "field", i
+		default:
+			return nil, fmt.Errorf("unknown target %q", a.target)
+		}
+
+		p := &filterParser{toks: stmt[2:]}
+		if a.expr, e = p.parseOr(); e != nil {
+			return nil, e
+		}
+		if p.pos < len(p.toks) {
+			return nil, fmt.Errorf("unexpected %q", p.toks[p.pos])
+		}
+		assignments = append(assignments, a)
+	}
+
+	if len(assignments) == 0 {
+		return nil, fmt.Errorf("empty script")
+	}
+
+	delimiter := KeyDelimiter
+	return pipeline.TransformFunc(func(rec []byte) ([][]byte, error) {
+		line := string(rec)
+		for _, a := range assignments {
+			r := newFilterRecord(line, delimiter, nil)
+			v := toString(a.expr.eval(&r))
+
+			switch a.target {
+			case "line":
+				line = v
+			case "key":
+				if i := strings.Index(line, delimiter); i >= 0 {
+					line = v + line[i:]
+				} else {
+					line = v
+				}
+			case "value":
+				line = r.key + delimiter + v
+			case "field":
+				fields := strings.Split(line, delimiter)
+				for len(fields) < a.field {
+					fields = append(fields, "")
+				}
+				fields[a.field-1] = v
+				line = strings.Join(fields, delimiter)
+			}
+		}
+		return [][]byte{[]byte(line)}, nil
+	}), nil
+}
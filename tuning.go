@@ -0,0 +1,64 @@
+package inetdata
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+)
+
+// Workers is the number of parallel workers, such as parsers and compressors
+var Workers = runtime.NumCPU()
+
+// QueueDepth is the capacity of the channels between the stages of a tool
+var QueueDepth = 1000
+
+// ReaderBuffer is the size in bytes of the buffer used to read each input
+var ReaderBuffer = 50000
+
+// The smallest reader buffer, which still fits any common line
+const MIN_READER_BUFFER = 4096
+
+// Return the value of an integer environment variable, or the default if it
+// is unset or not a number
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if len(v) == 0 {
+		return def
+	}
+
+	i, e := strconv.Atoi(v)
+	if e != nil {
+		Log.Warnf("Ignoring %s, not a number: %q", name, v)
+		return def
+	}
+	return i
+}
+
+// AddTuningFlags registers the -workers, -queue-depth, and -reader-buffer
+// flags. Their defaults may be overridden with the INETDATA_WORKERS,
+// INETDATA_QUEUE_DEPTH, and INETDATA_READER_BUFFER environment variables,
+// while a flag on the command line takes precedence over both.
+func AddTuningFlags() {
+	flag.IntVar(&Workers, "workers", envInt("INETDATA_WORKERS", Workers), "The number of parallel workers and CPUs to use (env: INETDATA_WORKERS)")
+	flag.IntVar(&QueueDepth, "queue-depth", envInt("INETDATA_QUEUE_DEPTH", QueueDepth), "The number of records buffered between stages (env: INETDATA_QUEUE_DEPTH)")
+	flag.IntVar(&ReaderBuffer, "reader-buffer", envInt("INETDATA_READER_BUFFER", ReaderBuffer), "The size in bytes of the input read buffer (env: INETDATA_READER_BUFFER)")
+}
+
+// ApplyTuning validates the tuning flags after they are parsed and limits
+// the process to -workers CPUs
+func ApplyTuning() error {
+	if Workers < 1 {
+		return fmt.Errorf("-workers must be at least 1")
+	}
+	if QueueDepth < 0 {
+		return fmt.Errorf("-queue-depth must not be negative")
+	}
+	if ReaderBuffer < MIN_READER_BUFFER {
+		return fmt.Errorf("-reader-buffer must be at least %d", MIN_READER_BUFFER)
+	}
+
+	runtime.GOMAXPROCS(Workers)
+	return nil
+}
@@ -3,99 +3,129 @@ package inetdata
 import (
 	"bufio"
 	"fmt"
-	"github.com/fathom6/golang-mtbl"
+	"github.com/fathom6/inetdata-parsers/dnsname"
+	"github.com/fathom6/inetdata-parsers/linereader"
+	"github.com/fathom6/inetdata-parsers/mtbl"
 	"io"
 	"os"
 	"regexp"
+	"strconv"
+	"strings"
 )
 
 var Match_SHA1 = regexp.MustCompile(`^[a-zA-Z0-9]{40}$`)
 
+// MTBL_COMPRESSION_ZSTD mirrors the libmtbl enum value (libmtbl 1.1+), which
+// the Go bindings do not export
+const MTBL_COMPRESSION_ZSTD = 5
+
 var MTBLCompressionTypes = map[string]int{
 	"none":   mtbl.COMPRESSION_NONE,
 	"snappy": mtbl.COMPRESSION_SNAPPY,
 	"zlib":   mtbl.COMPRESSION_ZLIB,
 	"lz4":    mtbl.COMPRESSION_LZ4,
 	"lz4hc":  mtbl.COMPRESSION_LZ4HC,
+	"zstd":   MTBL_COMPRESSION_ZSTD,
 }
 
 var Split_WS = regexp.MustCompile(`\s+`)
 
+// LinePool holds the line buffers of ReadLineBytesFromInputs
+var LinePool = linereader.NewPool()
+
 func PrintVersion(app string) {
 	fmt.Fprintf(os.Stderr, "%s v%s\n", app, Version)
 }
 
-func ReverseKey(s string) string {
-	b := make([]byte, len(s))
-	var j int = len(s) - 1
-	for i := 0; i <= j; i++ {
-		b[j-i] = s[i]
+// UnescapeDelimiter interprets Go escape sequences (\t, \x00, etc) in a
+// delimiter supplied on the command line, returning the input unchanged
+// if it can not be unquoted.
+func UnescapeDelimiter(s string) string {
+	if u, e := strconv.Unquote(`"` + s + `"`); e == nil {
+		return u
 	}
-	return string(b)
+	return s
+}
+
+// ParseFieldList converts a comma-separated list of one-based field indexes
+// (such as "2,4,3") into a slice of indexes in the order specified.
+func ParseFieldList(s string) ([]int, error) {
+	fields := []int{}
+	for _, bit := range strings.Split(s, ",") {
+		bit = strings.TrimSpace(bit)
+		if len(bit) == 0 {
+			continue
+		}
+		idx, e := strconv.Atoi(bit)
+		if e != nil || idx < 1 {
+			return nil, fmt.Errorf("invalid field index: %q", bit)
+		}
+		fields = append(fields, idx)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty field list: %q", s)
+	}
+	return fields, nil
+}
+
+// ReverseKey reverses the bytes of a name, see dnsname.Reverse
+func ReverseKey(s string) string {
+	return dnsname.Reverse(s)
+}
+
+// ReverseLabels reverses the label order of a domain name, see
+// dnsname.ReverseLabels
+func ReverseLabels(s string) string {
+	return dnsname.ReverseLabels(s)
 }
 
 func ReadLines(input *os.File, out chan<- string) error {
-	var (
-		frontbufferSize = 50000
-		r               = bufio.NewReaderSize(input, frontbufferSize)
-	)
-	return ReadLinesFromReader(r, out)
+	r := bufio.NewReaderSize(input, ReaderBuffer)
+	return readLines(r, out, true)
+}
+
+// ReadLinesCompressed decompresses the input with the specified codec (see
+// NewInputReader) before splitting it into lines.
+func ReadLinesCompressed(input io.Reader, codec string, out chan<- string) error {
+	r, err := NewInputReader(input, codec)
+	if err != nil {
+		close(out)
+		return err
+	}
+	return readLines(r, out, true)
 }
 
 func ReadLinesFromReader(input io.Reader, out chan<- string) error {
+	return readLines(input, out, false)
+}
 
-	var (
-		backbufferSize  = 200000
-		frontbufferSize = 50000
-		r               = bufio.NewReaderSize(input, frontbufferSize)
-		buf             []byte
-		pred            []byte
-		err             error
-	)
-
-	if backbufferSize <= frontbufferSize {
-		backbufferSize = (frontbufferSize / 3) * 4
+// Split the input into lines. An interruptible input stops at the next line
+// after a signal, see HandleSignals.
+func readLines(input io.Reader, out chan<- string, interruptible bool) error {
+	r := linereader.NewReader(input, ReaderBuffer)
+	if interruptible {
+		r.Stop = Interrupted
 	}
 
-	for {
-		buf, err = r.ReadSlice('\n')
-
-		if err == bufio.ErrBufferFull {
-			if len(buf) == 0 {
-				continue
-			}
-
-			if pred == nil {
-				pred = make([]byte, len(buf), backbufferSize)
-				copy(pred, buf)
-			} else {
-				pred = append(pred, buf...)
-			}
-			continue
-		} else if err == io.EOF && len(buf) == 0 && len(pred) == 0 {
-			break
-		}
-
-		if len(pred) > 0 {
-			buf, pred = append(pred, buf...), pred[:0]
-		}
+	defer close(out)
 
-		if len(buf) > 0 && buf[len(buf)-1] == '\n' {
-			buf = buf[:len(buf)-1]
+	for {
+		buf, err := r.Scan()
+		if err == io.EOF {
+			return nil
 		}
-
-		if len(buf) == 0 {
-			continue
+		if err != nil {
+			return err
 		}
-
 		out <- string(buf)
 	}
+}
 
-	close(out)
-
-	if err != nil && err != io.EOF {
-		return err
+// Split the input into pooled lines, see linereader.Reader.Send
+func readLineBytes(input io.Reader, out chan<- *linereader.Line, interruptible bool) error {
+	r := linereader.NewReader(input, ReaderBuffer)
+	if interruptible {
+		r.Stop = Interrupted
 	}
-
-	return nil
+	return r.Send(LinePool, out)
 }